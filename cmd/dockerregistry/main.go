@@ -2,10 +2,8 @@ package main
 
 import (
 	"flag"
-	"fmt"
+	"io"
 	"math/rand"
-	"net/http"
-	_ "net/http/pprof"
 	"os"
 	"runtime"
 	"time"
@@ -16,6 +14,7 @@ import (
 	"github.com/openshift/library-go/pkg/serviceability"
 
 	"github.com/openshift/image-registry/pkg/cmd/dockerregistry"
+	registryconfig "github.com/openshift/image-registry/pkg/dockerregistry/server/configuration"
 	"github.com/openshift/image-registry/pkg/version"
 )
 
@@ -62,53 +61,55 @@ func main() {
 
 	defer serviceability.BehaviorOnPanic(os.Getenv("OPENSHIFT_ON_PANIC"), version.Get())()
 	defer serviceability.Profile(os.Getenv("OPENSHIFT_PROFILE")).Stop()
-	startProfiler()
 
 	rand.Seed(time.Now().UTC().UnixNano())
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
+	args := flag.Args()
+
+	// The subcommands have their own flags, which are followed by the
+	// configuration path.
+	checkPullthroughNamespace := ""
+	if len(args) > 0 && args[0] == dockerregistry.CheckPullthroughCommand {
+		checkPullthroughNamespace, args = dockerregistry.ParseCheckPullthroughArgs(args[1:])
+	}
+
 	// TODO convert to flags instead of a config file?
 	configurationPath := ""
-	if flag.NArg() > 0 {
-		configurationPath = flag.Arg(0)
+	if len(args) > 0 {
+		configurationPath = args[0]
 	}
 	if configurationPath == "" {
 		configurationPath = os.Getenv("REGISTRY_CONFIGURATION_PATH")
 	}
 
-	if configurationPath == "" {
-		fmt.Println("configuration path unspecified")
-		os.Exit(1)
-	}
 	// Prevent a warning about unrecognized environment variable
 	if err := os.Unsetenv("REGISTRY_CONFIGURATION_PATH"); err != nil {
 		log.Fatalf("Unable to unset REGISTRY_CONFIGURATION_PATH: %v", err)
 	}
 
-	configFile, err := os.Open(configurationPath)
-	if err != nil {
-		log.Fatalf("Unable to open configuration file: %s", err)
+	var configFile io.Reader
+	if configurationPath == "" {
+		// Without a configuration file the registry is configured only by
+		// the environment variables.
+		log.Infof("configuration path unspecified, using the default configuration")
+		var err error
+		configFile, err = registryconfig.DefaultConfiguration()
+		if err != nil {
+			log.Fatalf("Unable to create the default configuration: %s", err)
+		}
+	} else {
+		f, err := os.Open(configurationPath)
+		if err != nil {
+			log.Fatalf("Unable to open configuration file: %s", err)
+		}
+		configFile = f
 	}
 
-	dockerregistry.Execute(configFile)
-}
-
-func env(key string, defaultValue string) string {
-	val := os.Getenv(key)
-	if len(val) == 0 {
-		return defaultValue
+	if len(checkPullthroughNamespace) > 0 {
+		dockerregistry.ExecuteCheckPullthrough(configFile, checkPullthroughNamespace)
+		return
 	}
-	return val
-}
 
-func startProfiler() {
-	if env("OPENSHIFT_PROFILE", "") == "web" {
-		go func() {
-			runtime.SetBlockProfileRate(1)
-			profilePort := env("OPENSHIFT_PROFILE_PORT", "6060")
-			profileHost := env("OPENSHIFT_PROFILE_HOST", "127.0.0.1")
-			log.Infof(fmt.Sprintf("Starting profiling endpoint at http://%s:%s/debug/pprof/", profileHost, profilePort))
-			log.Fatal(http.ListenAndServe(fmt.Sprintf("%s:%s", profileHost, profilePort), nil))
-		}()
-	}
+	dockerregistry.Execute(configFile)
 }
@@ -0,0 +1,120 @@
+package dockerregistry
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/distribution/distribution/v3/configuration"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server"
+	registryconfig "github.com/openshift/image-registry/pkg/dockerregistry/server/configuration"
+)
+
+// CheckPullthroughCommand is the subcommand that checks the remote
+// repositories of a namespace.
+const CheckPullthroughCommand = "check-pullthrough"
+
+// ParseCheckPullthroughArgs parses the flags of the check-pullthrough
+// subcommand. It returns the namespace and the remaining arguments.
+func ParseCheckPullthroughArgs(args []string) (string, []string) {
+	fs := flag.NewFlagSet(CheckPullthroughCommand, flag.ExitOnError)
+	namespace := fs.String("namespace", "", "the namespace whose image streams are checked")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: dockerregistry %s -namespace <namespace> [config.yml]\n\n", CheckPullthroughCommand)
+		fmt.Fprintf(fs.Output(), "Request the manifests of the image streams of the namespace from their remote registries and mirrors with the pullthrough credentials.\n\n")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if len(*namespace) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	return *namespace, fs.Args()
+}
+
+// ExecuteCheckPullthrough checks that the registry can pull through the
+// images of the image streams of namespace, and prints a report for every
+// remote registry. The process exits with a non-zero status if a check
+// fails.
+func ExecuteCheckPullthrough(configFile io.Reader, namespace string) {
+	config, extraConfig, err := registryconfig.Parse(configFile)
+	if err != nil {
+		log.Fatalf("error parsing configuration file: %s", err)
+	}
+
+	// The report is printed to the standard output, the registry logs are
+	// needed only for warnings.
+	config.Loglevel = ""
+	config.Log.Level = configuration.Loglevel(os.Getenv("REGISTRY_LOG_LEVEL"))
+	if len(config.Log.Level) == 0 {
+		config.Log.Level = "warning"
+	}
+
+	ctx := context.Background()
+	ctx, err = configureLogging(ctx, config)
+	if err != nil {
+		log.Fatalf("error configuring logging: %s", err)
+	}
+
+	registryClient, err := newRegistryClient(extraConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	report, err := server.CheckPullthrough(ctx, registryClient, extraConfig, namespace)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	printPullthroughReport(os.Stdout, report)
+	if !report.Passed {
+		os.Exit(1)
+	}
+}
+
+// printPullthroughReport writes the results of report grouped by registry.
+func printPullthroughReport(w io.Writer, report *server.PullthroughCheckReport) {
+	if len(report.Results) == 0 {
+		fmt.Fprintf(w, "The image streams of the namespace %s don't reference remote registries\n", report.Namespace)
+		return
+	}
+
+	registry := ""
+	for _, result := range report.Results {
+		if result.Registry != registry {
+			if len(registry) > 0 {
+				fmt.Fprintln(w)
+			}
+			registry = result.Registry
+			fmt.Fprintln(w, registry)
+		}
+
+		status := "OK"
+		if len(result.Error) > 0 {
+			status = "FAILED"
+		}
+		fmt.Fprintf(w, "  %-6s %s", status, result.Repository)
+		if len(result.MirrorOf) > 0 {
+			fmt.Fprintf(w, " (mirror of %s)", result.MirrorOf)
+		}
+		fmt.Fprintln(w)
+
+		credentials := "none"
+		if result.HasCredentials {
+			credentials = "found"
+			if len(result.PullSecret) > 0 {
+				credentials += " in the secret " + result.PullSecret
+			}
+		}
+		fmt.Fprintf(w, "         manifest: %s, credentials: %s, insecure: %t\n", result.Reference, credentials, result.Insecure)
+		fmt.Fprintf(w, "         image streams: %s\n", strings.Join(result.ImageStreams, ", "))
+		if len(result.Error) > 0 {
+			fmt.Fprintf(w, "         error: %s\n", result.Error)
+		}
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -40,23 +41,36 @@ import (
 	"github.com/openshift/library-go/pkg/crypto"
 
 	"github.com/openshift/image-registry/pkg/dockerregistry/server"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/accesslog"
 	"github.com/openshift/image-registry/pkg/dockerregistry/server/audit"
 	"github.com/openshift/image-registry/pkg/dockerregistry/server/client"
 	registryconfig "github.com/openshift/image-registry/pkg/dockerregistry/server/configuration"
 	"github.com/openshift/image-registry/pkg/dockerregistry/server/maxconnections"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/metrics"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/traffic"
 	"github.com/openshift/image-registry/pkg/origin-common/clientcmd"
 	"github.com/openshift/image-registry/pkg/version"
 )
 
 var (
 	experimental            = flag.Bool("experimental", false, "enable experimental features")
-	pruneMode               = flag.String("prune", "", "prune blobs from the storage and exit (check, delete)")
+	pruneMode               = flag.String("prune", "", "prune blobs from the storage and exit (check, delete, plan, apply)")
+	prunePlan               = flag.String("prune-plan", "", "the file with the prune plan that is written by -prune=plan and executed by -prune=apply")
+	pruneKeepRunning        = flag.Bool("prune-keep-running", false, "keep the images of the pods of all namespaces when pruning, even if they are deleted from the API (requires the permission to list pods)")
+	pruneKeepList           = flag.String("prune-keep-list", "", "the file with the digests or image references by digest that are kept when pruning, one per line")
+	pruneOrphanedImages     = flag.Duration("prune-orphaned-images", 0, "delete the images that are pushed by digest, but not tagged into image streams, if they are older than the duration, before pruning blobs (requires the permission to delete images)")
 	restoreMode             = flag.String("restore-mode", "", "check data corruption or recover storage data if possible (valid values: check, check-database, check-storage, recover)")
 	restoreNamespace        = flag.String("restore-namespace", "", "check and recover only specified namespace")
 	listRepositories        = flag.Bool("list-repositories", false, "shows list of repositories")
 	listBlobs               = flag.Bool("list-blobs", false, "shows list of blob digests stored in the storage")
 	listManifests           = flag.Bool("list-manifests", false, "shows list of manifest digests stored in the storage")
 	listRepositoryManifests = flag.String("list-manifests-from", "", "shows the manifest digests in the specified repository")
+	selfCheckOnly           = flag.Bool("self-check-only", false, "run the startup self-check and exit with a non-zero status if it fails")
+	selfCheckReport         = flag.String("self-check-report", "", "the file where the JSON report of the startup self-check is written")
+	loadgenProfile          = flag.String("loadgen-profile", "", "replay the pulls of the traffic recorded by openshift.trafficrecording against -loadgen-target and exit")
+	loadgenTarget           = flag.String("loadgen-target", "", "the base URL of the registry that the recorded traffic is replayed against")
+	loadgenConcurrency      = flag.Int("loadgen-concurrency", 1, "the number of recorded requests that are replayed at the same time")
+	loadgenTokenFile        = flag.String("loadgen-token-file", "", "the file with the bearer token that is sent with the replayed requests")
 )
 
 func versionFields() map[interface{}]interface{} {
@@ -95,10 +109,38 @@ func optionsConflict() error {
 		}
 	}
 
+	if *selfCheckOnly && (listOpts.Repositories || listOpts.Blobs || listOpts.Manifests || len(*pruneMode) > 0 || len(*restoreMode) > 0) {
+		return fmt.Errorf("option -self-check-only can't be used with -list-repositories, -list-blobs, -list-manifests, -list-manifests-from, -prune and -restore-mode")
+	}
+
+	if len(*loadgenProfile) > 0 && (listOpts.Repositories || listOpts.Blobs || listOpts.Manifests || len(*pruneMode) > 0 || len(*restoreMode) > 0 || *selfCheckOnly) {
+		return fmt.Errorf("option -loadgen-profile can't be used with -list-repositories, -list-blobs, -list-manifests, -list-manifests-from, -prune, -restore-mode and -self-check-only")
+	}
+
+	if (len(*loadgenProfile) > 0) != (len(*loadgenTarget) > 0) {
+		return fmt.Errorf("option -loadgen-target is required for and only allowed with -loadgen-profile")
+	}
+
 	if len(*pruneMode) > 0 && len(*restoreMode) > 0 {
 		return fmt.Errorf("options -prune and -restore-mode are mutually exclusive")
 	}
 
+	if (*pruneMode == "plan" || *pruneMode == "apply") != (len(*prunePlan) > 0) {
+		return fmt.Errorf("option -prune-plan is required for and only allowed with -prune=plan and -prune=apply")
+	}
+
+	if len(*pruneMode) == 0 && (*pruneKeepRunning || len(*pruneKeepList) > 0) {
+		return fmt.Errorf("options -prune-keep-running and -prune-keep-list are only allowed with -prune")
+	}
+
+	if *pruneOrphanedImages < 0 {
+		return fmt.Errorf("option -prune-orphaned-images must not be negative")
+	}
+
+	if *pruneOrphanedImages > 0 && *pruneMode != "check" && *pruneMode != "delete" {
+		return fmt.Errorf("option -prune-orphaned-images is only allowed with -prune=check and -prune=delete")
+	}
+
 	if len(*restoreMode) > 0 && !*experimental {
 		return fmt.Errorf("option -restore-mode is experimental. Please specify the -experimental to use it.")
 	}
@@ -113,6 +155,11 @@ func Execute(configFile io.Reader) {
 		os.Exit(2)
 	}
 
+	if len(*loadgenProfile) != 0 {
+		ExecuteLoadgen(*loadgenProfile, *loadgenTarget, *loadgenTokenFile, *loadgenConcurrency)
+		return
+	}
+
 	listOpts := getListOptions()
 
 	if listOpts.Repositories || listOpts.Blobs || listOpts.Manifests {
@@ -132,17 +179,13 @@ func Execute(configFile io.Reader) {
 	}
 
 	if len(*pruneMode) != 0 {
-		var dryRun bool
 		switch *pruneMode {
-		case "delete":
-			dryRun = false
-		case "check":
-			dryRun = true
+		case "check", "delete", "plan", "apply":
+			ExecutePruner(configFile, *pruneMode, *prunePlan, *pruneKeepRunning, *pruneKeepList, *pruneOrphanedImages)
 		default:
 			log.Error("invalid value for the -prune option")
 			os.Exit(2)
 		}
-		ExecutePruner(configFile, dryRun)
 		return
 	}
 
@@ -161,6 +204,18 @@ func Execute(configFile io.Reader) {
 	// with uuid generation under low entropy.
 	uuid.Loggerf = dcontext.GetLogger(ctx).Warnf
 
+	if *selfCheckOnly {
+		report := runSelfCheck(ctx, dockerConfig, extraConfig, false)
+		reportErr := writeSelfCheckReport(ctx, report, *selfCheckReport)
+		if reportErr != nil {
+			dcontext.GetLogger(ctx).Errorf("%v", reportErr)
+		}
+		if !report.Passed || reportErr != nil {
+			os.Exit(1)
+		}
+		return
+	}
+
 	dcontext.GetLoggerWithFields(ctx, versionFields()).Info("start registry")
 
 	srv, err := NewServer(ctx, dockerConfig, extraConfig)
@@ -172,15 +227,36 @@ func Execute(configFile io.Reader) {
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 
+	if extraConfig.Profiling.Enabled && !extraConfig.Profiling.RequireAuth {
+		go func() {
+			dcontext.GetLogger(ctx).Infof("starting profiling endpoint at http://%s/debug/pprof/", extraConfig.Profiling.Addr)
+			errc <- http.ListenAndServe(extraConfig.Profiling.Addr, server.NewProfilingHandler())
+		}()
+	}
+
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	go func() {
 		if dockerConfig.HTTP.TLS.Certificate == "" {
 			dcontext.GetLogger(ctx).Infof("listening on %s", srv.Addr)
-			errc <- srv.ListenAndServe()
+			errc <- srv.Serve(ln)
 			return
 		}
 
 		dcontext.GetLogger(ctx).Infof("listening on %s, tls", srv.Addr)
-		errc <- srv.ListenAndServeTLS(dockerConfig.HTTP.TLS.Certificate, dockerConfig.HTTP.TLS.Key)
+		errc <- srv.ServeTLS(ln, dockerConfig.HTTP.TLS.Certificate, dockerConfig.HTTP.TLS.Key)
+	}()
+
+	// The self-check doesn't delay the startup. It runs once the listener is
+	// bound, so that the token realm that is served by the registry answers.
+	go func() {
+		report := runSelfCheck(ctx, dockerConfig, extraConfig, true)
+		if err := writeSelfCheckReport(ctx, report, *selfCheckReport); err != nil {
+			dcontext.GetLogger(ctx).Errorf("%v", err)
+		}
 	}()
 
 	select {
@@ -201,10 +277,58 @@ func Execute(configFile io.Reader) {
 	dcontext.GetLogger(ctx).Infof("server shutdown, bye.")
 }
 
+// newReconnectingRegistryClient returns the client of the API server that is
+// rebuilt from the reloaded kubeconfig as configured by the kubeclient section
+// of extraConfig.
+func newReconnectingRegistryClient(ctx context.Context, extraConfig *registryconfig.Configuration) (client.RegistryClient, error) {
+	reconnect := extraConfig.KubeClient.Reconnect
+	if !reconnect.Enabled {
+		return newRegistryClient(extraConfig)
+	}
+
+	m := metrics.NewNoopMetrics()
+	if extraConfig.Metrics.Enabled {
+		m = metrics.NewMetrics(metrics.NewPrometheusSink())
+	}
+	return client.NewReconnectingRegistryClient(ctx, func() (client.RegistryClient, error) {
+		return newRegistryClient(extraConfig)
+	}, client.ReconnectConfig{
+		Failures:       reconnect.Failures,
+		InitialBackoff: reconnect.InitialBackoff,
+		MaxBackoff:     reconnect.MaxBackoff,
+		Metrics:        m.KubeClient(),
+	})
+}
+
+// newRegistryClient returns the client of the API server that is configured
+// by the kubeconfig and the kubeclient section of extraConfig.
+func newRegistryClient(extraConfig *registryconfig.Configuration) (client.RegistryClient, error) {
+	tlsConf := client.TLSConfig{
+		CAFile:   extraConfig.KubeClient.TLS.CAFile,
+		CertFile: extraConfig.KubeClient.TLS.CertFile,
+		KeyFile:  extraConfig.KubeClient.TLS.KeyFile,
+	}
+	if s := extraConfig.KubeClient.TLS.MinVersion; len(s) > 0 {
+		minVersion, err := crypto.TLSVersion(s)
+		if err != nil {
+			return nil, fmt.Errorf("openshift.kubeclient.tls.minversion: %v", err)
+		}
+		tlsConf.MinVersion = minVersion
+	}
+	registryClient, err := client.NewRegistryClientWithTLS(clientcmd.NewConfig().BindToFile(extraConfig.KubeConfig), tlsConf)
+	if err != nil {
+		return nil, fmt.Errorf("openshift.kubeclient.tls: %v", err)
+	}
+	return registryClient, nil
+}
+
 func NewServer(ctx context.Context, dockerConfig *configuration.Configuration, extraConfig *registryconfig.Configuration) (*http.Server, error) {
 	setDefaultLogParameters(dockerConfig)
 
-	registryClient := client.NewRegistryClient(clientcmd.NewConfig().BindToFile(extraConfig.KubeConfig))
+	registryClient, err := newReconnectingRegistryClient(ctx, extraConfig)
+	if err != nil {
+		return nil, err
+	}
 
 	readLimiter := newLimiter(extraConfig.Requests.Read)
 	writeLimiter := newLimiter(extraConfig.Requests.Write)
@@ -216,8 +340,29 @@ func NewServer(ctx context.Context, dockerConfig *configuration.Configuration, e
 	handler = alive("/healthz", handler)
 	handler = health.Handler(handler)
 	handler = panicHandler(handler)
+	var recorder *traffic.Recorder
+	if extraConfig.TrafficRecording.Enabled {
+		f, err := traffic.OpenFile(extraConfig.TrafficRecording.Path, extraConfig.TrafficRecording.MaxBytes)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open the traffic recording file: %v", err)
+		}
+		recorder = traffic.NewRecorder(f, extraConfig.TrafficRecording.SampleRate, handler)
+		handler = recorder
+	}
 	if !dockerConfig.Log.AccessLog.Disabled {
-		handler = logrusLoggingHandler(ctx, handler)
+		if len(extraConfig.AccessLog.Format) > 0 {
+			w := io.Writer(os.Stdout)
+			if len(extraConfig.AccessLog.Path) > 0 {
+				f, err := os.OpenFile(extraConfig.AccessLog.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+				if err != nil {
+					return nil, fmt.Errorf("unable to open the access log file: %v", err)
+				}
+				w = f
+			}
+			handler = accesslog.NewHandler(w, accesslog.Format(extraConfig.AccessLog.Format), handler)
+		} else {
+			handler = logrusLoggingHandler(ctx, handler)
+		}
 	}
 
 	var tlsConf *tls.Config
@@ -271,11 +416,19 @@ func NewServer(ctx context.Context, dockerConfig *configuration.Configuration, e
 		}
 	}
 
-	return &http.Server{
+	srv := &http.Server{
 		Addr:      dockerConfig.HTTP.Addr,
 		Handler:   handler,
 		TLSConfig: tlsConf,
-	}, nil
+	}
+	if recorder != nil {
+		srv.RegisterOnShutdown(func() {
+			if err := recorder.Close(); err != nil {
+				dcontext.GetLogger(ctx).Errorf("unable to close the traffic recording file: %v", err)
+			}
+		})
+	}
+	return srv, nil
 }
 
 // configureLogging prepares the context with a logger using the
@@ -0,0 +1,68 @@
+package dockerregistry
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/traffic"
+)
+
+// ExecuteLoadgen replays the pulls of the recorded profile against the
+// target registry and prints the summary as JSON.
+func ExecuteLoadgen(profile, target, tokenFile string, concurrency int) {
+	if concurrency < 1 {
+		log.Fatalf("invalid value for the -loadgen-concurrency option: %d", concurrency)
+	}
+
+	targetURL, err := url.Parse(target)
+	if err != nil {
+		log.Fatalf("invalid value for the -loadgen-target option: %v", err)
+	}
+	if targetURL.Scheme != "http" && targetURL.Scheme != "https" {
+		log.Fatalf("invalid value for the -loadgen-target option: %q is not an http or https URL", target)
+	}
+
+	f, err := os.Open(profile)
+	if err != nil {
+		log.Fatalf("unable to open the traffic profile: %v", err)
+	}
+	records, err := traffic.ReadProfile(f)
+	f.Close()
+	if err != nil {
+		log.Fatalf("unable to read the traffic profile %s: %v", profile, err)
+	}
+
+	var token string
+	if len(tokenFile) > 0 {
+		data, err := os.ReadFile(tokenFile)
+		if err != nil {
+			log.Fatalf("unable to read the token file: %v", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	log.Infof("replaying %d recorded requests against %s with concurrency %d", len(records), target, concurrency)
+
+	replayer := &traffic.Replayer{
+		Target:      targetURL,
+		Token:       token,
+		Concurrency: concurrency,
+	}
+	summary := replayer.Replay(ctx, records)
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(summary); err != nil {
+		log.Fatalf("unable to write the summary: %v", err)
+	}
+}
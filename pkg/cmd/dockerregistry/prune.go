@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"time"
 
 	"github.com/docker/go-units"
 	log "github.com/sirupsen/logrus"
@@ -14,14 +15,27 @@ import (
 	"github.com/distribution/distribution/v3/registry/storage"
 	"github.com/distribution/distribution/v3/registry/storage/driver/factory"
 
-	"github.com/openshift/image-registry/pkg/dockerregistry/server/client"
 	registryconfig "github.com/openshift/image-registry/pkg/dockerregistry/server/configuration"
 	"github.com/openshift/image-registry/pkg/dockerregistry/server/prune"
-	"github.com/openshift/image-registry/pkg/origin-common/clientcmd"
+	regstorage "github.com/openshift/image-registry/pkg/dockerregistry/server/storage"
 )
 
-// ExecutePruner runs the pruner.
-func ExecutePruner(configFile io.Reader, dryRun bool) {
+// ExecutePruner runs the pruner. The mode is one of:
+//
+//   - check: report what would be deleted,
+//   - delete: delete the data,
+//   - plan: write what would be deleted into planFile, the storage is opened
+//     read-only,
+//   - apply: delete the data from planFile.
+//
+// If keepRunning is true, the images of the pods of all namespaces are kept.
+// If keepListFile is not empty, the digests that are listed in the file are
+// kept as well.
+//
+// If orphanedImagesAge is not zero, the images that are pushed by digest and
+// are not referenced by image streams are deleted from the API before the
+// blobs are pruned, if they are older than orphanedImagesAge.
+func ExecutePruner(configFile io.Reader, mode, planFile string, keepRunning bool, keepListFile string, orphanedImagesAge time.Duration) {
 	config, extraConfig, err := registryconfig.Parse(configFile)
 	if err != nil {
 		log.Fatalf("error parsing configuration file: %s", err)
@@ -42,48 +56,199 @@ func ExecutePruner(configFile io.Reader, dryRun bool) {
 		log.Fatalf("error configuring logging: %s", err)
 	}
 
+	dryRun := mode == "check" || mode == "plan"
+
 	startPrune := "start prune"
 	var registryOptions []storage.RegistryOption
-	if dryRun {
+	switch mode {
+	case "check":
 		startPrune += " (dry-run mode)"
-	} else {
+	case "plan":
+		startPrune += " (plan mode)"
+	case "apply":
+		startPrune += " (apply mode)"
+	}
+	if !dryRun {
 		registryOptions = append(registryOptions, storage.EnableDelete)
 	}
 	dcontext.GetLoggerWithFields(ctx, versionFields()).Info(startPrune)
 
-	registryClient := client.NewRegistryClient(clientcmd.NewConfig().BindToFile(extraConfig.KubeConfig))
+	var plan *prune.Plan
+	if mode == "apply" {
+		f, err := os.Open(planFile)
+		if err != nil {
+			log.Fatalf("error opening the prune plan: %s", err)
+		}
+		plan, err = prune.ReadPlan(f)
+		f.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	registryClient, err := newRegistryClient(extraConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var running prune.RunningDigests
+	if keepRunning {
+		oc, err := registryClient.Client()
+		if err != nil {
+			log.Fatalf("error creating the client: %s", err)
+		}
+		running, err = prune.ListRunningDigests(ctx, oc)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(keepListFile) > 0 {
+		f, err := os.Open(keepListFile)
+		if err != nil {
+			log.Fatalf("error opening the keep list: %s", err)
+		}
+		keepList, err := prune.ReadKeepList(f)
+		f.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if running == nil {
+			running = keepList
+		} else {
+			for dgst, user := range keepList {
+				running[dgst] = user
+			}
+		}
+	}
+
+	var orphanedImages []string
+	if orphanedImagesAge > 0 {
+		oc, err := registryClient.Client()
+		if err != nil {
+			log.Fatalf("error creating the client: %s", err)
+		}
+		orphanedImages, err = prune.OrphanedImages(ctx, oc, orphanedImagesAge, running)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !dryRun {
+			if err := prune.DeleteImages(ctx, oc, orphanedImages); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
 
 	storageDriver, err := factory.Create(config.Storage.Type(), config.Storage.Parameters())
 	if err != nil {
 		log.Fatalf("error creating storage driver: %s", err)
 	}
+	if extraConfig.Encryption.Enabled {
+		keys, err := regstorage.LoadEncryptionKeys(extraConfig.Encryption.KeysDir, extraConfig.Encryption.PrimaryKey)
+		if err != nil {
+			log.Fatalf("error loading encryption keys: %s", err)
+		}
+		storageDriver = regstorage.NewEncryptingDriver(storageDriver, keys)
+	}
+	if mode == "plan" {
+		storageDriver = prune.ReadOnlyDriver(storageDriver)
+	}
 
 	registry, err := storage.NewRegistry(ctx, storageDriver, registryOptions...)
 	if err != nil {
 		log.Fatalf("error creating registry: %s", err)
 	}
 
+	var versions prune.BlobVersions
+	if config.Storage.Type() == "s3" {
+		versions, err = prune.NewS3BlobVersions(ctx, config.Storage.Parameters())
+		if err != nil {
+			log.Fatalf("error checking versioning of the storage: %s", err)
+		}
+	}
+
+	var trash *regstorage.Trash
+	if extraConfig.Trash.Enabled {
+		trash = regstorage.NewTrash(storageDriver, extraConfig.Trash.Retention)
+	}
+
 	var pruner prune.Pruner
+	var planPruner *prune.PlanPruner
 
-	if dryRun {
+	switch mode {
+	case "check":
 		pruner = &prune.DryRunPruner{}
-	} else {
-		pruner = &prune.RegistryPruner{StorageDriver: storageDriver}
+	case "plan":
+		planPruner = &prune.PlanPruner{}
+		pruner = planPruner
+	default:
+		pruner = &prune.RegistryPruner{StorageDriver: storageDriver, Trash: trash}
 	}
 
-	stats, err := prune.Prune(ctx, registry, registryClient, pruner)
+	var stats prune.Summary
+	if plan != nil {
+		stats, err = prune.ApplyPlan(ctx, registry, registryClient, pruner, plan, versions, running)
+	} else {
+		stats, err = prune.Prune(ctx, registry, registryClient, pruner, versions, running)
+	}
 	if err != nil {
 		log.Error(err)
 	}
+	if planPruner != nil && err == nil {
+		if err = writePrunePlan(planFile, &planPruner.Plan); err != nil {
+			log.Error(err)
+		}
+	}
 	if dryRun {
+		if orphanedImagesAge > 0 {
+			fmt.Printf("Would delete %d orphaned images, their blobs are not included below\n", len(orphanedImages))
+		}
 		fmt.Printf("Would delete %d blobs\n", stats.Blobs)
-		fmt.Printf("Would free up %s of disk space\n", units.BytesSize(float64(stats.DiskSpace)))
-		fmt.Println("Use -prune=delete to actually delete the data")
+		fmt.Printf("Would free up %s of disk space\n", units.BytesSize(float64(stats.DiskSpace-stats.RetainedDiskSpace)))
+		if stats.RetainedDiskSpace > 0 {
+			fmt.Printf("Would not free up %s of disk space that is retained by the storage\n", units.BytesSize(float64(stats.RetainedDiskSpace)))
+		}
+		if mode == "plan" {
+			fmt.Printf("Use -prune=apply -prune-plan=%s to delete the data of the plan\n", planFile)
+		} else {
+			fmt.Println("Use -prune=delete to actually delete the data")
+		}
+	} else if trash != nil {
+		if orphanedImagesAge > 0 {
+			fmt.Printf("Deleted %d orphaned images\n", len(orphanedImages))
+		}
+		fmt.Printf("Moved %d blobs (%s) to the trash, they are kept for %s\n", stats.Blobs, units.BytesSize(float64(stats.DiskSpace)), extraConfig.Trash.Retention)
+
+		blobs, size, purgeErr := trash.Purge(ctx)
+		if purgeErr != nil {
+			log.Error(purgeErr)
+			err = purgeErr
+		}
+		fmt.Printf("Deleted %d blobs with expired retention from the trash\n", blobs)
+		fmt.Printf("Freed up %s of disk space\n", units.BytesSize(float64(size)))
 	} else {
+		if orphanedImagesAge > 0 {
+			fmt.Printf("Deleted %d orphaned images\n", len(orphanedImages))
+		}
 		fmt.Printf("Deleted %d blobs\n", stats.Blobs)
-		fmt.Printf("Freed up %s of disk space\n", units.BytesSize(float64(stats.DiskSpace)))
+		fmt.Printf("Freed up %s of disk space\n", units.BytesSize(float64(stats.DiskSpace-stats.RetainedDiskSpace)))
+		if stats.RetainedDiskSpace > 0 {
+			fmt.Printf("Did not free up %s of disk space that is retained by the storage\n", units.BytesSize(float64(stats.RetainedDiskSpace)))
+		}
 	}
 	if err != nil {
 		os.Exit(1)
 	}
 }
+
+// writePrunePlan writes plan into the file name.
+func writePrunePlan(name string, plan *prune.Plan) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return fmt.Errorf("error creating the prune plan: %w", err)
+	}
+	if err := prune.WritePlan(f, plan); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
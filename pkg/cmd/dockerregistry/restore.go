@@ -12,10 +12,8 @@ import (
 	"github.com/distribution/distribution/v3/registry/storage"
 	"github.com/distribution/distribution/v3/registry/storage/driver/factory"
 
-	"github.com/openshift/image-registry/pkg/dockerregistry/server/client"
 	registryconfig "github.com/openshift/image-registry/pkg/dockerregistry/server/configuration"
 	"github.com/openshift/image-registry/pkg/dockerregistry/server/prune"
-	"github.com/openshift/image-registry/pkg/origin-common/clientcmd"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
@@ -30,7 +28,10 @@ func ExecuteRestore(configFile io.Reader, mode, namespace string) {
 		log.Fatalf("error parsing configuration file: %s", err)
 	}
 
-	registryClient := client.NewRegistryClient(clientcmd.NewConfig().BindToFile(config.KubeConfig))
+	registryClient, err := newRegistryClient(config)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	// A lot of installations have the 'debug' log level in their config files,
 	// but it's too verbose for pruning. Therefore we ignore it, but we still
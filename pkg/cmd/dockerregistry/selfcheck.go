@@ -0,0 +1,280 @@
+package dockerregistry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+	dcontext "github.com/distribution/distribution/v3/context"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/factory"
+	"github.com/distribution/distribution/v3/uuid"
+
+	authnv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+	registryconfig "github.com/openshift/image-registry/pkg/dockerregistry/server/configuration"
+)
+
+// selfCheckTimeout limits the duration of every self-check. The checks run
+// in parallel.
+const selfCheckTimeout = 30 * time.Second
+
+// selfCheckStoragePath is the directory of the probe objects of the storage
+// check.
+const selfCheckStoragePath = "/docker/registry/v2/selfcheck"
+
+// SelfCheckReport is the result of the checks that the registry runs on
+// startup.
+type SelfCheckReport struct {
+	Time   time.Time         `json:"time"`
+	Passed bool              `json:"passed"`
+	Checks []SelfCheckResult `json:"checks"`
+}
+
+// SelfCheckResult is the result of a single check.
+type SelfCheckResult struct {
+	Name     string `json:"name"`
+	Passed   bool   `json:"passed"`
+	Skipped  bool   `json:"skipped,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// errSelfCheckSkipped is returned by checks that are not applicable to the
+// configuration.
+type errSelfCheckSkipped struct {
+	reason string
+}
+
+func (e errSelfCheckSkipped) Error() string {
+	return e.reason
+}
+
+// selfCheck is a named check of the self-check.
+type selfCheck struct {
+	name string
+	fn   func(context.Context) error
+}
+
+// runSelfCheck checks that the registry can use its storage, the API server
+// and the token realm. The token realm is served by the registry itself, so
+// it's checked only if the registry is serving.
+func runSelfCheck(ctx context.Context, dockerConfig *configuration.Configuration, extraConfig *registryconfig.Configuration, serving bool) *SelfCheckReport {
+	// the checks of the API server report the errors of the client
+	// configuration
+	registryClient, clientErr := newRegistryClient(extraConfig)
+
+	return runSelfChecks(ctx, []selfCheck{
+		{"storage", func(ctx context.Context) error {
+			return checkStorage(ctx, dockerConfig.Storage)
+		}},
+		{"apiserver", func(ctx context.Context) error {
+			if clientErr != nil {
+				return clientErr
+			}
+			return checkAPIServer(ctx, registryClient)
+		}},
+		{"mirror-sets", func(ctx context.Context) error {
+			if clientErr != nil {
+				return clientErr
+			}
+			return checkMirrorSets(ctx, registryClient)
+		}},
+		{"auth-realm", func(ctx context.Context) error {
+			if !serving {
+				return errSelfCheckSkipped{reason: "the token realm is served by the registry, which is not serving"}
+			}
+			return checkTokenRealm(ctx, extraConfig.Auth.TokenRealm)
+		}},
+	})
+}
+
+// runSelfChecks runs the checks in parallel and reports their results in
+// their order.
+func runSelfChecks(ctx context.Context, checks []selfCheck) *SelfCheckReport {
+	report := &SelfCheckReport{
+		Time:   time.Now().UTC(),
+		Passed: true,
+		Checks: make([]SelfCheckResult, len(checks)),
+	}
+
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			checkCtx, cancel := context.WithTimeout(ctx, selfCheckTimeout)
+			defer cancel()
+			start := time.Now()
+			err := check.fn(checkCtx)
+
+			result := SelfCheckResult{
+				Name:     check.name,
+				Passed:   err == nil,
+				Duration: time.Since(start).Round(time.Millisecond).String(),
+			}
+			if skipped, ok := err.(errSelfCheckSkipped); ok {
+				result.Passed = true
+				result.Skipped = true
+				result.Error = skipped.reason
+			} else if err != nil {
+				result.Error = err.Error()
+			}
+			report.Checks[i] = result
+		}()
+	}
+	wg.Wait()
+
+	for _, result := range report.Checks {
+		if !result.Passed {
+			report.Passed = false
+		}
+	}
+	return report
+}
+
+// storageReadOnly returns true if the storage is in the read-only maintenance
+// mode.
+func storageReadOnly(storage configuration.Storage) bool {
+	readOnly, ok := storage["maintenance"]["readonly"].(map[interface{}]interface{})
+	if !ok {
+		return false
+	}
+	enabled, _ := readOnly["enabled"].(bool)
+	return enabled
+}
+
+// checkStorage writes, reads and deletes a probe object in the storage. If the
+// storage is read-only, it only lists the root of the storage.
+func checkStorage(ctx context.Context, storage configuration.Storage) error {
+	storageDriver, err := factory.Create(storage.Type(), storage.Parameters())
+	if err != nil {
+		return fmt.Errorf("unable to create the storage driver: %w", err)
+	}
+
+	if storageReadOnly(storage) {
+		if _, err := storageDriver.List(ctx, "/"); err != nil {
+			if _, ok := err.(storagedriver.PathNotFoundError); !ok {
+				return fmt.Errorf("unable to list the storage: %w", err)
+			}
+		}
+		return nil
+	}
+
+	path := selfCheckStoragePath + "/" + uuid.Generate().String()
+	content := []byte("image registry self-check")
+	if err := storageDriver.PutContent(ctx, path, content); err != nil {
+		return fmt.Errorf("unable to write the probe object: %w", err)
+	}
+	got, err := storageDriver.GetContent(ctx, path)
+	if err != nil {
+		_ = storageDriver.Delete(ctx, path)
+		return fmt.Errorf("unable to read the probe object: %w", err)
+	}
+	if !bytes.Equal(got, content) {
+		_ = storageDriver.Delete(ctx, path)
+		return fmt.Errorf("the probe object is corrupted: got %q, want %q", got, content)
+	}
+	if err := storageDriver.Delete(ctx, path); err != nil {
+		return fmt.Errorf("unable to delete the probe object: %w", err)
+	}
+	return nil
+}
+
+// checkAPIServer checks that the registry can authenticate to the API server.
+func checkAPIServer(ctx context.Context, registryClient client.RegistryClient) error {
+	c, err := registryClient.Client()
+	if err != nil {
+		return fmt.Errorf("unable to create the client: %w", err)
+	}
+	if _, err := c.SelfSubjectReviews().Create(ctx, &authnv1.SelfSubjectReview{}, metav1.CreateOptions{}); err != nil {
+		return fmt.Errorf("unable to get the identity of the registry: %w", err)
+	}
+	return nil
+}
+
+// checkMirrorSets checks that the registry can list the mirror configuration
+// that is used for pullthrough.
+func checkMirrorSets(ctx context.Context, registryClient client.RegistryClient) error {
+	c, err := registryClient.Client()
+	if err != nil {
+		return fmt.Errorf("unable to create the client: %w", err)
+	}
+	opts := metav1.ListOptions{Limit: 1}
+	if _, err := c.ImageContentSourcePolicy().List(ctx, opts); err != nil {
+		return fmt.Errorf("unable to list image content source policies: %w", err)
+	}
+	if _, err := c.ImageDigestMirrorSet().List(ctx, opts); err != nil {
+		return fmt.Errorf("unable to list image digest mirror sets: %w", err)
+	}
+	if _, err := c.ImageTagMirrorSet().List(ctx, opts); err != nil {
+		return fmt.Errorf("unable to list image tag mirror sets: %w", err)
+	}
+	return nil
+}
+
+// selfCheckClient is the client of the token realm check. The redirects are
+// not followed, any response is an answer.
+var selfCheckClient = &http.Client{
+	Transport: http.DefaultTransport.(*http.Transport).Clone(),
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// checkTokenRealm checks that the configured token realm answers HTTP
+// requests. The status of the response doesn't matter.
+func checkTokenRealm(ctx context.Context, tokenRealm string) error {
+	if len(tokenRealm) == 0 {
+		return errSelfCheckSkipped{reason: "the token realm is determined from the requests"}
+	}
+	u, err := registryconfig.TokenRealm(tokenRealm)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := selfCheckClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("the token realm %s is not reachable: %w", u, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// writeSelfCheckReport logs the report as JSON and writes it into the file
+// reportFile if it's not empty.
+func writeSelfCheckReport(ctx context.Context, report *SelfCheckReport, reportFile string) error {
+	buf, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	if report.Passed {
+		dcontext.GetLogger(ctx).Infof("self-check report: %s", buf)
+	} else {
+		dcontext.GetLogger(ctx).Warnf("self-check failed: %s", buf)
+	}
+
+	if len(reportFile) == 0 {
+		return nil
+	}
+	buf, err = json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(reportFile, append(buf, '\n'), 0644); err != nil {
+		return fmt.Errorf("unable to write the self-check report: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package dockerregistry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/distribution/distribution/v3/configuration"
+)
+
+func TestCheckStorage(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		readOnly bool
+	}{
+		{name: "read-write"},
+		{name: "read-only", readOnly: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			storage := configuration.Storage{
+				"filesystem": configuration.Parameters{"rootdirectory": root},
+			}
+			if tc.readOnly {
+				storage["maintenance"] = configuration.Parameters{
+					"readonly": map[interface{}]interface{}{"enabled": true},
+				}
+			}
+			if got := storageReadOnly(storage); got != tc.readOnly {
+				t.Errorf("got read-only %t, want %t", got, tc.readOnly)
+			}
+
+			if err := checkStorage(context.Background(), storage); err != nil {
+				t.Fatal(err)
+			}
+
+			probes, err := os.ReadDir(filepath.Join(root, filepath.FromSlash(selfCheckStoragePath)))
+			if tc.readOnly {
+				if !os.IsNotExist(err) {
+					t.Errorf("the check of the read-only storage wrote %v, err %v", probes, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(probes) != 0 {
+				t.Errorf("the probe is not deleted: %v", probes)
+			}
+		})
+	}
+}
+
+func TestCheckTokenRealm(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/openshift/token" {
+			t.Errorf("got request for %s, want /openshift/token", r.URL.Path)
+		}
+		// The redirects are answers too.
+		http.Redirect(w, r, "http://unreachable.invalid/", http.StatusFound)
+	}))
+	defer srv.Close()
+
+	if err := checkTokenRealm(context.Background(), srv.URL); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if requests != 1 {
+		t.Errorf("got %d requests, want 1", requests)
+	}
+
+	var skipped errSelfCheckSkipped
+	if err := checkTokenRealm(context.Background(), ""); !errors.As(err, &skipped) {
+		t.Errorf("got %v for the empty realm, want the check to be skipped", err)
+	}
+
+	unreachable := srv.URL
+	srv.Close()
+	if err := checkTokenRealm(context.Background(), unreachable); err == nil {
+		t.Error("expected an error for the unreachable realm")
+	}
+}
+
+func TestRunSelfChecks(t *testing.T) {
+	release := make(chan struct{})
+	report := runSelfChecks(context.Background(), []selfCheck{
+		{"blocked", func(ctx context.Context) error {
+			// Waits for the check that runs after it.
+			<-release
+			return nil
+		}},
+		{"failed", func(ctx context.Context) error {
+			close(release)
+			return errors.New("unavailable")
+		}},
+		{"skipped", func(ctx context.Context) error {
+			return errSelfCheckSkipped{reason: "not configured"}
+		}},
+	})
+
+	if report.Passed {
+		t.Error("expected the report to fail")
+	}
+	expected := []SelfCheckResult{
+		{Name: "blocked", Passed: true},
+		{Name: "failed", Error: "unavailable"},
+		{Name: "skipped", Passed: true, Skipped: true, Error: "not configured"},
+	}
+	if len(report.Checks) != len(expected) {
+		t.Fatalf("got %d results, want %d", len(report.Checks), len(expected))
+	}
+	for i, result := range report.Checks {
+		result.Duration = ""
+		if result != expected[i] {
+			t.Errorf("got result %+v, want %+v", result, expected[i])
+		}
+	}
+
+	reportFile := filepath.Join(t.TempDir(), "report.json")
+	if err := writeSelfCheckReport(context.Background(), report, reportFile); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := os.ReadFile(reportFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written SelfCheckReport
+	if err := json.Unmarshal(buf, &written); err != nil {
+		t.Fatal(err)
+	}
+	if written.Passed || len(written.Checks) != len(expected) {
+		t.Errorf("got written report %+v", written)
+	}
+}
@@ -0,0 +1,282 @@
+package accesslog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// Format is the format of the access log lines.
+type Format string
+
+const (
+	// FormatCombined is the Apache combined log format followed by the
+	// quoted namespace, repository, reference and upstream of the request
+	// and its latency in seconds.
+	FormatCombined Format = "combined"
+	// FormatJSON writes an Entry as JSON per line.
+	FormatJSON Format = "json"
+)
+
+// combinedTimeFormat is the format of the time in the Apache logs.
+const combinedTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// Entry is the access log record of a request.
+type Entry struct {
+	Time           time.Time `json:"time"`
+	RemoteAddr     string    `json:"remoteAddr"`
+	Method         string    `json:"method"`
+	Path           string    `json:"path"`
+	Protocol       string    `json:"protocol"`
+	Status         int       `json:"status"`
+	Bytes          int64     `json:"bytes"`
+	LatencySeconds float64   `json:"latencySeconds"`
+	Referer        string    `json:"referer,omitempty"`
+	UserAgent      string    `json:"userAgent,omitempty"`
+	User           string    `json:"user,omitempty"`
+	Namespace      string    `json:"namespace,omitempty"`
+	Repository     string    `json:"repository,omitempty"`
+	Digest         string    `json:"digest,omitempty"`
+	Tag            string    `json:"tag,omitempty"`
+	// Upstream is the remote repository that the content was pulled
+	// through from.
+	Upstream string `json:"upstream,omitempty"`
+}
+
+// details are the fields of the entry that are known only to the registry
+// application. They are filled while the request is served.
+type details struct {
+	mu       sync.Mutex
+	user     string
+	upstream string
+}
+
+type detailsKey struct{}
+
+func detailsFrom(ctx context.Context) (*details, bool) {
+	d, ok := ctx.Value(detailsKey{}).(*details)
+	return d, ok
+}
+
+// SetUser records the name of the user that made the request of ctx.
+func SetUser(ctx context.Context, user string) {
+	if d, ok := detailsFrom(ctx); ok {
+		d.mu.Lock()
+		d.user = user
+		d.mu.Unlock()
+	}
+}
+
+// SetUpstream records the remote repository that the request of ctx is
+// served from.
+func SetUpstream(ctx context.Context, upstream string) {
+	if d, ok := detailsFrom(ctx); ok {
+		d.mu.Lock()
+		d.upstream = upstream
+		d.mu.Unlock()
+	}
+}
+
+// Handler is an http.Handler that writes an access log line for every
+// request.
+type Handler struct {
+	handler http.Handler
+	format  Format
+
+	mu sync.Mutex
+	w  io.Writer
+
+	// now allows to override the time for tests.
+	now func() time.Time
+}
+
+// NewHandler returns an http.Handler that serves the requests using h and
+// writes their access log lines in format into w.
+func NewHandler(w io.Writer, format Format, h http.Handler) *Handler {
+	return &Handler{
+		handler: h,
+		format:  format,
+		w:       w,
+		now:     time.Now,
+	}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d := &details{}
+	rw := &loggingResponseWriter{ResponseWriter: w}
+	start := h.now()
+	h.handler.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), detailsKey{}, d)))
+
+	status := rw.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	remoteAddr := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		remoteAddr = host
+	}
+
+	entry := Entry{
+		Time:           start,
+		RemoteAddr:     remoteAddr,
+		Method:         r.Method,
+		Path:           r.URL.Path,
+		Protocol:       r.Proto,
+		Status:         status,
+		Bytes:          rw.written,
+		LatencySeconds: h.now().Sub(start).Seconds(),
+		Referer:        r.Referer(),
+		UserAgent:      r.UserAgent(),
+	}
+	entry.Namespace, entry.Repository, entry.Digest, entry.Tag = parsePath(r.URL.Path)
+	d.mu.Lock()
+	entry.User = d.user
+	entry.Upstream = d.upstream
+	d.mu.Unlock()
+
+	var line []byte
+	if h.format == FormatJSON {
+		var err error
+		line, err = json.Marshal(&entry)
+		if err != nil {
+			return
+		}
+		line = append(line, '\n')
+	} else {
+		line = []byte(combinedLine(&entry))
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	// The access log is best effort, it must not fail the requests.
+	_, _ = h.w.Write(line)
+}
+
+// parsePath returns the namespace, the repository, and the digest or the
+// tag of a request to the v2 API.
+func parsePath(path string) (namespace, repository, dgst, tag string) {
+	if !strings.HasPrefix(path, "/v2/") {
+		return
+	}
+	path = strings.TrimPrefix(path, "/v2/")
+	for _, route := range []string{"/manifests/", "/blobs/", "/tags/", "/referrers/"} {
+		i := strings.LastIndex(path, route)
+		if i <= 0 {
+			continue
+		}
+		repository = path[:i]
+		if j := strings.Index(repository, "/"); j > 0 {
+			namespace = repository[:j]
+		}
+
+		ref := path[i+len(route):]
+		if _, err := digest.Parse(ref); err == nil {
+			dgst = ref
+		} else if route == "/manifests/" {
+			tag = ref
+		}
+		return
+	}
+	return
+}
+
+// combinedLine formats entry in the Apache combined log format with the
+// fields of the registry at the end.
+func combinedLine(entry *Entry) string {
+	size := "-"
+	if entry.Bytes > 0 {
+		size = strconv.FormatInt(entry.Bytes, 10)
+	}
+	ref := entry.Digest
+	if len(ref) == 0 {
+		ref = entry.Tag
+	}
+	return fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %s %s %s %s %s %s %s %.3f\n",
+		orDash(entry.RemoteAddr),
+		orDash(entry.User),
+		entry.Time.Format(combinedTimeFormat),
+		entry.Method,
+		entry.Path,
+		entry.Protocol,
+		entry.Status,
+		size,
+		quote(entry.Referer),
+		quote(entry.UserAgent),
+		quote(entry.Namespace),
+		quote(entry.Repository),
+		quote(ref),
+		quote(entry.Upstream),
+		entry.LatencySeconds,
+	)
+}
+
+func orDash(s string) string {
+	if len(s) == 0 {
+		return "-"
+	}
+	return s
+}
+
+// quote returns s in double quotes. The quotes and the control characters
+// of s are escaped.
+func quote(s string) string {
+	if len(s) == 0 {
+		return `"-"`
+	}
+	return strconv.Quote(s)
+}
+
+// loggingResponseWriter remembers the status and the size of the response.
+type loggingResponseWriter struct {
+	http.ResponseWriter
+
+	status  int
+	written int64
+}
+
+func (w *loggingResponseWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *loggingResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+// ReadFrom keeps the zero-copy serving of the blobs working.
+func (w *loggingResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	var n int64
+	var err error
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(struct{ io.Writer }{w.ResponseWriter}, r)
+	}
+	w.written += n
+	return n, err
+}
+
+func (w *loggingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,144 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestHandler(format Format, h http.Handler) (*Handler, *bytes.Buffer) {
+	buf := &bytes.Buffer{}
+	handler := NewHandler(buf, format, h)
+	start := time.Date(2024, time.March, 5, 10, 20, 30, 0, time.UTC)
+	calls := 0
+	handler.now = func() time.Time {
+		calls++
+		if calls == 1 {
+			return start
+		}
+		return start.Add(250 * time.Millisecond)
+	}
+	return handler, buf
+}
+
+func TestHandlerJSON(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		SetUser(r.Context(), "system:serviceaccount:ns:builder")
+		SetUpstream(r.Context(), "registry.example.com/ubi8/ubi")
+		_, _ = w.Write([]byte("hello"))
+	})
+	handler, buf := newTestHandler(FormatJSON, h)
+
+	req := httptest.NewRequest(http.MethodGet, "/v2/ns/app/blobs/sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef?token=secret", nil)
+	req.RemoteAddr = "10.0.0.1:12345"
+	req.Header.Set("User-Agent", "cri-o")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	var entry Entry
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("unable to decode %q: %v", buf.String(), err)
+	}
+	expected := Entry{
+		Time:           time.Date(2024, time.March, 5, 10, 20, 30, 0, time.UTC),
+		RemoteAddr:     "10.0.0.1",
+		Method:         http.MethodGet,
+		Path:           "/v2/ns/app/blobs/sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+		Protocol:       "HTTP/1.1",
+		Status:         http.StatusOK,
+		Bytes:          5,
+		LatencySeconds: 0.25,
+		UserAgent:      "cri-o",
+		User:           "system:serviceaccount:ns:builder",
+		Namespace:      "ns",
+		Repository:     "ns/app",
+		Digest:         "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+		Upstream:       "registry.example.com/ubi8/ubi",
+	}
+	if entry != expected {
+		t.Errorf("got %#+v, want %#+v", entry, expected)
+	}
+}
+
+func TestHandlerCombined(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		SetUser(r.Context(), "developer")
+		w.WriteHeader(http.StatusNotFound)
+	})
+	handler, buf := newTestHandler(FormatCombined, h)
+
+	req := httptest.NewRequest(http.MethodGet, "/v2/ns/app/manifests/latest", nil)
+	req.RemoteAddr = "10.0.0.1:12345"
+	req.Header.Set("User-Agent", `docker/24 "test"`)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	expected := `10.0.0.1 - developer [05/Mar/2024:10:20:30 +0000] "GET /v2/ns/app/manifests/latest HTTP/1.1" 404 - "-" "docker/24 \"test\"" "ns" "ns/app" "latest" "-" 0.250` + "\n"
+	if buf.String() != expected {
+		t.Errorf("got %q, want %q", buf.String(), expected)
+	}
+}
+
+func TestParsePath(t *testing.T) {
+	const dgst = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	for _, tc := range []struct {
+		path       string
+		namespace  string
+		repository string
+		digest     string
+		tag        string
+	}{
+		{path: "/v2/"},
+		{path: "/healthz"},
+		{path: "/v2/ns/app/manifests/latest", namespace: "ns", repository: "ns/app", tag: "latest"},
+		{path: "/v2/ns/app/manifests/" + dgst, namespace: "ns", repository: "ns/app", digest: dgst},
+		{path: "/v2/ns/app/blobs/" + dgst, namespace: "ns", repository: "ns/app", digest: dgst},
+		{path: "/v2/ns/app/blobs/uploads/8d6b2f1c", namespace: "ns", repository: "ns/app"},
+		{path: "/v2/ns/app/tags/list", namespace: "ns", repository: "ns/app"},
+		{path: "/v2/ns/manifests/manifests/v1", namespace: "ns", repository: "ns/manifests", tag: "v1"},
+		{path: "/v2/app/manifests/latest", repository: "app", tag: "latest"},
+	} {
+		namespace, repository, digest, tag := parsePath(tc.path)
+		if namespace != tc.namespace || repository != tc.repository || digest != tc.digest || tag != tc.tag {
+			t.Errorf("%s: got %q %q %q %q, want %q %q %q %q", tc.path, namespace, repository, digest, tag, tc.namespace, tc.repository, tc.digest, tc.tag)
+		}
+	}
+}
+
+// readerFromRecorder is a response writer that supports io.ReaderFrom like
+// the connections of net/http.
+type readerFromRecorder struct {
+	*httptest.ResponseRecorder
+	readFrom bool
+}
+
+func (w *readerFromRecorder) ReadFrom(r io.Reader) (int64, error) {
+	w.readFrom = true
+	return io.Copy(w.ResponseRecorder, r)
+}
+
+func TestHandlerReadFrom(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rf, ok := w.(io.ReaderFrom)
+		if !ok {
+			t.Fatal("expected the response writer to implement io.ReaderFrom")
+		}
+		if _, err := rf.ReadFrom(strings.NewReader("blob data")); err != nil {
+			t.Fatal(err)
+		}
+	})
+	handler, buf := newTestHandler(FormatCombined, h)
+
+	w := &readerFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v2/ns/app/blobs/uploads/1", nil))
+
+	if !w.readFrom || w.Body.String() != "blob data" {
+		t.Errorf("expected the data to be sent by ReadFrom, got %t %q", w.readFrom, w.Body.String())
+	}
+	if !strings.Contains(buf.String(), `" 200 9 "`) {
+		t.Errorf("expected the status and the size in %q", buf.String())
+	}
+}
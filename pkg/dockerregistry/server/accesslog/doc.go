@@ -0,0 +1,5 @@
+// Package accesslog writes a line for every request served by the registry in
+// the Apache combined log format or as JSON, with the namespace, the
+// repository and the user of the request, so that the access logs can be
+// ingested by the cluster logging stack.
+package accesslog
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+
+	authorizationapi "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+)
+
+// accessReviewCall is a self subject access review in progress. Its result is
+// available when done is closed.
+type accessReviewCall struct {
+	done     chan struct{}
+	response *authorizationapi.SelfSubjectAccessReview
+	err      error
+}
+
+// accessReviewCoalescer combines identical self subject access reviews that
+// are made at the same time, so that parallel requests of a client (e.g.
+// downloads of the layers of an image) share one review.
+type accessReviewCoalescer struct {
+	mu    sync.Mutex
+	calls map[string]*accessReviewCall
+
+	// waiting allows to observe the requests that wait for a review in
+	// progress for tests.
+	waiting func(key string)
+}
+
+func newAccessReviewCoalescer() *accessReviewCoalescer {
+	return &accessReviewCoalescer{
+		calls: make(map[string]*accessReviewCall),
+	}
+}
+
+// Client returns c with the self subject access reviews coalesced for the
+// requests with the token.
+func (arc *accessReviewCoalescer) Client(c client.Interface, token string) client.Interface {
+	sum := sha256.Sum256([]byte(token))
+	return &coalescingAccessReviewsClient{
+		Interface: c,
+		coalescer: arc,
+		tokenHash: hex.EncodeToString(sum[:]),
+	}
+}
+
+// do runs review unless an identical review is in progress, in which case
+// the result of the review in progress is returned. The review is not bound
+// to the context of the request that starts it, as other requests may wait
+// for its result.
+func (arc *accessReviewCoalescer) do(ctx context.Context, key string, review func(ctx context.Context) (*authorizationapi.SelfSubjectAccessReview, error)) (*authorizationapi.SelfSubjectAccessReview, error) {
+	arc.mu.Lock()
+	call, ok := arc.calls[key]
+	if !ok {
+		call = &accessReviewCall{
+			done: make(chan struct{}),
+		}
+		arc.calls[key] = call
+
+		reviewCtx := context.WithoutCancel(ctx)
+		go func() {
+			call.response, call.err = review(reviewCtx)
+
+			arc.mu.Lock()
+			delete(arc.calls, key)
+			arc.mu.Unlock()
+			close(call.done)
+		}()
+	}
+	arc.mu.Unlock()
+	if ok && arc.waiting != nil {
+		arc.waiting(key)
+	}
+
+	select {
+	case <-call.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if call.err != nil {
+		return nil, call.err
+	}
+	return call.response.DeepCopy(), nil
+}
+
+// coalescingAccessReviewsClient is a client whose self subject access
+// reviews are coalesced with the reviews for the same token.
+type coalescingAccessReviewsClient struct {
+	client.Interface
+
+	coalescer *accessReviewCoalescer
+	tokenHash string
+}
+
+func (c *coalescingAccessReviewsClient) SelfSubjectAccessReviews() client.SelfSubjectAccessReviewInterface {
+	return &coalescingSelfSubjectAccessReviews{
+		SelfSubjectAccessReviewInterface: c.Interface.SelfSubjectAccessReviews(),
+		client:                           c,
+	}
+}
+
+type coalescingSelfSubjectAccessReviews struct {
+	client.SelfSubjectAccessReviewInterface
+
+	client *coalescingAccessReviewsClient
+}
+
+func (r *coalescingSelfSubjectAccessReviews) Create(ctx context.Context, sar *authorizationapi.SelfSubjectAccessReview, opts metav1.CreateOptions) (*authorizationapi.SelfSubjectAccessReview, error) {
+	spec, err := json.Marshal(sar.Spec)
+	if err != nil {
+		return nil, err
+	}
+	key := r.client.tokenHash + " " + string(spec)
+	return r.client.coalescer.do(ctx, key, func(ctx context.Context) (*authorizationapi.SelfSubjectAccessReview, error) {
+		return r.SelfSubjectAccessReviewInterface.Create(ctx, sar, opts)
+	})
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	authorizationapi "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+)
+
+type fakeAccessReviewsClient struct {
+	client.Interface
+
+	calls   atomic.Int32
+	started chan struct{}
+	release chan struct{}
+}
+
+func (c *fakeAccessReviewsClient) SelfSubjectAccessReviews() client.SelfSubjectAccessReviewInterface {
+	return c
+}
+
+func (c *fakeAccessReviewsClient) Create(ctx context.Context, sar *authorizationapi.SelfSubjectAccessReview, opts metav1.CreateOptions) (*authorizationapi.SelfSubjectAccessReview, error) {
+	c.calls.Add(1)
+	c.started <- struct{}{}
+	<-c.release
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	response := sar.DeepCopy()
+	response.Status.Allowed = true
+	return response, nil
+}
+
+// notifyAccessReviewWaiting makes arc send the keys of the waiting requests
+// to the returned channel.
+func notifyAccessReviewWaiting(arc *accessReviewCoalescer) <-chan string {
+	waiting := make(chan string, 10)
+	arc.waiting = func(key string) {
+		waiting <- key
+	}
+	return waiting
+}
+
+func TestAccessReviewCoalescer(t *testing.T) {
+	ctx := context.Background()
+
+	fake := &fakeAccessReviewsClient{
+		started: make(chan struct{}, 10),
+		release: make(chan struct{}),
+	}
+	coalescer := newAccessReviewCoalescer()
+	waiting := notifyAccessReviewWaiting(coalescer)
+
+	review := func(token, namespace string) *authorizationapi.SelfSubjectAccessReview {
+		response, err := coalescer.Client(fake, token).SelfSubjectAccessReviews().Create(ctx, &authorizationapi.SelfSubjectAccessReview{
+			Spec: authorizationapi.SelfSubjectAccessReviewSpec{
+				ResourceAttributes: &authorizationapi.ResourceAttributes{
+					Namespace:   namespace,
+					Verb:        "get",
+					Resource:    "imagestreams",
+					Subresource: "layers",
+				},
+			},
+		}, metav1.CreateOptions{})
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+		return response
+	}
+
+	var wg sync.WaitGroup
+	responses := make([]*authorizationapi.SelfSubjectAccessReview, 3)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		responses[0] = review("token1", "foo")
+	}()
+	<-fake.started
+
+	// Wait until the second review joins the first one.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		responses[1] = review("token1", "foo")
+	}()
+	<-waiting
+
+	// Reviews for other tokens are not coalesced.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		responses[2] = review("token2", "foo")
+	}()
+	<-fake.started
+
+	close(fake.release)
+	wg.Wait()
+
+	if calls := fake.calls.Load(); calls != 2 {
+		t.Errorf("got %d access reviews, want 2", calls)
+	}
+	for i, response := range responses {
+		if response == nil || !response.Status.Allowed {
+			t.Errorf("response %d: expected the access to be allowed, got %#v", i, response)
+		}
+	}
+	if responses[0] == responses[1] {
+		t.Errorf("expected the coalesced reviews to get their own copies of the response")
+	}
+}
+
+func TestAccessReviewCoalescerCanceledRequest(t *testing.T) {
+	fake := &fakeAccessReviewsClient{
+		started: make(chan struct{}, 10),
+		release: make(chan struct{}),
+	}
+	coalescer := newAccessReviewCoalescer()
+	waiting := notifyAccessReviewWaiting(coalescer)
+
+	review := func(ctx context.Context) (*authorizationapi.SelfSubjectAccessReview, error) {
+		return coalescer.Client(fake, "token").SelfSubjectAccessReviews().Create(ctx, &authorizationapi.SelfSubjectAccessReview{
+			Spec: authorizationapi.SelfSubjectAccessReviewSpec{
+				ResourceAttributes: &authorizationapi.ResourceAttributes{
+					Namespace: "foo",
+					Verb:      "get",
+					Resource:  "imagestreams",
+				},
+			},
+		}, metav1.CreateOptions{})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	firstErr := make(chan error, 1)
+	go func() {
+		_, err := review(ctx)
+		firstErr <- err
+	}()
+	<-fake.started
+
+	var (
+		wg       sync.WaitGroup
+		response *authorizationapi.SelfSubjectAccessReview
+		err      error
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		response, err = review(context.Background())
+	}()
+	<-waiting
+
+	// The request that started the review goes away.
+	cancel()
+	if err := <-firstErr; !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v for the canceled request, want %v", err, context.Canceled)
+	}
+
+	close(fake.release)
+	wg.Wait()
+
+	if err != nil {
+		t.Fatalf("the request that joined the review failed: %v", err)
+	}
+	if !response.Status.Allowed {
+		t.Errorf("expected the access to be allowed")
+	}
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 
@@ -17,6 +18,7 @@ import (
 
 	"github.com/openshift/image-registry/pkg/dockerregistry/server/api"
 	"github.com/openshift/image-registry/pkg/dockerregistry/server/cache"
+	regstorage "github.com/openshift/image-registry/pkg/dockerregistry/server/storage"
 )
 
 func (app *App) registerBlobHandler(dockerApp *handlers.App) {
@@ -43,6 +45,15 @@ func (app *App) registerBlobHandler(dockerApp *handlers.App) {
 		// custom access records
 		pruneAccessRecords,
 	)
+
+	dockerApp.RegisterRoute(
+		"admin-blobs-restore",
+		// POST /admin/blobs/<digest>/restore
+		adminRouter.Path(api.AdminRestorePath).Methods("POST"),
+		app.blobRestoreDispatcher,
+		handlers.NameNotRequired,
+		pruneAccessRecords,
+	)
 }
 
 // blobDispatcher takes the request context and builds the appropriate handler
@@ -55,6 +66,7 @@ func (app *App) blobDispatcher(ctx *handlers.Context, r *http.Request) http.Hand
 		Cache:   app.cache,
 		Context: ctx,
 		driver:  app.driver,
+		trash:   app.trash,
 		Digest:  dgst,
 	}
 
@@ -68,6 +80,9 @@ type blobHandler struct {
 	*handlers.Context
 
 	driver storagedriver.StorageDriver
+	// trash keeps the data of deleted blobs. It is nil if the blobs are
+	// deleted permanently.
+	trash  *regstorage.Trash
 	Digest digest.Digest
 	Cache  cache.DigestCache
 }
@@ -84,32 +99,88 @@ func (bh *blobHandler) Delete(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	err := bh.Cache.Remove(bh.Digest)
-	if err != nil {
-		dcontext.GetLogger(bh).Errorf("blobHandler: ignore error: unable to remove %q from cache: %v", bh.Digest, err)
+	if err := removeBlobData(bh.Context, bh.driver, bh.trash, bh.Cache, bh.Digest); err != nil {
+		bh.Errors = append(bh.Errors, err)
+		return
 	}
 
-	vacuum := storage.NewVacuum(bh.Context, bh.driver)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// removeBlobData removes the data of the blob dgst from the storage, or moves
+// it into the trash if trash is not nil. The links of the repositories are
+// not removed. The blobs that don't exist are ignored.
+func removeBlobData(ctx context.Context, driver storagedriver.StorageDriver, trash *regstorage.Trash, digestCache cache.DigestCache, dgst digest.Digest) error {
+	err := digestCache.Remove(dgst)
+	if err != nil {
+		dcontext.GetLogger(ctx).Errorf("blobHandler: ignore error: unable to remove %q from cache: %v", dgst, err)
+	}
 
-	err = vacuum.RemoveBlob(bh.Digest.String())
+	if trash != nil {
+		err = trash.Add(ctx, dgst)
+	} else {
+		vacuum := storage.NewVacuum(ctx, driver)
+		err = vacuum.RemoveBlob(dgst.String())
+	}
 	if err != nil {
 		// ignore not found error
 		switch t := err.(type) {
 		case storagedriver.PathNotFoundError:
 		case errcode.Error:
 			if t.Code != v2.ErrorCodeBlobUnknown {
-				bh.Errors = append(bh.Errors, err)
-				return
+				return err
 			}
 		default:
 			if err != distribution.ErrBlobUnknown {
-				detail := fmt.Sprintf("error deleting blob %q: %v", bh.Digest, err)
-				err = errcode.ErrorCodeUnknown.WithDetail(detail)
-				bh.Errors = append(bh.Errors, err)
-				return
+				detail := fmt.Sprintf("error deleting blob %q: %v", dgst, err)
+				return errcode.ErrorCodeUnknown.WithDetail(detail)
 			}
 		}
-		dcontext.GetLogger(bh).Infof("blobHandler: ignoring %T error: %v", err, err)
+		dcontext.GetLogger(ctx).Infof("blobHandler: ignoring %T error: %v", err, err)
+	}
+	return nil
+}
+
+// blobRestoreDispatcher takes the request context and builds the handler for
+// restoring blobs from the trash.
+func (app *App) blobRestoreDispatcher(ctx *handlers.Context, r *http.Request) http.Handler {
+	reference := dcontext.GetStringValue(ctx, "vars.digest")
+	dgst, _ := digest.Parse(reference)
+
+	blobHandler := &blobHandler{
+		Cache:   app.cache,
+		Context: ctx,
+		driver:  app.driver,
+		trash:   app.trash,
+		Digest:  dgst,
+	}
+
+	return gorillahandlers.MethodHandler{
+		"POST": http.HandlerFunc(blobHandler.Restore),
+	}
+}
+
+// Restore moves the blob back from the trash.
+func (bh *blobHandler) Restore(w http.ResponseWriter, req *http.Request) {
+	defer func() {
+		_ = req.Body.Close()
+	}()
+
+	if bh.trash == nil {
+		bh.Errors = append(bh.Errors, errcode.ErrorCodeUnsupported.WithDetail("the trash is not enabled"))
+		return
+	}
+	if len(bh.Digest) == 0 {
+		bh.Errors = append(bh.Errors, v2.ErrorCodeBlobUnknown)
+		return
+	}
+
+	if err := bh.trash.Restore(bh.Context, bh.Digest); err == distribution.ErrBlobUnknown {
+		bh.Errors = append(bh.Errors, v2.ErrorCodeBlobUnknown.WithDetail(fmt.Sprintf("blob %s is not in the trash", bh.Digest)))
+		return
+	} else if err != nil {
+		bh.Errors = append(bh.Errors, errcode.ErrorCodeUnknown.WithDetail(err.Error()))
+		return
 	}
 
 	w.WriteHeader(http.StatusNoContent)
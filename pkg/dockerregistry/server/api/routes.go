@@ -8,7 +8,16 @@ var (
 	AdminPrefix      = "/admin/"
 	ExtensionsPrefix = "/extensions/v2/"
 
-	AdminPath      = "/blobs/{digest:" + reference.DigestRegexp.String() + "}"
-	SignaturesPath = "/{name:" + reference.NameRegexp.String() + "}/signatures/{digest:" + reference.DigestRegexp.String() + "}"
-	MetricsPath    = "/metrics"
+	AdminPath                 = "/blobs/{digest:" + reference.DigestRegexp.String() + "}"
+	AdminRestorePath          = AdminPath + "/restore"
+	SignaturesPath            = "/{name:" + reference.NameRegexp.String() + "}/signatures/{digest:" + reference.DigestRegexp.String() + "}"
+	ExportPath                = "/{name:" + reference.NameRegexp.String() + "}/export"
+	CacheInvalidatePath       = "/{name:" + reference.NameRegexp.String() + "}/cache-invalidate"
+	UploadProgressPath        = "/{name:" + reference.NameRegexp.String() + "}/uploads/{uuid:[a-zA-Z0-9-_.=]+}/progress"
+	PullthroughCandidatesPath = "/{name:" + reference.NameRegexp.String() + "}/pullthrough-candidates"
+	ReferrersPath             = "/v2/{name:" + reference.NameRegexp.String() + "}/referrers/{digest:" + reference.DigestRegexp.String() + "}"
+	NamespaceReposPath        = "/namespaces/{namespace:[a-z0-9](?:[-a-z0-9]*[a-z0-9])?}/repositories"
+	MetricsPath               = "/metrics"
+	ProfilingPath             = "/debug/pprof/{profile:[a-z]*}"
+	DiagnosticsPath           = "/diagnostics"
 )
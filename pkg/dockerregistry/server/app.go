@@ -2,10 +2,15 @@ package server
 
 import (
 	"context"
+	"fmt"
 	"net/http"
+	"os"
+	"path"
+	"runtime"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
 
 	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/configuration"
@@ -14,11 +19,14 @@ import (
 	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
 	kubecache "k8s.io/apimachinery/pkg/util/cache"
 
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/api"
 	"github.com/openshift/image-registry/pkg/dockerregistry/server/cache"
 	"github.com/openshift/image-registry/pkg/dockerregistry/server/client"
 	registryconfig "github.com/openshift/image-registry/pkg/dockerregistry/server/configuration"
 	"github.com/openshift/image-registry/pkg/dockerregistry/server/maxconnections"
 	"github.com/openshift/image-registry/pkg/dockerregistry/server/metrics"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/policy"
+	regstorage "github.com/openshift/image-registry/pkg/dockerregistry/server/storage"
 	"github.com/openshift/image-registry/pkg/dockerregistry/server/supermiddleware"
 )
 
@@ -60,18 +68,150 @@ type App struct {
 	// name. Will be initialized only if the quota is enforced.
 	quotaEnforcing *quotaEnforcingConfig
 
+	// events records the pushes rejected by the quota enforcement on image
+	// streams. It is nil if the quota isn't enforced or the events are
+	// unavailable.
+	events *eventRecorder
+
+	// degraded serves pulls while the API server is unreachable. It is nil
+	// if the degraded mode is disabled.
+	degraded *degradedMode
+
+	// tagDigests reports the tags that are pulled with another digest than
+	// the last time. It is nil if the tracking is disabled.
+	tagDigests *tagDigests
+
+	// platformPulls counts the pulled images by their platforms. It is nil
+	// if the metrics are disabled.
+	platformPulls *platformPulls
+
+	// tagIndex remembers the sorted tags of the listed image streams.
+	tagIndex *tagIndex
+
+	// policyHooks are the compiled-in hooks that can reject changes of
+	// repositories.
+	policyHooks policy.Hooks
+
 	// cache is a shared cache of digests and descriptors.
 	cache cache.DigestCache
 
+	// cacheWarmup fills the cache with the blobs of the image streams of
+	// newly accessed repositories. It is nil if the warm-up is disabled.
+	cacheWarmup *cacheWarmup
+
 	// metrics provide methods to collect statistics.
 	metrics metrics.Metrics
 
+	// registryPolicy enforces the cluster-wide registry restrictions on
+	// pullthrough.
+	registryPolicy *registryPolicy
+
+	// proxy selects the proxy for connections to upstream registries.
+	proxy *clusterProxy
+
+	// authChallenges remembers the auth schemes of upstream registries.
+	authChallenges *authChallenges
+
+	// mirrorHealth orders the mirrors of the pullthrough by their health.
+	// It is nil if the mirrors are tried in their declared order.
+	mirrorHealth *mirrorHealth
+
+	// fallbackMirror is the last resort for pullthrough misses. It is nil
+	// if it isn't configured.
+	fallbackMirror *fallbackMirror
+
+	// blobRedirector decides whether blob downloads can be redirected. It is
+	// nil if redirects are disabled.
+	blobRedirector BlobRedirector
+
+	// zeroCopyRootDirectory is the root directory of the filesystem storage
+	// driver, the blobs are served from its files. It is empty if blobs are
+	// served through the storage driver.
+	zeroCopyRootDirectory string
+
+	// ociConversions remembers the manifests that were served with OCI media
+	// types. It is nil if the conversion is disabled.
+	ociConversions *ociConversions
+
+	// foreignLayerMirror downloads layers with external URLs into the
+	// registry. It is nil if the layers are not mirrored.
+	foreignLayerMirror *foreignLayerMirror
+
+	// layerHints tells container runtimes the order of the layers of the
+	// served images. It is nil if the hints are disabled.
+	layerHints *layerHints
+
+	// tagPropagator notifies the peers about the pushed tags. It is nil if
+	// there are no peers.
+	tagPropagator *tagPropagator
+
+	// decompressionLimits rejects the layers that are decompression bombs.
+	// It is nil if the limits are disabled.
+	decompressionLimits *decompressionLimits
+
+	// signatureVerifier enforces the signature policies of image streams. It
+	// is nil if the verification is disabled.
+	signatureVerifier *signatureVerifier
+
+	// spool keeps the writes in a local directory until they are moved to
+	// the storage backend. It is nil if the spool is disabled.
+	spool *regstorage.Spool
+
+	// encryptionKeys encrypt the blob data in the storage. It is nil if the
+	// encryption at rest is disabled.
+	encryptionKeys *regstorage.EncryptionKeys
+
+	// trash keeps the data of deleted blobs. It is nil if the trash is
+	// disabled.
+	trash *regstorage.Trash
+
+	// blobDataRemover removes the data of the blobs whose deletions are
+	// forced.
+	blobDataRemover *blobDataRemover
+
+	// blobPulls keeps the last pull times of blobs for the watermark
+	// pruning. It is nil if the pruning is disabled.
+	blobPulls *blobPulls
+
+	// uploads keeps the progress of the blob uploads.
+	uploads *uploadTracker
+
+	// manifestPuts combines the identical manifest pushes.
+	manifestPuts *manifestPutCoalescer
+
+	// mirroredImages annotates the images mirrored by the pullthrough. It
+	// is nil if the annotation is disabled.
+	mirroredImages *mirroredImageAnnotator
+
+	// mirrorQueue mirrors the pulled blobs in the background. It is nil if
+	// the mirroring is disabled.
+	mirrorQueue *mirrorQueue
+
+	// diagnostics collects the bundles for support cases. It is nil if the
+	// diagnostics are disabled.
+	diagnostics *diagnostics
+
 	// paginationCache maps repository names to opaque continue tokens received from master API for subsequent
 	// list imagestreams requests
 	paginationCache *kubecache.LRUExpireCache
 }
 
 func (app *App) Storage(driver storagedriver.StorageDriver, options map[string]interface{}) (storagedriver.StorageDriver, error) {
+	if app.config.Spool.Enabled {
+		// The size is validated by the configuration parser.
+		maxSize, err := registryconfig.ParseSpoolSize(app.config.Spool.MaxSize)
+		if err != nil {
+			return nil, err
+		}
+		app.spool, err = regstorage.NewSpool(app.ctx, driver, app.config.Spool.Directory, maxSize, app.metrics.Spool())
+		if err != nil {
+			return nil, err
+		}
+		driver = app.spool
+	}
+	if app.encryptionKeys != nil {
+		driver = regstorage.NewEncryptingDriver(driver, app.encryptionKeys)
+	}
 	app.driver = app.metrics.StorageDriver(driver)
 	return app.driver, nil
 }
@@ -105,31 +245,112 @@ func NewApp(ctx context.Context, registryClient client.RegistryClient, dockerCon
 		registryClient:  registryClient,
 		config:          extraConfig,
 		writeLimiter:    writeLimiter,
-		quotaEnforcing:  newQuotaEnforcingConfig(ctx, extraConfig.Quota),
 		paginationCache: kubecache.NewLRUExpireCache(defaultPaginationCacheSize),
+		registryPolicy:  newRegistryPolicy(registryClient),
+		uploads:         newUploadTracker(),
+		manifestPuts:    newManifestPutCoalescer(),
+		tagIndex:        newTagIndex(),
 	}
-
 	if app.config.Metrics.Enabled {
 		app.metrics = metrics.NewMetrics(metrics.NewPrometheusSink())
+		app.platformPulls = newPlatformPulls(app.metrics.PlatformPulls())
 	} else {
 		app.metrics = metrics.NewNoopMetrics()
 	}
 
+	app.proxy = newClusterProxy(registryClient, newCertificatePins(ctx, extraConfig.Pullthrough.CertificatePins, app.metrics.CertificatePins()))
+	app.authChallenges = newAuthChallenges(extraConfig.Pullthrough.BasicAuthHosts)
+	app.mirrorHealth = newMirrorHealth(extraConfig.Pullthrough.MirrorOrder)
+	app.fallbackMirror = newFallbackMirror(extraConfig.Pullthrough.FallbackMirror, app.proxy, app.authChallenges)
+
+	app.diagnostics = newDiagnostics(log.StandardLogger(), dockerConfig, extraConfig)
+
+	app.quotaEnforcing = newQuotaEnforcingConfig(ctx, extraConfig.Quota, app.metrics)
+	app.degraded = newDegradedMode(extraConfig.DegradedMode, app.metrics.DegradedMode())
+	app.tagDigests = newTagDigests(extraConfig.Cache, app.metrics.TagDigests())
+	app.policyHooks = policy.Registered()
+	app.layerHints = newLayerHints(extraConfig.Server.LayerHints)
+
 	cacheTTL := time.Duration(0)
 	if !app.config.Cache.Disabled {
 		cacheTTL = app.config.Cache.BlobRepositoryTTL
 	}
 
-	digestCache, err := cache.NewBlobDigest(
-		defaultDescriptorCacheSize,
-		defaultDigestToRepositoryCacheSize,
-		cacheTTL,
-		app.metrics,
-	)
+	var digestCache cache.DigestCache
+	var err error
+	if app.config.Cache.Backend == registryconfig.CacheBackendRedis {
+		if dockerConfig.Redis.Addr == "" {
+			dcontext.GetLogger(ctx).Fatalf("configuration error: openshift.cache.backend is redis, but redis.addr is not set")
+		}
+		digestCache, err = cache.NewRedisBlobDigest(
+			newRedisPool(ctx, dockerConfig),
+			defaultDigestToRepositoryCacheSize,
+			cacheTTL,
+			app.metrics,
+		)
+	} else {
+		digestCache, err = cache.NewBlobDigest(
+			defaultDescriptorCacheSize,
+			defaultDigestToRepositoryCacheSize,
+			cacheTTL,
+			app.metrics,
+		)
+	}
 	if err != nil {
 		dcontext.GetLogger(ctx).Fatalf("unable to create cache: %v", err)
 	}
 	app.cache = digestCache
+	app.cacheWarmup = newCacheWarmup(extraConfig.Cache, cacheTTL, digestCache, app.BlobStatter)
+
+	if app.config.P2P.Enabled {
+		redirector, err := newP2PBlobRedirector(app.config)
+		if err != nil {
+			dcontext.GetLogger(ctx).Fatalf("unable to create p2p blob redirector: %v", err)
+		}
+		app.blobRedirector = redirector
+	}
+
+	if app.config.Encryption.Enabled {
+		app.encryptionKeys, err = regstorage.LoadEncryptionKeys(app.config.Encryption.KeysDir, app.config.Encryption.PrimaryKey)
+		if err != nil {
+			dcontext.GetLogger(ctx).Fatalf("unable to load encryption keys: %v", err)
+		}
+	}
+
+	if app.config.Server.ZeroCopy && app.encryptionKeys != nil {
+		dcontext.GetLogger(ctx).Warnf("openshift.server.zerocopy is ignored, the blob data is encrypted")
+	} else if app.config.Server.ZeroCopy && app.config.Spool.Enabled {
+		dcontext.GetLogger(ctx).Warnf("openshift.server.zerocopy is ignored, the blobs are written into the spool")
+	} else if app.config.Server.ZeroCopy {
+		if root, ok := filesystemRootDirectory(dockerConfig.Storage); ok {
+			app.zeroCopyRootDirectory = root
+		} else {
+			dcontext.GetLogger(ctx).Warnf("openshift.server.zerocopy is ignored for the storage driver %q", dockerConfig.Storage.Type())
+		}
+	}
+
+	if app.config.Compatibility.ServeOCI || app.config.Compatibility.NegotiateManifests {
+		app.ociConversions = newOCIConversions()
+	}
+
+	if app.config.Compatibility.ForeignLayers == registryconfig.ForeignLayersMirror {
+		app.foreignLayerMirror = newForeignLayerMirror(app.proxy, app.config.Compatibility.ForeignLayerHosts)
+	}
+
+	app.signatureVerifier, err = newSignatureVerifier(app.config.Signatures)
+	if err != nil {
+		dcontext.GetLogger(ctx).Fatalf("unable to create signature verifier: %v", err)
+	}
+
+	app.tagPropagator, err = newTagPropagator(app.config.TagPropagation, app.config.Server.Addr)
+	if err != nil {
+		dcontext.GetLogger(ctx).Fatalf("unable to create tag propagator: %v", err)
+	}
+	if app.tagPropagator != nil {
+		app.tagPropagator.run(ctx)
+	}
+
+	app.decompressionLimits = newDecompressionLimits(app.config.Security)
 
 	superapp := supermiddleware.App(app)
 	if am := appMiddlewareFrom(ctx); am != nil {
@@ -144,13 +365,45 @@ func NewApp(ctx context.Context, registryClient client.RegistryClient, dockerCon
 		dcontext.GetLogger(ctx).Fatalf("configuration error: the registry middleware %q is not activated", supermiddleware.Name)
 	}
 
+	if app.spool != nil {
+		go app.spool.Run(ctx, app.config.Spool.MoveInterval)
+	}
+
+	if app.config.Trash.Enabled {
+		app.trash = regstorage.NewTrash(app.driver, app.config.Trash.Retention)
+	}
+
+	// Every replica removes the data of the blobs whose deletions it
+	// accepted.
+	app.blobDataRemover = app.newBlobDataRemover()
+	go app.blobDataRemover.Run(ctx)
+
+	if len(app.config.Pruning.HighWatermark) > 0 {
+		identity, err := os.Hostname()
+		if err != nil {
+			dcontext.GetLogger(ctx).Fatalf("unable to get the identity of the replica: %v", err)
+		}
+		app.blobPulls = newBlobPulls()
+		mergeBlobPulls(ctx, app.driver, app.blobPulls, 0)
+		go app.runBlobPullsSnapshots(ctx, identity, blobPullsSnapshotInterval)
+	}
+
+	if app.config.Cache.Persist.Enabled && !app.config.Cache.Disabled {
+		app.loadDigestCache(ctx)
+		go app.runDigestCacheSnapshots(ctx, app.config.Cache.Persist.Interval)
+	}
+
 	// Add a token handling endpoint
 	if dockerConfig.Auth.Type() == supermiddleware.Name {
 		tokenRealm, err := registryconfig.TokenRealm(extraConfig.Auth.TokenRealm)
 		if err != nil {
 			dcontext.GetLogger(dockerApp).Fatalf("error setting up token auth: %s", err)
 		}
-		err = dockerApp.NewRoute().Methods("GET").PathPrefix(tokenRealm.Path).Handler(NewTokenHandler(ctx, registryClient)).GetError()
+		tokenHandler, err := NewTokenHandler(ctx, registryClient, dockerApp.Config.HTTP.Secret, extraConfig.Auth.RefreshTokenLifetime)
+		if err != nil {
+			dcontext.GetLogger(dockerApp).Fatalf("error setting up token endpoint: %v", err)
+		}
+		err = dockerApp.NewRoute().Methods("GET", "POST").PathPrefix(tokenRealm.Path).Handler(tokenHandler).GetError()
 		if err != nil {
 			dcontext.GetLogger(dockerApp).Fatalf("error setting up token endpoint at %q: %v", tokenRealm.Path, err)
 		}
@@ -160,12 +413,90 @@ func NewApp(ctx context.Context, registryClient client.RegistryClient, dockerCon
 	app.registerBlobHandler(dockerApp)
 
 	// Registry extensions endpoint provides extra functionality to handle the image
-	// signatures.
+	// signatures and exports.
 	isImageClient, err := registryClient.Client()
 	if err != nil {
 		dcontext.GetLogger(dockerApp).Fatalf("unable to get client for signatures: %v", err)
 	}
+	if app.quotaEnforcing.enforcementEnabled {
+		app.events, err = app.newEventRecorder(isImageClient)
+		if err != nil {
+			dcontext.GetLogger(dockerApp).Warnf("events of the quota enforcement are disabled: %v", err)
+		}
+	}
+
 	RegisterSignatureHandler(dockerApp, isImageClient)
+	RegisterExportHandler(dockerApp)
+	app.registerCacheInvalidationHandler(dockerApp)
+	app.registerUploadProgressHandler(dockerApp)
+	app.registerReferrersHandler(dockerApp)
+	app.registerNamespaceRepositoriesHandler(dockerApp, isImageClient)
+	app.registerPullthroughCandidatesHandler(dockerApp, isImageClient)
+	if app.diagnostics != nil {
+		app.registerDiagnosticsHandler(dockerApp)
+	}
+
+	coordinator, err := newCoordinator(extraConfig.Coordination, isImageClient, app.metrics)
+	if err != nil {
+		dcontext.GetLogger(dockerApp).Fatalf("unable to set up the coordination between replicas: %v", err)
+	}
+
+	if interval := extraConfig.Pullthrough.ScheduledImportInterval; interval > 0 {
+		r := newScheduledImportReconciler(isImageClient, interval)
+		r.state = coordinator.State()
+		coordinator.Go(ctx, "scheduled imports", r.Run)
+	}
+
+	if interval := extraConfig.Pullthrough.MirrorAnnotationInterval; interval > 0 && extraConfig.Pullthrough.Mirror {
+		app.mirroredImages = newMirroredImageAnnotator(isImageClient, interval)
+		go app.mirroredImages.run(ctx)
+	}
+
+	if extraConfig.Pullthrough.Mirror {
+		app.mirrorQueue = newMirrorQueue(extraConfig.Pullthrough.MirrorQueue, app.writeLimiter, app.metrics.MirrorQueue())
+		go app.mirrorQueue.run(ctx)
+	}
+
+	if interval := extraConfig.ManifestVerification.Interval; interval > 0 {
+		r := newManifestVerificationReconciler(isImageClient, app.registry, app.metrics.ManifestReconciliation(), interval, extraConfig.ManifestVerification.SampleSize)
+		r.state = coordinator.State()
+		coordinator.Go(ctx, "manifest verification", r.Run)
+	}
+
+	if app.trash != nil {
+		r := newTrashPurger(app.trash, extraConfig.Trash.PurgeInterval)
+		r.state = coordinator.State()
+		coordinator.Go(ctx, "trash purge", r.Run)
+	}
+
+	if app.blobPulls != nil {
+		r, err := app.newWatermarkPruner(ctx, dockerConfig.Storage, isImageClient)
+		if err != nil {
+			dcontext.GetLogger(dockerApp).Fatalf("configuration error in openshift.pruning: %v", err)
+		}
+		r.state = coordinator.State()
+		coordinator.Go(ctx, "watermark pruning", r.Run)
+	}
+
+	if coordinator != nil {
+		go coordinator.Run(ctx)
+	}
+
+	if extraConfig.ImageService.Enabled {
+		scheme := "http"
+		if len(dockerConfig.HTTP.TLS.Certificate) > 0 {
+			scheme = "https"
+		}
+		err := app.serveImageService(ctx, extraConfig.ImageService.Addr, &imageService{
+			app:            app,
+			registryClient: registryClient,
+			client:         isImageClient,
+			registryURL:    fmt.Sprintf("%s://%s", scheme, extraConfig.Server.Addr),
+		})
+		if err != nil {
+			dcontext.GetLogger(dockerApp).Fatalf("unable to start the image service: %v", err)
+		}
+	}
 
 	// Advertise features supported by OpenShift
 	if dockerApp.Config.HTTP.Headers == nil {
@@ -176,6 +507,30 @@ func NewApp(ctx context.Context, registryClient client.RegistryClient, dockerCon
 	dockerApp.RegisterHealthChecks()
 
 	h := http.Handler(dockerApp)
+	h = newPayloadErrorHandler(dockerConfig.HTTP.Prefix, h)
+	h = newOCIUploadHandler(dockerConfig.HTTP.Prefix, h)
+	h = newManifestETagHandler(dockerConfig.HTTP.Prefix, h)
+	if app.ociConversions != nil {
+		h = newOCIConversionHandler(dockerConfig.HTTP.Prefix, h)
+	}
+	h = newRepositoryAliasHandler(dockerConfig.HTTP.Prefix, h, extraConfig.Aliases, registryClient)
+	h = newOCIErrorHandler(dockerConfig.HTTP.Prefix, h)
+	if dockerConfig.Auth.Type() == supermiddleware.Name {
+		ac, err := app.Auth(nil)
+		if err != nil {
+			dcontext.GetLogger(dockerApp).Fatalf("error setting up the ping handler: %v", err)
+		}
+		h = newPingHandler(dockerConfig.HTTP.Prefix, h, ac.(*AccessController), dockerApp.Config.HTTP.Headers)
+	}
+	h = newV1PingHandler(dockerConfig.HTTP.Prefix, h)
+	h, err = newContentTrustHandler(dockerConfig.HTTP.Prefix, h, extraConfig.ContentTrust)
+	if err != nil {
+		dcontext.GetLogger(dockerApp).Fatalf("configuration error in openshift.contenttrust: %v", err)
+	}
+	h = newRequestIDHandler(h)
+	if app.zeroCopyRootDirectory != "" {
+		h = newZeroCopyHandler(h)
+	}
 
 	// Registry extensions endpoint provides prometheus metrics.
 	if extraConfig.Metrics.Enabled {
@@ -188,6 +543,15 @@ func NewApp(ctx context.Context, registryClient client.RegistryClient, dockerCon
 		h = promhttp.InstrumentHandlerTimeToWriteHeader(metrics.HTTPTimeToWriteHeaderSeconds, h)
 	}
 
+	if extraConfig.Profiling.Enabled {
+		runtime.SetBlockProfileRate(1)
+		metrics.RegisterRuntimeMetrics()
+		if extraConfig.Profiling.RequireAuth {
+			RegisterProfilingHandler(dockerApp)
+			dcontext.GetLogger(dockerApp).Infof("profiling endpoint is available at %s", path.Join(api.ExtensionsPrefix, "debug/pprof")+"/")
+		}
+	}
+
 	dcontext.GetLogger(dockerApp).Infof("Using %q as Docker Registry URL", extraConfig.Server.Addr)
 
 	return h
@@ -15,6 +15,18 @@ const (
 	AuditStatusEntry = "openshift.request.status"
 	AuditErrorEntry  = "openshift.request.error"
 
+	// AuditGroupsEntry is a comma-separated list of the groups of the user.
+	AuditGroupsEntry = "openshift.auth.groups"
+	// AuditServiceAccountEntry is the <namespace>/<name> of the service
+	// account that made the request.
+	AuditServiceAccountEntry = "openshift.auth.serviceaccount"
+	// AuditPodEntry is the <namespace>/<name> of the pod that the token of
+	// the service account is bound to.
+	AuditPodEntry = "openshift.auth.pod"
+	// AuditPodUIDEntry is the UID of the pod that the token of the service
+	// account is bound to.
+	AuditPodUIDEntry = "openshift.auth.poduid"
+
 	auditLoggerKey = "openshift.audit.logger"
 
 	DefaultLoggerType = "registry"
@@ -6,9 +6,11 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"slices"
 	"strings"
 
 	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
 	registryauth "github.com/distribution/distribution/v3/registry/auth"
 
 	authnv1 "k8s.io/api/authentication/v1"
@@ -19,9 +21,11 @@ import (
 	imageapi "github.com/openshift/api/image/v1"
 	"github.com/openshift/library-go/pkg/apiserver/httprequest"
 
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/accesslog"
 	"github.com/openshift/image-registry/pkg/dockerregistry/server/audit"
 	"github.com/openshift/image-registry/pkg/dockerregistry/server/client"
 	"github.com/openshift/image-registry/pkg/dockerregistry/server/configuration"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/metrics"
 )
 
 type deferredErrors map[string]error
@@ -41,11 +45,19 @@ func (d deferredErrors) Empty() bool {
 
 const (
 	defaultUserName = "anonymous"
+
+	serviceAccountUsernamePrefix = "system:serviceaccount:"
+
+	// podNameExtraKey and podUIDExtraKey are the extra fields of the user
+	// info of service account tokens that are bound to a pod.
+	podNameExtraKey = "authentication.kubernetes.io/pod-name"
+	podUIDExtraKey  = "authentication.kubernetes.io/pod-uid"
 )
 
 // WithUserInfoLogger creates a new context with provided user infomation.
 func WithUserInfoLogger(ctx context.Context, username, userid string) context.Context {
 	ctx = context.WithValue(ctx, audit.AuditUserEntry, username)
+	accesslog.SetUser(ctx, username)
 	if len(userid) > 0 {
 		ctx = context.WithValue(ctx, audit.AuditUserIDEntry, userid)
 	}
@@ -55,12 +67,73 @@ func WithUserInfoLogger(ctx context.Context, username, userid string) context.Co
 	))
 }
 
+// withUserIdentityLogger creates a new context with the identity of the user
+// from the token review, so that the audit records attribute the request to
+// a service account and to the pod it comes from.
+func withUserIdentityLogger(ctx context.Context, userInfo authnv1.UserInfo) context.Context {
+	if len(userInfo.Groups) > 0 {
+		ctx = context.WithValue(ctx, audit.AuditGroupsEntry, strings.Join(userInfo.Groups, ","))
+	}
+	if namespace, name, ok := serviceAccountFromUsername(userInfo.Username); ok {
+		ctx = context.WithValue(ctx, audit.AuditServiceAccountEntry, namespace+"/"+name)
+		if pod := userInfoExtra(userInfo, podNameExtraKey); len(pod) > 0 {
+			ctx = context.WithValue(ctx, audit.AuditPodEntry, namespace+"/"+pod)
+		}
+		if uid := userInfoExtra(userInfo, podUIDExtraKey); len(uid) > 0 {
+			ctx = context.WithValue(ctx, audit.AuditPodUIDEntry, uid)
+		}
+	}
+	ctx = WithUserInfoLogger(ctx, userInfo.Username, userInfo.UID)
+	return dcontext.WithLogger(ctx, dcontext.GetLogger(ctx,
+		audit.AuditGroupsEntry,
+		audit.AuditServiceAccountEntry,
+		audit.AuditPodEntry,
+		audit.AuditPodUIDEntry,
+	))
+}
+
+// serviceAccountFromUsername returns the namespace and the name of the
+// service account with the username system:serviceaccount:<namespace>:<name>.
+func serviceAccountFromUsername(username string) (string, string, bool) {
+	rest, ok := strings.CutPrefix(username, serviceAccountUsernamePrefix)
+	if !ok {
+		return "", "", false
+	}
+	namespace, name, ok := strings.Cut(rest, ":")
+	if !ok || len(namespace) == 0 || len(name) == 0 {
+		return "", "", false
+	}
+	return namespace, name, true
+}
+
+func userInfoExtra(userInfo authnv1.UserInfo, key string) string {
+	if values := userInfo.Extra[key]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
 type AccessController struct {
 	realm          string
 	tokenRealm     *url.URL
 	registryClient client.RegistryClient
 	auditLog       bool
 	metricsConfig  configuration.Metrics
+	metricsSecrets *metricsSecrets
+	namespaces     *namespacePhases
+	accessReviews  *accessReviewCoalescer
+
+	// reviewMetrics reports the latency and the errors of the token and
+	// access reviews.
+	reviewMetrics metrics.AuthReviews
+
+	// singleRepositoryCheck skips the pull checks of the repositories that
+	// have push checks.
+	singleRepositoryCheck bool
+
+	// degraded reuses the access reviews of pulls while the API server is
+	// unreachable. It is nil if the degraded mode is disabled.
+	degraded *degradedMode
 }
 
 var _ registryauth.AccessController = &AccessController{}
@@ -75,7 +148,10 @@ var _ registryauth.Challenge = &authChallenge{}
 type tokenAuthChallenge struct {
 	realm   string
 	service string
-	err     error
+	// scope is the scope of the token that the request needs, e.g.
+	// repository:ns/name:pull,push.
+	scope string
+	err   error
 }
 
 var _ registryauth.Challenge = &tokenAuthChallenge{}
@@ -98,12 +174,23 @@ func (app *App) Auth(options map[string]interface{}) (registryauth.AccessControl
 	if err != nil {
 		return nil, err
 	}
+	var reviewMetrics metrics.AuthReviews
+	if app.metrics != nil {
+		reviewMetrics = app.metrics.AuthReviews()
+	}
 	return &AccessController{
 		realm:          app.config.Auth.Realm,
 		tokenRealm:     tokenRealm,
 		registryClient: app.registryClient,
 		metricsConfig:  app.config.Metrics,
+		metricsSecrets: newMetricsSecrets(app.config.Metrics),
+		namespaces:     newNamespacePhases(),
+		accessReviews:  newAccessReviewCoalescer(),
 		auditLog:       app.config.Audit.Enabled,
+
+		singleRepositoryCheck: app.config.Auth.SingleRepositoryCheck,
+		degraded:              app.degraded,
+		reviewMetrics:         reviewMetrics,
 	}, nil
 }
 
@@ -136,9 +223,48 @@ func (ac *tokenAuthChallenge) SetHeaders(req *http.Request, w http.ResponseWrite
 	if ac.service != "" {
 		str += fmt.Sprintf(",service=%q", ac.service)
 	}
+	if ac.scope != "" {
+		str += fmt.Sprintf(",scope=%q", ac.scope)
+	}
 	w.Header().Set("WWW-Authenticate", str)
 }
 
+// challengeScope returns the scopes of the repository and registry resources
+// of accessRecords for the token challenges, e.g.
+// "repository:ns/name:pull,push repository:other/name:pull". The clients
+// that request tokens with the minimal scopes ask for them.
+func challengeScope(accessRecords []registryauth.Access) string {
+	var resources []registryauth.Resource
+	actions := make(map[registryauth.Resource][]string)
+	for _, access := range accessRecords {
+		switch access.Resource.Type {
+		case "repository", "registry":
+		default:
+			continue
+		}
+		if access.Resource.Name == "" || access.Action == "" {
+			continue
+		}
+		resource := registryauth.Resource{
+			Type: access.Resource.Type,
+			Name: access.Resource.Name,
+		}
+		known, ok := actions[resource]
+		if !ok {
+			resources = append(resources, resource)
+		}
+		if !slices.Contains(known, access.Action) {
+			actions[resource] = append(known, access.Action)
+		}
+	}
+
+	scopes := make([]string, 0, len(resources))
+	for _, resource := range resources {
+		scopes = append(scopes, fmt.Sprintf("%s:%s:%s", resource.Type, resource.Name, strings.Join(actions[resource], ",")))
+	}
+	return strings.Join(scopes, " ")
+}
+
 // wrapErr wraps errors related to authorization in an authChallenge error that will present a WWW-Authenticate challenge response
 func (ac *AccessController) wrapErr(ctx context.Context, err error) error {
 	switch err {
@@ -184,11 +310,25 @@ func (ac *AccessController) wrapErr(ctx context.Context, err error) error {
 //	origin/pkg/cmd/dockerregistry/dockerregistry.go#Execute
 //	distribution/distribution/registry/handlers/app.go#appendAccessRecords
 func (ac *AccessController) Authorized(ctx context.Context, accessRecords ...registryauth.Access) (context.Context, error) {
+	authCtx, err := ac.authorize(ctx, accessRecords...)
+	if ac.degraded != nil {
+		authCtx, err = ac.degraded.authorized(ctx, authCtx, err, accessRecords)
+	}
+	if challenge, ok := err.(*tokenAuthChallenge); ok {
+		challenge.scope = challengeScope(accessRecords)
+	}
+	return authCtx, err
+}
+
+// authorize reviews the access of the request with the API server.
+func (ac *AccessController) authorize(ctx context.Context, accessRecords ...registryauth.Access) (context.Context, error) {
 	req, err := dcontext.GetRequest(ctx)
 	if err != nil {
 		return nil, ac.wrapErr(ctx, err)
 	}
 
+	ctx = withRequestIDLogger(ctx)
+
 	bearerToken, err := getOpenShiftAPIToken(req)
 	if err != nil {
 		return nil, ac.wrapErr(ctx, err)
@@ -202,17 +342,22 @@ func (ac *AccessController) Authorized(ctx context.Context, accessRecords ...reg
 	if err != nil {
 		return nil, ac.wrapErr(ctx, err)
 	}
+	if ac.reviewMetrics != nil {
+		irClient = measureAuthReviews(irClient, ac.reviewMetrics)
+		osClient = measureAuthReviews(osClient, ac.reviewMetrics)
+	}
+	osClient = ac.accessReviews.Client(osClient, bearerToken)
 
 	// In case of docker login, hits endpoint /v2
-	if len(bearerToken) > 0 && !isMetricsBearerToken(ac.metricsConfig, bearerToken) {
-		user, userid, err := verifyOpenShiftUser(ctx, osClient)
+	if len(bearerToken) > 0 && !isMetricsBearerToken(ctx, ac.metricsConfig, ac.metricsSecrets, bearerToken) {
+		userInfo, err := verifyOpenShiftUser(ctx, osClient)
 		if err != nil {
 			if kerrors.IsUnauthorized(err) || kerrors.IsForbidden(err) {
 				return nil, ac.wrapErr(ctx, ErrOpenShiftAccessDenied)
 			}
 			return nil, ac.wrapErr(ctx, err)
 		}
-		ctx = WithUserInfoLogger(ctx, user, userid)
+		ctx = withUserIdentityLogger(ctx, userInfo)
 	} else {
 		ctx = WithUserInfoLogger(ctx, defaultUserName, "")
 	}
@@ -224,10 +369,25 @@ func (ac *AccessController) Authorized(ctx context.Context, accessRecords ...reg
 
 	// pushChecks remembers which ns/name pairs had push access checks done
 	pushChecks := map[string]bool{}
+	// pushNamespaces are the namespaces of the repositories with push access
+	pushNamespaces := []string{}
 	// possibleCrossMountErrors holds errors which may be related to cross mount errors
 	possibleCrossMountErrors := deferredErrors{}
 
 	verifiedPrune := false
+	verifiedDryRun := false
+	forceDelete := false
+
+	// pushRequested are the ns/name pairs whose pull checks are covered by
+	// their push checks.
+	pushRequested := map[string]bool{}
+	if ac.singleRepositoryCheck {
+		for _, access := range accessRecords {
+			if access.Resource.Type == "repository" && access.Action == "push" {
+				pushRequested[access.Resource.Name] = true
+			}
+		}
+	}
 
 	// Validate all requested accessRecords
 	// Only return failure errors from this loop. Success should continue to validate all records
@@ -246,7 +406,20 @@ func (ac *AccessController) Authorized(ctx context.Context, accessRecords ...reg
 			case "push":
 				verb = "update"
 				pushChecks[imageStreamNS+"/"+imageStreamName] = true
+				if !slices.Contains(pushNamespaces, imageStreamNS) {
+					pushNamespaces = append(pushNamespaces, imageStreamNS)
+				}
+				if !verifiedDryRun && isDryRunRequest(req) {
+					if err := verifyDryRunAccess(ctx, osClient, irClient); err != nil {
+						return nil, ac.wrapErr(ctx, err)
+					}
+					verifiedDryRun = true
+				}
 			case "pull":
+				if pushRequested[access.Resource.Name] {
+					dcontext.GetLogger(ctx).Debugf("Origin auth: pull access to %s is checked by the push check", access.Resource.Name)
+					continue
+				}
 				verb = "get"
 			case "delete":
 				if strings.Contains(req.URL.Path, "/blobs/uploads/") {
@@ -258,6 +431,7 @@ func (ac *AccessController) Authorized(ctx context.Context, accessRecords ...reg
 						}
 						verifiedPrune = true
 					}
+					forceDelete = isForceBlobDeleteRequest(req)
 					continue
 				}
 			default:
@@ -292,7 +466,27 @@ func (ac *AccessController) Authorized(ctx context.Context, accessRecords ...reg
 		case "metrics":
 			switch access.Action {
 			case "get":
-				if err := verifyMetricsAccess(ctx, ac.metricsConfig, bearerToken, osClient, irClient); err != nil {
+				if err := verifyMetricsAccess(ctx, ac.metricsConfig, ac.metricsSecrets, bearerToken, osClient, irClient); err != nil {
+					return nil, ac.wrapErr(ctx, err)
+				}
+			default:
+				return nil, ac.wrapErr(ctx, ErrUnsupportedAction)
+			}
+
+		case "profiling":
+			switch access.Action {
+			case "get":
+				if err := verifyProfilingAccess(ctx, ac.metricsSecrets, bearerToken, osClient, irClient); err != nil {
+					return nil, ac.wrapErr(ctx, err)
+				}
+			default:
+				return nil, ac.wrapErr(ctx, ErrUnsupportedAction)
+			}
+
+		case "diagnostics":
+			switch access.Action {
+			case "get":
+				if err := verifyDiagnosticsAccess(ctx, osClient, irClient); err != nil {
 					return nil, ac.wrapErr(ctx, err)
 				}
 			default:
@@ -313,6 +507,15 @@ func (ac *AccessController) Authorized(ctx context.Context, accessRecords ...reg
 				return nil, ac.wrapErr(ctx, ErrUnsupportedAction)
 			}
 
+		case "namespace":
+			switch access.Action {
+			case "list":
+				// The repositories of the namespace are filtered by the
+				// pull access of the user when they are listed.
+			default:
+				return nil, ac.wrapErr(ctx, ErrUnsupportedAction)
+			}
+
 		case "registry":
 			switch access.Resource.Name {
 			case "catalog":
@@ -343,11 +546,34 @@ func (ac *AccessController) Authorized(ctx context.Context, accessRecords ...reg
 		}
 	}
 
+	// The image stream mappings cannot be created in terminating namespaces,
+	// so reject pushes before anything is uploaded. The user is authorized,
+	// so the errors are deferred to the repositories instead of challenging
+	// the client, and the clients get DENIED with the reason.
+	for _, namespace := range pushNamespaces {
+		if !ac.namespaces.IsTerminating(ctx, irClient, namespace) {
+			continue
+		}
+		dcontext.GetLogger(ctx).Errorf("Origin auth: refusing to push into namespace %s as it is being deleted", namespace)
+		for namespaceAndName := range pushChecks {
+			if strings.HasPrefix(namespaceAndName, namespace+"/") {
+				possibleCrossMountErrors.Add(namespaceAndName, errcode.ErrorCodeDenied.WithMessage(fmt.Sprintf("namespace %s is being deleted", namespace)))
+			}
+		}
+	}
+
 	// Conditionally add auth errors we want to handle later to the context
 	if !possibleCrossMountErrors.Empty() {
 		dcontext.GetLogger(ctx).Debugf("Origin auth: deferring errors: %#v", possibleCrossMountErrors)
 		ctx = withDeferredErrors(ctx, possibleCrossMountErrors)
 	}
+	if verifiedDryRun {
+		ctx = withDryRun(ctx)
+	}
+	if forceDelete {
+		ctx = withForceBlobDelete(ctx)
+	}
+
 	// Always add a marker to the context so we know auth was run
 	ctx = withAuthPerformed(ctx)
 
@@ -385,15 +611,14 @@ func getOpenShiftAPIToken(req *http.Request) (string, error) {
 	return token, nil
 }
 
-func verifyOpenShiftUser(ctx context.Context, c client.SelfSubjectReviews) (string, string, error) {
+func verifyOpenShiftUser(ctx context.Context, c client.SelfSubjectReviews) (authnv1.UserInfo, error) {
 	ssr := &authnv1.SelfSubjectReview{}
 	response, err := c.SelfSubjectReviews().Create(ctx, ssr, metav1.CreateOptions{})
 	if err != nil {
 		dcontext.GetLogger(ctx).Errorf("Self subject review failed with error: %s", err)
-		return "", "", err
+		return authnv1.UserInfo{}, err
 	}
-	userInfo := response.Status.UserInfo
-	return userInfo.Username, userInfo.UID, nil
+	return response.Status.UserInfo, nil
 }
 
 func sarStatus(sar *authorizationapi.SelfSubjectAccessReview) string {
@@ -535,6 +760,14 @@ func verifyPruneAccess(
 	return verifyWithGlobalSAR(ctx, "images", "", "delete", remoteClient, internalClient)
 }
 
+func verifyDryRunAccess(
+	ctx context.Context,
+	remoteClient client.SelfSubjectAccessReviewsNamespacer,
+	internalClient client.SubjectAccessReviewsNamespacer,
+) error {
+	return verifyWithGlobalSAR(ctx, "images", "", "create", remoteClient, internalClient)
+}
+
 func verifyCatalogAccess(
 	ctx context.Context,
 	remoteClient client.SelfSubjectAccessReviewsNamespacer,
@@ -546,6 +779,7 @@ func verifyCatalogAccess(
 func verifyMetricsAccess(
 	ctx context.Context,
 	metrics configuration.Metrics,
+	secrets *metricsSecrets,
 	token string,
 	remoteClient client.SelfSubjectAccessReviewsNamespacer,
 	internalClient client.SubjectAccessReviewsNamespacer,
@@ -554,8 +788,8 @@ func verifyMetricsAccess(
 		return ErrOpenShiftAccessDenied
 	}
 
-	if len(metrics.Secret) > 0 {
-		if metrics.Secret != token {
+	if secrets.Configured() {
+		if !secrets.Valid(ctx, token) {
 			return ErrOpenShiftAccessDenied
 		}
 		return nil
@@ -568,9 +802,40 @@ func verifyMetricsAccess(
 	return nil
 }
 
-func isMetricsBearerToken(metrics configuration.Metrics, token string) bool {
+// verifyProfilingAccess checks access to the profiling endpoint. It uses the
+// same credentials as the metrics endpoint, but doesn't require the metrics to
+// be enabled.
+func verifyProfilingAccess(
+	ctx context.Context,
+	secrets *metricsSecrets,
+	token string,
+	remoteClient client.SelfSubjectAccessReviewsNamespacer,
+	internalClient client.SubjectAccessReviewsNamespacer,
+) error {
+	if secrets.Configured() {
+		if !secrets.Valid(ctx, token) {
+			return ErrOpenShiftAccessDenied
+		}
+		return nil
+	}
+
+	return verifyWithGlobalSAR(ctx, "registry", "metrics", "get", remoteClient, internalClient)
+}
+
+// verifyDiagnosticsAccess checks access to the diagnostics bundles. The
+// bundles contain the logs and the configuration of the registry, so they are
+// available only to the administrators.
+func verifyDiagnosticsAccess(
+	ctx context.Context,
+	remoteClient client.SelfSubjectAccessReviewsNamespacer,
+	internalClient client.SubjectAccessReviewsNamespacer,
+) error {
+	return verifyWithGlobalSAR(ctx, "registry", "diagnostics", "get", remoteClient, internalClient)
+}
+
+func isMetricsBearerToken(ctx context.Context, metrics configuration.Metrics, secrets *metricsSecrets, token string) bool {
 	if metrics.Enabled {
-		return metrics.Secret == token
+		return secrets.Valid(ctx, token)
 	}
 	return false
 }
@@ -18,10 +18,12 @@ import (
 
 	authenticationapi "k8s.io/api/authentication/v1"
 	authorizationapi "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
 	restclient "k8s.io/client-go/rest"
 
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/audit"
 	"github.com/openshift/image-registry/pkg/dockerregistry/server/client"
 	"github.com/openshift/image-registry/pkg/dockerregistry/server/configuration"
 	"github.com/openshift/image-registry/pkg/origin-common/clientcmd"
@@ -36,6 +38,7 @@ var (
 func init() {
 	authorizationapi.AddToScheme(scheme)
 	authenticationapi.AddToScheme(scheme)
+	corev1.AddToScheme(scheme)
 }
 
 func sarResponse(ns string, allowed bool, reason string) *authorizationapi.SelfSubjectAccessReview {
@@ -45,6 +48,13 @@ func sarResponse(ns string, allowed bool, reason string) *authorizationapi.SelfS
 	return resp
 }
 
+func namespaceResponse(name string, phase corev1.NamespacePhase) *corev1.Namespace {
+	ns := &corev1.Namespace{}
+	ns.Name = name
+	ns.Status.Phase = phase
+	return ns
+}
+
 // TestVerifyImageStreamAccess mocks openshift http request/response and
 // tests invalid/valid/scoped openshift tokens.
 func TestVerifyImageStreamAccess(t *testing.T) {
@@ -122,6 +132,10 @@ func TestAccessController(t *testing.T) {
 		expectedHeaders    http.Header
 		expectedRepoErr    string
 		expectedActions    []string
+		method             string
+		path               string
+		headers            http.Header
+		expectedDryRun     bool
 	}{
 		"no token": {
 			access:            []auth.Access{},
@@ -141,6 +155,25 @@ func TestAccessController(t *testing.T) {
 			expectedChallenge: true,
 			expectedHeaders:   http.Header{"Www-Authenticate": []string{`Bearer realm="https://openshift-example.com/openshift/token"`}},
 		},
+		"no token, pull scope": {
+			access: []auth.Access{{
+				Resource: auth.Resource{Type: "repository", Name: "foo/bar"},
+				Action:   "pull",
+			}},
+			expectedError:     ErrTokenRequired,
+			expectedChallenge: true,
+			expectedHeaders:   http.Header{"Www-Authenticate": []string{`Bearer realm="http://tokenrealm.com/openshift/token",scope="repository:foo/bar:pull"`}},
+		},
+		"no token, cross-mount scope": {
+			access: []auth.Access{
+				{Resource: auth.Resource{Type: "repository", Name: "foo/bar"}, Action: "pull"},
+				{Resource: auth.Resource{Type: "repository", Name: "foo/bar"}, Action: "push"},
+				{Resource: auth.Resource{Type: "repository", Name: "baz/qux"}, Action: "pull"},
+			},
+			expectedError:     ErrTokenRequired,
+			expectedChallenge: true,
+			expectedHeaders:   http.Header{"Www-Authenticate": []string{`Bearer realm="http://tokenrealm.com/openshift/token",scope="repository:foo/bar:pull,push repository:baz/qux:pull"`}},
+		},
 		"invalid registry token": {
 			access: []auth.Access{{
 				Resource: auth.Resource{Type: "repository"},
@@ -295,6 +328,98 @@ func TestAccessController(t *testing.T) {
 				"POST /apis/authorization.k8s.io/v1/selfsubjectaccessreviews (Authorization=Bearer awesome)",
 			},
 		},
+		"dry run push": {
+			access: []auth.Access{
+				{Resource: auth.Resource{Type: "repository", Name: "foo/bar"}, Action: "pull"},
+				{Resource: auth.Resource{Type: "repository", Name: "foo/bar"}, Action: "push"},
+			},
+			method:     "PUT",
+			path:       "/v2/foo/bar/manifests/latest",
+			headers:    http.Header{"Openshift-Dry-Run": []string{"true"}},
+			basicToken: "b3BlbnNoaWZ0OmF3ZXNvbWU=",
+			openshiftResponses: []response{
+				{200, runtime.EncodeOrDie(codecs.LegacyCodec(authenticationapi.SchemeGroupVersion), &authenticationapi.SelfSubjectReview{Status: authenticationapi.SelfSubjectReviewStatus{UserInfo: authenticationapi.UserInfo{Username: "usr1"}}})},
+				{200, runtime.EncodeOrDie(codecs.LegacyCodec(authorizationapi.SchemeGroupVersion), sarResponse("foo", true, "authorized!"))},
+				{200, runtime.EncodeOrDie(codecs.LegacyCodec(authorizationapi.SchemeGroupVersion), sarResponse("", true, "authorized!"))},
+				{200, runtime.EncodeOrDie(codecs.LegacyCodec(authorizationapi.SchemeGroupVersion), sarResponse("foo", true, "authorized!"))},
+				{200, runtime.EncodeOrDie(codecs.LegacyCodec(corev1.SchemeGroupVersion), namespaceResponse("foo", corev1.NamespaceActive))},
+			},
+			expectedDryRun: true,
+			expectedActions: []string{
+				"POST /apis/authentication.k8s.io/v1/selfsubjectreviews (Authorization=Bearer awesome)",
+				"POST /apis/authorization.k8s.io/v1/selfsubjectaccessreviews (Authorization=Bearer awesome)",
+				"POST /apis/authorization.k8s.io/v1/selfsubjectaccessreviews (Authorization=Bearer awesome)",
+				"POST /apis/authorization.k8s.io/v1/selfsubjectaccessreviews (Authorization=Bearer awesome)",
+				"GET /api/v1/namespaces/foo (Authorization=)",
+			},
+		},
+		"pull and push with single repository check": {
+			authConfig: &configuration.Auth{
+				Realm:                 "myrealm",
+				TokenRealm:            "http://tokenrealm.com",
+				SingleRepositoryCheck: true,
+			},
+			access: []auth.Access{
+				{Resource: auth.Resource{Type: "repository", Name: "foo/bar"}, Action: "pull"},
+				{Resource: auth.Resource{Type: "repository", Name: "foo/bar"}, Action: "push"},
+				{Resource: auth.Resource{Type: "repository", Name: "baz/qux"}, Action: "pull"},
+			},
+			basicToken: "b3BlbnNoaWZ0OmF3ZXNvbWU=",
+			openshiftResponses: []response{
+				{200, runtime.EncodeOrDie(codecs.LegacyCodec(authenticationapi.SchemeGroupVersion), &authenticationapi.SelfSubjectReview{Status: authenticationapi.SelfSubjectReviewStatus{UserInfo: authenticationapi.UserInfo{Username: "usr1"}}})},
+				{200, runtime.EncodeOrDie(codecs.LegacyCodec(authorizationapi.SchemeGroupVersion), sarResponse("foo", true, "authorized!"))},
+				{200, runtime.EncodeOrDie(codecs.LegacyCodec(authorizationapi.SchemeGroupVersion), sarResponse("baz", true, "authorized!"))},
+				{200, runtime.EncodeOrDie(codecs.LegacyCodec(corev1.SchemeGroupVersion), namespaceResponse("foo", corev1.NamespaceActive))},
+			},
+			expectedActions: []string{
+				"POST /apis/authentication.k8s.io/v1/selfsubjectreviews (Authorization=Bearer awesome)",
+				"POST /apis/authorization.k8s.io/v1/selfsubjectaccessreviews (Authorization=Bearer awesome)",
+				"POST /apis/authorization.k8s.io/v1/selfsubjectaccessreviews (Authorization=Bearer awesome)",
+				"GET /api/v1/namespaces/foo (Authorization=)",
+			},
+		},
+		"push to terminating namespace": {
+			access: []auth.Access{
+				{Resource: auth.Resource{Type: "repository", Name: "foo/bar"}, Action: "pull"},
+				{Resource: auth.Resource{Type: "repository", Name: "foo/bar"}, Action: "push"},
+			},
+			basicToken: "b3BlbnNoaWZ0OmF3ZXNvbWU=",
+			openshiftResponses: []response{
+				{200, runtime.EncodeOrDie(codecs.LegacyCodec(authenticationapi.SchemeGroupVersion), &authenticationapi.SelfSubjectReview{Status: authenticationapi.SelfSubjectReviewStatus{UserInfo: authenticationapi.UserInfo{Username: "usr1"}}})},
+				{200, runtime.EncodeOrDie(codecs.LegacyCodec(authorizationapi.SchemeGroupVersion), sarResponse("foo", true, "authorized!"))},
+				{200, runtime.EncodeOrDie(codecs.LegacyCodec(authorizationapi.SchemeGroupVersion), sarResponse("foo", true, "authorized!"))},
+				{200, runtime.EncodeOrDie(codecs.LegacyCodec(corev1.SchemeGroupVersion), namespaceResponse("foo", corev1.NamespaceTerminating))},
+			},
+			expectedError:     nil,
+			expectedChallenge: false,
+			expectedRepoErr:   "foo/bar",
+			expectedActions: []string{
+				"POST /apis/authentication.k8s.io/v1/selfsubjectreviews (Authorization=Bearer awesome)",
+				"POST /apis/authorization.k8s.io/v1/selfsubjectaccessreviews (Authorization=Bearer awesome)",
+				"POST /apis/authorization.k8s.io/v1/selfsubjectaccessreviews (Authorization=Bearer awesome)",
+				"GET /api/v1/namespaces/foo (Authorization=)",
+			},
+		},
+		"dry run push without access": {
+			access: []auth.Access{
+				{Resource: auth.Resource{Type: "repository", Name: "foo/bar"}, Action: "push"},
+			},
+			method:     "PUT",
+			path:       "/v2/foo/bar/manifests/latest",
+			headers:    http.Header{"Openshift-Dry-Run": []string{"true"}},
+			basicToken: "b3BlbnNoaWZ0OmF3ZXNvbWU=",
+			openshiftResponses: []response{
+				{200, runtime.EncodeOrDie(codecs.LegacyCodec(authenticationapi.SchemeGroupVersion), &authenticationapi.SelfSubjectReview{Status: authenticationapi.SelfSubjectReviewStatus{UserInfo: authenticationapi.UserInfo{Username: "usr1"}}})},
+				{200, runtime.EncodeOrDie(codecs.LegacyCodec(authorizationapi.SchemeGroupVersion), sarResponse("", false, "no!"))},
+			},
+			expectedError:     ErrOpenShiftAccessDenied,
+			expectedChallenge: true,
+			expectedHeaders:   http.Header{"Www-Authenticate": []string{`Basic realm=myrealm,error="access denied"`}},
+			expectedActions: []string{
+				"POST /apis/authentication.k8s.io/v1/selfsubjectreviews (Authorization=Bearer awesome)",
+				"POST /apis/authorization.k8s.io/v1/selfsubjectaccessreviews (Authorization=Bearer awesome)",
+			},
+		},
 		"deferred cross-mount error": {
 			// cross-mount push requests check pull/push access on the target repo and pull access on the source repo.
 			// we expect the access check failure for fromrepo/bbb to be added to the context as a deferred error,
@@ -310,6 +435,7 @@ func TestAccessController(t *testing.T) {
 				{200, runtime.EncodeOrDie(codecs.LegacyCodec(authorizationapi.SchemeGroupVersion), sarResponse("pushrepo", true, "authorized!"))},
 				{200, runtime.EncodeOrDie(codecs.LegacyCodec(authorizationapi.SchemeGroupVersion), sarResponse("pushrepo", true, "authorized!"))},
 				{200, runtime.EncodeOrDie(codecs.LegacyCodec(authorizationapi.SchemeGroupVersion), sarResponse("fromrepo", false, "no!"))},
+				{200, runtime.EncodeOrDie(codecs.LegacyCodec(corev1.SchemeGroupVersion), namespaceResponse("pushrepo", corev1.NamespaceActive))},
 			},
 			expectedError:     nil,
 			expectedChallenge: false,
@@ -319,6 +445,7 @@ func TestAccessController(t *testing.T) {
 				"POST /apis/authorization.k8s.io/v1/selfsubjectaccessreviews (Authorization=Bearer awesome)",
 				"POST /apis/authorization.k8s.io/v1/selfsubjectaccessreviews (Authorization=Bearer awesome)",
 				"POST /apis/authorization.k8s.io/v1/selfsubjectaccessreviews (Authorization=Bearer awesome)",
+				"GET /api/v1/namespaces/pushrepo (Authorization=)",
 			},
 		},
 		"valid openshift token": {
@@ -395,10 +522,17 @@ func TestAccessController(t *testing.T) {
 			if err != nil {
 				t.Fatal(err)
 			}
-			req, err := http.NewRequest("GET", addr, nil)
+			method := test.method
+			if len(method) == 0 {
+				method = "GET"
+			}
+			req, err := http.NewRequest(method, addr+test.path, nil)
 			if err != nil {
 				t.Fatalf("%s: %v", k, err)
 			}
+			for key, values := range test.headers {
+				req.Header[key] = values
+			}
 			// Simulate a secure request to the specified server
 			req.Host = reqURL.Host
 			req.TLS = &tls.ConnectionState{ServerName: reqURL.Host}
@@ -463,6 +597,9 @@ func TestAccessController(t *testing.T) {
 				if !authPerformed(authCtx) {
 					t.Fatalf("expected AuthPerformed to be true")
 				}
+				if dryRun(authCtx) != test.expectedDryRun {
+					t.Fatalf("expected DryRun to be %v", test.expectedDryRun)
+				}
 				deferredErrors, hasDeferred := deferredErrorsFrom(authCtx)
 				if len(test.expectedRepoErr) > 0 {
 					if !hasDeferred || deferredErrors[test.expectedRepoErr] == nil {
@@ -519,6 +656,47 @@ func simulateOpenShiftMaster(responses []response) (*httptest.Server, *[]string)
 	return server, &actions
 }
 
+func TestChallengeScope(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		access   []auth.Access
+		expected string
+	}{
+		{
+			name: "no access records",
+		},
+		{
+			name: "duplicate actions",
+			access: []auth.Access{
+				{Resource: auth.Resource{Type: "repository", Name: "ns/app"}, Action: "push"},
+				{Resource: auth.Resource{Type: "repository", Name: "ns/app"}, Action: "pull"},
+				{Resource: auth.Resource{Type: "repository", Name: "ns/app"}, Action: "push"},
+			},
+			expected: "repository:ns/app:push,pull",
+		},
+		{
+			name: "catalog",
+			access: []auth.Access{
+				{Resource: auth.Resource{Type: "registry", Name: "catalog"}, Action: "*"},
+			},
+			expected: "registry:catalog:*",
+		},
+		{
+			name: "extensions resources",
+			access: []auth.Access{
+				{Resource: auth.Resource{Type: "metrics"}, Action: "get"},
+				{Resource: auth.Resource{Type: "admin"}, Action: "prune"},
+				{Resource: auth.Resource{Type: "repository", Name: "ns/app"}, Action: "delete"},
+			},
+			expected: "repository:ns/app:delete",
+		},
+	} {
+		if scope := challengeScope(tc.access); scope != tc.expected {
+			t.Errorf("%s: got scope %q, want %q", tc.name, scope, tc.expected)
+		}
+	}
+}
+
 func TestSARStatus(t *testing.T) {
 	testCases := []struct {
 		sar    *authorizationapi.SelfSubjectAccessReview
@@ -572,3 +750,71 @@ func TestSARStatus(t *testing.T) {
 		}
 	}
 }
+
+func TestWithUserIdentityLogger(t *testing.T) {
+	testCases := []struct {
+		name     string
+		userInfo authenticationapi.UserInfo
+		expected map[string]interface{}
+	}{
+		{
+			name: "user",
+			userInfo: authenticationapi.UserInfo{
+				Username: "alice",
+				UID:      "1234",
+				Groups:   []string{"developers", "system:authenticated"},
+			},
+			expected: map[string]interface{}{
+				audit.AuditUserEntry:   "alice",
+				audit.AuditUserIDEntry: "1234",
+				audit.AuditGroupsEntry: "developers,system:authenticated",
+			},
+		},
+		{
+			name: "service account bound to a pod",
+			userInfo: authenticationapi.UserInfo{
+				Username: "system:serviceaccount:ci:builder",
+				UID:      "5678",
+				Groups:   []string{"system:serviceaccounts"},
+				Extra: map[string]authenticationapi.ExtraValue{
+					podNameExtraKey: {"build-1"},
+					podUIDExtraKey:  {"9abc"},
+				},
+			},
+			expected: map[string]interface{}{
+				audit.AuditUserEntry:           "system:serviceaccount:ci:builder",
+				audit.AuditUserIDEntry:         "5678",
+				audit.AuditGroupsEntry:         "system:serviceaccounts",
+				audit.AuditServiceAccountEntry: "ci/builder",
+				audit.AuditPodEntry:            "ci/build-1",
+				audit.AuditPodUIDEntry:         "9abc",
+			},
+		},
+		{
+			name: "malformed service account username",
+			userInfo: authenticationapi.UserInfo{
+				Username: "system:serviceaccount:ci",
+			},
+			expected: map[string]interface{}{
+				audit.AuditUserEntry: "system:serviceaccount:ci",
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := withUserIdentityLogger(context.Background(), tc.userInfo)
+			for _, key := range []string{
+				audit.AuditUserEntry,
+				audit.AuditUserIDEntry,
+				audit.AuditGroupsEntry,
+				audit.AuditServiceAccountEntry,
+				audit.AuditPodEntry,
+				audit.AuditPodUIDEntry,
+			} {
+				if value := ctx.Value(key); value != tc.expected[key] {
+					t.Errorf("%s: got %v, want %v", key, value, tc.expected[key])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/client/auth/challenge"
+	kubecache "k8s.io/apimachinery/pkg/util/cache"
+)
+
+const (
+	authChallengeCacheSize = 1024
+	authChallengeCacheTTL  = time.Hour
+)
+
+// authChallenges remembers the auth scheme chosen for every upstream
+// registry. Registries without a token service may respond with different
+// challenges for different paths, or may not challenge the ping at all, so
+// that the scheme cannot be derived from a single response.
+type authChallenges struct {
+	basicHosts map[string]bool
+	cache      *kubecache.LRUExpireCache
+}
+
+func newAuthChallenges(basicHosts []string) *authChallenges {
+	c := &authChallenges{
+		basicHosts: make(map[string]bool),
+		cache:      kubecache.NewLRUExpireCache(authChallengeCacheSize),
+	}
+	for _, host := range basicHosts {
+		c.basicHosts[host] = true
+	}
+	return c
+}
+
+// Manager returns a challenge manager for a registry client context. The
+// default manager is returned if c is nil.
+func (c *authChallenges) Manager() challenge.Manager {
+	if c == nil {
+		return challenge.NewSimpleManager()
+	}
+	return &authChallengeManager{
+		Manager:    challenge.NewSimpleManager(),
+		challenges: c,
+	}
+}
+
+// forcesBasic returns true if the registry at the endpoint is configured to
+// be accessed with Basic authentication.
+func (c *authChallenges) forcesBasic(endpoint *url.URL) bool {
+	host := strings.ToLower(endpoint.Host)
+	return c.basicHosts[host] || c.basicHosts[strings.ToLower(endpoint.Hostname())]
+}
+
+// authChallengeManager is a challenge.Manager that returns the challenge
+// of the scheme chosen for the host instead of the last challenges of the
+// path.
+type authChallengeManager struct {
+	challenge.Manager
+	challenges *authChallenges
+}
+
+func (m *authChallengeManager) GetChallenges(endpoint url.URL) ([]challenge.Challenge, error) {
+	if m.challenges.forcesBasic(&endpoint) {
+		return []challenge.Challenge{{
+			Scheme:     "basic",
+			Parameters: map[string]string{"realm": endpoint.Host},
+		}}, nil
+	}
+	if c, ok := m.challenges.cache.Get(authChallengeKey(&endpoint)); ok {
+		return []challenge.Challenge{c.(challenge.Challenge)}, nil
+	}
+	return m.Manager.GetChallenges(endpoint)
+}
+
+func (m *authChallengeManager) AddResponse(resp *http.Response) error {
+	if err := m.Manager.AddResponse(resp); err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		// An authorized response doesn't mean that other paths of the
+		// registry don't need authentication, so the chosen scheme is kept.
+		return nil
+	}
+	if c, ok := chooseAuthChallenge(challenge.ResponseChallenges(resp)); ok {
+		m.challenges.cache.Add(authChallengeKey(resp.Request.URL), c, authChallengeCacheTTL)
+	}
+	return nil
+}
+
+// chooseAuthChallenge returns the challenge that is used for the registry,
+// the token service is preferred over Basic authentication.
+func chooseAuthChallenge(challenges []challenge.Challenge) (challenge.Challenge, bool) {
+	for _, scheme := range []string{"bearer", "basic"} {
+		for _, c := range challenges {
+			if strings.EqualFold(c.Scheme, scheme) {
+				return c, true
+			}
+		}
+	}
+	return challenge.Challenge{}, false
+}
+
+// authChallengeKey returns the host of the endpoint with the default port of
+// its scheme.
+func authChallengeKey(endpoint *url.URL) string {
+	host := strings.ToLower(endpoint.Host)
+	if endpoint.Port() == "" {
+		port := "443"
+		if endpoint.Scheme == "http" {
+			port = "80"
+		}
+		host = net.JoinHostPort(strings.ToLower(endpoint.Hostname()), port)
+	}
+	return endpoint.Scheme + "://" + host
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/distribution/distribution/v3/registry/client/auth/challenge"
+)
+
+func TestAuthChallengeManager(t *testing.T) {
+	response := func(endpoint string, status int, challenges ...string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := &http.Response{
+			StatusCode: status,
+			Header:     http.Header{},
+			Request:    req,
+		}
+		for _, c := range challenges {
+			resp.Header.Add("WWW-Authenticate", c)
+		}
+		return resp
+	}
+
+	basic := challenge.Challenge{
+		Scheme:     "basic",
+		Parameters: map[string]string{"realm": "Artifactory Realm"},
+	}
+	bearer := challenge.Challenge{
+		Scheme:     "bearer",
+		Parameters: map[string]string{"realm": "https://auth.example.com/token", "service": "registry"},
+	}
+
+	for _, tc := range []struct {
+		name       string
+		basicHosts []string
+		responses  []*http.Response
+		endpoint   string
+		expected   []challenge.Challenge
+	}{
+		{
+			name:     "no challenges",
+			endpoint: "https://registry.example.com/v2/",
+		},
+		{
+			name: "basic challenge",
+			responses: []*http.Response{
+				response("https://artifactory.example.com/v2/", http.StatusUnauthorized, `Basic realm="Artifactory Realm"`),
+			},
+			endpoint: "https://artifactory.example.com/v2/",
+			expected: []challenge.Challenge{basic},
+		},
+		{
+			name: "chosen scheme is kept after an authorized ping",
+			responses: []*http.Response{
+				response("https://artifactory.example.com/v2/", http.StatusUnauthorized, `Basic realm="Artifactory Realm"`),
+				response("https://artifactory.example.com/v2/", http.StatusOK),
+			},
+			endpoint: "https://artifactory.example.com/v2/",
+			expected: []challenge.Challenge{basic},
+		},
+		{
+			name: "chosen scheme is shared between paths",
+			responses: []*http.Response{
+				response("https://artifactory.example.com/artifactory/api/docker/v2/", http.StatusUnauthorized, `Basic realm="Artifactory Realm"`),
+			},
+			endpoint: "https://artifactory.example.com:443/v2/",
+			expected: []challenge.Challenge{basic},
+		},
+		{
+			name: "token service is preferred",
+			responses: []*http.Response{
+				response("https://registry.example.com/v2/", http.StatusUnauthorized, `Basic realm="Artifactory Realm"`, `Bearer realm="https://auth.example.com/token",service="registry"`),
+			},
+			endpoint: "https://registry.example.com/v2/",
+			expected: []challenge.Challenge{bearer},
+		},
+		{
+			name:       "forced basic authentication",
+			basicHosts: []string{"artifactory.example.com"},
+			responses: []*http.Response{
+				response("https://artifactory.example.com:8443/v2/", http.StatusUnauthorized, `Bearer realm="https://auth.example.com/token",service="registry"`),
+			},
+			endpoint: "https://artifactory.example.com:8443/v2/",
+			expected: []challenge.Challenge{{
+				Scheme:     "basic",
+				Parameters: map[string]string{"realm": "artifactory.example.com:8443"},
+			}},
+		},
+		{
+			name:       "forced basic authentication for another port",
+			basicHosts: []string{"artifactory.example.com:8443"},
+			endpoint:   "https://artifactory.example.com/v2/",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			challenges := newAuthChallenges(tc.basicHosts)
+			for _, resp := range tc.responses {
+				if err := challenges.Manager().AddResponse(resp); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			endpoint, err := url.Parse(tc.endpoint)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := challenges.Manager().GetChallenges(*endpoint)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) == 0 && len(tc.expected) == 0 {
+				return
+			}
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("got challenges %#+v, want %#+v", got, tc.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	authnv1 "k8s.io/api/authentication/v1"
+	authorizationapi "k8s.io/api/authorization/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/metrics"
+)
+
+const (
+	// The kinds of the reviews in metrics.
+	selfSubjectReviewKind       = "selfsubjectreview"
+	selfSubjectAccessReviewKind = "selfsubjectaccessreview"
+	subjectAccessReviewKind     = "subjectaccessreview"
+
+	// slowAuthReviewThreshold is the duration of a review after which it is
+	// logged as slow, e.g. because of a slow webhook authorizer.
+	slowAuthReviewThreshold = time.Second
+)
+
+// measuredReviewsClient is a client whose token and access reviews are
+// measured, so that the latency of the authorization is visible separately
+// from the latency of the storage and the upstream registries.
+type measuredReviewsClient struct {
+	client.Interface
+
+	metrics metrics.AuthReviews
+}
+
+// measureAuthReviews returns c with its token and access reviews reported to
+// m.
+func measureAuthReviews(c client.Interface, m metrics.AuthReviews) client.Interface {
+	return &measuredReviewsClient{
+		Interface: c,
+		metrics:   m,
+	}
+}
+
+// observe reports a review of kind for attrs that started at started and
+// failed with err, if any.
+func (c *measuredReviewsClient) observe(ctx context.Context, kind string, attrs *authorizationapi.ResourceAttributes, started time.Time, err error) {
+	duration := time.Since(started)
+
+	verb, resource := "", ""
+	if attrs != nil {
+		verb, resource = attrs.Verb, attrs.Resource
+		if len(attrs.Subresource) > 0 {
+			resource += "/" + attrs.Subresource
+		}
+	}
+
+	c.metrics.Reviewed(kind, verb, resource, duration)
+	if err != nil {
+		reason := string(kerrors.ReasonForError(err))
+		if reason == "" {
+			reason = "Unknown"
+		}
+		c.metrics.Failed(kind, verb, resource, reason)
+	}
+
+	if duration >= slowAuthReviewThreshold {
+		dcontext.GetLogger(ctx).Warnf("slow %s for verb=%q resource=%q took %s", kind, verb, resource, duration)
+	} else {
+		dcontext.GetLogger(ctx).Debugf("%s for verb=%q resource=%q took %s", kind, verb, resource, duration)
+	}
+}
+
+func (c *measuredReviewsClient) SelfSubjectReviews() client.SelfSubjectReviewInterface {
+	return &measuredSelfSubjectReviews{
+		SelfSubjectReviewInterface: c.Interface.SelfSubjectReviews(),
+		client:                     c,
+	}
+}
+
+func (c *measuredReviewsClient) SelfSubjectAccessReviews() client.SelfSubjectAccessReviewInterface {
+	return &measuredSelfSubjectAccessReviews{
+		SelfSubjectAccessReviewInterface: c.Interface.SelfSubjectAccessReviews(),
+		client:                           c,
+	}
+}
+
+func (c *measuredReviewsClient) SubjectAccessReviews() client.SubjectAccessReviewInterface {
+	return &measuredSubjectAccessReviews{
+		SubjectAccessReviewInterface: c.Interface.SubjectAccessReviews(),
+		client:                       c,
+	}
+}
+
+type measuredSelfSubjectReviews struct {
+	client.SelfSubjectReviewInterface
+
+	client *measuredReviewsClient
+}
+
+func (r *measuredSelfSubjectReviews) Create(ctx context.Context, ssr *authnv1.SelfSubjectReview, opts metav1.CreateOptions) (*authnv1.SelfSubjectReview, error) {
+	started := time.Now()
+	response, err := r.SelfSubjectReviewInterface.Create(ctx, ssr, opts)
+	r.client.observe(ctx, selfSubjectReviewKind, nil, started, err)
+	return response, err
+}
+
+type measuredSelfSubjectAccessReviews struct {
+	client.SelfSubjectAccessReviewInterface
+
+	client *measuredReviewsClient
+}
+
+func (r *measuredSelfSubjectAccessReviews) Create(ctx context.Context, sar *authorizationapi.SelfSubjectAccessReview, opts metav1.CreateOptions) (*authorizationapi.SelfSubjectAccessReview, error) {
+	started := time.Now()
+	response, err := r.SelfSubjectAccessReviewInterface.Create(ctx, sar, opts)
+	r.client.observe(ctx, selfSubjectAccessReviewKind, sar.Spec.ResourceAttributes, started, err)
+	return response, err
+}
+
+type measuredSubjectAccessReviews struct {
+	client.SubjectAccessReviewInterface
+
+	client *measuredReviewsClient
+}
+
+func (r *measuredSubjectAccessReviews) Create(ctx context.Context, sar *authorizationapi.SubjectAccessReview, opts metav1.CreateOptions) (*authorizationapi.SubjectAccessReview, error) {
+	started := time.Now()
+	response, err := r.SubjectAccessReviewInterface.Create(ctx, sar, opts)
+	r.client.observe(ctx, subjectAccessReviewKind, sar.Spec.ResourceAttributes, started, err)
+	return response, err
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	authorizationapi "k8s.io/api/authorization/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/metrics"
+	metricstesting "github.com/openshift/image-registry/pkg/dockerregistry/server/metrics/testing"
+	"github.com/openshift/image-registry/pkg/testutil"
+	"github.com/openshift/image-registry/pkg/testutil/counter"
+)
+
+func TestMeasuredAuthReviews(t *testing.T) {
+	ctx := testutil.WithTestLogger(context.Background(), t)
+
+	c, sink := metricstesting.NewCounterSink()
+	userClient := measureAuthReviews(&accessReviewClient{
+		Interface: client.NewFakeRegistryAPIClient(nil, nil),
+		allowed: func(attrs *authorizationapi.ResourceAttributes) bool {
+			return attrs.Namespace == "ns"
+		},
+	}, metrics.NewMetrics(sink).AuthReviews())
+
+	if err := verifyImageStreamAccess(ctx, "ns", "app", "get", userClient, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyImageStreamAccess(ctx, "other", "app", "update", userClient, nil); err != ErrOpenShiftAccessDenied {
+		t.Fatalf("got error %v, want %v", err, ErrOpenShiftAccessDenied)
+	}
+
+	failingClient := measureAuthReviews(&failingAccessReviewClient{
+		Interface: client.NewFakeRegistryAPIClient(nil, nil),
+		err:       kerrors.NewInternalError(context.DeadlineExceeded),
+	}, metrics.NewMetrics(sink).AuthReviews())
+	if err := verifyImageStreamAccess(ctx, "ns", "app", "get", failingClient, nil); err == nil {
+		t.Fatal("expected the review to fail")
+	}
+
+	if diff := c.Diff(counter.M{
+		"auth_review:selfsubjectaccessreview:get:imagestreams/layers":                      2,
+		"auth_review:selfsubjectaccessreview:update:imagestreams/layers":                   1,
+		"auth_review_errors:selfsubjectaccessreview:get:imagestreams/layers:InternalError": 1,
+	}); diff != nil {
+		t.Error(diff)
+	}
+}
+
+// failingAccessReviewClient fails all self subject access reviews with err.
+type failingAccessReviewClient struct {
+	client.Interface
+	err error
+}
+
+func (c *failingAccessReviewClient) SelfSubjectAccessReviews() client.SelfSubjectAccessReviewInterface {
+	return c
+}
+
+func (c *failingAccessReviewClient) Create(ctx context.Context, sar *authorizationapi.SelfSubjectAccessReview, opts metav1.CreateOptions) (*authorizationapi.SelfSubjectAccessReview, error) {
+	return nil, c.err
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/cache"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/prune"
+	regstorage "github.com/openshift/image-registry/pkg/dockerregistry/server/storage"
+)
+
+// forceBlobDeleteParam is the query parameter of DELETE
+// /v2/<name>/blobs/<digest> that makes the registry remove the data of the
+// blob from the storage if no other repository links it and no image uses it.
+// The data is removed in the background after the response. The deletion of
+// blobs requires the prune access.
+const forceBlobDeleteParam = "force"
+
+// isForceBlobDeleteRequest reports whether req is a blob deletion that asks
+// to remove the data of the blob.
+func isForceBlobDeleteRequest(req *http.Request) bool {
+	if req.Method != http.MethodDelete || !strings.Contains(req.URL.Path, "/blobs/") || strings.Contains(req.URL.Path, "/blobs/uploads/") {
+		return false
+	}
+	force, err := strconv.ParseBool(req.URL.Query().Get(forceBlobDeleteParam))
+	return err == nil && force
+}
+
+// blobDeletingBlobStore removes only the layer link of the repository when a
+// blob is deleted. The data of the blob is shared by all repositories that
+// have the same layer, so it is removed only if the deletion is forced, and
+// then only by the blobDataRemover of the application.
+type blobDeletingBlobStore struct {
+	distribution.BlobStore
+
+	repo *repository
+}
+
+var _ distribution.BlobStore = &blobDeletingBlobStore{}
+
+func (bs *blobDeletingBlobStore) Delete(ctx context.Context, dgst digest.Digest) error {
+	err := bs.BlobStore.Delete(ctx, dgst)
+	if errors.As(err, &storagedriver.PathNotFoundError{}) {
+		// The blob is available in the repository through its image
+		// stream, but it isn't linked in the repository, so there is
+		// nothing to delete.
+		return distribution.ErrBlobUnknown
+	}
+	if err != nil {
+		return err
+	}
+
+	if !forceBlobDelete(ctx) {
+		return nil
+	}
+
+	bs.repo.app.blobDataRemover.Add(dgst)
+	return nil
+}
+
+// blobDataRemovalDelay is the time the forced deletions are collected before
+// their blobs are checked, so that the deletions of the layers of an image
+// share one walk of the storage and one listing of the images.
+const blobDataRemovalDelay = 10 * time.Second
+
+// blobDataRemover removes the data of the blobs whose deletions are forced.
+// The data is kept if another repository still links the blob or an Image
+// uses it, the same way as the pruner keeps the blobs of the images.
+type blobDataRemover struct {
+	driver      storagedriver.StorageDriver
+	trash       *regstorage.Trash
+	digestCache cache.DigestCache
+
+	// blobsInUse returns the blobs that are used by images.
+	blobsInUse func(ctx context.Context) (map[string]string, error)
+
+	mu      sync.Mutex
+	pending map[digest.Digest]struct{}
+	added   chan struct{}
+}
+
+func (app *App) newBlobDataRemover() *blobDataRemover {
+	return &blobDataRemover{
+		driver:      app.driver,
+		trash:       app.trash,
+		digestCache: app.cache,
+		blobsInUse: func(ctx context.Context) (map[string]string, error) {
+			return prune.BlobsInUse(ctx, app.registryClient)
+		},
+		pending: make(map[digest.Digest]struct{}),
+		added:   make(chan struct{}, 1),
+	}
+}
+
+// Add queues the removal of the data of the blob dgst.
+func (r *blobDataRemover) Add(dgst digest.Digest) {
+	r.mu.Lock()
+	r.pending[dgst] = struct{}{}
+	r.mu.Unlock()
+
+	select {
+	case r.added <- struct{}{}:
+	default:
+	}
+}
+
+// Run removes the data of the queued blobs until ctx is done.
+func (r *blobDataRemover) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.added:
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(blobDataRemovalDelay):
+		}
+		r.remove(ctx)
+	}
+}
+
+// remove removes the data of the queued blobs that are neither linked nor
+// used by images. If the blobs cannot be checked, their data is kept until
+// the pruning of the registry.
+func (r *blobDataRemover) remove(ctx context.Context) {
+	r.mu.Lock()
+	pending := r.pending
+	r.pending = make(map[digest.Digest]struct{})
+	r.mu.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+
+	links, err := regstorage.LayerLinks(ctx, r.driver)
+	if err != nil {
+		dcontext.GetLogger(ctx).Errorf("unable to get the layer links, keeping the data of %d deleted blobs: %v", len(pending), err)
+		return
+	}
+	inuse, err := r.blobsInUse(ctx)
+	if err != nil {
+		dcontext.GetLogger(ctx).Errorf("unable to get the blobs used by images, keeping the data of %d deleted blobs: %v", len(pending), err)
+		return
+	}
+
+	for dgst := range pending {
+		repo, err := r.linkingRepository(ctx, dgst, links[dgst])
+		if err != nil {
+			dcontext.GetLogger(ctx).Errorf("unable to check the layer links of the blob %s, keeping its data: %v", dgst, err)
+			continue
+		}
+		if repo != "" {
+			dcontext.GetLogger(ctx).Infof("keeping the data of the blob %s, it is still linked in the repository %s", dgst, repo)
+			continue
+		}
+		if ref, ok := inuse[dgst.String()]; ok {
+			dcontext.GetLogger(ctx).Infof("keeping the data of the blob %s, it is used by the image %s", dgst, ref)
+			continue
+		}
+
+		dcontext.GetLogger(ctx).Infof("removing the data of the blob %s, it isn't linked in any repository", dgst)
+		if err := removeBlobData(ctx, r.driver, r.trash, r.digestCache, dgst); err != nil {
+			dcontext.GetLogger(ctx).Errorf("unable to remove the data of the blob %s: %v", dgst, err)
+		}
+	}
+}
+
+// linkingRepository returns the first of repos that still has the layer link
+// of the blob dgst. The layer directories are left behind by the deletion of
+// their links, so the links themselves are checked.
+func (r *blobDataRemover) linkingRepository(ctx context.Context, dgst digest.Digest, repos []string) (string, error) {
+	for _, repo := range repos {
+		_, err := r.driver.Stat(ctx, regstorage.LayerLinkPath(repo, dgst))
+		if err == nil {
+			return repo, nil
+		}
+		if !errors.As(err, &storagedriver.PathNotFoundError{}) {
+			return "", err
+		}
+	}
+	return "", nil
+}
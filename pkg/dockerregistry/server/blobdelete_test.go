@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/cache"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/metrics"
+	regstorage "github.com/openshift/image-registry/pkg/dockerregistry/server/storage"
+	"github.com/openshift/image-registry/pkg/testutil"
+)
+
+func TestBlobDeletingBlobStore(t *testing.T) {
+	ctx := testutil.WithTestLogger(context.Background(), t)
+
+	driver := inmemory.New()
+	registry, err := storage.NewRegistry(ctx, driver, storage.EnableDelete)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digestCache, err := cache.NewBlobDigest(5, 3, time.Minute, metrics.NewNoopMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &App{
+		driver:   driver,
+		registry: registry,
+		cache:    digestCache,
+	}
+	inuse := map[string]string{}
+	app.blobDataRemover = app.newBlobDataRemover()
+	app.blobDataRemover.blobsInUse = func(ctx context.Context) (map[string]string, error) {
+		return inuse, nil
+	}
+
+	newBlobStore := func(name string) distribution.BlobStore {
+		named, err := reference.WithName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		repo, err := registry.Repository(ctx, named)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &blobDeletingBlobStore{
+			BlobStore: repo.Blobs(ctx),
+			repo:      &repository{Repository: repo, app: app},
+		}
+	}
+
+	// The layer is shared by both repositories.
+	foo := newBlobStore("user/foo")
+	bar := newBlobStore("user/bar")
+	content := []byte("shared layer")
+	desc, err := foo.Put(ctx, "application/octet-stream", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bar.Put(ctx, "application/octet-stream", content); err != nil {
+		t.Fatal(err)
+	}
+
+	dataExists := func() bool {
+		_, err := driver.Stat(ctx, regstorage.BlobDataPath(desc.Digest))
+		return err == nil
+	}
+
+	// The deletion is forced, but bar still needs the data.
+	if err := foo.Delete(withForceBlobDelete(ctx), desc.Digest); err != nil {
+		t.Fatal(err)
+	}
+	app.blobDataRemover.remove(ctx)
+	if _, err := foo.Stat(ctx, desc.Digest); err != distribution.ErrBlobUnknown {
+		t.Fatalf("expected the blob to be unlinked from user/foo, got %v", err)
+	}
+	if _, err := bar.Stat(ctx, desc.Digest); err != nil {
+		t.Fatalf("expected the blob to be available in user/bar: %v", err)
+	}
+	if !dataExists() {
+		t.Fatal("expected the data of the shared blob to be kept")
+	}
+
+	if err := foo.Delete(ctx, desc.Digest); err != distribution.ErrBlobUnknown {
+		t.Fatalf("expected ErrBlobUnknown for the unlinked blob, got %v", err)
+	}
+
+	// Without the force flag only the link is removed.
+	if _, err := foo.Put(ctx, "application/octet-stream", content); err != nil {
+		t.Fatal(err)
+	}
+	if err := bar.Delete(ctx, desc.Digest); err != nil {
+		t.Fatal(err)
+	}
+	if err := foo.Delete(ctx, desc.Digest); err != nil {
+		t.Fatal(err)
+	}
+	if !dataExists() {
+		t.Fatal("expected the data to be kept without the force flag")
+	}
+
+	// The last reference is removed with the force flag.
+	if _, err := bar.Put(ctx, "application/octet-stream", content); err != nil {
+		t.Fatal(err)
+	}
+	if err := bar.Delete(withForceBlobDelete(ctx), desc.Digest); err != nil {
+		t.Fatal(err)
+	}
+	if !dataExists() {
+		t.Fatal("expected the data to be removed in the background")
+	}
+	inuse[desc.Digest.String()] = "user/foo@" + desc.Digest.String()
+	app.blobDataRemover.remove(ctx)
+	if !dataExists() {
+		t.Fatal("expected the data of the blob used by an image to be kept")
+	}
+
+	// The deletion is forced again after the image is deleted.
+	delete(inuse, desc.Digest.String())
+	if _, err := bar.Put(ctx, "application/octet-stream", content); err != nil {
+		t.Fatal(err)
+	}
+	if err := bar.Delete(withForceBlobDelete(ctx), desc.Digest); err != nil {
+		t.Fatal(err)
+	}
+	app.blobDataRemover.remove(ctx)
+	if dataExists() {
+		t.Fatal("expected the data of the unreferenced blob to be removed")
+	}
+}
+
+func TestIsForceBlobDeleteRequest(t *testing.T) {
+	for _, tc := range []struct {
+		method string
+		url    string
+		force  bool
+	}{
+		{method: http.MethodDelete, url: "/v2/user/app/blobs/sha256:abc?force=true", force: true},
+		{method: http.MethodDelete, url: "/v2/user/app/blobs/sha256:abc"},
+		{method: http.MethodDelete, url: "/v2/user/app/blobs/sha256:abc?force=no"},
+		{method: http.MethodDelete, url: "/v2/user/app/blobs/uploads/123?force=true"},
+		{method: http.MethodDelete, url: "/v2/user/app/manifests/sha256:abc?force=true"},
+		{method: http.MethodGet, url: "/v2/user/app/blobs/sha256:abc?force=true"},
+	} {
+		req := httptest.NewRequest(tc.method, tc.url, nil)
+		if force := isForceBlobDeleteRequest(req); force != tc.force {
+			t.Errorf("%s %s: got %t, want %t", tc.method, tc.url, force, tc.force)
+		}
+	}
+}
@@ -2,22 +2,36 @@ package server
 
 import (
 	"context"
+	// Register sha512 so that digests using this algorithm are valid.
+	_ "crypto/sha512"
 
 	"github.com/distribution/distribution/v3"
 	dcontext "github.com/distribution/distribution/v3/context"
 	"github.com/opencontainers/go-digest"
+
+	imageapiv1 "github.com/openshift/api/image/v1"
 )
 
 const (
-	// DigestSha256EmptyTar is the canonical sha256 digest of empty data
-	digestSha256EmptyTar = digest.Digest("sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855")
+	// digestSHA256EmptyTar is the canonical sha256 digest of empty data
+	digestSHA256EmptyTar = digest.Digest("sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855")
 
 	// digestSHA256GzippedEmptyTar is the canonical sha256 digest of gzippedEmptyTar
 	digestSHA256GzippedEmptyTar = digest.Digest("sha256:a3ed95caeb02ffe68cdd9fd84406680ae93d633cb16422d00e8a7c22955b46d4")
+
+	// digestSHA512EmptyTar is the sha512 digest of empty data
+	digestSHA512EmptyTar = digest.Digest("sha512:cf83e1357eefb8bdf1542850d66d8007d620e4050b5715dc83f4a921d36ce9ce47d0d13c5d85f2b0ff8318d2877eec2f63b931bd47417a81a538327af927da3e")
+
+	// digestSHA512GzippedEmptyTar is the sha512 digest of gzippedEmptyTar
+	digestSHA512GzippedEmptyTar = digest.Digest("sha512:d821ea66df9bca548b237085143c3d028ff931f339efa1027eec114394ba9f1c6cbe9f83e49131879b1b0f558551a95b4740c4d5322a3aaf23927c22815750a7")
 )
 
 func isEmptyDigest(dgst digest.Digest) bool {
-	return dgst == digestSha256EmptyTar || dgst == digestSHA256GzippedEmptyTar
+	switch dgst {
+	case digestSHA256EmptyTar, digestSHA256GzippedEmptyTar, digestSHA512EmptyTar, digestSHA512GzippedEmptyTar:
+		return true
+	}
+	return false
 }
 
 type blobDescriptorServiceFactoryFunc func(svc distribution.BlobDescriptorService) distribution.BlobDescriptorService
@@ -53,17 +67,37 @@ func (bs *blobDescriptorService) Stat(ctx context.Context, dgst digest.Digest) (
 
 	// Empty layers are considered to be "public" and we don't need to check whether they are referenced - schema v2
 	// has no empty layers.
-	if isEmptyDigest(dgst) {
+	if isEmptyDigest(dgst) || isEmptyDigest(desc.Digest) {
 		return desc, nil
 	}
 
+	// The blob store returns the canonical descriptor, so the requested
+	// digest may be calculated with another algorithm (e.g. sha512). The
+	// image stream may reference the blob by either of them.
+	dgsts := []digest.Digest{dgst}
+	if len(desc.Digest) > 0 && desc.Digest != dgst {
+		dgsts = append(dgsts, desc.Digest)
+	}
+
 	// ensure it's referenced inside of corresponding image stream
-	if bs.repo.cache.ContainsRepository(dgst, bs.repo.imageStream.Reference()) {
-		dcontext.GetLogger(ctx).Debugf("(*blobDescriptorService).Stat: found cached blob %q in repository %s", dgst.String(), bs.repo.imageStream.Reference())
-		return desc, nil
+	for _, d := range dgsts {
+		if bs.repo.cache.ContainsRepository(d, bs.repo.imageStream.Reference()) {
+			dcontext.GetLogger(ctx).Debugf("(*blobDescriptorService).Stat: found cached blob %q in repository %s", d.String(), bs.repo.imageStream.Reference())
+			return desc, nil
+		}
 	}
 
-	found, layers, image := bs.repo.imageStream.HasBlob(ctx, dgst)
+	var (
+		found  bool
+		layers *imageapiv1.ImageStreamLayers
+		image  *imageapiv1.Image
+	)
+	for _, d := range dgsts {
+		found, layers, image = bs.repo.imageStream.HasBlob(ctx, d)
+		if found {
+			break
+		}
+	}
 	if !found {
 		dcontext.GetLogger(ctx).Debugf("(*blobDescriptorService).Stat: blob %s is neither empty nor referenced in image stream %s", dgst.String(), bs.repo.Named().Name())
 		return distribution.Descriptor{}, distribution.ErrBlobUnknown
@@ -13,13 +13,19 @@ import (
 
 	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/configuration"
+	"github.com/distribution/distribution/v3/reference"
 	"github.com/distribution/distribution/v3/registry/api/errcode"
 	registryauth "github.com/distribution/distribution/v3/registry/auth"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
 	"github.com/opencontainers/go-digest"
 
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/cache"
 	registryclient "github.com/openshift/image-registry/pkg/dockerregistry/server/client"
 	srvconfig "github.com/openshift/image-registry/pkg/dockerregistry/server/configuration"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/metrics"
 	"github.com/openshift/image-registry/pkg/dockerregistry/server/supermiddleware"
+	"github.com/openshift/image-registry/pkg/imagestream"
 	"github.com/openshift/image-registry/pkg/testutil"
 )
 
@@ -423,3 +429,84 @@ func (f *fakeAccessController) Authorized(ctx context.Context, access ...registr
 
 	return ctx, nil
 }
+
+func TestIsEmptyDigest(t *testing.T) {
+	gzippedEmptyTar := []byte{
+		31, 139, 8, 0, 0, 9, 110, 136, 0, 255, 98, 24, 5, 163, 96, 20, 140, 88,
+		0, 8, 0, 0, 255, 255, 46, 175, 181, 239, 0, 4, 0, 0,
+	}
+
+	for _, alg := range []digest.Algorithm{digest.SHA256, digest.SHA512} {
+		for _, content := range [][]byte{{}, gzippedEmptyTar} {
+			dgst := alg.FromBytes(content)
+			if !isEmptyDigest(dgst) {
+				t.Errorf("isEmptyDigest(%s): got false, want true", dgst)
+			}
+		}
+	}
+
+	if dgst := digest.SHA512.FromString("foo"); isEmptyDigest(dgst) {
+		t.Errorf("isEmptyDigest(%s): got true, want false", dgst)
+	}
+}
+
+// unlinkedBlobDescriptorService is a blob descriptor service of a repository
+// without layer links.
+type unlinkedBlobDescriptorService struct {
+	distribution.BlobDescriptorService
+}
+
+func (bs unlinkedBlobDescriptorService) Stat(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, error) {
+	return distribution.Descriptor{}, distribution.ErrBlobUnknown
+}
+
+func TestBlobDescriptorServiceStatSHA512(t *testing.T) {
+	ctx := context.Background()
+	ctx = testutil.WithTestLogger(ctx, t)
+
+	fos, imageClient := testutil.NewFakeOpenShiftWithClient(ctx)
+	image := testutil.AddRandomImage(t, fos, "user", "app", "latest")
+	dgst256 := digest.Digest(image.DockerImageLayers[0].Name)
+	dgst512 := digest.SHA512.FromString("layer")
+
+	digestCache, err := cache.NewBlobDigest(5, 3, time.Hour, metrics.NewNoopMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The blob was pushed with the sha512 digest, but it is stored under
+	// its canonical sha256 digest.
+	desc := distribution.Descriptor{Digest: dgst256, Size: image.DockerImageLayers[0].LayerSize}
+	if err := (&cache.Provider{Cache: digestCache}).SetDescriptor(ctx, dgst512, desc); err != nil {
+		t.Fatal(err)
+	}
+
+	registry, err := storage.NewRegistry(ctx, inmemory.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	named, err := reference.WithName("user/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := &blobDescriptorService{
+		BlobDescriptorService: unlinkedBlobDescriptorService{},
+		repo: &repository{
+			Repository:  &namedRepository{name: named},
+			app:         &App{registry: registry, cache: digestCache},
+			imageStream: imagestream.New(ctx, "user", "app", registryclient.NewFakeRegistryAPIClient(nil, imageClient)),
+			cache:       cache.NewRepositoryDigest(digestCache),
+		},
+	}
+
+	got, err := bs.Stat(ctx, dgst512)
+	if err != nil {
+		t.Fatalf("unable to stat the blob by its sha512 digest: %v", err)
+	}
+	if got.Digest != dgst256 {
+		t.Errorf("got digest %s, want %s", got.Digest, dgst256)
+	}
+
+	if _, err := bs.Stat(ctx, digest.SHA512.FromString("unknown")); err != distribution.ErrBlobUnknown {
+		t.Errorf("got error %v for the unknown sha512 digest, want %v", err, distribution.ErrBlobUnknown)
+	}
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/opencontainers/go-digest"
+)
+
+// maxBlobFailovers is how many times a single download of a remote blob can
+// be moved to another candidate repository.
+const maxBlobFailovers = 3
+
+// errNoAlternateBlobSource is returned when there is no other candidate
+// repository to continue a download from.
+var errNoAlternateBlobSource = errors.New("no alternate source for the blob")
+
+// blobFailover is implemented by blob getters that can open a blob in
+// another candidate repository when the download from the current one
+// fails.
+type blobFailover interface {
+	// Failover excludes the repository that is currently used for the
+	// blob dgst and opens the blob in the next candidate repository.
+	Failover(ctx context.Context, dgst digest.Digest) (distribution.ReadSeekCloser, error)
+}
+
+// openBlobWithFailover opens the remote blob dgst. If the getter supports
+// failover, the returned reader continues the download from another
+// candidate repository when the connection to the current one breaks.
+func openBlobWithFailover(ctx context.Context, store BlobGetterService, dgst digest.Digest, size int64) (distribution.ReadSeekCloser, error) {
+	rsc, err := store.Open(ctx, dgst)
+	if err != nil {
+		return nil, err
+	}
+
+	failover, ok := store.(blobFailover)
+	if !ok {
+		return rsc, nil
+	}
+
+	return &failoverBlobReader{
+		ctx:      ctx,
+		failover: failover,
+		dgst:     dgst,
+		size:     size,
+		rsc:      rsc,
+	}, nil
+}
+
+// failoverBlobReader reads a remote blob. When the read fails before the end
+// of the blob, the reader is replaced by a reader from the next candidate
+// repository that is positioned at the current offset, so that the client
+// receives the blob without interruption.
+type failoverBlobReader struct {
+	ctx      context.Context
+	failover blobFailover
+	dgst     digest.Digest
+	size     int64
+
+	rsc       distribution.ReadSeekCloser
+	offset    int64
+	failovers int
+}
+
+var _ distribution.ReadSeekCloser = &failoverBlobReader{}
+
+func (r *failoverBlobReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.rsc.Read(p)
+		r.offset += int64(n)
+		if err == nil || (err == io.EOF && r.offset >= r.size) {
+			return n, err
+		}
+
+		if failoverErr := r.next(err); failoverErr != nil {
+			dcontext.GetLogger(r.ctx).Errorf("unable to continue the download of %s at offset %d: %v", r.dgst, r.offset, failoverErr)
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// next replaces the current reader, which failed with err, by a reader from
+// the next candidate repository.
+func (r *failoverBlobReader) next(err error) error {
+	if r.failovers >= maxBlobFailovers {
+		return errNoAlternateBlobSource
+	}
+	r.failovers++
+
+	dcontext.GetLogger(r.ctx).Warnf("download of %s failed at offset %d, trying another repository: %v", r.dgst, r.offset, err)
+
+	rsc, err := r.failover.Failover(r.ctx, r.dgst)
+	if err != nil {
+		return err
+	}
+	if _, err := rsc.Seek(r.offset, io.SeekStart); err != nil {
+		_ = rsc.Close()
+		return err
+	}
+
+	_ = r.rsc.Close()
+	r.rsc = rsc
+	return nil
+}
+
+func (r *failoverBlobReader) Seek(offset int64, whence int) (int64, error) {
+	n, err := r.rsc.Seek(offset, whence)
+	if err != nil {
+		return n, err
+	}
+	r.offset = n
+	return n, nil
+}
+
+func (r *failoverBlobReader) Close() error {
+	return r.rsc.Close()
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/openshift/image-registry/pkg/testutil"
+)
+
+var errConnectionReset = errors.New("connection reset by peer")
+
+// brokenBlobReader fails when it reaches failAt.
+type brokenBlobReader struct {
+	*bytes.Reader
+	failAt int64
+}
+
+func (r *brokenBlobReader) Read(p []byte) (int, error) {
+	offset := r.Size() - int64(r.Len())
+	if r.failAt >= 0 {
+		if offset >= r.failAt {
+			return 0, errConnectionReset
+		}
+		if rest := r.failAt - offset; int64(len(p)) > rest {
+			p = p[:rest]
+		}
+	}
+	return r.Reader.Read(p)
+}
+
+func (r *brokenBlobReader) Close() error {
+	return nil
+}
+
+// failoverBlobGetter serves the blob from the sources in order, each source
+// fails at the given offset or never if the offset is negative.
+type failoverBlobGetter struct {
+	BlobGetterService
+
+	content []byte
+	sources []int64
+	opened  int
+}
+
+func (g *failoverBlobGetter) Stat(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, error) {
+	return distribution.Descriptor{Digest: dgst, Size: int64(len(g.content)), MediaType: "application/octet-stream"}, nil
+}
+
+func (g *failoverBlobGetter) Open(ctx context.Context, dgst digest.Digest) (distribution.ReadSeekCloser, error) {
+	return g.Failover(ctx, dgst)
+}
+
+func (g *failoverBlobGetter) Failover(ctx context.Context, dgst digest.Digest) (distribution.ReadSeekCloser, error) {
+	if g.opened >= len(g.sources) {
+		return nil, errNoAlternateBlobSource
+	}
+	failAt := g.sources[g.opened]
+	g.opened++
+	return &brokenBlobReader{Reader: bytes.NewReader(g.content), failAt: failAt}, nil
+}
+
+func TestCopyContentFailover(t *testing.T) {
+	ctx := context.Background()
+	ctx = testutil.WithTestLogger(ctx, t)
+
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	dgst := digest.FromBytes(content)
+
+	for _, tc := range []struct {
+		name        string
+		sources     []int64
+		rangeHeader string
+		expected    []byte
+	}{
+		{
+			name:     "no failures",
+			sources:  []int64{-1},
+			expected: content,
+		},
+		{
+			name:     "failure in the middle of the blob",
+			sources:  []int64{8000, -1},
+			expected: content,
+		},
+		{
+			name:     "several failures",
+			sources:  []int64{1000, 2000, 9999, -1},
+			expected: content,
+		},
+		{
+			name:        "range request",
+			sources:     []int64{5000, -1},
+			rangeHeader: "bytes=4000-5999",
+			expected:    content[4000:6000],
+		},
+		{
+			name:     "no alternate sources",
+			sources:  []int64{8000},
+			expected: content[:8000],
+		},
+		{
+			name:     "too many failures",
+			sources:  []int64{1000, 2000, 3000, 4000, -1},
+			expected: content[:4000],
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			store := &failoverBlobGetter{
+				content: content,
+				sources: tc.sources,
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/v2/user/app/blobs/"+dgst.String(), nil)
+			if tc.rangeHeader != "" {
+				req.Header.Set("Range", tc.rangeHeader)
+			}
+			w := httptest.NewRecorder()
+
+			// The response is already started when the download fails,
+			// so the client can only see that the body is truncated.
+			_, _ = copyContent(ctx, store, dgst, w, req)
+
+			if !bytes.Equal(w.Body.Bytes(), tc.expected) {
+				t.Errorf("got %d bytes, want %d bytes", w.Body.Len(), len(tc.expected))
+			}
+		})
+	}
+}
+
+func TestFailoverBlobReaderWithoutFailover(t *testing.T) {
+	ctx := context.Background()
+
+	content := []byte("content")
+	store := &failoverBlobGetter{content: content, sources: []int64{-1}}
+
+	// Getters that don't support failover are used as is.
+	rsc, err := openBlobWithFailover(ctx, struct{ BlobGetterService }{store}, digest.FromBytes(content), int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := rsc.(*failoverBlobReader); ok {
+		t.Errorf("expected the reader of the getter, got %T", rsc)
+	}
+	data, err := io.ReadAll(rsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, content) {
+		t.Errorf("got %q, want %q", data, content)
+	}
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/openshift/image-registry/pkg/imagestream"
+)
+
+// blobMediaTypeBlobStore wraps a distribution.BlobStore and sets the
+// Content-Type header of blob downloads to the media type of the blob in the
+// images of the image stream, e.g. a gzipped or zstd compressed layer or an
+// image config. The storage doesn't keep the media types of blobs, so they are
+// served as application/octet-stream otherwise.
+type blobMediaTypeBlobStore struct {
+	distribution.BlobStore
+
+	imageStream imagestream.ImageStream
+}
+
+var _ distribution.BlobStore = &blobMediaTypeBlobStore{}
+
+func (bs *blobMediaTypeBlobStore) ServeBlob(ctx context.Context, w http.ResponseWriter, req *http.Request, dgst digest.Digest) error {
+	mediaType := bs.mediaType(ctx, dgst)
+	if mediaType == "" {
+		return bs.BlobStore.ServeBlob(ctx, w, req, dgst)
+	}
+	return bs.BlobStore.ServeBlob(ctx, &blobMediaTypeResponseWriter{ResponseWriter: w, mediaType: mediaType}, req, dgst)
+}
+
+// mediaType returns the media type of the blob dgst from the layers of the
+// image stream, or an empty string if it's unknown.
+func (bs *blobMediaTypeBlobStore) mediaType(ctx context.Context, dgst digest.Digest) string {
+	layers, err := bs.imageStream.Layers(ctx)
+	if err != nil {
+		dcontext.GetLogger(ctx).Debugf("unable to get the media type of the blob %s: %v", dgst, err)
+		return ""
+	}
+	if blob, ok := layers.Blobs[dgst.String()]; ok {
+		return blob.MediaType
+	}
+	return ""
+}
+
+// blobMediaTypeResponseWriter sets the Content-Type header only for responses
+// with the content, the storage sets it after the wrapper is called.
+type blobMediaTypeResponseWriter struct {
+	http.ResponseWriter
+
+	mediaType   string
+	wroteHeader bool
+}
+
+func (w *blobMediaTypeResponseWriter) WriteHeader(statusCode int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		switch statusCode {
+		case http.StatusOK, http.StatusPartialContent:
+			w.Header().Set("Content-Type", w.mediaType)
+		}
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *blobMediaTypeResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
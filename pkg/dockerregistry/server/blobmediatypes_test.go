@@ -0,0 +1,84 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+	"github.com/openshift/image-registry/pkg/imagestream"
+	"github.com/openshift/image-registry/pkg/testutil"
+)
+
+func TestBlobMediaTypeBlobStoreServeBlob(t *testing.T) {
+	ctx := context.Background()
+	ctx = testutil.WithTestLogger(ctx, t)
+
+	const zstdLayer = "application/vnd.oci.image.layer.v1.tar+zstd"
+
+	fos, imageClient := testutil.NewFakeOpenShiftWithClient(ctx)
+	image, err := testutil.CreateRandomImage("ns", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	image.DockerImageLayers[0].MediaType = zstdLayer
+	testutil.AddImageStream(t, fos, "ns", "app", nil)
+	testutil.AddImage(t, fos, image, "ns", "app", "latest")
+
+	layer := digest.Digest(image.DockerImageLayers[0].Name)
+	other := digest.FromString("a blob that isn't a layer of the image stream")
+
+	for _, tc := range []struct {
+		name            string
+		method          string
+		dgst            digest.Digest
+		wantContentType string
+	}{
+		{
+			name:            "GET layer",
+			method:          http.MethodGet,
+			dgst:            layer,
+			wantContentType: zstdLayer,
+		},
+		{
+			name:            "HEAD layer",
+			method:          http.MethodHead,
+			dgst:            layer,
+			wantContentType: zstdLayer,
+		},
+		{
+			name:            "blob of another image stream",
+			method:          http.MethodGet,
+			dgst:            other,
+			wantContentType: "application/octet-stream",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			bs := &blobMediaTypeBlobStore{
+				BlobStore: testutil.NewFakeBlobStore(nil, testutil.BlobContents{
+					layer: []byte("layer"),
+					other: []byte("other"),
+				}),
+				imageStream: imagestream.New(ctx, "ns", "app", client.NewFakeRegistryAPIClient(nil, imageClient)),
+			}
+
+			req := httptest.NewRequest(tc.method, "/v2/ns/app/blobs/"+tc.dgst.String(), nil)
+			w := httptest.NewRecorder()
+			// The storage sets the media type of its descriptors.
+			w.Header().Set("Content-Type", "application/octet-stream")
+
+			if err := bs.ServeBlob(ctx, w, req, tc.dgst); err != nil {
+				t.Fatal(err)
+			}
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+			}
+			if contentType := w.Header().Get("Content-Type"); contentType != tc.wantContentType {
+				t.Errorf("got Content-Type %q, want %q", contentType, tc.wantContentType)
+			}
+		})
+	}
+}
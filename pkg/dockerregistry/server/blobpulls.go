@@ -0,0 +1,211 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// blobPullsDir is the location of the snapshots of the last pull times
+	// of blobs in the storage. Every replica writes its own snapshot, so
+	// that the replica that prunes the storage knows about the pulls from
+	// all of them.
+	blobPullsDir = "/openshift/pulls"
+
+	// blobPullsSnapshotInterval is how often the replicas save their
+	// snapshots. The pulls from other replicas are known to the pruning
+	// after this delay.
+	blobPullsSnapshotInterval = time.Minute
+
+	// blobPullsStaleAge is the age of the snapshots of the replicas that
+	// are gone. They are removed after their pulls are merged.
+	blobPullsStaleAge = time.Hour
+)
+
+// blobPulls keeps the time of the last pull of every blob. The stats of blobs
+// count as pulls, as the clients check that the blobs exist before they push
+// the manifests that use them, and the registry checks the blobs of the
+// pushed manifests.
+type blobPulls struct {
+	mu    sync.Mutex
+	times map[digest.Digest]time.Time
+	now   func() time.Time
+}
+
+func newBlobPulls() *blobPulls {
+	return &blobPulls{
+		times: make(map[digest.Digest]time.Time),
+		now:   time.Now,
+	}
+}
+
+// Record records a pull of the blob dgst.
+func (p *blobPulls) Record(dgst digest.Digest) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.times[dgst] = p.now()
+}
+
+// LastPull returns the time of the last pull of the blob dgst. It returns
+// false if the blob hasn't been pulled.
+func (p *blobPulls) LastPull(dgst digest.Digest) (time.Time, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	t, ok := p.times[dgst]
+	return t, ok
+}
+
+// Forget removes the blob dgst, e.g. after it was deleted.
+func (p *blobPulls) Forget(dgst digest.Digest) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.times, dgst)
+}
+
+// Retain forgets the blobs for which keep returns false, e.g. the blobs that
+// are no longer in the storage.
+func (p *blobPulls) Retain(keep func(dgst digest.Digest) bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for dgst := range p.times {
+		if !keep(dgst) {
+			delete(p.times, dgst)
+		}
+	}
+}
+
+// Snapshot returns the pull times as a JSON object with Unix times.
+func (p *blobPulls) Snapshot() ([]byte, error) {
+	p.mu.Lock()
+	times := make(map[digest.Digest]int64, len(p.times))
+	for dgst, t := range p.times {
+		times[dgst] = t.Unix()
+	}
+	p.mu.Unlock()
+	return json.Marshal(times)
+}
+
+// Merge adds the pull times from a snapshot. The later time is kept for the
+// blobs that are known already.
+func (p *blobPulls) Merge(data []byte) error {
+	var times map[digest.Digest]int64
+	if err := json.Unmarshal(data, &times); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for dgst, unix := range times {
+		t := time.Unix(unix, 0)
+		if t.After(p.times[dgst]) {
+			p.times[dgst] = t
+		}
+	}
+	return nil
+}
+
+// blobPullsSnapshotPath returns the location of the snapshot of the replica
+// identity.
+func blobPullsSnapshotPath(identity string) string {
+	return path.Join(blobPullsDir, identity+".json")
+}
+
+// mergeBlobPulls merges the snapshots of all replicas into the pull times. The
+// snapshots that are older than staleAge are removed after they are merged,
+// unless staleAge is 0. Errors are logged as the blobs without a pull time are
+// ordered by the time when they were pushed.
+func mergeBlobPulls(ctx context.Context, d storagedriver.StorageDriver, pulls *blobPulls, staleAge time.Duration) {
+	paths, err := d.List(ctx, blobPullsDir)
+	if _, ok := err.(storagedriver.PathNotFoundError); ok {
+		return
+	}
+	if err != nil {
+		dcontext.GetLogger(ctx).Errorf("unable to list blob pull snapshots in %s: %v", blobPullsDir, err)
+		return
+	}
+
+	for _, p := range paths {
+		fi, err := d.Stat(ctx, p)
+		if err != nil {
+			dcontext.GetLogger(ctx).Errorf("unable to get blob pull snapshot %s: %v", p, err)
+			continue
+		}
+		data, err := d.GetContent(ctx, p)
+		if err != nil {
+			dcontext.GetLogger(ctx).Errorf("unable to read blob pull snapshot %s: %v", p, err)
+			continue
+		}
+		if err := pulls.Merge(data); err != nil {
+			dcontext.GetLogger(ctx).Errorf("unable to restore blob pulls from %s: %v", p, err)
+			continue
+		}
+
+		// The pulls of the replica that is gone are kept in the snapshot
+		// of this replica.
+		if staleAge > 0 && pulls.now().Sub(fi.ModTime()) > staleAge {
+			dcontext.GetLogger(ctx).Infof("removing the stale blob pull snapshot %s", p)
+			if err := d.Delete(ctx, p); err != nil {
+				dcontext.GetLogger(ctx).Errorf("unable to remove blob pull snapshot %s: %v", p, err)
+			}
+		}
+	}
+}
+
+// runBlobPullsSnapshots saves snapshots of the pull times of the replica
+// identity every interval until ctx is done.
+func (app *App) runBlobPullsSnapshots(ctx context.Context, identity string, interval time.Duration) {
+	snapshotPath := blobPullsSnapshotPath(identity)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			data, err := app.blobPulls.Snapshot()
+			if err == nil {
+				err = app.driver.PutContent(ctx, snapshotPath, data)
+			}
+			if err != nil {
+				dcontext.GetLogger(ctx).Errorf("unable to save blob pull snapshot %s: %v", snapshotPath, err)
+			}
+		}
+	}
+}
+
+// pullRecordingBlobStore wraps a distribution.BlobStore and records the
+// time of successful blob downloads and stats.
+type pullRecordingBlobStore struct {
+	distribution.BlobStore
+
+	pulls *blobPulls
+}
+
+var _ distribution.BlobStore = &pullRecordingBlobStore{}
+
+func (bs *pullRecordingBlobStore) Stat(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, error) {
+	desc, err := bs.BlobStore.Stat(ctx, dgst)
+	if err == nil {
+		bs.pulls.Record(dgst)
+	}
+	return desc, err
+}
+
+func (bs *pullRecordingBlobStore) ServeBlob(ctx context.Context, w http.ResponseWriter, req *http.Request, dgst digest.Digest) error {
+	err := bs.BlobStore.ServeBlob(ctx, w, req, dgst)
+	if err == nil {
+		bs.pulls.Record(dgst)
+	}
+	return err
+}
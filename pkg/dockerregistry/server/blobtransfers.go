@@ -0,0 +1,31 @@
+package server
+
+import (
+	"net/http"
+)
+
+// sentBytesCounter is implemented by the response writers that count the
+// bytes sent to the client.
+type sentBytesCounter interface {
+	// countSent counts n bytes that are sent to the client without the
+	// Write method of the response writer.
+	countSent(n int64)
+}
+
+// countingResponseWriter counts the bytes of the response body.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+var _ sentBytesCounter = &countingResponseWriter{}
+
+func (w *countingResponseWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *countingResponseWriter) countSent(n int64) {
+	w.n += n
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/metrics"
+	metricstesting "github.com/openshift/image-registry/pkg/dockerregistry/server/metrics/testing"
+	"github.com/openshift/image-registry/pkg/testutil"
+)
+
+// contentBlobStore is a local blob store that serves content for every
+// digest, optionally through a connection writer like zeroCopyBlobStore.
+type contentBlobStore struct {
+	distribution.BlobStore
+
+	content  []byte
+	zeroCopy bool
+}
+
+func (bs contentBlobStore) ServeBlob(ctx context.Context, w http.ResponseWriter, req *http.Request, dgst digest.Digest) error {
+	if bs.zeroCopy {
+		w = &zeroCopyResponseWriter{ResponseWriter: w, conn: &bytes.Buffer{}}
+	}
+	_, err := io.Copy(w, bytes.NewReader(bs.content))
+	return err
+}
+
+func TestPullthroughServeBlobLocalTransfers(t *testing.T) {
+	ctx := testutil.WithTestLogger(context.Background(), t)
+	content := []byte("local layer")
+	dgst := digest.FromBytes(content)
+
+	for _, zeroCopy := range []bool{false, true} {
+		c, sink := metricstesting.NewCounterSink()
+		pbs := &pullthroughBlobStore{
+			BlobStore: contentBlobStore{content: content, zeroCopy: zeroCopy},
+			transfers: metrics.NewMetrics(sink).BlobTransfers(),
+			namespace: "ns",
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/v2/ns/is/blobs/"+dgst.String(), nil)
+		if err := pbs.ServeBlob(ctx, httptest.NewRecorder(), req, dgst); err != nil {
+			t.Fatal(err)
+		}
+
+		values := c.Values()
+		if served := values["blob_served_bytes:ns:local"]; served != len(content) {
+			t.Errorf("zeroCopy=%t: got %d bytes served locally, want %d", zeroCopy, served, len(content))
+		}
+		if served := values["blob_served_bytes:ns:pullthrough"]; served != 0 {
+			t.Errorf("zeroCopy=%t: got %d bytes served through pullthrough, want 0", zeroCopy, served)
+		}
+	}
+}
@@ -19,7 +19,10 @@ type DigestCache interface {
 	Repositories(dgst digest.Digest) []string
 	Remove(dgst digest.Digest) error
 	ScopedRemove(dgst digest.Digest, repository string) error
+	RemoveRepository(repository string) int
 	Add(dgst digest.Digest, value *DigestValue) error
+	Snapshot() ([]byte, error)
+	Restore(data []byte) error
 }
 
 type DigestValue struct {
@@ -31,31 +34,110 @@ type DigestItem struct {
 	expireTime   time.Time
 	desc         *distribution.Descriptor
 	repositories *simplelru.LRU
+
+	// aliases contains all the digests (calculated with different
+	// algorithms) under which the item is stored.
+	aliases map[digest.Digest]struct{}
 }
 
+const (
+	// descriptorCacheName is the name of the descriptor cache in metrics.
+	descriptorCacheName = "descriptor"
+
+	// digestToRepositoryCacheName is the name of the cache of repositories
+	// that contain a digest in metrics.
+	digestToRepositoryCacheName = "digest_to_repository"
+)
+
 type digestCache struct {
 	ttl      time.Duration
 	repoSize int
 	metrics  metrics.DigestCache
 
+	descriptorMetrics metrics.InternalCache
+	repoMetrics       metrics.InternalCache
+
 	mu    sync.Mutex
 	clock clock.Clock
 	lru   *simplelru.LRU
+
+	// repoEntries is the number of repositories in all items.
+	repoEntries int
 }
 
 func NewBlobDigest(digestSize, repoSize int, itemTTL time.Duration, metrics metrics.DigestCache) (DigestCache, error) {
-	lru, err := simplelru.NewLRU(digestSize, nil)
+	gbd := &digestCache{
+		ttl:               itemTTL,
+		repoSize:          repoSize,
+		metrics:           metrics,
+		descriptorMetrics: metrics.InternalCache(descriptorCacheName),
+		repoMetrics:       metrics.InternalCache(digestToRepositoryCacheName),
+		clock:             clock.RealClock{},
+	}
+
+	lru, err := simplelru.NewLRU(digestSize, gbd.onEvict)
 	if err != nil {
 		return nil, err
 	}
+	gbd.lru = lru
+
+	return gbd, nil
+}
+
+// onEvict purges the repositories of the item when it is removed under its
+// last digest, so that they are not counted in the metrics anymore.
+func (gbd *digestCache) onEvict(key interface{}, value interface{}) {
+	d, _ := value.(*DigestItem)
+	if d == nil {
+		return
+	}
+	for alias := range d.aliases {
+		if alias == key {
+			continue
+		}
+		if v, ok := gbd.lru.Peek(alias); ok && v == value {
+			return
+		}
+	}
+	d.repositories.Purge()
+}
+
+// newRepositories returns a new LRU for the repositories of an item.
+func (gbd *digestCache) newRepositories() (*simplelru.LRU, error) {
+	return simplelru.NewLRU(gbd.repoSize, func(key interface{}, value interface{}) {
+		gbd.repoEntries--
+	})
+}
+
+// addRepository adds repo to the repositories of the item and updates the
+// metrics.
+func (gbd *digestCache) addRepository(item *DigestItem, repo string) {
+	if item.repositories.Contains(repo) {
+		item.repositories.Add(repo, struct{}{})
+		return
+	}
+	gbd.repoEntries++
+	if item.repositories.Add(repo, struct{}{}) {
+		gbd.repoMetrics.Evict()
+	}
+}
+
+// addDigest adds the item under dgst and updates the metrics.
+func (gbd *digestCache) addDigest(dgst digest.Digest, item *DigestItem) {
+	// The LRU doesn't call the eviction callback when a value is replaced.
+	if old, ok := gbd.lru.Peek(dgst); ok && old != item {
+		gbd.onEvict(dgst, old)
+	}
+	if gbd.lru.Add(dgst, item) {
+		gbd.descriptorMetrics.Evict()
+	}
+}
 
-	return &digestCache{
-		ttl:      itemTTL,
-		repoSize: repoSize,
-		metrics:  metrics,
-		clock:    clock.RealClock{},
-		lru:      lru,
-	}, nil
+// updateEntries updates the metrics with the current number of entries. It
+// must be called with the lock held.
+func (gbd *digestCache) updateEntries() {
+	gbd.descriptorMetrics.Entries(gbd.lru.Len())
+	gbd.repoMetrics.Entries(gbd.repoEntries)
 }
 
 func (gbd *digestCache) get(dgst digest.Digest, reuse bool) *DigestItem {
@@ -97,12 +179,16 @@ func (gbd *digestCache) Get(dgst digest.Digest) (distribution.Descriptor, error)
 
 	value := gbd.get(dgst, false)
 
+	defer gbd.updateEntries()
+
 	if value == nil || value.desc == nil {
 		gbd.metrics.DigestCache().Request(false)
+		gbd.descriptorMetrics.Request(false)
 		return distribution.Descriptor{}, distribution.ErrBlobUnknown
 	}
 
 	gbd.metrics.DigestCache().Request(true)
+	gbd.descriptorMetrics.Request(true)
 	return *value.desc, nil
 }
 
@@ -120,12 +206,16 @@ func (gbd *digestCache) ScopedGet(dgst digest.Digest, repository string) (distri
 
 	value := gbd.get(dgst, false)
 
+	defer gbd.updateEntries()
+
 	if value == nil || value.desc == nil || !value.repositories.Contains(repository) {
 		gbd.metrics.DigestCacheScoped().Request(false)
+		gbd.repoMetrics.Request(false)
 		return distribution.Descriptor{}, distribution.ErrBlobUnknown
 	}
 
 	gbd.metrics.DigestCacheScoped().Request(true)
+	gbd.repoMetrics.Request(true)
 	return *value.desc, nil
 }
 
@@ -142,9 +232,12 @@ func (gbd *digestCache) Repositories(dgst digest.Digest) []string {
 	defer gbd.mu.Unlock()
 
 	item := gbd.get(dgst, false)
-	if item == nil {
+	defer gbd.updateEntries()
+	if item == nil || item.repositories.Len() == 0 {
+		gbd.repoMetrics.Request(false)
 		return nil
 	}
+	gbd.repoMetrics.Request(true)
 
 	var repos []string
 	for _, v := range item.repositories.Keys() {
@@ -165,6 +258,13 @@ func (gbd *digestCache) Remove(dgst digest.Digest) error {
 
 	gbd.mu.Lock()
 	defer gbd.mu.Unlock()
+	defer gbd.updateEntries()
+
+	if value := gbd.peek(dgst); value != nil {
+		for alias := range value.aliases {
+			gbd.lru.Remove(alias)
+		}
+	}
 
 	gbd.lru.Remove(dgst)
 	return nil
@@ -182,6 +282,8 @@ func (gbd *digestCache) ScopedRemove(dgst digest.Digest, repository string) erro
 	gbd.mu.Lock()
 	defer gbd.mu.Unlock()
 
+	defer gbd.updateEntries()
+
 	value := gbd.peek(dgst)
 
 	if value == nil {
@@ -192,6 +294,34 @@ func (gbd *digestCache) ScopedRemove(dgst digest.Digest, repository string) erro
 	return nil
 }
 
+// RemoveRepository removes the repository from the items of all digests that
+// are known to be in it. The descriptors are kept, they don't depend on the
+// repository. It returns the number of items the repository is removed from.
+func (gbd *digestCache) RemoveRepository(repository string) int {
+	if gbd.ttl == 0 {
+		return 0
+	}
+
+	gbd.mu.Lock()
+	defer gbd.mu.Unlock()
+
+	defer gbd.updateEntries()
+
+	removed := 0
+	for _, key := range gbd.lru.Keys() {
+		dgst := key.(digest.Digest)
+		value := gbd.peek(dgst)
+		if value == nil || !value.repositories.Contains(repository) {
+			continue
+		}
+		// The aliases share the value, so the repository is removed from
+		// it only once.
+		value.repositories.Remove(repository)
+		removed++
+	}
+	return removed
+}
+
 func (gbd *digestCache) Add(dgst digest.Digest, item *DigestValue) error {
 	if err := dgst.Validate(); err != nil {
 		return err
@@ -208,10 +338,12 @@ func (gbd *digestCache) Add(dgst digest.Digest, item *DigestValue) error {
 	gbd.mu.Lock()
 	defer gbd.mu.Unlock()
 
+	defer gbd.updateEntries()
+
 	value := gbd.get(dgst, true)
 
 	if value == nil {
-		lru, err := simplelru.NewLRU(gbd.repoSize, nil)
+		lru, err := gbd.newRepositories()
 		if err != nil {
 			return err
 		}
@@ -223,7 +355,7 @@ func (gbd *digestCache) Add(dgst digest.Digest, item *DigestValue) error {
 	}
 
 	if item.repo != nil {
-		value.repositories.Add(*item.repo, struct{}{})
+		gbd.addRepository(value, *item.repo)
 	}
 
 	if item.desc != nil {
@@ -231,11 +363,17 @@ func (gbd *digestCache) Add(dgst digest.Digest, item *DigestValue) error {
 
 		if dgst.Algorithm() != item.desc.Digest.Algorithm() && dgst != item.desc.Digest {
 			// if the digests differ, set the other canonical mapping
-			gbd.lru.Add(item.desc.Digest, value)
+			gbd.addDigest(item.desc.Digest, value)
+
+			if value.aliases == nil {
+				value.aliases = make(map[digest.Digest]struct{})
+			}
+			value.aliases[dgst] = struct{}{}
+			value.aliases[item.desc.Digest] = struct{}{}
 		}
 	}
 
-	gbd.lru.Add(dgst, value)
+	gbd.addDigest(dgst, value)
 
 	return nil
 }
@@ -12,6 +12,8 @@ import (
 	"github.com/opencontainers/go-digest"
 
 	"github.com/openshift/image-registry/pkg/dockerregistry/server/metrics"
+	metricstesting "github.com/openshift/image-registry/pkg/dockerregistry/server/metrics/testing"
+	"github.com/openshift/image-registry/pkg/testutil/counter"
 )
 
 const (
@@ -207,3 +209,129 @@ func TestDigestCacheDigestMigration(t *testing.T) {
 		t.Fatalf("unexpected digest: %#+v != %#+v", desc256.Digest, desc512.Digest)
 	}
 }
+
+func TestDigestCacheRemoveDigestAliases(t *testing.T) {
+	dgst256 := digest.Digest("sha256:4355a46b19d348dc2f57c046f8ef63d4538ebb936000f3c9ee954a27460dd865")
+	dgst512 := digest.Digest("sha512:3abb6677af34ac57c0ca5828fd94f9d886c26ce59a8ce60ecf6778079423dccff1d6f19cb655805d56098e6d38a1a710dee59523eed7511e5a9e4b8ccb3a4686")
+
+	cache, err := NewBlobDigest(5, 3, ttl1m, metrics.NewNoopMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = cache.Add(dgst512, &DigestValue{
+		desc: &distribution.Descriptor{
+			Digest: dgst256,
+			Size:   1234,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cache.Remove(dgst256); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dgst := range []digest.Digest{dgst256, dgst512} {
+		if _, err := cache.Get(dgst); err != distribution.ErrBlobUnknown {
+			t.Errorf("cache.Get(%s): got %v, want %v", dgst, err, distribution.ErrBlobUnknown)
+		}
+	}
+}
+
+func TestDigestCacheRemoveRepository(t *testing.T) {
+	dgst1 := digest.Digest("sha256:4355a46b19d348dc2f57c046f8ef63d4538ebb936000f3c9ee954a27460dd865")
+	dgst2 := digest.Digest("sha256:bef57ec7f53a6d40beb640a780a639c83bc29ac8a9816f1fc6c5c6dcd93c4721")
+	foo := "ns/foo"
+	bar := "ns/bar"
+
+	cache, err := NewBlobDigest(5, 3, ttl1m, metrics.NewNoopMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, item := range []struct {
+		dgst digest.Digest
+		repo *string
+	}{
+		{dgst: dgst1, repo: &foo},
+		{dgst: dgst1, repo: &bar},
+		{dgst: dgst2, repo: &bar},
+	} {
+		err := cache.Add(item.dgst, &DigestValue{
+			desc: &distribution.Descriptor{Digest: item.dgst, Size: 10},
+			repo: item.repo,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if removed := cache.RemoveRepository(foo); removed != 1 {
+		t.Errorf("got %d removed items, want 1", removed)
+	}
+
+	if _, err := cache.ScopedGet(dgst1, foo); err != distribution.ErrBlobUnknown {
+		t.Errorf("cache.ScopedGet(%s, %s): got %v, want %v", dgst1, foo, err, distribution.ErrBlobUnknown)
+	}
+	if _, err := cache.ScopedGet(dgst1, bar); err != nil {
+		t.Errorf("cache.ScopedGet(%s, %s): unexpected error: %v", dgst1, bar, err)
+	}
+	if _, err := cache.ScopedGet(dgst2, bar); err != nil {
+		t.Errorf("cache.ScopedGet(%s, %s): unexpected error: %v", dgst2, bar, err)
+	}
+}
+
+func TestDigestCacheMetrics(t *testing.T) {
+	dgst := digest.Digest("sha256:4355a46b19d348dc2f57c046f8ef63d4538ebb936000f3c9ee954a27460dd865")
+	other := digest.Digest("sha256:bef57ec7f53a6d40beb640a780a639c83bc29ac8a9816f1fc6c5c6dcd93c4721")
+
+	c, sink := metricstesting.NewCounterSink()
+	cache, err := NewBlobDigest(1, 1, ttl1m, metrics.NewMetrics(sink))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, repo := range []string{"foo", "bar"} {
+		repo := repo
+		if err := cache.Add(dgst, &DigestValue{desc: &distribution.Descriptor{Digest: dgst, Size: 1}, repo: &repo}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := cache.ScopedGet(dgst, "foo"); err != distribution.ErrBlobUnknown {
+		t.Fatalf("got error %v for evicted repository, want %v", err, distribution.ErrBlobUnknown)
+	}
+	if _, err := cache.ScopedGet(dgst, "bar"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.Get(dgst); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cache.Add(other, &DigestValue{desc: &distribution.Descriptor{Digest: other, Size: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.Get(dgst); err != distribution.ErrBlobUnknown {
+		t.Fatalf("got error %v for evicted digest, want %v", err, distribution.ErrBlobUnknown)
+	}
+
+	if diff := c.Diff(counter.M{
+		"digest_cache_requests:Hit":                1,
+		"digest_cache_requests:Miss":               1,
+		"digest_cache_scoped_requests:Hit":         1,
+		"digest_cache_scoped_requests:Miss":        1,
+		"cache_requests:descriptor:Hit":            1,
+		"cache_requests:descriptor:Miss":           1,
+		"cache_evictions:descriptor":               1,
+		"cache_entries:descriptor":                 1,
+		"cache_hit_ratio:descriptor":               50,
+		"cache_requests:digest_to_repository:Hit":  1,
+		"cache_requests:digest_to_repository:Miss": 1,
+		"cache_evictions:digest_to_repository":     1,
+		"cache_entries:digest_to_repository":       0,
+		"cache_hit_ratio:digest_to_repository":     50,
+	}); diff != nil {
+		t.Fatal(diff)
+	}
+}
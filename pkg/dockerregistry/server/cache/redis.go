@@ -0,0 +1,371 @@
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/gomodule/redigo/redis"
+	"github.com/opencontainers/go-digest"
+	"k8s.io/utils/clock"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/metrics"
+)
+
+// redisKeyPrefix is the prefix of all the keys of the digest cache in redis.
+const redisKeyPrefix = "openshift::digest::"
+
+// errRedisSnapshot is returned by the snapshot operations of the redis digest
+// cache. The redis server keeps the cache across restarts of the replicas.
+var errRedisSnapshot = errors.New("the redis digest cache cannot be snapshotted")
+
+// redisDigestCache is a digest cache that is kept in redis and shared by all
+// the replicas of the registry.
+//
+// The descriptor of a digest is stored in the key <prefix><digest> and its
+// repositories in the sorted set <prefix><digest>::repositories, ordered by
+// the time they were added. A digest calculated with another algorithm than
+// the digest of its descriptor is an alias, the key <prefix><digest>::alias
+// holds the digest under which the item is stored. The set
+// <prefix>repository::<name> contains the digests that were added to the
+// repository. Every write resets the expiration of the keys it touches.
+type redisDigestCache struct {
+	pool     *redis.Pool
+	ttl      time.Duration
+	repoSize int
+	metrics  metrics.DigestCache
+
+	descriptorMetrics metrics.InternalCache
+	repoMetrics       metrics.InternalCache
+
+	clock clock.Clock
+}
+
+var _ DigestCache = &redisDigestCache{}
+
+// NewRedisBlobDigest returns a digest cache that is stored in the redis
+// server of pool. At most repoSize repositories are kept for each digest.
+func NewRedisBlobDigest(pool *redis.Pool, repoSize int, itemTTL time.Duration, metrics metrics.DigestCache) (DigestCache, error) {
+	if pool == nil {
+		return nil, fmt.Errorf("redis is not configured")
+	}
+	if repoSize <= 0 {
+		return nil, fmt.Errorf("must provide a positive size")
+	}
+	return &redisDigestCache{
+		pool:              pool,
+		ttl:               itemTTL,
+		repoSize:          repoSize,
+		metrics:           metrics,
+		descriptorMetrics: metrics.InternalCache(descriptorCacheName),
+		repoMetrics:       metrics.InternalCache(digestToRepositoryCacheName),
+		clock:             clock.RealClock{},
+	}, nil
+}
+
+func redisDescriptorKey(dgst digest.Digest) string {
+	return redisKeyPrefix + dgst.String()
+}
+
+func redisRepositoriesKey(dgst digest.Digest) string {
+	return redisKeyPrefix + dgst.String() + "::repositories"
+}
+
+func redisAliasKey(dgst digest.Digest) string {
+	return redisKeyPrefix + dgst.String() + "::alias"
+}
+
+func redisRepositoryKey(repository string) string {
+	return redisKeyPrefix + "repository::" + repository
+}
+
+// ttlMilliseconds returns the expiration of the keys in milliseconds.
+func (c *redisDigestCache) ttlMilliseconds() int64 {
+	ms := c.ttl.Milliseconds()
+	if ms < 1 {
+		ms = 1
+	}
+	return ms
+}
+
+// resolve returns the digest under which the item of dgst is stored.
+func (c *redisDigestCache) resolve(conn redis.Conn, dgst digest.Digest) (digest.Digest, error) {
+	canonical, err := redis.String(conn.Do("GET", redisAliasKey(dgst)))
+	if err == redis.ErrNil {
+		return dgst, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return digest.Digest(canonical), nil
+}
+
+// descriptor returns the descriptor of the item stored under dgst, or nil if
+// it is unknown.
+func (c *redisDigestCache) descriptor(conn redis.Conn, dgst digest.Digest) (*distribution.Descriptor, error) {
+	data, err := redis.Bytes(conn.Do("GET", redisDescriptorKey(dgst)))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var desc distribution.Descriptor
+	if err := json.Unmarshal(data, &desc); err != nil {
+		return nil, err
+	}
+	return &desc, nil
+}
+
+func (c *redisDigestCache) Get(dgst digest.Digest) (distribution.Descriptor, error) {
+	if err := dgst.Validate(); err != nil {
+		return distribution.Descriptor{}, err
+	}
+
+	if c.ttl == 0 {
+		return distribution.Descriptor{}, distribution.ErrBlobUnknown
+	}
+
+	conn := c.pool.Get()
+	defer conn.Close()
+
+	// Errors of the redis server are cache misses, the callers get the
+	// descriptors from the storage.
+	var desc *distribution.Descriptor
+	canonical, err := c.resolve(conn, dgst)
+	if err == nil {
+		desc, err = c.descriptor(conn, canonical)
+	}
+	if err != nil || desc == nil {
+		c.metrics.DigestCache().Request(false)
+		c.descriptorMetrics.Request(false)
+		return distribution.Descriptor{}, distribution.ErrBlobUnknown
+	}
+
+	c.metrics.DigestCache().Request(true)
+	c.descriptorMetrics.Request(true)
+	return *desc, nil
+}
+
+func (c *redisDigestCache) ScopedGet(dgst digest.Digest, repository string) (distribution.Descriptor, error) {
+	if err := dgst.Validate(); err != nil {
+		return distribution.Descriptor{}, err
+	}
+
+	if c.ttl == 0 {
+		return distribution.Descriptor{}, distribution.ErrBlobUnknown
+	}
+
+	conn := c.pool.Get()
+	defer conn.Close()
+
+	var desc *distribution.Descriptor
+	found := false
+	canonical, err := c.resolve(conn, dgst)
+	if err == nil {
+		desc, err = c.descriptor(conn, canonical)
+	}
+	if err == nil && desc != nil {
+		_, err = redis.Float64(conn.Do("ZSCORE", redisRepositoriesKey(canonical), repository))
+		found = err == nil
+	}
+	if !found {
+		c.metrics.DigestCacheScoped().Request(false)
+		c.repoMetrics.Request(false)
+		return distribution.Descriptor{}, distribution.ErrBlobUnknown
+	}
+
+	c.metrics.DigestCacheScoped().Request(true)
+	c.repoMetrics.Request(true)
+	return *desc, nil
+}
+
+func (c *redisDigestCache) Repositories(dgst digest.Digest) []string {
+	if err := dgst.Validate(); err != nil {
+		return nil
+	}
+
+	if c.ttl == 0 {
+		return nil
+	}
+
+	conn := c.pool.Get()
+	defer conn.Close()
+
+	var repos []string
+	canonical, err := c.resolve(conn, dgst)
+	if err == nil {
+		repos, err = redis.Strings(conn.Do("ZRANGE", redisRepositoriesKey(canonical), 0, -1))
+	}
+	if err != nil || len(repos) == 0 {
+		c.repoMetrics.Request(false)
+		return nil
+	}
+	c.repoMetrics.Request(true)
+	return repos
+}
+
+func (c *redisDigestCache) Remove(dgst digest.Digest) error {
+	if err := dgst.Validate(); err != nil {
+		return err
+	}
+
+	if c.ttl == 0 {
+		return nil
+	}
+
+	conn := c.pool.Get()
+	defer conn.Close()
+
+	return c.remove(conn, dgst)
+}
+
+// remove deletes the item of dgst together with the alias of dgst.
+func (c *redisDigestCache) remove(conn redis.Conn, dgst digest.Digest) error {
+	canonical, err := c.resolve(conn, dgst)
+	if err != nil {
+		return err
+	}
+	keys := []interface{}{
+		redisDescriptorKey(canonical),
+		redisRepositoriesKey(canonical),
+		redisAliasKey(dgst),
+	}
+	_, err = conn.Do("DEL", keys...)
+	return err
+}
+
+func (c *redisDigestCache) ScopedRemove(dgst digest.Digest, repository string) error {
+	if err := dgst.Validate(); err != nil {
+		return err
+	}
+
+	if c.ttl == 0 {
+		return nil
+	}
+
+	conn := c.pool.Get()
+	defer conn.Close()
+
+	canonical, err := c.resolve(conn, dgst)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Do("ZREM", redisRepositoriesKey(canonical), repository)
+	return err
+}
+
+// RemoveRepository removes the repository from the items of all digests that
+// are known to be in it. The descriptors are kept, they don't depend on the
+// repository. It returns the number of items the repository is removed from.
+func (c *redisDigestCache) RemoveRepository(repository string) int {
+	if c.ttl == 0 {
+		return 0
+	}
+
+	conn := c.pool.Get()
+	defer conn.Close()
+
+	digests, err := redis.Strings(conn.Do("SMEMBERS", redisRepositoryKey(repository)))
+	if err != nil {
+		return 0
+	}
+
+	removed := 0
+	for _, d := range digests {
+		dgst := digest.Digest(d)
+		canonical, err := c.resolve(conn, dgst)
+		if err != nil {
+			continue
+		}
+		// The digest may have been removed from the repository since it
+		// was added to the set.
+		n, err := redis.Int(conn.Do("ZREM", redisRepositoriesKey(canonical), repository))
+		if err != nil {
+			continue
+		}
+		removed += n
+	}
+	_, _ = conn.Do("DEL", redisRepositoryKey(repository))
+	return removed
+}
+
+func (c *redisDigestCache) Add(dgst digest.Digest, item *DigestValue) error {
+	if err := dgst.Validate(); err != nil {
+		return err
+	}
+
+	if item == nil || (item.desc == nil && item.repo == nil) {
+		return nil
+	}
+
+	if c.ttl == 0 {
+		return nil
+	}
+
+	conn := c.pool.Get()
+	defer conn.Close()
+
+	ttl := c.ttlMilliseconds()
+
+	canonical := dgst
+	if item.desc != nil && dgst.Algorithm() != item.desc.Digest.Algorithm() && dgst != item.desc.Digest {
+		// the item is stored under the digest of the descriptor
+		canonical = item.desc.Digest
+		if _, err := conn.Do("SET", redisAliasKey(dgst), canonical.String(), "PX", ttl); err != nil {
+			return err
+		}
+	} else {
+		var err error
+		canonical, err = c.resolve(conn, dgst)
+		if err != nil {
+			return err
+		}
+	}
+
+	if item.desc != nil {
+		data, err := json.Marshal(item.desc)
+		if err != nil {
+			return err
+		}
+		if _, err := conn.Do("SET", redisDescriptorKey(canonical), data, "PX", ttl); err != nil {
+			return err
+		}
+	}
+
+	if item.repo != nil {
+		key := redisRepositoriesKey(canonical)
+		if _, err := conn.Do("ZADD", key, c.clock.Now().UnixNano(), *item.repo); err != nil {
+			return err
+		}
+		// keep only the most recently added repositories
+		if _, err := conn.Do("ZREMRANGEBYRANK", key, 0, -c.repoSize-1); err != nil {
+			return err
+		}
+		if _, err := conn.Do("PEXPIRE", key, ttl); err != nil {
+			return err
+		}
+
+		repoKey := redisRepositoryKey(*item.repo)
+		if _, err := conn.Do("SADD", repoKey, dgst.String()); err != nil {
+			return err
+		}
+		if _, err := conn.Do("PEXPIRE", repoKey, ttl); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Snapshot is not supported by the redis digest cache.
+func (c *redisDigestCache) Snapshot() ([]byte, error) {
+	return nil, errRedisSnapshot
+}
+
+// Restore is not supported by the redis digest cache.
+func (c *redisDigestCache) Restore(data []byte) error {
+	return errRedisSnapshot
+}
@@ -0,0 +1,309 @@
+package cache
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/gomodule/redigo/redis"
+	"github.com/opencontainers/go-digest"
+	clock "k8s.io/utils/clock/testing"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/metrics"
+)
+
+// fakeRedis is a redis server that supports the commands used by the digest
+// cache. The keys do not expire, their expiration is recorded in ttls.
+type fakeRedis struct {
+	mu      sync.Mutex
+	strings map[string][]byte
+	zsets   map[string]map[string]float64
+	sets    map[string]map[string]struct{}
+	ttls    map[string]int64
+}
+
+func newFakeRedis() *fakeRedis {
+	return &fakeRedis{
+		strings: make(map[string][]byte),
+		zsets:   make(map[string]map[string]float64),
+		sets:    make(map[string]map[string]struct{}),
+		ttls:    make(map[string]int64),
+	}
+}
+
+func (r *fakeRedis) pool() *redis.Pool {
+	return &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return &fakeRedisConn{server: r}, nil
+		},
+	}
+}
+
+type fakeRedisConn struct {
+	server *fakeRedis
+}
+
+func (c *fakeRedisConn) Close() error { return nil }
+func (c *fakeRedisConn) Err() error   { return nil }
+func (c *fakeRedisConn) Send(cmd string, args ...interface{}) error {
+	return fmt.Errorf("not supported")
+}
+func (c *fakeRedisConn) Flush() error                  { return nil }
+func (c *fakeRedisConn) Receive() (interface{}, error) { return nil, fmt.Errorf("not supported") }
+
+func (c *fakeRedisConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	r := c.server
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	str := func(i int) string {
+		switch v := args[i].(type) {
+		case string:
+			return v
+		case []byte:
+			return string(v)
+		default:
+			return fmt.Sprint(v)
+		}
+	}
+
+	switch cmd {
+	case "":
+		return nil, nil
+	case "GET":
+		v, ok := r.strings[str(0)]
+		if !ok {
+			return nil, nil
+		}
+		return v, nil
+	case "SET":
+		r.strings[str(0)] = []byte(str(1))
+		if len(args) == 4 && str(2) == "PX" {
+			r.ttls[str(0)] = args[3].(int64)
+		}
+		return "OK", nil
+	case "DEL":
+		n := int64(0)
+		for i := range args {
+			key := str(i)
+			if _, ok := r.strings[key]; ok {
+				n++
+			}
+			if _, ok := r.zsets[key]; ok {
+				n++
+			}
+			if _, ok := r.sets[key]; ok {
+				n++
+			}
+			delete(r.strings, key)
+			delete(r.zsets, key)
+			delete(r.sets, key)
+			delete(r.ttls, key)
+		}
+		return n, nil
+	case "PEXPIRE":
+		r.ttls[str(0)] = args[1].(int64)
+		return int64(1), nil
+	case "ZADD":
+		zset, ok := r.zsets[str(0)]
+		if !ok {
+			zset = make(map[string]float64)
+			r.zsets[str(0)] = zset
+		}
+		zset[str(2)] = float64(args[1].(int64))
+		return int64(1), nil
+	case "ZSCORE":
+		score, ok := r.zsets[str(0)][str(1)]
+		if !ok {
+			return nil, nil
+		}
+		return []byte(strconv.FormatFloat(score, 'g', -1, 64)), nil
+	case "ZREM":
+		if _, ok := r.zsets[str(0)][str(1)]; !ok {
+			return int64(0), nil
+		}
+		delete(r.zsets[str(0)], str(1))
+		return int64(1), nil
+	case "ZRANGE", "ZREMRANGEBYRANK":
+		zset := r.zsets[str(0)]
+		var members []string
+		for member := range zset {
+			members = append(members, member)
+		}
+		sort.Slice(members, func(i, j int) bool {
+			return zset[members[i]] < zset[members[j]]
+		})
+		start, stop := args[1].(int), args[2].(int)
+		if start < 0 {
+			start += len(members)
+		}
+		if stop < 0 {
+			stop += len(members)
+		}
+		if start < 0 {
+			start = 0
+		}
+		var reply []interface{}
+		for i := start; i <= stop && i < len(members); i++ {
+			if cmd == "ZREMRANGEBYRANK" {
+				delete(zset, members[i])
+			}
+			reply = append(reply, []byte(members[i]))
+		}
+		if cmd == "ZREMRANGEBYRANK" {
+			return int64(len(reply)), nil
+		}
+		return reply, nil
+	case "SADD":
+		set, ok := r.sets[str(0)]
+		if !ok {
+			set = make(map[string]struct{})
+			r.sets[str(0)] = set
+		}
+		set[str(1)] = struct{}{}
+		return int64(1), nil
+	case "SMEMBERS":
+		var reply []interface{}
+		for member := range r.sets[str(0)] {
+			reply = append(reply, []byte(member))
+		}
+		return reply, nil
+	}
+	return nil, fmt.Errorf("unsupported command %s", cmd)
+}
+
+func TestRedisDigestCache(t *testing.T) {
+	dgst := digest.Digest("sha256:4355a46b19d348dc2f57c046f8ef63d4538ebb936000f3c9ee954a27460dd865")
+	server := newFakeRedis()
+
+	// Two replicas of the registry share the cache.
+	first, err := NewRedisBlobDigest(server.pool(), 2, ttl1m, metrics.NewNoopMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewRedisBlobDigest(server.pool(), 2, ttl1m, metrics.NewNoopMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fakeClock := clock.NewFakeClock(time.Now())
+	first.(*redisDigestCache).clock = fakeClock
+
+	if _, err := second.Get(dgst); err != distribution.ErrBlobUnknown {
+		t.Fatalf("expected ErrBlobUnknown, got %v", err)
+	}
+
+	desc := distribution.Descriptor{
+		Digest:    dgst,
+		Size:      1234,
+		MediaType: "application/octet-stream",
+	}
+	for _, repo := range []string{"foo", "bar", "baz"} {
+		repo := repo
+		fakeClock.Step(time.Second)
+		if err := first.Add(dgst, &DigestValue{desc: &desc, repo: &repo}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := second.Get(dgst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, desc) {
+		t.Fatalf("unexpected descriptor: %#+v", got)
+	}
+
+	if repos := second.Repositories(dgst); !reflect.DeepEqual(repos, []string{"bar", "baz"}) {
+		t.Fatalf("unexpected repositories: %v", repos)
+	}
+	if _, err := second.ScopedGet(dgst, "foo"); err != distribution.ErrBlobUnknown {
+		t.Fatalf("expected the oldest repository to be removed, got %v", err)
+	}
+	if _, err := second.ScopedGet(dgst, "bar"); err != nil {
+		t.Fatal(err)
+	}
+
+	if ttl := server.ttls[redisDescriptorKey(dgst)]; ttl != ttl1m.Milliseconds() {
+		t.Fatalf("unexpected expiration of the descriptor: %dms", ttl)
+	}
+
+	if err := second.ScopedRemove(dgst, "bar"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := first.ScopedGet(dgst, "bar"); err != distribution.ErrBlobUnknown {
+		t.Fatalf("expected ErrBlobUnknown, got %v", err)
+	}
+
+	if n := first.RemoveRepository("bar"); n != 0 {
+		t.Fatalf("expected no items to be removed for bar, got %d", n)
+	}
+	if n := first.RemoveRepository("baz"); n != 1 {
+		t.Fatalf("expected 1 item to be removed for baz, got %d", n)
+	}
+	if _, err := second.ScopedGet(dgst, "baz"); err != distribution.ErrBlobUnknown {
+		t.Fatalf("expected ErrBlobUnknown, got %v", err)
+	}
+	if _, err := second.Get(dgst); err != nil {
+		t.Fatalf("expected the descriptor to be kept, got %v", err)
+	}
+}
+
+func TestRedisDigestCacheAlias(t *testing.T) {
+	dgst := digest.Digest("sha256:4355a46b19d348dc2f57c046f8ef63d4538ebb936000f3c9ee954a27460dd865")
+	alias := digest.Digest("sha512:" + fmt.Sprintf("%0128x", 1))
+	repo := "foo"
+
+	c, err := NewRedisBlobDigest(newFakeRedis().pool(), 3, ttl1m, metrics.NewNoopMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Add(alias, &DigestValue{desc: &distribution.Descriptor{Digest: dgst, Size: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Add(alias, &DigestValue{repo: &repo}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, d := range []digest.Digest{dgst, alias} {
+		desc, err := c.ScopedGet(d, repo)
+		if err != nil {
+			t.Fatalf("%s: %v", d, err)
+		}
+		if desc.Digest != dgst {
+			t.Fatalf("%s: unexpected descriptor: %#+v", d, desc)
+		}
+	}
+
+	if err := c.Remove(alias); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(dgst); err != distribution.ErrBlobUnknown {
+		t.Fatalf("expected ErrBlobUnknown, got %v", err)
+	}
+}
+
+func TestRedisDigestCacheDisabled(t *testing.T) {
+	dgst := digest.Digest("sha256:4355a46b19d348dc2f57c046f8ef63d4538ebb936000f3c9ee954a27460dd865")
+	server := newFakeRedis()
+
+	c, err := NewRedisBlobDigest(server.pool(), 3, 0, metrics.NewNoopMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Add(dgst, &DigestValue{desc: &distribution.Descriptor{Digest: dgst}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(server.strings) != 0 {
+		t.Fatalf("expected nothing to be stored, got %v", server.strings)
+	}
+	if _, err := c.Snapshot(); err == nil {
+		t.Fatal("expected an error from Snapshot")
+	}
+}
@@ -0,0 +1,166 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/opencontainers/go-digest"
+)
+
+const snapshotVersion = 1
+
+// snapshot is the serialized form of the digest cache.
+type snapshot struct {
+	Version int            `json:"version"`
+	Items   []snapshotItem `json:"items"`
+}
+
+type snapshotItem struct {
+	// Digests contains the digest of the item and its aliases.
+	Digests      []digest.Digest          `json:"digests"`
+	ExpireTime   time.Time                `json:"expireTime"`
+	Descriptor   *distribution.Descriptor `json:"descriptor,omitempty"`
+	Repositories []string                 `json:"repositories,omitempty"`
+}
+
+// Snapshot serializes the items of the cache that are not expired. The items
+// are ordered from the least recently used to the most recently used.
+func (gbd *digestCache) Snapshot() ([]byte, error) {
+	s := snapshot{
+		Version: snapshotVersion,
+		Items:   []snapshotItem{},
+	}
+
+	if gbd.ttl == 0 {
+		return json.Marshal(s)
+	}
+
+	gbd.mu.Lock()
+	defer gbd.mu.Unlock()
+
+	now := gbd.clock.Now()
+	seen := make(map[*DigestItem]struct{})
+	for _, key := range gbd.lru.Keys() {
+		item := gbd.peek(key.(digest.Digest))
+		if item == nil || item.expireTime.Before(now) {
+			continue
+		}
+		if _, ok := seen[item]; ok {
+			continue
+		}
+		seen[item] = struct{}{}
+
+		digests := []digest.Digest{key.(digest.Digest)}
+		for alias := range item.aliases {
+			if alias != digests[0] {
+				digests = append(digests, alias)
+			}
+		}
+
+		var repos []string
+		for _, repo := range item.repositories.Keys() {
+			repos = append(repos, repo.(string))
+		}
+
+		s.Items = append(s.Items, snapshotItem{
+			Digests:      digests,
+			ExpireTime:   item.expireTime,
+			Descriptor:   item.desc,
+			Repositories: repos,
+		})
+	}
+
+	return json.Marshal(s)
+}
+
+// Restore adds the items from a snapshot made by Snapshot to the cache.
+// Expired items are skipped.
+func (gbd *digestCache) Restore(data []byte) error {
+	var s snapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	if s.Version != snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", s.Version)
+	}
+
+	if gbd.ttl == 0 {
+		return nil
+	}
+
+	gbd.mu.Lock()
+	defer gbd.mu.Unlock()
+	defer gbd.updateEntries()
+
+	now := gbd.clock.Now()
+	for _, si := range s.Items {
+		if len(si.Digests) == 0 || si.ExpireTime.Before(now) {
+			continue
+		}
+
+		lru, err := gbd.newRepositories()
+		if err != nil {
+			return err
+		}
+
+		item := &DigestItem{
+			expireTime:   si.ExpireTime,
+			desc:         si.Descriptor,
+			repositories: lru,
+		}
+		for _, repo := range si.Repositories {
+			gbd.addRepository(item, repo)
+		}
+		if len(si.Digests) > 1 {
+			item.aliases = make(map[digest.Digest]struct{})
+			for _, dgst := range si.Digests {
+				item.aliases[dgst] = struct{}{}
+			}
+		}
+
+		for _, dgst := range si.Digests {
+			if err := dgst.Validate(); err != nil {
+				return err
+			}
+			gbd.addDigest(dgst, item)
+		}
+	}
+
+	return nil
+}
+
+// SnapshotStats summarizes a snapshot made by Snapshot.
+type SnapshotStats struct {
+	// Items is the number of cached blobs.
+	Items int `json:"items"`
+	// Digests is the number of digests of the items, including the aliases.
+	Digests int `json:"digests"`
+	// Descriptors is the number of items with a descriptor.
+	Descriptors int `json:"descriptors"`
+	// Repositories is the number of repositories in which the items are
+	// known to exist, summed over the items.
+	Repositories int `json:"repositories"`
+}
+
+// StatsOfSnapshot returns the statistics of a snapshot made by Snapshot.
+func StatsOfSnapshot(data []byte) (SnapshotStats, error) {
+	var s snapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return SnapshotStats{}, err
+	}
+	if s.Version != snapshotVersion {
+		return SnapshotStats{}, fmt.Errorf("unsupported snapshot version %d", s.Version)
+	}
+
+	stats := SnapshotStats{Items: len(s.Items)}
+	for _, item := range s.Items {
+		stats.Digests += len(item.Digests)
+		if item.Descriptor != nil {
+			stats.Descriptors++
+		}
+		stats.Repositories += len(item.Repositories)
+	}
+	return stats, nil
+}
@@ -0,0 +1,141 @@
+package cache
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	clock "k8s.io/utils/clock/testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/metrics"
+)
+
+func TestDigestCacheSnapshotRestore(t *testing.T) {
+	dgst := digest.Digest("sha256:4355a46b19d348dc2f57c046f8ef63d4538ebb936000f3c9ee954a27460dd865")
+	alias := digest.Digest("sha512:a4abd4448c49562d828115d13a1fccea927f52b4d5459297f8b43e42da89238bc13626e43dcb38ddb082488927ec904fb42057443983e88585179d50551afe62")
+	stale := digest.Digest("sha256:bef57ec7f53a6d40beb640a780a639c83bc29ac8a9816f1fc6c5c6dcd93c4721")
+	repos := []string{"foo", "bar"}
+	now := time.Now()
+	fakeClock := clock.NewFakeClock(now)
+
+	cache, err := NewBlobDigest(5, 3, ttl5m, metrics.NewNoopMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.(*digestCache).clock = fakeClock
+
+	if err := cache.Add(stale, &DigestValue{desc: &distribution.Descriptor{Digest: stale, Size: 1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	fakeClock.Step(ttl1m * 3)
+
+	for _, repo := range repos {
+		repo := repo
+		if err := cache.Add(alias, &DigestValue{desc: &distribution.Descriptor{Digest: dgst, Size: 1234}, repo: &repo}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := cache.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The stale item expires after the snapshot is made.
+	fakeClock.Step(ttl1m * 3)
+
+	restored, err := NewBlobDigest(5, 3, ttl5m, metrics.NewNoopMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored.(*digestCache).clock = fakeClock
+
+	if err := restored.Restore(data); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, d := range []digest.Digest{dgst, alias} {
+		desc, err := restored.ScopedGet(d, "foo")
+		if err != nil {
+			t.Fatalf("%s: %v", d, err)
+		}
+		if desc.Digest != dgst || desc.Size != 1234 {
+			t.Errorf("%s: unexpected descriptor: %#+v", d, desc)
+		}
+	}
+
+	gotRepos := restored.Repositories(dgst)
+	sort.Strings(gotRepos)
+	if !reflect.DeepEqual(gotRepos, []string{"bar", "foo"}) {
+		t.Errorf("got repositories %v, want %v", gotRepos, []string{"bar", "foo"})
+	}
+
+	if _, err := restored.Get(stale); err != distribution.ErrBlobUnknown {
+		t.Errorf("got error %v for expired item, want %v", err, distribution.ErrBlobUnknown)
+	}
+
+	if err := restored.Remove(dgst); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := restored.Get(alias); err != distribution.ErrBlobUnknown {
+		t.Errorf("got error %v for removed alias, want %v", err, distribution.ErrBlobUnknown)
+	}
+}
+
+func TestDigestCacheRestoreInvalidSnapshot(t *testing.T) {
+	cache, err := NewBlobDigest(5, 3, ttl5m, metrics.NewNoopMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, data := range []string{
+		`not json`,
+		`{"version": 42, "items": []}`,
+	} {
+		if err := cache.Restore([]byte(data)); err == nil {
+			t.Errorf("%s: expected an error", data)
+		}
+	}
+}
+
+func TestStatsOfSnapshot(t *testing.T) {
+	dgst := digest.Digest("sha256:4355a46b19d348dc2f57c046f8ef63d4538ebb936000f3c9ee954a27460dd865")
+	alias := digest.Digest("sha512:a4abd4448c49562d828115d13a1fccea927f52b4d5459297f8b43e42da89238bc13626e43dcb38ddb082488927ec904fb42057443983e88585179d50551afe62")
+	other := digest.Digest("sha256:bef57ec7f53a6d40beb640a780a639c83bc29ac8a9816f1fc6c5c6dcd93c4721")
+
+	cache, err := NewBlobDigest(5, 3, ttl5m, metrics.NewNoopMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, repo := range []string{"foo", "bar"} {
+		repo := repo
+		if err := cache.Add(alias, &DigestValue{desc: &distribution.Descriptor{Digest: dgst, Size: 1234}, repo: &repo}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cache.Add(other, &DigestValue{desc: &distribution.Descriptor{Digest: other, Size: 1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := cache.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := StatsOfSnapshot(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := SnapshotStats{Items: 2, Digests: 3, Descriptors: 2, Repositories: 2}
+	if stats != expected {
+		t.Errorf("got %#+v, want %#+v", stats, expected)
+	}
+
+	if _, err := StatsOfSnapshot([]byte(`{"version": 42, "items": []}`)); err == nil {
+		t.Errorf("expected an error for an unsupported version")
+	}
+}
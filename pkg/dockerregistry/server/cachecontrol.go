@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/opencontainers/go-digest"
+)
+
+// cacheControlBlobStore wraps a distribution.BlobStore and sets the
+// Cache-Control header for successful blob downloads. Blobs are content
+// addressable, so they can be cached by proxies in front of the registry.
+type cacheControlBlobStore struct {
+	distribution.BlobStore
+
+	cacheControl string
+}
+
+var _ distribution.BlobStore = &cacheControlBlobStore{}
+
+func (bs *cacheControlBlobStore) ServeBlob(ctx context.Context, w http.ResponseWriter, req *http.Request, dgst digest.Digest) error {
+	return bs.BlobStore.ServeBlob(ctx, &cacheControlResponseWriter{ResponseWriter: w, cacheControl: bs.cacheControl}, req, dgst)
+}
+
+// cacheControlResponseWriter sets the Cache-Control header only for
+// responses with the content, so that redirects and errors are not cached.
+type cacheControlResponseWriter struct {
+	http.ResponseWriter
+
+	cacheControl string
+	wroteHeader  bool
+}
+
+func (w *cacheControlResponseWriter) WriteHeader(statusCode int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		switch statusCode {
+		case http.StatusOK, http.StatusPartialContent, http.StatusNotModified:
+			w.Header().Set("Cache-Control", w.cacheControl)
+		}
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *cacheControlResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// cacheControlManifestService wraps a distribution.ManifestService and sets
+// the Cache-Control header for manifests that are requested by digest.
+// Manifests requested by tag are not cached as tags can be moved.
+type cacheControlManifestService struct {
+	distribution.ManifestService
+
+	cacheControl string
+}
+
+var _ distribution.ManifestService = &cacheControlManifestService{}
+
+func (m *cacheControlManifestService) Get(ctx context.Context, dgst digest.Digest, options ...distribution.ManifestServiceOption) (distribution.Manifest, error) {
+	manifest, err := m.ManifestService.Get(ctx, dgst, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := digest.Parse(dcontext.GetStringValue(ctx, "vars.reference")); err != nil {
+		return manifest, nil
+	}
+
+	req, err := dcontext.GetRequest(ctx)
+	if err != nil || (req.Method != http.MethodGet && req.Method != http.MethodHead) {
+		return manifest, nil
+	}
+
+	w, err := dcontext.GetResponseWriter(ctx)
+	if err != nil {
+		return manifest, nil
+	}
+
+	w.Header().Set("Cache-Control", m.cacheControl)
+
+	return manifest, nil
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/manifest/schema2"
+	"github.com/gorilla/mux"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/openshift/image-registry/pkg/testutil"
+)
+
+const testCacheControl = "private, max-age=31536000, immutable"
+
+func TestCacheControlBlobStoreServeBlob(t *testing.T) {
+	ctx := context.Background()
+	ctx = testutil.WithTestLogger(ctx, t)
+
+	content := []byte("layer content")
+	dgst := makeDigestFromBytes(content)
+
+	for _, tc := range []struct {
+		name             string
+		dgst             digest.Digest
+		redirect         bool
+		wantCacheControl string
+	}{
+		{
+			name:             "served blob",
+			dgst:             dgst,
+			wantCacheControl: testCacheControl,
+		},
+		{
+			name:     "redirected blob",
+			dgst:     dgst,
+			redirect: true,
+		},
+		{
+			name: "unknown blob",
+			dgst: unknownBlobDigest,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var bs distribution.BlobStore = testutil.NewFakeBlobStore(nil, testutil.BlobContents{
+				dgst: content,
+			})
+			if tc.redirect {
+				bs = &redirectingBlobStore{
+					BlobStore:  bs,
+					redirector: &fakeBlobRedirector{url: "http://127.0.0.1:30020/"},
+					repo:       "user/app",
+				}
+			}
+			bs = &cacheControlBlobStore{
+				BlobStore:    bs,
+				cacheControl: testCacheControl,
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/v2/user/app/blobs/"+tc.dgst.String(), nil)
+			w := httptest.NewRecorder()
+
+			_ = bs.ServeBlob(ctx, w, req, tc.dgst)
+
+			if cacheControl := w.Header().Get("Cache-Control"); cacheControl != tc.wantCacheControl {
+				t.Errorf("got Cache-Control %q, want %q", cacheControl, tc.wantCacheControl)
+			}
+		})
+	}
+}
+
+func TestCacheControlManifestServiceGet(t *testing.T) {
+	manifest, err := testutil.MakeSchema2Manifest(
+		distribution.Descriptor{Digest: "sha256:bef57ec7f53a6d40beb640a780a639c83bc29ac8a9816f1fc6c5c6dcd93c4721", Size: 2, MediaType: schema2.MediaTypeImageConfig},
+		nil,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, payload, err := manifest.Payload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dgst := digest.FromBytes(payload)
+
+	for _, tc := range []struct {
+		name             string
+		reference        string
+		dgst             digest.Digest
+		wantCacheControl string
+	}{
+		{
+			name:             "by digest",
+			reference:        dgst.String(),
+			dgst:             dgst,
+			wantCacheControl: testCacheControl,
+		},
+		{
+			name:      "by tag",
+			reference: "latest",
+			dgst:      dgst,
+		},
+		{
+			name:      "unknown manifest",
+			reference: unknownBlobDigest,
+			dgst:      unknownBlobDigest,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			ctx = testutil.WithTestLogger(ctx, t)
+
+			req := httptest.NewRequest(http.MethodGet, "/v2/user/app/manifests/"+tc.reference, nil)
+			req = mux.SetURLVars(req, map[string]string{"reference": tc.reference})
+			ctx = dcontext.WithRequest(ctx, req)
+			ctx = dcontext.WithVars(ctx, req)
+			w := httptest.NewRecorder()
+			ctx, _ = dcontext.WithResponseWriter(ctx, w)
+
+			ms := &cacheControlManifestService{
+				ManifestService: testutil.NewFakeManifestService("user/app", map[digest.Digest]distribution.Manifest{
+					dgst: manifest,
+				}),
+				cacheControl: testCacheControl,
+			}
+
+			_, _ = ms.Get(ctx, tc.dgst)
+
+			if cacheControl := w.Header().Get("Cache-Control"); cacheControl != tc.wantCacheControl {
+				t.Errorf("got Cache-Control %q, want %q", cacheControl, tc.wantCacheControl)
+			}
+		})
+	}
+}
+
+type fakeBlobRedirector struct {
+	url string
+}
+
+func (r *fakeBlobRedirector) BlobRedirectURL(ctx context.Context, req *http.Request, repo string, desc distribution.Descriptor) (string, error) {
+	return r.url, nil
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"net/http"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/registry/auth"
+	"github.com/distribution/distribution/v3/registry/handlers"
+	gorillahandlers "github.com/gorilla/handlers"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/api"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/cache"
+)
+
+func (app *App) registerCacheInvalidationHandler(dockerApp *handlers.App) {
+	extensionsRouter := dockerApp.NewRoute().PathPrefix(api.ExtensionsPrefix).Subrouter()
+	invalidateAccess := func(r *http.Request) []auth.Access {
+		return []auth.Access{
+			{
+				Resource: auth.Resource{
+					Type: "repository",
+					Name: dcontext.GetStringValue(dcontext.WithVars(dockerApp, r), "vars.name"),
+				},
+				Action: "push",
+			},
+		}
+	}
+	dockerApp.RegisterRoute(
+		"extensions-cache-invalidate",
+		// POST /extensions/v2/<namespace>/<name>/cache-invalidate
+		extensionsRouter.Path(api.CacheInvalidatePath).Methods("POST"),
+		app.cacheInvalidationDispatcher,
+		handlers.NameRequired,
+		invalidateAccess,
+	)
+}
+
+// cacheInvalidationDispatcher takes the request context and builds the
+// handler for the cache invalidation requests.
+func (app *App) cacheInvalidationDispatcher(ctx *handlers.Context, r *http.Request) http.Handler {
+	cacheInvalidationHandler := &cacheInvalidationHandler{
+		Context:  ctx,
+		Cache:    app.cache,
+		TagIndex: app.tagIndex,
+	}
+
+	return gorillahandlers.MethodHandler{
+		"POST": http.HandlerFunc(cacheInvalidationHandler.Post),
+	}
+}
+
+// cacheInvalidationHandler flushes the cached data of a repository.
+type cacheInvalidationHandler struct {
+	*handlers.Context
+
+	Cache    cache.DigestCache
+	TagIndex *tagIndex
+}
+
+// Post removes the repository from the digest to repository mappings of the
+// digest cache and forgets the sorted tags of the repository. The descriptors
+// of the blobs are kept, they are the same in all repositories. Image streams
+// are cached only for the duration of a request, so they are always read again
+// by the next request.
+func (h *cacheInvalidationHandler) Post(w http.ResponseWriter, req *http.Request) {
+	defer func() {
+		if err := req.Body.Close(); err != nil {
+			dcontext.GetLogger(h).Errorf("cacheInvalidationHandler: unable to close the request body: %v", err)
+		}
+	}()
+
+	repo := h.Repository.Named().Name()
+	removed := h.Cache.RemoveRepository(repo)
+	h.TagIndex.forget(repo)
+	dcontext.GetLogger(h).Infof("cacheInvalidationHandler: removed the repository %s from %d cached blobs", repo, removed)
+
+	w.WriteHeader(http.StatusNoContent)
+}
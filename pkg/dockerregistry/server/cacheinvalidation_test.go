@@ -0,0 +1,76 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/handlers"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/cache"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/metrics"
+	"github.com/openshift/image-registry/pkg/testutil"
+)
+
+type namedRepository struct {
+	distribution.Repository
+	name reference.Named
+}
+
+func (r *namedRepository) Named() reference.Named {
+	return r.name
+}
+
+func TestCacheInvalidationHandler(t *testing.T) {
+	ctx := context.Background()
+	ctx = testutil.WithTestLogger(ctx, t)
+
+	dgst := digest.Digest("sha256:4355a46b19d348dc2f57c046f8ef63d4538ebb936000f3c9ee954a27460dd865")
+	desc := distribution.Descriptor{Digest: dgst, Size: 10}
+
+	digestCache, err := cache.NewBlobDigest(5, 3, time.Minute, metrics.NewNoopMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := &cache.Provider{Cache: digestCache}
+	for _, repo := range []string{"ns/app", "ns/other"} {
+		bds, err := provider.RepositoryScoped(repo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := bds.SetDescriptor(ctx, dgst, desc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	named, err := reference.WithName("ns/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &cacheInvalidationHandler{
+		Context: &handlers.Context{
+			Context:    ctx,
+			Repository: &namedRepository{name: named},
+		},
+		Cache: digestCache,
+	}
+
+	w := httptest.NewRecorder()
+	h.Post(w, httptest.NewRequest(http.MethodPost, "/extensions/v2/ns/app/cache-invalidate", nil))
+
+	if w.Code != http.StatusNoContent {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusNoContent)
+	}
+	if _, err := digestCache.Get(dgst); err != nil {
+		t.Errorf("expected the descriptor to be kept, got %v", err)
+	}
+	if repos := digestCache.Repositories(dgst); !reflect.DeepEqual(repos, []string{"ns/other"}) {
+		t.Errorf("got repositories %q for %s, want [ns/other]", repos, dgst)
+	}
+}
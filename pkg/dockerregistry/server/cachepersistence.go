@@ -0,0 +1,61 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+// digestCacheSnapshotPath is the location of the digest cache snapshot in the
+// storage. It is outside of the distribution's root directory, so it doesn't
+// interfere with the garbage collection.
+const digestCacheSnapshotPath = "/openshift/cache/digests.json"
+
+// loadDigestCache restores the digest cache from the latest snapshot if it
+// exists. Errors are logged as the registry can work with a cold cache.
+func (app *App) loadDigestCache(ctx context.Context) {
+	data, err := app.driver.GetContent(ctx, digestCacheSnapshotPath)
+	if _, ok := err.(storagedriver.PathNotFoundError); ok {
+		dcontext.GetLogger(ctx).Infof("digest cache snapshot %s does not exist, starting with an empty cache", digestCacheSnapshotPath)
+		return
+	}
+	if err != nil {
+		dcontext.GetLogger(ctx).Errorf("unable to read digest cache snapshot %s: %v", digestCacheSnapshotPath, err)
+		return
+	}
+
+	if err := app.cache.Restore(data); err != nil {
+		dcontext.GetLogger(ctx).Errorf("unable to restore digest cache from %s: %v", digestCacheSnapshotPath, err)
+		return
+	}
+	dcontext.GetLogger(ctx).Infof("digest cache is restored from %s", digestCacheSnapshotPath)
+}
+
+// saveDigestCache writes a snapshot of the digest cache into the storage.
+func (app *App) saveDigestCache(ctx context.Context) error {
+	data, err := app.cache.Snapshot()
+	if err != nil {
+		return err
+	}
+	return app.driver.PutContent(ctx, digestCacheSnapshotPath, data)
+}
+
+// runDigestCacheSnapshots saves snapshots of the digest cache every interval
+// until ctx is done.
+func (app *App) runDigestCacheSnapshots(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := app.saveDigestCache(ctx); err != nil {
+				dcontext.GetLogger(ctx).Errorf("unable to save digest cache snapshot %s: %v", digestCacheSnapshotPath, err)
+			}
+		}
+	}
+}
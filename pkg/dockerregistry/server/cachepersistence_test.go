@@ -0,0 +1,59 @@
+package server
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/cache"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/metrics"
+	"github.com/openshift/image-registry/pkg/testutil"
+)
+
+func TestDigestCachePersistence(t *testing.T) {
+	ctx := context.Background()
+	ctx = testutil.WithTestLogger(ctx, t)
+
+	dgst := digest.Digest("sha256:4355a46b19d348dc2f57c046f8ef63d4538ebb936000f3c9ee954a27460dd865")
+	driver := inmemory.New()
+
+	newApp := func() *App {
+		digestCache, err := cache.NewBlobDigest(
+			defaultDescriptorCacheSize,
+			defaultDigestToRepositoryCacheSize,
+			time.Minute,
+			metrics.NewNoopMetrics(),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &App{
+			driver: driver,
+			cache:  digestCache,
+		}
+	}
+
+	// Loading a missing snapshot leaves the cache empty.
+	app := newApp()
+	app.loadDigestCache(ctx)
+	if repos := app.cache.Repositories(dgst); repos != nil {
+		t.Fatalf("got repositories %v, want none", repos)
+	}
+
+	if err := cache.NewRepositoryDigest(app.cache).AddDigest(dgst, "user/app"); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.saveDigestCache(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := newApp()
+	restarted.loadDigestCache(ctx)
+	if repos := restarted.cache.Repositories(dgst); !reflect.DeepEqual(repos, []string{"user/app"}) {
+		t.Errorf("got repositories %v, want %v", repos, []string{"user/app"})
+	}
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/opencontainers/go-digest"
+	kubecache "k8s.io/apimachinery/pkg/util/cache"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/cache"
+	registryconfig "github.com/openshift/image-registry/pkg/dockerregistry/server/configuration"
+	"github.com/openshift/image-registry/pkg/imagestream"
+)
+
+const (
+	// cacheWarmupSize is the maximum number of remembered repositories that
+	// have been warmed up.
+	cacheWarmupSize = 4096
+
+	// cacheWarmupConcurrency is the number of blobs that are looked up in the
+	// storage at the same time during a warm-up.
+	cacheWarmupConcurrency = 8
+)
+
+// cacheWarmup fills the digest cache with the blobs of an image stream when
+// its repository is accessed for the first time, so that the first pull
+// doesn't discover the blobs of the image stream one by one.
+type cacheWarmup struct {
+	ttl     time.Duration
+	cache   cache.RepositoryDigest
+	statter func() distribution.BlobStatter
+
+	mu     sync.Mutex
+	warmed *kubecache.LRUExpireCache
+}
+
+// newCacheWarmup returns the warm-up of digestCache configured by cfg. The
+// blobs are looked up using the statter that caches their descriptors in
+// digestCache. It returns nil if the warm-up or the cache is disabled.
+func newCacheWarmup(cfg *registryconfig.Cache, ttl time.Duration, digestCache cache.DigestCache, statter func() distribution.BlobStatter) *cacheWarmup {
+	if cfg == nil || !cfg.Warmup.Enabled || ttl <= 0 {
+		return nil
+	}
+	return &cacheWarmup{
+		ttl:     ttl,
+		cache:   cache.NewRepositoryDigest(digestCache),
+		statter: statter,
+		warmed:  kubecache.NewLRUExpireCache(cacheWarmupSize),
+	}
+}
+
+// begin returns true if the repository should be warmed up, i.e. it hasn't
+// been warmed up within the TTL of the cache.
+func (w *cacheWarmup) begin(repo string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.warmed.Get(repo); ok {
+		return false
+	}
+	w.warmed.Add(repo, struct{}{}, w.ttl)
+	return true
+}
+
+// warm fetches the layers of the image stream in a single call and caches
+// the repository of all its blobs and images. The descriptors of the blobs
+// that are stored in the registry are cached as well.
+func (w *cacheWarmup) warm(ctx context.Context, is imagestream.ImageStream) {
+	started := time.Now()
+
+	layers, err := is.Layers(ctx)
+	if err != nil || len(layers.Images) == 0 {
+		// The image stream may get its images later, e.g. by a push.
+		w.mu.Lock()
+		w.warmed.Remove(is.Reference())
+		w.mu.Unlock()
+		if err != nil {
+			dcontext.GetLogger(ctx).Debugf("cache warm-up: unable to get layers of image stream %s: %v", is.Reference(), err)
+		}
+		return
+	}
+
+	RememberLayersOfImageStream(ctx, w.cache, layers, is.Reference())
+
+	dgsts := make(chan digest.Digest)
+	statter := w.statter()
+	var (
+		wg     sync.WaitGroup
+		stored atomic.Int32
+	)
+	for i := 0; i < cacheWarmupConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for dgst := range dgsts {
+				// Only the descriptors of the blobs that exist in the
+				// storage are cached, the other ones are pulled through.
+				if _, err := statter.Stat(ctx, dgst); err == nil {
+					stored.Add(1)
+				}
+			}
+		}()
+	}
+	for dgst := range layers.Blobs {
+		dgsts <- digest.Digest(dgst)
+	}
+	total := len(layers.Blobs)
+	for dgst := range layers.Images {
+		// The manifests are usually listed as blobs too.
+		if _, ok := layers.Blobs[dgst]; !ok {
+			dgsts <- digest.Digest(dgst)
+			total++
+		}
+	}
+	close(dgsts)
+	wg.Wait()
+
+	dcontext.GetLogger(ctx).Debugf("cache warm-up: cached %d of %d blobs of image stream %s in %s", stored.Load(), total, is.Reference(), time.Since(started))
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/cache"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+	registryconfig "github.com/openshift/image-registry/pkg/dockerregistry/server/configuration"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/metrics"
+	"github.com/openshift/image-registry/pkg/imagestream"
+	"github.com/openshift/image-registry/pkg/testutil"
+)
+
+// storedBlobs is a blob statter of the blobs stored in the registry.
+type storedBlobs struct {
+	mu    sync.Mutex
+	blobs map[digest.Digest]bool
+	stats int
+}
+
+func (s *storedBlobs) Stat(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats++
+	if !s.blobs[dgst] {
+		return distribution.Descriptor{}, distribution.ErrBlobUnknown
+	}
+	return distribution.Descriptor{Digest: dgst, Size: 1}, nil
+}
+
+func TestCacheWarmup(t *testing.T) {
+	ctx := testutil.WithTestLogger(context.Background(), t)
+
+	fos, imageClient := testutil.NewFakeOpenShiftWithClient(ctx)
+	image := testutil.AddRandomImage(t, fos, "ns", "app", "latest")
+	registryClient := client.NewFakeRegistryAPIClient(nil, imageClient)
+
+	stored := digest.Digest(image.DockerImageLayers[0].Name)
+	pulledThrough := digest.Digest(image.DockerImageLayers[1].Name)
+	statter := &storedBlobs{
+		blobs: map[digest.Digest]bool{
+			stored:                    true,
+			digest.Digest(image.Name): true,
+		},
+	}
+
+	digestCache, err := cache.NewBlobDigest(defaultDescriptorCacheSize, defaultDigestToRepositoryCacheSize, time.Minute, metrics.NewNoopMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := newCacheWarmup(&registryconfig.Cache{
+		Warmup: registryconfig.CacheWarmup{Enabled: true},
+	}, time.Minute, digestCache, func() distribution.BlobStatter {
+		return &cache.BlobStatter{Cache: digestCache, Svc: statter}
+	})
+
+	if !w.begin("ns/app") {
+		t.Fatal("expected the first access to ns/app to start the warm-up")
+	}
+	if w.begin("ns/app") {
+		t.Fatal("expected ns/app to be warmed up only once")
+	}
+	w.warm(ctx, imagestream.New(ctx, "ns", "app", registryClient))
+
+	if desc, err := digestCache.ScopedGet(stored, "ns/app"); err != nil || desc.Digest != stored {
+		t.Errorf("got descriptor %v and error %v for the stored blob %s", desc, err, stored)
+	}
+	if _, err := digestCache.Get(pulledThrough); err != distribution.ErrBlobUnknown {
+		t.Errorf("got error %v for the blob %s that isn't stored, want %v", err, pulledThrough, distribution.ErrBlobUnknown)
+	}
+	rd := cache.NewRepositoryDigest(digestCache)
+	for _, dgst := range []digest.Digest{stored, pulledThrough, digest.Digest(image.Name)} {
+		if !rd.ContainsRepository(dgst, "ns/app") {
+			t.Errorf("expected %s to be cached as a blob of ns/app", dgst)
+		}
+	}
+	if expected := len(image.DockerImageLayers) + 1; statter.stats != expected {
+		// The layers and the manifest, each of them once.
+		t.Errorf("got %d lookups of blobs, want %d", statter.stats, expected)
+	}
+
+	if !w.begin("ns/missing") {
+		t.Fatal("expected the first access to ns/missing to start the warm-up")
+	}
+	w.warm(ctx, imagestream.New(ctx, "ns", "missing", registryClient))
+	if !w.begin("ns/missing") {
+		t.Error("expected the warm-up of the missing image stream to be retried")
+	}
+}
+
+func TestCacheWarmupDisabled(t *testing.T) {
+	digestCache, err := cache.NewBlobDigest(defaultDescriptorCacheSize, defaultDigestToRepositoryCacheSize, 0, metrics.NewNoopMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+	enabled := &registryconfig.Cache{Warmup: registryconfig.CacheWarmup{Enabled: true}}
+
+	if w := newCacheWarmup(&registryconfig.Cache{}, time.Minute, digestCache, nil); w != nil {
+		t.Error("expected no warm-up if it isn't enabled")
+	}
+	if w := newCacheWarmup(enabled, 0, digestCache, nil); w != nil {
+		t.Error("expected no warm-up if the cache is disabled")
+	}
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/metrics"
+)
+
+// certificatePinError is returned when the certificates of an upstream
+// registry don't match its pins, e.g. because the connection is intercepted
+// by a proxy that re-signs the traffic.
+type certificatePinError struct {
+	host string
+}
+
+func (e *certificatePinError) Error() string {
+	return fmt.Sprintf("certificate pin mismatch for %s: no certificate of the chain matches the configured pins", e.host)
+}
+
+// certificatePins checks the public keys of the upstream registries that
+// have pins in the configuration.
+type certificatePins struct {
+	ctx     context.Context
+	pins    map[string]map[string]bool
+	metrics metrics.CertificatePins
+}
+
+// newCertificatePins returns the checker of the pins by host name in cfg. It
+// returns nil if no registry is pinned.
+func newCertificatePins(ctx context.Context, cfg map[string][]string, m metrics.CertificatePins) *certificatePins {
+	if len(cfg) == 0 {
+		return nil
+	}
+	p := &certificatePins{
+		ctx:     ctx,
+		pins:    make(map[string]map[string]bool, len(cfg)),
+		metrics: m,
+	}
+	for host, hostPins := range cfg {
+		set := make(map[string]bool, len(hostPins))
+		for _, pin := range hostPins {
+			set[pin] = true
+		}
+		p.pins[strings.ToLower(host)] = set
+	}
+	return p
+}
+
+// certificatePin returns the pin of the public key of cert.
+func certificatePin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "sha256/" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// VerifyConnection refuses the connection if the server is pinned and none
+// of its certificates match its pins. It is called after the usual
+// verification of the chain, so the pins restrict the trusted certificates
+// further. Only the verified chains are checked as the server may send any
+// other certificates. If the chain isn't verified because the registry is
+// insecure, only the leaf certificate, whose key the server has proven to
+// own, is checked.
+func (p *certificatePins) VerifyConnection(cs tls.ConnectionState) error {
+	host := strings.ToLower(strings.TrimSuffix(cs.ServerName, "."))
+	pins, ok := p.pins[host]
+	if !ok {
+		return nil
+	}
+
+	var certs []*x509.Certificate
+	for _, chain := range cs.VerifiedChains {
+		certs = append(certs, chain...)
+	}
+	if len(cs.VerifiedChains) == 0 && len(cs.PeerCertificates) > 0 {
+		certs = cs.PeerCertificates[:1]
+	}
+	for _, cert := range certs {
+		if pins[certificatePin(cert)] {
+			return nil
+		}
+	}
+
+	p.metrics.Rejected(host)
+	err := &certificatePinError{host: host}
+	dcontext.GetLogger(p.ctx).Errorf("refusing the connection to %s: %v", host, err)
+	return err
+}
+
+// tlsConfig returns the TLS configuration that checks the pins, with the
+// verification of the chain skipped if insecure is true.
+func (p *certificatePins) tlsConfig(insecure bool) *tls.Config {
+	if p == nil {
+		if insecure {
+			return &tls.Config{InsecureSkipVerify: true}
+		}
+		return nil
+	}
+	return &tls.Config{
+		InsecureSkipVerify: insecure,
+		VerifyConnection:   p.VerifyConnection,
+	}
+}
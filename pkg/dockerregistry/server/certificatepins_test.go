@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/metrics"
+	metricstesting "github.com/openshift/image-registry/pkg/dockerregistry/server/metrics/testing"
+	"github.com/openshift/image-registry/pkg/testutil"
+	"github.com/openshift/image-registry/pkg/testutil/counter"
+)
+
+func TestCertificatePinsTransport(t *testing.T) {
+	ctx := testutil.WithTestLogger(context.Background(), t)
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	pin := certificatePin(server.Certificate())
+
+	for _, tc := range []struct {
+		name     string
+		pins     map[string][]string
+		rejected bool
+	}{
+		{
+			name: "matching pin",
+			pins: map[string][]string{"registry.example.com": {"sha256/AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=", pin}},
+		},
+		{
+			name:     "mismatching pin",
+			pins:     map[string][]string{"registry.example.com": {"sha256/AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="}},
+			rejected: true,
+		},
+		{
+			name: "other host",
+			pins: map[string][]string{"quay.io": {"sha256/AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, sink := metricstesting.NewCounterSink()
+			pins := newCertificatePins(ctx, tc.pins, metrics.NewMetrics(sink).CertificatePins())
+			_, insecure := newClusterProxy(nil, pins).Transports()
+			transport := insecure.(*http.Transport).Clone()
+			transport.Proxy = nil
+			transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, server.Listener.Addr().String())
+			}
+
+			req, err := http.NewRequestWithContext(ctx, "GET", "https://registry.example.com/v2/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := (&http.Client{Transport: transport}).Do(req)
+			if err == nil {
+				resp.Body.Close()
+			}
+
+			var pinErr *certificatePinError
+			if tc.rejected {
+				if !errors.As(err, &pinErr) {
+					t.Fatalf("got error %v, want a certificate pin error", err)
+				}
+				if err := c.Diff(counter.M{"pullthrough_certificate_pin_failures:registry.example.com": 1}); err != nil {
+					t.Error(err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Diff(counter.M{}); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestCertificatePinsVerifiedChains(t *testing.T) {
+	ctx := testutil.WithTestLogger(context.Background(), t)
+
+	leaf := &x509.Certificate{RawSubjectPublicKeyInfo: []byte("leaf")}
+	intermediate := &x509.Certificate{RawSubjectPublicKeyInfo: []byte("intermediate")}
+	pins := newCertificatePins(ctx, map[string][]string{
+		"quay.io": {certificatePin(intermediate)},
+	}, metrics.NewNoopMetrics().CertificatePins())
+
+	// The certificates that the server sends aren't trusted unless they are
+	// part of a verified chain.
+	unverified := tls.ConnectionState{
+		ServerName:       "Quay.io",
+		PeerCertificates: []*x509.Certificate{leaf, intermediate},
+	}
+	if err := pins.VerifyConnection(unverified); err == nil {
+		t.Error("expected the unverified intermediate certificate not to match the pins")
+	}
+
+	verified := unverified
+	verified.VerifiedChains = [][]*x509.Certificate{{leaf, intermediate}}
+	if err := pins.VerifyConnection(verified); err != nil {
+		t.Errorf("unexpected error for the verified chain: %v", err)
+	}
+}
@@ -3,6 +3,7 @@ package client
 import (
 	authnv1 "k8s.io/client-go/kubernetes/typed/authentication/v1"
 	authclientv1 "k8s.io/client-go/kubernetes/typed/authorization/v1"
+	coordinationclientv1 "k8s.io/client-go/kubernetes/typed/coordination/v1"
 	coreclientv1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	restclient "k8s.io/client-go/rest"
 
@@ -24,14 +25,22 @@ type RegistryClient interface {
 // Interface contains client methods that registry use to communicate with
 // Origin or Kubernetes API.
 type Interface interface {
+	ImageConfigsInterfacer
+	ProxyConfigsInterfacer
 	ImageSignaturesInterfacer
 	ImagesInterfacer
 	ImageStreamImagesNamespacer
+	ImageStreamImportsNamespacer
 	ImageStreamMappingsNamespacer
 	ImageStreamSecretsNamespacer
 	ImageStreamsNamespacer
 	ImageStreamTagsNamespacer
 	LimitRangesGetter
+	NamespacesGetter
+	ConfigMapsGetter
+	EventsGetter
+	PodsGetter
+	LeasesGetter
 	SelfSubjectReviews
 	LocalSubjectAccessReviewsNamespacer
 	SelfSubjectAccessReviewsNamespacer
@@ -47,6 +56,7 @@ type apiClient struct {
 	user     userclientv1.UserV1Interface
 	operator operatorclientv1alpha1.OperatorV1alpha1Interface
 	config   cfgv1.ConfigV1Interface
+	coord    coordinationclientv1.CoordinationV1Interface
 }
 
 func newAPIClient(
@@ -57,6 +67,7 @@ func newAPIClient(
 	userClient userclientv1.UserV1Interface,
 	operatorClient operatorclientv1alpha1.OperatorV1alpha1Interface,
 	configClient cfgv1.ConfigV1Interface,
+	coordinationClient coordinationclientv1.CoordinationV1Interface,
 ) Interface {
 	return &apiClient{
 		kube:     kc,
@@ -66,6 +77,7 @@ func newAPIClient(
 		user:     userClient,
 		operator: operatorClient,
 		config:   configClient,
+		coord:    coordinationClient,
 	}
 }
 
@@ -81,6 +93,14 @@ func (c *apiClient) ImageTagMirrorSet() cfgv1.ImageTagMirrorSetInterface {
 	return c.config.ImageTagMirrorSets()
 }
 
+func (c *apiClient) ImageConfigs() cfgv1.ImageInterface {
+	return c.config.Images()
+}
+
+func (c *apiClient) ProxyConfigs() cfgv1.ProxyInterface {
+	return c.config.Proxies()
+}
+
 func (c *apiClient) Images() ImageInterface {
 	return c.image.Images()
 }
@@ -97,6 +117,10 @@ func (c *apiClient) ImageStreamImages(namespace string) ImageStreamImageInterfac
 	return c.image.ImageStreamImages(namespace)
 }
 
+func (c *apiClient) ImageStreamImports(namespace string) ImageStreamImportInterface {
+	return c.image.ImageStreamImports(namespace)
+}
+
 func (c *apiClient) ImageStreamMappings(namespace string) ImageStreamMappingInterface {
 	return c.image.ImageStreamMappings(namespace)
 }
@@ -113,6 +137,26 @@ func (c *apiClient) LimitRanges(namespace string) LimitRangeInterface {
 	return c.kube.LimitRanges(namespace)
 }
 
+func (c *apiClient) Namespaces() NamespaceInterface {
+	return c.kube.Namespaces()
+}
+
+func (c *apiClient) ConfigMaps(namespace string) ConfigMapInterface {
+	return c.kube.ConfigMaps(namespace)
+}
+
+func (c *apiClient) Events(namespace string) EventInterface {
+	return c.kube.Events(namespace)
+}
+
+func (c *apiClient) Pods(namespace string) PodInterface {
+	return c.kube.Pods(namespace)
+}
+
+func (c *apiClient) Leases(namespace string) coordinationclientv1.LeaseInterface {
+	return c.coord.Leases(namespace)
+}
+
 func (c *apiClient) SelfSubjectReviews() SelfSubjectReviewInterface {
 	return c.authn.SelfSubjectReviews()
 }
@@ -131,6 +175,9 @@ func (c *apiClient) SubjectAccessReviews() SubjectAccessReviewInterface {
 
 type registryClient struct {
 	kubeConfig *restclient.Config
+
+	// minVersion is nil if the minimum TLS version isn't configured.
+	minVersion *minTLSVersion
 }
 
 // NewRegistryClient provides a new registry client.
@@ -153,13 +200,14 @@ func (c *registryClient) Client() (Interface, error) {
 		userclientv1.NewForConfigOrDie(c.kubeConfig),
 		operatorclientv1alpha1.NewForConfigOrDie(c.kubeConfig),
 		cfgv1.NewForConfigOrDie(c.kubeConfig),
+		coordinationclientv1.NewForConfigOrDie(c.kubeConfig),
 	), nil
 }
 
 // ClientFromToken returns the client based on the bearer token.
 func (c *registryClient) ClientFromToken(token string) (Interface, error) {
 	newClient := *c
-	newKubeconfig := restclient.AnonymousClientConfig(newClient.kubeConfig)
+	newKubeconfig := c.withMinTLSVersion(restclient.AnonymousClientConfig(newClient.kubeConfig))
 	newKubeconfig.BearerToken = token
 	newClient.kubeConfig = newKubeconfig
 
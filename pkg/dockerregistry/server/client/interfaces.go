@@ -6,6 +6,7 @@ import (
 	authnv1 "k8s.io/api/authentication/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	coreclientv1 "k8s.io/client-go/kubernetes/typed/core/v1"
 
 	imageapiv1 "github.com/openshift/api/image/v1"
@@ -17,6 +18,7 @@ import (
 	cfgv1 "github.com/openshift/client-go/config/clientset/versioned/typed/config/v1"
 	authnclientv1 "k8s.io/client-go/kubernetes/typed/authentication/v1"
 	authclientv1 "k8s.io/client-go/kubernetes/typed/authorization/v1"
+	coordinationclientv1 "k8s.io/client-go/kubernetes/typed/coordination/v1"
 )
 
 type ImageContentSourcePolicyInterfacer interface {
@@ -25,6 +27,14 @@ type ImageContentSourcePolicyInterfacer interface {
 	ImageTagMirrorSet() cfgv1.ImageTagMirrorSetInterface
 }
 
+type ImageConfigsInterfacer interface {
+	ImageConfigs() cfgv1.ImageInterface
+}
+
+type ProxyConfigsInterfacer interface {
+	ProxyConfigs() cfgv1.ProxyInterface
+}
+
 type ImagesInterfacer interface {
 	Images() ImageInterface
 }
@@ -37,6 +47,10 @@ type ImageStreamImagesNamespacer interface {
 	ImageStreamImages(namespace string) ImageStreamImageInterface
 }
 
+type ImageStreamImportsNamespacer interface {
+	ImageStreamImports(namespace string) ImageStreamImportInterface
+}
+
 type ImageStreamsNamespacer interface {
 	ImageStreams(namespace string) ImageStreamInterface
 }
@@ -57,6 +71,26 @@ type LimitRangesGetter interface {
 	LimitRanges(namespace string) LimitRangeInterface
 }
 
+type NamespacesGetter interface {
+	Namespaces() NamespaceInterface
+}
+
+type ConfigMapsGetter interface {
+	ConfigMaps(namespace string) ConfigMapInterface
+}
+
+type EventsGetter interface {
+	Events(namespace string) EventInterface
+}
+
+type PodsGetter interface {
+	Pods(namespace string) PodInterface
+}
+
+type LeasesGetter interface {
+	Leases(namespace string) coordinationclientv1.LeaseInterface
+}
+
 type SelfSubjectReviews interface {
 	SelfSubjectReviews() SelfSubjectReviewInterface
 }
@@ -92,6 +126,13 @@ type ImageInterface interface {
 	Create(ctx context.Context, image *imageapiv1.Image, opts metav1.CreateOptions) (*imageapiv1.Image, error)
 	Update(ctx context.Context, image *imageapiv1.Image, opts metav1.UpdateOptions) (*imageapiv1.Image, error)
 	List(ctx context.Context, opts metav1.ListOptions) (*imageapiv1.ImageList, error)
+	Delete(ctx context.Context, name string, opts metav1.DeleteOptions) error
+}
+
+var _ ImageStreamImportInterface = imageclientv1.ImageStreamImportInterface(nil)
+
+type ImageStreamImportInterface interface {
+	Create(ctx context.Context, imageStreamImport *imageapiv1.ImageStreamImport, opts metav1.CreateOptions) (*imageapiv1.ImageStreamImport, error)
 }
 
 var _ ImageStreamInterface = imageclientv1.ImageStreamInterface(nil)
@@ -127,6 +168,34 @@ type LimitRangeInterface interface {
 	List(ctx context.Context, opts metav1.ListOptions) (*corev1.LimitRangeList, error)
 }
 
+var _ NamespaceInterface = coreclientv1.NamespaceInterface(nil)
+
+type NamespaceInterface interface {
+	Get(ctx context.Context, name string, opts metav1.GetOptions) (*corev1.Namespace, error)
+}
+
+var _ ConfigMapInterface = coreclientv1.ConfigMapInterface(nil)
+
+type ConfigMapInterface interface {
+	Get(ctx context.Context, name string, opts metav1.GetOptions) (*corev1.ConfigMap, error)
+	Create(ctx context.Context, configMap *corev1.ConfigMap, opts metav1.CreateOptions) (*corev1.ConfigMap, error)
+	Update(ctx context.Context, configMap *corev1.ConfigMap, opts metav1.UpdateOptions) (*corev1.ConfigMap, error)
+}
+
+var _ EventInterface = coreclientv1.EventInterface(nil)
+
+type EventInterface interface {
+	Create(ctx context.Context, event *corev1.Event, opts metav1.CreateOptions) (*corev1.Event, error)
+	Update(ctx context.Context, event *corev1.Event, opts metav1.UpdateOptions) (*corev1.Event, error)
+	Patch(ctx context.Context, name string, pt types.PatchType, data []byte, opts metav1.PatchOptions, subresources ...string) (*corev1.Event, error)
+}
+
+var _ PodInterface = coreclientv1.PodInterface(nil)
+
+type PodInterface interface {
+	List(ctx context.Context, opts metav1.ListOptions) (*corev1.PodList, error)
+}
+
 var _ SelfSubjectReviewInterface = authnclientv1.SelfSubjectReviewInterface(nil)
 
 type SelfSubjectReviewInterface interface {
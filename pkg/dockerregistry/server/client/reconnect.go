@@ -0,0 +1,329 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	coordinationclientv1 "k8s.io/client-go/kubernetes/typed/coordination/v1"
+	restclient "k8s.io/client-go/rest"
+
+	cfgv1 "github.com/openshift/client-go/config/clientset/versioned/typed/config/v1"
+	operatorclientv1alpha1 "github.com/openshift/client-go/operator/clientset/versioned/typed/operator/v1alpha1"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/metrics"
+)
+
+// ReconnectConfig configures a registry client that is rebuilt when the API
+// server keeps rejecting its credentials.
+type ReconnectConfig struct {
+	// Failures is the number of consecutive requests that fail because of
+	// the credentials after which the client is rebuilt.
+	Failures int
+	// InitialBackoff is the delay before the client is rebuilt again if the
+	// requests keep failing. It is doubled after each rebuild.
+	InitialBackoff time.Duration
+	// MaxBackoff limits the delay between rebuilds.
+	MaxBackoff time.Duration
+	// Metrics reports the failing requests and the rebuilds.
+	Metrics metrics.KubeClient
+}
+
+// reconnectingRegistryClient is a registry client whose clients are built
+// once and rebuilt by newClient when the requests of the registry keep
+// failing with 401 Unauthorized or with certificates that cannot be verified.
+// newClient is expected to reload the kubeconfig, so that the rotated
+// certificates and tokens are picked up.
+//
+// The bound service account tokens don't need a rebuild, the clients reload
+// the token files themselves.
+type reconnectingRegistryClient struct {
+	ctx       context.Context
+	newClient func() (RegistryClient, error)
+	config    ReconnectConfig
+
+	// failures is the number of consecutive requests of the registry that
+	// failed because of the credentials.
+	failures atomic.Int32
+
+	mu             sync.RWMutex
+	registryClient *registryClient
+	client         Interface
+	// backoff is the delay between the next rebuild and the one after it.
+	backoff time.Duration
+	// nextRebuild is the earliest time of the next rebuild.
+	nextRebuild time.Time
+}
+
+// NewReconnectingRegistryClient returns a registry client that is built by
+// newClient and rebuilt when the API server keeps rejecting its credentials.
+// The clients returned by Client use the rebuilt client too.
+func NewReconnectingRegistryClient(ctx context.Context, newClient func() (RegistryClient, error), config ReconnectConfig) (RegistryClient, error) {
+	c := &reconnectingRegistryClient{
+		ctx:       ctx,
+		newClient: newClient,
+		config:    config,
+		backoff:   config.InitialBackoff,
+	}
+	if err := c.build(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// build replaces the clients with the ones built by newClient.
+func (c *reconnectingRegistryClient) build() error {
+	rc, err := c.newClient()
+	if err != nil {
+		return err
+	}
+	r, ok := rc.(*registryClient)
+	if !ok {
+		return fmt.Errorf("unable to rebuild the registry client of type %T", rc)
+	}
+
+	kubeConfig := restclient.CopyConfig(r.kubeConfig)
+	if kubeConfig.CAFile != "" {
+		// The transports are cached by the paths of the files, so the
+		// rebuilt client would keep the old certificate authorities.
+		data, err := os.ReadFile(kubeConfig.CAFile)
+		if err != nil {
+			return fmt.Errorf("unable to read the CA bundle: %w", err)
+		}
+		kubeConfig.CAData = data
+		kubeConfig.CAFile = ""
+	}
+	wrapTransport := kubeConfig.WrapTransport
+	kubeConfig.WrapTransport = func(rt http.RoundTripper) http.RoundTripper {
+		if wrapTransport != nil {
+			rt = wrapTransport(rt)
+		}
+		return &failureObservingTransport{
+			RoundTripper: rt,
+			client:       c,
+		}
+	}
+
+	rebuilt := &registryClient{
+		kubeConfig: kubeConfig,
+		minVersion: r.minVersion,
+	}
+	client, err := rebuilt.Client()
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.registryClient = rebuilt
+	c.client = client
+	return nil
+}
+
+// succeeded resets the failures and the backoff after a request that isn't
+// rejected because of the credentials.
+func (c *reconnectingRegistryClient) succeeded() {
+	if c.failures.Swap(0) == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.backoff = c.config.InitialBackoff
+}
+
+// failed counts a request that failed because of reason and rebuilds the
+// clients if the requests keep failing and the backoff is over.
+func (c *reconnectingRegistryClient) failed(reason string) {
+	c.config.Metrics.Failed(reason)
+	if int(c.failures.Add(1)) < c.config.Failures {
+		return
+	}
+
+	c.mu.Lock()
+	now := time.Now()
+	if now.Before(c.nextRebuild) {
+		c.mu.Unlock()
+		return
+	}
+	c.nextRebuild = now.Add(c.backoff)
+	c.backoff *= 2
+	if c.backoff > c.config.MaxBackoff {
+		c.backoff = c.config.MaxBackoff
+	}
+	c.mu.Unlock()
+
+	dcontext.GetLogger(c.ctx).Warnf("rebuilding the clients of the API server after %d failed requests (last reason: %s)", c.failures.Load(), reason)
+	err := c.build()
+	c.config.Metrics.Rebuilt(err)
+	if err != nil {
+		dcontext.GetLogger(c.ctx).Errorf("unable to rebuild the clients of the API server: %v", err)
+	}
+}
+
+func (c *reconnectingRegistryClient) current() (*registryClient, Interface) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.registryClient, c.client
+}
+
+// Client returns the client that uses the clients rebuilt later too.
+func (c *reconnectingRegistryClient) Client() (Interface, error) {
+	return &reconnectingClient{registryClient: c}, nil
+}
+
+// ClientFromToken returns the client based on the bearer token. The client
+// is not rebuilt, but it uses the certificate authorities of the latest
+// rebuild.
+func (c *reconnectingRegistryClient) ClientFromToken(token string) (Interface, error) {
+	rc, _ := c.current()
+	return rc.ClientFromToken(token)
+}
+
+// failureObservingTransport reports the responses of the requests of the
+// registry to its client.
+type failureObservingTransport struct {
+	http.RoundTripper
+
+	client *reconnectingRegistryClient
+}
+
+func (t *failureObservingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		// The other errors, like the unreachable API server, are not
+		// fixed by a rebuild.
+		if isCertificateError(err) {
+			t.client.failed(metrics.KubeClientFailureCertificate)
+		}
+		return resp, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		t.client.failed(metrics.KubeClientFailureUnauthorized)
+	} else {
+		t.client.succeeded()
+	}
+	return resp, err
+}
+
+// isCertificateError returns true if err is caused by a certificate of the
+// API server that cannot be verified.
+func isCertificateError(err error) bool {
+	var verificationErr *tls.CertificateVerificationError
+	var authorityErr x509.UnknownAuthorityError
+	return errors.As(err, &verificationErr) || errors.As(err, &authorityErr)
+}
+
+// reconnectingClient is a client that uses the latest clients of its
+// registry client, so that the long-lived users of the client get the rebuilt
+// clients.
+type reconnectingClient struct {
+	registryClient *reconnectingRegistryClient
+}
+
+var _ Interface = &reconnectingClient{}
+
+func (c *reconnectingClient) current() Interface {
+	_, client := c.registryClient.current()
+	return client
+}
+
+func (c *reconnectingClient) ImageContentSourcePolicy() operatorclientv1alpha1.ImageContentSourcePolicyInterface {
+	return c.current().ImageContentSourcePolicy()
+}
+
+func (c *reconnectingClient) ImageDigestMirrorSet() cfgv1.ImageDigestMirrorSetInterface {
+	return c.current().ImageDigestMirrorSet()
+}
+
+func (c *reconnectingClient) ImageTagMirrorSet() cfgv1.ImageTagMirrorSetInterface {
+	return c.current().ImageTagMirrorSet()
+}
+
+func (c *reconnectingClient) ImageConfigs() cfgv1.ImageInterface {
+	return c.current().ImageConfigs()
+}
+
+func (c *reconnectingClient) ProxyConfigs() cfgv1.ProxyInterface {
+	return c.current().ProxyConfigs()
+}
+
+func (c *reconnectingClient) Images() ImageInterface {
+	return c.current().Images()
+}
+
+func (c *reconnectingClient) ImageSignatures() ImageSignatureInterface {
+	return c.current().ImageSignatures()
+}
+
+func (c *reconnectingClient) ImageStreams(namespace string) ImageStreamInterface {
+	return c.current().ImageStreams(namespace)
+}
+
+func (c *reconnectingClient) ImageStreamImages(namespace string) ImageStreamImageInterface {
+	return c.current().ImageStreamImages(namespace)
+}
+
+func (c *reconnectingClient) ImageStreamImports(namespace string) ImageStreamImportInterface {
+	return c.current().ImageStreamImports(namespace)
+}
+
+func (c *reconnectingClient) ImageStreamMappings(namespace string) ImageStreamMappingInterface {
+	return c.current().ImageStreamMappings(namespace)
+}
+
+func (c *reconnectingClient) ImageStreamTags(namespace string) ImageStreamTagInterface {
+	return c.current().ImageStreamTags(namespace)
+}
+
+func (c *reconnectingClient) ImageStreamSecrets(namespace string) ImageStreamSecretInterface {
+	return c.current().ImageStreamSecrets(namespace)
+}
+
+func (c *reconnectingClient) LimitRanges(namespace string) LimitRangeInterface {
+	return c.current().LimitRanges(namespace)
+}
+
+func (c *reconnectingClient) Namespaces() NamespaceInterface {
+	return c.current().Namespaces()
+}
+
+func (c *reconnectingClient) ConfigMaps(namespace string) ConfigMapInterface {
+	return c.current().ConfigMaps(namespace)
+}
+
+func (c *reconnectingClient) Events(namespace string) EventInterface {
+	return c.current().Events(namespace)
+}
+
+func (c *reconnectingClient) Pods(namespace string) PodInterface {
+	return c.current().Pods(namespace)
+}
+
+func (c *reconnectingClient) Leases(namespace string) coordinationclientv1.LeaseInterface {
+	return c.current().Leases(namespace)
+}
+
+func (c *reconnectingClient) SelfSubjectReviews() SelfSubjectReviewInterface {
+	return c.current().SelfSubjectReviews()
+}
+
+func (c *reconnectingClient) LocalSubjectAccessReviews(namespace string) LocalSubjectAccessReviewInterface {
+	return c.current().LocalSubjectAccessReviews(namespace)
+}
+
+func (c *reconnectingClient) SelfSubjectAccessReviews() SelfSubjectAccessReviewInterface {
+	return c.current().SelfSubjectAccessReviews()
+}
+
+func (c *reconnectingClient) SubjectAccessReviews() SubjectAccessReviewInterface {
+	return c.current().SubjectAccessReviews()
+}
@@ -0,0 +1,191 @@
+package client
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	authnv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	restclient "k8s.io/client-go/rest"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/metrics"
+	metricstesting "github.com/openshift/image-registry/pkg/dockerregistry/server/metrics/testing"
+)
+
+// newSelfSubjectReviewServer returns a server that accepts the self subject
+// reviews with the token that is returned by token.
+func newSelfSubjectReviewServer(token func() string) *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if t := token(); t != "" && r.Header.Get("Authorization") != "Bearer "+t {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"Unauthorized","code":401}`))
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"kind":"SelfSubjectReview","apiVersion":"authentication.k8s.io/v1","status":{"userInfo":{"username":"registry"}}}`))
+	}))
+}
+
+func writeServerCA(t *testing.T, caFile string, server *httptest.Server) {
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func selfSubjectReview(c Interface) error {
+	_, err := c.SelfSubjectReviews().Create(context.Background(), &authnv1.SelfSubjectReview{}, metav1.CreateOptions{})
+	return err
+}
+
+func TestReconnectingRegistryClientToken(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		accepted = "first"
+		token    = "expired"
+		builds   int
+	)
+	server := newSelfSubjectReviewServer(func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return accepted
+	})
+	defer server.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	writeServerCA(t, caFile, server)
+
+	c, sink := metricstesting.NewCounterSink()
+	registryClient, err := NewReconnectingRegistryClient(context.Background(), func() (RegistryClient, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		builds++
+		return &registryClient{
+			kubeConfig: &restclient.Config{
+				Host:            server.URL,
+				BearerToken:     token,
+				TLSClientConfig: restclient.TLSClientConfig{CAFile: caFile},
+			},
+		}, nil
+	}, ReconnectConfig{
+		Failures:       2,
+		InitialBackoff: time.Hour,
+		MaxBackoff:     time.Hour,
+		Metrics:        metrics.NewMetrics(sink).KubeClient(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := registryClient.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := selfSubjectReview(client); err == nil {
+		t.Fatal("the expired token is accepted")
+	}
+	mu.Lock()
+	token = "first"
+	mu.Unlock()
+	if err := selfSubjectReview(client); err == nil {
+		t.Fatal("the token is reloaded before the failures reach the threshold")
+	}
+	if err := selfSubjectReview(client); err != nil {
+		t.Fatalf("the client isn't rebuilt with the new token: %v", err)
+	}
+
+	// The token is rotated again, but the client isn't rebuilt until the
+	// backoff is over.
+	mu.Lock()
+	accepted, token = "second", "second"
+	mu.Unlock()
+	for i := 0; i < 3; i++ {
+		if err := selfSubjectReview(client); err == nil {
+			t.Fatal("the client is rebuilt during the backoff")
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if builds != 2 {
+		t.Errorf("got %d builds, want 2", builds)
+	}
+	values := c.Values()
+	if n := values["api_client_auth_failures:"+metrics.KubeClientFailureUnauthorized]; n != 5 {
+		t.Errorf("got %d unauthorized requests, want 5", n)
+	}
+	if n := values["api_client_rebuilds:success"]; n != 1 {
+		t.Errorf("got %d rebuilds, want 1", n)
+	}
+}
+
+func TestReconnectingRegistryClientCARotation(t *testing.T) {
+	server := newSelfSubjectReviewServer(func() string { return "" })
+	defer server.Close()
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.crt")
+	// The certificate of the client isn't the CA of the server.
+	certFile, _ := writeClientCertificate(t, dir)
+	data, err := os.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(caFile, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c, sink := metricstesting.NewCounterSink()
+	registryClient, err := NewReconnectingRegistryClient(context.Background(), func() (RegistryClient, error) {
+		return &registryClient{
+			kubeConfig: &restclient.Config{
+				Host:            server.URL,
+				BearerToken:     "registry-token",
+				TLSClientConfig: restclient.TLSClientConfig{CAFile: caFile},
+			},
+		}, nil
+	}, ReconnectConfig{
+		Failures:       1,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     time.Millisecond,
+		Metrics:        metrics.NewMetrics(sink).KubeClient(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := registryClient.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The CA bundle is rotated in place, so the path of the file is the same.
+	writeServerCA(t, caFile, server)
+	if err := selfSubjectReview(client); err == nil {
+		t.Fatal("the certificate of the server is verified with the unrelated CA")
+	}
+	if err := selfSubjectReview(client); err != nil {
+		t.Fatalf("the client isn't rebuilt with the rotated CA: %v", err)
+	}
+
+	userClient, err := registryClient.ClientFromToken("user-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := selfSubjectReview(userClient); err != nil {
+		t.Errorf("the user client doesn't use the rotated CA: %v", err)
+	}
+
+	values := c.Values()
+	if n := values["api_client_auth_failures:"+metrics.KubeClientFailureCertificate]; n != 1 {
+		t.Errorf("got %d certificate failures, want 1", n)
+	}
+	if n := values["api_client_rebuilds:success"]; n != 1 {
+		t.Errorf("got %d rebuilds, want 1", n)
+	}
+}
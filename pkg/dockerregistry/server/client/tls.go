@@ -0,0 +1,112 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+
+	restclient "k8s.io/client-go/rest"
+
+	"github.com/openshift/image-registry/pkg/origin-common/clientcmd"
+)
+
+// TLSConfig configures the connections to the API server in addition to the
+// kubeconfig. The empty fields keep the settings of the kubeconfig.
+type TLSConfig struct {
+	// CAFile is a PEM bundle of the certificate authorities that are
+	// trusted to sign the certificate of the API server.
+	CAFile string
+	// CertFile and KeyFile are the client certificate and its key. They
+	// are presented only by the clients of the registry itself, not by the
+	// clients with the tokens of users, as the API server would
+	// authenticate the users as the registry.
+	CertFile string
+	KeyFile  string
+	// MinVersion is the minimum TLS version, e.g. tls.VersionTLS13.
+	MinVersion uint16
+}
+
+// NewRegistryClientWithTLS is like NewRegistryClient, but connects to the API
+// server with tlsConfig. The files of tlsConfig are checked in advance, so
+// that a misconfiguration is reported at startup.
+func NewRegistryClientWithTLS(config *clientcmd.Config, tlsConfig TLSConfig) (RegistryClient, error) {
+	c := NewRegistryClient(config).(*registryClient)
+
+	if tlsConfig.CAFile != "" {
+		data, err := os.ReadFile(tlsConfig.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the CA bundle: %w", err)
+		}
+		if !x509.NewCertPool().AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("the CA bundle %s has no PEM encoded certificates", tlsConfig.CAFile)
+		}
+		// CAData takes precedence over CAFile.
+		c.kubeConfig.CAFile = tlsConfig.CAFile
+		c.kubeConfig.CAData = nil
+	}
+
+	if tlsConfig.CertFile != "" || tlsConfig.KeyFile != "" {
+		if _, err := tls.LoadX509KeyPair(tlsConfig.CertFile, tlsConfig.KeyFile); err != nil {
+			return nil, fmt.Errorf("unable to load the client certificate: %w", err)
+		}
+		c.kubeConfig.CertFile = tlsConfig.CertFile
+		c.kubeConfig.CertData = nil
+		c.kubeConfig.KeyFile = tlsConfig.KeyFile
+		c.kubeConfig.KeyData = nil
+	}
+
+	if tlsConfig.MinVersion != 0 {
+		c.minVersion = &minTLSVersion{
+			version:    tlsConfig.MinVersion,
+			transports: make(map[*http.Transport]*http.Transport),
+		}
+		c.kubeConfig.WrapTransport = c.minVersion.wrap
+	}
+
+	return c, nil
+}
+
+// minTLSVersion raises the minimum TLS version of the transports of the
+// clients. The rest config has no setting for it.
+type minTLSVersion struct {
+	version uint16
+
+	mu sync.Mutex
+	// transports maps the transports that are shared between the clients
+	// with the same TLS configuration to their copies, so that the copies
+	// are shared too and the connections are reused.
+	transports map[*http.Transport]*http.Transport
+}
+
+func (v *minTLSVersion) wrap(rt http.RoundTripper) http.RoundTripper {
+	t, ok := rt.(*http.Transport)
+	if !ok {
+		return rt
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if c, ok := v.transports[t]; ok {
+		return c
+	}
+	c := t.Clone()
+	if c.TLSClientConfig == nil {
+		c.TLSClientConfig = &tls.Config{}
+	}
+	c.TLSClientConfig.MinVersion = v.version
+	v.transports[t] = c
+	return c
+}
+
+// withMinTLSVersion adds the minimum TLS version to config, as
+// AnonymousClientConfig doesn't copy it.
+func (c *registryClient) withMinTLSVersion(config *restclient.Config) *restclient.Config {
+	if c.minVersion != nil {
+		config.WrapTransport = c.minVersion.wrap
+	}
+	return config
+}
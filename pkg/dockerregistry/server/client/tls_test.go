@@ -0,0 +1,189 @@
+package client
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	authnv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/openshift/image-registry/pkg/origin-common/clientcmd"
+)
+
+// writeClientCertificate writes a self-signed client certificate and its key
+// into dir.
+func writeClientCertificate(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "system:serviceaccount:openshift-image-registry:registry"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestNewRegistryClientWithTLSErrors(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeClientCertificate(t, dir)
+	garbage := filepath.Join(dir, "garbage.pem")
+	if err := os.WriteFile(garbage, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name      string
+		tlsConfig TLSConfig
+	}{
+		{
+			name:      "missing CA bundle",
+			tlsConfig: TLSConfig{CAFile: filepath.Join(dir, "missing.pem")},
+		},
+		{
+			name:      "CA bundle without certificates",
+			tlsConfig: TLSConfig{CAFile: garbage},
+		},
+		{
+			name:      "invalid key",
+			tlsConfig: TLSConfig{CertFile: certFile, KeyFile: garbage},
+		},
+		{
+			name:      "key of another certificate",
+			tlsConfig: TLSConfig{CertFile: certFile, KeyFile: certFile},
+		},
+	} {
+		config := clientcmd.NewConfig()
+		config.SkipEnv = true
+		if _, err := NewRegistryClientWithTLS(config, tc.tlsConfig); err == nil {
+			t.Errorf("%s: expected an error", tc.name)
+		}
+	}
+
+	config := clientcmd.NewConfig()
+	config.SkipEnv = true
+	if _, err := NewRegistryClientWithTLS(config, TLSConfig{CertFile: certFile, KeyFile: keyFile}); err != nil {
+		t.Errorf("valid client certificate: %v", err)
+	}
+}
+
+func TestNewRegistryClientWithTLS(t *testing.T) {
+	type request struct {
+		version       uint16
+		clientCert    bool
+		authorization string
+	}
+	var (
+		mu       sync.Mutex
+		requests []request
+	)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, request{
+			version:       r.TLS.Version,
+			clientCert:    len(r.TLS.PeerCertificates) > 0,
+			authorization: r.Header.Get("Authorization"),
+		})
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"kind":"SelfSubjectReview","apiVersion":"authentication.k8s.io/v1","status":{"userInfo":{"username":"registry"}}}`))
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.crt")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := writeClientCertificate(t, dir)
+
+	config := clientcmd.NewConfig()
+	config.SkipEnv = true
+	if err := config.MasterAddr.Set(server.URL); err != nil {
+		t.Fatal(err)
+	}
+	registryClient, err := NewRegistryClientWithTLS(config, TLSConfig{
+		CAFile:     caFile,
+		CertFile:   certFile,
+		KeyFile:    keyFile,
+		MinVersion: tls.VersionTLS13,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	c, err := registryClient.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.SelfSubjectReviews().Create(ctx, &authnv1.SelfSubjectReview{}, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("registry client: %v", err)
+	}
+
+	userClient, err := registryClient.ClientFromToken("user-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := userClient.SelfSubjectReviews().Create(ctx, &authnv1.SelfSubjectReview{}, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("user client: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(requests) != 2 {
+		t.Fatalf("got %d requests, want 2", len(requests))
+	}
+	for i, r := range requests {
+		if r.version != tls.VersionTLS13 {
+			t.Errorf("request %d: got TLS version %x, want TLS 1.3", i, r.version)
+		}
+	}
+	if !requests[0].clientCert {
+		t.Errorf("the registry client didn't present the client certificate")
+	}
+	if requests[1].clientCert {
+		t.Errorf("the user client presented the client certificate of the registry")
+	}
+	if requests[1].authorization != "Bearer user-token" {
+		t.Errorf("got Authorization %q for the user client, want the token of the user", requests[1].authorization)
+	}
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	configv1 "github.com/openshift/api/config/v1"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+)
+
+const (
+	// proxyConfigName is the name of the cluster-wide proxy configuration.
+	proxyConfigName = "cluster"
+
+	// clusterProxyTTL is how long the proxy configuration is cached.
+	clusterProxyTTL = time.Minute
+
+	// clusterProxyErrorTTL is how long the errors reading the proxy
+	// configuration are cached.
+	clusterProxyErrorTTL = 10 * time.Second
+)
+
+// proxyConnectError is returned when the proxy refuses to establish a tunnel
+// to the upstream registry.
+type proxyConnectError struct {
+	proxy  string
+	status string
+}
+
+func (e *proxyConnectError) Error() string {
+	return fmt.Sprintf("proxyconnect %s: %s", e.proxy, e.status)
+}
+
+// clusterProxy selects the proxy for connections to upstream registries
+// according to the cluster proxy configuration. The environment variables
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY are used when the cluster doesn't have
+// a proxy configuration.
+type clusterProxy struct {
+	registryClient client.RegistryClient
+
+	secureTransport   http.RoundTripper
+	insecureTransport http.RoundTripper
+
+	// status caches the status of the proxy configuration. A nil value
+	// means the cluster doesn't configure a proxy.
+	status *ttlCache[*configv1.ProxyStatus]
+}
+
+// newClusterProxy returns the proxy selector for connections to upstream
+// registries. The certificates of the registries are checked against pins, if
+// any.
+func newClusterProxy(registryClient client.RegistryClient, pins *certificatePins) *clusterProxy {
+	p := &clusterProxy{
+		registryClient: registryClient,
+	}
+	p.status = newTTLCache(clusterProxyTTL, clusterProxyErrorTTL, p.loadProxyStatus)
+
+	secure := http.DefaultTransport.(*http.Transport).Clone()
+	secure.Proxy = p.Proxy
+	secure.OnProxyConnectResponse = onProxyConnectResponse
+	secure.TLSClientConfig = pins.tlsConfig(false)
+	p.secureTransport = secure
+
+	insecure := secure.Clone()
+	insecure.TLSClientConfig = pins.tlsConfig(true)
+	p.insecureTransport = insecure
+
+	return p
+}
+
+// Transports returns the transports for secure and insecure upstream
+// registries. The default transports are used if p is nil.
+func (p *clusterProxy) Transports() (secure http.RoundTripper, insecure http.RoundTripper) {
+	if p == nil {
+		return secureTransport, insecureTransport
+	}
+	return p.secureTransport, p.insecureTransport
+}
+
+func (p *clusterProxy) loadProxyStatus(ctx context.Context) (*configv1.ProxyStatus, error) {
+	c, err := p.registryClient.Client()
+	if err != nil {
+		dcontext.GetLogger(ctx).Errorf("unable to get client to read the proxy configuration: %v", err)
+		return nil, err
+	}
+
+	config, err := c.ProxyConfigs().Get(ctx, proxyConfigName, metav1.GetOptions{})
+	switch {
+	case kerrors.IsNotFound(err):
+		return nil, nil
+	case err != nil:
+		dcontext.GetLogger(ctx).Errorf("unable to get the proxy configuration %s: %v", proxyConfigName, err)
+		return nil, err
+	case len(config.Status.HTTPProxy) == 0 && len(config.Status.HTTPSProxy) == 0:
+		return nil, nil
+	}
+	return &config.Status, nil
+}
+
+// proxyStatus returns the cached status of the proxy configuration. The last
+// known configuration is used while the proxy configuration cannot be read.
+func (p *clusterProxy) proxyStatus(ctx context.Context) *configv1.ProxyStatus {
+	status, _ := p.status.Get(ctx)
+	return status
+}
+
+// Proxy returns the URL of the proxy for req, or nil if req should not use a
+// proxy. Registries inside the cluster are always reached directly.
+func (p *clusterProxy) Proxy(req *http.Request) (*url.URL, error) {
+	if isInClusterHost(req.URL.Hostname()) {
+		return nil, nil
+	}
+
+	status := p.proxyStatus(req.Context())
+	if status == nil {
+		return http.ProxyFromEnvironment(req)
+	}
+
+	proxy := status.HTTPProxy
+	if req.URL.Scheme == "https" {
+		proxy = status.HTTPSProxy
+	}
+	if len(proxy) == 0 || matchNoProxy(status.NoProxy, req.URL) {
+		return nil, nil
+	}
+
+	if !strings.Contains(proxy, "://") {
+		proxy = "http://" + proxy
+	}
+	proxyURL, err := url.Parse(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy address %q in the proxy configuration %s: %v", proxy, proxyConfigName, err)
+	}
+	return proxyURL, nil
+}
+
+// onProxyConnectResponse rejects the connection if the proxy doesn't
+// establish the tunnel, so that the failure can be told apart from errors of
+// the upstream registry.
+func onProxyConnectResponse(ctx context.Context, proxyURL *url.URL, connectReq *http.Request, connectRes *http.Response) error {
+	if connectRes.StatusCode != http.StatusOK {
+		err := &proxyConnectError{
+			proxy:  proxyURL.Redacted(),
+			status: connectRes.Status,
+		}
+		dcontext.GetLogger(ctx).Errorf("unable to connect to %s through the proxy: %v", connectReq.URL.Host, err)
+		return err
+	}
+	return nil
+}
+
+// isInClusterHost reports whether host is a service of the cluster or the
+// local host.
+func isInClusterHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "localhost" {
+		return true
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.IsLoopback()
+	}
+	return strings.HasSuffix(host, ".svc") || strings.HasSuffix(host, ".svc.cluster.local")
+}
+
+// matchNoProxy reports whether u matches the comma-separated list noProxy. The
+// list may contain IP addresses, CIDRs, domain names that match the domain
+// and its subdomains, and "*" that matches all hosts. An entry with a port
+// matches only that port.
+func matchNoProxy(noProxy string, u *url.URL) bool {
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	port := u.Port()
+	if len(port) == 0 {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	ip := net.ParseIP(host)
+
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if len(entry) == 0 {
+			continue
+		}
+		if entry == "*" {
+			return true
+		}
+
+		if _, ipnet, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && ipnet.Contains(ip) {
+				return true
+			}
+			continue
+		}
+
+		entryHost, entryPort := entry, ""
+		if h, p, err := net.SplitHostPort(entry); err == nil {
+			entryHost, entryPort = h, p
+		}
+		if len(entryPort) > 0 && entryPort != port {
+			continue
+		}
+
+		if entryIP := net.ParseIP(entryHost); entryIP != nil {
+			if ip != nil && entryIP.Equal(ip) {
+				return true
+			}
+			continue
+		}
+
+		entryHost = strings.TrimPrefix(entryHost, "*")
+		entryHost = strings.TrimPrefix(entryHost, ".")
+		if host == entryHost || strings.HasSuffix(host, "."+entryHost) {
+			return true
+		}
+	}
+	return false
+}
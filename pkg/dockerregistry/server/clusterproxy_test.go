@@ -0,0 +1,131 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	configv1 "github.com/openshift/api/config/v1"
+	cfgfake "github.com/openshift/client-go/config/clientset/versioned/fake"
+	cfgv1 "github.com/openshift/client-go/config/clientset/versioned/typed/config/v1"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+	"github.com/openshift/image-registry/pkg/testutil"
+)
+
+type proxyConfigClient struct {
+	client.Interface
+	config cfgv1.ConfigV1Interface
+}
+
+func (c *proxyConfigClient) ProxyConfigs() cfgv1.ProxyInterface {
+	return c.config.Proxies()
+}
+
+func TestMatchNoProxy(t *testing.T) {
+	for _, tc := range []struct {
+		noProxy string
+		url     string
+		want    bool
+	}{
+		{noProxy: "", url: "https://quay.io/v2/", want: false},
+		{noProxy: "*", url: "https://quay.io/v2/", want: true},
+		{noProxy: "quay.io", url: "https://quay.io/v2/", want: true},
+		{noProxy: "quay.io", url: "https://cdn.quay.io/v2/", want: true},
+		{noProxy: ".example.com", url: "https://registry.example.com/v2/", want: true},
+		{noProxy: ".example.com", url: "https://registry.example.org/v2/", want: false},
+		{noProxy: "example.com", url: "https://notexample.com/v2/", want: false},
+		{noProxy: "mirror.local:5000", url: "https://mirror.local:5000/v2/", want: true},
+		{noProxy: "mirror.local:5000", url: "https://mirror.local/v2/", want: false},
+		{noProxy: "10.0.0.0/16", url: "http://10.0.3.4:5000/v2/", want: true},
+		{noProxy: "10.0.0.0/16", url: "http://10.1.3.4:5000/v2/", want: false},
+		{noProxy: " 192.168.1.1 , quay.io", url: "https://192.168.1.1/v2/", want: true},
+	} {
+		u, err := url.Parse(tc.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := matchNoProxy(tc.noProxy, u); got != tc.want {
+			t.Errorf("matchNoProxy(%q, %s) = %t, want %t", tc.noProxy, tc.url, got, tc.want)
+		}
+	}
+}
+
+func TestClusterProxy(t *testing.T) {
+	ctx := context.Background()
+	ctx = testutil.WithTestLogger(ctx, t)
+
+	cfgclient := cfgfake.NewSimpleClientset(&configv1.Proxy{
+		ObjectMeta: metav1.ObjectMeta{Name: proxyConfigName},
+		Status: configv1.ProxyStatus{
+			HTTPProxy:  "http-proxy.example.com:3128",
+			HTTPSProxy: "https://https-proxy.example.com:3129",
+			NoProxy:    ".internal.example.com",
+		},
+	})
+	proxy := newClusterProxy(&imageConfigRegistryClient{
+		client: &proxyConfigClient{config: cfgclient.ConfigV1()},
+	}, nil)
+
+	for _, tc := range []struct {
+		url  string
+		want string
+	}{
+		{url: "http://quay.io/v2/", want: "http://http-proxy.example.com:3128"},
+		{url: "https://quay.io/v2/", want: "https://https-proxy.example.com:3129"},
+		{url: "https://mirror.internal.example.com/v2/", want: ""},
+		{url: "https://mirror.openshift-mirror.svc:5000/v2/", want: ""},
+		{url: "https://localhost:5000/v2/", want: ""},
+	} {
+		req, err := http.NewRequestWithContext(ctx, "GET", tc.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxyURL, err := proxy.Proxy(req)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.url, err)
+		}
+		got := ""
+		if proxyURL != nil {
+			got = proxyURL.String()
+		}
+		if got != tc.want {
+			t.Errorf("%s: got proxy %q, want %q", tc.url, got, tc.want)
+		}
+	}
+}
+
+func TestClusterProxyConnectError(t *testing.T) {
+	ctx := context.Background()
+	ctx = testutil.WithTestLogger(ctx, t)
+
+	proxyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer proxyServer.Close()
+
+	cfgclient := cfgfake.NewSimpleClientset(&configv1.Proxy{
+		ObjectMeta: metav1.ObjectMeta{Name: proxyConfigName},
+		Status: configv1.ProxyStatus{
+			HTTPSProxy: proxyServer.URL,
+		},
+	})
+	proxy := newClusterProxy(&imageConfigRegistryClient{
+		client: &proxyConfigClient{config: cfgclient.ConfigV1()},
+	}, nil)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", "https://registry.example.com/v2/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secure, _ := proxy.Transports()
+	_, err = secure.RoundTrip(req)
+	if err == nil || !strings.Contains(err.Error(), "proxyconnect") {
+		t.Fatalf("got error %v, want a proxy connection error", err)
+	}
+}
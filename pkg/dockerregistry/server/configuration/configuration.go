@@ -1,22 +1,26 @@
 package configuration
 
 import (
-	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"net"
 	"net/url"
 	"os"
-	"reflect"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
-	"gopkg.in/yaml.v2"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation"
 
 	//"github.com/distribution/distribution/registry/auth"
 	"github.com/distribution/distribution/v3/configuration"
+	"github.com/openshift/library-go/pkg/crypto"
 )
 
 // Environment variables.
@@ -62,6 +66,20 @@ const (
 	// DEPRECATED: Use the REGISTRY_OPENSHIFT_PULLTHROUGH_MIRROR instead.
 	mirrorPullthroughEnvVar = "REGISTRY_MIDDLEWARE_REPOSITORY_OPENSHIFT_MIRRORPULLTHROUGH"
 
+	// profileEnvVar enables the profiling endpoint on a dedicated listener if set to "web".
+	// DEPRECATED: Use the REGISTRY_OPENSHIFT_PROFILING_ENABLED instead.
+	profileEnvVar = "OPENSHIFT_PROFILE"
+
+	// profileHostEnvVar and profilePortEnvVar specify the address of the profiling listener enabled by
+	// the OPENSHIFT_PROFILE environment variable.
+	// DEPRECATED: Use the REGISTRY_OPENSHIFT_PROFILING_ADDR instead.
+	profileHostEnvVar = "OPENSHIFT_PROFILE_HOST"
+	profilePortEnvVar = "OPENSHIFT_PROFILE_PORT"
+
+	// DefaultStorageEnvVar selects the storage driver of the default
+	// configuration, either inmemory or filesystem.
+	DefaultStorageEnvVar = "REGISTRY_DEFAULT_STORAGE"
+
 	realmKey         = "realm"
 	tokenRealmKey    = "tokenrealm"
 	defaultTokenPath = "/openshift/token"
@@ -71,8 +89,120 @@ const (
 	// Default values
 	defaultBlobRepositoryCacheTTL = time.Minute * 10
 	defaultProjectCacheTTL        = time.Minute
+	defaultCachePersistInterval   = time.Minute * 5
+	defaultProfilingAddr          = "127.0.0.1:6060"
+	defaultP2PHeader              = "OpenShift-P2P"
+
+	defaultManifestVerificationSampleSize = 100
+
+	defaultCoordinationLeaseDuration = time.Second * 15
+	defaultCoordinationRenewDeadline = time.Second * 10
+	defaultCoordinationRetryPeriod   = time.Second * 2
+
+	defaultTrashRetention     = time.Hour * 24 * 7
+	defaultTrashPurgeInterval = time.Hour
+
+	defaultPruningInterval   = time.Hour
+	defaultPruningMinBlobAge = time.Hour
+
+	defaultRefreshTokenLifetime = time.Hour * 24 * 30
+
+	defaultWriteRetriesAttempts       = 4
+	defaultWriteRetriesInitialBackoff = time.Millisecond * 200
+	defaultWriteRetriesMaxBackoff     = time.Second * 5
+
+	defaultDegradedModeAuthCacheTTL = time.Minute * 10
+
+	defaultMirrorQueueWorkers        = 8
+	defaultMirrorQueueMaxQueued      = 1000
+	defaultMirrorQueuePrioritySize   = 1 << 20
+	defaultMirrorQueueAttempts       = 3
+	defaultMirrorQueueInitialBackoff = time.Second * 5
+	defaultMirrorQueueMaxBackoff     = time.Minute
+
+	defaultTrafficRecordingSampleRate = 1.0
+	defaultTrafficRecordingMaxBytes   = 100 << 20
+
+	// defaultMaxDecompressedFiles is the number of files in a layer that is
+	// allowed if the maximum decompression ratio is set.
+	defaultMaxDecompressedFiles = 1000000
+
+	// defaultDiagnosticsLogEntries is the number of recent log entries that
+	// are kept for the diagnostics bundles.
+	defaultDiagnosticsLogEntries = 1000
+
+	defaultSpoolMoveInterval = time.Second * 10
+
+	defaultKubeClientReconnectFailures       = 3
+	defaultKubeClientReconnectInitialBackoff = time.Second
+	defaultKubeClientReconnectMaxBackoff     = time.Minute * 5
+
+	defaultStorage                 = "filesystem"
+	defaultFilesystemRootDirectory = "/registry"
 )
 
+// defaultConfiguration is used when the registry is started without a
+// configuration file. The storage driver is substituted, everything else can
+// be changed by the environment variables.
+const defaultConfiguration = `version: 0.1
+log:
+  level: info
+http:
+  addr: :5000
+storage:
+  cache:
+    blobdescriptor: inmemory
+  delete:
+    enabled: true
+%s
+auth:
+  openshift: {}
+middleware:
+  registry:
+  - name: openshift
+  repository:
+  - name: openshift
+  storage:
+  - name: openshift
+openshift:
+  version: 1.0
+  auth:
+    realm: openshift
+`
+
+// DefaultConfiguration returns the configuration for running the registry
+// without a configuration file. The storage driver is selected by the
+// REGISTRY_DEFAULT_STORAGE environment variable and defaults to the
+// filesystem driver with the root directory /registry.
+func DefaultConfiguration() (io.Reader, error) {
+	driver := os.Getenv(DefaultStorageEnvVar)
+	// Prevent a warning about unrecognized environment variable.
+	if err := os.Unsetenv(DefaultStorageEnvVar); err != nil {
+		return nil, err
+	}
+	return defaultConfigurationFor(driver)
+}
+
+// defaultConfigurationFor returns the default configuration with the storage
+// driver driver.
+func defaultConfigurationFor(driver string) (io.Reader, error) {
+	if driver == "" {
+		driver = defaultStorage
+	}
+
+	var storage string
+	switch driver {
+	case "inmemory":
+		storage = "  inmemory: {}"
+	case "filesystem":
+		storage = "  filesystem:\n    rootdirectory: " + defaultFilesystemRootDirectory
+	default:
+		return nil, fmt.Errorf("unsupported storage driver %q in %s, expected inmemory or filesystem", driver, DefaultStorageEnvVar)
+	}
+
+	return strings.NewReader(fmt.Sprintf(defaultConfiguration, storage)), nil
+}
+
 // TokenRealm returns the template URL to use as the token realm redirect.
 // An empty scheme/host in the returned URL means to match the scheme/host on incoming requests.
 func TokenRealm(tokenRealmString string) (*url.URL, error) {
@@ -121,11 +251,39 @@ type Configuration struct {
 	Quota         *Quota                `yaml:"quota"`
 	Pullthrough   *Pullthrough          `yaml:"pullthrough"`
 	Compatibility *Compatibility        `yaml:"compatibility"`
+	Profiling     *Profiling            `yaml:"profiling"`
+	P2P           *P2P                  `yaml:"p2p"`
+	Signatures    *Signatures           `yaml:"signatures"`
+	Aliases       *Aliases              `yaml:"aliases"`
+
+	ManifestVerification *ManifestVerification `yaml:"manifestverification"`
+	Coordination         *Coordination         `yaml:"coordination"`
+	Trash                *Trash                `yaml:"trash"`
+	Encryption           *Encryption           `yaml:"encryption"`
+	Pruning              *Pruning              `yaml:"pruning"`
+	WriteRetries         *WriteRetries         `yaml:"writeretries"`
+	DegradedMode         *DegradedMode         `yaml:"degradedmode"`
+	ImageService         *ImageService         `yaml:"imageservice"`
+	TrafficRecording     *TrafficRecording     `yaml:"trafficrecording"`
+	TagPropagation       *TagPropagation       `yaml:"tagpropagation"`
+	Security             *Security             `yaml:"security"`
+	ContentTrust         *ContentTrust         `yaml:"contenttrust"`
+	AccessLog            *AccessLog            `yaml:"accesslog"`
+	Diagnostics          *Diagnostics          `yaml:"diagnostics"`
+	KubeClient           *KubeClient           `yaml:"kubeclient"`
+	Spool                *Spool                `yaml:"spool"`
 }
 
 type Metrics struct {
 	Enabled bool   `yaml:"enabled"`
 	Secret  string `yaml:"secret"`
+	// Secrets are additional bearer tokens that are accepted by the metrics
+	// endpoint.
+	Secrets []string `yaml:"secrets"`
+	// SecretsFile is a file with accepted bearer tokens, one per line. The
+	// file is reloaded when it changes, so the tokens can be rotated without
+	// a restart.
+	SecretsFile string `yaml:"secretsfile"`
 }
 
 type Requests struct {
@@ -141,11 +299,57 @@ type RequestsLimits struct {
 
 type Server struct {
 	Addr string `yaml:"addr"`
+	// CacheControl is the value of the Cache-Control header for blob
+	// downloads and manifests requested by digest. The header is not set if
+	// it's empty. The responses are private unless the value says otherwise,
+	// as they are served only to the users that may pull the repositories.
+	CacheControl string `yaml:"cachecontrol"`
+	// AnonymousPulls states that the images can be pulled by anonymous
+	// users. Only then CacheControl may allow shared caches to store the
+	// responses (public).
+	AnonymousPulls bool `yaml:"anonymouspulls"`
+	// BlobMediaTypes sets the Content-Type header of blob downloads to the
+	// media types of the blobs in the layers of the image stream, instead
+	// of application/octet-stream.
+	BlobMediaTypes bool `yaml:"blobmediatypes"`
+	// ZeroCopy makes the registry serve blobs directly from the files of
+	// the filesystem storage driver, so that the kernel can send them
+	// without copying them through the registry (sendfile). It is ignored
+	// for other storage drivers.
+	ZeroCopy bool `yaml:"zerocopy"`
+	// LayerHints sends the order and the sizes of the layers of images to
+	// container runtimes with the manifests, so that they can prioritize
+	// the downloads of the layers that are needed first.
+	LayerHints ServerLayerHints `yaml:"layerhints"`
+	// AutoProvisionImageStreams makes the registry create the image stream
+	// of a repository on the first push into it. If it's false, the pushes
+	// into image streams that don't exist are rejected with NAME_UNKNOWN.
+	// It defaults to true.
+	AutoProvisionImageStreams *bool `yaml:"autoprovisionimagestreams"`
+}
+
+type ServerLayerHints struct {
+	// Enabled makes the registry send the layer hints to the clients that
+	// identify themselves as containerd or CRI-O.
+	Enabled bool `yaml:"enabled"`
+	// PrefetchLayers is the number of the first layers of an image that
+	// are announced with Link headers, so that they can be fetched eagerly.
+	// Link headers are not sent if it's zero.
+	PrefetchLayers int `yaml:"prefetchlayers"`
 }
 
 type Auth struct {
 	Realm      string `yaml:"realm"`
 	TokenRealm string `yaml:"tokenrealm"`
+	// SingleRepositoryCheck makes the registry check only the push access
+	// for the repositories which are both pulled and pushed by a request.
+	// It reduces the number of access reviews if the roles that allow to
+	// push images also allow to pull them.
+	SingleRepositoryCheck bool `yaml:"singlerepositorycheck"`
+	// RefreshTokenLifetime is the maximum lifetime of the refresh tokens
+	// issued by the token endpoint. A refresh token is also rejected once
+	// the OpenShift token it was issued for expires.
+	RefreshTokenLifetime time.Duration `yaml:"refreshtokenlifetime"`
 }
 
 type Audit struct {
@@ -155,128 +359,552 @@ type Audit struct {
 type Cache struct {
 	Disabled          bool          `yaml:"disabled"`
 	BlobRepositoryTTL time.Duration `yaml:"blobrepositoryttl"`
+	// Backend is where the digest cache is kept, CacheBackendInMemory or
+	// CacheBackendRedis. It defaults to CacheBackendInMemory.
+	Backend string `yaml:"backend"`
+	// Persist allows the digest cache to survive restarts of the registry.
+	Persist CachePersist `yaml:"persist"`
+	// TagDigests reports the tags that are pulled with another digest than
+	// the last time.
+	TagDigests CacheTagDigests `yaml:"tagdigests"`
+	// Warmup fills the digest cache with the blobs of an image stream when
+	// its repository is accessed for the first time.
+	Warmup CacheWarmup `yaml:"warmup"`
+}
+
+const (
+	// CacheBackendInMemory keeps the digest cache in the memory of each
+	// replica.
+	CacheBackendInMemory = "inmemory"
+	// CacheBackendRedis keeps the digest cache in the redis server of the
+	// redis section of the configuration, so it is shared by all replicas.
+	CacheBackendRedis = "redis"
+)
+
+type CachePersist struct {
+	// Enabled makes the registry save snapshots of the digest cache into
+	// the storage and load the latest snapshot at startup.
+	Enabled bool `yaml:"enabled"`
+	// Interval is how often the snapshots are saved.
+	Interval time.Duration `yaml:"interval"`
+}
+
+type CacheTagDigests struct {
+	// Enabled makes the registry remember the digest served for each pulled
+	// tag and log a warning when the tag resolves to another digest.
+	Enabled bool `yaml:"enabled"`
+	// PreviousDigestHeader makes the registry send the previously served
+	// digest of the tag to the clients when it changes.
+	PreviousDigestHeader bool `yaml:"previousdigestheader"`
+}
+
+type CacheWarmup struct {
+	// Enabled makes the registry fetch the layers of the image stream in a
+	// single call when its repository is accessed for the first time and
+	// cache the descriptors of the blobs that are stored in the registry.
+	Enabled bool `yaml:"enabled"`
 }
 
 type Quota struct {
 	Enabled  bool          `yaml:"enabled"`
 	CacheTTL time.Duration `yaml:"cachettl"`
+	// StorageLimits enables the storage limits that are set on the image
+	// streams by the image.openshift.io/storage-limit-bytes annotation. The
+	// image streams are read when the blobs are linked to their
+	// repositories.
+	StorageLimits bool `yaml:"storagelimits"`
 }
 
 type Pullthrough struct {
 	Enabled bool `yaml:"enabled"`
 	Mirror  bool `yaml:"mirror"`
+	// ScheduledImportInterval is how often the registry re-imports tags
+	// that have a scheduled import policy and the Local reference policy.
+	// A zero value disables the registry-side scheduled imports.
+	ScheduledImportInterval time.Duration `yaml:"scheduledimportinterval"`
+	// MirrorAnnotationInterval is how often the registry writes the
+	// image.openshift.io/manifestBlobStored annotation on the images whose
+	// manifests and configs were mirrored. The mirroring doesn't update the
+	// images otherwise, so the annotation adds at most one update per image,
+	// when the last of its blobs is stored. A zero value disables the
+	// annotation.
+	MirrorAnnotationInterval time.Duration `yaml:"mirrorannotationinterval"`
+	// FallbackMirror is a registry that is searched for blobs and manifests
+	// that cannot be found in any of the candidate repositories.
+	FallbackMirror FallbackMirror `yaml:"fallbackmirror"`
+	// BasicAuthHosts is a list of upstream registries, given as host names
+	// with optional ports, that are accessed with HTTP Basic authentication
+	// regardless of the challenges they respond with.
+	BasicAuthHosts []string `yaml:"basicauthhosts"`
+	// CertificatePins maps host names of upstream registries, without ports,
+	// to the pins of their public keys. A pin is "sha256/" followed by the base64 encoded
+	// SHA-256 digest of the DER encoded SubjectPublicKeyInfo of a
+	// certificate. A connection to a pinned registry is refused unless a
+	// certificate of its chain matches one of the pins.
+	CertificatePins map[string][]string `yaml:"certificatepins"`
+	// MirrorOrder is the order in which the mirrors of image content
+	// source policies, image digest mirror sets and image tag mirror sets
+	// are tried. It is MirrorOrderHealth or MirrorOrderDeclared, and
+	// defaults to MirrorOrderHealth.
+	MirrorOrder string `yaml:"mirrororder"`
+	// MirrorQueue limits the background mirroring of the blobs that are
+	// pulled through.
+	MirrorQueue MirrorQueue `yaml:"mirrorqueue"`
+}
+
+// MirrorQueue configures the queue of the blobs that are mirrored in the
+// background. The blobs are taken from the namespaces in turns, the small
+// blobs first.
+type MirrorQueue struct {
+	// Workers is the number of blobs that are mirrored concurrently.
+	Workers int `yaml:"workers"`
+	// MaxQueued is the maximum number of blobs that wait for a worker or
+	// for a retry. The blobs that are pulled while the queue is full
+	// aren't mirrored.
+	MaxQueued int `yaml:"maxqueued"`
+	// PrioritySize is the size in bytes up to which the blobs, e.g. the
+	// image configs, are mirrored before the larger ones.
+	PrioritySize int64 `yaml:"prioritysize"`
+	// Attempts is the maximum number of attempts to mirror a blob. 1
+	// disables the retries.
+	Attempts int `yaml:"attempts"`
+	// InitialBackoff is the delay before the first retry. It is doubled
+	// after each retry.
+	InitialBackoff time.Duration `yaml:"initialbackoff"`
+	// MaxBackoff limits the delay between retries.
+	MaxBackoff time.Duration `yaml:"maxbackoff"`
+}
+
+const (
+	// MirrorOrderHealth tries the mirrors with the highest success rates
+	// and the lowest latencies of the recent requests first. The mirrors
+	// with similar health keep their declared order.
+	MirrorOrderHealth = "health"
+	// MirrorOrderDeclared tries the mirrors in the order in which they are
+	// declared.
+	MirrorOrderDeclared = "declared"
+)
+
+type FallbackMirror struct {
+	// Registry is the host name of the mirror, optionally followed by a
+	// path prefix. Repositories are searched in the mirror by their
+	// original path, i.e. docker.io/library/busybox is searched as
+	// <registry>/library/busybox. An empty value disables the fallback.
+	Registry string `yaml:"registry"`
+	// Insecure allows the registry to fall back to plain HTTP and to skip
+	// the TLS verification for the mirror.
+	Insecure bool `yaml:"insecure"`
+	// CredentialsFile is a path to a Docker config.json file with
+	// credentials for the mirror.
+	CredentialsFile string `yaml:"credentialsfile"`
 }
 
 type Compatibility struct {
 	AcceptSchema2 bool `yaml:"acceptschema2"`
+	// DisableSchema1 rejects pushes and pulls of manifests V2 schema 1 and
+	// conversions of newer manifests to schema 1 for old clients.
+	DisableSchema1 bool `yaml:"disableschema1"`
+	// MaxManifestBytes is the maximum size of a manifest payload that can be
+	// pushed into the registry. A zero value means there is no limit.
+	MaxManifestBytes int64 `yaml:"maxmanifestbytes"`
+	// MaxLayers is the maximum number of layers that a pushed image can
+	// have. A zero value means there is no limit.
+	MaxLayers int `yaml:"maxlayers"`
+	// ManifestAnnotations is the list of org.opencontainers.image.*
+	// annotations of pushed OCI manifests that are copied into the
+	// annotations of the Image objects. It defaults to
+	// DefaultManifestAnnotations.
+	ManifestAnnotations []string `yaml:"manifestannotations"`
+	// AllowedMediaTypes restricts the media types of pushed manifests and
+	// their configs and layers. A media type that ends with * matches
+	// all media types with the prefix. If it is empty, all media types are
+	// allowed.
+	AllowedMediaTypes []string `yaml:"allowedmediatypes"`
+	// BlockedMediaTypes are the media types of manifests, configs and layers
+	// that are rejected on push. They take precedence over
+	// AllowedMediaTypes.
+	BlockedMediaTypes []string `yaml:"blockedmediatypes"`
+	// ServeOCI serves Docker schema 2 manifests and manifest lists with OCI
+	// media types to clients that accept only OCI manifests.
+	ServeOCI bool `yaml:"serveoci"`
+	// NegotiateManifests responds with 406 Not Acceptable to the manifest
+	// requests with Accept headers that allow neither the stored manifest
+	// nor a conversion of it. It implies ServeOCI.
+	NegotiateManifests bool `yaml:"negotiatemanifests"`
+	// ForeignLayers is the handling of pushed layers with external URLs,
+	// such as the layers of Windows base images. It is one of
+	// ForeignLayersAllow, ForeignLayersReject or ForeignLayersMirror.
+	ForeignLayers string `yaml:"foreignlayers"`
+	// ForeignLayerHosts are the hosts the foreign layers are mirrored from.
+	// A host that starts with "*." matches the subdomains of the rest. The
+	// layers with URLs of other hosts are not mirrored. It's required for
+	// ForeignLayersMirror.
+	ForeignLayerHosts []string `yaml:"foreignlayerhosts"`
 }
 
-type versionInfo struct {
-	Openshift struct {
-		Version *configuration.Version
-	}
+const (
+	// ForeignLayersAllow accepts layers with external URLs. Clients download
+	// them from their URLs.
+	ForeignLayersAllow = "allow"
+	// ForeignLayersReject rejects manifests with layers with external URLs.
+	ForeignLayersReject = "reject"
+	// ForeignLayersMirror downloads layers with external URLs into the
+	// registry when their manifests are pushed or mirrored, so that clients
+	// can fall back to the registry if the URLs are unavailable.
+	ForeignLayersMirror = "mirror"
+)
+
+// DefaultManifestAnnotations are the manifest annotations that are copied into
+// the Image objects if openshift.compatibility.manifestannotations is not set.
+var DefaultManifestAnnotations = []string{
+	"org.opencontainers.image.source",
+	"org.opencontainers.image.revision",
+	"org.opencontainers.image.created",
 }
 
-// Parse parses an input configuration and returns docker configuration structure and
-// openshift specific configuration.
-// Environment variables may be used to override configuration parameters.
-func Parse(rd io.Reader) (*configuration.Configuration, *Configuration, error) {
-	in, err := ioutil.ReadAll(rd)
-	if err != nil {
-		return nil, nil, err
-	}
+type Profiling struct {
+	Enabled bool `yaml:"enabled"`
+	// Addr is the address of a dedicated listener for the profiling
+	// endpoint. It is used only if RequireAuth is false.
+	Addr string `yaml:"addr"`
+	// RequireAuth makes the profiling endpoint to be served by the registry
+	// listener and protected by the same credentials as the metrics endpoint.
+	RequireAuth bool `yaml:"requireauth"`
+}
 
-	// We don't want to change the version from the environment variables.
-	if err := os.Unsetenv("REGISTRY_OPENSHIFT_VERSION"); err != nil {
-		return nil, nil, err
-	}
+type P2P struct {
+	// Enabled allows the registry to redirect blob downloads to a node-local
+	// peer-to-peer distribution endpoint.
+	Enabled bool `yaml:"enabled"`
+	// Header is the request header that clients set to "true" to signal that
+	// they can be redirected to the endpoint.
+	Header string `yaml:"header"`
+	// Endpoint is the base URL of the peer-to-peer endpoint as seen by the
+	// clients, for example http://127.0.0.1:30020.
+	Endpoint string `yaml:"endpoint"`
+}
 
-	openshiftEnv, err := popEnv("REGISTRY_OPENSHIFT_")
-	if err != nil {
-		return nil, nil, err
-	}
+type Signatures struct {
+	// Verify makes the registry verify the signatures of images pulled from
+	// image streams that have the signature policy annotation.
+	Verify bool `yaml:"verify"`
+	// PublicKeys maps the key names used in the signature policies to files
+	// with PEM-encoded public keys.
+	PublicKeys map[string]string `yaml:"publickeys"`
+	// TagConvention makes the registry add the cosign signatures pushed as
+	// sha256-<digest>.sig tags to the signatures of the signed images, and
+	// the attestations and the SBOMs pushed as .att and .sbom tags as
+	// references to their layers.
+	TagConvention bool `yaml:"tagconvention"`
+}
 
-	dockerConfig, err := configuration.Parse(bytes.NewBuffer(in))
-	if err != nil {
-		return nil, nil, err
-	}
+type Aliases struct {
+	// DefaultNamespace is the namespace of repositories that are requested
+	// by a name without a namespace.
+	DefaultNamespace string `yaml:"defaultnamespace"`
+	// ConfigMap is the <namespace>/<name> of a ConfigMap that maps names
+	// without a namespace to <namespace>/<name> of repositories. Its entries
+	// take precedence over DefaultNamespace.
+	ConfigMap string `yaml:"configmap"`
+}
 
-	dockerEnv, err := popEnv("REGISTRY_")
-	if err != nil {
-		return nil, nil, err
-	}
-	if err := pushEnv(openshiftEnv); err != nil {
-		return nil, nil, err
-	}
+type ManifestVerification struct {
+	// Interval is how often the registry checks that the manifests of
+	// images with the manifest blob stored annotation exist in the storage.
+	// A zero value disables the verification.
+	Interval time.Duration `yaml:"interval"`
+	// SampleSize is the number of images that are checked every interval.
+	SampleSize int `yaml:"samplesize"`
+}
 
-	config := openshiftConfig{}
+// Coordination configures the leader election that makes only one replica
+// run the background jobs that work on the whole cluster.
+type Coordination struct {
+	Enabled bool `yaml:"enabled"`
+	// Namespace is the namespace of the lease and the state ConfigMap. It
+	// defaults to the namespace of the registry pod.
+	Namespace string `yaml:"namespace"`
+	// LeaseDuration is how long the other replicas wait before they take
+	// over the lease of the leader that stopped renewing it.
+	LeaseDuration time.Duration `yaml:"leaseduration"`
+	// RenewDeadline is how long the leader tries to renew the lease before
+	// it gives up the leadership.
+	RenewDeadline time.Duration `yaml:"renewdeadline"`
+	// RetryPeriod is how often the replicas try to acquire or renew the
+	// lease.
+	RetryPeriod time.Duration `yaml:"retryperiod"`
+}
 
-	vInfo := &versionInfo{}
-	if err := yaml.Unmarshal(in, &vInfo); err != nil {
-		return nil, nil, err
-	}
+// Trash configures the soft deletion of pruned blobs.
+type Trash struct {
+	// Enabled moves the data of pruned blobs into the trash of the storage
+	// instead of deleting it, so that the blobs can be restored.
+	Enabled bool `yaml:"enabled"`
+	// Retention is how long the blobs are kept in the trash before they are
+	// deleted permanently.
+	Retention time.Duration `yaml:"retention"`
+	// PurgeInterval is how often the registry deletes the blobs with expired
+	// retention from the trash.
+	PurgeInterval time.Duration `yaml:"purgeinterval"`
+}
 
-	if vInfo.Openshift.Version != nil {
-		if *vInfo.Openshift.Version != CurrentVersion {
-			return nil, nil, ErrUnsupportedVersion
-		}
-	}
+// Encryption configures the encryption at rest of the blob data.
+type Encryption struct {
+	// Enabled makes the registry encrypt the data of new blobs before it is
+	// written to the storage. The blobs that were stored before are still
+	// readable.
+	Enabled bool `yaml:"enabled"`
+	// KeysDir is a directory with the key encryption keys, e.g. a mounted
+	// secret. Every file in it has a base64-encoded 256-bit key.
+	KeysDir string `yaml:"keysdir"`
+	// PrimaryKey is the name of the file in KeysDir with the key that
+	// encrypts new blobs. The other keys are used to read the blobs that were
+	// encrypted before the keys were rotated.
+	PrimaryKey string `yaml:"primarykey"`
+}
 
-	p := configuration.NewParser("registry", []configuration.VersionedParseInfo{
-		{
-			Version: dockerConfig.Version,
-			ParseAs: reflect.TypeOf(config),
-			ConversionFunc: func(c interface{}) (interface{}, error) {
-				return c, nil
-			},
-		},
-	})
+// Spool configures the write-behind spool of the storage, e.g. for object
+// stores with flaky connectivity.
+type Spool struct {
+	// Enabled makes the registry write the uploads and the blobs into a
+	// local directory when the storage backend fails. They are moved to the
+	// storage backend in the background, and they are read from the spool
+	// until they are moved.
+	Enabled bool `yaml:"enabled"`
+	// Directory is the local directory of the spool, e.g. a mounted
+	// volume. It should be kept across restarts of the registry, as the
+	// files that are not moved yet are only there.
+	Directory string `yaml:"directory"`
+	// MaxSize is the maximum number of bytes in the spool, e.g. 20Gi. The
+	// writes that would exceed it fail.
+	MaxSize string `yaml:"maxsize"`
+	// MoveInterval is how often the registry retries to move the spooled
+	// files to the storage backend after a failure.
+	MoveInterval time.Duration `yaml:"moveinterval"`
+}
 
-	if err = p.Parse(in, &config); err != nil {
-		return nil, nil, err
-	}
-	if err := pushEnv(dockerEnv); err != nil {
-		return nil, nil, err
-	}
+// Pruning configures the pruning of unused blobs that is triggered by the
+// usage of the storage.
+type Pruning struct {
+	// HighWatermark is the usage of the storage that starts the pruning,
+	// either in bytes (e.g. 500Gi) or in percent of the capacity of the
+	// volume (e.g. 90%). An empty value disables the pruning.
+	HighWatermark string `yaml:"highwatermark"`
+	// LowWatermark is the usage of the storage where the pruning stops. It
+	// must be lower than HighWatermark.
+	LowWatermark string `yaml:"lowwatermark"`
+	// Interval is how often the usage of the storage is checked.
+	Interval time.Duration `yaml:"interval"`
+	// MinBlobAge protects the blobs that were recently pushed, so that the
+	// blobs of pushes in progress are not pruned before their images are
+	// created.
+	MinBlobAge time.Duration `yaml:"minblobage"`
+}
 
-	if err := InitExtraConfig(dockerConfig, &config.Openshift); err != nil {
-		return nil, nil, err
-	}
+// WriteRetries configures the retries of the writes to the API server that
+// fail with transient errors (conflicts, throttling and server errors), e.g.
+// while the API server restarts.
+type WriteRetries struct {
+	// Attempts is the maximum number of attempts of a write. 1 disables
+	// the retries, but the conflicts are still retried a few times.
+	Attempts int `yaml:"attempts"`
+	// InitialBackoff is the delay before the first retry. It is doubled
+	// after each retry.
+	InitialBackoff time.Duration `yaml:"initialbackoff"`
+	// MaxBackoff limits the delay between retries, including the delay
+	// requested by the API server.
+	MaxBackoff time.Duration `yaml:"maxbackoff"`
+}
+
+// DegradedMode configures the pulls that are served while the API server is
+// unreachable.
+type DegradedMode struct {
+	// Enabled makes the registry serve the pulls of the content stored in
+	// the registry while the API server is unreachable, if the access of
+	// the client was recently reviewed.
+	Enabled bool `yaml:"enabled"`
+	// AuthCacheTTL is how long the successful access reviews are used
+	// while the API server is unreachable.
+	AuthCacheTTL time.Duration `yaml:"authcachettl"`
+}
 
-	return dockerConfig, &config.Openshift, nil
+// ImageService configures the experimental gRPC API that lets node-local
+// agents resolve manifests and blob URLs without the registry protocol.
+type ImageService struct {
+	// Enabled starts the gRPC listener.
+	Enabled bool `yaml:"enabled"`
+	// Addr is the path of the Unix socket of the listener prefixed with
+	// unix://. The API is served without TLS, so it doesn't listen on TCP.
+	Addr string `yaml:"addr"`
 }
 
-type envVar struct {
-	name  string
-	value string
+type TrafficRecording struct {
+	// Enabled makes the registry write the metadata of the served requests
+	// into Path, so that the traffic can be replayed by -loadgen-profile.
+	Enabled bool `yaml:"enabled"`
+	// Path is the file where the requests are appended as JSON lines.
+	Path string `yaml:"path"`
+	// SampleRate is the fraction of the requests that are recorded, from 0
+	// to 1. It defaults to 1.
+	SampleRate float64 `yaml:"samplerate"`
+	// MaxBytes is the size at which Path is rotated to Path.1. It defaults
+	// to 100MiB.
+	MaxBytes int64 `yaml:"maxbytes"`
 }
 
-func popEnv(prefix string) ([]envVar, error) {
-	var envVars []envVar
+type Security struct {
+	// MaxDecompressionRatio is the largest allowed ratio of the decompressed
+	// size of a layer to its compressed size. The layers that exceed it are
+	// rejected as decompression bombs. Zero disables the checks.
+	MaxDecompressionRatio float64 `yaml:"maxdecompressionratio"`
+	// MaxFiles is the largest allowed number of files in a layer. It
+	// defaults to 1000000 when MaxDecompressionRatio is set.
+	MaxFiles int `yaml:"maxfiles"`
+	// CheckUploads makes the registry check the pushed layers too, not only
+	// the mirrored ones. The layer is read back from the storage when the
+	// upload is completed.
+	CheckUploads bool `yaml:"checkuploads"`
+}
 
-	for _, env := range os.Environ() {
-		if !strings.HasPrefix(env, prefix) {
-			continue
-		}
-		envParts := strings.SplitN(env, "=", 2)
-		err := os.Unsetenv(envParts[0])
+type ContentTrust struct {
+	// NotaryURL is the Notary v1 server that the requests of the Docker
+	// content trust, /v2/<name>/_trust/..., are passed through to. If it's
+	// empty, the requests are rejected with a message that tells the
+	// clients to disable the content trust or to use another server.
+	NotaryURL string `yaml:"notaryurl"`
+}
+
+type AccessLog struct {
+	// Format is the format of the access log: combined for the Apache
+	// combined log format or json for a JSON object per line. Both include
+	// the namespace, the repository, the reference, the user and the
+	// upstream of the requests. If it's empty, the requests are logged by
+	// the registry logger.
+	Format string `yaml:"format"`
+	// Path is the file where the access log is appended. The standard
+	// output is used if it's empty.
+	Path string `yaml:"path"`
+}
+
+type Diagnostics struct {
+	// Enabled registers the diagnostics bundle endpoint
+	// /extensions/v2/diagnostics and keeps the recent log entries in
+	// memory for the bundles.
+	Enabled bool `yaml:"enabled"`
+	// LogEntries is the number of recent log entries in a bundle. It
+	// defaults to defaultDiagnosticsLogEntries.
+	LogEntries int `yaml:"logentries"`
+}
+
+// KubeClient configures the clients of the API server in addition to the
+// kubeconfig.
+type KubeClient struct {
+	TLS       KubeClientTLS       `yaml:"tls"`
+	Reconnect KubeClientReconnect `yaml:"reconnect"`
+}
+
+// KubeClientReconnect configures the rebuilding of the clients of the
+// registry when the API server keeps rejecting their credentials, e.g. after
+// the certificate authority of the API server is rotated.
+type KubeClientReconnect struct {
+	// Enabled makes the registry rebuild its clients from the reloaded
+	// kubeconfig and files of the credentials.
+	Enabled bool `yaml:"enabled"`
+	// Failures is the number of consecutive requests that fail because of
+	// the credentials after which the clients are rebuilt.
+	Failures int `yaml:"failures"`
+	// InitialBackoff is the delay before the clients are rebuilt again if
+	// the requests keep failing. It is doubled after each rebuild.
+	InitialBackoff time.Duration `yaml:"initialbackoff"`
+	// MaxBackoff limits the delay between rebuilds.
+	MaxBackoff time.Duration `yaml:"maxbackoff"`
+}
+
+// KubeClientTLS overrides the TLS settings of the kubeconfig for the
+// connections to the API server. The empty fields keep the settings of the
+// kubeconfig.
+type KubeClientTLS struct {
+	// CAFile is a PEM bundle of the certificate authorities that sign the
+	// certificate of the API server.
+	CAFile string `yaml:"cafile"`
+	// CertFile and KeyFile are the client certificate and its key that the
+	// registry presents to the API server. They are not presented with the
+	// tokens of users.
+	CertFile string `yaml:"certfile"`
+	KeyFile  string `yaml:"keyfile"`
+	// MinVersion is the minimum TLS version, e.g. VersionTLS13.
+	MinVersion string `yaml:"minversion"`
+}
+
+type TagPropagation struct {
+	// Peers are the registries or clusters that are notified about the tags
+	// pushed to this registry, so that they can import the images.
+	Peers []TagPropagationPeer `yaml:"peers"`
+}
+
+type TagPropagationPeer struct {
+	// URL is the endpoint that receives the notifications as POST requests.
+	URL string `yaml:"url"`
+	// SecretFile is a file with the key that signs the notifications with
+	// HMAC-SHA256.
+	SecretFile string `yaml:"secretfile"`
+}
+
+// Watermark is a usage of the storage, either in bytes or in percent of the
+// capacity of the volume.
+type Watermark struct {
+	Bytes   int64
+	Percent float64
+}
+
+// ParseWatermark parses a number of bytes with an optional suffix (e.g. 500Gi
+// or 1T) or a percentage (e.g. 90%).
+func ParseWatermark(s string) (Watermark, error) {
+	if p, ok := strings.CutSuffix(s, "%"); ok {
+		percent, err := strconv.ParseFloat(p, 64)
 		if err != nil {
-			return nil, err
+			return Watermark{}, fmt.Errorf("invalid percentage %q", s)
+		}
+		if percent <= 0 || percent > 100 {
+			return Watermark{}, fmt.Errorf("percentage %q is out of range (0%%, 100%%]", s)
 		}
+		return Watermark{Percent: percent}, nil
+	}
+	q, err := resource.ParseQuantity(s)
+	if err != nil {
+		return Watermark{}, fmt.Errorf("invalid size %q: %v", s, err)
+	}
+	if q.Sign() <= 0 {
+		return Watermark{}, fmt.Errorf("size %q must be positive", s)
+	}
+	return Watermark{Bytes: q.Value()}, nil
+}
 
-		envVars = append(envVars, envVar{envParts[0], envParts[1]})
+// Size returns the watermark in bytes for a volume with the given capacity.
+func (w Watermark) Size(capacity int64) int64 {
+	if w.Percent > 0 {
+		return int64(float64(capacity) * w.Percent / 100)
 	}
+	return w.Bytes
+}
 
-	return envVars, nil
+type versionInfo struct {
+	Openshift struct {
+		Version *configuration.Version
+	}
 }
 
-func pushEnv(environ []envVar) error {
-	for _, env := range environ {
-		if err := os.Setenv(env.name, env.value); err != nil {
-			return err
-		}
+// Parse parses an input configuration and returns docker configuration structure and
+// openshift specific configuration.
+// Environment variables may be used to override configuration parameters.
+//
+// Parse is equivalent to Load with the environment of the process.
+func Parse(rd io.Reader) (*configuration.Configuration, *Configuration, error) {
+	config, err := Load(rd, os.Environ())
+	if err != nil {
+		return nil, nil, err
 	}
-	return nil
+	return config.Docker, config.OpenShift, nil
 }
 
 func setDefaultMiddleware(config *configuration.Configuration) {
@@ -316,11 +944,11 @@ func setDefaultMiddleware(config *configuration.Configuration) {
 	*/
 }
 
-func getServerAddr(options configuration.Parameters, cfgValue string) (registryAddr string, err error) {
+func getServerAddr(options configuration.Parameters, cfgValue string, env environment) (registryAddr string, err error) {
 	var found bool
 
 	if len(registryAddr) == 0 {
-		registryAddr, found = os.LookupEnv(dockerRegistryURLEnvVar)
+		registryAddr, found = env.lookup(dockerRegistryURLEnvVar)
 		if found {
 			log.Infof("DEPRECATED: %q is deprecated, use the 'REGISTRY_OPENSHIFT_SERVER_ADDR' instead", dockerRegistryURLEnvVar)
 		}
@@ -328,7 +956,7 @@ func getServerAddr(options configuration.Parameters, cfgValue string) (registryA
 
 	if len(registryAddr) == 0 {
 		// Legacy configuration
-		registryAddr, err = getStringOption(openShiftDockerRegistryURLEnvVar, "dockerregistryurl", registryAddr, options)
+		registryAddr, err = getStringOption(env, openShiftDockerRegistryURLEnvVar, "dockerregistryurl", registryAddr, options)
 		if err != nil {
 			return
 		}
@@ -345,21 +973,61 @@ func getServerAddr(options configuration.Parameters, cfgValue string) (registryA
 	return
 }
 
-func migrateServerSection(cfg *Configuration, options configuration.Parameters) (err error) {
+func migrateServerSection(cfg *Configuration, options configuration.Parameters, env environment) (err error) {
 	cfgAddr := ""
 	if cfg.Server != nil {
 		cfgAddr = cfg.Server.Addr
 	} else {
 		cfg.Server = &Server{}
 	}
-	cfg.Server.Addr, err = getServerAddr(options, cfgAddr)
+	cfg.Server.Addr, err = getServerAddr(options, cfgAddr, env)
 	if err != nil {
-		err = fmt.Errorf("configuration error in openshift.server.addr: %v", err)
+		err = fieldError("openshift.server.addr", err)
+		return
+	}
+	if cfg.Server.LayerHints.PrefetchLayers < 0 {
+		err = fieldErrorf("openshift.server.layerhints.prefetchlayers", "%d is negative", cfg.Server.LayerHints.PrefetchLayers)
+		return
+	}
+	if len(cfg.Server.CacheControl) > 0 {
+		cfg.Server.CacheControl, err = normalizeCacheControl(cfg.Server.CacheControl, cfg.Server.AnonymousPulls)
+		if err != nil {
+			err = fieldError("openshift.server.cachecontrol", err)
+			return
+		}
+	}
+	if cfg.Server.AutoProvisionImageStreams == nil {
+		autoProvision := true
+		cfg.Server.AutoProvisionImageStreams = &autoProvision
 	}
 	return
 }
 
-func migrateQuotaSection(cfg *Configuration, options configuration.Parameters) (err error) {
+// normalizeCacheControl makes the Cache-Control header private if it doesn't
+// specify whether shared caches may store the responses. The public responses
+// would be served by shared caches to the users that are not authorized to
+// pull the repositories, so they are allowed only with anonymous pulls.
+func normalizeCacheControl(cacheControl string, anonymousPulls bool) (string, error) {
+	scoped := false
+	for _, directive := range strings.Split(cacheControl, ",") {
+		name, _, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "public":
+			if !anonymousPulls {
+				return "", fmt.Errorf("public responses can be served by shared caches to unauthorized users, this requires openshift.server.anonymouspulls")
+			}
+			scoped = true
+		case "private", "no-store":
+			scoped = true
+		}
+	}
+	if !scoped {
+		cacheControl = "private, " + cacheControl
+	}
+	return cacheControl, nil
+}
+
+func migrateQuotaSection(cfg *Configuration, options configuration.Parameters, env environment) (err error) {
 	defEnabled := false
 	defCacheTTL := defaultProjectCacheTTL
 
@@ -371,19 +1039,19 @@ func migrateQuotaSection(cfg *Configuration, options configuration.Parameters) (
 		cfg.Quota = &Quota{}
 	}
 
-	cfg.Quota.Enabled, err = getBoolOption(enforceQuotaEnvVar, "enforcequota", defEnabled, options)
+	cfg.Quota.Enabled, err = getBoolOption(env, enforceQuotaEnvVar, "enforcequota", defEnabled, options)
 	if err != nil {
-		err = fmt.Errorf("configuration error in openshift.quota.enabled: %v", err)
+		err = fieldError("openshift.quota.enabled", err)
 		return
 	}
-	cfg.Quota.CacheTTL, err = getDurationOption(projectCacheTTLEnvVar, "projectcachettl", defCacheTTL, options)
+	cfg.Quota.CacheTTL, err = getDurationOption(env, projectCacheTTLEnvVar, "projectcachettl", defCacheTTL, options)
 	if err != nil {
-		err = fmt.Errorf("configuration error in openshift.quota.cachettl: %v", err)
+		err = fieldError("openshift.quota.cachettl", err)
 	}
 	return
 }
 
-func migrateCacheSection(cfg *Configuration, options configuration.Parameters) (err error) {
+func migrateCacheSection(cfg *Configuration, options configuration.Parameters, env environment) (err error) {
 	defBlobRepositoryTTL := defaultBlobRepositoryCacheTTL
 
 	if cfg.Cache != nil {
@@ -393,15 +1061,38 @@ func migrateCacheSection(cfg *Configuration, options configuration.Parameters) (
 		cfg.Cache = &Cache{}
 	}
 
-	cfg.Cache.BlobRepositoryTTL, err = getDurationOption(blobRepositoryCacheTTLEnvVar, "blobrepositorycachettl", defBlobRepositoryTTL, options)
+	cfg.Cache.BlobRepositoryTTL, err = getDurationOption(env, blobRepositoryCacheTTLEnvVar, "blobrepositorycachettl", defBlobRepositoryTTL, options)
 	if err != nil {
-		err = fmt.Errorf("configuration error in openshift.cache.blobrepositoryttl: %v", err)
+		err = fieldError("openshift.cache.blobrepositoryttl", err)
+		return
+	}
+
+	switch cfg.Cache.Backend {
+	case "":
+		cfg.Cache.Backend = CacheBackendInMemory
+	case CacheBackendInMemory, CacheBackendRedis:
+	default:
+		err = fieldErrorf("openshift.cache.backend", "unknown backend %q", cfg.Cache.Backend)
 		return
 	}
+
+	if cfg.Cache.Persist.Enabled {
+		if cfg.Cache.Backend == CacheBackendRedis {
+			err = fieldErrorf("openshift.cache.persist", "the redis backend cannot be persisted")
+			return
+		}
+		if cfg.Cache.Persist.Interval < 0 {
+			err = fieldErrorf("openshift.cache.persist.interval", "negative value %s", cfg.Cache.Persist.Interval)
+			return
+		}
+		if cfg.Cache.Persist.Interval == 0 {
+			cfg.Cache.Persist.Interval = defaultCachePersistInterval
+		}
+	}
 	return
 }
 
-func migratePullthroughSection(cfg *Configuration, options configuration.Parameters) (err error) {
+func migratePullthroughSection(cfg *Configuration, options configuration.Parameters, env environment) (err error) {
 	defEnabled := true
 	defMirror := true
 
@@ -413,14 +1104,15 @@ func migratePullthroughSection(cfg *Configuration, options configuration.Paramet
 		cfg.Pullthrough = &Pullthrough{}
 	}
 
-	cfg.Pullthrough.Enabled, err = getBoolOption(pullthroughEnvVar, "pullthrough", defEnabled, options)
+	cfg.Pullthrough.Enabled, err = getBoolOption(env, pullthroughEnvVar, "pullthrough", defEnabled, options)
 	if err != nil {
-		err = fmt.Errorf("configuration error in openshift.pullthrough.enabled: %v", err)
+		err = fieldError("openshift.pullthrough.enabled", err)
 		return
 	}
-	cfg.Pullthrough.Mirror, err = getBoolOption(mirrorPullthroughEnvVar, "mirrorpullthrough", defMirror, options)
+	cfg.Pullthrough.Mirror, err = getBoolOption(env, mirrorPullthroughEnvVar, "mirrorpullthrough", defMirror, options)
 	if err != nil {
-		err = fmt.Errorf("configuration error in openshift.pullthrough.mirror: %v", err)
+		err = fieldError("openshift.pullthrough.mirror", err)
+		return
 	}
 
 	if !cfg.Pullthrough.Enabled {
@@ -428,10 +1120,129 @@ func migratePullthroughSection(cfg *Configuration, options configuration.Paramet
 		cfg.Pullthrough.Enabled = true
 	}
 
+	if cfg.Pullthrough.ScheduledImportInterval < 0 {
+		err = fieldErrorf("openshift.pullthrough.scheduledimportinterval", "negative value %s", cfg.Pullthrough.ScheduledImportInterval)
+		return
+	}
+
+	if cfg.Pullthrough.MirrorAnnotationInterval < 0 {
+		err = fieldErrorf("openshift.pullthrough.mirrorannotationinterval", "negative value %s", cfg.Pullthrough.MirrorAnnotationInterval)
+		return
+	}
+
+	if registry := cfg.Pullthrough.FallbackMirror.Registry; len(registry) > 0 {
+		if strings.Contains(registry, "://") {
+			err = fieldErrorf("openshift.pullthrough.fallbackmirror.registry", "%q must not contain a scheme", registry)
+			return
+		}
+		cfg.Pullthrough.FallbackMirror.Registry = strings.TrimSuffix(registry, "/")
+	}
+
+	for i, host := range cfg.Pullthrough.BasicAuthHosts {
+		if len(host) == 0 || strings.Contains(host, "/") {
+			err = fieldErrorf("openshift.pullthrough.basicauthhosts", "%q is not a host name", host)
+			return
+		}
+		cfg.Pullthrough.BasicAuthHosts[i] = strings.ToLower(host)
+	}
+
+	pins := make(map[string][]string, len(cfg.Pullthrough.CertificatePins))
+	for host, hostPins := range cfg.Pullthrough.CertificatePins {
+		// The pins are looked up by the server name that is sent to the
+		// registry, which isn't sent for IP addresses.
+		if len(host) == 0 || strings.ContainsAny(host, "/:") || net.ParseIP(host) != nil {
+			err = fieldErrorf("openshift.pullthrough.certificatepins", "%q is not a host name", host)
+			return
+		}
+		if len(hostPins) == 0 {
+			err = fieldErrorf("openshift.pullthrough.certificatepins", "no pins for %s", host)
+			return
+		}
+		for _, pin := range hostPins {
+			if err = validateCertificatePin(pin); err != nil {
+				err = fieldErrorf("openshift.pullthrough.certificatepins", "pin %q for %s: %v", pin, host, err)
+				return
+			}
+		}
+		host = strings.ToLower(host)
+		pins[host] = append(pins[host], hostPins...)
+	}
+	cfg.Pullthrough.CertificatePins = pins
+
+	switch cfg.Pullthrough.MirrorOrder {
+	case "":
+		cfg.Pullthrough.MirrorOrder = MirrorOrderHealth
+	case MirrorOrderHealth, MirrorOrderDeclared:
+	default:
+		err = fieldErrorf("openshift.pullthrough.mirrororder", "unknown order %q, expected %q or %q", cfg.Pullthrough.MirrorOrder, MirrorOrderHealth, MirrorOrderDeclared)
+		return
+	}
+
+	err = migrateMirrorQueue(&cfg.Pullthrough.MirrorQueue)
 	return
 }
 
-func migrateCompatibilitySection(cfg *Configuration, options configuration.Parameters) (err error) {
+func migrateMirrorQueue(q *MirrorQueue) error {
+	if q.Workers < 0 {
+		return fieldErrorf("openshift.pullthrough.mirrorqueue.workers", "negative value %d", q.Workers)
+	}
+	if q.MaxQueued < 0 {
+		return fieldErrorf("openshift.pullthrough.mirrorqueue.maxqueued", "negative value %d", q.MaxQueued)
+	}
+	if q.PrioritySize < 0 {
+		return fieldErrorf("openshift.pullthrough.mirrorqueue.prioritysize", "negative value %d", q.PrioritySize)
+	}
+	if q.Attempts < 0 {
+		return fieldErrorf("openshift.pullthrough.mirrorqueue.attempts", "negative value %d", q.Attempts)
+	}
+	if q.InitialBackoff < 0 {
+		return fieldErrorf("openshift.pullthrough.mirrorqueue.initialbackoff", "negative value %s", q.InitialBackoff)
+	}
+	if q.MaxBackoff < 0 {
+		return fieldErrorf("openshift.pullthrough.mirrorqueue.maxbackoff", "negative value %s", q.MaxBackoff)
+	}
+	if q.Workers == 0 {
+		q.Workers = defaultMirrorQueueWorkers
+	}
+	if q.MaxQueued == 0 {
+		q.MaxQueued = defaultMirrorQueueMaxQueued
+	}
+	if q.PrioritySize == 0 {
+		q.PrioritySize = defaultMirrorQueuePrioritySize
+	}
+	if q.Attempts == 0 {
+		q.Attempts = defaultMirrorQueueAttempts
+	}
+	if q.InitialBackoff == 0 {
+		q.InitialBackoff = defaultMirrorQueueInitialBackoff
+	}
+	if q.MaxBackoff == 0 {
+		q.MaxBackoff = defaultMirrorQueueMaxBackoff
+	}
+	if q.MaxBackoff < q.InitialBackoff {
+		return fieldErrorf("openshift.pullthrough.mirrorqueue.maxbackoff", "%s is less than the initial backoff %s", q.MaxBackoff, q.InitialBackoff)
+	}
+	return nil
+}
+
+// validateCertificatePin checks that pin is a base64 encoded SHA-256 digest
+// prefixed with "sha256/".
+func validateCertificatePin(pin string) error {
+	encoded, ok := strings.CutPrefix(pin, "sha256/")
+	if !ok {
+		return errors.New("must start with sha256/")
+	}
+	sum, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("invalid base64 encoding: %v", err)
+	}
+	if len(sum) != sha256.Size {
+		return fmt.Errorf("got %d bytes, want %d", len(sum), sha256.Size)
+	}
+	return nil
+}
+
+func migrateCompatibilitySection(cfg *Configuration, options configuration.Parameters, env environment) (err error) {
 	defAcceptSchema2 := true
 
 	if cfg.Compatibility != nil {
@@ -441,14 +1252,577 @@ func migrateCompatibilitySection(cfg *Configuration, options configuration.Param
 		cfg.Compatibility = &Compatibility{}
 	}
 
-	cfg.Compatibility.AcceptSchema2, err = getBoolOption(acceptSchema2EnvVar, "acceptschema2", defAcceptSchema2, options)
+	cfg.Compatibility.AcceptSchema2, err = getBoolOption(env, acceptSchema2EnvVar, "acceptschema2", defAcceptSchema2, options)
 	if err != nil {
-		err = fmt.Errorf("configuration error in openshift.compatibility.acceptschema2: %v", err)
+		err = fieldError("openshift.compatibility.acceptschema2", err)
+		return
+	}
+
+	if cfg.Compatibility.MaxManifestBytes < 0 {
+		err = fieldErrorf("openshift.compatibility.maxmanifestbytes", "negative value %d", cfg.Compatibility.MaxManifestBytes)
+		return
+	}
+	if cfg.Compatibility.MaxLayers < 0 {
+		err = fieldErrorf("openshift.compatibility.maxlayers", "negative value %d", cfg.Compatibility.MaxLayers)
+		return
+	}
+
+	if cfg.Compatibility.ManifestAnnotations == nil {
+		cfg.Compatibility.ManifestAnnotations = DefaultManifestAnnotations
+	}
+	for _, annotation := range cfg.Compatibility.ManifestAnnotations {
+		if !strings.HasPrefix(annotation, "org.opencontainers.image.") {
+			err = fieldErrorf("openshift.compatibility.manifestannotations", "%q is not an org.opencontainers.image.* annotation", annotation)
+			return
+		}
+	}
+
+	for key, mediaTypes := range map[string][]string{
+		"allowedmediatypes": cfg.Compatibility.AllowedMediaTypes,
+		"blockedmediatypes": cfg.Compatibility.BlockedMediaTypes,
+	} {
+		for _, mediaType := range mediaTypes {
+			if len(mediaType) == 0 || strings.Contains(strings.TrimSuffix(mediaType, "*"), "*") {
+				err = fieldErrorf(fmt.Sprintf("openshift.compatibility.%s", key), "invalid media type %q", mediaType)
+				return
+			}
+		}
+	}
+
+	switch cfg.Compatibility.ForeignLayers {
+	case "":
+		cfg.Compatibility.ForeignLayers = ForeignLayersAllow
+	case ForeignLayersAllow, ForeignLayersReject, ForeignLayersMirror:
+	default:
+		err = fieldErrorf("openshift.compatibility.foreignlayers", "unknown value %q, expected %q, %q or %q", cfg.Compatibility.ForeignLayers, ForeignLayersAllow, ForeignLayersReject, ForeignLayersMirror)
+		return
+	}
+	if cfg.Compatibility.ForeignLayers == ForeignLayersMirror && len(cfg.Compatibility.ForeignLayerHosts) == 0 {
+		err = fieldErrorf("openshift.compatibility.foreignlayerhosts", "at least one host is required when the foreign layers are mirrored")
+		return
+	}
+	for i, host := range cfg.Compatibility.ForeignLayerHosts {
+		if len(strings.TrimPrefix(host, "*.")) == 0 || strings.ContainsAny(host, "/:") || strings.Contains(strings.TrimPrefix(host, "*."), "*") {
+			err = fieldErrorf("openshift.compatibility.foreignlayerhosts", "%q is not a host name", host)
+			return
+		}
+		cfg.Compatibility.ForeignLayerHosts[i] = strings.ToLower(host)
 	}
 	return
 }
 
-func migrateMiddleware(dockercfg *configuration.Configuration, cfg *Configuration) (err error) {
+func migrateProfilingSection(cfg *Configuration, options configuration.Parameters, env environment) (err error) {
+	if cfg.Profiling == nil {
+		cfg.Profiling = &Profiling{
+			RequireAuth: true,
+		}
+		if env.get(profileEnvVar) == "web" {
+			log.Infof("DEPRECATED: %s=web is deprecated, use the 'REGISTRY_OPENSHIFT_PROFILING_ENABLED' instead", profileEnvVar)
+			host := env.get(profileHostEnvVar)
+			if len(host) == 0 {
+				host = "127.0.0.1"
+			}
+			port := env.get(profilePortEnvVar)
+			if len(port) == 0 {
+				port = "6060"
+			}
+			cfg.Profiling.Enabled = true
+			cfg.Profiling.RequireAuth = false
+			cfg.Profiling.Addr = net.JoinHostPort(host, port)
+		}
+	}
+
+	if !cfg.Profiling.Enabled {
+		return
+	}
+	if cfg.Profiling.RequireAuth && len(cfg.Profiling.Addr) > 0 {
+		log.Warnf("openshift.profiling.addr is ignored because openshift.profiling.requireauth is enabled")
+	}
+	if !cfg.Profiling.RequireAuth && len(cfg.Profiling.Addr) == 0 {
+		cfg.Profiling.Addr = defaultProfilingAddr
+	}
+	return
+}
+
+func migrateP2PSection(cfg *Configuration, options configuration.Parameters, env environment) (err error) {
+	if cfg.P2P == nil {
+		cfg.P2P = &P2P{}
+	}
+	if !cfg.P2P.Enabled {
+		return
+	}
+	if len(cfg.P2P.Header) == 0 {
+		cfg.P2P.Header = defaultP2PHeader
+	}
+	if len(cfg.P2P.Endpoint) == 0 {
+		err = fieldErrorf("openshift.p2p.endpoint", "the endpoint is required when p2p redirects are enabled")
+		return
+	}
+	u, err := url.Parse(cfg.P2P.Endpoint)
+	if err != nil {
+		err = fieldError("openshift.p2p.endpoint", err)
+		return
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || len(u.Host) == 0 {
+		err = fieldErrorf("openshift.p2p.endpoint", "%q is not an absolute http(s) URL", cfg.P2P.Endpoint)
+	}
+	return
+}
+
+func migrateSignaturesSection(cfg *Configuration, options configuration.Parameters, env environment) (err error) {
+	if cfg.Signatures == nil {
+		cfg.Signatures = &Signatures{}
+	}
+	if !cfg.Signatures.Verify {
+		return
+	}
+	if len(cfg.Signatures.PublicKeys) == 0 {
+		err = fieldErrorf("openshift.signatures.publickeys", "at least one public key is required when signature verification is enabled")
+		return
+	}
+	for name, path := range cfg.Signatures.PublicKeys {
+		if len(path) == 0 {
+			err = fieldErrorf(fmt.Sprintf("openshift.signatures.publickeys.%s", name), "the path is required")
+			return
+		}
+	}
+	return
+}
+
+func migrateAliasesSection(cfg *Configuration, options configuration.Parameters, env environment) (err error) {
+	if cfg.Aliases == nil {
+		cfg.Aliases = &Aliases{}
+	}
+	if ns := cfg.Aliases.DefaultNamespace; len(ns) > 0 {
+		if errs := validation.IsDNS1123Label(ns); len(errs) > 0 {
+			err = fieldErrorf("openshift.aliases.defaultnamespace", "%q is not a valid namespace: %s", ns, strings.Join(errs, ", "))
+			return
+		}
+	}
+	if cm := cfg.Aliases.ConfigMap; len(cm) > 0 {
+		namespace, name, ok := strings.Cut(cm, "/")
+		if !ok || len(namespace) == 0 || len(name) == 0 || strings.Contains(name, "/") {
+			err = fieldErrorf("openshift.aliases.configmap", "%q is not in the form <namespace>/<name>", cm)
+			return
+		}
+	}
+	return
+}
+
+func migrateManifestVerificationSection(cfg *Configuration, options configuration.Parameters, env environment) (err error) {
+	if cfg.ManifestVerification == nil {
+		cfg.ManifestVerification = &ManifestVerification{}
+	}
+	if cfg.ManifestVerification.Interval < 0 {
+		err = fieldErrorf("openshift.manifestverification.interval", "negative value %s", cfg.ManifestVerification.Interval)
+		return
+	}
+	if cfg.ManifestVerification.SampleSize < 0 {
+		err = fieldErrorf("openshift.manifestverification.samplesize", "negative value %d", cfg.ManifestVerification.SampleSize)
+		return
+	}
+	if cfg.ManifestVerification.SampleSize == 0 {
+		cfg.ManifestVerification.SampleSize = defaultManifestVerificationSampleSize
+	}
+	return
+}
+
+func migrateCoordinationSection(cfg *Configuration, options configuration.Parameters, env environment) (err error) {
+	if cfg.Coordination == nil {
+		cfg.Coordination = &Coordination{}
+	}
+	if cfg.Coordination.LeaseDuration == 0 {
+		cfg.Coordination.LeaseDuration = defaultCoordinationLeaseDuration
+	}
+	if cfg.Coordination.RenewDeadline == 0 {
+		cfg.Coordination.RenewDeadline = defaultCoordinationRenewDeadline
+	}
+	if cfg.Coordination.RetryPeriod == 0 {
+		cfg.Coordination.RetryPeriod = defaultCoordinationRetryPeriod
+	}
+	if cfg.Coordination.RetryPeriod < 0 {
+		err = fieldErrorf("openshift.coordination.retryperiod", "negative value %s", cfg.Coordination.RetryPeriod)
+		return
+	}
+	if cfg.Coordination.RenewDeadline <= cfg.Coordination.RetryPeriod {
+		err = fieldErrorf("openshift.coordination.renewdeadline", "%s must be greater than retryperiod %s", cfg.Coordination.RenewDeadline, cfg.Coordination.RetryPeriod)
+		return
+	}
+	if cfg.Coordination.LeaseDuration <= cfg.Coordination.RenewDeadline {
+		err = fieldErrorf("openshift.coordination.leaseduration", "%s must be greater than renewdeadline %s", cfg.Coordination.LeaseDuration, cfg.Coordination.RenewDeadline)
+		return
+	}
+	return
+}
+
+func migrateTrashSection(cfg *Configuration, options configuration.Parameters, env environment) (err error) {
+	if cfg.Trash == nil {
+		cfg.Trash = &Trash{}
+	}
+	if cfg.Trash.Retention < 0 {
+		err = fieldErrorf("openshift.trash.retention", "negative value %s", cfg.Trash.Retention)
+		return
+	}
+	if cfg.Trash.PurgeInterval < 0 {
+		err = fieldErrorf("openshift.trash.purgeinterval", "negative value %s", cfg.Trash.PurgeInterval)
+		return
+	}
+	if cfg.Trash.Retention == 0 {
+		cfg.Trash.Retention = defaultTrashRetention
+	}
+	if cfg.Trash.PurgeInterval == 0 {
+		cfg.Trash.PurgeInterval = defaultTrashPurgeInterval
+	}
+	return
+}
+
+func migrateEncryptionSection(cfg *Configuration, options configuration.Parameters, env environment) (err error) {
+	if cfg.Encryption == nil {
+		cfg.Encryption = &Encryption{}
+	}
+	if !cfg.Encryption.Enabled {
+		return
+	}
+	if len(cfg.Encryption.KeysDir) == 0 {
+		err = fieldErrorf("openshift.encryption.keysdir", "the directory with the keys is required")
+		return
+	}
+	if len(cfg.Encryption.PrimaryKey) == 0 {
+		err = fieldErrorf("openshift.encryption.primarykey", "the primary key is required")
+		return
+	}
+	return
+}
+
+func migratePruningSection(cfg *Configuration, options configuration.Parameters, env environment) (err error) {
+	if cfg.Pruning == nil {
+		cfg.Pruning = &Pruning{}
+	}
+	if cfg.Pruning.Interval < 0 {
+		err = fieldErrorf("openshift.pruning.interval", "negative value %s", cfg.Pruning.Interval)
+		return
+	}
+	if cfg.Pruning.MinBlobAge < 0 {
+		err = fieldErrorf("openshift.pruning.minblobage", "negative value %s", cfg.Pruning.MinBlobAge)
+		return
+	}
+	if cfg.Pruning.Interval == 0 {
+		cfg.Pruning.Interval = defaultPruningInterval
+	}
+	if cfg.Pruning.MinBlobAge == 0 {
+		cfg.Pruning.MinBlobAge = defaultPruningMinBlobAge
+	}
+	if len(cfg.Pruning.HighWatermark) == 0 {
+		if len(cfg.Pruning.LowWatermark) != 0 {
+			err = fieldErrorf("openshift.pruning.lowwatermark", "highwatermark is required")
+		}
+		return
+	}
+	if cfg.Coordination == nil || !cfg.Coordination.Enabled {
+		err = fieldErrorf("openshift.pruning.highwatermark", "the pruning requires openshift.coordination.enabled, so that only one replica deletes blobs")
+		return
+	}
+	high, err := ParseWatermark(cfg.Pruning.HighWatermark)
+	if err != nil {
+		err = fieldError("openshift.pruning.highwatermark", err)
+		return
+	}
+	if len(cfg.Pruning.LowWatermark) == 0 {
+		err = fieldErrorf("openshift.pruning.lowwatermark", "the low watermark is required")
+		return
+	}
+	low, err := ParseWatermark(cfg.Pruning.LowWatermark)
+	if err != nil {
+		err = fieldError("openshift.pruning.lowwatermark", err)
+		return
+	}
+	if (high.Percent > 0) != (low.Percent > 0) {
+		err = fieldErrorf("openshift.pruning.lowwatermark", "%s and the high watermark %s must be both sizes or both percentages", cfg.Pruning.LowWatermark, cfg.Pruning.HighWatermark)
+		return
+	}
+	if (high.Percent > 0 && low.Percent >= high.Percent) || (high.Percent == 0 && low.Bytes >= high.Bytes) {
+		err = fieldErrorf("openshift.pruning.lowwatermark", "%s must be lower than the high watermark %s", cfg.Pruning.LowWatermark, cfg.Pruning.HighWatermark)
+		return
+	}
+	return
+}
+
+func migrateWriteRetriesSection(cfg *Configuration, options configuration.Parameters, env environment) (err error) {
+	if cfg.WriteRetries == nil {
+		cfg.WriteRetries = &WriteRetries{}
+	}
+	if cfg.WriteRetries.Attempts < 0 {
+		err = fieldErrorf("openshift.writeretries.attempts", "negative value %d", cfg.WriteRetries.Attempts)
+		return
+	}
+	if cfg.WriteRetries.InitialBackoff < 0 {
+		err = fieldErrorf("openshift.writeretries.initialbackoff", "negative value %s", cfg.WriteRetries.InitialBackoff)
+		return
+	}
+	if cfg.WriteRetries.MaxBackoff < 0 {
+		err = fieldErrorf("openshift.writeretries.maxbackoff", "negative value %s", cfg.WriteRetries.MaxBackoff)
+		return
+	}
+	if cfg.WriteRetries.Attempts == 0 {
+		cfg.WriteRetries.Attempts = defaultWriteRetriesAttempts
+	}
+	if cfg.WriteRetries.InitialBackoff == 0 {
+		cfg.WriteRetries.InitialBackoff = defaultWriteRetriesInitialBackoff
+	}
+	if cfg.WriteRetries.MaxBackoff == 0 {
+		cfg.WriteRetries.MaxBackoff = defaultWriteRetriesMaxBackoff
+	}
+	if cfg.WriteRetries.MaxBackoff < cfg.WriteRetries.InitialBackoff {
+		err = fieldErrorf("openshift.writeretries.maxbackoff", "%s is less than the initial backoff %s", cfg.WriteRetries.MaxBackoff, cfg.WriteRetries.InitialBackoff)
+		return
+	}
+	return
+}
+
+func migrateDegradedModeSection(cfg *Configuration, options configuration.Parameters, env environment) (err error) {
+	if cfg.DegradedMode == nil {
+		cfg.DegradedMode = &DegradedMode{}
+	}
+	if cfg.DegradedMode.AuthCacheTTL < 0 {
+		err = fieldErrorf("openshift.degradedmode.authcachettl", "negative value %s", cfg.DegradedMode.AuthCacheTTL)
+		return
+	}
+	if cfg.DegradedMode.AuthCacheTTL == 0 {
+		cfg.DegradedMode.AuthCacheTTL = defaultDegradedModeAuthCacheTTL
+	}
+	return
+}
+
+func migrateImageServiceSection(cfg *Configuration, options configuration.Parameters, env environment) (err error) {
+	if cfg.ImageService == nil {
+		cfg.ImageService = &ImageService{}
+	}
+	if !cfg.ImageService.Enabled {
+		return
+	}
+	if len(cfg.ImageService.Addr) == 0 {
+		err = fieldErrorf("openshift.imageservice.addr", "the address is required when the image service is enabled")
+		return
+	}
+	path, ok := strings.CutPrefix(cfg.ImageService.Addr, "unix://")
+	if !ok {
+		err = fieldErrorf("openshift.imageservice.addr", "%q is not a Unix socket, the image service doesn't use TLS", cfg.ImageService.Addr)
+		return
+	}
+	if !filepath.IsAbs(path) {
+		err = fieldErrorf("openshift.imageservice.addr", "%q is not an absolute path", path)
+	}
+	return
+}
+
+func migrateTrafficRecordingSection(cfg *Configuration, options configuration.Parameters, env environment) (err error) {
+	if cfg.TrafficRecording == nil {
+		cfg.TrafficRecording = &TrafficRecording{}
+	}
+	if !cfg.TrafficRecording.Enabled {
+		return
+	}
+	if len(cfg.TrafficRecording.Path) == 0 {
+		err = fieldErrorf("openshift.trafficrecording.path", "the path is required when the traffic recording is enabled")
+		return
+	}
+	if cfg.TrafficRecording.SampleRate < 0 || cfg.TrafficRecording.SampleRate > 1 {
+		err = fieldErrorf("openshift.trafficrecording.samplerate", "%v is not between 0 and 1", cfg.TrafficRecording.SampleRate)
+		return
+	}
+	if cfg.TrafficRecording.SampleRate == 0 {
+		cfg.TrafficRecording.SampleRate = defaultTrafficRecordingSampleRate
+	}
+	if cfg.TrafficRecording.MaxBytes < 0 {
+		err = fieldErrorf("openshift.trafficrecording.maxbytes", "must not be negative")
+		return
+	}
+	if cfg.TrafficRecording.MaxBytes == 0 {
+		cfg.TrafficRecording.MaxBytes = defaultTrafficRecordingMaxBytes
+	}
+	return
+}
+
+func migrateSecuritySection(cfg *Configuration, options configuration.Parameters, env environment) (err error) {
+	if cfg.Security == nil {
+		cfg.Security = &Security{}
+	}
+	if cfg.Security.MaxDecompressionRatio < 0 {
+		err = fieldErrorf("openshift.security.maxdecompressionratio", "must not be negative")
+		return
+	}
+	if cfg.Security.MaxDecompressionRatio > 0 && cfg.Security.MaxDecompressionRatio < 1 {
+		err = fieldErrorf("openshift.security.maxdecompressionratio", "%v is less than 1", cfg.Security.MaxDecompressionRatio)
+		return
+	}
+	if cfg.Security.MaxFiles < 0 {
+		err = fieldErrorf("openshift.security.maxfiles", "must not be negative")
+		return
+	}
+	if cfg.Security.MaxDecompressionRatio == 0 {
+		if cfg.Security.CheckUploads {
+			err = fieldErrorf("openshift.security.checkuploads", "the uploads can be checked only if maxdecompressionratio is set")
+		}
+		return
+	}
+	if cfg.Security.MaxFiles == 0 {
+		cfg.Security.MaxFiles = defaultMaxDecompressedFiles
+	}
+	return
+}
+
+func migrateTagPropagationSection(cfg *Configuration, options configuration.Parameters, env environment) (err error) {
+	if cfg.TagPropagation == nil {
+		cfg.TagPropagation = &TagPropagation{}
+	}
+	for i, peer := range cfg.TagPropagation.Peers {
+		u, parseErr := url.Parse(peer.URL)
+		if parseErr != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			err = fieldErrorf(fmt.Sprintf("openshift.tagpropagation.peers[%d].url", i), "%q is not an http or https URL", peer.URL)
+			return
+		}
+		if len(peer.SecretFile) == 0 {
+			err = fieldErrorf(fmt.Sprintf("openshift.tagpropagation.peers[%d].secretfile", i), "the secret is required to sign the notifications")
+			return
+		}
+	}
+	return
+}
+
+func migrateContentTrustSection(cfg *Configuration, options configuration.Parameters, env environment) (err error) {
+	if cfg.ContentTrust == nil {
+		cfg.ContentTrust = &ContentTrust{}
+	}
+	if len(cfg.ContentTrust.NotaryURL) > 0 {
+		u, parseErr := url.Parse(cfg.ContentTrust.NotaryURL)
+		if parseErr != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			err = fieldErrorf("openshift.contenttrust.notaryurl", "%q is not an http or https URL", cfg.ContentTrust.NotaryURL)
+			return
+		}
+	}
+	return
+}
+
+func migrateAccessLogSection(cfg *Configuration, options configuration.Parameters, env environment) (err error) {
+	if cfg.AccessLog == nil {
+		cfg.AccessLog = &AccessLog{}
+	}
+	switch cfg.AccessLog.Format {
+	case "":
+		if len(cfg.AccessLog.Path) > 0 {
+			err = fieldErrorf("openshift.accesslog.path", "the format is required when the path is set")
+			return
+		}
+	case "combined", "json":
+	default:
+		err = fieldErrorf("openshift.accesslog.format", "%q is neither combined nor json", cfg.AccessLog.Format)
+		return
+	}
+	return
+}
+
+func migrateDiagnosticsSection(cfg *Configuration, options configuration.Parameters, env environment) (err error) {
+	if cfg.Diagnostics == nil {
+		cfg.Diagnostics = &Diagnostics{}
+	}
+	if cfg.Diagnostics.LogEntries < 0 {
+		err = fieldErrorf("openshift.diagnostics.logentries", "must not be negative")
+		return
+	}
+	if cfg.Diagnostics.LogEntries == 0 {
+		cfg.Diagnostics.LogEntries = defaultDiagnosticsLogEntries
+	}
+	return
+}
+
+func migrateKubeClientSection(cfg *Configuration, options configuration.Parameters, env environment) (err error) {
+	if cfg.KubeClient == nil {
+		cfg.KubeClient = &KubeClient{}
+	}
+	tlsConfig := cfg.KubeClient.TLS
+	if (tlsConfig.CertFile == "") != (tlsConfig.KeyFile == "") {
+		err = fieldErrorf("openshift.kubeclient.tls", "certfile and keyfile must be set together")
+		return
+	}
+	if tlsConfig.MinVersion != "" {
+		if _, err = crypto.TLSVersion(tlsConfig.MinVersion); err != nil {
+			err = fieldErrorf("openshift.kubeclient.tls.minversion", "%v (valid values are %q)", err, crypto.ValidTLSVersions())
+			return
+		}
+	}
+
+	reconnect := &cfg.KubeClient.Reconnect
+	if reconnect.Failures < 0 {
+		err = fieldErrorf("openshift.kubeclient.reconnect.failures", "negative value %d", reconnect.Failures)
+		return
+	}
+	if reconnect.InitialBackoff < 0 {
+		err = fieldErrorf("openshift.kubeclient.reconnect.initialbackoff", "negative value %s", reconnect.InitialBackoff)
+		return
+	}
+	if reconnect.MaxBackoff < 0 {
+		err = fieldErrorf("openshift.kubeclient.reconnect.maxbackoff", "negative value %s", reconnect.MaxBackoff)
+		return
+	}
+	if reconnect.Failures == 0 {
+		reconnect.Failures = defaultKubeClientReconnectFailures
+	}
+	if reconnect.InitialBackoff == 0 {
+		reconnect.InitialBackoff = defaultKubeClientReconnectInitialBackoff
+	}
+	if reconnect.MaxBackoff == 0 {
+		reconnect.MaxBackoff = defaultKubeClientReconnectMaxBackoff
+	}
+	if reconnect.MaxBackoff < reconnect.InitialBackoff {
+		err = fieldErrorf("openshift.kubeclient.reconnect.maxbackoff", "%s is less than the initial backoff %s", reconnect.MaxBackoff, reconnect.InitialBackoff)
+		return
+	}
+	return
+}
+
+func migrateSpoolSection(cfg *Configuration, options configuration.Parameters, env environment) (err error) {
+	if cfg.Spool == nil {
+		cfg.Spool = &Spool{}
+	}
+	if cfg.Spool.MoveInterval < 0 {
+		err = fieldErrorf("openshift.spool.moveinterval", "negative value %s", cfg.Spool.MoveInterval)
+		return
+	}
+	if cfg.Spool.MoveInterval == 0 {
+		cfg.Spool.MoveInterval = defaultSpoolMoveInterval
+	}
+	if !cfg.Spool.Enabled {
+		return
+	}
+	if len(cfg.Spool.Directory) == 0 {
+		err = fieldErrorf("openshift.spool.directory", "the directory of the spool is required")
+		return
+	}
+	if len(cfg.Spool.MaxSize) == 0 {
+		err = fieldErrorf("openshift.spool.maxsize", "the maximum size of the spool is required")
+		return
+	}
+	if _, err = ParseSpoolSize(cfg.Spool.MaxSize); err != nil {
+		err = fieldError("openshift.spool.maxsize", err)
+		return
+	}
+	return
+}
+
+// ParseSpoolSize parses the maximum size of the spool, a number of bytes with
+// an optional suffix (e.g. 20Gi).
+func ParseSpoolSize(s string) (int64, error) {
+	w, err := ParseWatermark(s)
+	if err != nil {
+		return 0, err
+	}
+	if w.Percent > 0 {
+		return 0, fmt.Errorf("the size %q must be a number of bytes, not a percentage", s)
+	}
+	return w.Bytes, nil
+}
+
+func migrateMiddleware(dockercfg *configuration.Configuration, cfg *Configuration, env environment) (err error) {
 	var repoMiddleware *configuration.Middleware
 	for _, middleware := range dockercfg.Middleware["repository"] {
 		if middleware.Name == middlewareName {
@@ -476,17 +1850,24 @@ func migrateMiddleware(dockercfg *configuration.Configuration, cfg *Configuratio
 
 	if cfg.Auth == nil {
 		cfg.Auth = &Auth{}
-		cfg.Auth.Realm, err = getStringOption("", realmKey, "origin", dockercfg.Auth.Parameters())
+		cfg.Auth.Realm, err = getStringOption(env, "", realmKey, "origin", dockercfg.Auth.Parameters())
 		if err != nil {
-			err = fmt.Errorf("configuration error in openshift.auth.realm: %v", err)
+			err = fieldError("openshift.auth.realm", err)
 			return
 		}
-		cfg.Auth.TokenRealm, err = getStringOption("", tokenRealmKey, "", dockercfg.Auth.Parameters())
+		cfg.Auth.TokenRealm, err = getStringOption(env, "", tokenRealmKey, "", dockercfg.Auth.Parameters())
 		if err != nil {
-			err = fmt.Errorf("configuration error in openshift.auth.tokenrealm: %v", err)
+			err = fieldError("openshift.auth.tokenrealm", err)
 			return
 		}
 	}
+	if cfg.Auth.RefreshTokenLifetime < 0 {
+		err = fieldErrorf("openshift.auth.refreshtokenlifetime", "must not be negative")
+		return
+	}
+	if cfg.Auth.RefreshTokenLifetime == 0 {
+		cfg.Auth.RefreshTokenLifetime = defaultRefreshTokenLifetime
+	}
 	if cfg.Audit == nil {
 		cfg.Audit = &Audit{}
 		authParameters := dockercfg.Auth.Parameters()
@@ -499,21 +1880,41 @@ func migrateMiddleware(dockercfg *configuration.Configuration, cfg *Configuratio
 				}
 			}
 
-			cfg.Audit.Enabled, err = getBoolOption("", "enabled", false, auditOptions)
+			cfg.Audit.Enabled, err = getBoolOption(env, "", "enabled", false, auditOptions)
 			if err != nil {
-				err = fmt.Errorf("configuration error in openshift.audit.enabled: %v", err)
+				err = fieldError("openshift.audit.enabled", err)
 				return
 			}
 		}
 	}
-	for _, migrator := range []func(*Configuration, configuration.Parameters) error{
+	for _, migrator := range []func(*Configuration, configuration.Parameters, environment) error{
 		migrateServerSection,
 		migrateCacheSection,
 		migrateQuotaSection,
 		migratePullthroughSection,
 		migrateCompatibilitySection,
+		migrateProfilingSection,
+		migrateP2PSection,
+		migrateSignaturesSection,
+		migrateAliasesSection,
+		migrateManifestVerificationSection,
+		migrateCoordinationSection,
+		migrateTrashSection,
+		migrateEncryptionSection,
+		migratePruningSection,
+		migrateWriteRetriesSection,
+		migrateDegradedModeSection,
+		migrateImageServiceSection,
+		migrateTrafficRecordingSection,
+		migrateTagPropagationSection,
+		migrateSecuritySection,
+		migrateContentTrustSection,
+		migrateAccessLogSection,
+		migrateDiagnosticsSection,
+		migrateKubeClientSection,
+		migrateSpoolSection,
 	} {
-		err = migrator(cfg, repoMiddleware.Options)
+		err = migrator(cfg, repoMiddleware.Options, env)
 		if err != nil {
 			return
 		}
@@ -521,8 +1922,18 @@ func migrateMiddleware(dockercfg *configuration.Configuration, cfg *Configuratio
 	return nil
 }
 
+// InitExtraConfig sets the defaults of cfg and validates it. The options of
+// the openshift middleware in dockercfg and the environment of the process
+// override the values of cfg.
 func InitExtraConfig(dockercfg *configuration.Configuration, cfg *Configuration) error {
+	return initExtraConfig(dockercfg, cfg, newEnvironment(os.Environ()))
+}
+
+func initExtraConfig(dockercfg *configuration.Configuration, cfg *Configuration, env environment) error {
 	setDefaultMiddleware(dockercfg)
-	dockercfg.Compatibility.Schema1.Enabled = true
-	return migrateMiddleware(dockercfg, cfg)
+	if err := migrateMiddleware(dockercfg, cfg, env); err != nil {
+		return err
+	}
+	dockercfg.Compatibility.Schema1.Enabled = !cfg.Compatibility.DisableSchema1
+	return nil
 }
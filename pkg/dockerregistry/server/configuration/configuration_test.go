@@ -2,10 +2,12 @@ package configuration
 
 import (
 	"bytes"
+	"fmt"
 	"os"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/distribution/distribution/v3/configuration"
 )
@@ -609,6 +611,120 @@ openshift:
 	}
 }
 
+func TestServerLayerHints(t *testing.T) {
+	configYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+    layerhints:
+      enabled: true
+      prefetchlayers: 3
+`
+	_, cfg, err := Parse(strings.NewReader(configYaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (ServerLayerHints{Enabled: true, PrefetchLayers: 3}); cfg.Server.LayerHints != expected {
+		t.Errorf("unexpected value: cfg.Server.LayerHints: got %#+v, want %#+v", cfg.Server.LayerHints, expected)
+	}
+
+	badConfigYaml := strings.Replace(configYaml, "prefetchlayers: 3", "prefetchlayers: -1", 1)
+	if _, _, err := Parse(strings.NewReader(badConfigYaml)); err == nil {
+		t.Fatalf("expected error for a negative number of prefetched layers")
+	}
+}
+
+func TestServerCacheControl(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		cacheControl   string
+		anonymousPulls bool
+		expected       string
+		expectedErr    bool
+	}{
+		{
+			name:         "private by default",
+			cacheControl: "max-age=31536000, immutable",
+			expected:     "private, max-age=31536000, immutable",
+		},
+		{
+			name:         "private",
+			cacheControl: "private, max-age=600",
+			expected:     "private, max-age=600",
+		},
+		{
+			name:         "public without anonymous pulls",
+			cacheControl: "Public, max-age=31536000",
+			expectedErr:  true,
+		},
+		{
+			name:           "public with anonymous pulls",
+			cacheControl:   "public, max-age=31536000",
+			anonymousPulls: true,
+			expected:       "public, max-age=31536000",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			configYaml := fmt.Sprintf(`
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+    cachecontrol: %q
+    anonymouspulls: %t
+`, tc.cacheControl, tc.anonymousPulls)
+			_, cfg, err := Parse(strings.NewReader(configYaml))
+			if tc.expectedErr {
+				if err == nil {
+					t.Fatalf("expected an error, got cachecontrol %q", cfg.Server.CacheControl)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Server.CacheControl != tc.expected {
+				t.Errorf("got cachecontrol %q, want %q", cfg.Server.CacheControl, tc.expected)
+			}
+		})
+	}
+}
+
+func TestServerAutoProvisionImageStreams(t *testing.T) {
+	configYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+`
+	_, cfg, err := Parse(strings.NewReader(configYaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := cfg.Server.AutoProvisionImageStreams; p == nil || !*p {
+		t.Errorf("expected the image streams to be auto provisioned by default, got %v", p)
+	}
+
+	configYaml += "    autoprovisionimagestreams: false\n"
+	_, cfg, err = Parse(strings.NewReader(configYaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := cfg.Server.AutoProvisionImageStreams; p == nil || *p {
+		t.Errorf("expected the auto provisioning of image streams to be disabled, got %v", p)
+	}
+}
+
 func TestServerAddrConfigPriority(t *testing.T) {
 	configYaml := `
 version: 0.1
@@ -814,3 +930,1760 @@ openshift:
 		t.Fatalf("expected configuration\n\t%#v\ngot\n\t%#v", expectConfig, currentConfig)
 	}
 }
+
+func TestCompatibilityLimits(t *testing.T) {
+	configYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+  compatibility:
+    acceptschema2: true
+    disableschema1: true
+    maxmanifestbytes: 4194304
+    maxlayers: 128
+    serveoci: true
+    negotiatemanifests: true
+    foreignlayers: mirror
+    foreignlayerhosts:
+    - MCR.microsoft.com
+    - "*.blob.core.windows.net"
+`
+	dockercfg, cfg, err := Parse(strings.NewReader(configYaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.Compatibility.DisableSchema1 || dockercfg.Compatibility.Schema1.Enabled {
+		t.Errorf("expected schema 1 to be disabled, got cfg.Compatibility.DisableSchema1: %t, dockercfg.Compatibility.Schema1.Enabled: %t", cfg.Compatibility.DisableSchema1, dockercfg.Compatibility.Schema1.Enabled)
+	}
+	if cfg.Compatibility.MaxManifestBytes != 4194304 {
+		t.Errorf("unexpected value: cfg.Compatibility.MaxManifestBytes: %d", cfg.Compatibility.MaxManifestBytes)
+	}
+	if cfg.Compatibility.MaxLayers != 128 {
+		t.Errorf("unexpected value: cfg.Compatibility.MaxLayers: %d", cfg.Compatibility.MaxLayers)
+	}
+	if !cfg.Compatibility.ServeOCI {
+		t.Errorf("unexpected value: cfg.Compatibility.ServeOCI: %t", cfg.Compatibility.ServeOCI)
+	}
+	if !cfg.Compatibility.NegotiateManifests {
+		t.Errorf("unexpected value: cfg.Compatibility.NegotiateManifests: %t", cfg.Compatibility.NegotiateManifests)
+	}
+	if cfg.Compatibility.ForeignLayers != ForeignLayersMirror {
+		t.Errorf("unexpected value: cfg.Compatibility.ForeignLayers: %q", cfg.Compatibility.ForeignLayers)
+	}
+	if expected := []string{"mcr.microsoft.com", "*.blob.core.windows.net"}; !reflect.DeepEqual(cfg.Compatibility.ForeignLayerHosts, expected) {
+		t.Errorf("unexpected value: cfg.Compatibility.ForeignLayerHosts: %q", cfg.Compatibility.ForeignLayerHosts)
+	}
+
+	for _, bad := range []string{
+		"    foreignlayerhosts: []\n",
+		"    foreignlayerhosts: [\"http://mcr.microsoft.com\"]\n",
+		"    foreignlayerhosts: [\"*\"]\n",
+	} {
+		badConfigYaml := strings.Replace(configYaml, "    foreignlayerhosts:\n    - MCR.microsoft.com\n    - \"*.blob.core.windows.net\"\n", bad, 1)
+		if _, _, err := Parse(strings.NewReader(badConfigYaml)); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+	if !reflect.DeepEqual(cfg.Compatibility.ManifestAnnotations, DefaultManifestAnnotations) {
+		t.Errorf("unexpected value: cfg.Compatibility.ManifestAnnotations: %v", cfg.Compatibility.ManifestAnnotations)
+	}
+
+	badConfigYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+  compatibility:
+    maxlayers: -1
+`
+	if _, _, err := Parse(strings.NewReader(badConfigYaml)); err == nil {
+		t.Fatalf("expected error for negative maxlayers")
+	}
+
+	badConfigYaml = `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+  compatibility:
+    manifestannotations:
+      - io.example.secret
+`
+	if _, _, err := Parse(strings.NewReader(badConfigYaml)); err == nil {
+		t.Fatalf("expected error for a manifest annotation outside of org.opencontainers.image")
+	}
+
+	badConfigYaml = `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+  compatibility:
+    blockedmediatypes:
+      - application/*.tar
+`
+	if _, _, err := Parse(strings.NewReader(badConfigYaml)); err == nil {
+		t.Fatalf("expected error for a media type with a wildcard in the middle")
+	}
+
+	badConfigYaml = `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+  compatibility:
+    foreignlayers: download
+`
+	if _, _, err := Parse(strings.NewReader(badConfigYaml)); err == nil {
+		t.Fatalf("expected error for an unknown foreignlayers value")
+	}
+}
+
+func TestPullthroughScheduledImportInterval(t *testing.T) {
+	configYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+  pullthrough:
+    enabled: true
+    mirror: true
+    scheduledimportinterval: 15m
+`
+	_, cfg, err := Parse(strings.NewReader(configYaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Pullthrough.ScheduledImportInterval != 15*time.Minute {
+		t.Errorf("unexpected value: cfg.Pullthrough.ScheduledImportInterval: %s", cfg.Pullthrough.ScheduledImportInterval)
+	}
+
+	badConfigYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+  pullthrough:
+    enabled: true
+    scheduledimportinterval: -1m
+`
+	if _, _, err := Parse(strings.NewReader(badConfigYaml)); err == nil {
+		t.Fatalf("expected error for negative scheduledimportinterval")
+	}
+}
+
+func TestPullthroughMirrorAnnotationInterval(t *testing.T) {
+	configYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+  pullthrough:
+    enabled: true
+    mirror: true
+    mirrorannotationinterval: 30s
+`
+	_, cfg, err := Parse(strings.NewReader(configYaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Pullthrough.MirrorAnnotationInterval != 30*time.Second {
+		t.Errorf("unexpected value: cfg.Pullthrough.MirrorAnnotationInterval: %s", cfg.Pullthrough.MirrorAnnotationInterval)
+	}
+
+	badConfigYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+  pullthrough:
+    enabled: true
+    mirrorannotationinterval: -1s
+`
+	if _, _, err := Parse(strings.NewReader(badConfigYaml)); err == nil {
+		t.Fatalf("expected error for negative mirrorannotationinterval")
+	}
+}
+
+func TestPullthroughMirrorOrder(t *testing.T) {
+	for _, tc := range []struct {
+		order    string
+		expected string
+		err      bool
+	}{
+		{order: "", expected: MirrorOrderHealth},
+		{order: "health", expected: MirrorOrderHealth},
+		{order: "declared", expected: MirrorOrderDeclared},
+		{order: "random", err: true},
+	} {
+		configYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+  pullthrough:
+    enabled: true
+    mirrororder: "` + tc.order + `"
+`
+		_, cfg, err := Parse(strings.NewReader(configYaml))
+		if tc.err {
+			if err == nil {
+				t.Errorf("%q: expected an error", tc.order)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tc.order, err)
+			continue
+		}
+		if cfg.Pullthrough.MirrorOrder != tc.expected {
+			t.Errorf("%q: got order %q, want %q", tc.order, cfg.Pullthrough.MirrorOrder, tc.expected)
+		}
+	}
+}
+
+func TestPullthroughMirrorQueue(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		queue    string
+		expected MirrorQueue
+		err      bool
+	}{
+		{
+			name: "defaults",
+			expected: MirrorQueue{
+				Workers:        defaultMirrorQueueWorkers,
+				MaxQueued:      defaultMirrorQueueMaxQueued,
+				PrioritySize:   defaultMirrorQueuePrioritySize,
+				Attempts:       defaultMirrorQueueAttempts,
+				InitialBackoff: defaultMirrorQueueInitialBackoff,
+				MaxBackoff:     defaultMirrorQueueMaxBackoff,
+			},
+		},
+		{
+			name: "custom",
+			queue: `
+      workers: 2
+      maxqueued: 10
+      prioritysize: 4096
+      attempts: 1
+      initialbackoff: 1s
+      maxbackoff: 2s`,
+			expected: MirrorQueue{
+				Workers:        2,
+				MaxQueued:      10,
+				PrioritySize:   4096,
+				Attempts:       1,
+				InitialBackoff: time.Second,
+				MaxBackoff:     2 * time.Second,
+			},
+		},
+		{
+			name: "negative workers",
+			queue: `
+      workers: -1`,
+			err: true,
+		},
+		{
+			name: "max backoff less than initial backoff",
+			queue: `
+      initialbackoff: 10s
+      maxbackoff: 1s`,
+			err: true,
+		},
+	} {
+		configYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+  pullthrough:
+    enabled: true
+    mirrorqueue: {}`
+		if tc.queue != "" {
+			configYaml = strings.TrimSuffix(configYaml, " {}") + tc.queue
+		}
+		_, cfg, err := Parse(strings.NewReader(configYaml + "\n"))
+		if tc.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if cfg.Pullthrough.MirrorQueue != tc.expected {
+			t.Errorf("%s: got %#+v, want %#+v", tc.name, cfg.Pullthrough.MirrorQueue, tc.expected)
+		}
+	}
+}
+
+func TestPullthroughFallbackMirror(t *testing.T) {
+	configYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+  pullthrough:
+    enabled: true
+    mirror: true
+    fallbackmirror:
+      registry: artifactory.example.com/docker-remote/
+      credentialsfile: /etc/registry/fallback-mirror/config.json
+`
+	_, cfg, err := Parse(strings.NewReader(configYaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := FallbackMirror{
+		Registry:        "artifactory.example.com/docker-remote",
+		CredentialsFile: "/etc/registry/fallback-mirror/config.json",
+	}
+	if !reflect.DeepEqual(cfg.Pullthrough.FallbackMirror, expected) {
+		t.Errorf("unexpected value: cfg.Pullthrough.FallbackMirror: %#+v", cfg.Pullthrough.FallbackMirror)
+	}
+
+	badConfigYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+  pullthrough:
+    enabled: true
+    fallbackmirror:
+      registry: https://artifactory.example.com
+`
+	if _, _, err := Parse(strings.NewReader(badConfigYaml)); err == nil {
+		t.Fatalf("expected error for fallbackmirror registry with a scheme")
+	}
+}
+
+func TestPullthroughBasicAuthHosts(t *testing.T) {
+	configYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+  pullthrough:
+    enabled: true
+    basicauthhosts:
+    - Artifactory.example.com:8443
+    - registry.example.com
+`
+	_, cfg, err := Parse(strings.NewReader(configYaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"artifactory.example.com:8443", "registry.example.com"}
+	if !reflect.DeepEqual(cfg.Pullthrough.BasicAuthHosts, expected) {
+		t.Errorf("unexpected value: cfg.Pullthrough.BasicAuthHosts: %#+v", cfg.Pullthrough.BasicAuthHosts)
+	}
+
+	badConfigYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+  pullthrough:
+    enabled: true
+    basicauthhosts:
+    - artifactory.example.com/docker-remote
+`
+	if _, _, err := Parse(strings.NewReader(badConfigYaml)); err == nil {
+		t.Fatalf("expected error for basicauthhosts entry with a path")
+	}
+}
+
+func TestPullthroughCertificatePins(t *testing.T) {
+	configYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+  pullthrough:
+    enabled: true
+    certificatepins:
+      Quay.io:
+      - sha256/47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=
+      - sha256/AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=
+`
+	_, cfg, err := Parse(strings.NewReader(configYaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]string{
+		"quay.io": {
+			"sha256/47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=",
+			"sha256/AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=",
+		},
+	}
+	if !reflect.DeepEqual(cfg.Pullthrough.CertificatePins, expected) {
+		t.Errorf("unexpected value: cfg.Pullthrough.CertificatePins: %#+v", cfg.Pullthrough.CertificatePins)
+	}
+
+	for _, bad := range []string{
+		`
+      quay.io:443:
+      - sha256/47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=`,
+		`
+      192.0.2.1:
+      - sha256/47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=`,
+		`
+      quay.io: []`,
+		`
+      quay.io:
+      - 47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=`,
+		`
+      quay.io:
+      - sha256/47DEQpj8HBSa`,
+	} {
+		badConfigYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+  pullthrough:
+    enabled: true
+    certificatepins:` + bad + "\n"
+		if _, _, err := Parse(strings.NewReader(badConfigYaml)); err == nil {
+			t.Errorf("expected error for certificatepins %s", bad)
+		}
+	}
+}
+
+func TestProfiling(t *testing.T) {
+	configYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+`
+	profilingYaml := `
+  profiling:
+    enabled: true
+`
+	testCases := []struct {
+		name     string
+		config   string
+		setenv   map[string]string
+		expected Profiling
+	}{
+		{
+			name:   "default",
+			config: configYaml,
+			expected: Profiling{
+				RequireAuth: true,
+			},
+		},
+		{
+			name:   "without auth",
+			config: configYaml + profilingYaml,
+			expected: Profiling{
+				Enabled: true,
+				Addr:    "127.0.0.1:6060",
+			},
+		},
+		{
+			name:   "with auth",
+			config: configYaml + profilingYaml + "    requireauth: true\n",
+			expected: Profiling{
+				Enabled:     true,
+				RequireAuth: true,
+			},
+		},
+		{
+			name:   "deprecated environment variables",
+			config: configYaml,
+			setenv: map[string]string{
+				"OPENSHIFT_PROFILE":      "web",
+				"OPENSHIFT_PROFILE_PORT": "6061",
+			},
+			expected: Profiling{
+				Enabled: true,
+				Addr:    "127.0.0.1:6061",
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			for name, value := range tc.setenv {
+				os.Setenv(name, value)
+				defer os.Unsetenv(name)
+			}
+			_, cfg, err := Parse(strings.NewReader(tc.config))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*cfg.Profiling, tc.expected) {
+				t.Errorf("got %#v, want %#v", *cfg.Profiling, tc.expected)
+			}
+		})
+	}
+}
+
+func TestP2P(t *testing.T) {
+	configYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+  p2p:
+    enabled: true
+    endpoint: http://127.0.0.1:30020
+`
+	_, cfg, err := Parse(strings.NewReader(configYaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.P2P.Header != defaultP2PHeader {
+		t.Errorf("unexpected value: cfg.P2P.Header: %q", cfg.P2P.Header)
+	}
+
+	badConfigYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+  p2p:
+    enabled: true
+    endpoint: 127.0.0.1:30020
+`
+	if _, _, err := Parse(strings.NewReader(badConfigYaml)); err == nil {
+		t.Fatalf("expected error for relative p2p endpoint")
+	}
+}
+
+func TestCachePersist(t *testing.T) {
+	configYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+  cache:
+    blobrepositoryttl: 10m
+    persist:
+      enabled: true
+`
+	_, cfg, err := Parse(strings.NewReader(configYaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Cache.Persist.Interval != defaultCachePersistInterval {
+		t.Errorf("unexpected value: cfg.Cache.Persist.Interval: %s", cfg.Cache.Persist.Interval)
+	}
+}
+
+func TestCacheTagDigests(t *testing.T) {
+	configYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+  cache:
+    tagdigests:
+      enabled: true
+      previousdigestheader: true
+`
+	_, cfg, err := Parse(strings.NewReader(configYaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := CacheTagDigests{
+		Enabled:              true,
+		PreviousDigestHeader: true,
+	}
+	if !reflect.DeepEqual(cfg.Cache.TagDigests, expected) {
+		t.Errorf("unexpected value: cfg.Cache.TagDigests: %#+v", cfg.Cache.TagDigests)
+	}
+}
+
+func TestCacheWarmup(t *testing.T) {
+	configYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+  cache:
+    warmup:
+      enabled: true
+`
+	_, cfg, err := Parse(strings.NewReader(configYaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.Cache.Warmup.Enabled {
+		t.Errorf("unexpected value: cfg.Cache.Warmup: %#+v", cfg.Cache.Warmup)
+	}
+}
+
+func TestCacheBackend(t *testing.T) {
+	configYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+`
+	_, cfg, err := Parse(strings.NewReader(configYaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Cache.Backend != CacheBackendInMemory {
+		t.Errorf("unexpected value: cfg.Cache.Backend: %q", cfg.Cache.Backend)
+	}
+
+	redisYaml := configYaml + `  cache:
+    backend: redis
+`
+	_, cfg, err = Parse(strings.NewReader(redisYaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Cache.Backend != CacheBackendRedis {
+		t.Errorf("unexpected value: cfg.Cache.Backend: %q", cfg.Cache.Backend)
+	}
+
+	for _, badConfigYaml := range []string{
+		configYaml + `  cache:
+    backend: memcached
+`,
+		redisYaml + `    persist:
+      enabled: true
+`,
+	} {
+		if _, _, err := Parse(strings.NewReader(badConfigYaml)); err == nil {
+			t.Errorf("expected error for configuration:\n%s", badConfigYaml)
+		}
+	}
+}
+
+func TestSignatures(t *testing.T) {
+	configYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+  signatures:
+    verify: true
+    publickeys:
+      release: /etc/registry/signature-keys/release.pub
+    tagconvention: true
+`
+	_, cfg, err := Parse(strings.NewReader(configYaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Signatures.PublicKeys["release"] != "/etc/registry/signature-keys/release.pub" {
+		t.Errorf("unexpected value: cfg.Signatures.PublicKeys: %v", cfg.Signatures.PublicKeys)
+	}
+	if !cfg.Signatures.TagConvention {
+		t.Errorf("unexpected value: cfg.Signatures.TagConvention: %v", cfg.Signatures.TagConvention)
+	}
+
+	badConfigYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+  signatures:
+    verify: true
+`
+	if _, _, err := Parse(strings.NewReader(badConfigYaml)); err == nil {
+		t.Fatalf("expected error for signature verification without public keys")
+	}
+}
+
+func TestAliases(t *testing.T) {
+	configYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+  aliases:
+    defaultnamespace: shared
+    configmap: openshift-image-registry/repository-aliases
+`
+	_, cfg, err := Parse(strings.NewReader(configYaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Aliases.DefaultNamespace != "shared" {
+		t.Errorf("unexpected value: cfg.Aliases.DefaultNamespace: %q", cfg.Aliases.DefaultNamespace)
+	}
+	if cfg.Aliases.ConfigMap != "openshift-image-registry/repository-aliases" {
+		t.Errorf("unexpected value: cfg.Aliases.ConfigMap: %q", cfg.Aliases.ConfigMap)
+	}
+
+	for _, aliases := range []string{
+		"defaultnamespace: Shared_Namespace",
+		"configmap: repository-aliases",
+	} {
+		badConfigYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+  aliases:
+    ` + aliases + `
+`
+		if _, _, err := Parse(strings.NewReader(badConfigYaml)); err == nil {
+			t.Errorf("%s: expected an error", aliases)
+		}
+	}
+}
+
+func TestManifestVerification(t *testing.T) {
+	configYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+  manifestverification:
+    interval: 1h
+`
+	_, cfg, err := Parse(strings.NewReader(configYaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ManifestVerification.Interval != time.Hour {
+		t.Errorf("unexpected value: cfg.ManifestVerification.Interval: %s", cfg.ManifestVerification.Interval)
+	}
+	if cfg.ManifestVerification.SampleSize != defaultManifestVerificationSampleSize {
+		t.Errorf("unexpected value: cfg.ManifestVerification.SampleSize: %d", cfg.ManifestVerification.SampleSize)
+	}
+
+	for _, verification := range []string{
+		"interval: -1h",
+		"samplesize: -1",
+	} {
+		badConfigYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+  manifestverification:
+    ` + verification + `
+`
+		if _, _, err := Parse(strings.NewReader(badConfigYaml)); err == nil {
+			t.Errorf("%s: expected an error", verification)
+		}
+	}
+}
+
+func TestCoordination(t *testing.T) {
+	configYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+  coordination:
+    enabled: true
+    namespace: openshift-image-registry
+`
+	_, cfg, err := Parse(strings.NewReader(configYaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.Coordination.Enabled {
+		t.Errorf("unexpected value: cfg.Coordination.Enabled: %t", cfg.Coordination.Enabled)
+	}
+	if cfg.Coordination.Namespace != "openshift-image-registry" {
+		t.Errorf("unexpected value: cfg.Coordination.Namespace: %s", cfg.Coordination.Namespace)
+	}
+	if cfg.Coordination.LeaseDuration != defaultCoordinationLeaseDuration {
+		t.Errorf("unexpected value: cfg.Coordination.LeaseDuration: %s", cfg.Coordination.LeaseDuration)
+	}
+	if cfg.Coordination.RenewDeadline != defaultCoordinationRenewDeadline {
+		t.Errorf("unexpected value: cfg.Coordination.RenewDeadline: %s", cfg.Coordination.RenewDeadline)
+	}
+	if cfg.Coordination.RetryPeriod != defaultCoordinationRetryPeriod {
+		t.Errorf("unexpected value: cfg.Coordination.RetryPeriod: %s", cfg.Coordination.RetryPeriod)
+	}
+
+	for _, coordination := range []string{
+		"retryperiod: -1s",
+		"renewdeadline: 2s",
+		"leaseduration: 10s",
+	} {
+		badConfigYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+  coordination:
+    ` + coordination + `
+`
+		if _, _, err := Parse(strings.NewReader(badConfigYaml)); err == nil {
+			t.Errorf("%s: expected an error", coordination)
+		}
+	}
+}
+
+func TestTrash(t *testing.T) {
+	configYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+  trash:
+    enabled: true
+    retention: 72h
+`
+	_, cfg, err := Parse(strings.NewReader(configYaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.Trash.Enabled {
+		t.Errorf("unexpected value: cfg.Trash.Enabled: %t", cfg.Trash.Enabled)
+	}
+	if cfg.Trash.Retention != 72*time.Hour {
+		t.Errorf("unexpected value: cfg.Trash.Retention: %s", cfg.Trash.Retention)
+	}
+	if cfg.Trash.PurgeInterval != defaultTrashPurgeInterval {
+		t.Errorf("unexpected value: cfg.Trash.PurgeInterval: %s", cfg.Trash.PurgeInterval)
+	}
+
+	for _, trash := range []string{
+		"retention: -1h",
+		"purgeinterval: -1m",
+	} {
+		badConfigYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+  trash:
+    ` + trash + `
+`
+		if _, _, err := Parse(strings.NewReader(badConfigYaml)); err == nil {
+			t.Errorf("%s: expected an error", trash)
+		}
+	}
+}
+
+func TestRefreshTokenLifetime(t *testing.T) {
+	configYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+`
+	_, cfg, err := Parse(strings.NewReader(configYaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Auth.RefreshTokenLifetime != defaultRefreshTokenLifetime {
+		t.Errorf("unexpected value: cfg.Auth.RefreshTokenLifetime: %s", cfg.Auth.RefreshTokenLifetime)
+	}
+
+	badConfigYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+  auth:
+    refreshtokenlifetime: -1h
+`
+	if _, _, err := Parse(strings.NewReader(badConfigYaml)); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	configYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+  encryption:
+    enabled: true
+    keysdir: /etc/registry/encryption
+    primarykey: key-1
+`
+	_, cfg, err := Parse(strings.NewReader(configYaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.Encryption.Enabled {
+		t.Errorf("unexpected value: cfg.Encryption.Enabled: %t", cfg.Encryption.Enabled)
+	}
+	if cfg.Encryption.KeysDir != "/etc/registry/encryption" {
+		t.Errorf("unexpected value: cfg.Encryption.KeysDir: %s", cfg.Encryption.KeysDir)
+	}
+	if cfg.Encryption.PrimaryKey != "key-1" {
+		t.Errorf("unexpected value: cfg.Encryption.PrimaryKey: %s", cfg.Encryption.PrimaryKey)
+	}
+
+	for _, encryption := range []string{
+		"keysdir: /etc/registry/encryption",
+		"primarykey: key-1",
+	} {
+		badConfigYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+  encryption:
+    enabled: true
+    ` + encryption + `
+`
+		if _, _, err := Parse(strings.NewReader(badConfigYaml)); err == nil {
+			t.Errorf("%s: expected an error", encryption)
+		}
+	}
+}
+
+func TestPruning(t *testing.T) {
+	configYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+  coordination:
+    enabled: true
+  pruning:
+    highwatermark: 90%
+    lowwatermark: 75%
+    interval: 10m
+`
+	_, cfg, err := Parse(strings.NewReader(configYaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Pruning.HighWatermark != "90%" {
+		t.Errorf("unexpected value: cfg.Pruning.HighWatermark: %s", cfg.Pruning.HighWatermark)
+	}
+	if cfg.Pruning.LowWatermark != "75%" {
+		t.Errorf("unexpected value: cfg.Pruning.LowWatermark: %s", cfg.Pruning.LowWatermark)
+	}
+	if cfg.Pruning.Interval != 10*time.Minute {
+		t.Errorf("unexpected value: cfg.Pruning.Interval: %s", cfg.Pruning.Interval)
+	}
+	if cfg.Pruning.MinBlobAge != defaultPruningMinBlobAge {
+		t.Errorf("unexpected value: cfg.Pruning.MinBlobAge: %s", cfg.Pruning.MinBlobAge)
+	}
+
+	for _, pruning := range []string{
+		"{highwatermark: 90%}",
+		"{lowwatermark: 75%}",
+		"{highwatermark: 90%, lowwatermark: 90%}",
+		"{highwatermark: 100Gi, lowwatermark: 200Gi}",
+		"{highwatermark: 100Gi, lowwatermark: 50%}",
+		"{highwatermark: 101%, lowwatermark: 50%}",
+		"{highwatermark: 0, lowwatermark: 0}",
+		"{highwatermark: lots, lowwatermark: 1Gi}",
+		"{interval: -1m}",
+		"{minblobage: -1h}",
+	} {
+		badConfigYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+  coordination:
+    enabled: true
+  pruning: ` + pruning + `
+`
+		if _, _, err := Parse(strings.NewReader(badConfigYaml)); err == nil {
+			t.Errorf("%s: expected an error", pruning)
+		}
+	}
+
+	uncoordinatedConfigYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+  pruning:
+    highwatermark: 90%
+    lowwatermark: 75%
+`
+	if _, _, err := Parse(strings.NewReader(uncoordinatedConfigYaml)); err == nil || !strings.Contains(err.Error(), "openshift.coordination.enabled") {
+		t.Errorf("got %v for the pruning without the coordination, want an error", err)
+	}
+}
+
+func TestParseWatermark(t *testing.T) {
+	for _, tc := range []struct {
+		value    string
+		expected Watermark
+		size     int64
+	}{
+		{value: "1000", expected: Watermark{Bytes: 1000}, size: 1000},
+		{value: "500Gi", expected: Watermark{Bytes: 500 << 30}, size: 500 << 30},
+		{value: "1T", expected: Watermark{Bytes: 1e12}, size: 1e12},
+		{value: "90%", expected: Watermark{Percent: 90}, size: 900},
+		{value: "12.5%", expected: Watermark{Percent: 12.5}, size: 125},
+	} {
+		w, err := ParseWatermark(tc.value)
+		if err != nil {
+			t.Errorf("%s: %v", tc.value, err)
+			continue
+		}
+		if w != tc.expected {
+			t.Errorf("%s: got %+v, want %+v", tc.value, w, tc.expected)
+		}
+		if size := w.Size(1000); size != tc.size {
+			t.Errorf("%s: got size %d, want %d", tc.value, size, tc.size)
+		}
+	}
+}
+
+func TestDefaultConfiguration(t *testing.T) {
+	testCases := []struct {
+		name     string
+		setenv   map[string]string
+		expected string
+		params   configuration.Parameters
+		err      bool
+	}{
+		{
+			name:     "filesystem by default",
+			expected: "filesystem",
+			params:   configuration.Parameters{"rootdirectory": "/registry"},
+		},
+		{
+			name: "inmemory",
+			setenv: map[string]string{
+				DefaultStorageEnvVar: "inmemory",
+			},
+			expected: "inmemory",
+			params:   configuration.Parameters{},
+		},
+		{
+			name: "filesystem with root directory from environment",
+			setenv: map[string]string{
+				DefaultStorageEnvVar:                        "filesystem",
+				"REGISTRY_STORAGE_FILESYSTEM_ROOTDIRECTORY": "/tmp/registry",
+			},
+			expected: "filesystem",
+			params:   configuration.Parameters{"rootdirectory": "/tmp/registry"},
+		},
+		{
+			name: "unsupported driver",
+			setenv: map[string]string{
+				DefaultStorageEnvVar: "s3",
+			},
+			err: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			os.Setenv("REGISTRY_OPENSHIFT_SERVER_ADDR", ":5000")
+			defer os.Unsetenv("REGISTRY_OPENSHIFT_SERVER_ADDR")
+			for name, value := range tc.setenv {
+				os.Setenv(name, value)
+				defer os.Unsetenv(name)
+			}
+
+			configFile, err := DefaultConfiguration()
+			if tc.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := os.LookupEnv(DefaultStorageEnvVar); ok {
+				t.Errorf("expected %s to be unset", DefaultStorageEnvVar)
+			}
+
+			dockerConfig, cfg, err := Parse(configFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if storageType := dockerConfig.Storage.Type(); storageType != tc.expected {
+				t.Errorf("unexpected storage type: %s", storageType)
+			}
+			if params := dockerConfig.Storage.Parameters(); !reflect.DeepEqual(params, tc.params) {
+				t.Errorf("unexpected storage parameters: %#v", params)
+			}
+			if _, ok := dockerConfig.Auth[middlewareName]; !ok {
+				t.Errorf("expected the openshift auth, got %#v", dockerConfig.Auth)
+			}
+			for _, middlewareType := range []string{"registry", "repository", "storage"} {
+				if m := dockerConfig.Middleware[middlewareType]; len(m) != 1 || m[0].Name != middlewareName {
+					t.Errorf("unexpected %s middleware: %#v", middlewareType, m)
+				}
+			}
+			if cfg.Server.Addr != ":5000" {
+				t.Errorf("unexpected value: cfg.Server.Addr: %s", cfg.Server.Addr)
+			}
+		})
+	}
+}
+
+func TestWriteRetries(t *testing.T) {
+	configYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+  writeretries:
+    attempts: 6
+    initialbackoff: 1s
+`
+	_, cfg, err := Parse(strings.NewReader(configYaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := WriteRetries{
+		Attempts:       6,
+		InitialBackoff: time.Second,
+		MaxBackoff:     defaultWriteRetriesMaxBackoff,
+	}
+	if !reflect.DeepEqual(*cfg.WriteRetries, expected) {
+		t.Errorf("got %#v, want %#v", *cfg.WriteRetries, expected)
+	}
+
+	for _, writeRetries := range []string{
+		"{attempts: -1}",
+		"{initialbackoff: -1s}",
+		"{maxbackoff: -1s}",
+		"{initialbackoff: 10s, maxbackoff: 1s}",
+	} {
+		badConfigYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+  writeretries: ` + writeRetries + `
+`
+		if _, _, err := Parse(strings.NewReader(badConfigYaml)); err == nil {
+			t.Errorf("%s: expected an error", writeRetries)
+		}
+	}
+}
+
+func TestDegradedMode(t *testing.T) {
+	configYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+  degradedmode:
+    enabled: true
+`
+	_, cfg, err := Parse(strings.NewReader(configYaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := DegradedMode{
+		Enabled:      true,
+		AuthCacheTTL: defaultDegradedModeAuthCacheTTL,
+	}
+	if !reflect.DeepEqual(*cfg.DegradedMode, expected) {
+		t.Errorf("got %#v, want %#v", *cfg.DegradedMode, expected)
+	}
+
+	badConfigYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+  degradedmode:
+    enabled: true
+    authcachettl: -1m
+`
+	if _, _, err := Parse(strings.NewReader(badConfigYaml)); err == nil {
+		t.Error("expected an error for a negative authcachettl")
+	}
+}
+
+func TestImageService(t *testing.T) {
+	configYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+  imageservice:
+    enabled: true
+    addr: unix:///var/run/image-registry/grpc.sock
+`
+	_, cfg, err := Parse(strings.NewReader(configYaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := ImageService{
+		Enabled: true,
+		Addr:    "unix:///var/run/image-registry/grpc.sock",
+	}
+	if !reflect.DeepEqual(*cfg.ImageService, expected) {
+		t.Errorf("got %#v, want %#v", *cfg.ImageService, expected)
+	}
+
+	for _, addr := range []string{"", `"unix://grpc.sock"`, `"localhost:5001"`} {
+		badConfigYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+  imageservice:
+    enabled: true
+    addr: ` + addr + `
+`
+		if _, _, err := Parse(strings.NewReader(badConfigYaml)); err == nil {
+			t.Errorf("expected an error for the address %s", addr)
+		}
+	}
+}
+
+func TestTrafficRecording(t *testing.T) {
+	configYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+  trafficrecording:
+    enabled: true
+    path: /tmp/traffic.json
+`
+	_, cfg, err := Parse(strings.NewReader(configYaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.TrafficRecording.SampleRate != defaultTrafficRecordingSampleRate {
+		t.Errorf("unexpected value: cfg.TrafficRecording.SampleRate: %v", cfg.TrafficRecording.SampleRate)
+	}
+	if cfg.TrafficRecording.MaxBytes != defaultTrafficRecordingMaxBytes {
+		t.Errorf("unexpected value: cfg.TrafficRecording.MaxBytes: %v", cfg.TrafficRecording.MaxBytes)
+	}
+
+	for _, badConfigYaml := range []string{
+		strings.Replace(configYaml, "    path: /tmp/traffic.json\n", "", 1),
+		configYaml + "    samplerate: 1.5\n",
+		configYaml + "    maxbytes: -1\n",
+	} {
+		if _, _, err := Parse(strings.NewReader(badConfigYaml)); err == nil {
+			t.Errorf("expected error for configuration:\n%s", badConfigYaml)
+		}
+	}
+}
+
+func TestTagPropagation(t *testing.T) {
+	configYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+  tagpropagation:
+    peers:
+`
+	goodConfigYaml := configYaml + `    - url: https://registry.spoke.example.com/tags
+      secretfile: /etc/secrets/spoke
+`
+	_, cfg, err := Parse(strings.NewReader(goodConfigYaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []TagPropagationPeer{
+		{URL: "https://registry.spoke.example.com/tags", SecretFile: "/etc/secrets/spoke"},
+	}
+	if !reflect.DeepEqual(cfg.TagPropagation.Peers, expected) {
+		t.Errorf("unexpected value: cfg.TagPropagation.Peers: %#+v", cfg.TagPropagation.Peers)
+	}
+
+	for _, badConfigYaml := range []string{
+		configYaml + `    - url: registry.spoke.example.com/tags
+      secretfile: /etc/secrets/spoke
+`,
+		configYaml + `    - url: https://registry.spoke.example.com/tags
+`,
+	} {
+		if _, _, err := Parse(strings.NewReader(badConfigYaml)); err == nil {
+			t.Errorf("expected error for configuration:\n%s", badConfigYaml)
+		}
+	}
+}
+
+func TestSecurity(t *testing.T) {
+	configYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+  security:
+    maxdecompressionratio: 50
+`
+	_, cfg, err := Parse(strings.NewReader(configYaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Security.MaxDecompressionRatio != 50 {
+		t.Errorf("unexpected value: cfg.Security.MaxDecompressionRatio: %v", cfg.Security.MaxDecompressionRatio)
+	}
+	if cfg.Security.MaxFiles != defaultMaxDecompressedFiles {
+		t.Errorf("unexpected value: cfg.Security.MaxFiles: %v", cfg.Security.MaxFiles)
+	}
+
+	for _, badConfigYaml := range []string{
+		strings.Replace(configYaml, "maxdecompressionratio: 50", "maxdecompressionratio: 0.5", 1),
+		strings.Replace(configYaml, "maxdecompressionratio: 50", "maxdecompressionratio: -1", 1),
+		configYaml + "    maxfiles: -1\n",
+		strings.Replace(configYaml, "maxdecompressionratio: 50", "checkuploads: true", 1),
+	} {
+		if _, _, err := Parse(strings.NewReader(badConfigYaml)); err == nil {
+			t.Errorf("expected error for configuration:\n%s", badConfigYaml)
+		}
+	}
+}
+
+func TestContentTrust(t *testing.T) {
+	configYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+  contenttrust:
+    notaryurl: https://notary.example.com
+`
+	_, cfg, err := Parse(strings.NewReader(configYaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ContentTrust.NotaryURL != "https://notary.example.com" {
+		t.Errorf("unexpected value: cfg.ContentTrust.NotaryURL: %q", cfg.ContentTrust.NotaryURL)
+	}
+
+	for _, badConfigYaml := range []string{
+		strings.Replace(configYaml, "https://notary.example.com", "notary.example.com", 1),
+		strings.Replace(configYaml, "https://notary.example.com", "ftp://notary.example.com", 1),
+	} {
+		if _, _, err := Parse(strings.NewReader(badConfigYaml)); err == nil {
+			t.Errorf("expected error for configuration:\n%s", badConfigYaml)
+		}
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	configYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+  accesslog:
+    format: json
+    path: /var/log/image-registry/access.log
+`
+	_, cfg, err := Parse(strings.NewReader(configYaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.AccessLog.Format != "json" {
+		t.Errorf("unexpected value: cfg.AccessLog.Format: %q", cfg.AccessLog.Format)
+	}
+	if cfg.AccessLog.Path != "/var/log/image-registry/access.log" {
+		t.Errorf("unexpected value: cfg.AccessLog.Path: %q", cfg.AccessLog.Path)
+	}
+
+	for _, badConfigYaml := range []string{
+		strings.Replace(configYaml, "format: json", "format: common", 1),
+		strings.Replace(configYaml, "format: json", "format: \"\"", 1),
+	} {
+		if _, _, err := Parse(strings.NewReader(badConfigYaml)); err == nil {
+			t.Errorf("expected error for configuration:\n%s", badConfigYaml)
+		}
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	configYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+  diagnostics:
+    enabled: true
+`
+	_, cfg, err := Parse(strings.NewReader(configYaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.Diagnostics.Enabled {
+		t.Errorf("unexpected value: cfg.Diagnostics.Enabled: %t", cfg.Diagnostics.Enabled)
+	}
+	if cfg.Diagnostics.LogEntries != defaultDiagnosticsLogEntries {
+		t.Errorf("unexpected value: cfg.Diagnostics.LogEntries: %d", cfg.Diagnostics.LogEntries)
+	}
+
+	badConfigYaml := configYaml + "    logentries: -1\n"
+	if _, _, err := Parse(strings.NewReader(badConfigYaml)); err == nil {
+		t.Errorf("expected error for negative logentries")
+	}
+}
+
+func TestKubeClientTLS(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		tls  string
+		err  bool
+	}{
+		{
+			name: "defaults",
+		},
+		{
+			name: "all settings",
+			tls: `
+      cafile: /etc/registry/apiserver/ca.crt
+      certfile: /etc/registry/apiserver/tls.crt
+      keyfile: /etc/registry/apiserver/tls.key
+      minversion: VersionTLS13`,
+		},
+		{
+			name: "certificate without a key",
+			tls: `
+      certfile: /etc/registry/apiserver/tls.crt`,
+			err: true,
+		},
+		{
+			name: "unknown version",
+			tls: `
+      minversion: TLS1.3`,
+			err: true,
+		},
+	} {
+		configYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+`
+		if tc.tls != "" {
+			configYaml += `  kubeclient:
+    tls:` + tc.tls + "\n"
+		}
+		_, cfg, err := Parse(strings.NewReader(configYaml))
+		if tc.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if cfg.KubeClient == nil {
+			t.Errorf("%s: the kubeclient section is not initialized", tc.name)
+		}
+	}
+}
+
+func TestKubeClientReconnect(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		reconnect string
+		expected  KubeClientReconnect
+		err       bool
+	}{
+		{
+			name: "defaults",
+			expected: KubeClientReconnect{
+				Failures:       defaultKubeClientReconnectFailures,
+				InitialBackoff: defaultKubeClientReconnectInitialBackoff,
+				MaxBackoff:     defaultKubeClientReconnectMaxBackoff,
+			},
+		},
+		{
+			name: "all settings",
+			reconnect: `
+      enabled: true
+      failures: 5
+      initialbackoff: 10s
+      maxbackoff: 1m`,
+			expected: KubeClientReconnect{
+				Enabled:        true,
+				Failures:       5,
+				InitialBackoff: 10 * time.Second,
+				MaxBackoff:     time.Minute,
+			},
+		},
+		{
+			name: "negative failures",
+			reconnect: `
+      failures: -1`,
+			err: true,
+		},
+		{
+			name: "negative backoff",
+			reconnect: `
+      initialbackoff: -1s`,
+			err: true,
+		},
+		{
+			name: "maximum backoff less than the initial one",
+			reconnect: `
+      initialbackoff: 10m`,
+			err: true,
+		},
+	} {
+		configYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+`
+		if tc.reconnect != "" {
+			configYaml += `  kubeclient:
+    reconnect:` + tc.reconnect + "\n"
+		}
+		_, cfg, err := Parse(strings.NewReader(configYaml))
+		if tc.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if cfg.KubeClient.Reconnect != tc.expected {
+			t.Errorf("%s: got %+v, want %+v", tc.name, cfg.KubeClient.Reconnect, tc.expected)
+		}
+	}
+}
+
+func TestSpool(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		spool string
+		err   bool
+	}{
+		{
+			name: "defaults",
+		},
+		{
+			name: "enabled",
+			spool: `
+    enabled: true
+    directory: /spool
+    maxsize: 20Gi
+    moveinterval: 1m`,
+		},
+		{
+			name: "no directory",
+			spool: `
+    enabled: true
+    maxsize: 20Gi`,
+			err: true,
+		},
+		{
+			name: "no maximum size",
+			spool: `
+    enabled: true
+    directory: /spool`,
+			err: true,
+		},
+		{
+			name: "percentage",
+			spool: `
+    enabled: true
+    directory: /spool
+    maxsize: 50%`,
+			err: true,
+		},
+		{
+			name: "negative interval",
+			spool: `
+    moveinterval: -1s`,
+			err: true,
+		},
+	} {
+		configYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: "localhost:5000"
+`
+		if tc.spool != "" {
+			configYaml += "  spool:" + tc.spool + "\n"
+		}
+		_, cfg, err := Parse(strings.NewReader(configYaml))
+		if tc.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if cfg.Spool.MoveInterval <= 0 {
+			t.Errorf("%s: got move interval %s, want a positive value", tc.name, cfg.Spool.MoveInterval)
+		}
+	}
+}
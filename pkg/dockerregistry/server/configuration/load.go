@@ -0,0 +1,158 @@
+package configuration
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/distribution/distribution/v3/configuration"
+)
+
+// Config is the configuration of the registry: the configuration of the
+// distribution registry and the openshift specific configuration which are
+// read from the same file.
+type Config struct {
+	Docker    *configuration.Configuration
+	OpenShift *Configuration
+}
+
+// FieldError is returned when a field of the configuration has an invalid
+// value. Field is the path of the field, e.g. openshift.quota.cachettl.
+type FieldError struct {
+	Field string
+	Err   error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("configuration error in %s: %v", e.Field, e.Err)
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+func fieldError(field string, err error) error {
+	return &FieldError{Field: field, Err: err}
+}
+
+func fieldErrorf(field string, format string, args ...interface{}) error {
+	return &FieldError{Field: field, Err: fmt.Errorf(format, args...)}
+}
+
+// environment contains the environment variables that override the
+// configuration.
+type environment map[string]string
+
+// newEnvironment returns the environment of environ, which has the form of
+// os.Environ.
+func newEnvironment(environ []string) environment {
+	env := make(environment, len(environ))
+	for _, kv := range environ {
+		name, value, _ := strings.Cut(kv, "=")
+		env[name] = value
+	}
+	return env
+}
+
+func (env environment) lookup(name string) (string, bool) {
+	value, ok := env[name]
+	return value, ok
+}
+
+func (env environment) get(name string) string {
+	return env[name]
+}
+
+// filter returns the variables whose names are accepted by keep.
+func (env environment) filter(keep func(name string) bool) environment {
+	filtered := make(environment)
+	for name, value := range env {
+		if keep(name) {
+			filtered[name] = value
+		}
+	}
+	return filtered
+}
+
+// Load parses the configuration from rd. The variables of environ, which has
+// the form of os.Environ, override the parameters of the configuration. The
+// environment of the process is not used.
+func Load(rd io.Reader, environ []string) (*Config, error) {
+	in, err := io.ReadAll(rd)
+	if err != nil {
+		return nil, err
+	}
+
+	env := newEnvironment(environ)
+	// We don't want to change the version from the environment variables.
+	delete(env, "REGISTRY_OPENSHIFT_VERSION")
+
+	openshiftEnv := env.filter(func(name string) bool {
+		return strings.HasPrefix(name, "REGISTRY_OPENSHIFT_")
+	})
+	dockerEnv := env.filter(func(name string) bool {
+		return strings.HasPrefix(name, "REGISTRY_") && !strings.HasPrefix(name, "REGISTRY_OPENSHIFT_")
+	})
+
+	dockerConfig, err := parseDockerConfiguration(in, dockerEnv)
+	if err != nil {
+		return nil, err
+	}
+
+	vInfo := &versionInfo{}
+	if err := yaml.Unmarshal(in, &vInfo); err != nil {
+		return nil, err
+	}
+
+	if vInfo.Openshift.Version != nil {
+		if *vInfo.Openshift.Version != CurrentVersion {
+			return nil, ErrUnsupportedVersion
+		}
+	}
+
+	config := openshiftConfig{}
+	p := &envParser{prefix: "registry", env: openshiftEnv}
+	if err := p.parse(in, &config); err != nil {
+		return nil, err
+	}
+
+	if err := initExtraConfig(dockerConfig, &config.Openshift, env); err != nil {
+		return nil, err
+	}
+
+	return &Config{
+		Docker:    dockerConfig,
+		OpenShift: &config.Openshift,
+	}, nil
+}
+
+// Default returns the configuration for running the registry without a
+// configuration file. It is the configuration of DefaultConfiguration with
+// the variables of environ applied.
+func Default(environ []string) (*Config, error) {
+	env := newEnvironment(environ)
+	rd, err := defaultConfigurationFor(env.get(DefaultStorageEnvVar))
+	if err != nil {
+		return nil, err
+	}
+
+	var filtered []string
+	for _, kv := range environ {
+		if !strings.HasPrefix(kv, DefaultStorageEnvVar+"=") {
+			filtered = append(filtered, kv)
+		}
+	}
+	return Load(rd, filtered)
+}
+
+// Validate checks the configuration that was loaded or modified by the
+// caller and sets the defaults of the fields that are not set. The errors
+// about invalid fields are *FieldError.
+func (c *Config) Validate() error {
+	if c.Docker == nil || c.OpenShift == nil {
+		return fmt.Errorf("the configuration is incomplete")
+	}
+	return initExtraConfig(c.Docker, c.OpenShift, nil)
+}
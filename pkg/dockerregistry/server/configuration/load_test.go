@@ -0,0 +1,144 @@
+package configuration
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoad(t *testing.T) {
+	configYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  quota:
+    cachettl: 1m
+`
+	// The environment of the process is ignored.
+	os.Setenv("REGISTRY_OPENSHIFT_QUOTA_CACHETTL", "invalid")
+	defer os.Unsetenv("REGISTRY_OPENSHIFT_QUOTA_CACHETTL")
+	os.Setenv("REGISTRY_LOG_LEVEL", "error")
+	defer os.Unsetenv("REGISTRY_LOG_LEVEL")
+
+	cfg, err := Load(strings.NewReader(configYaml), []string{
+		"REGISTRY_OPENSHIFT_SERVER_ADDR=registry:5000",
+		"REGISTRY_OPENSHIFT_QUOTA_ENABLED=true",
+		"REGISTRY_OPENSHIFT_VERSION=2.0",
+		"REGISTRY_HTTP_ADDR=:5001",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.OpenShift.Server.Addr != "registry:5000" {
+		t.Errorf("unexpected server address: %q", cfg.OpenShift.Server.Addr)
+	}
+	if !cfg.OpenShift.Quota.Enabled || cfg.OpenShift.Quota.CacheTTL != time.Minute {
+		t.Errorf("unexpected quota section: %#+v", cfg.OpenShift.Quota)
+	}
+	if cfg.Docker.HTTP.Addr != ":5001" {
+		t.Errorf("unexpected http address: %q", cfg.Docker.HTTP.Addr)
+	}
+	if cfg.Docker.Log.Level == "error" {
+		t.Errorf("unexpected log level: %q", cfg.Docker.Log.Level)
+	}
+
+	if v := os.Getenv("REGISTRY_OPENSHIFT_QUOTA_CACHETTL"); v != "invalid" {
+		t.Errorf("expected the environment of the process to be unchanged, got %q", v)
+	}
+	if _, ok := os.LookupEnv("REGISTRY_HTTP_ADDR"); ok {
+		t.Error("expected REGISTRY_HTTP_ADDR not to be added to the environment of the process")
+	}
+}
+
+func TestLoadOverridesNestedFields(t *testing.T) {
+	configYaml := `
+version: 0.1
+storage:
+  filesystem:
+    rootdirectory: /registry
+openshift:
+  version: 1.0
+  server:
+    addr: registry:5000
+`
+	cfg, err := Load(strings.NewReader(configYaml), []string{
+		"REGISTRY_STORAGE_FILESYSTEM_ROOTDIRECTORY=/data",
+		"REGISTRY_STORAGE_MAINTENANCE_READONLY={enabled: true}",
+		"REGISTRY_HTTP_HEADERS_X-CONTENT-TYPE-OPTIONS=[nosniff]",
+		"REGISTRY_OPENSHIFT_PULLTHROUGH_MIRROR=false",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir := cfg.Docker.Storage.Parameters()["rootdirectory"]; dir != "/data" {
+		t.Errorf("unexpected root directory: %v", dir)
+	}
+	if readonly, ok := cfg.Docker.Storage["maintenance"]["readonly"].(map[interface{}]interface{}); !ok || readonly["enabled"] != true {
+		t.Errorf("unexpected maintenance section: %#+v", cfg.Docker.Storage["maintenance"])
+	}
+	if headers := cfg.Docker.HTTP.Headers["x-content-type-options"]; len(headers) != 1 || headers[0] != "nosniff" {
+		t.Errorf("unexpected headers: %#+v", cfg.Docker.HTTP.Headers)
+	}
+	if cfg.OpenShift.Pullthrough.Mirror {
+		t.Error("expected the mirroring of the pulled through blobs to be disabled")
+	}
+}
+
+func TestLoadFieldError(t *testing.T) {
+	configYaml := `
+version: 0.1
+storage:
+  inmemory: {}
+openshift:
+  version: 1.0
+  server:
+    addr: registry:5000
+  coordination:
+    enabled: true
+  pruning:
+    highwatermark: 50%
+    lowwatermark: 60%
+`
+	_, err := Load(strings.NewReader(configYaml), nil)
+	var fieldErr *FieldError
+	if !errors.As(err, &fieldErr) {
+		t.Fatalf("expected a field error, got %v", err)
+	}
+	if fieldErr.Field != "openshift.pruning.lowwatermark" {
+		t.Errorf("unexpected field: %q", fieldErr.Field)
+	}
+	if !strings.HasPrefix(err.Error(), "configuration error in openshift.pruning.lowwatermark: ") {
+		t.Errorf("unexpected error message: %q", err.Error())
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	cfg, err := Default([]string{
+		"REGISTRY_DEFAULT_STORAGE=inmemory",
+		"REGISTRY_OPENSHIFT_SERVER_ADDR=registry:5000",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if storageType := cfg.Docker.Storage.Type(); storageType != "inmemory" {
+		t.Errorf("unexpected storage type: %s", storageType)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	cfg.OpenShift.Auth.RefreshTokenLifetime = -time.Second
+	err = cfg.Validate()
+	var fieldErr *FieldError
+	if !errors.As(err, &fieldErr) || fieldErr.Field != "openshift.auth.refreshtokenlifetime" {
+		t.Fatalf("expected an error in openshift.auth.refreshtokenlifetime, got %v", err)
+	}
+
+	if _, err := Default([]string{"REGISTRY_DEFAULT_STORAGE=s3"}); err == nil {
+		t.Fatal("expected an error for an unsupported storage driver")
+	}
+}
@@ -0,0 +1,199 @@
+package configuration
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+
+	"github.com/distribution/distribution/v3/configuration"
+)
+
+// The parser of the distribution registry reads the overrides only from the
+// environment of the process. envParser applies the overrides the same way,
+// but it takes them from an environment, so that the configurations can be
+// loaded without changing the environment of the process.
+
+// envParser parses a configuration and overrides its fields by the variables
+// of env that start with prefix.
+type envParser struct {
+	prefix string
+	env    environment
+}
+
+// parseDockerConfiguration is equivalent to configuration.Parse with the
+// variables of env instead of the environment of the process.
+func parseDockerConfiguration(in []byte, env environment) (*configuration.Configuration, error) {
+	var versioned struct {
+		Version configuration.Version
+	}
+	if err := yaml.Unmarshal(in, &versioned); err != nil {
+		return nil, err
+	}
+	if versioned.Version != configuration.MajorMinorVersion(0, 1) {
+		return nil, fmt.Errorf("unsupported version: %q", versioned.Version)
+	}
+
+	config := new(configuration.Configuration)
+	p := &envParser{prefix: "registry", env: env}
+	if err := p.parse(in, config); err != nil {
+		return nil, err
+	}
+
+	if config.Log.Level == configuration.Loglevel("") {
+		if config.Loglevel != configuration.Loglevel("") {
+			config.Log.Level = config.Loglevel
+		} else {
+			config.Log.Level = configuration.Loglevel("info")
+		}
+	}
+	if config.Loglevel != configuration.Loglevel("") {
+		config.Loglevel = configuration.Loglevel("")
+	}
+	if config.Catalog.MaxEntries <= 0 {
+		config.Catalog.MaxEntries = 1000
+	}
+	if config.Storage.Type() == "" {
+		return nil, errors.New("no storage configuration provided")
+	}
+	return config, nil
+}
+
+// parse unmarshals in into v and overrides the fields of v by the variables
+// of the environment: v.Abc is replaced by the value of PREFIX_ABC, v.Abc.Xyz
+// is replaced by the value of PREFIX_ABC_XYZ, and so forth.
+func (p *envParser) parse(in []byte, v interface{}) error {
+	if err := yaml.Unmarshal(in, v); err != nil {
+		return err
+	}
+
+	// The variables are applied in the lexical order, so that the more
+	// specific variables are applied after the less specific ones (i.e.
+	// REGISTRY_STORAGE before REGISTRY_STORAGE_FILESYSTEM_ROOTDIRECTORY).
+	names := make([]string, 0, len(p.env))
+	for name := range p.env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if !strings.HasPrefix(name, strings.ToUpper(p.prefix)+"_") {
+			continue
+		}
+		path := strings.Split(name, "_")
+		if err := p.overwriteFields(reflect.ValueOf(v), name, path[1:], p.env[name]); err != nil {
+			return fmt.Errorf("parsing environment variable %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// overwriteFields replaces the value at path in v by payload. path must not
+// be empty.
+func (p *envParser) overwriteFields(v reflect.Value, fullpath string, path []string, payload string) error {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return fmt.Errorf("encountered nil pointer while handling environment variable %s", fullpath)
+		}
+		v = reflect.Indirect(v)
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		return p.overwriteStruct(v, fullpath, path, payload)
+	case reflect.Map:
+		return p.overwriteMap(v, fullpath, path, payload)
+	case reflect.Interface:
+		if v.NumMethod() == 0 {
+			if !v.IsNil() {
+				return p.overwriteFields(v.Elem(), fullpath, path, payload)
+			}
+			// The interface is empty, it becomes a map.
+			wrapped := reflect.MakeMap(reflect.TypeOf(map[string]interface{}{}))
+			v.Set(wrapped)
+			return p.overwriteMap(wrapped, fullpath, path, payload)
+		}
+	}
+	return nil
+}
+
+func (p *envParser) overwriteStruct(v reflect.Value, fullpath string, path []string, payload string) error {
+	fieldIndex := -1
+	for i := 0; i < v.NumField(); i++ {
+		if strings.ToUpper(v.Type().Field(i).Name) == path[0] {
+			fieldIndex = i
+			break
+		}
+	}
+	if fieldIndex < 0 {
+		log.Warnf("Ignoring unrecognized environment variable %s", fullpath)
+		return nil
+	}
+	field := v.Field(fieldIndex)
+	sf := v.Type().Field(fieldIndex)
+
+	if len(path) == 1 {
+		// The variable sets the field.
+		fieldVal := reflect.New(sf.Type)
+		if err := yaml.Unmarshal([]byte(payload), fieldVal.Interface()); err != nil {
+			return err
+		}
+		field.Set(reflect.Indirect(fieldVal))
+		return nil
+	}
+
+	switch sf.Type.Kind() {
+	case reflect.Map:
+		if field.IsNil() {
+			field.Set(reflect.MakeMap(sf.Type))
+		}
+	case reflect.Ptr:
+		if field.IsNil() {
+			field.Set(reflect.New(field.Type().Elem()))
+		}
+	}
+	return p.overwriteFields(field, fullpath, path[1:], payload)
+}
+
+func (p *envParser) overwriteMap(m reflect.Value, fullpath string, path []string, payload string) error {
+	if m.Type().Key().Kind() != reflect.String {
+		log.Warnf("Ignoring environment variable %s involving map with non-string keys", fullpath)
+		return nil
+	}
+
+	if len(path) > 1 {
+		// The existing value is modified unless it's nil.
+		for _, k := range m.MapKeys() {
+			if strings.ToUpper(k.String()) != path[0] {
+				continue
+			}
+			mapValue := m.MapIndex(k)
+			if (mapValue.Kind() == reflect.Ptr || mapValue.Kind() == reflect.Interface || mapValue.Kind() == reflect.Map) && mapValue.IsNil() {
+				break
+			}
+			return p.overwriteFields(mapValue, fullpath, path[1:], payload)
+		}
+	}
+
+	var mapValue reflect.Value
+	if m.Type().Elem().Kind() == reflect.Map {
+		mapValue = reflect.MakeMap(m.Type().Elem())
+	} else {
+		mapValue = reflect.New(m.Type().Elem())
+	}
+	if len(path) > 1 {
+		if err := p.overwriteFields(mapValue, fullpath, path[1:], payload); err != nil {
+			return err
+		}
+	} else {
+		if err := yaml.Unmarshal([]byte(payload), mapValue.Interface()); err != nil {
+			return err
+		}
+	}
+
+	m.SetMapIndex(reflect.ValueOf(strings.ToLower(path[0])), reflect.Indirect(mapValue))
+	return nil
+}
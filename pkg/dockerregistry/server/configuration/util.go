@@ -2,7 +2,6 @@ package configuration
 
 import (
 	"fmt"
-	"os"
 	"strings"
 	"time"
 )
@@ -46,6 +45,7 @@ func convertDuration(value interface{}, defval interface{}) (d interface{}, err
 }
 
 func getOptionValue(
+	env environment,
 	envVar string,
 	optionName string,
 	defval interface{},
@@ -65,7 +65,7 @@ func getOptionValue(
 	if len(envVar) == 0 {
 		return
 	}
-	envValue := os.Getenv(envVar)
+	envValue := env.get(envVar)
 	if len(envValue) == 0 {
 		return
 	}
@@ -80,17 +80,17 @@ func getOptionValue(
 	return
 }
 
-func getBoolOption(envVar string, optionName string, defval bool, options map[string]interface{}) (bool, error) {
-	value, err := getOptionValue(envVar, optionName, defval, options, convertBool)
+func getBoolOption(env environment, envVar string, optionName string, defval bool, options map[string]interface{}) (bool, error) {
+	value, err := getOptionValue(env, envVar, optionName, defval, options, convertBool)
 	return value.(bool), err
 }
 
-func getStringOption(envVar string, optionName string, defval string, options map[string]interface{}) (string, error) {
-	value, err := getOptionValue(envVar, optionName, defval, options, convertString)
+func getStringOption(env environment, envVar string, optionName string, defval string, options map[string]interface{}) (string, error) {
+	value, err := getOptionValue(env, envVar, optionName, defval, options, convertString)
 	return value.(string), err
 }
 
-func getDurationOption(envVar string, optionName string, defval time.Duration, options map[string]interface{}) (time.Duration, error) {
-	value, err := getOptionValue(envVar, optionName, defval, options, convertDuration)
+func getDurationOption(env environment, envVar string, optionName string, defval time.Duration, options map[string]interface{}) (time.Duration, error) {
+	value, err := getOptionValue(env, envVar, optionName, defval, options, convertDuration)
 	return value.(time.Duration), err
 }
@@ -116,7 +116,7 @@ func TestGetBoolOption(t *testing.T) {
 		for key, value := range tc.exportEnv {
 			os.Setenv(key, value)
 		}
-		d, err := getBoolOption(tc.envName, tc.option, tc.defaultValue, tc.options)
+		d, err := getBoolOption(newEnvironment(os.Environ()), tc.envName, tc.option, tc.defaultValue, tc.options)
 		if err == nil && tc.expectedError {
 			t.Errorf("[%s] unexpected non-error", tc.name)
 		} else if err != nil && !tc.expectedError {
@@ -223,7 +223,7 @@ func TestGetDurationOption(t *testing.T) {
 		for key, value := range tc.exportEnv {
 			os.Setenv(key, value)
 		}
-		d, err := getDurationOption(tc.envName, tc.option, tc.defaultValue, tc.options)
+		d, err := getDurationOption(newEnvironment(os.Environ()), tc.envName, tc.option, tc.defaultValue, tc.options)
 		if err == nil && tc.expectedError {
 			t.Errorf("[%s] unexpected non-error", tc.name)
 		} else if err != nil && !tc.expectedError {
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/configuration"
+)
+
+// contentTrustDocsURL is the documentation of the Docker content trust that
+// the clients are pointed to when the registry doesn't pass the requests
+// through to a Notary server.
+const contentTrustDocsURL = "https://docs.docker.com/engine/security/trust/"
+
+// notaryResponseHeaderTimeout limits the time to wait for the response of the
+// Notary server, so that the clients don't hang if it doesn't answer.
+const notaryResponseHeaderTimeout = 30 * time.Second
+
+var ErrorCodeContentTrustUnsupported = errcode.Register(errGroup, errcode.ErrorDescriptor{
+	Value:          "CONTENT_TRUST_UNSUPPORTED",
+	Message:        "the registry doesn't serve Docker content trust metadata, unset DOCKER_CONTENT_TRUST or set DOCKER_CONTENT_TRUST_SERVER to a Notary server",
+	HTTPStatusCode: http.StatusNotImplemented,
+})
+
+// contentTrustHandler handles the requests of the Notary v1 API,
+// /v2/<gun>/_trust/..., that Docker clients with DOCKER_CONTENT_TRUST=1 send
+// if DOCKER_CONTENT_TRUST_SERVER points to the registry. The requests are
+// passed through to the configured Notary server, which authenticates them
+// on its own, or rejected with an error that tells what to change. Without
+// it the distribution application answers them with NAME_UNKNOWN.
+type contentTrustHandler struct {
+	prefix  string
+	proxy   http.Handler
+	handler http.Handler
+}
+
+func newContentTrustHandler(prefix string, handler http.Handler, cfg *configuration.ContentTrust) (http.Handler, error) {
+	h := &contentTrustHandler{
+		prefix:  strings.TrimSuffix(prefix, "/"),
+		handler: handler,
+	}
+	if cfg == nil || len(cfg.NotaryURL) == 0 {
+		return h, nil
+	}
+
+	target, err := url.Parse(cfg.NotaryURL)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = notaryResponseHeaderTimeout
+	h.proxy = &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			// The Notary server serves the API without the prefix of
+			// the registry.
+			pr.Out.URL.Path = strings.TrimPrefix(pr.Out.URL.Path, h.prefix)
+			pr.Out.URL.RawPath = ""
+			pr.SetURL(target)
+			pr.SetXForwarded()
+		},
+		Transport: transport,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			ctx := dcontext.WithRequest(r.Context(), r)
+			dcontext.GetLogger(ctx).Errorf("unable to pass the content trust request %s through to the Notary server %s: %v", r.URL.Path, target.Host, err)
+			if err := errcode.ServeJSON(w, errcode.ErrorCodeUnavailable.WithDetail("the Notary server is unavailable")); err != nil {
+				dcontext.GetLogger(ctx).Errorf("error serving the content trust response: %v", err)
+			}
+		},
+	}
+	return h, nil
+}
+
+// isContentTrustPath returns true if path is in the Notary v1 API. The
+// repository names cannot have components that start with an underscore, so
+// the paths cannot be confused with the paths of the registry API.
+func (h *contentTrustHandler) isContentTrustPath(path string) bool {
+	rest, ok := strings.CutPrefix(path, h.prefix+"/v2/")
+	return ok && strings.Contains("/"+rest, "/_trust/")
+}
+
+func (h *contentTrustHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.isContentTrustPath(r.URL.Path) {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+
+	if h.proxy != nil {
+		h.proxy.ServeHTTP(w, r)
+		return
+	}
+
+	ctx := dcontext.WithRequest(r.Context(), r)
+	dcontext.GetLogger(ctx).Infof("rejecting the content trust request %s from the client %q, no Notary server is configured", r.URL.Path, r.UserAgent())
+
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	err := ErrorCodeContentTrustUnsupported.WithDetail(map[string]string{
+		"documentation": contentTrustDocsURL,
+	})
+	if err := errcode.ServeJSON(w, err); err != nil {
+		dcontext.GetLogger(ctx).Errorf("error serving the content trust response: %v", err)
+	}
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/configuration"
+)
+
+func TestContentTrustHandler(t *testing.T) {
+	var notaryPath string
+	notary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		notaryPath = r.URL.Path
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(`{"signed":{}}`))
+	}))
+	defer notary.Close()
+
+	registry := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+
+	const trustPath = "/v2/registry.example.com/user/app/_trust/tuf/root.json"
+
+	t.Run("passthrough", func(t *testing.T) {
+		h, err := newContentTrustHandler("/prefix/", registry, &configuration.ContentTrust{NotaryURL: notary.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/prefix"+trustPath, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+		}
+		if notaryPath != trustPath {
+			t.Errorf("the Notary server got the path %q, want %q", notaryPath, trustPath)
+		}
+
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/prefix/v2/user/app/manifests/latest", nil))
+		if w.Code != http.StatusTeapot {
+			t.Errorf("expected the registry API to be served by the registry, got status %d", w.Code)
+		}
+	})
+
+	t.Run("rejection", func(t *testing.T) {
+		h, err := newContentTrustHandler("", registry, &configuration.ContentTrust{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, trustPath, nil))
+		if w.Code != http.StatusNotImplemented {
+			t.Fatalf("got status %d, want %d", w.Code, http.StatusNotImplemented)
+		}
+
+		var body struct {
+			Errors []struct {
+				Code string `json:"code"`
+			} `json:"errors"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if len(body.Errors) != 1 || body.Errors[0].Code != "CONTENT_TRUST_UNSUPPORTED" {
+			t.Errorf("unexpected response: %s", w.Body.String())
+		}
+
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v2/user/trust/manifests/latest", nil))
+		if w.Code != http.StatusTeapot {
+			t.Errorf("expected the registry API to be served by the registry, got status %d", w.Code)
+		}
+	})
+}
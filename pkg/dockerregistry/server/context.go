@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"io"
 
 	"github.com/openshift/image-registry/pkg/dockerregistry/server/client"
 )
@@ -22,6 +23,26 @@ const (
 
 	// deferredErrorsKey is the key for deferred errors in Contexts.
 	deferredErrorsKey contextKey = "deferredErrors"
+
+	// dryRunKey is the key to indicate that a manifest push should not
+	// persist anything in Contexts.
+	dryRunKey contextKey = "dryRun"
+
+	// forceBlobDeleteKey is the key to indicate that the data of a deleted
+	// blob should be removed if no other repository links it.
+	forceBlobDeleteKey contextKey = "forceBlobDelete"
+
+	// ociConversionKey is the key for the conversion of the requested
+	// manifest to OCI media types in Contexts.
+	ociConversionKey contextKey = "ociConversion"
+
+	// requestIDKey is the key for the correlation ID of the request in
+	// Contexts. It is also the name of the field in log entries.
+	requestIDKey contextKey = "openshift.request.id"
+
+	// connectionWriterKey is the key for the response writer of the
+	// connection in Contexts.
+	connectionWriterKey contextKey = "connectionWriter"
 )
 
 func appMiddlewareFrom(ctx context.Context) appMiddleware {
@@ -64,3 +85,65 @@ func deferredErrorsFrom(ctx context.Context) (deferredErrors, bool) {
 	errs, ok := ctx.Value(deferredErrorsKey).(deferredErrors)
 	return errs, ok
 }
+
+// withDryRun returns a new Context with indication that the request is a
+// dry run.
+func withDryRun(parent context.Context) context.Context {
+	return context.WithValue(parent, dryRunKey, true)
+}
+
+// dryRun reports whether ctx has indication that the request is a dry run.
+func dryRun(ctx context.Context) bool {
+	dryRun, ok := ctx.Value(dryRunKey).(bool)
+	return ok && dryRun
+}
+
+// withForceBlobDelete sets the force flag of the blob deletion.
+func withForceBlobDelete(parent context.Context) context.Context {
+	return context.WithValue(parent, forceBlobDeleteKey, true)
+}
+
+// forceBlobDelete reports whether the data of the deleted blob should be
+// removed from the storage.
+func forceBlobDelete(ctx context.Context) bool {
+	force, ok := ctx.Value(forceBlobDeleteKey).(bool)
+	return ok && force
+}
+
+// withOCIConversion returns a new Context that carries the result of the
+// conversion of the requested manifest to OCI media types.
+func withOCIConversion(parent context.Context, conversion *ociConversion) context.Context {
+	return context.WithValue(parent, ociConversionKey, conversion)
+}
+
+// ociConversionFrom returns the conversion stored in ctx, if any.
+func ociConversionFrom(ctx context.Context) *ociConversion {
+	conversion, _ := ctx.Value(ociConversionKey).(*ociConversion)
+	return conversion
+}
+
+// withRequestID returns a new Context that carries the correlation ID of the
+// request.
+func withRequestID(parent context.Context, id string) context.Context {
+	return context.WithValue(parent, requestIDKey, id)
+}
+
+// requestIDFrom returns the correlation ID of the request stored in ctx, if
+// any.
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// withConnectionWriter returns a new Context that carries the response writer
+// of the connection.
+func withConnectionWriter(parent context.Context, w io.ReaderFrom) context.Context {
+	return context.WithValue(parent, connectionWriterKey, w)
+}
+
+// connectionWriterFrom returns the response writer of the connection stored
+// in ctx, if any.
+func connectionWriterFrom(ctx context.Context) (io.ReaderFrom, bool) {
+	w, ok := ctx.Value(connectionWriterKey).(io.ReaderFrom)
+	return w, ok
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+	registryconfig "github.com/openshift/image-registry/pkg/dockerregistry/server/configuration"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/coordination"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/metrics"
+)
+
+// serviceAccountNamespaceFile contains the namespace of the registry pod.
+const serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// registryNamespace returns namespace if it's not empty, otherwise the
+// namespace of the registry pod.
+func registryNamespace(namespace string) (string, error) {
+	if namespace != "" {
+		return namespace, nil
+	}
+	data, err := os.ReadFile(serviceAccountNamespaceFile)
+	if err != nil {
+		return "", fmt.Errorf("unable to get the namespace of the registry: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// newCoordinator returns the coordinator of the background jobs. It returns
+// nil if the coordination is disabled, in which case every replica runs the
+// jobs.
+func newCoordinator(cfg *registryconfig.Coordination, c client.Interface, m metrics.Metrics) (*coordination.Coordinator, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	namespace, err := registryNamespace(cfg.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	identity, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get the identity of the replica: %w", err)
+	}
+
+	return coordination.New(coordination.Config{
+		Namespace:     namespace,
+		Identity:      identity,
+		LeaseDuration: cfg.LeaseDuration,
+		RenewDeadline: cfg.RenewDeadline,
+		RetryPeriod:   cfg.RetryPeriod,
+	}, c, c, m.Coordination()), nil
+}
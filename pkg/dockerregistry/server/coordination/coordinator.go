@@ -0,0 +1,187 @@
+// Package coordination makes sure that the background jobs that work on the
+// whole cluster run on only one replica of the registry.
+package coordination
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/metrics"
+)
+
+const (
+	// LeaseName is the name of the Lease that is held by the leader.
+	LeaseName = "image-registry-leader"
+
+	// StateName is the name of the ConfigMap with the shared state.
+	StateName = "image-registry-state"
+
+	// leaderKey is the key of the state with the identity of the last
+	// leader.
+	leaderKey = "leader"
+)
+
+// Job is a background job that runs until ctx is done.
+type Job func(ctx context.Context)
+
+// Config is the configuration of the leader election.
+type Config struct {
+	Namespace     string
+	Identity      string
+	LeaseDuration time.Duration
+	RenewDeadline time.Duration
+	RetryPeriod   time.Duration
+}
+
+// Coordinator elects a leader among the replicas of the registry and runs
+// the registered jobs on the leader. A nil *Coordinator runs the jobs on
+// every replica.
+type Coordinator struct {
+	config     Config
+	lock       resourcelock.Interface
+	state      *State
+	leadership metrics.Leadership
+
+	mu   sync.Mutex
+	jobs map[string]Job
+
+	// leading is held while the replica runs the jobs.
+	leading sync.Mutex
+}
+
+// New returns a coordinator that holds the lease and keeps the state in the
+// namespace of the configuration.
+func New(config Config, leases client.LeasesGetter, configMaps client.ConfigMapsGetter, leadership metrics.Leadership) *Coordinator {
+	return &Coordinator{
+		config: config,
+		lock: &resourcelock.LeaseLock{
+			LeaseMeta: metav1.ObjectMeta{
+				Namespace: config.Namespace,
+				Name:      LeaseName,
+			},
+			Client: leases,
+			LockConfig: resourcelock.ResourceLockConfig{
+				Identity: config.Identity,
+			},
+		},
+		state:      NewState(configMaps, config.Namespace, StateName),
+		leadership: leadership,
+		jobs:       make(map[string]Job),
+	}
+}
+
+// State returns the state that is shared between the replicas. It returns
+// nil if c is nil.
+func (c *Coordinator) State() *State {
+	if c == nil {
+		return nil
+	}
+	return c.state
+}
+
+// Go registers the job name to be run while the replica is the leader. If c
+// is nil, the job is started immediately.
+func (c *Coordinator) Go(ctx context.Context, name string, job Job) {
+	if c == nil {
+		go job(ctx)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.jobs[name] = job
+}
+
+// Run takes part in the leader election until ctx is done. The registered
+// jobs are started when the replica becomes the leader and are stopped when
+// it loses the lease.
+func (c *Coordinator) Run(ctx context.Context) {
+	for {
+		elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+			Lock:            c.lock,
+			LeaseDuration:   c.config.LeaseDuration,
+			RenewDeadline:   c.config.RenewDeadline,
+			RetryPeriod:     c.config.RetryPeriod,
+			ReleaseOnCancel: true,
+			Name:            LeaseName,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: c.lead,
+				OnStoppedLeading: func() {
+					dcontext.GetLogger(ctx).Infof("coordination: %s is no longer the leader", c.config.Identity)
+				},
+			},
+		})
+		if err != nil {
+			dcontext.GetLogger(ctx).Fatalf("coordination: unable to create the leader elector: %v", err)
+		}
+
+		// Run returns when the lease is lost, in which case the replica
+		// becomes a candidate again.
+		elector.Run(ctx)
+
+		// The jobs are stopped asynchronously, wait for them so that they
+		// don't overlap with the jobs of the next term.
+		c.leading.Lock()
+		c.leading.Unlock() // nolint:staticcheck
+
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+	}
+}
+
+// lead runs the registered jobs until ctx is done.
+func (c *Coordinator) lead(ctx context.Context) {
+	c.leading.Lock()
+	defer c.leading.Unlock()
+	if ctx.Err() != nil {
+		// The leadership was lost before the jobs were started.
+		return
+	}
+
+	dcontext.GetLogger(ctx).Infof("coordination: %s is the leader", c.config.Identity)
+
+	c.leadership.Leader(true)
+	defer c.leadership.Leader(false)
+
+	previous, _, err := c.state.Get(ctx, leaderKey)
+	if err != nil {
+		dcontext.GetLogger(ctx).Warnf("coordination: %v", err)
+	}
+	if previous != c.config.Identity {
+		if previous != "" {
+			dcontext.GetLogger(ctx).Infof("coordination: %s took over from %s", c.config.Identity, previous)
+			c.leadership.Takeover()
+		}
+		if err := c.state.Set(ctx, leaderKey, c.config.Identity); err != nil {
+			dcontext.GetLogger(ctx).Warnf("coordination: %v", err)
+		}
+	}
+
+	c.mu.Lock()
+	jobs := make(map[string]Job, len(c.jobs))
+	for name, job := range c.jobs {
+		jobs[name] = job
+	}
+	c.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for name, job := range jobs {
+		dcontext.GetLogger(ctx).Infof("coordination: starting %s", name)
+		wg.Add(1)
+		go func(job Job) {
+			defer wg.Done()
+			job(ctx)
+		}(job)
+	}
+	wg.Wait()
+}
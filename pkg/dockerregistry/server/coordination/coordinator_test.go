@@ -0,0 +1,274 @@
+package coordination
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	coordinationclientv1 "k8s.io/client-go/kubernetes/typed/coordination/v1"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/metrics"
+	metricstesting "github.com/openshift/image-registry/pkg/dockerregistry/server/metrics/testing"
+	"github.com/openshift/image-registry/pkg/testutil/counter"
+)
+
+// fakeConfigMaps stores ConfigMaps in memory and rejects updates of stale
+// objects.
+type fakeConfigMaps struct {
+	mu         sync.Mutex
+	configMaps map[string]*corev1.ConfigMap
+
+	// conflicts is the number of updates that fail with a conflict.
+	conflicts int
+}
+
+func newFakeConfigMaps() *fakeConfigMaps {
+	return &fakeConfigMaps{configMaps: make(map[string]*corev1.ConfigMap)}
+}
+
+func (f *fakeConfigMaps) ConfigMaps(namespace string) client.ConfigMapInterface {
+	return &fakeConfigMapInterface{f: f, namespace: namespace}
+}
+
+type fakeConfigMapInterface struct {
+	f         *fakeConfigMaps
+	namespace string
+}
+
+func (c *fakeConfigMapInterface) Get(ctx context.Context, name string, opts metav1.GetOptions) (*corev1.ConfigMap, error) {
+	c.f.mu.Lock()
+	defer c.f.mu.Unlock()
+	cm, ok := c.f.configMaps[c.namespace+"/"+name]
+	if !ok {
+		return nil, kerrors.NewNotFound(schema.GroupResource{Resource: "configmaps"}, name)
+	}
+	return cm.DeepCopy(), nil
+}
+
+func (c *fakeConfigMapInterface) Create(ctx context.Context, cm *corev1.ConfigMap, opts metav1.CreateOptions) (*corev1.ConfigMap, error) {
+	c.f.mu.Lock()
+	defer c.f.mu.Unlock()
+	key := c.namespace + "/" + cm.Name
+	if _, ok := c.f.configMaps[key]; ok {
+		return nil, kerrors.NewAlreadyExists(schema.GroupResource{Resource: "configmaps"}, cm.Name)
+	}
+	cm = cm.DeepCopy()
+	cm.ResourceVersion = "1"
+	c.f.configMaps[key] = cm
+	return cm.DeepCopy(), nil
+}
+
+func (c *fakeConfigMapInterface) Update(ctx context.Context, cm *corev1.ConfigMap, opts metav1.UpdateOptions) (*corev1.ConfigMap, error) {
+	c.f.mu.Lock()
+	defer c.f.mu.Unlock()
+	key := c.namespace + "/" + cm.Name
+	current, ok := c.f.configMaps[key]
+	if !ok {
+		return nil, kerrors.NewNotFound(schema.GroupResource{Resource: "configmaps"}, cm.Name)
+	}
+	if c.f.conflicts > 0 || current.ResourceVersion != cm.ResourceVersion {
+		if c.f.conflicts > 0 {
+			c.f.conflicts--
+		}
+		return nil, kerrors.NewConflict(schema.GroupResource{Resource: "configmaps"}, cm.Name, nil)
+	}
+	version, _ := strconv.Atoi(current.ResourceVersion)
+	cm = cm.DeepCopy()
+	cm.ResourceVersion = strconv.Itoa(version + 1)
+	c.f.configMaps[key] = cm
+	return cm.DeepCopy(), nil
+}
+
+// fakeLeases stores Leases in memory.
+type fakeLeases struct {
+	mu     sync.Mutex
+	leases map[string]*coordinationv1.Lease
+}
+
+func (f *fakeLeases) Leases(namespace string) coordinationclientv1.LeaseInterface {
+	return &fakeLeaseInterface{f: f, namespace: namespace}
+}
+
+type fakeLeaseInterface struct {
+	coordinationclientv1.LeaseInterface
+
+	f         *fakeLeases
+	namespace string
+}
+
+func (c *fakeLeaseInterface) Get(ctx context.Context, name string, opts metav1.GetOptions) (*coordinationv1.Lease, error) {
+	c.f.mu.Lock()
+	defer c.f.mu.Unlock()
+	lease, ok := c.f.leases[c.namespace+"/"+name]
+	if !ok {
+		return nil, kerrors.NewNotFound(schema.GroupResource{Group: "coordination.k8s.io", Resource: "leases"}, name)
+	}
+	return lease.DeepCopy(), nil
+}
+
+func (c *fakeLeaseInterface) Create(ctx context.Context, lease *coordinationv1.Lease, opts metav1.CreateOptions) (*coordinationv1.Lease, error) {
+	c.f.mu.Lock()
+	defer c.f.mu.Unlock()
+	key := c.namespace + "/" + lease.Name
+	if _, ok := c.f.leases[key]; ok {
+		return nil, kerrors.NewAlreadyExists(schema.GroupResource{Group: "coordination.k8s.io", Resource: "leases"}, lease.Name)
+	}
+	c.f.leases[key] = lease.DeepCopy()
+	return lease.DeepCopy(), nil
+}
+
+func (c *fakeLeaseInterface) Update(ctx context.Context, lease *coordinationv1.Lease, opts metav1.UpdateOptions) (*coordinationv1.Lease, error) {
+	c.f.mu.Lock()
+	defer c.f.mu.Unlock()
+	c.f.leases[c.namespace+"/"+lease.Name] = lease.DeepCopy()
+	return lease.DeepCopy(), nil
+}
+
+func TestStateSet(t *testing.T) {
+	ctx := context.Background()
+
+	configMaps := newFakeConfigMaps()
+	state := NewState(configMaps, "openshift-image-registry", StateName)
+
+	if _, ok, err := state.Get(ctx, "key"); err != nil || ok {
+		t.Fatalf("got ok=%t, err=%v, want the key to be unset", ok, err)
+	}
+
+	if err := state.Set(ctx, "key", "a"); err != nil {
+		t.Fatal(err)
+	}
+	configMaps.conflicts = stateUpdateAttempts - 1
+	if err := state.Set(ctx, "other", "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	for key, expected := range map[string]string{"key": "a", "other": "b"} {
+		value, ok, err := state.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok || value != expected {
+			t.Errorf("%s: got %q (ok=%t), want %q", key, value, ok, expected)
+		}
+	}
+
+	configMaps.conflicts = stateUpdateAttempts
+	if err := state.Set(ctx, "key", "c"); !kerrors.IsConflict(err) {
+		t.Errorf("got %v, want a conflict", err)
+	}
+}
+
+func TestStateEvery(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	state := NewState(newFakeConfigMaps(), "openshift-image-registry", StateName)
+
+	// The previous leader has just run the job.
+	if err := state.Set(ctx, "job.lastrun", time.Now().UTC().Format(time.RFC3339)); err != nil {
+		t.Fatal(err)
+	}
+
+	runs := make(chan struct{}, 1)
+	go state.Every(ctx, "job", time.Hour, func(ctx context.Context) {
+		runs <- struct{}{}
+	})
+
+	select {
+	case <-runs:
+		t.Fatal("the job should continue the schedule of the previous leader")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	var nilState *State
+	go nilState.Every(ctx, "job", time.Hour, func(ctx context.Context) {
+		runs <- struct{}{}
+	})
+
+	select {
+	case <-runs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the job should run immediately without the state")
+	}
+}
+
+func TestCoordinatorTakeover(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	configMaps := newFakeConfigMaps()
+	if err := NewState(configMaps, "openshift-image-registry", StateName).Set(ctx, leaderKey, "image-registry-0"); err != nil {
+		t.Fatal(err)
+	}
+
+	c, sink := metricstesting.NewCounterSink()
+	coordinator := New(Config{
+		Namespace:     "openshift-image-registry",
+		Identity:      "image-registry-1",
+		LeaseDuration: 3 * time.Second,
+		RenewDeadline: 2 * time.Second,
+		RetryPeriod:   100 * time.Millisecond,
+	}, &fakeLeases{leases: make(map[string]*coordinationv1.Lease)}, configMaps, metrics.NewMetrics(sink).Coordination())
+
+	started := make(chan struct{})
+	coordinator.Go(ctx, "job", func(ctx context.Context) {
+		close(started)
+		<-ctx.Done()
+	})
+
+	done := make(chan struct{})
+	go func() {
+		coordinator.Run(ctx)
+		close(done)
+	}()
+
+	select {
+	case <-started:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the job was not started")
+	}
+
+	if diff := c.Diff(counter.M{"coordination_leader": 1, "coordination_takeovers": 1}); diff != nil {
+		t.Errorf("unexpected metrics: %q", diff)
+	}
+	if leader, _, err := coordinator.State().Get(ctx, leaderKey); err != nil || leader != "image-registry-1" {
+		t.Errorf("got leader %q (err=%v), want %q", leader, err, "image-registry-1")
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the coordinator did not stop")
+	}
+	if diff := c.Diff(counter.M{"coordination_leader": 0, "coordination_takeovers": 1}); diff != nil {
+		t.Errorf("unexpected metrics: %q", diff)
+	}
+}
+
+func TestNilCoordinator(t *testing.T) {
+	ctx := context.Background()
+
+	var coordinator *Coordinator
+	if coordinator.State() != nil {
+		t.Error("expected no state")
+	}
+
+	started := make(chan struct{})
+	coordinator.Go(ctx, "job", func(ctx context.Context) {
+		close(started)
+	})
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the job should be started immediately")
+	}
+}
@@ -0,0 +1,141 @@
+package coordination
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+)
+
+// stateUpdateAttempts is how many times an update of the state is retried
+// when it conflicts with an update from another replica.
+const stateUpdateAttempts = 5
+
+// State is the operational state of the registry that is shared between its
+// replicas. It is stored in a ConfigMap, so the keys must be valid keys of
+// ConfigMap data.
+type State struct {
+	client    client.ConfigMapsGetter
+	namespace string
+	name      string
+}
+
+// NewState returns the state stored in the ConfigMap namespace/name.
+func NewState(c client.ConfigMapsGetter, namespace, name string) *State {
+	return &State{
+		client:    c,
+		namespace: namespace,
+		name:      name,
+	}
+}
+
+// Get returns the value of key. It returns false if the key is not set.
+func (s *State) Get(ctx context.Context, key string) (string, bool, error) {
+	cm, err := s.client.ConfigMaps(s.namespace).Get(ctx, s.name, metav1.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("unable to get the state %s/%s: %w", s.namespace, s.name, err)
+	}
+	value, ok := cm.Data[key]
+	return value, ok, nil
+}
+
+// Set sets key to value. The ConfigMap is created if it doesn't exist.
+func (s *State) Set(ctx context.Context, key, value string) error {
+	configMaps := s.client.ConfigMaps(s.namespace)
+
+	var err error
+	for i := 0; i < stateUpdateAttempts; i++ {
+		var cm *corev1.ConfigMap
+		cm, err = configMaps.Get(ctx, s.name, metav1.GetOptions{})
+		if kerrors.IsNotFound(err) {
+			_, err = configMaps.Create(ctx, &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: s.namespace,
+					Name:      s.name,
+				},
+				Data: map[string]string{key: value},
+			}, metav1.CreateOptions{})
+			if kerrors.IsAlreadyExists(err) {
+				continue
+			}
+			break
+		}
+		if err != nil {
+			break
+		}
+
+		if cm.Data == nil {
+			cm.Data = make(map[string]string)
+		}
+		cm.Data[key] = value
+		_, err = configMaps.Update(ctx, cm, metav1.UpdateOptions{})
+		if !kerrors.IsConflict(err) {
+			break
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("unable to set %s in the state %s/%s: %w", key, s.namespace, s.name, err)
+	}
+	return nil
+}
+
+// Every runs fn every interval until ctx is done. The time of the last run
+// is kept in the state, so that a replica that takes over continues the
+// schedule of the previous leader instead of starting over. If s is nil, the
+// first run is immediate.
+func (s *State) Every(ctx context.Context, name string, interval time.Duration, fn func(ctx context.Context)) {
+	key := name + ".lastrun"
+
+	timer := time.NewTimer(s.nextRun(ctx, key, interval))
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		fn(ctx)
+		if s != nil {
+			if err := s.Set(ctx, key, time.Now().UTC().Format(time.RFC3339)); err != nil {
+				dcontext.GetLogger(ctx).Warnf("unable to save the last run of %s: %v", name, err)
+			}
+		}
+		timer.Reset(interval)
+	}
+}
+
+// nextRun returns how long to wait until the next run according to the last
+// run stored under key.
+func (s *State) nextRun(ctx context.Context, key string, interval time.Duration) time.Duration {
+	if s == nil {
+		return 0
+	}
+
+	value, ok, err := s.Get(ctx, key)
+	if err != nil {
+		dcontext.GetLogger(ctx).Warnf("unable to get %s: %v", key, err)
+		return 0
+	}
+	if !ok {
+		return 0
+	}
+	lastRun, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		dcontext.GetLogger(ctx).Warnf("unable to parse %s: %v", key, err)
+		return 0
+	}
+	if elapsed := time.Since(lastRun); elapsed < interval {
+		return interval - elapsed
+	}
+	return 0
+}
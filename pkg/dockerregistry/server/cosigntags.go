@@ -0,0 +1,265 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/opencontainers/go-digest"
+	kapierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	imageapiv1 "github.com/openshift/api/image/v1"
+)
+
+const (
+	// cosignSignatureTagSuffix, cosignAttestationTagSuffix and
+	// cosignSBOMTagSuffix are the suffixes of the tags that cosign uses to
+	// store the signatures, the attestations and the SBOMs of the image
+	// sha256:<digest> as sha256-<digest>.<suffix> in the same repository.
+	cosignSignatureTagSuffix   = "sig"
+	cosignAttestationTagSuffix = "att"
+	cosignSBOMTagSuffix        = "sbom"
+
+	// cosignAttestationType and cosignSBOMType are the types of the image
+	// signatures that refer to the attestations and the SBOMs of the images.
+	cosignAttestationType = "cosign-attestation"
+	cosignSBOMType        = "cosign-sbom"
+
+	// cosignSimpleSigningMediaType is the media type of the layers of cosign
+	// signature manifests. The layer is the signed simple signing payload.
+	cosignSimpleSigningMediaType = "application/vnd.dev.cosign.simplesigning.v1+json"
+
+	// cosignSignatureAnnotation is the annotation of a signature layer with
+	// the base64-encoded signature of the payload.
+	cosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+
+	// cosignPayloadMaxBytes limits the size of the signature payloads that
+	// are read from the storage.
+	cosignPayloadMaxBytes = 1 << 20
+)
+
+// cosignArtifactLayerMediaTypes are the media types of the layers of the
+// signatures, the attestations and the SBOMs that cosign stores in the
+// repositories. Container runtimes don't unpack such layers.
+var cosignArtifactLayerMediaTypes = map[string]bool{
+	cosignSimpleSigningMediaType:            true,
+	"application/vnd.dsse.envelope.v1+json": true,
+	"text/spdx":                             true,
+	"text/spdx+json":                        true,
+	"text/spdx+xml":                         true,
+	"application/vnd.cyclonedx":             true,
+	"application/vnd.cyclonedx+json":        true,
+	"application/vnd.cyclonedx+xml":         true,
+	"application/vnd.syft+json":             true,
+}
+
+// parseCosignTag returns the digest of the image that the cosign tag
+// sha256-<digest>.<suffix> belongs to and the suffix of the tag.
+func parseCosignTag(tag string) (digest.Digest, string, bool) {
+	name, suffix, ok := strings.Cut(tag, ".")
+	if !ok {
+		return "", "", false
+	}
+	switch suffix {
+	case cosignSignatureTagSuffix, cosignAttestationTagSuffix, cosignSBOMTagSuffix:
+	default:
+		return "", "", false
+	}
+	hex, ok := strings.CutPrefix(name, string(digest.SHA256)+"-")
+	if !ok {
+		return "", "", false
+	}
+	dgst := digest.NewDigestFromEncoded(digest.SHA256, hex)
+	if dgst.Validate() != nil {
+		return "", "", false
+	}
+	return dgst, suffix, true
+}
+
+// isCosignArtifact reports whether image is a signature, an attestation or
+// an SBOM stored by cosign, i.e. all its layers are cosign artifacts.
+func isCosignArtifact(image *imageapiv1.Image) bool {
+	if len(image.DockerImageLayers) == 0 {
+		return false
+	}
+	for _, layer := range image.DockerImageLayers {
+		if !cosignArtifactLayerMediaTypes[layer.MediaType] {
+			return false
+		}
+	}
+	return true
+}
+
+// cosignTagManifestService records the signatures that cosign pushes as
+// sha256-<digest>.sig tags as image signatures of the signed images, so that
+// they are served by the signatures API and are checked by the signature
+// policies just like the signatures created with the signatures API. The
+// attestations and the SBOMs pushed as .att and .sbom tags are recorded as
+// image signatures of their own types that refer to the layers with the
+// content. The manifests are stored as usual images, so cosign finds them by
+// their tags.
+type cosignTagManifestService struct {
+	distribution.ManifestService
+	blobStore distribution.BlobProvider
+}
+
+var _ distribution.ManifestService = &cosignTagManifestService{}
+
+func (m *cosignTagManifestService) Put(ctx context.Context, manifest distribution.Manifest, options ...distribution.ManifestServiceOption) (digest.Digest, error) {
+	tag := ""
+	for _, option := range options {
+		if opt, ok := option.(distribution.WithTagOption); ok {
+			tag = opt.Tag
+			break
+		}
+	}
+	subject, suffix, ok := parseCosignTag(tag)
+	if !ok || dryRun(ctx) {
+		return m.ManifestService.Put(ctx, manifest, options...)
+	}
+
+	// The signatures are created before the tag, so that the tag isn't left
+	// without the signatures if they are rejected.
+	var signatures []*imageapiv1.ImageSignature
+	var err error
+	if suffix == cosignSignatureTagSuffix {
+		signatures, err = m.signatures(ctx, subject, manifest)
+	} else {
+		signatures, err = m.artifactReferences(ctx, subject, suffix, manifest)
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := m.createSignatures(ctx, subject, signatures); err != nil {
+		return "", err
+	}
+
+	return m.ManifestService.Put(ctx, manifest, options...)
+}
+
+// signatures returns the image signatures of the layers of a cosign
+// signature manifest for the image subject.
+func (m *cosignTagManifestService) signatures(ctx context.Context, subject digest.Digest, manifest distribution.Manifest) ([]*imageapiv1.ImageSignature, error) {
+	oci, ok := manifest.(*ocischema.DeserializedManifest)
+	if !ok {
+		return nil, ErrorCodeSignatureInvalid.WithDetail("cosign signatures must be OCI image manifests")
+	}
+
+	var signatures []*imageapiv1.ImageSignature
+	for _, layer := range oci.Layers {
+		if layer.MediaType != cosignSimpleSigningMediaType {
+			continue
+		}
+		encoded, ok := layer.Annotations[cosignSignatureAnnotation]
+		if !ok {
+			continue
+		}
+		sig, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, ErrorCodeSignatureInvalid.WithDetail(fmt.Sprintf("invalid signature of the layer %s: %v", layer.Digest, err))
+		}
+		if layer.Size > cosignPayloadMaxBytes {
+			return nil, ErrorCodeSignatureInvalid.WithDetail(fmt.Sprintf("the payload %s is larger than %d bytes", layer.Digest, cosignPayloadMaxBytes))
+		}
+		payload, err := m.blobStore.Get(ctx, layer.Digest)
+		if err != nil {
+			return nil, err
+		}
+		content, err := json.Marshal(cosignSignature{Payload: payload, Signature: sig})
+		if err != nil {
+			return nil, errcode.ErrorCodeUnknown.WithDetail(err)
+		}
+
+		// The signatures made by different keys have the same payload.
+		hash := sha256.Sum256(sig)
+		signatures = append(signatures, &imageapiv1.ImageSignature{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: fmt.Sprintf("%s@%x", subject, hash[:16]),
+			},
+			Type:    cosignSignatureType,
+			Content: content,
+		})
+	}
+	return signatures, nil
+}
+
+// artifactReferences returns the image signatures that refer to the layers of
+// a cosign attestation or SBOM manifest for the image subject. The content of
+// the signatures is the descriptor of the layer, the layers themselves may be
+// too large for the Image objects and stay in the storage.
+func (m *cosignTagManifestService) artifactReferences(ctx context.Context, subject digest.Digest, suffix string, manifest distribution.Manifest) ([]*imageapiv1.ImageSignature, error) {
+	oci, ok := manifest.(*ocischema.DeserializedManifest)
+	if !ok {
+		return nil, ErrorCodeSignatureInvalid.WithDetail("cosign attestations and SBOMs must be OCI image manifests")
+	}
+
+	signatureType := cosignAttestationType
+	if suffix == cosignSBOMTagSuffix {
+		signatureType = cosignSBOMType
+	}
+
+	var signatures []*imageapiv1.ImageSignature
+	for _, layer := range oci.Layers {
+		if !cosignArtifactLayerMediaTypes[layer.MediaType] {
+			continue
+		}
+		content, err := json.Marshal(distribution.Descriptor{
+			MediaType: layer.MediaType,
+			Digest:    layer.Digest,
+			Size:      layer.Size,
+		})
+		if err != nil {
+			return nil, errcode.ErrorCodeUnknown.WithDetail(err)
+		}
+
+		hash := sha256.Sum256([]byte(signatureType + "@" + layer.Digest.String()))
+		signatures = append(signatures, &imageapiv1.ImageSignature{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: fmt.Sprintf("%s@%x", subject, hash[:16]),
+			},
+			Type:    signatureType,
+			Content: content,
+		})
+	}
+	return signatures, nil
+}
+
+// createSignatures adds the signatures to the image subject on behalf of the
+// user, who needs the same permissions as for the signatures API. cosign
+// pushes all signatures of the image every time it adds one, so the existing
+// signatures are skipped.
+func (m *cosignTagManifestService) createSignatures(ctx context.Context, subject digest.Digest, signatures []*imageapiv1.ImageSignature) error {
+	if len(signatures) == 0 {
+		return nil
+	}
+
+	uclient, ok := userClientFrom(ctx)
+	if !ok {
+		return errcode.ErrorCodeUnknown.WithDetail("unable to get origin client")
+	}
+
+	for _, sig := range signatures {
+		_, err := uclient.ImageSignatures().Create(ctx, sig, metav1.CreateOptions{})
+		switch {
+		case err == nil:
+			dcontext.GetLogger(ctx).Debugf("cosignTagManifestService.Put: signature %s added to %s", sig.Name, subject)
+		case kapierrors.IsAlreadyExists(err):
+		case kapierrors.IsUnauthorized(err), kapierrors.IsForbidden(err):
+			dcontext.GetLogger(ctx).Errorf("cosignTagManifestService.Put: not allowed to add signature %s: %v", sig.Name, err)
+			return distribution.ErrAccessDenied
+		case kapierrors.IsBadRequest(err), kapierrors.IsInvalid(err), kapierrors.IsNotFound(err):
+			return ErrorCodeSignatureInvalid.WithDetail(err.Error())
+		default:
+			return errcode.ErrorCodeUnknown.WithDetail(fmt.Sprintf("unable to create image %s signature: %v", subject, err))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/opencontainers/go-digest"
+	kapierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgotesting "k8s.io/client-go/testing"
+
+	imageapiv1 "github.com/openshift/api/image/v1"
+	imagefakeclient "github.com/openshift/client-go/image/clientset/versioned/typed/image/v1/fake"
+
+	registryclient "github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+	"github.com/openshift/image-registry/pkg/testutil"
+)
+
+// payloadBlobs is a blob provider of signature payloads.
+type payloadBlobs map[digest.Digest][]byte
+
+func (b payloadBlobs) Stat(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, error) {
+	payload, ok := b[dgst]
+	if !ok {
+		return distribution.Descriptor{}, distribution.ErrBlobUnknown
+	}
+	return distribution.Descriptor{Digest: dgst, Size: int64(len(payload))}, nil
+}
+
+func (b payloadBlobs) Get(ctx context.Context, dgst digest.Digest) ([]byte, error) {
+	payload, ok := b[dgst]
+	if !ok {
+		return nil, distribution.ErrBlobUnknown
+	}
+	return payload, nil
+}
+
+func (b payloadBlobs) Open(ctx context.Context, dgst digest.Digest) (distribution.ReadSeekCloser, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+// storingManifestService accepts all manifests.
+type storingManifestService struct {
+	distribution.ManifestService
+	puts int
+}
+
+func (ms *storingManifestService) Put(ctx context.Context, manifest distribution.Manifest, options ...distribution.ManifestServiceOption) (digest.Digest, error) {
+	ms.puts++
+	_, payload, err := manifest.Payload()
+	if err != nil {
+		return "", err
+	}
+	return digest.FromBytes(payload), nil
+}
+
+func TestParseCosignTag(t *testing.T) {
+	const hex = "0000000000000000000000000000000000000000000000000000000000000001"
+	for _, tc := range []struct {
+		tag     string
+		subject digest.Digest
+		suffix  string
+	}{
+		{tag: "sha256-" + hex + ".sig", subject: "sha256:" + hex, suffix: "sig"},
+		{tag: "sha256-" + hex + ".att", subject: "sha256:" + hex, suffix: "att"},
+		{tag: "sha256-" + hex + ".sbom", subject: "sha256:" + hex, suffix: "sbom"},
+		{tag: "sha256-" + hex + ".txt"},
+		{tag: "sha256-" + hex},
+		{tag: "sha256-0001.sig"},
+		{tag: "sha512-" + hex + ".sig"},
+		{tag: "latest"},
+	} {
+		subject, suffix, ok := parseCosignTag(tc.tag)
+		if ok != (tc.subject != "") || subject != tc.subject || suffix != tc.suffix {
+			t.Errorf("%s: got %q, %q, %t, want %q, %q", tc.tag, subject, suffix, ok, tc.subject, tc.suffix)
+		}
+	}
+}
+
+func TestCosignTagManifestServicePut(t *testing.T) {
+	ctx := testutil.WithTestLogger(context.Background(), t)
+
+	const subject = digest.Digest("sha256:0000000000000000000000000000000000000000000000000000000000000001")
+	payload := []byte(fmt.Sprintf(`{"critical":{"image":{"docker-manifest-digest":%q},"type":%q}}`, subject, cosignPayloadType))
+	payloadDigest := digest.FromBytes(payload)
+
+	manifest, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned: ocischema.SchemaVersion,
+		Config: distribution.Descriptor{
+			MediaType: "application/vnd.oci.image.config.v1+json",
+			Digest:    "sha256:0000000000000000000000000000000000000000000000000000000000000002",
+			Size:      2,
+		},
+		Layers: []distribution.Descriptor{
+			{
+				MediaType:   cosignSimpleSigningMediaType,
+				Digest:      payloadDigest,
+				Size:        int64(len(payload)),
+				Annotations: map[string]string{cosignSignatureAnnotation: base64.StdEncoding.EncodeToString([]byte("signature-1"))},
+			},
+			{
+				MediaType:   cosignSimpleSigningMediaType,
+				Digest:      payloadDigest,
+				Size:        int64(len(payload)),
+				Annotations: map[string]string{cosignSignatureAnnotation: base64.StdEncoding.EncodeToString([]byte("signature-2"))},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imageClient := &imagefakeclient.FakeImageV1{Fake: &clientgotesting.Fake{}}
+	var created []*imageapiv1.ImageSignature
+	imageClient.AddReactor("create", "imagesignatures", func(action clientgotesting.Action) (bool, runtime.Object, error) {
+		sig := action.(clientgotesting.CreateAction).GetObject().(*imageapiv1.ImageSignature)
+		for _, c := range created {
+			if c.Name == sig.Name {
+				return true, nil, kapierrors.NewAlreadyExists(imageapiv1.Resource("imagesignatures"), sig.Name)
+			}
+		}
+		created = append(created, sig)
+		return true, sig, nil
+	})
+	osclient, err := registryclient.NewFakeRegistryClient(imageClient).Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx = withUserClient(ctx, osclient)
+
+	inner := &storingManifestService{}
+	ms := &cosignTagManifestService{
+		ManifestService: inner,
+		blobStore:       payloadBlobs{payloadDigest: payload},
+	}
+
+	// cosign pushes the signature manifest again with all signatures.
+	for i := 0; i < 2; i++ {
+		if _, err := ms.Put(ctx, manifest, distribution.WithTag("sha256-"+subject.Encoded()+".sig")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if inner.puts != 2 {
+		t.Errorf("got %d stored manifests, want 2", inner.puts)
+	}
+	if len(created) != 2 {
+		t.Fatalf("got %d signatures, want 2", len(created))
+	}
+	if created[0].Name == created[1].Name {
+		t.Errorf("the signatures have the same name %s", created[0].Name)
+	}
+	for _, sig := range created {
+		if sig.Type != cosignSignatureType {
+			t.Errorf("%s: got type %q, want %q", sig.Name, sig.Type, cosignSignatureType)
+		}
+		if !strings.HasPrefix(sig.Name, subject.String()+"@") {
+			t.Errorf("%s: the signature is not named after the image %s", sig.Name, subject)
+		}
+	}
+
+	var content cosignSignature
+	if err := json.Unmarshal(created[1].Content, &content); err != nil {
+		t.Fatal(err)
+	}
+	if string(content.Payload) != string(payload) || string(content.Signature) != "signature-2" {
+		t.Errorf("unexpected content of the signature: %s", created[1].Content)
+	}
+
+	// The attestations and the SBOMs refer to their layers.
+	for _, tc := range []struct {
+		suffix       string
+		mediaType    string
+		expectedType string
+	}{
+		{suffix: "att", mediaType: "application/vnd.dsse.envelope.v1+json", expectedType: cosignAttestationType},
+		{suffix: "sbom", mediaType: "text/spdx+json", expectedType: cosignSBOMType},
+	} {
+		layer := distribution.Descriptor{MediaType: tc.mediaType, Digest: digest.FromString(tc.suffix), Size: 100}
+		artifact, err := ocischema.FromStruct(ocischema.Manifest{
+			Versioned: ocischema.SchemaVersion,
+			Config:    manifest.Config,
+			Layers:    []distribution.Descriptor{layer},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ms.Put(ctx, artifact, distribution.WithTag("sha256-"+subject.Encoded()+"."+tc.suffix)); err != nil {
+			t.Fatal(err)
+		}
+		sig := created[len(created)-1]
+		if sig.Type != tc.expectedType {
+			t.Errorf("%s: got type %q, want %q", tc.suffix, sig.Type, tc.expectedType)
+		}
+		var content distribution.Descriptor
+		if err := json.Unmarshal(sig.Content, &content); err != nil {
+			t.Fatal(err)
+		}
+		if content.Digest != layer.Digest || content.MediaType != layer.MediaType || content.Size != layer.Size {
+			t.Errorf("%s: got content %s, want the descriptor of %s", tc.suffix, sig.Content, layer.Digest)
+		}
+	}
+	if len(created) != 4 {
+		t.Errorf("got %d signatures, want 4", len(created))
+	}
+
+	// The tag isn't created if the signatures are rejected.
+	puts := inner.puts
+	imageClient.PrependReactor("create", "imagesignatures", func(action clientgotesting.Action) (bool, runtime.Object, error) {
+		return true, nil, kapierrors.NewForbidden(imageapiv1.Resource("imagesignatures"), "", fmt.Errorf("denied"))
+	})
+	if _, err := ms.Put(ctx, manifest, distribution.WithTag("sha256-"+subject.Encoded()+".sig")); err != distribution.ErrAccessDenied {
+		t.Errorf("got error %v, want %v", err, distribution.ErrAccessDenied)
+	}
+	if inner.puts != puts {
+		t.Errorf("the manifest is stored although its signatures are rejected")
+	}
+}
+
+func TestIsCosignArtifact(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		layers   []string
+		expected bool
+	}{
+		{name: "signature", layers: []string{cosignSimpleSigningMediaType, cosignSimpleSigningMediaType}, expected: true},
+		{name: "attestation", layers: []string{"application/vnd.dsse.envelope.v1+json"}, expected: true},
+		{name: "sbom", layers: []string{"text/spdx+json"}, expected: true},
+		{name: "image", layers: []string{"application/vnd.oci.image.layer.v1.tar+gzip"}},
+		{name: "mixed", layers: []string{cosignSimpleSigningMediaType, "application/vnd.oci.image.layer.v1.tar+gzip"}},
+		{name: "no layers"},
+	} {
+		image := &imageapiv1.Image{}
+		for _, mediaType := range tc.layers {
+			image.DockerImageLayers = append(image.DockerImageLayers, imageapiv1.ImageLayer{MediaType: mediaType})
+		}
+		if got := isCosignArtifact(image); got != tc.expected {
+			t.Errorf("%s: got %t, want %t", tc.name, got, tc.expected)
+		}
+	}
+}
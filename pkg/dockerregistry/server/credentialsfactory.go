@@ -19,9 +19,23 @@ type credentialStoreFactory struct {
 // CredentialStoreFor returns authentication info for accessing "image". Returns only one
 // authentication.
 func (c *credentialStoreFactory) CredentialStoreFor(image string) auth.CredentialStore {
-	var nocreds auth.CredentialStore = registryclient.NoCredentials
+	auths := c.lookup(image)
+	if len(auths) == 0 {
+		return registryclient.NoCredentials
+	}
+
+	return dockerregistry.NewStaticCredentialStore(&auths[0].AuthConfig)
+}
+
+// hasCredentials returns true if there is authentication info for accessing
+// "image".
+func (c *credentialStoreFactory) hasCredentials(image string) bool {
+	return len(c.lookup(image)) > 0
+}
+
+func (c *credentialStoreFactory) lookup(image string) []credentialprovider.LazyAuthConfiguration {
 	if c.keyring == nil {
-		return nocreds
+		return nil
 	}
 
 	if strings.HasPrefix(image, "registry-1.docker.io/") {
@@ -29,9 +43,5 @@ func (c *credentialStoreFactory) CredentialStoreFor(image string) auth.Credentia
 	}
 
 	auths, _ := c.keyring.Lookup(image)
-	if len(auths) == 0 {
-		return nocreds
-	}
-
-	return dockerregistry.NewStaticCredentialStore(&auths[0].AuthConfig)
+	return auths
 }
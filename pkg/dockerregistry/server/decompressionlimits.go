@@ -0,0 +1,372 @@
+package server
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/configuration"
+)
+
+// decompressionRatioMinSize is the decompressed size of a layer up to which
+// the decompression ratio is not checked. Small layers with repetitive
+// content have high ratios without being dangerous.
+const decompressionRatioMinSize = 16 << 20
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+	errDecompressionAborted = errors.New("the inspection of the layer was aborted")
+)
+
+// decompressionLimitError is returned when a layer exceeds the decompression
+// limits.
+type decompressionLimitError struct {
+	reason string
+}
+
+func (e *decompressionLimitError) Error() string {
+	return "the layer looks like a decompression bomb: " + e.reason
+}
+
+// decompressionLimits protects the consumers of the images from layers that
+// are small in the registry, but are huge or have too many files when they
+// are extracted. The layers are decompressed and their tar archives are read
+// while they are written to the storage or when their uploads are completed.
+type decompressionLimits struct {
+	maxRatio float64
+	maxFiles int
+}
+
+// newDecompressionLimits returns nil if the limits are disabled.
+func newDecompressionLimits(cfg *configuration.Security) *decompressionLimits {
+	if cfg == nil || cfg.MaxDecompressionRatio == 0 {
+		return nil
+	}
+	return &decompressionLimits{
+		maxRatio: cfg.MaxDecompressionRatio,
+		maxFiles: cfg.MaxFiles,
+	}
+}
+
+// check reads the layer from r and returns *decompressionLimitError if it
+// exceeds the limits. The content that is neither a tar archive nor a
+// compressed tar archive is not checked.
+func (l *decompressionLimits) check(r io.Reader) error {
+	compressed := &countingReader{Reader: r}
+	br := bufio.NewReader(compressed)
+	magic, _ := br.Peek(len(zstdMagic))
+
+	var rd io.Reader = br
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil
+		}
+		defer gr.Close()
+		rd = gr
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil
+		}
+		defer zr.Close()
+		rd = zr
+	}
+
+	decompressed := &decompressedSizeLimitReader{
+		Reader:     rd,
+		compressed: compressed,
+		maxRatio:   l.maxRatio,
+	}
+	tr := tar.NewReader(decompressed)
+	files := 0
+	for {
+		_, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		var limitErr *decompressionLimitError
+		if errors.As(err, &limitErr) {
+			return err
+		}
+		if err != nil {
+			// Not a layer, or a corrupted one. The clients get the same
+			// errors when they extract it.
+			return nil
+		}
+		files++
+		if files > l.maxFiles {
+			return &decompressionLimitError{reason: fmt.Sprintf("it has more than %d files", l.maxFiles)}
+		}
+	}
+}
+
+// countingReader counts the bytes read from Reader.
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// decompressedSizeLimitReader fails once the ratio of the bytes read from
+// Reader to the bytes read from compressed exceeds maxRatio.
+type decompressedSizeLimitReader struct {
+	io.Reader
+	compressed *countingReader
+	maxRatio   float64
+	n          int64
+}
+
+func (r *decompressedSizeLimitReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += int64(n)
+	if r.n > decompressionRatioMinSize && float64(r.n) > r.maxRatio*float64(r.compressed.n) {
+		return n, &decompressionLimitError{
+			reason: fmt.Sprintf("%d compressed bytes expand to more than %d bytes, the maximum ratio is %v", r.compressed.n, r.n, r.maxRatio),
+		}
+	}
+	return n, err
+}
+
+// decompressionInspection checks the content that is written into it in the
+// background.
+type decompressionInspection struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func (l *decompressionLimits) startInspection() *decompressionInspection {
+	pr, pw := io.Pipe()
+	in := &decompressionInspection{
+		pw:   pw,
+		done: make(chan error, 1),
+	}
+	go func() {
+		err := l.check(pr)
+		if err != nil {
+			// The writes fail from now on.
+			_ = pr.CloseWithError(err)
+		} else {
+			// Consume the rest of the content, e.g. the padding of the tar
+			// archive.
+			_, _ = io.Copy(io.Discard, pr)
+		}
+		in.done <- err
+	}()
+	return in
+}
+
+func (in *decompressionInspection) Write(p []byte) (int, error) {
+	return in.pw.Write(p)
+}
+
+// finish waits for the result of the inspection of the content that was
+// written.
+func (in *decompressionInspection) finish() error {
+	_ = in.pw.Close()
+	return <-in.done
+}
+
+// abort stops the inspection.
+func (in *decompressionInspection) abort() {
+	_ = in.pw.CloseWithError(errDecompressionAborted)
+	<-in.done
+}
+
+// decompressionLimitedBlobStore rejects the blobs that exceed the
+// decompression limits. It needs to wrap the blob store of the storage, so
+// that the content of the chunked uploads can be read.
+type decompressionLimitedBlobStore struct {
+	distribution.BlobStore
+
+	limits *decompressionLimits
+	repo   *repository
+}
+
+var _ distribution.BlobStore = &decompressionLimitedBlobStore{}
+
+func (bs *decompressionLimitedBlobStore) Create(ctx context.Context, options ...distribution.BlobCreateOption) (distribution.BlobWriter, error) {
+	bw, err := bs.BlobStore.Create(ctx, options...)
+	if err != nil {
+		return nil, err
+	}
+	return &decompressionLimitedBlobWriter{
+		BlobWriter: bw,
+		ctx:        ctx,
+		limits:     bs.limits,
+		repo:       bs.repo,
+	}, nil
+}
+
+func (bs *decompressionLimitedBlobStore) Resume(ctx context.Context, id string) (distribution.BlobWriter, error) {
+	bw, err := bs.BlobStore.Resume(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return &decompressionLimitedBlobWriter{
+		BlobWriter: bw,
+		ctx:        ctx,
+		limits:     bs.limits,
+		repo:       bs.repo,
+	}, nil
+}
+
+// decompressionLimitedBlobWriter inspects the content while it is written if
+// the whole upload goes through it, i.e. it's written by the request that
+// completes the upload. The content of the uploads that are written by
+// several requests is read back from the storage once, when the upload is
+// committed.
+type decompressionLimitedBlobWriter struct {
+	distribution.BlobWriter
+
+	ctx    context.Context
+	limits *decompressionLimits
+	repo   *repository
+
+	inspection *decompressionInspection
+	// started is set after the first write.
+	started bool
+}
+
+// start starts the inspection on the first write if nothing was written by
+// the previous requests of the upload.
+func (bw *decompressionLimitedBlobWriter) start() {
+	if bw.started {
+		return
+	}
+	bw.started = true
+	if bw.BlobWriter.Size() == 0 {
+		bw.inspection = bw.limits.startInspection()
+	}
+}
+
+// rejected converts the failures of the inspection into the errors for the
+// clients.
+func (bw *decompressionLimitedBlobWriter) rejected(err error) error {
+	var limitErr *decompressionLimitError
+	if !errors.As(err, &limitErr) {
+		return err
+	}
+	dcontext.GetLogger(bw.ctx).Errorf("refusing to store the blob of the upload %s: %v", bw.BlobWriter.ID(), limitErr)
+	if bw.repo != nil {
+		bw.repo.pushRejectedEventf(bw.ctx, "Push of a layer was rejected: %v", limitErr)
+	}
+	return reportPayloadError(bw.ctx, errcode.ErrorCodeDenied.WithMessage(limitErr.Error()))
+}
+
+// inspect passes p to the inspection. The inspection fails the write only if
+// the limits are exceeded.
+func (bw *decompressionLimitedBlobWriter) inspect(p []byte) error {
+	if bw.inspection == nil {
+		return nil
+	}
+	if _, err := bw.inspection.Write(p); err != nil {
+		return bw.rejected(err)
+	}
+	return nil
+}
+
+func (bw *decompressionLimitedBlobWriter) Write(p []byte) (int, error) {
+	bw.start()
+	if err := bw.inspect(p); err != nil {
+		return 0, err
+	}
+	return bw.BlobWriter.Write(p)
+}
+
+func (bw *decompressionLimitedBlobWriter) ReadFrom(r io.Reader) (int64, error) {
+	bw.start()
+	if bw.inspection == nil {
+		return bw.BlobWriter.ReadFrom(r)
+	}
+	return bw.BlobWriter.ReadFrom(&inspectingReader{Reader: r, bw: bw})
+}
+
+// inspectingReader passes the content that is read from Reader to the
+// inspection of bw.
+type inspectingReader struct {
+	io.Reader
+	bw *decompressionLimitedBlobWriter
+}
+
+func (r *inspectingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		if inspectErr := r.bw.inspect(p[:n]); inspectErr != nil {
+			return 0, inspectErr
+		}
+	}
+	return n, err
+}
+
+// checkStored checks the content of the upload that was written by the
+// previous requests.
+func (bw *decompressionLimitedBlobWriter) checkStored() error {
+	if bw.BlobWriter.Size() == 0 {
+		return nil
+	}
+	rd, ok := bw.BlobWriter.(interface {
+		Reader() (io.ReadCloser, error)
+	})
+	if !ok {
+		dcontext.GetLogger(bw.ctx).Warnf("unable to check the decompression limits of the upload %s: the uploaded content cannot be read", bw.BlobWriter.ID())
+		return nil
+	}
+	r, err := rd.Reader()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return bw.limits.check(io.LimitReader(r, bw.BlobWriter.Size()))
+}
+
+func (bw *decompressionLimitedBlobWriter) Commit(ctx context.Context, provisional distribution.Descriptor) (distribution.Descriptor, error) {
+	var err error
+	if bw.inspection != nil {
+		err = bw.inspection.finish()
+		bw.inspection = nil
+	} else {
+		err = bw.checkStored()
+	}
+	if err != nil {
+		return distribution.Descriptor{}, bw.rejected(err)
+	}
+	return bw.BlobWriter.Commit(ctx, provisional)
+}
+
+func (bw *decompressionLimitedBlobWriter) Cancel(ctx context.Context) error {
+	bw.stop()
+	return bw.BlobWriter.Cancel(ctx)
+}
+
+func (bw *decompressionLimitedBlobWriter) Close() error {
+	bw.stop()
+	return bw.BlobWriter.Close()
+}
+
+// stop aborts the inspection of an upload that is not committed by this
+// request.
+func (bw *decompressionLimitedBlobWriter) stop() {
+	if bw.inspection != nil {
+		bw.inspection.abort()
+		bw.inspection = nil
+	}
+}
@@ -0,0 +1,225 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/openshift/image-registry/pkg/testutil"
+)
+
+// tarLayer returns a tar archive with files of the given sizes.
+func tarLayer(t *testing.T, sizes ...int) []byte {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for i, size := range sizes {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     fmt.Sprintf("file%d", i),
+			Mode:     0644,
+			Size:     int64(size),
+			Typeflag: tar.TypeReg,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(make([]byte, size)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func gzipLayer(t *testing.T, layer []byte) []byte {
+	buf := &bytes.Buffer{}
+	gw := gzip.NewWriter(buf)
+	if _, err := gw.Write(layer); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func zstdLayer(t *testing.T, layer []byte) []byte {
+	buf := &bytes.Buffer{}
+	zw, err := zstd.NewWriter(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := zw.Write(layer); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecompressionLimitsCheck(t *testing.T) {
+	limits := &decompressionLimits{
+		maxRatio: 100,
+		maxFiles: 10,
+	}
+
+	bomb := tarLayer(t, 2*decompressionRatioMinSize)
+	manyFiles := tarLayer(t, make([]int, 11)...)
+
+	testCases := []struct {
+		name    string
+		content []byte
+		bomb    bool
+	}{
+		{
+			name:    "gzip layer",
+			content: gzipLayer(t, tarLayer(t, 1024, 4096)),
+		},
+		{
+			name:    "small layer with a high ratio",
+			content: gzipLayer(t, tarLayer(t, decompressionRatioMinSize/2)),
+		},
+		{
+			name:    "gzip bomb",
+			content: gzipLayer(t, bomb),
+			bomb:    true,
+		},
+		{
+			name:    "zstd bomb",
+			content: zstdLayer(t, bomb),
+			bomb:    true,
+		},
+		{
+			name:    "too many files",
+			content: gzipLayer(t, manyFiles),
+			bomb:    true,
+		},
+		{
+			name:    "uncompressed layer with too many files",
+			content: manyFiles,
+			bomb:    true,
+		},
+		{
+			name:    "not a layer",
+			content: []byte(`{"architecture":"amd64"}`),
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := limits.check(bytes.NewReader(tc.content))
+			var limitErr *decompressionLimitError
+			if tc.bomb != errors.As(err, &limitErr) {
+				t.Fatalf("unexpected result: %v", err)
+			}
+			if !tc.bomb && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+// committingBlobWriter is a blob writer that keeps the content in memory
+// and can read it back.
+type committingBlobWriter struct {
+	bufferBlobWriter
+	committed bool
+	reads     int
+}
+
+func (bw *committingBlobWriter) ID() string { return "upload" }
+
+func (bw *committingBlobWriter) Close() error { return nil }
+
+func (bw *committingBlobWriter) Reader() (io.ReadCloser, error) {
+	bw.reads++
+	return io.NopCloser(bytes.NewReader(bw.buf.Bytes())), nil
+}
+
+func (bw *committingBlobWriter) Commit(ctx context.Context, provisional distribution.Descriptor) (distribution.Descriptor, error) {
+	bw.committed = true
+	return provisional, nil
+}
+
+func TestDecompressionLimitedBlobWriter(t *testing.T) {
+	ctx := testutil.WithTestLogger(context.Background(), t)
+	limits := &decompressionLimits{
+		maxRatio: 100,
+		maxFiles: 10,
+	}
+
+	layer := gzipLayer(t, tarLayer(t, 1024))
+	bomb := gzipLayer(t, tarLayer(t, 2*decompressionRatioMinSize))
+
+	newWriter := func(bw *committingBlobWriter) *decompressionLimitedBlobWriter {
+		return &decompressionLimitedBlobWriter{
+			BlobWriter: bw,
+			ctx:        ctx,
+			limits:     limits,
+		}
+	}
+
+	t.Run("layer", func(t *testing.T) {
+		bw := &committingBlobWriter{}
+		w := newWriter(bw)
+		if _, err := w.ReadFrom(bytes.NewReader(layer)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Commit(ctx, distribution.Descriptor{}); err != nil {
+			t.Fatal(err)
+		}
+		if !bw.committed {
+			t.Fatal("expected the blob to be committed")
+		}
+	})
+
+	t.Run("bomb", func(t *testing.T) {
+		bw := &committingBlobWriter{}
+		w := newWriter(bw)
+		_, err := w.ReadFrom(bytes.NewReader(bomb))
+		if !isErrorCode(err, errcode.ErrorCodeDenied) {
+			t.Fatalf("expected %v, got %v", errcode.ErrorCodeDenied, err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("chunked upload", func(t *testing.T) {
+		bw := &committingBlobWriter{}
+		chunks := [][]byte{bomb[:len(bomb)/3], bomb[len(bomb)/3 : 2*len(bomb)/3], bomb[2*len(bomb)/3:]}
+		for i, chunk := range chunks {
+			// Every chunk is written by another request.
+			w := newWriter(bw)
+			if _, err := w.Write(chunk); err != nil && i > 0 {
+				t.Fatalf("chunk %d: the content is checked before the upload is completed: %v", i, err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if bw.reads != 0 {
+			t.Errorf("the stored content is read %d times before the upload is completed", bw.reads)
+		}
+
+		_, err := newWriter(bw).Commit(ctx, distribution.Descriptor{})
+		if !isErrorCode(err, errcode.ErrorCodeDenied) {
+			t.Fatalf("expected %v, got %v", errcode.ErrorCodeDenied, err)
+		}
+		if bw.committed {
+			t.Fatal("expected the blob not to be committed")
+		}
+		if bw.reads != 1 {
+			t.Errorf("got %d reads of the stored content, want 1", bw.reads)
+		}
+	})
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	registryauth "github.com/distribution/distribution/v3/registry/auth"
+	"github.com/opencontainers/go-digest"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	kubecache "k8s.io/apimachinery/pkg/util/cache"
+
+	registryconfig "github.com/openshift/image-registry/pkg/dockerregistry/server/configuration"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/metrics"
+)
+
+// degradedModeDecisionsSize is the maximum number of remembered access
+// reviews.
+const degradedModeDecisionsSize = 4096
+
+// degradedMode serves the pulls of the content stored in the registry while
+// the API server is unreachable. The successful access reviews of pulls are
+// remembered, so that the clients can still be authorized during an outage.
+type degradedMode struct {
+	ttl       time.Duration
+	decisions *kubecache.LRUExpireCache
+	metrics   metrics.DegradedMode
+
+	mu     sync.Mutex
+	active bool
+}
+
+// newDegradedMode returns the degraded mode configured by cfg. It returns nil
+// if the degraded mode is disabled.
+func newDegradedMode(cfg *registryconfig.DegradedMode, m metrics.DegradedMode) *degradedMode {
+	if cfg == nil || !cfg.Enabled {
+		return nil
+	}
+	return &degradedMode{
+		ttl:       cfg.AuthCacheTTL,
+		decisions: kubecache.NewLRUExpireCache(degradedModeDecisionsSize),
+		metrics:   m,
+	}
+}
+
+// apiUnreachable returns true if err means that the API server cannot be
+// reached or cannot handle requests.
+func apiUnreachable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if kerrors.IsServiceUnavailable(err) || kerrors.IsServerTimeout(err) || kerrors.IsTimeout(err) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// pullDecisionKey returns the key of the access review of accessRecords for
+// the token. It returns false if the request is not a pull.
+func pullDecisionKey(req *http.Request, token string, accessRecords []registryauth.Access) (string, bool) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return "", false
+	}
+	if len(accessRecords) == 0 {
+		return "", false
+	}
+
+	repos := make([]string, 0, len(accessRecords))
+	for _, access := range accessRecords {
+		if access.Resource.Type != "repository" || access.Action != "pull" {
+			return "", false
+		}
+		repos = append(repos, access.Resource.Name)
+	}
+	sort.Strings(repos)
+
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:]) + " " + strings.Join(repos, " "), true
+}
+
+// enter switches the registry into the degraded mode because of err.
+func (d *degradedMode) enter(ctx context.Context, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.active {
+		return
+	}
+	d.active = true
+	d.metrics.Active(true)
+	dcontext.GetLogger(ctx).Errorf("DEGRADED MODE: the API server is unreachable (%v), only the pulls of the content stored in the registry are served until it is reachable again", err)
+}
+
+// leave switches the registry back into the normal mode.
+func (d *degradedMode) leave(ctx context.Context) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.active {
+		return
+	}
+	d.active = false
+	d.metrics.Active(false)
+	dcontext.GetLogger(ctx).Infof("DEGRADED MODE: the API server is reachable again, leaving the degraded mode")
+}
+
+// authorized remembers the successful authorizations of pulls and reuses
+// them when the authorization fails because the API server is unreachable.
+// authCtx and authErr are the results of the authorization of accessRecords.
+func (d *degradedMode) authorized(ctx context.Context, authCtx context.Context, authErr error, accessRecords []registryauth.Access) (context.Context, error) {
+	req, err := dcontext.GetRequest(ctx)
+	if err != nil {
+		return authCtx, authErr
+	}
+	token, err := getOpenShiftAPIToken(req)
+	if err != nil {
+		return authCtx, authErr
+	}
+	key, ok := pullDecisionKey(req, token, accessRecords)
+	if !ok {
+		return authCtx, authErr
+	}
+
+	if authErr == nil {
+		// The pulls are always reviewed by the API server.
+		d.leave(authCtx)
+		d.decisions.Add(key, struct{}{}, d.ttl)
+		return authCtx, nil
+	}
+
+	if !apiUnreachable(authErr) {
+		return authCtx, authErr
+	}
+	if _, ok := d.decisions.Get(key); !ok {
+		return authCtx, authErr
+	}
+
+	ctx = withRequestIDLogger(ctx)
+	d.enter(ctx, authErr)
+	d.metrics.Served("auth")
+	dcontext.GetLogger(ctx).Warnf("DEGRADED MODE: allowing the pull by the access review made within %s: %v", d.ttl, authErr)
+
+	return withAuthPerformed(ctx), nil
+}
+
+// degradedManifestService serves the manifests stored in the registry when
+// they cannot be checked against the image stream because the API server is
+// unreachable.
+type degradedManifestService struct {
+	distribution.ManifestService
+
+	local    distribution.ManifestService
+	degraded *degradedMode
+}
+
+var _ distribution.ManifestService = &degradedManifestService{}
+
+func (m *degradedManifestService) Exists(ctx context.Context, dgst digest.Digest) (bool, error) {
+	exists, err := m.ManifestService.Exists(ctx, dgst)
+	if !apiUnreachable(err) {
+		return exists, err
+	}
+
+	localExists, localErr := m.local.Exists(ctx, dgst)
+	if localErr != nil || !localExists {
+		return exists, err
+	}
+
+	m.served(ctx, dgst, err)
+	return true, nil
+}
+
+func (m *degradedManifestService) Get(ctx context.Context, dgst digest.Digest, options ...distribution.ManifestServiceOption) (distribution.Manifest, error) {
+	manifest, err := m.ManifestService.Get(ctx, dgst, options...)
+	if !apiUnreachable(err) {
+		return manifest, err
+	}
+
+	localManifest, localErr := m.local.Get(ctx, dgst, options...)
+	if localErr != nil {
+		dcontext.GetLogger(ctx).Debugf("DEGRADED MODE: the manifest %s is not stored in the registry: %v", dgst, localErr)
+		return manifest, err
+	}
+
+	m.served(ctx, dgst, err)
+	return localManifest, nil
+}
+
+func (m *degradedManifestService) served(ctx context.Context, dgst digest.Digest, err error) {
+	m.degraded.enter(ctx, err)
+	m.degraded.metrics.Served("manifest")
+	dcontext.GetLogger(ctx).Warnf("DEGRADED MODE: serving the manifest %s stored in the registry without checking the image stream: %v", dgst, err)
+}
@@ -0,0 +1,217 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	registryauth "github.com/distribution/distribution/v3/registry/auth"
+	"github.com/opencontainers/go-digest"
+
+	registryconfig "github.com/openshift/image-registry/pkg/dockerregistry/server/configuration"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/metrics"
+	metricstesting "github.com/openshift/image-registry/pkg/dockerregistry/server/metrics/testing"
+	"github.com/openshift/image-registry/pkg/testutil"
+	"github.com/openshift/image-registry/pkg/testutil/counter"
+)
+
+// errAPIUnreachable is the error of the client when the API server is down.
+var errAPIUnreachable = &url.Error{
+	Op:  "Post",
+	URL: "https://api.example.com:6443/apis/authorization.k8s.io/v1/selfsubjectaccessreviews",
+	Err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")},
+}
+
+func TestDegradedModeAuthorized(t *testing.T) {
+	ctx := testutil.WithTestLogger(context.Background(), t)
+
+	c, sink := metricstesting.NewCounterSink()
+	d := newDegradedMode(&registryconfig.DegradedMode{
+		Enabled:      true,
+		AuthCacheTTL: time.Minute,
+	}, metrics.NewMetrics(sink).DegradedMode())
+
+	pull := []registryauth.Access{
+		{Resource: registryauth.Resource{Type: "repository", Name: "ns/app"}, Action: "pull"},
+	}
+	push := []registryauth.Access{
+		{Resource: registryauth.Resource{Type: "repository", Name: "ns/app"}, Action: "push"},
+	}
+	authorize := func(method, token string, accessRecords []registryauth.Access, authErr error) error {
+		req := httptest.NewRequest(method, "/v2/ns/app/manifests/latest", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		reqCtx := dcontext.WithRequest(ctx, req)
+		authCtx, err := d.authorized(reqCtx, reqCtx, authErr, accessRecords)
+		if err == nil && authErr != nil && !authPerformed(authCtx) {
+			t.Errorf("expected the degraded authorization to be marked as performed")
+		}
+		return err
+	}
+
+	if err := authorize(http.MethodGet, "alice", pull, errAPIUnreachable); err == nil {
+		t.Fatal("expected the pull without a previous review to be denied")
+	}
+	if err := authorize(http.MethodGet, "alice", pull, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := authorize(http.MethodPut, "alice", push, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name          string
+		method        string
+		token         string
+		accessRecords []registryauth.Access
+		authErr       error
+		expectAllowed bool
+	}{
+		{
+			name:          "reviewed pull",
+			method:        http.MethodGet,
+			token:         "alice",
+			accessRecords: pull,
+			authErr:       errAPIUnreachable,
+			expectAllowed: true,
+		},
+		{
+			name:          "reviewed pull with HEAD",
+			method:        http.MethodHead,
+			token:         "alice",
+			accessRecords: pull,
+			authErr:       errAPIUnreachable,
+			expectAllowed: true,
+		},
+		{
+			name:          "another token",
+			method:        http.MethodGet,
+			token:         "bob",
+			accessRecords: pull,
+			authErr:       errAPIUnreachable,
+		},
+		{
+			name:          "push",
+			method:        http.MethodPut,
+			token:         "alice",
+			accessRecords: push,
+			authErr:       errAPIUnreachable,
+		},
+		{
+			name:          "access denied",
+			method:        http.MethodGet,
+			token:         "alice",
+			accessRecords: pull,
+			authErr:       ErrOpenShiftAccessDenied,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := authorize(tc.method, tc.token, tc.accessRecords, tc.authErr)
+			if tc.expectAllowed && err != nil {
+				t.Errorf("expected the request to be allowed, got %v", err)
+			}
+			if !tc.expectAllowed && err != tc.authErr {
+				t.Errorf("got error %v, want %v", err, tc.authErr)
+			}
+		})
+	}
+
+	if diff := c.Diff(counter.M{
+		"degraded_mode_active":        1,
+		"degraded_mode_requests:auth": 2,
+	}); diff != nil {
+		t.Error(diff)
+	}
+
+	if err := authorize(http.MethodGet, "alice", pull, nil); err != nil {
+		t.Fatal(err)
+	}
+	if diff := c.Diff(counter.M{
+		"degraded_mode_active":        0,
+		"degraded_mode_requests:auth": 2,
+	}); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestDegradedManifestService(t *testing.T) {
+	ctx := testutil.WithTestLogger(context.Background(), t)
+
+	stored := digest.Digest("sha256:0000000000000000000000000000000000000000000000000000000000000001")
+	missing := digest.Digest("sha256:0000000000000000000000000000000000000000000000000000000000000002")
+	manifest := &ocischema.DeserializedManifest{}
+
+	for _, tc := range []struct {
+		name           string
+		dgst           digest.Digest
+		err            error
+		expectManifest bool
+		expectServed   int
+	}{
+		{
+			name:           "API server is unreachable",
+			dgst:           stored,
+			err:            errAPIUnreachable,
+			expectManifest: true,
+			expectServed:   1,
+		},
+		{
+			name: "manifest is not stored",
+			dgst: missing,
+			err:  errAPIUnreachable,
+		},
+		{
+			name: "manifest is not in the image stream",
+			dgst: stored,
+			err:  distribution.ErrManifestUnknownRevision{Name: "ns/app", Revision: stored},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, sink := metricstesting.NewCounterSink()
+			ms := testutil.NewFakeManifestService("ns/app", nil)
+			ms.SetError("Get", tc.err)
+			ms.SetError("Exists", tc.err)
+			dms := &degradedManifestService{
+				ManifestService: ms,
+				local: testutil.NewFakeManifestService("ns/app", map[digest.Digest]distribution.Manifest{
+					stored: manifest,
+				}),
+				degraded: newDegradedMode(&registryconfig.DegradedMode{Enabled: true}, metrics.NewMetrics(sink).DegradedMode()),
+			}
+
+			got, err := dms.Get(ctx, tc.dgst)
+			if tc.expectManifest {
+				if err != nil || got != manifest {
+					t.Errorf("got manifest %v and error %v, want the stored manifest", got, err)
+				}
+			} else if err != tc.err {
+				t.Errorf("got error %v, want %v", err, tc.err)
+			}
+
+			exists, err := dms.Exists(ctx, tc.dgst)
+			if tc.expectManifest {
+				if err != nil || !exists {
+					t.Errorf("got exists=%t and error %v, want the stored manifest", exists, err)
+				}
+			} else if err != tc.err {
+				t.Errorf("got error %v, want %v", err, tc.err)
+			}
+
+			expected := counter.M{}
+			if tc.expectServed > 0 {
+				expected["degraded_mode_active"] = 1
+				expected["degraded_mode_requests:manifest"] = 2 * tc.expectServed
+			}
+			if diff := c.Diff(expected); diff != nil {
+				t.Error(diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,463 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime/pprof"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/distribution/distribution/v3/registry/auth"
+	"github.com/distribution/distribution/v3/registry/client/auth/challenge"
+	"github.com/distribution/distribution/v3/registry/handlers"
+	gorillahandlers "github.com/gorilla/handlers"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/api"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/cache"
+	registryconfig "github.com/openshift/image-registry/pkg/dockerregistry/server/configuration"
+	"github.com/openshift/image-registry/pkg/version"
+)
+
+// diagnosticsContentType is the media type of the diagnostics bundle.
+const diagnosticsContentType = "application/gzip"
+
+// redactedValue replaces the secrets in the configuration of the bundles.
+const redactedValue = "<redacted>"
+
+// diagnostics collects the state of the registry into bundles that can be
+// attached to support cases, so that the problems can be investigated
+// without a live debugging session on the cluster.
+type diagnostics struct {
+	dockerConfig *configuration.Configuration
+	extraConfig  *registryconfig.Configuration
+	logs         *logRing
+}
+
+// newDiagnostics returns the diagnostics of the registry configured by
+// dockerConfig and extraConfig. The entries of logger are kept in memory from
+// now on. It returns nil if the diagnostics are disabled.
+func newDiagnostics(logger *log.Logger, dockerConfig *configuration.Configuration, extraConfig *registryconfig.Configuration) *diagnostics {
+	if !extraConfig.Diagnostics.Enabled {
+		return nil
+	}
+	d := &diagnostics{
+		dockerConfig: dockerConfig,
+		extraConfig:  extraConfig,
+		logs:         newLogRing(extraConfig.Diagnostics.LogEntries),
+	}
+	logger.AddHook(d.logs)
+	return d
+}
+
+// logRing is a logrus hook that keeps the most recent log entries.
+type logRing struct {
+	formatter log.Formatter
+
+	mu      sync.Mutex
+	entries [][]byte
+	next    int
+	full    bool
+}
+
+func newLogRing(size int) *logRing {
+	return &logRing{
+		formatter: &log.TextFormatter{
+			DisableColors:   true,
+			FullTimestamp:   true,
+			TimestampFormat: time.RFC3339Nano,
+		},
+		entries: make([][]byte, size),
+	}
+}
+
+func (r *logRing) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (r *logRing) Fire(entry *log.Entry) error {
+	line, err := r.formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.entries[r.next] = line
+	r.next++
+	if r.next == len(r.entries) {
+		r.next = 0
+		r.full = true
+	}
+	return nil
+}
+
+// lines returns the kept entries from the oldest to the newest.
+func (r *logRing) lines() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var buf bytes.Buffer
+	if r.full {
+		for _, line := range r.entries[r.next:] {
+			buf.Write(line)
+		}
+	}
+	for _, line := range r.entries[:r.next] {
+		buf.Write(line)
+	}
+	return buf.Bytes()
+}
+
+// redactedConfig returns the YAML representation of cfg without the values
+// of the fields that may contain secrets.
+func redactedConfig(cfg interface{}) ([]byte, error) {
+	data, err := yaml.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	if err := yaml.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(redact(v, nil))
+}
+
+// redact replaces the values of the secret fields of v. path is the path of v
+// in the configuration.
+func redact(v interface{}, path []string) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		for key, value := range v {
+			name, ok := key.(string)
+			if !ok {
+				v[key] = redact(value, path)
+				continue
+			}
+			fieldPath := append(path[:len(path):len(path)], strings.ToLower(name))
+			if isSecretField(fieldPath) {
+				if value != nil && value != "" {
+					v[key] = redactedValue
+				}
+				continue
+			}
+			v[key] = redact(value, fieldPath)
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = redact(v[i], path)
+		}
+	}
+	return v
+}
+
+// storageSections are the sections of the storage configuration that are not
+// storage drivers.
+var storageSections = map[string]bool{
+	"cache":       true,
+	"delete":      true,
+	"maintenance": true,
+	"redirect":    true,
+	"tag":         true,
+}
+
+// The parameters of the storage drivers, redis and the proxy are redacted
+// unless they are known not to hold secrets, as the storage drivers define
+// their own parameters.
+var (
+	storageParameters = map[string]bool{
+		"accelerate":                  true,
+		"accountname":                 true,
+		"bucket":                      true,
+		"chunksize":                   true,
+		"container":                   true,
+		"domain":                      true,
+		"encrypt":                     true,
+		"forcepathstyle":              true,
+		"insecureskipverify":          true,
+		"loglevel":                    true,
+		"maxthreads":                  true,
+		"multipartcopychunksize":      true,
+		"multipartcopymaxconcurrency": true,
+		"multipartcopythresholdsize":  true,
+		"objectacl":                   true,
+		"prefix":                      true,
+		"realm":                       true,
+		"region":                      true,
+		"regionendpoint":              true,
+		"rootdirectory":               true,
+		"secure":                      true,
+		"skipverify":                  true,
+		"storageclass":                true,
+		"tenant":                      true,
+		"usedualstack":                true,
+		"v4auth":                      true,
+	}
+	redisParameters = map[string]bool{
+		"addr":         true,
+		"db":           true,
+		"dialtimeout":  true,
+		"enabled":      true,
+		"idletimeout":  true,
+		"maxactive":    true,
+		"maxidle":      true,
+		"pool":         true,
+		"readtimeout":  true,
+		"tls":          true,
+		"writetimeout": true,
+	}
+	proxyParameters = map[string]bool{
+		"remoteurl": true,
+		"ttl":       true,
+	}
+)
+
+// isSecretField returns true if the configuration field at path may hold a
+// secret, e.g. http.secret, the keys and the tokens of the storage drivers, the
+// passwords of redis and the headers of the notification endpoints. The
+// sections are kept if they are known not to hold secrets.
+func isSecretField(path []string) bool {
+	name := path[len(path)-1]
+	switch name {
+	case "secrets", "authorization", "credentials":
+		return true
+	}
+	for _, suffix := range []string{"secret", "password", "key", "token"} {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+
+	switch {
+	case path[0] == "storage" && len(path) > 2 && !storageSections[path[1]]:
+		return !storageParameters[name]
+	case path[0] == "notifications" && len(path) > 3 && path[len(path)-2] == "headers":
+		return true
+	case path[0] == "redis" && len(path) > 1:
+		return !redisParameters[name]
+	case path[0] == "proxy" && len(path) > 1:
+		return !proxyParameters[name]
+	}
+	return false
+}
+
+// diagnosticsUpstreams describes the state of the connections to the
+// upstream registries.
+type diagnosticsUpstreams struct {
+	// DegradedMode is true if the registry serves only the content stored
+	// in it because the API server is unreachable. It is omitted if the
+	// degraded mode is disabled.
+	DegradedMode *bool `json:"degradedMode,omitempty"`
+	// BasicAuthHosts are the registries that are configured to be accessed
+	// with Basic authentication.
+	BasicAuthHosts []string `json:"basicAuthHosts,omitempty"`
+	// AuthSchemes are the auth schemes chosen for the upstream registries,
+	// keyed by their endpoints.
+	AuthSchemes map[string]string `json:"authSchemes"`
+	// Mirrors is the health of the upstream registries, keyed by their
+	// hosts. It is omitted if the mirrors are tried in their declared
+	// order.
+	Mirrors map[string]mirrorHealthStatus `json:"mirrors,omitempty"`
+}
+
+// diagnosticsCache describes the digest cache of the registry.
+type diagnosticsCache struct {
+	Disabled bool                 `json:"disabled"`
+	Backend  string               `json:"backend"`
+	Stats    *cache.SnapshotStats `json:"stats,omitempty"`
+	Error    string               `json:"error,omitempty"`
+}
+
+func (app *App) registerDiagnosticsHandler(dockerApp *handlers.App) {
+	extensionsRouter := dockerApp.NewRoute().PathPrefix(api.ExtensionsPrefix).Subrouter()
+	getAccess := func(r *http.Request) []auth.Access {
+		return []auth.Access{
+			{
+				Resource: auth.Resource{
+					Type: "diagnostics",
+				},
+				Action: "get",
+			},
+		}
+	}
+	dockerApp.RegisterRoute(
+		"extensions-diagnostics",
+		// GET /extensions/v2/diagnostics
+		extensionsRouter.Path(api.DiagnosticsPath).Methods("GET"),
+		app.diagnosticsDispatcher,
+		handlers.NameNotRequired,
+		getAccess,
+	)
+}
+
+// diagnosticsDispatcher takes the request context and builds the handler for
+// the diagnostics bundle requests.
+func (app *App) diagnosticsDispatcher(ctx *handlers.Context, r *http.Request) http.Handler {
+	diagnosticsHandler := &diagnosticsHandler{
+		Context: ctx,
+		app:     app,
+	}
+
+	return gorillahandlers.MethodHandler{
+		"GET": http.HandlerFunc(diagnosticsHandler.Get),
+	}
+}
+
+// diagnosticsHandler serves the diagnostics bundles.
+type diagnosticsHandler struct {
+	*handlers.Context
+
+	app *App
+}
+
+// Get sends a gzipped tar archive with the redacted configuration, the recent
+// log entries, the cache statistics, the goroutine and heap profiles and the
+// state of the upstream registries.
+func (h *diagnosticsHandler) Get(w http.ResponseWriter, req *http.Request) {
+	dcontext.GetLogger(h).Debugf("(*diagnosticsHandler).Get")
+
+	files, err := h.app.diagnosticsFiles()
+	if err != nil {
+		h.Errors = append(h.Errors, errcode.ErrorCodeUnknown.WithDetail(fmt.Sprintf("unable to collect diagnostics: %v", err)))
+		return
+	}
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, f := range files {
+		if err := writeTarFile(tw, f.name, f.data); err != nil {
+			h.Errors = append(h.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+			return
+		}
+	}
+	if err := tw.Close(); err != nil {
+		h.Errors = append(h.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+	if err := gw.Close(); err != nil {
+		h.Errors = append(h.Errors, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+
+	name := "registry-diagnostics-" + time.Now().UTC().Format("20060102T150405Z") + ".tar.gz"
+	w.Header().Set("Content-Type", diagnosticsContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	w.Header().Set("Content-Length", fmt.Sprint(buf.Len()))
+	w.WriteHeader(http.StatusOK)
+	_, _ = buf.WriteTo(w)
+}
+
+// diagnosticsFile is a file of the diagnostics bundle.
+type diagnosticsFile struct {
+	name string
+	data []byte
+}
+
+// diagnosticsFiles collects the files of a diagnostics bundle.
+func (app *App) diagnosticsFiles() ([]diagnosticsFile, error) {
+	var files []diagnosticsFile
+	add := func(name string, data []byte) {
+		files = append(files, diagnosticsFile{name: name, data: data})
+	}
+	addJSON := func(name string, v interface{}) error {
+		data, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		add(name, append(data, '\n'))
+		return nil
+	}
+
+	dockerConfig, err := redactedConfig(app.diagnostics.dockerConfig)
+	if err != nil {
+		return nil, fmt.Errorf("config.yaml: %w", err)
+	}
+	extraConfig, err := redactedConfig(app.diagnostics.extraConfig)
+	if err != nil {
+		return nil, fmt.Errorf("config.yaml: %w", err)
+	}
+	add("config.yaml", append(append(dockerConfig, "---\n# effective openshift configuration\n"...), extraConfig...))
+
+	if err := addJSON("version.json", version.Get()); err != nil {
+		return nil, err
+	}
+
+	add("logs.txt", app.diagnostics.logs.lines())
+
+	if err := addJSON("cache.json", app.cacheDiagnostics()); err != nil {
+		return nil, err
+	}
+
+	if err := addJSON("upstreams.json", app.upstreamDiagnostics()); err != nil {
+		return nil, err
+	}
+
+	var goroutines bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&goroutines, 2); err != nil {
+		return nil, fmt.Errorf("goroutine.txt: %w", err)
+	}
+	add("goroutine.txt", goroutines.Bytes())
+
+	var heap bytes.Buffer
+	if err := pprof.Lookup("heap").WriteTo(&heap, 0); err != nil {
+		return nil, fmt.Errorf("heap.pb.gz: %w", err)
+	}
+	add("heap.pb.gz", heap.Bytes())
+
+	return files, nil
+}
+
+func (app *App) cacheDiagnostics() diagnosticsCache {
+	d := diagnosticsCache{
+		Disabled: app.config.Cache.Disabled,
+		Backend:  app.config.Cache.Backend,
+	}
+	data, err := app.cache.Snapshot()
+	if err == nil {
+		var stats cache.SnapshotStats
+		stats, err = cache.StatsOfSnapshot(data)
+		d.Stats = &stats
+	}
+	if err != nil {
+		d.Stats = nil
+		d.Error = err.Error()
+	}
+	return d
+}
+
+func (app *App) upstreamDiagnostics() diagnosticsUpstreams {
+	d := diagnosticsUpstreams{
+		AuthSchemes: make(map[string]string),
+	}
+	if app.degraded != nil {
+		app.degraded.mu.Lock()
+		active := app.degraded.active
+		app.degraded.mu.Unlock()
+		d.DegradedMode = &active
+	}
+	for host := range app.authChallenges.basicHosts {
+		d.BasicAuthHosts = append(d.BasicAuthHosts, host)
+	}
+	sort.Strings(d.BasicAuthHosts)
+	for _, key := range app.authChallenges.cache.Keys() {
+		if c, ok := app.authChallenges.cache.Get(key); ok {
+			d.AuthSchemes[key.(string)] = strings.ToLower(c.(challenge.Challenge).Scheme)
+		}
+	}
+	if app.mirrorHealth != nil {
+		d.Mirrors = app.mirrorHealth.status()
+	}
+	return d
+}
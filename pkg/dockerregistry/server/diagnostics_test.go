@@ -0,0 +1,261 @@
+package server
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/distribution/distribution/v3/configuration"
+	log "github.com/sirupsen/logrus"
+
+	registryclient "github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+	srvconfig "github.com/openshift/image-registry/pkg/dockerregistry/server/configuration"
+	"github.com/openshift/image-registry/pkg/testutil"
+)
+
+func TestLogRing(t *testing.T) {
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+	ring := newLogRing(3)
+	logger.AddHook(ring)
+
+	logger.Info("first")
+	if lines := string(ring.lines()); !strings.Contains(lines, "msg=first") || strings.Count(lines, "\n") != 1 {
+		t.Errorf("got lines %q, want the first entry", lines)
+	}
+
+	for _, msg := range []string{"second", "third", "fourth", "fifth"} {
+		logger.Info(msg)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(ring.lines()), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("got %d lines, want 3: %q", len(lines), lines)
+	}
+	for i, msg := range []string{"third", "fourth", "fifth"} {
+		if !strings.Contains(lines[i], "msg="+msg) {
+			t.Errorf("line %d: got %q, want the entry %q", i, lines[i], msg)
+		}
+	}
+}
+
+func TestRedactedConfig(t *testing.T) {
+	cfg := &configuration.Configuration{
+		Storage: configuration.Storage{
+			"s3": configuration.Parameters{
+				"bucket":    "registry",
+				"accesskey": "AKIA",
+				"secretkey": "s3cr3t",
+			},
+		},
+	}
+	cfg.HTTP.Secret = "http-secret"
+	cfg.Redis.Password = "redis-password"
+	cfg.Notifications.Endpoints = []configuration.Endpoint{
+		{
+			Name:    "listener",
+			URL:     "https://listener.example.com/events",
+			Headers: http.Header{"Authorization": []string{"Bearer token"}},
+		},
+	}
+
+	data, err := redactedConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(data)
+	for _, secret := range []string{"AKIA", "s3cr3t", "http-secret", "redis-password", "Bearer token"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("the secret %q is not redacted:\n%s", secret, out)
+		}
+	}
+	for _, value := range []string{"bucket: registry", "https://listener.example.com/events", redactedValue} {
+		if !strings.Contains(out, value) {
+			t.Errorf("expected %q in the redacted configuration:\n%s", value, out)
+		}
+	}
+}
+
+func TestRedactedStorageConfig(t *testing.T) {
+	for _, tc := range []struct {
+		parameters configuration.Parameters
+		secrets    []string
+		kept       []string
+	}{
+		{
+			parameters: configuration.Parameters{
+				"accountname": "registryaccount",
+				"accountkey":  "azure-account-key",
+				"container":   "registry",
+				"credentials": map[interface{}]interface{}{
+					"type":     "client_secret",
+					"clientid": "azure-client-id",
+					"secret":   "azure-client-secret",
+				},
+			},
+			secrets: []string{"azure-account-key", "azure-client-id", "azure-client-secret"},
+			kept:    []string{"accountname: registryaccount", "container: registry"},
+		},
+		{
+			parameters: configuration.Parameters{
+				"bucket":         "registry",
+				"region":         "us-east-1",
+				"accesskey":      "AKIA",
+				"secretkey":      "s3cr3t",
+				"sessiontoken":   "s3-session-token",
+				"keyid":          "arn:aws:kms:key",
+				"regionendpoint": "https://s3.example.com",
+			},
+			secrets: []string{"AKIA", "s3cr3t", "s3-session-token", "arn:aws:kms:key"},
+			kept:    []string{"bucket: registry", "region: us-east-1", "regionendpoint: https://s3.example.com"},
+		},
+	} {
+		cfg := &configuration.Configuration{
+			Storage: configuration.Storage{
+				"driver": tc.parameters,
+			},
+		}
+		cfg.Redis.Addr = "redis:6379"
+		cfg.Proxy.RemoteURL = "https://upstream.example.com"
+		cfg.Proxy.Username = "proxy-user"
+
+		data, err := redactedConfig(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := string(data)
+		for _, secret := range append(tc.secrets, "proxy-user") {
+			if strings.Contains(out, secret) {
+				t.Errorf("the secret %q is not redacted:\n%s", secret, out)
+			}
+		}
+		for _, value := range append(tc.kept, "addr: redis:6379", "remoteurl: https://upstream.example.com") {
+			if !strings.Contains(out, value) {
+				t.Errorf("expected %q in the redacted configuration:\n%s", value, out)
+			}
+		}
+	}
+}
+
+func TestDiagnosticsBundle(t *testing.T) {
+	ctx := context.Background()
+	ctx = testutil.WithTestLogger(ctx, t)
+
+	_, imageClient := testutil.NewFakeOpenShiftWithClient(ctx)
+	osclient, err := registryclient.NewFakeRegistryClient(imageClient).Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx = withAppMiddleware(ctx, &fakeAccessControllerMiddleware{t: t, userClient: osclient})
+
+	dockercfg := &configuration.Configuration{
+		Loglevel: "debug",
+		Auth: map[string]configuration.Parameters{
+			"openshift": nil,
+		},
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"maintenance": configuration.Parameters{
+				"uploadpurging": map[interface{}]interface{}{
+					"enabled": false,
+				},
+			},
+		},
+		Middleware: map[string][]configuration.Middleware{
+			"registry":   {{Name: "openshift"}},
+			"repository": {{Name: "openshift"}},
+			"storage":    {{Name: "openshift"}},
+		},
+	}
+	dockercfg.HTTP.Secret = "http-secret"
+	cfg := &srvconfig.Configuration{
+		Server: &srvconfig.Server{
+			Addr: "localhost:5000",
+		},
+		Diagnostics: &srvconfig.Diagnostics{
+			Enabled: true,
+		},
+	}
+	if err := srvconfig.InitExtraConfig(dockercfg, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	app := NewApp(ctx, registryclient.NewFakeRegistryClient(imageClient), dockercfg, cfg, nil)
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	// The registry logs through the standard logger outside of the tests.
+	log.Info("diagnostics test marker")
+
+	resp, err := http.Get(server.URL + "/extensions/v2/diagnostics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != diagnosticsContentType {
+		t.Errorf("got content type %q, want %q", ct, diagnosticsContentType)
+	}
+
+	gr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[hdr.Name] = string(data)
+	}
+
+	for _, name := range []string{"config.yaml", "version.json", "logs.txt", "cache.json", "upstreams.json", "goroutine.txt", "heap.pb.gz"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("the bundle has no file %s", name)
+		}
+	}
+	if strings.Contains(files["config.yaml"], "http-secret") {
+		t.Errorf("the http secret is not redacted:\n%s", files["config.yaml"])
+	}
+	if !strings.Contains(files["config.yaml"], "diagnostics:") {
+		t.Errorf("config.yaml doesn't contain the openshift configuration:\n%s", files["config.yaml"])
+	}
+	if !strings.Contains(files["logs.txt"], "diagnostics test marker") {
+		t.Errorf("logs.txt doesn't contain the recent log entries:\n%s", files["logs.txt"])
+	}
+	if !strings.Contains(files["goroutine.txt"], "goroutine ") {
+		t.Errorf("goroutine.txt doesn't contain the goroutines")
+	}
+
+	var cacheInfo diagnosticsCache
+	if err := json.Unmarshal([]byte(files["cache.json"]), &cacheInfo); err != nil {
+		t.Fatal(err)
+	}
+	if cacheInfo.Stats == nil || cacheInfo.Error != "" {
+		t.Errorf("got cache diagnostics %#+v, want the statistics of the in-memory cache", cacheInfo)
+	}
+
+	var upstreams diagnosticsUpstreams
+	if err := json.Unmarshal([]byte(files["upstreams.json"]), &upstreams); err != nil {
+		t.Fatal(err)
+	}
+	if upstreams.AuthSchemes == nil {
+		t.Errorf("got upstream diagnostics %#+v, want the auth schemes", upstreams)
+	}
+}
@@ -0,0 +1,23 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// dryRunHeader is the request header that turns a manifest push into a dry
+// run. The manifest is verified as usual, but neither the manifest nor the
+// Image and ImageStreamMapping objects are created. Only cluster-wide image
+// creators are allowed to use it.
+const dryRunHeader = "OpenShift-Dry-Run"
+
+// isDryRunRequest reports whether req is a manifest push that asks for a dry
+// run.
+func isDryRunRequest(req *http.Request) bool {
+	if req.Method != http.MethodPut || !strings.Contains(req.URL.Path, "/manifests/") {
+		return false
+	}
+	dryRun, err := strconv.ParseBool(req.Header.Get(dryRunHeader))
+	return err == nil && dryRun
+}
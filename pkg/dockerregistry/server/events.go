@@ -0,0 +1,128 @@
+package server
+
+import (
+	"context"
+	"os"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	kubescheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+
+	imageapiv1 "github.com/openshift/api/image/v1"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+)
+
+// eventSourceComponent is the component that is reported as the source of
+// the events of the registry.
+const eventSourceComponent = "image-registry"
+
+// eventRecorder creates Kubernetes events for the pod of the registry and
+// for image streams, so that cluster administrators and project users can see
+// what the registry did. The events are sent in the background, and the
+// correlator of the broadcaster aggregates the similar events and limits
+// their rate, so a client that repeats a rejected push doesn't create an event
+// for every request.
+type eventRecorder struct {
+	broadcaster record.EventBroadcaster
+	recorder    record.EventRecorder
+	namespace   string
+	pod         string
+}
+
+func newEventRecorder(c client.EventsGetter, namespace, pod string) *eventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&eventSink{client: c})
+	return &eventRecorder{
+		broadcaster: broadcaster,
+		recorder: broadcaster.NewRecorder(kubescheme.Scheme, corev1.EventSource{
+			Component: eventSourceComponent,
+			Host:      pod,
+		}),
+		namespace: namespace,
+		pod:       pod,
+	}
+}
+
+// newEventRecorder returns the recorder of the events for the registry pod
+// that runs app.
+func (app *App) newEventRecorder(c client.EventsGetter) (*eventRecorder, error) {
+	namespace, err := registryNamespace(app.config.Coordination.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	pod, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	return newEventRecorder(c, namespace, pod), nil
+}
+
+// Eventf records an event of eventType (corev1.EventTypeNormal or
+// corev1.EventTypeWarning) for the registry pod. If r is nil, nothing is
+// recorded.
+func (r *eventRecorder) Eventf(ctx context.Context, eventType, reason, messageFmt string, args ...interface{}) {
+	if r == nil {
+		return
+	}
+
+	r.recorder.Eventf(&corev1.ObjectReference{
+		APIVersion: "v1",
+		Kind:       "Pod",
+		Namespace:  r.namespace,
+		Name:       r.pod,
+	}, eventType, reason, messageFmt, args...)
+}
+
+// ImageStreamEventf records an event for the image stream namespace/name. If
+// r is nil, nothing is recorded.
+func (r *eventRecorder) ImageStreamEventf(ctx context.Context, namespace, name, eventType, reason, messageFmt string, args ...interface{}) {
+	if r == nil {
+		return
+	}
+
+	r.recorder.Eventf(&corev1.ObjectReference{
+		APIVersion: imageapiv1.GroupVersion.String(),
+		Kind:       "ImageStream",
+		Namespace:  namespace,
+		Name:       name,
+	}, eventType, reason, messageFmt, args...)
+}
+
+// eventSink sends the events of the broadcaster to the API server. The
+// errors are logged and retried by the broadcaster.
+type eventSink struct {
+	client client.EventsGetter
+}
+
+var _ record.EventSink = &eventSink{}
+
+func (s *eventSink) Create(event *corev1.Event) (*corev1.Event, error) {
+	ctx := context.Background()
+	e, err := s.client.Events(event.Namespace).Create(ctx, event, metav1.CreateOptions{})
+	if err != nil {
+		dcontext.GetLogger(ctx).Warnf("unable to create the event %s for %s %s/%s: %v", event.Reason, event.InvolvedObject.Kind, event.Namespace, event.InvolvedObject.Name, err)
+	}
+	return e, err
+}
+
+func (s *eventSink) Update(event *corev1.Event) (*corev1.Event, error) {
+	ctx := context.Background()
+	e, err := s.client.Events(event.Namespace).Update(ctx, event, metav1.UpdateOptions{})
+	if err != nil {
+		dcontext.GetLogger(ctx).Warnf("unable to update the event %s for %s %s/%s: %v", event.Reason, event.InvolvedObject.Kind, event.Namespace, event.InvolvedObject.Name, err)
+	}
+	return e, err
+}
+
+func (s *eventSink) Patch(event *corev1.Event, data []byte) (*corev1.Event, error) {
+	ctx := context.Background()
+	e, err := s.client.Events(event.Namespace).Patch(ctx, event.Name, types.StrategicMergePatchType, data, metav1.PatchOptions{})
+	if err != nil {
+		dcontext.GetLogger(ctx).Warnf("unable to update the event %s for %s %s/%s: %v", event.Reason, event.InvolvedObject.Kind, event.Namespace, event.InvolvedObject.Name, err)
+	}
+	return e, err
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+	"github.com/openshift/image-registry/pkg/testutil"
+)
+
+// eventsClient keeps the created events in memory.
+type eventsClient struct {
+	mu     sync.Mutex
+	events map[string][]corev1.Event
+}
+
+func (c *eventsClient) Events(namespace string) client.EventInterface {
+	return &namespacedEventsClient{eventsClient: c, namespace: namespace}
+}
+
+// list returns the events created in the namespace.
+func (c *eventsClient) list(namespace string) []corev1.Event {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]corev1.Event(nil), c.events[namespace]...)
+}
+
+// wait returns the events in the namespace once there are n of them. The
+// events are sent in the background.
+func (c *eventsClient) wait(t *testing.T, namespace string, n int) []corev1.Event {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		events := c.list(namespace)
+		if len(events) >= n || time.Now().After(deadline) {
+			return events
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+type namespacedEventsClient struct {
+	*eventsClient
+	namespace string
+}
+
+func (c *namespacedEventsClient) Create(ctx context.Context, event *corev1.Event, opts metav1.CreateOptions) (*corev1.Event, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.events == nil {
+		c.events = make(map[string][]corev1.Event)
+	}
+	c.events[c.namespace] = append(c.events[c.namespace], *event)
+	return event, nil
+}
+
+func (c *namespacedEventsClient) Update(ctx context.Context, event *corev1.Event, opts metav1.UpdateOptions) (*corev1.Event, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, e := range c.events[c.namespace] {
+		if e.Name == event.Name {
+			c.events[c.namespace][i] = *event
+			return event, nil
+		}
+	}
+	return nil, fmt.Errorf("event %s not found", event.Name)
+}
+
+func (c *namespacedEventsClient) Patch(ctx context.Context, name string, pt types.PatchType, data []byte, opts metav1.PatchOptions, subresources ...string) (*corev1.Event, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, e := range c.events[c.namespace] {
+		if e.Name == name {
+			// The patches of the correlator replace the fields.
+			if err := json.Unmarshal(data, &e); err != nil {
+				return nil, err
+			}
+			c.events[c.namespace][i] = e
+			return &e, nil
+		}
+	}
+	return nil, fmt.Errorf("event %s not found", name)
+}
+
+func TestEventRecorderCorrelatesEvents(t *testing.T) {
+	ctx := testutil.WithTestLogger(context.Background(), t)
+	ec := &eventsClient{}
+	r := newEventRecorder(ec, "openshift-image-registry", "image-registry-1")
+
+	// A client that retries a rejected push doesn't create an event for
+	// every request.
+	for i := 0; i < 5; i++ {
+		r.ImageStreamEventf(ctx, "myproject", "app", corev1.EventTypeWarning, imagePushRejectedReason, "Push of a layer was rejected: %s", "limit exceeded")
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	var events []corev1.Event
+	for {
+		events = ec.list("myproject")
+		if len(events) == 1 && events[0].Count == 5 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(events) != 1 {
+		t.Fatalf("got %d events, want 1", len(events))
+	}
+	e := events[0]
+	if e.Count != 5 {
+		t.Errorf("got count %d, want 5", e.Count)
+	}
+	if e.InvolvedObject.Kind != "ImageStream" || e.InvolvedObject.Name != "app" || !strings.Contains(e.Message, "limit exceeded") {
+		t.Errorf("unexpected event: %+v", e)
+	}
+	if e.Source.Component != eventSourceComponent || e.Source.Host != "image-registry-1" {
+		t.Errorf("unexpected source: %+v", e.Source)
+	}
+}
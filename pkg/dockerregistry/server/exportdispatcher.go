@@ -0,0 +1,266 @@
+package server
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/manifest/manifestlist"
+	"github.com/distribution/distribution/v3/manifest/schema1"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	v2 "github.com/distribution/distribution/v3/registry/api/v2"
+	"github.com/distribution/distribution/v3/registry/handlers"
+	gorillahandlers "github.com/gorilla/handlers"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ociv1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	rerrors "github.com/openshift/image-registry/pkg/errors"
+)
+
+// exportContentType is the media type of the image export archive.
+const exportContentType = "application/x-tar"
+
+// exportManifest is a manifest that is written into the export archive.
+type exportManifest struct {
+	desc    distribution.Descriptor
+	payload []byte
+}
+
+type exportHandler struct {
+	ctx *handlers.Context
+}
+
+// NewExportDispatcher provides a function that handles the GET requests for
+// the export endpoint.
+func NewExportDispatcher() func(*handlers.Context, *http.Request) http.Handler {
+	return func(ctx *handlers.Context, r *http.Request) http.Handler {
+		exportHandler := &exportHandler{
+			ctx: ctx,
+		}
+		return gorillahandlers.MethodHandler{
+			"GET": http.HandlerFunc(exportHandler.Get),
+		}
+	}
+}
+
+// Get streams the image referenced by the tag as an OCI image layout archive.
+// All manifests and blobs are resolved before anything is written, so errors
+// about missing content are still reported to the client.
+func (h *exportHandler) Get(w http.ResponseWriter, req *http.Request) {
+	dcontext.GetLogger(h.ctx).Debugf("(*exportHandler).Get")
+
+	tag := req.URL.Query().Get("tag")
+	if len(tag) == 0 {
+		h.handleError(h.ctx, v2.ErrorCodeTagInvalid.WithDetail("tag parameter is required"), w)
+		return
+	}
+
+	desc, err := h.ctx.Repository.Tags(h.ctx).Get(h.ctx, tag)
+	if err != nil {
+		if _, ok := err.(distribution.ErrTagUnknown); ok {
+			err = v2.ErrorCodeManifestUnknown.WithDetail(err)
+		}
+		h.handleError(h.ctx, err, w)
+		return
+	}
+
+	ms, err := h.ctx.Repository.Manifests(h.ctx)
+	if err != nil {
+		h.handleError(h.ctx, err, w)
+		return
+	}
+
+	var (
+		manifests []exportManifest
+		blobs     []distribution.Descriptor
+		seen      = make(map[digest.Digest]bool)
+	)
+	root, err := h.collect(ms, desc.Digest, distribution.WithTag(tag), seen, &manifests, &blobs)
+	if err != nil {
+		h.handleError(h.ctx, err, w)
+		return
+	}
+
+	bs := h.ctx.Repository.Blobs(h.ctx)
+	for i, blob := range blobs {
+		d, err := bs.Stat(h.ctx, blob.Digest)
+		if err != nil {
+			if err == distribution.ErrBlobUnknown {
+				err = v2.ErrorCodeBlobUnknown.WithDetail(blob.Digest)
+			}
+			h.handleError(h.ctx, err, w)
+			return
+		}
+		blobs[i].Size = d.Size
+	}
+
+	root.Annotations = map[string]string{
+		ociv1.AnnotationRefName: tag,
+	}
+	index, err := json.Marshal(ociv1.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Manifests: []ociv1.Descriptor{root},
+	})
+	if err != nil {
+		h.handleError(h.ctx, errcode.ErrorCodeUnknown.WithDetail(fmt.Sprintf("failed to serialize image index: %v", err)), w)
+		return
+	}
+	layout, err := json.Marshal(ociv1.ImageLayout{Version: ociv1.ImageLayoutVersion})
+	if err != nil {
+		h.handleError(h.ctx, errcode.ErrorCodeUnknown.WithDetail(fmt.Sprintf("failed to serialize image layout: %v", err)), w)
+		return
+	}
+
+	name := strings.ReplaceAll(h.ctx.Repository.Named().Name(), "/", "_") + "_" + tag + ".tar"
+	w.Header().Set("Content-Type", exportContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	w.WriteHeader(http.StatusOK)
+
+	tw := tar.NewWriter(w)
+	if err := h.writeArchive(tw, layout, index, manifests, blobs); err != nil {
+		// The response status is already sent, the client will get a truncated
+		// archive.
+		dcontext.GetLogger(h.ctx).Errorf("export of %s:%s failed: %v", h.ctx.Repository.Named().Name(), tag, err)
+		return
+	}
+	if err := tw.Close(); err != nil {
+		dcontext.GetLogger(h.ctx).Errorf("export of %s:%s failed: %v", h.ctx.Repository.Named().Name(), tag, err)
+	}
+}
+
+// collect fetches the manifest dgst and the manifests it references. It
+// appends the manifests and the blobs that should be exported to manifests and
+// blobs and returns the descriptor of the manifest.
+func (h *exportHandler) collect(
+	ms distribution.ManifestService,
+	dgst digest.Digest,
+	option distribution.ManifestServiceOption,
+	seen map[digest.Digest]bool,
+	manifests *[]exportManifest,
+	blobs *[]distribution.Descriptor,
+) (ociv1.Descriptor, error) {
+	var options []distribution.ManifestServiceOption
+	if option != nil {
+		options = append(options, option)
+	}
+	m, err := ms.Get(h.ctx, dgst, options...)
+	if err != nil {
+		return ociv1.Descriptor{}, err
+	}
+	if _, ok := m.(*schema1.SignedManifest); ok {
+		return ociv1.Descriptor{}, v2.ErrorCodeManifestInvalid.WithDetail("schema 1 manifests cannot be exported")
+	}
+
+	mediaType, payload, err := m.Payload()
+	if err != nil {
+		return ociv1.Descriptor{}, err
+	}
+	desc := ociv1.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(payload),
+		Size:      int64(len(payload)),
+	}
+	if seen[desc.Digest] {
+		return desc, nil
+	}
+	seen[desc.Digest] = true
+	*manifests = append(*manifests, exportManifest{
+		desc:    distribution.Descriptor{MediaType: mediaType, Digest: desc.Digest, Size: desc.Size},
+		payload: payload,
+	})
+
+	if _, ok := m.(*manifestlist.DeserializedManifestList); ok {
+		for _, ref := range m.References() {
+			if _, err := h.collect(ms, ref.Digest, nil, seen, manifests, blobs); err != nil {
+				return ociv1.Descriptor{}, err
+			}
+		}
+		return desc, nil
+	}
+
+	for _, ref := range m.References() {
+		// Foreign layers are not distributed by the registry.
+		if len(ref.URLs) > 0 || seen[ref.Digest] {
+			continue
+		}
+		seen[ref.Digest] = true
+		*blobs = append(*blobs, ref)
+	}
+
+	return desc, nil
+}
+
+// writeArchive writes the OCI image layout into tw.
+func (h *exportHandler) writeArchive(tw *tar.Writer, layout, index []byte, manifests []exportManifest, blobs []distribution.Descriptor) error {
+	if err := writeTarFile(tw, ociv1.ImageLayoutFile, layout); err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, "index.json", index); err != nil {
+		return err
+	}
+	for _, m := range manifests {
+		if err := writeTarFile(tw, blobPath(m.desc.Digest), m.payload); err != nil {
+			return err
+		}
+	}
+
+	bs := h.ctx.Repository.Blobs(h.ctx)
+	for _, blob := range blobs {
+		if err := writeTarBlob(h.ctx, tw, bs, blob); err != nil {
+			return fmt.Errorf("unable to write blob %s: %v", blob.Digest, err)
+		}
+	}
+	return nil
+}
+
+func (h *exportHandler) handleError(ctx context.Context, err error, w http.ResponseWriter) {
+	rerrors.Handle(ctx, "export response completed with error", err)
+	ctx, w = dcontext.WithResponseWriter(ctx, w)
+	if serveErr := errcode.ServeJSON(w, err); serveErr != nil {
+		dcontext.GetResponseLogger(ctx).Errorf("error sending error response: %v", serveErr)
+		return
+	}
+}
+
+// blobPath returns the path of the blob dgst in the OCI image layout.
+func blobPath(dgst digest.Digest) string {
+	return path.Join("blobs", dgst.Algorithm().String(), dgst.Encoded())
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Name: name,
+		Mode: 0644,
+		Size: int64(len(data)),
+	}); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+func writeTarBlob(ctx context.Context, tw *tar.Writer, bs distribution.BlobStore, desc distribution.Descriptor) error {
+	rc, err := bs.Open(ctx, desc.Digest)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	if err := tw.WriteHeader(&tar.Header{
+		Name: blobPath(desc.Digest),
+		Mode: 0644,
+		Size: desc.Size,
+	}); err != nil {
+		return err
+	}
+	_, err = io.CopyN(tw, rc, desc.Size)
+	return err
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/distribution/distribution/v3/configuration"
+	_ "github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
+	ociv1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	registryclient "github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+	registryconfig "github.com/openshift/image-registry/pkg/dockerregistry/server/configuration"
+	"github.com/openshift/image-registry/pkg/testutil"
+)
+
+func TestExportGet(t *testing.T) {
+	ctx := context.Background()
+	ctx = testutil.WithTestLogger(ctx, t)
+
+	_, imageClient := testutil.NewFakeOpenShiftWithClient(ctx)
+
+	osclient, err := registryclient.NewFakeRegistryClient(imageClient).Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx = withAppMiddleware(ctx, &fakeAccessControllerMiddleware{t: t, userClient: osclient})
+
+	config := &registryconfig.Configuration{
+		Server: &registryconfig.Server{
+			Addr: "localhost:5000",
+		},
+	}
+	dockercfg := &configuration.Configuration{
+		Loglevel: "debug",
+		Auth: map[string]configuration.Parameters{
+			"openshift": nil,
+		},
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"delete": configuration.Parameters{
+				"enabled": true,
+			},
+			"maintenance": configuration.Parameters{
+				"uploadpurging": map[interface{}]interface{}{
+					"enabled": false,
+				},
+			},
+		},
+		Middleware: map[string][]configuration.Middleware{
+			"registry":   {{Name: "openshift"}},
+			"repository": {{Name: "openshift"}},
+			"storage":    {{Name: "openshift"}},
+		},
+	}
+	if err := registryconfig.InitExtraConfig(dockercfg, config); err != nil {
+		t.Fatal(err)
+	}
+
+	registryApp := NewApp(ctx, registryclient.NewFakeRegistryClient(imageClient), dockercfg, config, nil)
+	registryServer := httptest.NewServer(registryApp)
+	defer registryServer.Close()
+
+	repoName := "user/app"
+	transport, err := testutil.NewTransport(registryServer.URL, repoName, nil)
+	if err != nil {
+		t.Fatalf("failed to get transport for %s: %v", repoName, err)
+	}
+	repo, err := testutil.NewRepository(repoName, registryServer.URL, transport)
+	if err != nil {
+		t.Fatalf("failed to get repository %s: %v", repoName, err)
+	}
+	manifest, err := testutil.UploadSchema2Image(ctx, repo, "latest")
+	if err != nil {
+		t.Fatalf("unable to upload image: %v", err)
+	}
+	_, manifestPayload, err := manifest.Payload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestDigest := digest.FromBytes(manifestPayload)
+
+	for _, tc := range []struct {
+		name           string
+		query          string
+		expectedStatus int
+	}{
+		{
+			name:           "missing tag",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "unknown tag",
+			query:          "?tag=missing",
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "export",
+			query:          "?tag=latest",
+			expectedStatus: http.StatusOK,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := http.Get(registryServer.URL + "/extensions/v2/user/app/export" + tc.query)
+			if err != nil {
+				t.Fatalf("failed to do the request: %v", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tc.expectedStatus {
+				t.Fatalf("got response status %d, want %d", resp.StatusCode, tc.expectedStatus)
+			}
+			if resp.StatusCode != http.StatusOK {
+				return
+			}
+
+			if contentType := resp.Header.Get("Content-Type"); contentType != exportContentType {
+				t.Errorf("got content type %q, want %q", contentType, exportContentType)
+			}
+
+			files := make(map[string][]byte)
+			tr := tar.NewReader(resp.Body)
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("failed to read archive: %v", err)
+				}
+				data, err := io.ReadAll(tr)
+				if err != nil {
+					t.Fatalf("failed to read %s: %v", hdr.Name, err)
+				}
+				files[hdr.Name] = data
+			}
+
+			var layout ociv1.ImageLayout
+			if err := json.Unmarshal(files[ociv1.ImageLayoutFile], &layout); err != nil {
+				t.Fatalf("failed to parse %s: %v", ociv1.ImageLayoutFile, err)
+			}
+			if layout.Version != ociv1.ImageLayoutVersion {
+				t.Errorf("got image layout version %q, want %q", layout.Version, ociv1.ImageLayoutVersion)
+			}
+
+			var index ociv1.Index
+			if err := json.Unmarshal(files["index.json"], &index); err != nil {
+				t.Fatalf("failed to parse index.json: %v", err)
+			}
+			if len(index.Manifests) != 1 {
+				t.Fatalf("got %d manifests in the index, want 1", len(index.Manifests))
+			}
+			if index.Manifests[0].Digest != manifestDigest {
+				t.Errorf("got manifest %s, want %s", index.Manifests[0].Digest, manifestDigest)
+			}
+			if ref := index.Manifests[0].Annotations[ociv1.AnnotationRefName]; ref != "latest" {
+				t.Errorf("got ref name %q, want %q", ref, "latest")
+			}
+
+			expected := []digest.Digest{manifestDigest}
+			for _, ref := range manifest.References() {
+				expected = append(expected, ref.Digest)
+			}
+			for _, dgst := range expected {
+				data, ok := files[blobPath(dgst)]
+				if !ok {
+					t.Errorf("archive does not contain %s", blobPath(dgst))
+					continue
+				}
+				if got := digest.FromBytes(data); got != dgst {
+					t.Errorf("got content with digest %s for %s", got, blobPath(dgst))
+				}
+			}
+			if len(files) != len(expected)+2 {
+				t.Errorf("got %d files in the archive, want %d", len(files), len(expected)+2)
+			}
+		})
+	}
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"net/http"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/registry/auth"
+	"github.com/distribution/distribution/v3/registry/handlers"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/api"
+)
+
+// RegisterExportHandler registers the image export extension to Docker
+// registry.
+func RegisterExportHandler(app *handlers.App) {
+	extensionsRouter := app.NewRoute().PathPrefix(api.ExtensionsPrefix).Subrouter()
+	getExportAccess := func(r *http.Request) []auth.Access {
+		return []auth.Access{
+			{
+				Resource: auth.Resource{
+					Type: "repository",
+					Name: dcontext.GetStringValue(dcontext.WithVars(app, r), "vars.name"),
+				},
+				Action: "pull",
+			},
+		}
+	}
+	app.RegisterRoute(
+		"extensions-export-get",
+		extensionsRouter.Path(api.ExportPath).Methods("GET"),
+		NewExportDispatcher(),
+		handlers.NameRequired,
+		getExportAccess,
+	)
+}
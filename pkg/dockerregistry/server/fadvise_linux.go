@@ -0,0 +1,15 @@
+//go:build linux
+
+package server
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// adviseSequentialRead tells the kernel that f will be read sequentially,
+// which makes it use a larger readahead window for the file.
+func adviseSequentialRead(f *os.File) error {
+	return unix.Fadvise(int(f.Fd()), 0, 0, unix.FADV_SEQUENTIAL)
+}
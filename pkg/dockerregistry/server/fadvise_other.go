@@ -0,0 +1,12 @@
+//go:build !linux
+
+package server
+
+import (
+	"os"
+)
+
+// adviseSequentialRead does nothing, the readahead is tuned only on Linux.
+func adviseSequentialRead(f *os.File) error {
+	return nil
+}
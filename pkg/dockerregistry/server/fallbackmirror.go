@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/openshift/library-go/pkg/image/reference"
+	"github.com/openshift/library-go/pkg/image/registryclient"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/configuration"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/metrics"
+	"github.com/openshift/image-registry/pkg/kubernetes-common/credentialprovider"
+	"github.com/openshift/image-registry/pkg/requesttrace"
+)
+
+// fallbackMirror is a registry that is searched as the last resort for
+// content that cannot be found in the candidate repositories, for example
+// when the source registry of an image doesn't exist anymore.
+type fallbackMirror struct {
+	registry        string
+	insecure        bool
+	credentialsFile string
+	proxy           *clusterProxy
+	authChallenges  *authChallenges
+}
+
+// newFallbackMirror returns nil if the fallback mirror is not configured.
+func newFallbackMirror(cfg configuration.FallbackMirror, proxy *clusterProxy, authChallenges *authChallenges) *fallbackMirror {
+	if len(cfg.Registry) == 0 {
+		return nil
+	}
+	return &fallbackMirror{
+		registry:        cfg.Registry,
+		insecure:        cfg.Insecure,
+		credentialsFile: cfg.CredentialsFile,
+		proxy:           proxy,
+		authChallenges:  authChallenges,
+	}
+}
+
+// Reference returns the location of the repository ref in the mirror.
+func (fm *fallbackMirror) Reference(ref reference.DockerImageReference) (reference.DockerImageReference, error) {
+	mirrorRef, err := reference.Parse(fm.registry + "/" + ref.DockerClientDefaults().RepositoryName())
+	if err != nil {
+		return reference.DockerImageReference{}, fmt.Errorf("unable to map %s to the fallback mirror %s: %v", ref.Exact(), fm.registry, err)
+	}
+	return mirrorRef, nil
+}
+
+// Repository returns a client for the mirror of the repository ref.
+func (fm *fallbackMirror) Repository(ctx context.Context, ref reference.DockerImageReference, m metrics.Pullthrough) (distribution.Repository, reference.DockerImageReference, error) {
+	mirrorRef, err := fm.Reference(ref)
+	if err != nil {
+		return nil, mirrorRef, err
+	}
+
+	req, err := dcontext.GetRequest(ctx)
+	if err != nil {
+		dcontext.GetLogger(ctx).Errorf("unable to get request from context: %v", err)
+		return nil, mirrorRef, err
+	}
+
+	keyring := &credentialprovider.BasicDockerKeyring{}
+	if len(fm.credentialsFile) > 0 {
+		config, err := credentialprovider.ReadSpecificDockerConfigJsonFile(fm.credentialsFile)
+		if err != nil {
+			dcontext.GetLogger(ctx).Errorf("unable to read credentials for the fallback mirror from %s: %v", fm.credentialsFile, err)
+			return nil, mirrorRef, err
+		}
+		keyring.Add(config)
+	}
+
+	secure, insecure := fm.proxy.Transports()
+
+	registryContext := registryclient.NewContext(
+		secure, insecure,
+	).WithRequestModifiers(
+		requesttrace.New(ctx, req),
+	).WithCredentialsFactory(
+		&credentialStoreFactory{
+			keyring: keyring,
+		},
+	)
+	registryContext.Challenges = fm.authChallenges.Manager()
+
+	var retriever registryclient.RepositoryRetriever = registryContext
+	retriever = m.RepositoryRetriever(retriever)
+
+	repo, err := retriever.Repository(ctx, mirrorRef.RegistryURL(), mirrorRef.RepositoryName(), fm.insecure)
+	return repo, mirrorRef, err
+}
+
+// Stat looks for the blob dgst in the mirrors of the repositories refs.
+func (fm *fallbackMirror) Stat(ctx context.Context, refs []reference.DockerImageReference, dgst digest.Digest, m metrics.Pullthrough) (distribution.Descriptor, distribution.BlobStore, error) {
+	nerr := distribution.ErrBlobUnknown
+	seen := make(map[string]bool)
+	for _, ref := range refs {
+		if repoName := ref.DockerClientDefaults().AsRepository().Exact(); seen[repoName] {
+			continue
+		} else {
+			seen[repoName] = true
+		}
+
+		repo, mirrorRef, err := fm.Repository(ctx, ref, m)
+		if err != nil {
+			dcontext.GetLogger(ctx).Errorf("Error getting fallback mirror repository for %q: %v", ref.AsRepository().Exact(), err)
+			nerr = err
+			continue
+		}
+
+		bs := repo.Blobs(ctx)
+		desc, err := bs.Stat(ctx, dgst)
+		if err != nil {
+			if err != distribution.ErrBlobUnknown {
+				dcontext.GetLogger(ctx).Errorf("Error statting blob %s in fallback mirror %q: %v", dgst, mirrorRef.AsRepository().Exact(), err)
+			}
+			nerr = err
+			continue
+		}
+
+		dcontext.GetLogger(ctx).Infof("Found digest location in fallback mirror %q in %q", dgst, mirrorRef.AsRepository().Exact())
+		return desc, bs, nil
+	}
+	return distribution.Descriptor{}, nil, nerr
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/openshift/library-go/pkg/image/reference"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/configuration"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/metrics"
+	"github.com/openshift/image-registry/pkg/testutil"
+)
+
+func TestFallbackMirrorReference(t *testing.T) {
+	fm := newFallbackMirror(configuration.FallbackMirror{Registry: "mirror.example.com/docker-remote"}, nil, nil)
+
+	for _, tc := range []struct {
+		ref      string
+		expected string
+	}{
+		{ref: "busybox", expected: "mirror.example.com/docker-remote/library/busybox"},
+		{ref: "quay.io/openshift/origin-cli:latest", expected: "mirror.example.com/docker-remote/openshift/origin-cli"},
+		{ref: "registry.local:5000/a/b/c@sha256:4355a46b19d348dc2f57c046f8ef63d4538ebb936000f3c9ee954a27460dd865", expected: "mirror.example.com/docker-remote/a/b/c"},
+	} {
+		ref, err := reference.Parse(tc.ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mirrorRef, err := fm.Reference(ref)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.ref, err)
+		}
+		if got := mirrorRef.Exact(); got != tc.expected {
+			t.Errorf("%s: got %s, want %s", tc.ref, got, tc.expected)
+		}
+	}
+
+	if fm := newFallbackMirror(configuration.FallbackMirror{}, nil, nil); fm != nil {
+		t.Errorf("got %#+v for an empty configuration, want nil", fm)
+	}
+}
+
+func TestFallbackMirrorStat(t *testing.T) {
+	blob := []byte("fallback mirror blob")
+	dgst := digest.FromBytes(blob)
+
+	requests := 0
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Logf("mirror got %s %s", r.Method, r.URL.Path)
+
+		w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+
+		switch r.URL.Path {
+		case "/v2/":
+			w.Write([]byte(`{}`))
+		case "/v2/prefix/library/busybox/blobs/" + dgst.String():
+			requests++
+			w.Header().Set("Content-Length", fmt.Sprintf("%d", len(blob)))
+			w.Header().Set("Docker-Content-Digest", dgst.String())
+			w.WriteHeader(http.StatusOK)
+		default:
+			requests++
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer mirror.Close()
+
+	mirrorURL, err := url.Parse(mirror.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	ctx = testutil.WithTestLogger(ctx, t)
+	ctx = dcontext.WithRequest(ctx, httptest.NewRequest("GET", "/v2/user/app/blobs/"+dgst.String(), nil))
+
+	fm := newFallbackMirror(configuration.FallbackMirror{
+		Registry: mirrorURL.Host + "/prefix",
+		Insecure: true,
+	}, nil, nil)
+
+	var refs []reference.DockerImageReference
+	for _, s := range []string{
+		"quay.io/openshift/origin-cli",
+		"docker.io/library/busybox:latest",
+		"busybox:1.36",
+	} {
+		ref, err := reference.Parse(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		refs = append(refs, ref)
+	}
+
+	desc, bs, err := fm.Stat(ctx, refs, dgst, metrics.NewNoopMetrics())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.Digest != dgst || desc.Size != int64(len(blob)) {
+		t.Errorf("unexpected descriptor: %#+v", desc)
+	}
+	if bs == nil {
+		t.Errorf("expected a blob store")
+	}
+	if requests != 2 {
+		t.Errorf("got %d blob requests, want 2", requests)
+	}
+
+	requests = 0
+	if _, _, err := fm.Stat(ctx, refs[:1], dgst, metrics.NewNoopMetrics()); err == nil {
+		t.Errorf("expected an error for a blob that is not mirrored")
+	}
+	if requests != 1 {
+		t.Errorf("got %d blob requests, want 1", requests)
+	}
+}
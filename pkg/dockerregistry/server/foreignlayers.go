@@ -0,0 +1,264 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/opencontainers/go-digest"
+)
+
+// errForeignLayerUnavailable is returned when a foreign layer cannot be
+// downloaded from any of its URLs.
+var errForeignLayerUnavailable = errors.New("the layer cannot be downloaded from its URLs")
+
+// foreignLayerMirror downloads layers with external URLs into the registry.
+// It is used when openshift.compatibility.foreignlayers is set to mirror.
+//
+// The descriptors of the layers are not rewritten, as the registry and the
+// client have to agree on the digest of the pushed manifest. Clients that fall
+// back to the registry when the URLs are unavailable get the mirrored layers.
+//
+// The URLs are chosen by the clients, so the layers are downloaded only from
+// the configured hosts, and never from the addresses of the cluster network or
+// of the node. The addresses are checked when the connections are made, after
+// the host names are resolved.
+type foreignLayerMirror struct {
+	client *http.Client
+	hosts  []string
+	// allowAddress returns true if the layers may be downloaded from ip.
+	allowAddress func(ip net.IP) bool
+
+	mu       sync.Mutex
+	inflight map[digest.Digest]chan struct{}
+}
+
+func newForeignLayerMirror(proxy *clusterProxy, hosts []string) *foreignLayerMirror {
+	f := &foreignLayerMirror{
+		hosts:        hosts,
+		allowAddress: isPublicAddress,
+		inflight:     make(map[digest.Digest]chan struct{}),
+	}
+
+	secure, _ := proxy.Transports()
+	transport, ok := secure.(*http.Transport)
+	if !ok {
+		transport = http.DefaultTransport.(*http.Transport)
+	}
+	transport = transport.Clone()
+	transport.Proxy, transport.DialContext = f.dialer(transport.Proxy)
+	f.client = &http.Client{
+		Transport: transport,
+		// The redirects are followed only to the allowed hosts.
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return f.checkURL(req.URL)
+		},
+	}
+	return f
+}
+
+// isPublicAddress returns false for the loopback, private, link-local and
+// unspecified addresses.
+func isPublicAddress(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() && !ip.IsInterfaceLocalMulticast() && !ip.IsUnspecified()
+}
+
+// dialer returns the dial function that refuses connections to the addresses
+// that are not allowed, and the proxy function for it. The connections to the
+// proxies are made without the check, the proxies resolve the host names.
+func (f *foreignLayerMirror) dialer(proxy func(*http.Request) (*url.URL, error)) (func(*http.Request) (*url.URL, error), func(ctx context.Context, network, addr string) (net.Conn, error)) {
+	var proxies sync.Map
+	if proxy != nil {
+		// The transport asks for the proxy before it dials.
+		transportProxy := proxy
+		proxy = func(req *http.Request) (*url.URL, error) {
+			u, err := transportProxy(req)
+			if u != nil {
+				proxies.Store(proxyAddr(u), struct{}{})
+			}
+			return u, err
+		}
+	}
+
+	direct := &net.Dialer{}
+	checked := &net.Dialer{
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !f.allowAddress(ip) {
+				return fmt.Errorf("the address %s is not allowed", host)
+			}
+			return nil
+		},
+	}
+	return proxy, func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if _, ok := proxies.Load(addr); ok {
+			return direct.DialContext(ctx, network, addr)
+		}
+		return checked.DialContext(ctx, network, addr)
+	}
+}
+
+// proxyAddr returns the address the transport dials to connect to the proxy
+// u.
+func proxyAddr(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		switch u.Scheme {
+		case "https":
+			port = "443"
+		case "socks5", "socks5h":
+			port = "1080"
+		default:
+			port = "80"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// checkURL returns an error if the layers may not be downloaded from u.
+func (f *foreignLayerMirror) checkURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported URL scheme %q", u.Scheme)
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range f.hosts {
+		if host == allowed {
+			return nil
+		}
+		if domain, ok := strings.CutPrefix(allowed, "*"); ok && strings.HasSuffix(host, domain) {
+			return nil
+		}
+	}
+	return fmt.Errorf("the host %s is not allowed", host)
+}
+
+// foreignLayers returns the references of manifest with external URLs.
+func foreignLayers(manifest distribution.Manifest) []distribution.Descriptor {
+	var layers []distribution.Descriptor
+	for _, desc := range manifest.References() {
+		if len(desc.URLs) != 0 {
+			layers = append(layers, desc)
+		}
+	}
+	return layers
+}
+
+// mirror stores the foreign layers of manifest that are missing in blobStore.
+func (f *foreignLayerMirror) mirror(ctx context.Context, blobStore distribution.BlobStore, manifest distribution.Manifest) error {
+	for _, desc := range foreignLayers(manifest) {
+		if err := f.mirrorLayer(ctx, blobStore, desc); err != nil {
+			if err != errForeignLayerUnavailable {
+				dcontext.GetLogger(ctx).Errorf("unable to mirror foreign layer %s: %v", desc.Digest, err)
+			}
+			return ErrorCodeForeignLayerUnavailable.WithArgs(desc.Digest)
+		}
+	}
+	return nil
+}
+
+func (f *foreignLayerMirror) mirrorLayer(ctx context.Context, blobStore distribution.BlobStore, desc distribution.Descriptor) error {
+	// Only one download of a layer at a time, the others wait for it and
+	// find the layer in the storage.
+	var done chan struct{}
+	for done == nil {
+		f.mu.Lock()
+		inflight, ok := f.inflight[desc.Digest]
+		if !ok {
+			done = make(chan struct{})
+			f.inflight[desc.Digest] = done
+		}
+		f.mu.Unlock()
+
+		if ok {
+			select {
+			case <-inflight:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+	defer func() {
+		f.mu.Lock()
+		delete(f.inflight, desc.Digest)
+		f.mu.Unlock()
+		close(done)
+	}()
+
+	switch _, err := blobStore.Stat(ctx, desc.Digest); err {
+	case nil:
+		return nil
+	case distribution.ErrBlobUnknown:
+	default:
+		return err
+	}
+
+	for _, u := range desc.URLs {
+		err := f.download(ctx, blobStore, desc, u)
+		if err == nil {
+			dcontext.GetLogger(ctx).Infof("mirrored foreign layer %s from %s", desc.Digest, u)
+			return nil
+		}
+		// The errors are not sent to the clients, they would tell what the
+		// registry can reach.
+		dcontext.GetLogger(ctx).Warnf("unable to mirror foreign layer %s from %s: %v", desc.Digest, u, err)
+	}
+	return errForeignLayerUnavailable
+}
+
+func (f *foreignLayerMirror) download(ctx context.Context, blobStore distribution.BlobStore, desc distribution.Descriptor, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if err := f.checkURL(u); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	bw, err := blobStore.Create(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(bw, io.LimitReader(resp.Body, desc.Size)); err != nil {
+		_ = bw.Cancel(ctx)
+		return err
+	}
+	// Commit verifies the size and the digest of the layer.
+	if _, err := bw.Commit(ctx, distribution.Descriptor{
+		MediaType: desc.MediaType,
+		Digest:    desc.Digest,
+		Size:      desc.Size,
+	}); err != nil {
+		_ = bw.Cancel(ctx)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,239 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/manifest/schema2"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
+
+	registryclient "github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+	"github.com/openshift/image-registry/pkg/imagestream"
+	"github.com/openshift/image-registry/pkg/testutil"
+)
+
+func TestForeignLayerMirror(t *testing.T) {
+	ctx := context.Background()
+	ctx = testutil.WithTestLogger(ctx, t)
+
+	content := []byte("windows base layer")
+	layerDigest := digest.FromBytes(content)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/layer":
+			_, _ = w.Write(content)
+		case "/corrupted":
+			_, _ = w.Write([]byte("windows base lay3r"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	registry, err := storage.NewRegistry(ctx, inmemory.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	named, err := reference.WithName("user/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo, err := registry.Repository(ctx, named)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobStore := repo.Blobs(ctx)
+
+	newManifest := func(urls ...string) distribution.Manifest {
+		manifest, err := schema2.FromStruct(schema2.Manifest{
+			Versioned: schema2.SchemaVersion,
+			Config:    distribution.Descriptor{Digest: "sha256:bef57ec7f53a6d40beb640a780a639c83bc29ac8a9816f1fc6c5c6dcd93c4721", Size: 2, MediaType: schema2.MediaTypeImageConfig},
+			Layers: []distribution.Descriptor{
+				{Digest: layerDigest, Size: int64(len(content)), MediaType: schema2.MediaTypeForeignLayer, URLs: urls},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return manifest
+	}
+
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The layers are not downloaded from the addresses of the node.
+	f := newForeignLayerMirror(nil, []string{serverURL.Hostname()})
+	err = f.mirror(ctx, blobStore, newManifest(server.URL+"/layer"))
+	if e, ok := err.(errcode.Error); !ok || e.Code != ErrorCodeForeignLayerUnavailable {
+		t.Fatalf("got error %v, want %v", err, ErrorCodeForeignLayerUnavailable)
+	}
+	if strings.Contains(err.Error(), serverURL.Host) {
+		t.Errorf("expected the error not to tell what the registry can reach, got %q", err)
+	}
+
+	// The layers are downloaded only from the configured hosts.
+	f = newForeignLayerMirror(nil, []string{"*.example.com"})
+	f.allowAddress = func(ip net.IP) bool { return true }
+	if err := f.mirror(ctx, blobStore, newManifest(server.URL+"/layer")); err == nil {
+		t.Fatalf("expected the layer of a host that is not allowed not to be mirrored")
+	}
+
+	f = newForeignLayerMirror(nil, []string{serverURL.Hostname()})
+	f.allowAddress = func(ip net.IP) bool { return true }
+
+	err = f.mirror(ctx, blobStore, newManifest(server.URL+"/corrupted", "file:///layer"))
+	if e, ok := err.(errcode.Error); !ok || e.Code != ErrorCodeForeignLayerUnavailable {
+		t.Fatalf("got error %v, want %v", err, ErrorCodeForeignLayerUnavailable)
+	}
+	if _, err := blobStore.Stat(ctx, layerDigest); err != distribution.ErrBlobUnknown {
+		t.Fatalf("expected the corrupted layer not to be stored, got %v", err)
+	}
+
+	if err := f.mirror(ctx, blobStore, newManifest(server.URL+"/missing", server.URL+"/layer")); err != nil {
+		t.Fatal(err)
+	}
+	desc, err := blobStore.Stat(ctx, layerDigest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.Size != int64(len(content)) {
+		t.Errorf("got size %d, want %d", desc.Size, len(content))
+	}
+
+	// The layer is already in the storage, so the URLs are not used.
+	if err := f.mirror(ctx, blobStore, newManifest(server.URL+"/missing")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestForeignLayerMirrorCheckURL(t *testing.T) {
+	f := newForeignLayerMirror(nil, []string{"mcr.microsoft.com", "*.blob.core.windows.net"})
+	for rawURL, allowed := range map[string]bool{
+		"https://mcr.microsoft.com/v2/windows/blobs/sha256:1":      true,
+		"https://MCR.microsoft.com/layer":                          true,
+		"http://mcr.microsoft.com:8080/layer":                      true,
+		"https://eastus.blob.core.windows.net/layer":               true,
+		"https://blob.core.windows.net/layer":                      false,
+		"https://mcr.microsoft.com.example.com/layer":              false,
+		"https://example.com/layer":                                false,
+		"ftp://mcr.microsoft.com/layer":                            false,
+		"https://kubernetes.default.svc/api/v1/namespaces/secrets": false,
+	} {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := f.checkURL(u); (err == nil) != allowed {
+			t.Errorf("%s: got error %v, want allowed=%t", rawURL, err, allowed)
+		}
+	}
+
+	for ip, public := range map[string]bool{
+		"127.0.0.1":       false,
+		"10.0.0.1":        false,
+		"172.30.0.1":      false,
+		"192.168.1.1":     false,
+		"169.254.169.254": false,
+		"::1":             false,
+		"fd00::1":         false,
+		"0.0.0.0":         false,
+		"13.107.246.40":   true,
+	} {
+		if got := isPublicAddress(net.ParseIP(ip)); got != public {
+			t.Errorf("%s: got public=%t, want %t", ip, got, public)
+		}
+	}
+}
+
+func TestManifestServicePutForeignLayers(t *testing.T) {
+	ctx := context.Background()
+	ctx = testutil.WithTestLogger(ctx, t)
+
+	namespace := "user"
+	repo := "app"
+	repoName := fmt.Sprintf("%s/%s", namespace, repo)
+
+	manifest, err := schema2.FromStruct(schema2.Manifest{
+		Versioned: schema2.SchemaVersion,
+		Config:    distribution.Descriptor{Digest: "testconfig:1", Size: 2, MediaType: schema2.MediaTypeImageConfig},
+		Layers: []distribution.Descriptor{
+			{Digest: "testblob:1", Size: 2, MediaType: schema2.MediaTypeLayer},
+			{Digest: "testblob:2", Size: 2, MediaType: schema2.MediaTypeForeignLayer, URLs: []string{"https://example.com/layer"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobs := testutil.BlobContents{
+		"testconfig:1": []byte("{}"),
+		"testblob:1":   []byte("{}"),
+	}
+
+	for _, tc := range []struct {
+		name        string
+		reject      bool
+		expectedErr errcode.ErrorCode
+	}{
+		{
+			name: "allow",
+		},
+		{
+			name:        "reject",
+			reject:      true,
+			expectedErr: ErrorCodeManifestForeignLayer,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, imageClient := testutil.NewFakeOpenShiftWithClient(ctx)
+			client := registryclient.NewFakeRegistryAPIClient(nil, imageClient)
+			tms := testutil.NewFakeManifestService(repoName, nil)
+
+			ms := &manifestService{
+				serverAddr:          "localhost",
+				manifests:           tms,
+				blobStore:           testutil.NewFakeBlobStore(nil, blobs),
+				registryOSClient:    client,
+				imageStream:         imagestream.New(ctx, namespace, repo, client),
+				acceptSchema2:       true,
+				rejectForeignLayers: tc.reject,
+			}
+
+			osclient, err := registryclient.NewFakeRegistryClient(imageClient).Client()
+			if err != nil {
+				t.Fatal(err)
+			}
+			putCtx := withAuthPerformed(ctx)
+			putCtx = withUserClient(putCtx, osclient)
+
+			_, err = ms.Put(putCtx, manifest, distribution.WithTag("latest"))
+			if tc.expectedErr == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+
+			e, ok := err.(errcode.Error)
+			if !ok || e.Code != tc.expectedErr {
+				t.Fatalf("got error %v, want %v", err, tc.expectedErr)
+			}
+			if tms.Calls("Put") != 0 {
+				t.Errorf("expected the manifest not to be stored, got %d Put calls", tms.Calls("Put"))
+			}
+		})
+	}
+}
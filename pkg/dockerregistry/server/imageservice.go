@@ -0,0 +1,276 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/opencontainers/go-digest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+	rerrors "github.com/openshift/image-registry/pkg/errors"
+	"github.com/openshift/image-registry/pkg/imagestream"
+)
+
+// imageServiceName is the full name of the gRPC service.
+const imageServiceName = "openshift.imageregistry.v1.ImageService"
+
+// resolveManifestRequest asks for the manifest of a tag or a digest in a
+// repository.
+type resolveManifestRequest struct {
+	Repository string `json:"repository"`
+	Reference  string `json:"reference"`
+}
+
+type resolveManifestResponse struct {
+	Digest    digest.Digest `json:"digest"`
+	MediaType string        `json:"mediaType,omitempty"`
+}
+
+// getBlobURLRequest asks for the URL where a blob of a repository can be
+// downloaded.
+type getBlobURLRequest struct {
+	Repository string        `json:"repository"`
+	Digest     digest.Digest `json:"digest"`
+}
+
+type getBlobURLResponse struct {
+	URL string `json:"url"`
+}
+
+// jsonCodec encodes the messages of the image service as JSON, so that the
+// service doesn't need generated protobuf code.
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+// imageService is an experimental gRPC API that lets node-local agents find
+// the digests of manifests and the URLs of blobs without speaking the
+// registry protocol.
+type imageService struct {
+	app *App
+
+	// registryClient creates the clients of the callers for the access
+	// reviews.
+	registryClient client.RegistryClient
+
+	// client is the client of the registry. It is used to read the image
+	// streams.
+	client client.Interface
+
+	// registryURL is the base URL of the registry, it is used for the blob
+	// URLs if the peer-to-peer distribution is disabled.
+	registryURL string
+}
+
+// imageServiceServer is the interface of the handlers of the image service.
+type imageServiceServer interface {
+	ResolveManifest(ctx context.Context, req *resolveManifestRequest) (*resolveManifestResponse, error)
+	GetBlobURL(ctx context.Context, req *getBlobURLRequest) (*getBlobURLResponse, error)
+}
+
+var _ imageServiceServer = &imageService{}
+
+var imageServiceDesc = grpc.ServiceDesc{
+	ServiceName: imageServiceName,
+	HandlerType: (*imageServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ResolveManifest",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				req := &resolveManifestRequest{}
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				if interceptor == nil {
+					return srv.(imageServiceServer).ResolveManifest(ctx, req)
+				}
+				info := &grpc.UnaryServerInfo{
+					Server:     srv,
+					FullMethod: "/" + imageServiceName + "/ResolveManifest",
+				}
+				return interceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+					return srv.(imageServiceServer).ResolveManifest(ctx, req.(*resolveManifestRequest))
+				})
+			},
+		},
+		{
+			MethodName: "GetBlobURL",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				req := &getBlobURLRequest{}
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				if interceptor == nil {
+					return srv.(imageServiceServer).GetBlobURL(ctx, req)
+				}
+				info := &grpc.UnaryServerInfo{
+					Server:     srv,
+					FullMethod: "/" + imageServiceName + "/GetBlobURL",
+				}
+				return interceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+					return srv.(imageServiceServer).GetBlobURL(ctx, req.(*getBlobURLRequest))
+				})
+			},
+		},
+	},
+}
+
+// serveImageService starts the image service on the Unix socket addr. The
+// service is stopped when ctx is done. The service is served without TLS, so
+// the tokens of the callers are only accepted through the local socket.
+func (app *App) serveImageService(ctx context.Context, addr string, s *imageService) error {
+	path, ok := strings.CutPrefix(addr, "unix://")
+	if !ok {
+		return fmt.Errorf("the image service address %q is not a Unix socket", addr)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+
+	srv := grpc.NewServer(grpc.ForceServerCodec(jsonCodec{}))
+	srv.RegisterService(&imageServiceDesc, s)
+
+	go func() {
+		<-ctx.Done()
+		srv.GracefulStop()
+	}()
+	go func() {
+		if err := srv.Serve(l); err != nil {
+			dcontext.GetLogger(ctx).Errorf("the image service has stopped: %v", err)
+		}
+	}()
+
+	dcontext.GetLogger(ctx).Infof("the image service is listening on %s", path)
+	return nil
+}
+
+// ResolveManifest returns the digest of the manifest that the tag of the
+// repository points to. Digests are returned as is if the image stream has
+// them.
+func (s *imageService) ResolveManifest(ctx context.Context, req *resolveManifestRequest) (*resolveManifestResponse, error) {
+	is, err := s.imageStream(ctx, req.Repository)
+	if err != nil {
+		return nil, err
+	}
+
+	dgst, err := digest.Parse(req.Reference)
+	if err == nil {
+		if _, err := is.ResolveImageID(ctx, dgst); err != nil {
+			return nil, imageServiceError(err)
+		}
+	} else {
+		tags, err := is.Tags(ctx)
+		if err != nil {
+			return nil, imageServiceError(err)
+		}
+		var ok bool
+		dgst, ok = tags[req.Reference]
+		if !ok {
+			return nil, status.Errorf(codes.NotFound, "tag %s is not found in %s", req.Reference, req.Repository)
+		}
+	}
+
+	image, rErr := is.GetImageOfImageStream(ctx, dgst)
+	if rErr != nil {
+		return nil, imageServiceError(rErr)
+	}
+
+	return &resolveManifestResponse{
+		Digest:    dgst,
+		MediaType: image.DockerImageManifestMediaType,
+	}, nil
+}
+
+// GetBlobURL returns the URL where the blob of the repository can be
+// downloaded. The URL points to the peer-to-peer endpoint if it is
+// configured.
+func (s *imageService) GetBlobURL(ctx context.Context, req *getBlobURLRequest) (*getBlobURLResponse, error) {
+	if err := req.Digest.Validate(); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid digest %q: %v", req.Digest, err)
+	}
+
+	is, err := s.imageStream(ctx, req.Repository)
+	if err != nil {
+		return nil, err
+	}
+
+	if ok, _, _ := is.HasBlob(ctx, req.Digest); !ok {
+		return nil, status.Errorf(codes.NotFound, "blob %s is not found in %s", req.Digest, req.Repository)
+	}
+
+	if r, ok := s.app.blobRedirector.(*p2pBlobRedirector); ok {
+		return &getBlobURLResponse{URL: r.blobURL(req.Repository, req.Digest)}, nil
+	}
+	return &getBlobURLResponse{
+		URL: fmt.Sprintf("%s/v2/%s/blobs/%s", s.registryURL, req.Repository, req.Digest),
+	}, nil
+}
+
+// imageStream reviews the pull access of the caller to the repository and
+// returns its image stream.
+func (s *imageService) imageStream(ctx context.Context, repo string) (imagestream.ImageStream, error) {
+	namespace, name, ok := strings.Cut(repo, "/")
+	if !ok || len(namespace) == 0 || len(name) == 0 || strings.Contains(name, "/") {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid repository name %q", repo)
+	}
+
+	token := ""
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get("authorization") {
+		if bearer, ok := strings.CutPrefix(value, "Bearer "); ok {
+			token = bearer
+		}
+	}
+	if len(token) == 0 {
+		return nil, status.Error(codes.Unauthenticated, "bearer token is required")
+	}
+
+	userClient, err := s.registryClient.ClientFromToken(token)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "unable to create client: %v", err)
+	}
+	switch err := verifyImageStreamAccess(ctx, namespace, name, "get", userClient, s.client); err {
+	case nil:
+	case ErrOpenShiftAccessDenied:
+		return nil, status.Errorf(codes.PermissionDenied, "access to %s is denied", repo)
+	default:
+		return nil, status.Errorf(codes.Unavailable, "unable to review access to %s: %v", repo, err)
+	}
+
+	return s.app.newImageStream(ctx, namespace, name, s.client), nil
+}
+
+// imageServiceError converts the errors of image streams into gRPC errors.
+func imageServiceError(err rerrors.Error) error {
+	switch err.Code() {
+	case imagestream.ErrImageStreamNotFoundCode, imagestream.ErrImageStreamImageNotFoundCode:
+		return status.Error(codes.NotFound, err.Error())
+	case imagestream.ErrImageStreamForbiddenCode:
+		return status.Error(codes.PermissionDenied, err.Error())
+	default:
+		return status.Error(codes.Unavailable, err.Error())
+	}
+}
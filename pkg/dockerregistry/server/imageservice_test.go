@@ -0,0 +1,118 @@
+package server
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	authorizationapi "k8s.io/api/authorization/v1"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+	registryconfig "github.com/openshift/image-registry/pkg/dockerregistry/server/configuration"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/metrics"
+	"github.com/openshift/image-registry/pkg/testutil"
+)
+
+func TestImageService(t *testing.T) {
+	ctx, cancel := context.WithCancel(testutil.WithTestLogger(context.Background(), t))
+	defer cancel()
+
+	fos, imageClient := testutil.NewFakeOpenShiftWithClient(ctx)
+	image := testutil.AddRandomImage(t, fos, "ns", "app", "latest")
+	registryClient := client.NewFakeRegistryAPIClient(nil, imageClient)
+
+	userClient := &accessReviewClient{
+		Interface: registryClient,
+		allowed: func(attrs *authorizationapi.ResourceAttributes) bool {
+			return attrs.Namespace == "ns"
+		},
+	}
+
+	app := &App{
+		config:  &registryconfig.Configuration{},
+		metrics: metrics.NewNoopMetrics(),
+	}
+	addr := "unix://" + filepath.Join(t.TempDir(), "grpc.sock")
+	err := app.serveImageService(ctx, addr, &imageService{
+		app:            app,
+		registryClient: &testRegistryClient{client: userClient},
+		client:         registryClient,
+		registryURL:    "https://registry.example.com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithDefaultCallOptions(grpc.ForceCodec(jsonCodec{})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	authCtx := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer token")
+
+	manifest := &resolveManifestResponse{}
+	if err := conn.Invoke(authCtx, "/"+imageServiceName+"/ResolveManifest", &resolveManifestRequest{Repository: "ns/app", Reference: "latest"}, manifest); err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Digest.String() != image.Name || manifest.MediaType != image.DockerImageManifestMediaType {
+		t.Errorf("got %#+v, want the digest %s and the media type %s", manifest, image.Name, image.DockerImageManifestMediaType)
+	}
+
+	layer := image.DockerImageLayers[0].Name
+	blob := &getBlobURLResponse{}
+	if err := conn.Invoke(authCtx, "/"+imageServiceName+"/GetBlobURL", &getBlobURLRequest{Repository: "ns/app", Digest: digest.FromString("missing")}, blob); status.Code(err) != codes.NotFound {
+		t.Errorf("got error %v for a missing blob, want NotFound", err)
+	}
+	if err := conn.Invoke(authCtx, "/"+imageServiceName+"/GetBlobURL", &getBlobURLRequest{Repository: "ns/app", Digest: digest.Digest(layer)}, blob); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "https://registry.example.com/v2/ns/app/blobs/" + layer; blob.URL != expected {
+		t.Errorf("got URL %q, want %q", blob.URL, expected)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		ctx      context.Context
+		req      *resolveManifestRequest
+		expected codes.Code
+	}{
+		{
+			name:     "no token",
+			ctx:      ctx,
+			req:      &resolveManifestRequest{Repository: "ns/app", Reference: "latest"},
+			expected: codes.Unauthenticated,
+		},
+		{
+			name:     "access denied",
+			ctx:      authCtx,
+			req:      &resolveManifestRequest{Repository: "other/app", Reference: "latest"},
+			expected: codes.PermissionDenied,
+		},
+		{
+			name:     "invalid repository",
+			ctx:      authCtx,
+			req:      &resolveManifestRequest{Repository: "app", Reference: "latest"},
+			expected: codes.InvalidArgument,
+		},
+		{
+			name:     "unknown tag",
+			ctx:      authCtx,
+			req:      &resolveManifestRequest{Repository: "ns/app", Reference: "missing"},
+			expected: codes.NotFound,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := conn.Invoke(tc.ctx, "/"+imageServiceName+"/ResolveManifest", tc.req, &resolveManifestResponse{})
+			if code := status.Code(err); code != tc.expected {
+				t.Errorf("got error %v, want the code %s", err, tc.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+
+	"github.com/openshift/image-registry/pkg/imagestream"
+)
+
+// imageStreamGenerationHeader reports the generation and the resource
+// version of the image stream that was used to serve the request, so that
+// it can be seen whether the registry acted on stale data.
+const imageStreamGenerationHeader = "X-OpenShift-ImageStream-Generation"
+
+// setImageStreamGenerationHeader sets the X-OpenShift-ImageStream-Generation
+// header of manifest and tag list responses.
+func setImageStreamGenerationHeader(ctx context.Context, is imagestream.ImageStream) {
+	generation, resourceVersion, ok := is.Generation()
+	if !ok {
+		return
+	}
+
+	req, err := dcontext.GetRequest(ctx)
+	if err != nil || (req.Method != http.MethodGet && req.Method != http.MethodHead) {
+		return
+	}
+
+	w, err := dcontext.GetResponseWriter(ctx)
+	if err != nil {
+		return
+	}
+
+	w.Header().Set(imageStreamGenerationHeader, fmt.Sprintf("generation=%d, resourceVersion=%s", generation, resourceVersion))
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+
+	"github.com/openshift/image-registry/pkg/imagestream"
+)
+
+type fakeGenerationImageStream struct {
+	imagestream.ImageStream
+
+	generation      int64
+	resourceVersion string
+	fetched         bool
+}
+
+func (is *fakeGenerationImageStream) Generation() (int64, string, bool) {
+	return is.generation, is.resourceVersion, is.fetched
+}
+
+func TestSetImageStreamGenerationHeader(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		method   string
+		fetched  bool
+		expected string
+	}{
+		{
+			name:     "get",
+			method:   http.MethodGet,
+			fetched:  true,
+			expected: "generation=3, resourceVersion=12345",
+		},
+		{
+			name:     "head",
+			method:   http.MethodHead,
+			fetched:  true,
+			expected: "generation=3, resourceVersion=12345",
+		},
+		{
+			name:    "put",
+			method:  http.MethodPut,
+			fetched: true,
+		},
+		{
+			name:   "image stream not fetched",
+			method: http.MethodGet,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, "/v2/user/app/tags/list", nil)
+			ctx := dcontext.WithRequest(context.Background(), req)
+			w := httptest.NewRecorder()
+			ctx, _ = dcontext.WithResponseWriter(ctx, w)
+
+			setImageStreamGenerationHeader(ctx, &fakeGenerationImageStream{
+				generation:      3,
+				resourceVersion: "12345",
+				fetched:         tc.fetched,
+			})
+
+			if got := w.Header().Get(imageStreamGenerationHeader); got != tc.expected {
+				t.Errorf("got %s %q, want %q", imageStreamGenerationHeader, got, tc.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"context"
+
+	"github.com/distribution/distribution/v3"
+	v2 "github.com/distribution/distribution/v3/registry/api/v2"
+
+	"github.com/openshift/image-registry/pkg/imagestream"
+)
+
+// autoProvisionImageStreams returns true if the image streams are created
+// on the first push into their repositories.
+func (app *App) autoProvisionImageStreams() bool {
+	cfg := app.config.Server
+	return cfg == nil || cfg.AutoProvisionImageStreams == nil || *cfg.AutoProvisionImageStreams
+}
+
+// imageStreamRequiredBlobStore rejects the uploads into repositories whose
+// image streams don't exist. It is used when the image streams are not
+// auto provisioned, so that the clients don't upload blobs for a manifest
+// that would be rejected.
+type imageStreamRequiredBlobStore struct {
+	distribution.BlobStore
+
+	imageStream imagestream.ImageStream
+}
+
+var _ distribution.BlobStore = &imageStreamRequiredBlobStore{}
+
+func (bs *imageStreamRequiredBlobStore) Create(ctx context.Context, options ...distribution.BlobCreateOption) (distribution.BlobWriter, error) {
+	ok, err := bs.imageStream.Exists(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, v2.ErrorCodeNameUnknown.WithDetail(bs.imageStream.Reference())
+	}
+	return bs.BlobStore.Create(ctx, options...)
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	v2 "github.com/distribution/distribution/v3/registry/api/v2"
+
+	rerrors "github.com/openshift/image-registry/pkg/errors"
+	"github.com/openshift/image-registry/pkg/imagestream"
+	"github.com/openshift/image-registry/pkg/testutil"
+)
+
+// existingImageStream is an image stream that exists if exists is true.
+type existingImageStream struct {
+	imagestream.ImageStream
+
+	exists bool
+}
+
+func (is *existingImageStream) Reference() string {
+	return "user/app"
+}
+
+func (is *existingImageStream) Exists(ctx context.Context) (bool, rerrors.Error) {
+	return is.exists, nil
+}
+
+// creatingBlobStore is a blob store whose uploads are accepted.
+type creatingBlobStore struct {
+	distribution.BlobStore
+}
+
+func (bs creatingBlobStore) Create(ctx context.Context, options ...distribution.BlobCreateOption) (distribution.BlobWriter, error) {
+	return &committingBlobWriter{}, nil
+}
+
+func TestImageStreamRequiredBlobStore(t *testing.T) {
+	ctx := testutil.WithTestLogger(context.Background(), t)
+
+	bs := &imageStreamRequiredBlobStore{
+		BlobStore:   creatingBlobStore{},
+		imageStream: &existingImageStream{exists: true},
+	}
+	if _, err := bs.Create(ctx); err != nil {
+		t.Fatalf("unexpected error for an existing image stream: %v", err)
+	}
+
+	bs.imageStream = &existingImageStream{exists: false}
+	_, err := bs.Create(ctx)
+	if e, ok := err.(errcode.Error); !ok || e.Code != v2.ErrorCodeNameUnknown {
+		t.Fatalf("got %v, want NAME_UNKNOWN", err)
+	}
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+
+	imageapiv1 "github.com/openshift/api/image/v1"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/configuration"
+)
+
+const (
+	// layerOrderHeader lists the digests of the layers of an image in the
+	// order in which they are applied, the base layer first.
+	layerOrderHeader = "X-OpenShift-Layer-Order"
+
+	// layerSizesHeader lists the sizes of the layers in the same order.
+	layerSizesHeader = "X-OpenShift-Layer-Sizes"
+)
+
+// layerHintsUserAgents are the prefixes of the User-Agent headers of the
+// container runtimes that get the layer hints.
+var layerHintsUserAgents = []string{"containerd/", "cri-o/"}
+
+// layerHints tells container runtimes which layers of an image they need
+// first. Layers are applied in order, so a runtime that downloads them in
+// parallel can start unpacking earlier if the first layers are prioritized.
+type layerHints struct {
+	// prefetchLayers is the number of the first layers that are announced
+	// with Link headers.
+	prefetchLayers int
+}
+
+// newLayerHints returns nil if the hints are disabled.
+func newLayerHints(cfg configuration.ServerLayerHints) *layerHints {
+	if !cfg.Enabled {
+		return nil
+	}
+	return &layerHints{
+		prefetchLayers: cfg.PrefetchLayers,
+	}
+}
+
+// set sets the layer hint headers of the manifest response for the image in
+// the repository repo if the client is a container runtime.
+func (h *layerHints) set(ctx context.Context, repo string, image *imageapiv1.Image) {
+	if h == nil || len(image.DockerImageLayers) == 0 {
+		return
+	}
+
+	req, err := dcontext.GetRequest(ctx)
+	if err != nil || (req.Method != http.MethodGet && req.Method != http.MethodHead) || !isContainerRuntime(req.UserAgent()) {
+		return
+	}
+
+	w, err := dcontext.GetResponseWriter(ctx)
+	if err != nil {
+		return
+	}
+
+	layers := make([]imageapiv1.ImageLayer, len(image.DockerImageLayers))
+	copy(layers, image.DockerImageLayers)
+	if image.Annotations[imageapiv1.DockerImageLayersOrderAnnotation] == imageapiv1.DockerImageLayersOrderDescending {
+		for i, j := 0, len(layers)-1; i < j; i, j = i+1, j-1 {
+			layers[i], layers[j] = layers[j], layers[i]
+		}
+	}
+
+	digests := make([]string, 0, len(layers))
+	sizes := make([]string, 0, len(layers))
+	for _, layer := range layers {
+		digests = append(digests, layer.Name)
+		sizes = append(sizes, strconv.FormatInt(layer.LayerSize, 10))
+	}
+	w.Header().Set(layerOrderHeader, strings.Join(digests, ", "))
+	w.Header().Set(layerSizesHeader, strings.Join(sizes, ", "))
+
+	for i := 0; i < h.prefetchLayers && i < len(layers); i++ {
+		w.Header().Add("Link", fmt.Sprintf("</v2/%s/blobs/%s>; rel=preload", repo, layers[i].Name))
+	}
+}
+
+func isContainerRuntime(userAgent string) bool {
+	userAgent = strings.ToLower(userAgent)
+	for _, prefix := range layerHintsUserAgents {
+		if strings.HasPrefix(userAgent, prefix) {
+			return true
+		}
+	}
+	return false
+}
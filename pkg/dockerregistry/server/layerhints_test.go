@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	imageapiv1 "github.com/openshift/api/image/v1"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/configuration"
+)
+
+func TestLayerHints(t *testing.T) {
+	image := &imageapiv1.Image{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "sha256:0000000000000000000000000000000000000000000000000000000000000001",
+		},
+		DockerImageLayers: []imageapiv1.ImageLayer{
+			{Name: "sha256:a", LayerSize: 100},
+			{Name: "sha256:b", LayerSize: 20},
+			{Name: "sha256:c", LayerSize: 3},
+		},
+	}
+	descending := image.DeepCopy()
+	descending.Annotations = map[string]string{
+		imageapiv1.DockerImageLayersOrderAnnotation: imageapiv1.DockerImageLayersOrderDescending,
+	}
+	descending.DockerImageLayers[0], descending.DockerImageLayers[2] = descending.DockerImageLayers[2], descending.DockerImageLayers[0]
+
+	for _, tc := range []struct {
+		name      string
+		cfg       configuration.ServerLayerHints
+		userAgent string
+		method    string
+		image     *imageapiv1.Image
+		order     string
+		sizes     string
+		links     []string
+	}{
+		{
+			name:      "containerd",
+			cfg:       configuration.ServerLayerHints{Enabled: true},
+			userAgent: "containerd/v1.7.13",
+			method:    http.MethodGet,
+			image:     image,
+			order:     "sha256:a, sha256:b, sha256:c",
+			sizes:     "100, 20, 3",
+		},
+		{
+			name:      "cri-o with prefetching",
+			cfg:       configuration.ServerLayerHints{Enabled: true, PrefetchLayers: 2},
+			userAgent: "cri-o/1.29.1 go/go1.21 os/linux arch/amd64",
+			method:    http.MethodHead,
+			image:     image,
+			order:     "sha256:a, sha256:b, sha256:c",
+			sizes:     "100, 20, 3",
+			links: []string{
+				"</v2/user/app/blobs/sha256:a>; rel=preload",
+				"</v2/user/app/blobs/sha256:b>; rel=preload",
+			},
+		},
+		{
+			name:      "descending layers",
+			cfg:       configuration.ServerLayerHints{Enabled: true, PrefetchLayers: 5},
+			userAgent: "containerd/v1.7.13",
+			method:    http.MethodGet,
+			image:     descending,
+			order:     "sha256:a, sha256:b, sha256:c",
+			sizes:     "100, 20, 3",
+			links: []string{
+				"</v2/user/app/blobs/sha256:a>; rel=preload",
+				"</v2/user/app/blobs/sha256:b>; rel=preload",
+				"</v2/user/app/blobs/sha256:c>; rel=preload",
+			},
+		},
+		{
+			name:      "other client",
+			cfg:       configuration.ServerLayerHints{Enabled: true, PrefetchLayers: 2},
+			userAgent: "docker/24.0.7 go/go1.20.10",
+			method:    http.MethodGet,
+			image:     image,
+		},
+		{
+			name:      "disabled",
+			userAgent: "containerd/v1.7.13",
+			method:    http.MethodGet,
+			image:     image,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, "/v2/user/app/manifests/latest", nil)
+			req.Header.Set("User-Agent", tc.userAgent)
+			ctx := dcontext.WithRequest(context.Background(), req)
+			ctx, w := dcontext.WithResponseWriter(ctx, httptest.NewRecorder())
+
+			newLayerHints(tc.cfg).set(ctx, "user/app", tc.image)
+
+			header := w.Header()
+			if got := header.Get(layerOrderHeader); got != tc.order {
+				t.Errorf("got %s %q, want %q", layerOrderHeader, got, tc.order)
+			}
+			if got := header.Get(layerSizesHeader); got != tc.sizes {
+				t.Errorf("got %s %q, want %q", layerSizesHeader, got, tc.sizes)
+			}
+			if got := header.Values("Link"); len(got) != len(tc.links) || (len(got) > 0 && !reflect.DeepEqual(got, tc.links)) {
+				t.Errorf("got Link headers %q, want %q", got, tc.links)
+			}
+		})
+	}
+}
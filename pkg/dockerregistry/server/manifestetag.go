@@ -0,0 +1,144 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	regapi "github.com/distribution/distribution/v3/registry/api/v2"
+	"github.com/gorilla/mux"
+
+	imageapiv1 "github.com/openshift/api/image/v1"
+)
+
+// manifestETagHandler evaluates the conditional manifest requests instead of
+// distribution. The upstream handler emits the manifest digest as a strong
+// ETag and responds with 304 if one of the If-None-Match header values is
+// equal to the digest, but it neither understands lists of entity tags, weak
+// validators nor "*", and it doesn't send the ETag with 304 responses.
+//
+// The manifest is served by distribution without the condition, and its
+// response is replaced by 304 if its digest matches one of the entity tags,
+// so that the digest is known for tags and for the manifests that are
+// converted to other media types.
+type manifestETagHandler struct {
+	router  *mux.Router
+	handler http.Handler
+}
+
+func newManifestETagHandler(prefix string, handler http.Handler) http.Handler {
+	return &manifestETagHandler{
+		router:  regapi.RouterWithPrefix(prefix),
+		handler: handler,
+	}
+}
+
+func (h *manifestETagHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if (r.Method != http.MethodGet && r.Method != http.MethodHead) || len(r.Header["If-None-Match"]) == 0 {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+
+	var match mux.RouteMatch
+	if !h.router.Match(r, &match) || match.Route.GetName() != regapi.RouteNameManifest {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+
+	etags := parseETags(r.Header["If-None-Match"])
+	r.Header.Del("If-None-Match")
+
+	h.handler.ServeHTTP(&notModifiedResponseWriter{
+		ResponseWriter: w,
+		etags:          etags,
+	}, r)
+}
+
+// parseETags splits If-None-Match header values into a list of unquoted
+// entity tags. Weak validators are treated as strong ones as If-None-Match
+// uses the weak comparison function.
+func parseETags(values []string) []string {
+	var etags []string
+	for _, value := range values {
+		for _, etag := range strings.Split(value, ",") {
+			etag = strings.TrimSpace(etag)
+			etag = strings.TrimPrefix(etag, "W/")
+			etag = strings.Trim(etag, `"`)
+			if len(etag) == 0 {
+				continue
+			}
+			etags = append(etags, etag)
+		}
+	}
+	return etags
+}
+
+// etagsMatch returns true if one of etags is the digest dgst or "*", which
+// matches any existing manifest.
+func etagsMatch(etags []string, dgst string) bool {
+	for _, etag := range etags {
+		if etag == "*" || etag == dgst {
+			return true
+		}
+	}
+	return false
+}
+
+// notModifiedResponseWriter replaces the successful responses with the
+// manifests that match the entity tags with 304 responses that have the
+// entity tag and the digest headers.
+type notModifiedResponseWriter struct {
+	http.ResponseWriter
+	etags []string
+
+	wroteHeader bool
+	notModified bool
+}
+
+func (w *notModifiedResponseWriter) WriteHeader(statusCode int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	dgst := w.Header().Get("Docker-Content-Digest")
+	if statusCode == http.StatusOK && len(dgst) > 0 && etagsMatch(w.etags, dgst) {
+		w.notModified = true
+		statusCode = http.StatusNotModified
+		w.Header().Set("Etag", `"`+dgst+`"`)
+		w.Header().Del("Content-Length")
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *notModifiedResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.notModified {
+		// The 304 responses have no body.
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// setLastModifiedHeader sets the Last-Modified header of manifest responses to
+// the creation time of the image.
+func setLastModifiedHeader(ctx context.Context, image *imageapiv1.Image) {
+	if image.CreationTimestamp.IsZero() {
+		return
+	}
+
+	req, err := dcontext.GetRequest(ctx)
+	if err != nil || (req.Method != http.MethodGet && req.Method != http.MethodHead) {
+		return
+	}
+
+	w, err := dcontext.GetResponseWriter(ctx)
+	if err != nil {
+		return
+	}
+
+	w.Header().Set("Last-Modified", image.CreationTimestamp.UTC().Format(http.TimeFormat))
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseETags(t *testing.T) {
+	for _, tc := range []struct {
+		values []string
+		want   []string
+	}{
+		{values: []string{"sha256:a"}, want: []string{"sha256:a"}},
+		{values: []string{`"sha256:a"`}, want: []string{"sha256:a"}},
+		{values: []string{`W/"sha256:a"`}, want: []string{"sha256:a"}},
+		{values: []string{`"sha256:a", W/"sha256:b"`, `"sha256:c"`}, want: []string{"sha256:a", "sha256:b", "sha256:c"}},
+		{values: []string{` , `}, want: nil},
+	} {
+		if got := parseETags(tc.values); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseETags(%q): got %q, want %q", tc.values, got, tc.want)
+		}
+	}
+}
+
+func TestManifestETagHandler(t *testing.T) {
+	const dgst = "sha256:4355a46b19d348dc2f57c046f8ef63d4538ebb936000f3c9ee954a27460dd865"
+
+	// inner mimics the conditional handling of the upstream manifest handler.
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/missing") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		for _, etag := range r.Header["If-None-Match"] {
+			if etag == dgst {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		w.Header().Set("Etag", `"`+dgst+`"`)
+		w.Header().Set("Docker-Content-Digest", dgst)
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("{}"))
+	})
+	h := newManifestETagHandler("", inner)
+
+	for _, tc := range []struct {
+		name        string
+		method      string
+		path        string
+		ifNoneMatch string
+		moreTags    []string
+		wantStatus  int
+		wantETag    string
+	}{
+		{
+			name:        "weak validator",
+			method:      http.MethodGet,
+			path:        "/v2/ns/is/manifests/latest",
+			ifNoneMatch: `W/"` + dgst + `"`,
+			wantStatus:  http.StatusNotModified,
+			wantETag:    `"` + dgst + `"`,
+		},
+		{
+			name:        "list of entity tags",
+			method:      http.MethodHead,
+			path:        "/v2/ns/is/manifests/latest",
+			ifNoneMatch: `"sha256:0", "` + dgst + `"`,
+			wantStatus:  http.StatusNotModified,
+			wantETag:    `"` + dgst + `"`,
+		},
+		{
+			name:        "list of entity tags in several headers",
+			method:      http.MethodGet,
+			path:        "/v2/ns/is/manifests/" + dgst,
+			ifNoneMatch: `"sha256:0"`,
+			moreTags:    []string{`W/"` + dgst + `"`},
+			wantStatus:  http.StatusNotModified,
+			wantETag:    `"` + dgst + `"`,
+		},
+		{
+			name:        "any manifest",
+			method:      http.MethodGet,
+			path:        "/v2/ns/is/manifests/latest",
+			ifNoneMatch: "*",
+			wantStatus:  http.StatusNotModified,
+			wantETag:    `"` + dgst + `"`,
+		},
+		{
+			name:        "any manifest that doesn't exist",
+			method:      http.MethodGet,
+			path:        "/v2/ns/is/manifests/missing",
+			ifNoneMatch: "*",
+			wantStatus:  http.StatusNotFound,
+		},
+		{
+			name:        "no match",
+			method:      http.MethodGet,
+			path:        "/v2/ns/is/manifests/latest",
+			ifNoneMatch: `"sha256:0"`,
+			wantStatus:  http.StatusOK,
+			wantETag:    `"` + dgst + `"`,
+		},
+		{
+			name:        "not a manifest",
+			method:      http.MethodGet,
+			path:        "/v2/ns/is/blobs/" + dgst,
+			ifNoneMatch: `W/"` + dgst + `"`,
+			wantStatus:  http.StatusOK,
+			wantETag:    `"` + dgst + `"`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.path, nil)
+			req.Header.Set("If-None-Match", tc.ifNoneMatch)
+			for _, etag := range tc.moreTags {
+				req.Header.Add("If-None-Match", etag)
+			}
+			w := httptest.NewRecorder()
+
+			h.ServeHTTP(w, req)
+
+			if w.Code != tc.wantStatus {
+				t.Errorf("got status %d, want %d", w.Code, tc.wantStatus)
+			}
+			if etag := w.Header().Get("Etag"); etag != tc.wantETag {
+				t.Errorf("got Etag %q, want %q", etag, tc.wantETag)
+			}
+			if w.Code == http.StatusNotModified {
+				if got := w.Header().Get("Docker-Content-Digest"); got != dgst {
+					t.Errorf("got Docker-Content-Digest %q, want %q", got, dgst)
+				}
+				if w.Body.Len() != 0 {
+					t.Errorf("got a body %q with the 304 response", w.Body.String())
+				}
+			}
+		})
+	}
+}
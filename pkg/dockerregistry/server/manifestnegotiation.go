@@ -0,0 +1,118 @@
+package server
+
+import (
+	"context"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/manifest/manifestlist"
+	"github.com/distribution/distribution/v3/manifest/schema2"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/opencontainers/go-digest"
+	ociv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var ErrorCodeManifestNotAcceptable = errcode.Register(errGroup, errcode.ErrorDescriptor{
+	Value:          "MANIFEST_NOT_ACCEPTABLE",
+	Message:        "manifest is stored as %s, which is not allowed by the Accept header",
+	HTTPStatusCode: http.StatusNotAcceptable,
+})
+
+// manifestMediaTypes are the media types of the manifests that clients
+// negotiate with the Accept header.
+var manifestMediaTypes = []string{
+	schema2.MediaTypeManifest,
+	manifestlist.MediaTypeManifestList,
+	ociv1.MediaTypeImageManifest,
+	ociv1.MediaTypeImageIndex,
+}
+
+// negotiatingManifestService rejects the manifests that the client doesn't
+// accept. Distribution responds with 404 to such requests, so the rejection
+// is stored in the ociConversion of the request and ociConversionHandler
+// responds with 406 and the accepted media types instead. It is used when
+// openshift.compatibility.negotiatemanifests is set and it wraps
+// ociConvertingManifestService, so the manifests that can be converted are
+// not rejected.
+type negotiatingManifestService struct {
+	distribution.ManifestService
+}
+
+var _ distribution.ManifestService = &negotiatingManifestService{}
+
+func (m *negotiatingManifestService) Get(ctx context.Context, dgst digest.Digest, options ...distribution.ManifestServiceOption) (distribution.Manifest, error) {
+	manifest, err := m.ManifestService.Get(ctx, dgst, options...)
+	if err != nil {
+		return manifest, err
+	}
+
+	conversion := ociConversionFrom(ctx)
+	req, err := dcontext.GetRequest(ctx)
+	if conversion == nil || err != nil {
+		return manifest, nil
+	}
+	mediaType, _, err := manifest.Payload()
+	if err != nil {
+		return nil, err
+	}
+
+	// Schema 1 manifests are served to all clients, unless they are
+	// disabled.
+	if !acceptsMediaType(manifestMediaTypes, mediaType) {
+		return manifest, nil
+	}
+
+	accepted, ok := acceptedManifestMediaTypes(req)
+	if ok || acceptsMediaType(accepted, mediaType) {
+		return manifest, nil
+	}
+	// Old Docker clients accept schema 2, but not manifest lists.
+	// Distribution serves them the schema 1 manifest for linux/amd64.
+	if mediaType == manifestlist.MediaTypeManifestList && len(accepted) == 1 && accepted[0] == schema2.MediaTypeManifest {
+		return manifest, nil
+	}
+
+	dcontext.GetLogger(ctx).Errorf("manifest %s is stored as %s, the client accepts %s", dgst, mediaType, strings.Join(accepted, ", "))
+	conversion.notAcceptable = ErrorCodeManifestNotAcceptable.WithArgs(mediaType).WithDetail(map[string]interface{}{
+		"mediaType": mediaType,
+		"accepted":  accepted,
+	})
+	return nil, distribution.ErrManifestUnknownRevision{
+		Name:     dcontext.GetStringValue(ctx, "vars.name"),
+		Revision: dgst,
+	}
+}
+
+// acceptedManifestMediaTypes returns the manifest media types from the Accept
+// headers of req. It returns true if the client accepts any manifest, i.e. it
+// sends */* or no manifest media types at all.
+func acceptedManifestMediaTypes(req *http.Request) ([]string, bool) {
+	var accepted []string
+	for _, accept := range req.Header.Values("Accept") {
+		for _, mediaType := range strings.Split(accept, ",") {
+			mediaType, _, err := mime.ParseMediaType(mediaType)
+			if err != nil {
+				continue
+			}
+			if mediaType == "*/*" {
+				return nil, true
+			}
+			if acceptsMediaType(manifestMediaTypes, mediaType) && !acceptsMediaType(accepted, mediaType) {
+				accepted = append(accepted, mediaType)
+			}
+		}
+	}
+	return accepted, len(accepted) == 0
+}
+
+func acceptsMediaType(mediaTypes []string, mediaType string) bool {
+	for _, m := range mediaTypes {
+		if m == mediaType {
+			return true
+		}
+	}
+	return false
+}
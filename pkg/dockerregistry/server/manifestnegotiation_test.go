@@ -0,0 +1,238 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/manifest"
+	"github.com/distribution/distribution/v3/manifest/manifestlist"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/distribution/v3/manifest/schema1"
+	"github.com/distribution/distribution/v3/manifest/schema2"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	regapi "github.com/distribution/distribution/v3/registry/api/v2"
+	"github.com/gorilla/mux"
+	"github.com/opencontainers/go-digest"
+	ociv1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/openshift/image-registry/pkg/testutil"
+)
+
+// The Accept headers that the clients send for manifest requests.
+var (
+	containerdAccept = []string{
+		schema2.MediaTypeManifest + ", " + manifestlist.MediaTypeManifestList + ", " + ociv1.MediaTypeImageManifest + ", " + ociv1.MediaTypeImageIndex + ", */*",
+	}
+	podmanAccept = []string{
+		ociv1.MediaTypeImageManifest,
+		ociv1.MediaTypeImageIndex,
+		manifestlist.MediaTypeManifestList,
+		schema2.MediaTypeManifest,
+		schema1.MediaTypeSignedManifest,
+		schema1.MediaTypeManifest,
+	}
+	dockerAccept = []string{
+		schema2.MediaTypeManifest,
+		manifestlist.MediaTypeManifestList,
+		ociv1.MediaTypeImageIndex,
+		ociv1.MediaTypeImageManifest,
+		schema1.MediaTypeSignedManifest,
+	}
+	strictOCIAccept = []string{
+		ociv1.MediaTypeImageManifest + ", " + ociv1.MediaTypeImageIndex,
+	}
+	oldDockerAccept = []string{
+		schema2.MediaTypeManifest,
+	}
+)
+
+func TestNegotiatingManifestServiceGet(t *testing.T) {
+	image, err := schema2.FromStruct(schema2.Manifest{
+		Versioned: schema2.SchemaVersion,
+		Config:    distribution.Descriptor{Digest: digest.FromString("config"), Size: 6, MediaType: schema2.MediaTypeImageConfig},
+		Layers: []distribution.Descriptor{
+			{Digest: digest.FromString("layer"), Size: 5, MediaType: schema2.MediaTypeLayer},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ociImage, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned: manifest.Versioned{SchemaVersion: 2, MediaType: ociv1.MediaTypeImageManifest},
+		Config:    distribution.Descriptor{Digest: digest.FromString("config"), Size: 6, MediaType: ociv1.MediaTypeImageConfig},
+		Layers: []distribution.Descriptor{
+			{Digest: digest.FromString("layer"), Size: 5, MediaType: ociv1.MediaTypeImageLayerGzip},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifests := map[digest.Digest]distribution.Manifest{}
+	add := func(m distribution.Manifest) digest.Digest {
+		_, payload, err := m.Payload()
+		if err != nil {
+			t.Fatal(err)
+		}
+		dgst := digest.FromBytes(payload)
+		manifests[dgst] = m
+		return dgst
+	}
+	imageDigest := add(image)
+	ociImageDigest := add(ociImage)
+
+	list, err := manifestlist.FromDescriptors([]manifestlist.ManifestDescriptor{{
+		Descriptor: distribution.Descriptor{Digest: imageDigest, MediaType: schema2.MediaTypeManifest},
+		Platform:   manifestlist.PlatformSpec{Architecture: "arm64", OS: "linux"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := manifestlist.FromDescriptorsWithMediaType([]manifestlist.ManifestDescriptor{{
+		Descriptor: distribution.Descriptor{Digest: ociImageDigest, MediaType: ociv1.MediaTypeImageManifest},
+		Platform:   manifestlist.PlatformSpec{Architecture: "s390x", OS: "linux"},
+	}}, ociv1.MediaTypeImageIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listDigest := add(list)
+	indexDigest := add(index)
+
+	ms := &negotiatingManifestService{
+		ManifestService: &ociConvertingManifestService{
+			ManifestService: testutil.NewFakeManifestService("user/app", manifests),
+			conversions:     newOCIConversions(),
+		},
+	}
+
+	stored := []struct {
+		mediaType string
+		digest    digest.Digest
+	}{
+		{schema2.MediaTypeManifest, imageDigest},
+		{manifestlist.MediaTypeManifestList, listDigest},
+		{ociv1.MediaTypeImageManifest, ociImageDigest},
+		{ociv1.MediaTypeImageIndex, indexDigest},
+	}
+	for _, tc := range []struct {
+		client   string
+		accept   []string
+		byDigest bool
+		// expected are the media types served for the stored manifests
+		// in the order of stored. Empty values are not acceptable.
+		expected []string
+	}{
+		{
+			client:   "containerd",
+			accept:   containerdAccept,
+			expected: []string{schema2.MediaTypeManifest, manifestlist.MediaTypeManifestList, ociv1.MediaTypeImageManifest, ociv1.MediaTypeImageIndex},
+		},
+		{
+			client:   "podman",
+			accept:   podmanAccept,
+			expected: []string{schema2.MediaTypeManifest, manifestlist.MediaTypeManifestList, ociv1.MediaTypeImageManifest, ociv1.MediaTypeImageIndex},
+		},
+		{
+			client:   "docker",
+			accept:   dockerAccept,
+			expected: []string{schema2.MediaTypeManifest, manifestlist.MediaTypeManifestList, ociv1.MediaTypeImageManifest, ociv1.MediaTypeImageIndex},
+		},
+		{
+			client:   "docker by digest",
+			accept:   dockerAccept,
+			byDigest: true,
+			expected: []string{schema2.MediaTypeManifest, manifestlist.MediaTypeManifestList, ociv1.MediaTypeImageManifest, ociv1.MediaTypeImageIndex},
+		},
+		{
+			client:   "strict OCI client",
+			accept:   strictOCIAccept,
+			expected: []string{ociv1.MediaTypeImageManifest, ociv1.MediaTypeImageIndex, ociv1.MediaTypeImageManifest, ociv1.MediaTypeImageIndex},
+		},
+		{
+			client:   "strict OCI client by digest",
+			accept:   strictOCIAccept,
+			byDigest: true,
+			expected: []string{"", "", ociv1.MediaTypeImageManifest, ociv1.MediaTypeImageIndex},
+		},
+		{
+			client:   "old docker",
+			accept:   oldDockerAccept,
+			expected: []string{schema2.MediaTypeManifest, manifestlist.MediaTypeManifestList, "", ""},
+		},
+		{
+			client:   "no Accept header",
+			expected: []string{schema2.MediaTypeManifest, manifestlist.MediaTypeManifestList, ociv1.MediaTypeImageManifest, ociv1.MediaTypeImageIndex},
+		},
+	} {
+		for i, s := range stored {
+			reference := "latest"
+			if tc.byDigest {
+				reference = s.digest.String()
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/v2/user/app/manifests/"+reference, nil)
+			for _, a := range tc.accept {
+				req.Header.Add("Accept", a)
+			}
+			req = mux.SetURLVars(req, map[string]string{"name": "user/app", "reference": reference})
+			conversion := &ociConversion{}
+			ctx := testutil.WithTestLogger(context.Background(), t)
+			ctx = withOCIConversion(ctx, conversion)
+			ctx = dcontext.WithRequest(ctx, req)
+			ctx = dcontext.WithVars(ctx, req)
+
+			m, err := ms.Get(ctx, s.digest)
+			if tc.expected[i] == "" {
+				if _, ok := err.(distribution.ErrManifestUnknownRevision); !ok || conversion.notAcceptable == nil {
+					t.Errorf("%s: %s: got %v (negotiation error %v), want the manifest to be not acceptable", tc.client, s.mediaType, err, conversion.notAcceptable)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("%s: %s: %v", tc.client, s.mediaType, err)
+				continue
+			}
+			if mediaType, _, _ := m.Payload(); mediaType != tc.expected[i] || conversion.notAcceptable != nil {
+				t.Errorf("%s: %s: got %s (negotiation error %v), want %s", tc.client, s.mediaType, mediaType, conversion.notAcceptable, tc.expected[i])
+			}
+		}
+	}
+}
+
+func TestOCIConversionHandlerNotAcceptable(t *testing.T) {
+	h := newOCIConversionHandler("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ociConversionFrom(r.Context()).notAcceptable = ErrorCodeManifestNotAcceptable.WithArgs(ociv1.MediaTypeImageIndex).WithDetail(map[string]interface{}{
+			"mediaType": ociv1.MediaTypeImageIndex,
+			"accepted":  []string{schema2.MediaTypeManifest},
+		})
+		_ = errcode.ServeJSON(w, regapi.ErrorCodeManifestUnknown)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/v2/user/app/manifests/latest", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNotAcceptable {
+		t.Errorf("got status code %d, want %d", w.Code, http.StatusNotAcceptable)
+	}
+	var errs struct {
+		Errors []struct {
+			Code   string `json:"code"`
+			Detail struct {
+				MediaType string   `json:"mediaType"`
+				Accepted  []string `json:"accepted"`
+			} `json:"detail"`
+		} `json:"errors"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &errs); err != nil {
+		t.Fatalf("unable to decode the response %q: %v", w.Body.String(), err)
+	}
+	if len(errs.Errors) != 1 || errs.Errors[0].Code != "MANIFEST_NOT_ACCEPTABLE" || errs.Errors[0].Detail.MediaType != ociv1.MediaTypeImageIndex || len(errs.Errors[0].Detail.Accepted) != 1 {
+		t.Errorf("got the response %s, want only the negotiation error", w.Body.String())
+	}
+}
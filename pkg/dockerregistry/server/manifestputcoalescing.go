@@ -0,0 +1,87 @@
+package server
+
+import (
+	"context"
+	"sync"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/opencontainers/go-digest"
+)
+
+// manifestPutCall is a manifest push in progress. Its result is available
+// when done is closed.
+type manifestPutCall struct {
+	done chan struct{}
+	err  error
+}
+
+// manifestPutCoalescer combines the identical manifest pushes that are
+// handled at the same time, e.g. by parallel CI jobs that push the same
+// image. Only one of them stores the manifest and creates the Image and the
+// image stream mapping, the others return its result if it succeeds.
+type manifestPutCoalescer struct {
+	mu    sync.Mutex
+	calls map[string]*manifestPutCall
+
+	// waiting allows to observe the requests that wait for a push in
+	// progress for tests.
+	waiting func(key string)
+}
+
+func newManifestPutCoalescer() *manifestPutCoalescer {
+	return &manifestPutCoalescer{
+		calls: make(map[string]*manifestPutCall),
+	}
+}
+
+// manifestPutKey identifies the push of the manifest dgst to the tag of the
+// repository. The tag is empty for the pushes by digest.
+func manifestPutKey(repository string, dgst digest.Digest, tag string) string {
+	return repository + "@" + dgst.String() + " " + tag
+}
+
+// do runs put unless an identical push is in progress, in which case it
+// waits for the push in progress and returns nil if it succeeds. The failures
+// are not shared, as they can be caused by the client of the push, e.g. by
+// its canceled context or its permissions, so put is run for ctx after the
+// push in progress fails.
+func (c *manifestPutCoalescer) do(ctx context.Context, key string, put func() error) error {
+	for {
+		c.mu.Lock()
+		call, ok := c.calls[key]
+		if !ok {
+			break
+		}
+		c.mu.Unlock()
+		if c.waiting != nil {
+			c.waiting(key)
+		}
+
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if call.err != nil {
+			dcontext.GetLogger(ctx).Debugf("manifestPutCoalescer: the concurrent push %s failed, pushing again: %v", key, call.err)
+			continue
+		}
+		dcontext.GetLogger(ctx).Debugf("manifestPutCoalescer: reusing the result of the concurrent push %s", key)
+		return nil
+	}
+
+	call := &manifestPutCall{
+		done: make(chan struct{}),
+	}
+	c.calls[key] = call
+	c.mu.Unlock()
+
+	call.err = put()
+
+	c.mu.Lock()
+	delete(c.calls, key)
+	c.mu.Unlock()
+	close(call.done)
+
+	return call.err
+}
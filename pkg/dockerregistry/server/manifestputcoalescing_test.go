@@ -0,0 +1,183 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/opencontainers/go-digest"
+
+	registryclient "github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+	"github.com/openshift/image-registry/pkg/imagestream"
+	"github.com/openshift/image-registry/pkg/testutil"
+)
+
+// blockingManifestService is a manifest service whose pushes wait until
+// release is closed.
+type blockingManifestService struct {
+	distribution.ManifestService
+
+	puts    atomic.Int32
+	started chan struct{}
+	release chan struct{}
+}
+
+func (ms *blockingManifestService) Put(ctx context.Context, manifest distribution.Manifest, options ...distribution.ManifestServiceOption) (digest.Digest, error) {
+	ms.puts.Add(1)
+	ms.started <- struct{}{}
+	<-ms.release
+	return ms.ManifestService.Put(ctx, manifest, options...)
+}
+
+// notifyWaiting makes c send the keys of the waiting requests to the
+// returned channel.
+func notifyWaiting(c *manifestPutCoalescer) <-chan string {
+	waiting := make(chan string, 10)
+	c.waiting = func(key string) {
+		waiting <- key
+	}
+	return waiting
+}
+
+func TestManifestPutCoalescing(t *testing.T) {
+	ctx := context.Background()
+	ctx = testutil.WithTestLogger(ctx, t)
+
+	namespace := "user"
+	repo := "app"
+
+	fos, imageClient := testutil.NewFakeOpenShiftWithClient(ctx)
+	testutil.AddImageStream(t, fos, namespace, repo, nil)
+	bs := testutil.NewFakeBlobStore(nil, testutil.BlobContents{
+		"testblob:1":   []byte("{}"),
+		"testconfig:2": []byte("{}"),
+	})
+	tms := &blockingManifestService{
+		ManifestService: testutil.NewFakeManifestService(namespace+"/"+repo, nil),
+		started:         make(chan struct{}, 10),
+		release:         make(chan struct{}),
+	}
+	client := registryclient.NewFakeRegistryAPIClient(nil, imageClient)
+	coalescer := newManifestPutCoalescer()
+	waiting := notifyWaiting(coalescer)
+	ms := &manifestService{
+		serverAddr:       "localhost",
+		manifests:        tms,
+		blobStore:        bs,
+		registryOSClient: client,
+		imageStream:      imagestream.New(ctx, namespace, repo, client),
+		acceptSchema2:    true,
+		puts:             coalescer,
+	}
+	osclient, err := registryclient.NewFakeRegistryClient(imageClient).Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	putCtx := withUserClient(withAuthPerformed(ctx), osclient)
+
+	manifest, err := testutil.MakeSchema2Manifest(
+		distribution.Descriptor{Digest: "testconfig:2", Size: 2},
+		[]distribution.Descriptor{{Digest: "testblob:1", Size: 2}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	results := make([]digest.Digest, 3)
+	put := func(i int, tag string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dgst, err := ms.Put(putCtx, manifest, distribution.WithTag(tag))
+			if err != nil {
+				t.Errorf("put %d: %v", i, err)
+			}
+			results[i] = dgst
+		}()
+	}
+
+	put(0, "latest")
+	<-tms.started
+
+	// The identical push waits for the first one.
+	put(1, "latest")
+	<-waiting
+
+	// The push of another tag isn't combined.
+	put(2, "v1")
+	<-tms.started
+
+	close(tms.release)
+	wg.Wait()
+
+	if puts := tms.puts.Load(); puts != 2 {
+		t.Errorf("got %d manifest puts, want 2", puts)
+	}
+	for i, dgst := range results {
+		if dgst != results[0] || dgst == "" {
+			t.Errorf("put %d: got digest %q, want %q", i, dgst, results[0])
+		}
+	}
+
+	is, err := fos.GetImageStream(namespace, repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := map[string]int{}
+	for _, tag := range is.Status.Tags {
+		events[tag.Tag] = len(tag.Items)
+	}
+	if events["latest"] != 1 || events["v1"] != 1 {
+		t.Errorf("got tag events %v, want one for latest and one for v1", events)
+	}
+}
+
+func TestManifestPutCoalescerFailed(t *testing.T) {
+	for _, failure := range []error{
+		context.Canceled,
+		errors.New("the user isn't allowed to create the image"),
+	} {
+		coalescer := newManifestPutCoalescer()
+		waiting := notifyWaiting(coalescer)
+		key := manifestPutKey("user/app", "sha256:0000000000000000000000000000000000000000000000000000000000000001", "latest")
+
+		started := make(chan struct{})
+		release := make(chan struct{})
+		done := make(chan error)
+		go func() {
+			done <- coalescer.do(context.Background(), key, func() error {
+				close(started)
+				<-release
+				return failure
+			})
+		}()
+		<-started
+
+		// The push in progress fails, so the waiting request pushes the
+		// manifest itself.
+		calls := 0
+		waiterDone := make(chan error)
+		go func() {
+			waiterDone <- coalescer.do(context.Background(), key, func() error {
+				calls++
+				return nil
+			})
+		}()
+		<-waiting
+		close(release)
+
+		if err := <-done; err != failure {
+			t.Errorf("got %v, want %v", err, failure)
+		}
+		if err := <-waiterDone; err != nil {
+			t.Errorf("%v: unexpected error: %v", failure, err)
+		}
+		if calls != 1 {
+			t.Errorf("%v: got %d calls, want 1", failure, calls)
+		}
+	}
+}
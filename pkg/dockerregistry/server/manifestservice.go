@@ -3,9 +3,12 @@ package server
 import (
 	"context"
 	"fmt"
+	"net/http"
+	"strings"
 
 	"github.com/distribution/distribution/v3"
 	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
 	"github.com/distribution/distribution/v3/manifest/schema2"
 	"github.com/distribution/distribution/v3/registry/api/errcode"
 	regapi "github.com/distribution/distribution/v3/registry/api/v2"
@@ -17,11 +20,51 @@ import (
 	"github.com/openshift/image-registry/pkg/dockerregistry/server/cache"
 	"github.com/openshift/image-registry/pkg/dockerregistry/server/client"
 	"github.com/openshift/image-registry/pkg/dockerregistry/server/manifesthandler"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/policy"
 	"github.com/openshift/image-registry/pkg/imagestream"
+	"github.com/openshift/library-go/pkg/quota/quotautil"
 )
 
 var _ distribution.ManifestService = &manifestService{}
 
+var (
+	ErrorCodeManifestTooLarge = errcode.Register(errGroup, errcode.ErrorDescriptor{
+		Value:          "MANIFEST_TOO_LARGE",
+		Message:        "manifest size %d exceeds the limit of %d bytes",
+		HTTPStatusCode: http.StatusRequestEntityTooLarge,
+	})
+
+	ErrorCodeManifestTooManyLayers = errcode.Register(errGroup, errcode.ErrorDescriptor{
+		Value:          "MANIFEST_TOO_MANY_LAYERS",
+		Message:        "manifest has %d layers, the limit is %d",
+		HTTPStatusCode: http.StatusBadRequest,
+	})
+
+	ErrorCodeManifestMediaTypeBlocked = errcode.Register(errGroup, errcode.ErrorDescriptor{
+		Value:          "MANIFEST_MEDIA_TYPE_BLOCKED",
+		Message:        "media type %s is not allowed in this registry",
+		HTTPStatusCode: http.StatusBadRequest,
+	})
+
+	ErrorCodeManifestForeignLayer = errcode.Register(errGroup, errcode.ErrorDescriptor{
+		Value:          "MANIFEST_FOREIGN_LAYER",
+		Message:        "layer %s has external URLs, which are not allowed in this registry",
+		HTTPStatusCode: http.StatusBadRequest,
+	})
+
+	ErrorCodeForeignLayerUnavailable = errcode.Register(errGroup, errcode.ErrorDescriptor{
+		Value:          "FOREIGN_LAYER_UNAVAILABLE",
+		Message:        "unable to download foreign layer %s",
+		HTTPStatusCode: http.StatusBadGateway,
+	})
+
+	ErrorCodeTagImmutable = errcode.Register(errGroup, errcode.ErrorDescriptor{
+		Value:          "TAG_IMMUTABLE",
+		Message:        "tag %s is immutable and already refers to image %s",
+		HTTPStatusCode: http.StatusConflict,
+	})
+)
+
 type manifestService struct {
 	manifests distribution.ManifestService
 	blobStore distribution.BlobStore
@@ -33,6 +76,89 @@ type manifestService struct {
 
 	// acceptSchema2 allows to refuse the manifest schema version 2
 	acceptSchema2 bool
+
+	// maxManifestBytes limits the size of a manifest payload. A zero value
+	// means no limit.
+	maxManifestBytes int64
+
+	// maxLayers limits the number of layers of an image. A zero value means
+	// no limit.
+	maxLayers int
+
+	// manifestAnnotations are the annotations of OCI manifests that are
+	// copied into the Image objects.
+	manifestAnnotations []string
+
+	// allowedMediaTypes and blockedMediaTypes restrict the media types of
+	// pushed manifests and of their references.
+	allowedMediaTypes []string
+	blockedMediaTypes []string
+
+	// rejectForeignLayers rejects manifests with layers with external URLs.
+	rejectForeignLayers bool
+
+	// foreignLayerMirror downloads the layers with external URLs of pushed
+	// manifests. It is nil if the layers are not mirrored.
+	foreignLayerMirror *foreignLayerMirror
+
+	// admitBlob checks a blob size against the image limit ranges. It is nil
+	// if the quota is not enforced.
+	admitBlob func(ctx context.Context, size int64) error
+
+	// pushRejected records the reason of a push rejected by the quota on the
+	// image stream. It is nil if the quota is not enforced.
+	pushRejected func(ctx context.Context, messageFmt string, args ...interface{})
+
+	// policyHooks can reject the pushed manifests and the tags they move.
+	policyHooks policy.Hooks
+
+	// layerHints tells container runtimes the order of the layers of the
+	// served images. It is nil if the hints are disabled.
+	layerHints *layerHints
+
+	// puts combines the identical pushes of the manifest. If it is nil, the
+	// pushes are not combined.
+	puts *manifestPutCoalescer
+}
+
+// checkMediaTypes checks the media types of the manifest and of the
+// descriptors it references against the allowed and blocked media types.
+func (m *manifestService) checkMediaTypes(mediaType string, manifest distribution.Manifest) error {
+	if len(m.allowedMediaTypes) == 0 && len(m.blockedMediaTypes) == 0 {
+		return nil
+	}
+
+	mediaTypes := []string{mediaType}
+	for _, ref := range manifest.References() {
+		if ref.MediaType != "" {
+			mediaTypes = append(mediaTypes, ref.MediaType)
+		}
+	}
+
+	for _, mediaType := range mediaTypes {
+		if matchMediaType(m.blockedMediaTypes, mediaType) {
+			return ErrorCodeManifestMediaTypeBlocked.WithArgs(mediaType)
+		}
+		if len(m.allowedMediaTypes) > 0 && !matchMediaType(m.allowedMediaTypes, mediaType) {
+			return ErrorCodeManifestMediaTypeBlocked.WithArgs(mediaType)
+		}
+	}
+	return nil
+}
+
+// matchMediaType reports whether mediaType matches one of the patterns. A
+// pattern that ends with * matches all media types with the prefix.
+func matchMediaType(patterns []string, mediaType string) bool {
+	for _, pattern := range patterns {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(mediaType, prefix) {
+				return true
+			}
+		} else if pattern == mediaType {
+			return true
+		}
+	}
+	return false
 }
 
 // Exists returns true if the manifest specified by dgst exists.
@@ -98,6 +224,9 @@ func (m *manifestService) Get(ctx context.Context, dgst digest.Digest, options .
 	}
 
 	RememberLayersOfImage(ctx, m.cache, image, ref)
+	setLastModifiedHeader(ctx, image)
+	setImageStreamGenerationHeader(ctx, m.imageStream)
+	m.layerHints.set(ctx, m.imageStream.Reference(), image)
 
 	return manifest, nil
 }
@@ -121,23 +250,22 @@ func (m *manifestService) Put(ctx context.Context, manifest distribution.Manifes
 		return "", regapi.ErrorCodeManifestInvalid.WithDetail(fmt.Errorf("manifest V2 schema 2 not allowed"))
 	}
 
-	// in order to stat the referenced blobs, repository need to be set on the context
-	if err := mh.Verify(ctx, false); err != nil {
-		return "", err
+	if m.maxManifestBytes > 0 && int64(len(payload)) > m.maxManifestBytes {
+		return "", ErrorCodeManifestTooLarge.WithArgs(len(payload), m.maxManifestBytes)
 	}
 
-	_, err = m.manifests.Put(ctx, manifest, options...)
-	if err != nil {
+	if err := m.checkMediaTypes(mediaType, manifest); err != nil {
 		return "", err
 	}
 
-	config, err := mh.Config(ctx)
-	if err != nil {
-		return "", err
+	if m.rejectForeignLayers {
+		if layers := foreignLayers(manifest); len(layers) != 0 {
+			return "", ErrorCodeManifestForeignLayer.WithArgs(layers[0].Digest)
+		}
 	}
 
-	dgst, err := mh.Digest()
-	if err != nil {
+	// in order to stat the referenced blobs, repository need to be set on the context
+	if err := mh.Verify(ctx, false); err != nil {
 		return "", err
 	}
 
@@ -146,28 +274,8 @@ func (m *manifestService) Put(ctx context.Context, manifest distribution.Manifes
 		return "", err
 	}
 
-	// Upload to openshift
-	uclient, ok := userClientFrom(ctx)
-	if !ok {
-		errmsg := "error creating user client to auto provision image stream: user client to master API unavailable"
-		dcontext.GetLogger(ctx).Errorf(errmsg)
-		return "", errcode.ErrorCodeUnknown.WithDetail(errmsg)
-	}
-
-	image := &imageapiv1.Image{
-		ObjectMeta: metav1.ObjectMeta{
-			Name: dgst.String(),
-			Annotations: map[string]string{
-				imageapiv1.ManagedByOpenShiftAnnotation:      "true",
-				imageapiv1.ImageManifestBlobStoredAnnotation: "true",
-				imageapiv1.DockerImageLayersOrderAnnotation:  layerOrder,
-			},
-		},
-		DockerImageReference:         fmt.Sprintf("%s/%s@%s", m.serverAddr, m.imageStream.Reference(), dgst.String()),
-		DockerImageManifest:          string(payload),
-		DockerImageManifestMediaType: mediaType,
-		DockerImageConfig:            string(config),
-		DockerImageLayers:            layers,
+	if m.maxLayers > 0 && len(layers) > m.maxLayers {
+		return "", ErrorCodeManifestTooManyLayers.WithArgs(len(layers), m.maxLayers)
 	}
 
 	tag := ""
@@ -178,38 +286,193 @@ func (m *manifestService) Put(ctx context.Context, manifest distribution.Manifes
 		}
 	}
 
-	pushByDigest := tag == ""
-	if pushByDigest {
-		image, err := m.registryOSClient.Images().Create(ctx, image, metav1.CreateOptions{})
-		if kapierrors.IsAlreadyExists(err) {
-			return dgst, nil
+	dgst, err := mh.Digest()
+	if err != nil {
+		return "", err
+	}
+
+	if tag != "" {
+		if err := m.checkTagImmutability(ctx, tag, dgst); err != nil {
+			return "", err
 		}
-		if err != nil {
-			dcontext.GetLogger(ctx).Errorf(
-				"manifestService.Put: image creation failed for image %s: %v",
-				image.Name, err,
-			)
+	}
+
+	if err := m.policyHooks.PutManifest(ctx, m.imageStream.Reference(), tag, manifest, dgst); err != nil {
+		return "", err
+	}
+	if tag != "" {
+		desc := distribution.Descriptor{
+			MediaType: mediaType,
+			Digest:    dgst,
+			Size:      int64(len(payload)),
+		}
+		if err := m.policyHooks.Tag(ctx, m.imageStream.Reference(), tag, desc); err != nil {
 			return "", err
 		}
-		return dgst, nil
 	}
 
-	rErr := m.imageStream.CreateImageStreamMapping(ctx, uclient, tag, image)
+	if dryRun(ctx) {
+		return m.dryRunPut(ctx, mh, layers)
+	}
+
+	// The identical pushes that are handled at the same time store the
+	// manifest and create the image only once.
+	store := func() error {
+		if m.foreignLayerMirror != nil {
+			if err := m.foreignLayerMirror.mirror(ctx, m.blobStore, manifest); err != nil {
+				return err
+			}
+		}
+
+		if _, err := m.manifests.Put(ctx, manifest, options...); err != nil {
+			return err
+		}
+
+		config, err := mh.Config(ctx)
+		if err != nil {
+			return err
+		}
+
+		// Upload to openshift
+		uclient, ok := userClientFrom(ctx)
+		if !ok {
+			errmsg := "error creating user client to auto provision image stream: user client to master API unavailable"
+			dcontext.GetLogger(ctx).Errorf(errmsg)
+			return errcode.ErrorCodeUnknown.WithDetail(errmsg)
+		}
+
+		image := &imageapiv1.Image{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: dgst.String(),
+				Annotations: map[string]string{
+					imageapiv1.ManagedByOpenShiftAnnotation:      "true",
+					imageapiv1.ImageManifestBlobStoredAnnotation: "true",
+					imageapiv1.DockerImageLayersOrderAnnotation:  layerOrder,
+				},
+			},
+			DockerImageReference:         fmt.Sprintf("%s/%s@%s", m.serverAddr, m.imageStream.Reference(), dgst.String()),
+			DockerImageManifest:          string(payload),
+			DockerImageManifestMediaType: mediaType,
+			DockerImageConfig:            string(config),
+			DockerImageLayers:            layers,
+		}
+		m.copyManifestAnnotations(manifest, image)
+
+		pushByDigest := tag == ""
+		if pushByDigest {
+			_, err := m.registryOSClient.Images().Create(ctx, image, metav1.CreateOptions{})
+			if kapierrors.IsAlreadyExists(err) {
+				// The image has been pushed concurrently.
+				return nil
+			}
+			if err != nil {
+				dcontext.GetLogger(ctx).Errorf(
+					"manifestService.Put: image creation failed for image %s: %v",
+					image.Name, err,
+				)
+				return err
+			}
+			return nil
+		}
+
+		rErr := m.imageStream.CreateImageStreamMapping(ctx, uclient, tag, image)
+		if rErr != nil {
+			switch rErr.Code() {
+			case imagestream.ErrImageStreamNotFoundCode:
+				// The image stream doesn't exist and it is not auto
+				// provisioned.
+				dcontext.GetLogger(ctx).Errorf("manifestService.Put: imagestreammapping failed for image %s@%s: %v", m.imageStream.Reference(), image.Name, rErr)
+				return regapi.ErrorCodeNameUnknown.WithDetail(m.imageStream.Reference())
+			case imagestream.ErrImageStreamForbiddenCode:
+				dcontext.GetLogger(ctx).Errorf("manifestService.Put: imagestreammapping got access denied for image %s@%s: %v", m.imageStream.Reference(), image.Name, rErr)
+				if m.pushRejected != nil && quotautil.IsErrorQuotaExceeded(rErr.Unwrap()) {
+					m.pushRejected(ctx, "Push of the image %s was rejected: %v", image.Name, rErr.Unwrap())
+				}
+				return distribution.ErrAccessDenied
+			}
+			return rErr
+		}
+
+		return nil
+	}
+	if m.puts == nil {
+		err = store()
+	} else {
+		err = m.puts.do(ctx, manifestPutKey(m.imageStream.Reference(), dgst, tag), store)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return dgst, nil
+}
+
+// checkTagImmutability refuses to move an existing immutable tag to the image
+// dgst. Pushing the image that the tag already refers to is allowed.
+func (m *manifestService) checkTagImmutability(ctx context.Context, tag string, dgst digest.Digest) error {
+	immutable, rErr := m.imageStream.TagIsImmutable(ctx, tag)
 	if rErr != nil {
-		switch rErr.Code() {
-		case imagestream.ErrImageStreamNotFoundCode:
-			dcontext.GetLogger(ctx).Errorf("manifestService.Put: imagestreammapping failed for image %s@%s: %v", m.imageStream.Reference(), image.Name, rErr)
-			return "", distribution.ErrManifestUnknownRevision{
-				Name:     m.imageStream.Reference(),
-				Revision: dgst,
+		if rErr.Code() == imagestream.ErrImageStreamNotFoundCode {
+			// The image stream will be created by this push.
+			return nil
+		}
+		return rErr
+	}
+	if !immutable {
+		return nil
+	}
+
+	tags, rErr := m.imageStream.Tags(ctx)
+	if rErr != nil {
+		return rErr
+	}
+	if current, ok := tags[tag]; ok && current != dgst {
+		dcontext.GetLogger(ctx).Errorf("manifestService.Put: refusing to move immutable tag %s of %s from %s to %s", tag, m.imageStream.Reference(), current, dgst)
+		return ErrorCodeTagImmutable.WithArgs(tag, current)
+	}
+	return nil
+}
+
+// copyManifestAnnotations copies the configured annotations of an OCI
+// manifest into the annotations of image, so that they can be shown without
+// fetching the manifest from the storage.
+func (m *manifestService) copyManifestAnnotations(manifest distribution.Manifest, image *imageapiv1.Image) {
+	oci, ok := manifest.(*ocischema.DeserializedManifest)
+	if !ok {
+		return
+	}
+	for _, key := range m.manifestAnnotations {
+		if value, ok := oci.Annotations[key]; ok {
+			image.Annotations[key] = value
+		}
+	}
+}
+
+// dryRunPut finishes the verification of a manifest that is pushed in the
+// dry-run mode and returns its digest without storing anything.
+func (m *manifestService) dryRunPut(ctx context.Context, mh manifesthandler.ManifestHandler, layers []imageapiv1.ImageLayer) (digest.Digest, error) {
+	if m.admitBlob != nil {
+		for _, layer := range layers {
+			if err := m.admitBlob(ctx, layer.LayerSize); err != nil {
+				return "", err
 			}
-		case imagestream.ErrImageStreamForbiddenCode:
-			dcontext.GetLogger(ctx).Errorf("manifestService.Put: imagestreammapping got access denied for image %s@%s: %v", m.imageStream.Reference(), image.Name, rErr)
-			return "", distribution.ErrAccessDenied
 		}
-		return "", rErr
 	}
 
+	if _, err := mh.Config(ctx); err != nil {
+		return "", err
+	}
+
+	dgst, err := mh.Digest()
+	if err != nil {
+		return "", err
+	}
+
+	if w, err := dcontext.GetResponseWriter(ctx); err == nil {
+		w.Header().Set(dryRunHeader, "true")
+	}
+
+	dcontext.GetLogger(ctx).Infof("manifestService.Put: dry run for manifest %s@%s succeeded", m.imageStream.Reference(), dgst.String())
 	return dgst, nil
 }
 
@@ -8,13 +8,16 @@ import (
 
 	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/manifest/manifestlist"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
 	"github.com/distribution/distribution/v3/manifest/schema2"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
 	"github.com/opencontainers/go-digest"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	imageapiv1 "github.com/openshift/api/image/v1"
 	"github.com/openshift/image-registry/pkg/dockerregistry/server/cache"
 	registryclient "github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/configuration"
 	"github.com/openshift/image-registry/pkg/dockerregistry/server/metrics"
 	"github.com/openshift/image-registry/pkg/imagestream"
 	"github.com/openshift/image-registry/pkg/testutil"
@@ -206,7 +209,7 @@ func TestManifestServiceGet(t *testing.T) {
 
 			ms := &manifestService{
 				cache:            cache,
-				manifests:        newTestManifestService(repoName, localManifestData),
+				manifests:        testutil.NewFakeManifestService(repoName, localManifestData),
 				imageStream:      imageStream,
 				registryOSClient: client,
 				acceptSchema2:    true,
@@ -258,11 +261,11 @@ func TestManifestServicePut(t *testing.T) {
 	for _, testCase := range testCases {
 		t.Run(testCase.name, func(t *testing.T) {
 			fos, imageClient := testutil.NewFakeOpenShiftWithClient(ctx)
-			bs := newTestBlobStore(nil, blobContents{
+			bs := testutil.NewFakeBlobStore(nil, testutil.BlobContents{
 				"testblob:1":   []byte("{}"),
 				"testconfig:2": []byte("{}"),
 			})
-			tms := newTestManifestService(repoName, nil)
+			tms := testutil.NewFakeManifestService(repoName, nil)
 			client := registryclient.NewFakeRegistryAPIClient(nil, imageClient)
 			imageStream := imagestream.New(ctx, namespace, repo, client)
 			digestCache, err := cache.NewBlobDigest(
@@ -393,3 +396,406 @@ func TestManifestServicePut(t *testing.T) {
 		})
 	}
 }
+
+func TestManifestServicePutLimits(t *testing.T) {
+	ctx := context.Background()
+	ctx = testutil.WithTestLogger(ctx, t)
+
+	namespace := "user"
+	repo := "app"
+	repoName := fmt.Sprintf("%s/%s", namespace, repo)
+
+	blobs := testutil.BlobContents{
+		"testconfig:1": []byte("{}"),
+		"testblob:1":   []byte("{}"),
+		"testblob:2":   []byte("{}"),
+		"testblob:3":   []byte("{}"),
+	}
+
+	manifest, err := testutil.MakeSchema2Manifest(
+		distribution.Descriptor{
+			Digest: "testconfig:1",
+			Size:   2,
+		},
+		[]distribution.Descriptor{
+			{Digest: "testblob:1", Size: 2},
+			{Digest: "testblob:2", Size: 2},
+			{Digest: "testblob:3", Size: 2},
+		},
+	)
+	if err != nil {
+		t.Fatalf("could not make schema 2 manifest: %s", err)
+	}
+	_, payload, err := manifest.Payload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	payloadSize := int64(len(payload))
+
+	testCases := []struct {
+		name             string
+		maxManifestBytes int64
+		maxLayers        int
+		allowed          []string
+		blocked          []string
+		expectedErr      errcode.ErrorCode
+	}{
+		{
+			name: "no limits",
+		},
+		{
+			name:             "manifest size at limit",
+			maxManifestBytes: payloadSize,
+		},
+		{
+			name:             "manifest size over limit",
+			maxManifestBytes: payloadSize - 1,
+			expectedErr:      ErrorCodeManifestTooLarge,
+		},
+		{
+			name:      "layers at limit",
+			maxLayers: 3,
+		},
+		{
+			name:        "layers over limit",
+			maxLayers:   2,
+			expectedErr: ErrorCodeManifestTooManyLayers,
+		},
+		{
+			name:    "allowed media types",
+			allowed: []string{"application/vnd.docker.*"},
+		},
+		{
+			name:        "media type not allowed",
+			allowed:     []string{"application/vnd.oci.*"},
+			expectedErr: ErrorCodeManifestMediaTypeBlocked,
+		},
+		{
+			name:    "other media type blocked",
+			blocked: []string{schema2.MediaTypeForeignLayer},
+		},
+		{
+			name:        "layer media type blocked",
+			allowed:     []string{"application/vnd.docker.*"},
+			blocked:     []string{schema2.MediaTypeLayer},
+			expectedErr: ErrorCodeManifestMediaTypeBlocked,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, imageClient := testutil.NewFakeOpenShiftWithClient(ctx)
+			client := registryclient.NewFakeRegistryAPIClient(nil, imageClient)
+			tms := testutil.NewFakeManifestService(repoName, nil)
+
+			ms := &manifestService{
+				serverAddr:        "localhost",
+				manifests:         tms,
+				blobStore:         testutil.NewFakeBlobStore(nil, blobs),
+				registryOSClient:  client,
+				imageStream:       imagestream.New(ctx, namespace, repo, client),
+				acceptSchema2:     true,
+				maxManifestBytes:  tc.maxManifestBytes,
+				maxLayers:         tc.maxLayers,
+				allowedMediaTypes: tc.allowed,
+				blockedMediaTypes: tc.blocked,
+			}
+
+			osclient, err := registryclient.NewFakeRegistryClient(imageClient).Client()
+			if err != nil {
+				t.Fatal(err)
+			}
+			putCtx := withAuthPerformed(ctx)
+			putCtx = withUserClient(putCtx, osclient)
+
+			_, err = ms.Put(putCtx, manifest, distribution.WithTag("latest"))
+			if tc.expectedErr == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+
+			e, ok := err.(errcode.Error)
+			if !ok || e.Code != tc.expectedErr {
+				t.Fatalf("got error %v, want %v", err, tc.expectedErr)
+			}
+			if tms.Calls("Put") != 0 {
+				t.Errorf("expected the manifest not to be stored, got %d Put calls", tms.Calls("Put"))
+			}
+		})
+	}
+}
+
+func TestManifestServicePutImmutableTags(t *testing.T) {
+	ctx := context.Background()
+	ctx = testutil.WithTestLogger(ctx, t)
+
+	namespace := "user"
+	repo := "app"
+	repoName := fmt.Sprintf("%s/%s", namespace, repo)
+
+	blobs := testutil.BlobContents{
+		"testconfig:1": []byte("{}"),
+		"testblob:1":   []byte("{}"),
+	}
+
+	manifest, err := testutil.MakeSchema2Manifest(
+		distribution.Descriptor{
+			Digest: "testconfig:1",
+			Size:   2,
+		},
+		[]distribution.Descriptor{
+			{Digest: "testblob:1", Size: 2},
+		},
+	)
+	if err != nil {
+		t.Fatalf("could not make schema 2 manifest: %s", err)
+	}
+	_, payload, err := manifest.Payload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestDigest := digest.FromBytes(payload)
+
+	testCases := []struct {
+		name        string
+		tag         string
+		expectedErr errcode.ErrorCode
+	}{
+		{
+			name:        "move immutable tag",
+			tag:         "release-1",
+			expectedErr: ErrorCodeTagImmutable,
+		},
+		{
+			name: "push the same image into immutable tag",
+			tag:  "release-2",
+		},
+		{
+			name: "new immutable tag",
+			tag:  "release-3",
+		},
+		{
+			name: "mutable tag",
+			tag:  "latest",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fos, imageClient := testutil.NewFakeOpenShiftWithClient(ctx)
+			testutil.AddImageStream(t, fos, namespace, repo, map[string]string{
+				imagestream.ImmutableTagsAnnotation: "release-*, stable",
+			})
+			testutil.AddRandomImage(t, fos, namespace, repo, "release-1")
+			testutil.AddRandomImage(t, fos, namespace, repo, "latest")
+			testutil.AddImage(t, fos, &imageapiv1.Image{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: manifestDigest.String(),
+				},
+				DockerImageReference: fmt.Sprintf("localhost/%s@%s", repoName, manifestDigest),
+			}, namespace, repo, "release-2")
+
+			client := registryclient.NewFakeRegistryAPIClient(nil, imageClient)
+			tms := testutil.NewFakeManifestService(repoName, nil)
+
+			ms := &manifestService{
+				serverAddr:       "localhost",
+				manifests:        tms,
+				blobStore:        testutil.NewFakeBlobStore(nil, blobs),
+				registryOSClient: client,
+				imageStream:      imagestream.New(ctx, namespace, repo, client),
+				acceptSchema2:    true,
+			}
+
+			osclient, err := registryclient.NewFakeRegistryClient(imageClient).Client()
+			if err != nil {
+				t.Fatal(err)
+			}
+			putCtx := withAuthPerformed(ctx)
+			putCtx = withUserClient(putCtx, osclient)
+
+			_, err = ms.Put(putCtx, manifest, distribution.WithTag(tc.tag))
+			if tc.expectedErr == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+
+			e, ok := err.(errcode.Error)
+			if !ok || e.Code != tc.expectedErr {
+				t.Fatalf("got error %v, want %v", err, tc.expectedErr)
+			}
+			if tms.Calls("Put") != 0 {
+				t.Errorf("expected the manifest not to be stored, got %d Put calls", tms.Calls("Put"))
+			}
+		})
+	}
+}
+
+func TestManifestServicePutAnnotations(t *testing.T) {
+	ctx := context.Background()
+	ctx = testutil.WithTestLogger(ctx, t)
+
+	namespace := "user"
+	repo := "app"
+	repoName := fmt.Sprintf("%s/%s", namespace, repo)
+
+	manifest, err := testutil.MakeOCISchemaManifest(
+		distribution.Descriptor{
+			Digest: "testconfig:1",
+			Size:   2,
+		},
+		[]distribution.Descriptor{
+			{Digest: "testblob:1", Size: 2},
+		},
+	)
+	if err != nil {
+		t.Fatalf("could not make OCI manifest: %s", err)
+	}
+	oci := manifest.(*ocischema.DeserializedManifest).Manifest
+	oci.Annotations = map[string]string{
+		"org.opencontainers.image.source":   "https://github.com/openshift/image-registry",
+		"org.opencontainers.image.revision": "0123456789abcdef",
+		"org.opencontainers.image.vendor":   "Red Hat",
+	}
+	manifest, err = ocischema.FromStruct(oci)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, imageClient := testutil.NewFakeOpenShiftWithClient(ctx)
+	client := registryclient.NewFakeRegistryAPIClient(nil, imageClient)
+	ms := &manifestService{
+		serverAddr: "localhost",
+		manifests:  testutil.NewFakeManifestService(repoName, nil),
+		blobStore: testutil.NewFakeBlobStore(nil, testutil.BlobContents{
+			"testconfig:1": []byte("{}"),
+			"testblob:1":   []byte("{}"),
+		}),
+		registryOSClient:    client,
+		imageStream:         imagestream.New(ctx, namespace, repo, client),
+		acceptSchema2:       true,
+		manifestAnnotations: configuration.DefaultManifestAnnotations,
+	}
+
+	osclient, err := registryclient.NewFakeRegistryClient(imageClient).Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	putCtx := withAuthPerformed(ctx)
+	putCtx = withUserClient(putCtx, osclient)
+
+	dgst, err := ms.Put(putCtx, manifest)
+	if err != nil {
+		t.Fatalf("failed to Put manifest: %s", err)
+	}
+
+	image, err := client.Images().Get(ctx, dgst.String(), metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{
+		"org.opencontainers.image.source":   "https://github.com/openshift/image-registry",
+		"org.opencontainers.image.revision": "0123456789abcdef",
+		"org.opencontainers.image.vendor":   "",
+	} {
+		if got := image.Annotations[key]; got != want {
+			t.Errorf("annotation %s: got %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestManifestServicePutDryRun(t *testing.T) {
+	ctx := context.Background()
+	ctx = testutil.WithTestLogger(ctx, t)
+
+	namespace := "user"
+	repo := "app"
+	repoName := fmt.Sprintf("%s/%s", namespace, repo)
+
+	blobs := testutil.BlobContents{
+		"testconfig:1": []byte("{}"),
+		"testblob:1":   []byte("{}"),
+	}
+
+	manifest, err := testutil.MakeSchema2Manifest(
+		distribution.Descriptor{
+			Digest: "testconfig:1",
+			Size:   2,
+		},
+		[]distribution.Descriptor{
+			{Digest: "testblob:1", Size: 2},
+		},
+	)
+	if err != nil {
+		t.Fatalf("could not make schema 2 manifest: %s", err)
+	}
+	_, payload, err := manifest.Payload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedDigest := digest.FromBytes(payload)
+
+	testCases := []struct {
+		name        string
+		admitBlob   func(ctx context.Context, size int64) error
+		expectedErr error
+	}{
+		{
+			name: "no quota",
+		},
+		{
+			name: "quota admits blobs",
+			admitBlob: func(ctx context.Context, size int64) error {
+				return nil
+			},
+		},
+		{
+			name: "quota rejects blobs",
+			admitBlob: func(ctx context.Context, size int64) error {
+				return distribution.ErrAccessDenied
+			},
+			expectedErr: distribution.ErrAccessDenied,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fos, imageClient := testutil.NewFakeOpenShiftWithClient(ctx)
+			client := registryclient.NewFakeRegistryAPIClient(nil, imageClient)
+			tms := testutil.NewFakeManifestService(repoName, nil)
+
+			ms := &manifestService{
+				serverAddr:       "localhost",
+				manifests:        tms,
+				blobStore:        testutil.NewFakeBlobStore(nil, blobs),
+				registryOSClient: client,
+				imageStream:      imagestream.New(ctx, namespace, repo, client),
+				acceptSchema2:    true,
+				admitBlob:        tc.admitBlob,
+			}
+
+			osclient, err := registryclient.NewFakeRegistryClient(imageClient).Client()
+			if err != nil {
+				t.Fatal(err)
+			}
+			putCtx := withAuthPerformed(ctx)
+			putCtx = withUserClient(putCtx, osclient)
+			putCtx = withDryRun(putCtx)
+
+			dgst, err := ms.Put(putCtx, manifest)
+			if err != tc.expectedErr {
+				t.Fatalf("got error %v, want %v", err, tc.expectedErr)
+			}
+			if tc.expectedErr == nil && dgst != expectedDigest {
+				t.Errorf("got digest %s, want %s", dgst, expectedDigest)
+			}
+			if tms.Calls("Put") != 0 {
+				t.Errorf("expected the manifest not to be stored, got %d Put calls", tms.Calls("Put"))
+			}
+			if _, err := fos.GetImage(expectedDigest.String()); err == nil {
+				t.Errorf("expected the image %s not to be created", expectedDigest)
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/opencontainers/go-digest"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	imageapiv1 "github.com/openshift/api/image/v1"
+	imageref "github.com/openshift/library-go/pkg/image/reference"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/coordination"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/metrics"
+)
+
+// manifestVerificationReconciler periodically checks that the manifests of
+// the images with the manifest blob stored annotation exist in the storage.
+// Every interval it checks the next sampleSize images, so that all images
+// are checked over time. A missing manifest is stored again from the image
+// object. If the image object doesn't have the manifest, the annotation is
+// removed.
+type manifestVerificationReconciler struct {
+	client     client.Interface
+	registry   distribution.Namespace
+	metrics    metrics.ManifestReconciliation
+	interval   time.Duration
+	sampleSize int
+
+	// continueToken is the position of the next sample in the list of
+	// images.
+	continueToken string
+
+	// state keeps the schedule when the leadership moves to another
+	// replica. It is nil if the replicas don't coordinate.
+	state *coordination.State
+}
+
+func newManifestVerificationReconciler(osClient client.Interface, registry distribution.Namespace, m metrics.ManifestReconciliation, interval time.Duration, sampleSize int) *manifestVerificationReconciler {
+	return &manifestVerificationReconciler{
+		client:     osClient,
+		registry:   registry,
+		metrics:    m,
+		interval:   interval,
+		sampleSize: sampleSize,
+	}
+}
+
+// Run verifies a sample of images every interval until ctx is done.
+func (r *manifestVerificationReconciler) Run(ctx context.Context) {
+	dcontext.GetLogger(ctx).Infof("starting verification of %d image manifests every %s", r.sampleSize, r.interval)
+	r.state.Every(ctx, "manifestverification", r.interval, r.reconcile)
+}
+
+func (r *manifestVerificationReconciler) reconcile(ctx context.Context) {
+	opts := metav1.ListOptions{
+		Limit:    int64(r.sampleSize),
+		Continue: r.continueToken,
+	}
+	images, err := r.client.Images().List(ctx, opts)
+	if apierrors.IsResourceExpired(err) && len(opts.Continue) > 0 {
+		dcontext.GetLogger(ctx).Warnf("manifest verification: continuation token expired (%v), starting over", err)
+		opts.Continue = ""
+		images, err = r.client.Images().List(ctx, opts)
+	}
+	if err != nil {
+		dcontext.GetLogger(ctx).Errorf("manifest verification: unable to list images: %v", err)
+		return
+	}
+
+	for i := range images.Items {
+		r.verifyImage(ctx, &images.Items[i])
+	}
+
+	// The next sample starts from the beginning when the end of the list is
+	// reached.
+	r.continueToken = images.Continue
+}
+
+func (r *manifestVerificationReconciler) verifyImage(ctx context.Context, image *imageapiv1.Image) {
+	if image.Annotations[imageapiv1.ImageManifestBlobStoredAnnotation] != "true" {
+		return
+	}
+
+	dgst, err := digest.Parse(image.Name)
+	if err != nil {
+		dcontext.GetLogger(ctx).Errorf("manifest verification: bad image name %q: %v", image.Name, err)
+		return
+	}
+
+	ref, err := imageref.Parse(image.DockerImageReference)
+	if err != nil || len(ref.Namespace) == 0 {
+		dcontext.GetLogger(ctx).Debugf("manifest verification: skipping image %s with the reference %q", image.Name, image.DockerImageReference)
+		return
+	}
+	repoName := ref.RepositoryName()
+
+	ms, err := r.manifests(ctx, repoName)
+	if err != nil {
+		dcontext.GetLogger(ctx).Errorf("manifest verification: unable to get manifests of repository %s: %v", repoName, err)
+		return
+	}
+
+	exists, err := ms.Exists(ctx, dgst)
+	if err != nil {
+		dcontext.GetLogger(ctx).Errorf("manifest verification: unable to check manifest %s in repository %s: %v", dgst, repoName, err)
+		return
+	}
+	if exists {
+		return
+	}
+
+	if len(image.DockerImageManifest) > 0 {
+		if err := restoreManifest(ctx, ms, image, dgst); err != nil {
+			dcontext.GetLogger(ctx).Errorf("manifest verification: unable to restore manifest %s in repository %s: %v", dgst, repoName, err)
+			return
+		}
+		dcontext.GetLogger(ctx).Infof("manifest verification: restored missing manifest %s in repository %s", dgst, repoName)
+		r.metrics.ManifestRestored()
+		return
+	}
+
+	image = image.DeepCopy()
+	delete(image.Annotations, imageapiv1.ImageManifestBlobStoredAnnotation)
+	if _, err := r.client.Images().Update(ctx, image, metav1.UpdateOptions{}); err != nil {
+		dcontext.GetLogger(ctx).Errorf("manifest verification: unable to remove the annotation %s from image %s: %v", imageapiv1.ImageManifestBlobStoredAnnotation, image.Name, err)
+		return
+	}
+	dcontext.GetLogger(ctx).Infof("manifest verification: removed the annotation %s from image %s as its manifest is missing in repository %s", imageapiv1.ImageManifestBlobStoredAnnotation, image.Name, repoName)
+	r.metrics.AnnotationRemoved()
+}
+
+func (r *manifestVerificationReconciler) manifests(ctx context.Context, repoName string) (distribution.ManifestService, error) {
+	named, err := reference.WithName(repoName)
+	if err != nil {
+		return nil, err
+	}
+	repo, err := r.registry.Repository(ctx, named)
+	if err != nil {
+		return nil, err
+	}
+	// The layers are not verified when a manifest is restored as they may
+	// be missing too.
+	return repo.Manifests(ctx, storage.SkipLayerVerification())
+}
+
+// restoreManifest stores the manifest from the image object into ms. The
+// stored manifest has to be the one the image was made of.
+func restoreManifest(ctx context.Context, ms distribution.ManifestService, image *imageapiv1.Image, dgst digest.Digest) error {
+	manifest, _, err := distribution.UnmarshalManifest(image.DockerImageManifestMediaType, []byte(image.DockerImageManifest))
+	if err != nil {
+		return err
+	}
+	stored, err := ms.Put(ctx, manifest)
+	if err != nil {
+		return err
+	}
+	if stored != dgst {
+		return fmt.Errorf("the manifest of the image has the digest %s", stored)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgotesting "k8s.io/client-go/testing"
+
+	imageapiv1 "github.com/openshift/api/image/v1"
+	imagefakeclient "github.com/openshift/client-go/image/clientset/versioned/typed/image/v1/fake"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/metrics"
+	metricstesting "github.com/openshift/image-registry/pkg/dockerregistry/server/metrics/testing"
+	"github.com/openshift/image-registry/pkg/testutil"
+)
+
+func TestManifestVerificationReconciler(t *testing.T) {
+	ctx := context.Background()
+	ctx = testutil.WithTestLogger(ctx, t)
+
+	registry, err := storage.NewRegistry(ctx, inmemory.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	named, err := reference.WithName("user/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo, err := registry.Repository(ctx, named)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms, err := repo.Manifests(ctx, storage.SkipLayerVerification())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newImage := func(layer digest.Digest, stored bool) *imageapiv1.Image {
+		manifest, err := testutil.MakeSchema2Manifest(
+			distribution.Descriptor{Digest: "sha256:bef57ec7f53a6d40beb640a780a639c83bc29ac8a9816f1fc6c5c6dcd93c4721", Size: 2},
+			[]distribution.Descriptor{{Digest: layer, Size: 2}},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mediaType, payload, err := manifest.Payload()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored {
+			if _, err := ms.Put(ctx, manifest); err != nil {
+				t.Fatal(err)
+			}
+		}
+		dgst := digest.FromBytes(payload)
+		return &imageapiv1.Image{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: dgst.String(),
+				Annotations: map[string]string{
+					imageapiv1.ManagedByOpenShiftAnnotation:      "true",
+					imageapiv1.ImageManifestBlobStoredAnnotation: "true",
+				},
+			},
+			DockerImageReference:         "localhost:5000/user/app@" + dgst.String(),
+			DockerImageManifest:          string(payload),
+			DockerImageManifestMediaType: mediaType,
+		}
+	}
+
+	stored := newImage("sha256:0000000000000000000000000000000000000000000000000000000000000001", true)
+	missing := newImage("sha256:0000000000000000000000000000000000000000000000000000000000000002", false)
+	withoutManifest := newImage("sha256:0000000000000000000000000000000000000000000000000000000000000003", false)
+	withoutManifest.DockerImageManifest = ""
+	notAnnotated := newImage("sha256:0000000000000000000000000000000000000000000000000000000000000004", false)
+	delete(notAnnotated.Annotations, imageapiv1.ImageManifestBlobStoredAnnotation)
+
+	var updates []*imageapiv1.Image
+	imageClient := &imagefakeclient.FakeImageV1{Fake: &clientgotesting.Fake{}}
+	imageClient.AddReactor("list", "images", func(action clientgotesting.Action) (bool, runtime.Object, error) {
+		return true, &imageapiv1.ImageList{Items: []imageapiv1.Image{*stored, *missing, *withoutManifest, *notAnnotated}}, nil
+	})
+	imageClient.AddReactor("update", "images", func(action clientgotesting.Action) (bool, runtime.Object, error) {
+		image := action.(clientgotesting.UpdateAction).GetObject().(*imageapiv1.Image)
+		updates = append(updates, image)
+		return true, image, nil
+	})
+
+	c, sink := metricstesting.NewCounterSink()
+	r := newManifestVerificationReconciler(client.NewFakeRegistryAPIClient(nil, imageClient), registry, metrics.NewMetrics(sink).ManifestReconciliation(), 0, 10)
+	r.reconcile(ctx)
+
+	if exists, err := ms.Exists(ctx, digest.Digest(missing.Name)); err != nil || !exists {
+		t.Errorf("expected the missing manifest to be restored, got exists=%t, err=%v", exists, err)
+	}
+
+	if len(updates) != 1 || updates[0].Name != withoutManifest.Name {
+		t.Fatalf("expected only image %s to be updated, got %d updates", withoutManifest.Name, len(updates))
+	}
+	if _, ok := updates[0].Annotations[imageapiv1.ImageManifestBlobStoredAnnotation]; ok {
+		t.Errorf("expected the annotation %s to be removed", imageapiv1.ImageManifestBlobStoredAnnotation)
+	}
+
+	values := c.Values()
+	if values["storage_corrected_images:ManifestRestored"] != 1 || values["storage_corrected_images:AnnotationRemoved"] != 1 {
+		t.Errorf("unexpected metrics: %v", values)
+	}
+}
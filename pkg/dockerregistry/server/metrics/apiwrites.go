@@ -0,0 +1,21 @@
+package metrics
+
+// APIWrites provides metrics for the writes to the API server.
+type APIWrites interface {
+	// Retried counts a write of operation that is retried after it failed
+	// with a transient error of reason.
+	Retried(operation, reason string)
+}
+
+type apiWrites struct {
+	sink Sink
+}
+
+func (w *apiWrites) Retried(operation, reason string) {
+	w.sink.APIWriteRetries(operation, reason).Inc()
+}
+
+type noopAPIWrites struct{}
+
+func (w noopAPIWrites) Retried(operation, reason string) {
+}
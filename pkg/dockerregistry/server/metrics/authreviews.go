@@ -0,0 +1,37 @@
+package metrics
+
+import (
+	"time"
+)
+
+// AuthReviews provides metrics for the reviews of the tokens and the access
+// of the clients that are made by the API server.
+type AuthReviews interface {
+	// Reviewed reports a review of kind for verb on resource that took
+	// duration.
+	Reviewed(kind, verb, resource string, duration time.Duration)
+
+	// Failed counts a review of kind for verb on resource that failed with
+	// an error of reason.
+	Failed(kind, verb, resource, reason string)
+}
+
+type authReviews struct {
+	sink Sink
+}
+
+func (r *authReviews) Reviewed(kind, verb, resource string, duration time.Duration) {
+	r.sink.AuthReviewDuration(kind, verb, resource).Observe(duration.Seconds())
+}
+
+func (r *authReviews) Failed(kind, verb, resource, reason string) {
+	r.sink.AuthReviewErrors(kind, verb, resource, reason).Inc()
+}
+
+type noopAuthReviews struct{}
+
+func (r noopAuthReviews) Reviewed(kind, verb, resource string, duration time.Duration) {
+}
+
+func (r noopAuthReviews) Failed(kind, verb, resource, reason string) {
+}
@@ -0,0 +1,48 @@
+package metrics
+
+const (
+	// BlobSourceLocal is the source of the blobs that are served from the
+	// local storage.
+	BlobSourceLocal = "local"
+
+	// BlobSourcePullthrough is the source of the blobs that are streamed
+	// from remote registries.
+	BlobSourcePullthrough = "pullthrough"
+)
+
+// BlobTransfers provides metrics for the bytes of blobs that are sent to the
+// clients and written into the storage by the mirroring.
+type BlobTransfers interface {
+	// Served counts n bytes of a blob of namespace that are sent to a
+	// client from source, which is BlobSourceLocal or
+	// BlobSourcePullthrough.
+	Served(namespace, source string, n int64)
+
+	// Mirrored counts n bytes of a remote blob that are written into the
+	// storage for namespace.
+	Mirrored(namespace string, n int64)
+}
+
+type blobTransfers struct {
+	sink Sink
+}
+
+func (t *blobTransfers) Served(namespace, source string, n int64) {
+	if n > 0 {
+		t.sink.BlobServedBytes(namespace, source).Add(float64(n))
+	}
+}
+
+func (t *blobTransfers) Mirrored(namespace string, n int64) {
+	if n > 0 {
+		t.sink.PullthroughMirroredBytes(namespace).Add(float64(n))
+	}
+}
+
+type noopBlobTransfers struct{}
+
+func (t noopBlobTransfers) Served(namespace, source string, n int64) {
+}
+
+func (t noopBlobTransfers) Mirrored(namespace string, n int64) {
+}
@@ -1,10 +1,26 @@
 package metrics
 
+import (
+	"sync"
+)
+
 // Cache provides generic metrics for caches.
 type Cache interface {
 	Request(hit bool)
 }
 
+// InternalCache provides metrics for an internal cache of the registry.
+type InternalCache interface {
+	Cache
+
+	// Evict counts an entry that is removed from the cache to make room for
+	// a new one or because it is expired.
+	Evict()
+
+	// Entries sets the current number of entries in the cache.
+	Entries(n int)
+}
+
 type cache struct {
 	hitCounter  Counter
 	missCounter Counter
@@ -18,7 +34,45 @@ func (c *cache) Request(hit bool) {
 	}
 }
 
+type internalCache struct {
+	cache
+	evictCounter  Counter
+	entriesGauge  Gauge
+	hitRatioGauge Gauge
+
+	mu     sync.Mutex
+	hits   uint64
+	misses uint64
+}
+
+func (c *internalCache) Request(hit bool) {
+	c.cache.Request(hit)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if hit {
+		c.hits++
+	} else {
+		c.misses++
+	}
+	c.hitRatioGauge.Set(float64(c.hits) / float64(c.hits+c.misses))
+}
+
+func (c *internalCache) Evict() {
+	c.evictCounter.Inc()
+}
+
+func (c *internalCache) Entries(n int) {
+	c.entriesGauge.Set(float64(n))
+}
+
 type noopCache struct{}
 
 func (c noopCache) Request(hit bool) {
 }
+
+func (c noopCache) Evict() {
+}
+
+func (c noopCache) Entries(n int) {
+}
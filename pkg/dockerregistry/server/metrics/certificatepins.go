@@ -0,0 +1,22 @@
+package metrics
+
+// CertificatePins provides metrics for the connections to remote registries
+// whose certificates are checked against the configured pins.
+type CertificatePins interface {
+	// Rejected counts a connection to registry that is refused because none
+	// of the certificates of the registry match its pins.
+	Rejected(registry string)
+}
+
+type certificatePins struct {
+	sink Sink
+}
+
+func (c *certificatePins) Rejected(registry string) {
+	c.sink.PullthroughCertificatePinFailures(registry).Inc()
+}
+
+type noopCertificatePins struct{}
+
+func (c noopCertificatePins) Rejected(registry string) {
+}
@@ -0,0 +1,27 @@
+package metrics
+
+// Coalescing provides metrics for operations that are shared by concurrent
+// requests.
+type Coalescing interface {
+	// Request counts a request that either started the operation or joined
+	// the operation that was already in progress.
+	Request(coalesced bool)
+}
+
+type coalescing struct {
+	startedCounter   Counter
+	coalescedCounter Counter
+}
+
+func (c *coalescing) Request(coalesced bool) {
+	if coalesced {
+		c.coalescedCounter.Inc()
+	} else {
+		c.startedCounter.Inc()
+	}
+}
+
+type noopCoalescing struct{}
+
+func (c noopCoalescing) Request(coalesced bool) {
+}
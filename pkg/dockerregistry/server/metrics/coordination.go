@@ -0,0 +1,36 @@
+package metrics
+
+// Leadership provides metrics for the leadership of the replica in the
+// coordination between replicas.
+type Leadership interface {
+	// Leader reports whether the replica is the leader.
+	Leader(leader bool)
+
+	// Takeover counts a takeover of the leadership by the replica.
+	Takeover()
+}
+
+type leadership struct {
+	leaderGauge      Gauge
+	takeoversCounter Counter
+}
+
+func (l *leadership) Leader(leader bool) {
+	if leader {
+		l.leaderGauge.Set(1)
+	} else {
+		l.leaderGauge.Set(0)
+	}
+}
+
+func (l *leadership) Takeover() {
+	l.takeoversCounter.Inc()
+}
+
+type noopLeadership struct{}
+
+func (l noopLeadership) Leader(leader bool) {
+}
+
+func (l noopLeadership) Takeover() {
+}
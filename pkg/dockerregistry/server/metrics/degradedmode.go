@@ -0,0 +1,36 @@
+package metrics
+
+// DegradedMode provides metrics for the pulls that are served while the API
+// server is unreachable.
+type DegradedMode interface {
+	// Active reports whether the registry serves requests in the degraded
+	// mode.
+	Active(active bool)
+
+	// Served counts a request of kind that is served in the degraded mode.
+	Served(kind string)
+}
+
+type degradedMode struct {
+	sink Sink
+}
+
+func (d *degradedMode) Active(active bool) {
+	if active {
+		d.sink.DegradedModeActive().Set(1)
+	} else {
+		d.sink.DegradedModeActive().Set(0)
+	}
+}
+
+func (d *degradedMode) Served(kind string) {
+	d.sink.DegradedModeRequests(kind).Inc()
+}
+
+type noopDegradedMode struct{}
+
+func (d noopDegradedMode) Active(active bool) {
+}
+
+func (d noopDegradedMode) Served(kind string) {
+}
@@ -0,0 +1,46 @@
+package metrics
+
+const (
+	// KubeClientFailureUnauthorized is the reason of a request that the API
+	// server rejects because of the credentials of the registry.
+	KubeClientFailureUnauthorized = "unauthorized"
+
+	// KubeClientFailureCertificate is the reason of a request that fails
+	// because the certificate of the API server cannot be verified.
+	KubeClientFailureCertificate = "certificate"
+)
+
+// KubeClient provides metrics for the clients of the API server that are
+// rebuilt when their credentials stop working.
+type KubeClient interface {
+	// Failed counts a request of the registry that fails because of its
+	// credentials. reason is one of the KubeClientFailure constants.
+	Failed(reason string)
+
+	// Rebuilt counts a rebuild of the clients that failed with err, if any.
+	Rebuilt(err error)
+}
+
+type kubeClient struct {
+	sink Sink
+}
+
+func (c *kubeClient) Failed(reason string) {
+	c.sink.KubeClientAuthFailures(reason).Inc()
+}
+
+func (c *kubeClient) Rebuilt(err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	c.sink.KubeClientRebuilds(result).Inc()
+}
+
+type noopKubeClient struct{}
+
+func (c noopKubeClient) Failed(reason string) {
+}
+
+func (c noopKubeClient) Rebuilt(err error) {
+}
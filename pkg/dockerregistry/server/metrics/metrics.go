@@ -5,6 +5,7 @@ import (
 	"io"
 	"net/url"
 	"strings"
+	"sync"
 
 	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/registry/api/errcode"
@@ -25,16 +26,57 @@ type Counter interface {
 	Inc()
 }
 
+// ValueCounter represents a single numerical value that only goes up by
+// arbitrary amounts.
+type ValueCounter interface {
+	Add(float64)
+}
+
+// Gauge represents a single numerical value that can arbitrarily go up and
+// down.
+type Gauge interface {
+	Set(float64)
+}
+
 // Sink provides an interface for exposing metrics.
 type Sink interface {
 	RequestDuration(funcname string) Observer
 	PullthroughBlobstoreCacheRequests(resultType string) Counter
+	PullthroughBlobRequests(resultType string) Counter
 	PullthroughRepositoryDuration(registry, funcname string) Observer
 	PullthroughRepositoryErrors(registry, funcname, errcode string) Counter
 	StorageDuration(funcname string) Observer
 	StorageErrors(funcname, errcode string) Counter
+	StorageCorrectedImages(action string) Counter
+	StorageUsage() Gauge
+	StorageWatermarkPrunes() Counter
+	StoragePrunedBlobs() Counter
+	StorageSpoolBytes() Gauge
+	StorageSpoolPendingFiles() Gauge
+	StorageSpoolMovedBytes() ValueCounter
+	StorageSpoolFailures(reason string) Counter
 	DigestCacheRequests(resultType string) Counter
 	DigestCacheScopedRequests(resultType string) Counter
+	CacheRequests(cacheName, resultType string) Counter
+	CacheEvictions(cacheName string) Counter
+	CacheEntries(cacheName string) Gauge
+	CacheHitRatio(cacheName string) Gauge
+	CoordinationLeader() Gauge
+	CoordinationTakeovers() Counter
+	APIWriteRetries(operation, reason string) Counter
+	DegradedModeActive() Gauge
+	DegradedModeRequests(kind string) Counter
+	TagDigestChanges() Counter
+	ManifestPlatformPulls(os, architecture, variant string) Counter
+	AuthReviewDuration(kind, verb, resource string) Observer
+	AuthReviewErrors(kind, verb, resource, reason string) Counter
+	KubeClientAuthFailures(reason string) Counter
+	KubeClientRebuilds(result string) Counter
+	PullthroughCertificatePinFailures(registry string) Counter
+	BlobServedBytes(namespace, source string) ValueCounter
+	PullthroughMirroredBytes(namespace string) ValueCounter
+	PullthroughMirrorQueued() Gauge
+	PullthroughMirrorFailures(reason string) Counter
 }
 
 // Metrics is a set of all metrics that can be provided.
@@ -43,12 +85,38 @@ type Metrics interface {
 	Pullthrough
 	Storage
 	DigestCache
+	Caches
+	Coordination
 }
 
 // Core is a set of metrics for the core functionality.
 type Core interface {
 	// Repository wraps a distribution.Repository to collect statistics.
 	Repository(r distribution.Repository, reponame string) distribution.Repository
+
+	// APIWrites returns an interface to count the writes to the API server
+	// that are retried.
+	APIWrites() APIWrites
+
+	// DegradedMode returns an interface to report the requests served while
+	// the API server is unreachable.
+	DegradedMode() DegradedMode
+
+	// TagDigests returns an interface to count the tags that are pulled with
+	// another digest than the last time.
+	TagDigests() TagDigests
+
+	// PlatformPulls returns an interface to count the pulled images by their
+	// platforms.
+	PlatformPulls() PlatformPulls
+
+	// AuthReviews returns an interface to report the latency and the errors
+	// of the reviews of tokens and access made by the API server.
+	AuthReviews() AuthReviews
+
+	// KubeClient returns an interface to report the failing credentials of
+	// the clients of the API server and the rebuilds of the clients.
+	KubeClient() KubeClient
 }
 
 // Pullthrough is a set of metrics for the pullthrough subsystem.
@@ -59,6 +127,24 @@ type Pullthrough interface {
 	// DigestBlobStoreCache() returns an interface to count cache hits/misses
 	// for pullthrough blobstores.
 	DigestBlobStoreCache() Cache
+
+	// BlobRequestCoalescing returns an interface to count requests for
+	// remote blobs that start a download or join a download in progress.
+	BlobRequestCoalescing() Coalescing
+
+	// CertificatePins returns an interface to count the connections to
+	// remote registries that are refused because their certificates don't
+	// match the configured pins.
+	CertificatePins() CertificatePins
+
+	// BlobTransfers returns an interface to count the bytes of blobs that
+	// are served from the local storage or from remote registries, and the
+	// bytes of remote blobs that are mirrored into the storage.
+	BlobTransfers() BlobTransfers
+
+	// MirrorQueue returns an interface to report the blobs that wait to be
+	// mirrored and the blobs whose mirroring fails.
+	MirrorQueue() MirrorQueue
 }
 
 // Storage is a set of metrics for the storage subsystem.
@@ -66,12 +152,39 @@ type Storage interface {
 	// StorageDriver wraps distribution/registry/storage/driver.StorageDriver
 	// to collect statistics.
 	StorageDriver(driver storagedriver.StorageDriver) storagedriver.StorageDriver
+
+	// ManifestReconciliation returns an interface to count images whose
+	// manifests are corrected by the background verification.
+	ManifestReconciliation() ManifestReconciliation
+
+	// WatermarkPruning returns an interface to report the usage of the
+	// storage and the blobs that are pruned when it exceeds the high
+	// watermark.
+	WatermarkPruning() WatermarkPruning
+
+	// Spool returns an interface to report the usage of the write-behind
+	// spool and the files that are moved to the storage backend.
+	Spool() Spool
 }
 
 // DigestCache is a set of metrics for the digest cache subsystem.
 type DigestCache interface {
 	DigestCache() Cache
 	DigestCacheScoped() Cache
+	Caches
+}
+
+// Coordination is a set of metrics for the coordination between replicas.
+type Coordination interface {
+	// Coordination returns an interface to report the leadership of the
+	// replica.
+	Coordination() Leadership
+}
+
+// Caches is a set of metrics for the internal caches. The metrics of each
+// cache are labeled by its name.
+type Caches interface {
+	InternalCache(name string) InternalCache
 }
 
 func dockerErrorCode(err error) string {
@@ -81,6 +194,12 @@ func dockerErrorCode(err error) string {
 	if strings.Contains(err.Error(), "no basic auth credentials") {
 		return "UNAUTHORIZED"
 	}
+	if strings.Contains(err.Error(), "proxyconnect") {
+		return "PROXY_CONNECTION_FAILED"
+	}
+	if strings.Contains(err.Error(), "certificate pin mismatch") {
+		return "CERTIFICATE_PIN_MISMATCH"
+	}
 	return "UNKNOWN"
 }
 
@@ -124,6 +243,9 @@ func storageSentinelError(err error) bool {
 
 type metrics struct {
 	sink Sink
+
+	mu     sync.Mutex
+	caches map[string]*internalCache
 }
 
 var _ Metrics = &metrics{}
@@ -132,7 +254,8 @@ var _ Metrics = &metrics{}
 // instrument the application.
 func NewMetrics(sink Sink) Metrics {
 	return &metrics{
-		sink: sink,
+		sink:   sink,
+		caches: make(map[string]*internalCache),
 	}
 }
 
@@ -143,6 +266,42 @@ func (m *metrics) Repository(r distribution.Repository, reponame string) distrib
 	})
 }
 
+func (m *metrics) APIWrites() APIWrites {
+	return &apiWrites{
+		sink: m.sink,
+	}
+}
+
+func (m *metrics) DegradedMode() DegradedMode {
+	return &degradedMode{
+		sink: m.sink,
+	}
+}
+
+func (m *metrics) TagDigests() TagDigests {
+	return &tagDigests{
+		sink: m.sink,
+	}
+}
+
+func (m *metrics) PlatformPulls() PlatformPulls {
+	return &platformPulls{
+		sink: m.sink,
+	}
+}
+
+func (m *metrics) AuthReviews() AuthReviews {
+	return &authReviews{
+		sink: m.sink,
+	}
+}
+
+func (m *metrics) KubeClient() KubeClient {
+	return &kubeClient{
+		sink: m.sink,
+	}
+}
+
 func (m *metrics) RepositoryRetriever(retriever registryclient.RepositoryRetriever) registryclient.RepositoryRetriever {
 	return repositoryRetriever{
 		retriever: retriever,
@@ -157,6 +316,31 @@ func (m *metrics) DigestBlobStoreCache() Cache {
 	}
 }
 
+func (m *metrics) BlobRequestCoalescing() Coalescing {
+	return &coalescing{
+		startedCounter:   m.sink.PullthroughBlobRequests("Started"),
+		coalescedCounter: m.sink.PullthroughBlobRequests("Coalesced"),
+	}
+}
+
+func (m *metrics) CertificatePins() CertificatePins {
+	return &certificatePins{
+		sink: m.sink,
+	}
+}
+
+func (m *metrics) BlobTransfers() BlobTransfers {
+	return &blobTransfers{
+		sink: m.sink,
+	}
+}
+
+func (m *metrics) MirrorQueue() MirrorQueue {
+	return &mirrorQueue{
+		sink: m.sink,
+	}
+}
+
 func (m *metrics) StorageDriver(driver storagedriver.StorageDriver) storagedriver.StorageDriver {
 	return wrapped.NewStorageDriver(driver, func(funcname string, f func() error) error {
 		defer NewTimer(m.sink.StorageDuration(funcname)).Stop()
@@ -168,6 +352,34 @@ func (m *metrics) StorageDriver(driver storagedriver.StorageDriver) storagedrive
 	})
 }
 
+func (m *metrics) ManifestReconciliation() ManifestReconciliation {
+	return &manifestReconciliation{
+		restoredCounter:          m.sink.StorageCorrectedImages("ManifestRestored"),
+		annotationRemovedCounter: m.sink.StorageCorrectedImages("AnnotationRemoved"),
+	}
+}
+
+func (m *metrics) WatermarkPruning() WatermarkPruning {
+	return &watermarkPruning{
+		usageGauge:         m.sink.StorageUsage(),
+		startedCounter:     m.sink.StorageWatermarkPrunes(),
+		prunedBlobsCounter: m.sink.StoragePrunedBlobs(),
+	}
+}
+
+func (m *metrics) Spool() Spool {
+	return &spool{
+		sink: m.sink,
+	}
+}
+
+func (m *metrics) Coordination() Leadership {
+	return &leadership{
+		leaderGauge:      m.sink.CoordinationLeader(),
+		takeoversCounter: m.sink.CoordinationTakeovers(),
+	}
+}
+
 func (m *metrics) DigestCache() Cache {
 	return &cache{
 		hitCounter:  m.sink.DigestCacheRequests("Hit"),
@@ -182,6 +394,28 @@ func (m *metrics) DigestCacheScoped() Cache {
 	}
 }
 
+func (m *metrics) InternalCache(name string) InternalCache {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// The hit ratio is calculated from all requests to the cache, so every
+	// caller has to get the same instance.
+	c, ok := m.caches[name]
+	if !ok {
+		c = &internalCache{
+			cache: cache{
+				hitCounter:  m.sink.CacheRequests(name, "Hit"),
+				missCounter: m.sink.CacheRequests(name, "Miss"),
+			},
+			evictCounter:  m.sink.CacheEvictions(name),
+			entriesGauge:  m.sink.CacheEntries(name),
+			hitRatioGauge: m.sink.CacheHitRatio(name),
+		}
+		m.caches[name] = c
+	}
+	return c
+}
+
 type noopMetrics struct{}
 
 var _ Metrics = noopMetrics{}
@@ -196,6 +430,30 @@ func (m noopMetrics) Repository(r distribution.Repository, reponame string) dist
 	return r
 }
 
+func (m noopMetrics) APIWrites() APIWrites {
+	return noopAPIWrites{}
+}
+
+func (m noopMetrics) DegradedMode() DegradedMode {
+	return noopDegradedMode{}
+}
+
+func (m noopMetrics) TagDigests() TagDigests {
+	return noopTagDigests{}
+}
+
+func (m noopMetrics) PlatformPulls() PlatformPulls {
+	return noopPlatformPulls{}
+}
+
+func (m noopMetrics) AuthReviews() AuthReviews {
+	return noopAuthReviews{}
+}
+
+func (m noopMetrics) KubeClient() KubeClient {
+	return noopKubeClient{}
+}
+
 func (m noopMetrics) RepositoryRetriever(retriever registryclient.RepositoryRetriever) registryclient.RepositoryRetriever {
 	return retriever
 }
@@ -204,10 +462,42 @@ func (m noopMetrics) DigestBlobStoreCache() Cache {
 	return noopCache{}
 }
 
+func (m noopMetrics) BlobRequestCoalescing() Coalescing {
+	return noopCoalescing{}
+}
+
+func (m noopMetrics) CertificatePins() CertificatePins {
+	return noopCertificatePins{}
+}
+
+func (m noopMetrics) BlobTransfers() BlobTransfers {
+	return noopBlobTransfers{}
+}
+
+func (m noopMetrics) MirrorQueue() MirrorQueue {
+	return noopMirrorQueue{}
+}
+
 func (m noopMetrics) StorageDriver(driver storagedriver.StorageDriver) storagedriver.StorageDriver {
 	return driver
 }
 
+func (m noopMetrics) ManifestReconciliation() ManifestReconciliation {
+	return noopManifestReconciliation{}
+}
+
+func (m noopMetrics) WatermarkPruning() WatermarkPruning {
+	return noopWatermarkPruning{}
+}
+
+func (m noopMetrics) Spool() Spool {
+	return noopSpool{}
+}
+
+func (m noopMetrics) Coordination() Leadership {
+	return noopLeadership{}
+}
+
 func (m noopMetrics) DigestCache() Cache {
 	return noopCache{}
 }
@@ -215,3 +505,7 @@ func (m noopMetrics) DigestCache() Cache {
 func (m noopMetrics) DigestCacheScoped() Cache {
 	return noopCache{}
 }
+
+func (m noopMetrics) InternalCache(name string) InternalCache {
+	return noopCache{}
+}
@@ -0,0 +1,51 @@
+package metrics
+
+const (
+	// MirrorFailureRetried is the reason of a failed attempt to mirror a
+	// blob that is retried.
+	MirrorFailureRetried = "retried"
+
+	// MirrorFailureFailed is the reason of a blob that isn't mirrored
+	// because all its attempts failed.
+	MirrorFailureFailed = "failed"
+
+	// MirrorFailureQueueFull is the reason of a blob that isn't mirrored
+	// because too many blobs were waiting.
+	MirrorFailureQueueFull = "queue_full"
+
+	// MirrorFailureWriteLimit is the reason of a blob that isn't mirrored
+	// because the write limits were reached.
+	MirrorFailureWriteLimit = "write_limit"
+)
+
+// MirrorQueue provides metrics for the queue of the blobs that are mirrored
+// in the background.
+type MirrorQueue interface {
+	// Queued reports the number of blobs that wait for a worker or for a
+	// retry.
+	Queued(n int)
+
+	// Failed counts a blob that isn't mirrored or an attempt that is
+	// retried. reason is one of the MirrorFailure constants.
+	Failed(reason string)
+}
+
+type mirrorQueue struct {
+	sink Sink
+}
+
+func (q *mirrorQueue) Queued(n int) {
+	q.sink.PullthroughMirrorQueued().Set(float64(n))
+}
+
+func (q *mirrorQueue) Failed(reason string) {
+	q.sink.PullthroughMirrorFailures(reason).Inc()
+}
+
+type noopMirrorQueue struct{}
+
+func (q noopMirrorQueue) Queued(n int) {
+}
+
+func (q noopMirrorQueue) Failed(reason string) {
+}
@@ -0,0 +1,21 @@
+package metrics
+
+// PlatformPulls provides metrics for the platforms of the pulled images.
+type PlatformPulls interface {
+	// Pulled counts a pull of an image for the platform. The values are
+	// empty if the platform of the image is unknown.
+	Pulled(os, architecture, variant string)
+}
+
+type platformPulls struct {
+	sink Sink
+}
+
+func (p *platformPulls) Pulled(os, architecture, variant string) {
+	p.sink.ManifestPlatformPulls(os, architecture, variant).Inc()
+}
+
+type noopPlatformPulls struct{}
+
+func (p noopPlatformPulls) Pulled(os, architecture, variant string) {
+}
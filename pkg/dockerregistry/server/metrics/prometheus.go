@@ -4,6 +4,7 @@ import (
 	"sync"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 
 	_ "k8s.io/component-base/metrics/prometheus/restclient"
 )
@@ -11,10 +12,16 @@ import (
 const (
 	namespace = "imageregistry"
 
-	httpSubsystem        = "http"
-	pullthroughSubsystem = "pullthrough"
-	storageSubsystem     = "storage"
-	digestCacheSubsystem = "digest_cache"
+	httpSubsystem         = "http"
+	pullthroughSubsystem  = "pullthrough"
+	storageSubsystem      = "storage"
+	digestCacheSubsystem  = "digest_cache"
+	cacheSubsystem        = "cache"
+	coordinationSubsystem = "coordination"
+	apiSubsystem          = "api"
+	degradedModeSubsystem = "degraded_mode"
+	tagSubsystem          = "tag"
+	authSubsystem         = "auth"
 )
 
 var (
@@ -43,6 +50,24 @@ var (
 		},
 		[]string{"code", "method"},
 	)
+	httpBlobServedBytesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: httpSubsystem,
+			Name:      "blob_served_bytes_total",
+			Help:      "Cumulative number of bytes of blobs sent to the clients from the local storage or from remote registries.",
+		},
+		[]string{"namespace", "source"},
+	)
+	httpManifestPlatformPullsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: httpSubsystem,
+			Name:      "manifest_platform_pulls_total",
+			Help:      "Cumulative number of image manifests sent to the clients by the platform of the image.",
+		},
+		[]string{"os", "architecture", "variant"},
+	)
 	HTTPRequestDurationSeconds = prometheus.NewSummaryVec(
 		prometheus.SummaryOpts{
 			Namespace:  namespace,
@@ -93,6 +118,15 @@ var (
 		},
 		[]string{"type"},
 	)
+	pullthroughBlobRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: pullthroughSubsystem,
+			Name:      "blob_requests_total",
+			Help:      "Total number of requests for remote blobs that started a download or joined a download in progress.",
+		},
+		[]string{"type"},
+	)
 	pullthroughRepositoryDurationSeconds = prometheus.NewSummaryVec(
 		prometheus.SummaryOpts{
 			Namespace:  namespace,
@@ -112,6 +146,41 @@ var (
 		},
 		[]string{"registry", "operation", "code"},
 	)
+	pullthroughMirroredBytesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: pullthroughSubsystem,
+			Name:      "mirrored_bytes_total",
+			Help:      "Cumulative number of bytes of remote blobs written into the storage by the mirroring.",
+		},
+		[]string{"namespace"},
+	)
+	pullthroughCertificatePinFailuresTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: pullthroughSubsystem,
+			Name:      "certificate_pin_failures_total",
+			Help:      "Cumulative number of connections to remote registries refused because their certificates didn't match the configured pins.",
+		},
+		[]string{"registry"},
+	)
+	pullthroughMirrorQueued = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: pullthroughSubsystem,
+			Name:      "mirror_queued",
+			Help:      "Number of blobs that wait to be mirrored into the storage.",
+		},
+	)
+	pullthroughMirrorFailuresTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: pullthroughSubsystem,
+			Name:      "mirror_failures_total",
+			Help:      "Cumulative number of blobs that weren't mirrored and of mirroring attempts that were retried.",
+		},
+		[]string{"reason"},
+	)
 
 	storageDurationSeconds = prometheus.NewSummaryVec(
 		prometheus.SummaryOpts{
@@ -132,6 +201,72 @@ var (
 		},
 		[]string{"operation", "code"},
 	)
+	storageCorrectedImagesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: storageSubsystem,
+			Name:      "corrected_images_total",
+			Help:      "Cumulative number of images with a manifest that was missing in the storage.",
+		},
+		[]string{"action"},
+	)
+	storageUsageBytes = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: storageSubsystem,
+			Name:      "usage_bytes",
+			Help:      "Usage of the storage in bytes that is checked against the pruning watermarks.",
+		},
+	)
+	storageWatermarkPrunesTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: storageSubsystem,
+			Name:      "watermark_prunes_total",
+			Help:      "Cumulative number of prunings started because the usage of the storage exceeded the high watermark.",
+		},
+	)
+	storagePrunedBlobsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: storageSubsystem,
+			Name:      "pruned_blobs_total",
+			Help:      "Cumulative number of unused blobs deleted because the usage of the storage exceeded the high watermark.",
+		},
+	)
+	storageSpoolBytes = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: storageSubsystem,
+			Name:      "spool_bytes",
+			Help:      "Number of bytes in the write-behind spool, including the uploads in progress.",
+		},
+	)
+	storageSpoolPendingFiles = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: storageSubsystem,
+			Name:      "spool_pending_files",
+			Help:      "Number of spooled files that are not moved to the storage backend yet.",
+		},
+	)
+	storageSpoolMovedBytesTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: storageSubsystem,
+			Name:      "spool_moved_bytes_total",
+			Help:      "Cumulative number of bytes moved from the write-behind spool to the storage backend.",
+		},
+	)
+	storageSpoolFailuresTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: storageSubsystem,
+			Name:      "spool_failures_total",
+			Help:      "Cumulative number of writes rejected by the full write-behind spool and of failed moves to the storage backend.",
+		},
+		[]string{"reason"},
+	)
 
 	digestCacheRequestsTotal = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
@@ -151,9 +286,141 @@ var (
 		},
 		[]string{"type"},
 	)
+
+	cacheRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: cacheSubsystem,
+			Name:      "requests_total",
+			Help:      "Total number of requests to the internal caches.",
+		},
+		[]string{"cache", "type"},
+	)
+	cacheEvictionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: cacheSubsystem,
+			Name:      "evictions_total",
+			Help:      "Total number of entries evicted from the internal caches.",
+		},
+		[]string{"cache"},
+	)
+	cacheEntries = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: cacheSubsystem,
+			Name:      "entries",
+			Help:      "Current number of entries in the internal caches.",
+		},
+		[]string{"cache"},
+	)
+	cacheHitRatio = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: cacheSubsystem,
+			Name:      "hit_ratio",
+			Help:      "Ratio of hits to all requests to the internal caches since the registry start.",
+		},
+		[]string{"cache"},
+	)
+
+	coordinationLeader = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: coordinationSubsystem,
+			Name:      "leader",
+			Help:      "Whether the replica runs the background jobs of the registry.",
+		},
+	)
+	coordinationTakeoversTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: coordinationSubsystem,
+			Name:      "takeovers_total",
+			Help:      "Cumulative number of times the replica became the leader.",
+		},
+	)
+
+	apiWriteRetriesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: apiSubsystem,
+			Name:      "write_retries_total",
+			Help:      "Cumulative number of writes to the API server that were retried after a transient error.",
+		},
+		[]string{"operation", "reason"},
+	)
+	apiClientAuthFailuresTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: apiSubsystem,
+			Name:      "client_auth_failures_total",
+			Help:      "Cumulative number of requests to the API server that failed because of the credentials of the registry.",
+		},
+		[]string{"reason"},
+	)
+	apiClientRebuildsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: apiSubsystem,
+			Name:      "client_rebuilds_total",
+			Help:      "Cumulative number of rebuilds of the clients of the API server with reloaded credentials.",
+		},
+		[]string{"result"},
+	)
+
+	degradedModeActive = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: degradedModeSubsystem,
+			Name:      "active",
+			Help:      "Whether the registry serves pulls without the API server because it is unreachable.",
+		},
+	)
+	degradedModeRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: degradedModeSubsystem,
+			Name:      "requests_total",
+			Help:      "Cumulative number of requests served without the API server because it was unreachable.",
+		},
+		[]string{"kind"},
+	)
+
+	tagDigestChangesTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: tagSubsystem,
+			Name:      "digest_changes_total",
+			Help:      "Cumulative number of tag pulls that resolved to another digest than the previous pull of the tag.",
+		},
+	)
+
+	authReviewDurationSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: authSubsystem,
+			Name:      "review_duration_seconds",
+			Help:      "Latency of the token and access reviews made by the API server in seconds.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"kind", "verb", "resource"},
+	)
+	authReviewErrorsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: authSubsystem,
+			Name:      "review_errors_total",
+			Help:      "Cumulative number of token and access reviews that failed with an error.",
+		},
+		[]string{"kind", "verb", "resource", "reason"},
+	)
 )
 
-var prometheusOnce sync.Once
+var (
+	prometheusOnce     sync.Once
+	runtimeMetricsOnce sync.Once
+)
 
 type prometheusSink struct{}
 
@@ -170,16 +437,56 @@ func NewPrometheusSink() Sink {
 	prometheusOnce.Do(func() {
 		prometheus.MustRegister(requestDurationSeconds)
 		prometheus.MustRegister(pullthroughBlobstoreCacheRequestsTotal)
+		prometheus.MustRegister(pullthroughBlobRequestsTotal)
 		prometheus.MustRegister(pullthroughRepositoryDurationSeconds)
 		prometheus.MustRegister(pullthroughRepositoryErrorsTotal)
+		prometheus.MustRegister(pullthroughCertificatePinFailuresTotal)
+		prometheus.MustRegister(pullthroughMirroredBytesTotal)
+		prometheus.MustRegister(pullthroughMirrorQueued)
+		prometheus.MustRegister(pullthroughMirrorFailuresTotal)
+		prometheus.MustRegister(httpBlobServedBytesTotal)
+		prometheus.MustRegister(httpManifestPlatformPullsTotal)
 		prometheus.MustRegister(storageDurationSeconds)
 		prometheus.MustRegister(storageErrorsTotal)
+		prometheus.MustRegister(storageCorrectedImagesTotal)
+		prometheus.MustRegister(storageUsageBytes)
+		prometheus.MustRegister(storageWatermarkPrunesTotal)
+		prometheus.MustRegister(storagePrunedBlobsTotal)
+		prometheus.MustRegister(storageSpoolBytes)
+		prometheus.MustRegister(storageSpoolPendingFiles)
+		prometheus.MustRegister(storageSpoolMovedBytesTotal)
+		prometheus.MustRegister(storageSpoolFailuresTotal)
 		prometheus.MustRegister(digestCacheRequestsTotal)
 		prometheus.MustRegister(digestCacheScopedRequestsTotal)
+		prometheus.MustRegister(cacheRequestsTotal)
+		prometheus.MustRegister(cacheEvictionsTotal)
+		prometheus.MustRegister(cacheEntries)
+		prometheus.MustRegister(cacheHitRatio)
+		prometheus.MustRegister(coordinationLeader)
+		prometheus.MustRegister(coordinationTakeoversTotal)
+		prometheus.MustRegister(apiWriteRetriesTotal)
+		prometheus.MustRegister(apiClientAuthFailuresTotal)
+		prometheus.MustRegister(apiClientRebuildsTotal)
+		prometheus.MustRegister(degradedModeActive)
+		prometheus.MustRegister(degradedModeRequestsTotal)
+		prometheus.MustRegister(tagDigestChangesTotal)
+		prometheus.MustRegister(authReviewDurationSeconds)
+		prometheus.MustRegister(authReviewErrorsTotal)
 	})
 	return prometheusSink{}
 }
 
+// RegisterRuntimeMetrics replaces the default Go collector with the one that
+// exposes all metrics provided by the Go runtime.
+func RegisterRuntimeMetrics() {
+	runtimeMetricsOnce.Do(func() {
+		prometheus.Unregister(collectors.NewGoCollector())
+		prometheus.MustRegister(collectors.NewGoCollector(
+			collectors.WithGoCollectorRuntimeMetrics(collectors.MetricsAll),
+		))
+	})
+}
+
 func (s prometheusSink) RequestDuration(funcname string) Observer {
 	return requestDurationSeconds.WithLabelValues(funcname)
 }
@@ -188,6 +495,10 @@ func (s prometheusSink) PullthroughBlobstoreCacheRequests(resultType string) Cou
 	return pullthroughBlobstoreCacheRequestsTotal.WithLabelValues(resultType)
 }
 
+func (s prometheusSink) PullthroughBlobRequests(resultType string) Counter {
+	return pullthroughBlobRequestsTotal.WithLabelValues(resultType)
+}
+
 func (s prometheusSink) PullthroughRepositoryDuration(registry, funcname string) Observer {
 	return pullthroughRepositoryDurationSeconds.WithLabelValues(registry, funcname)
 }
@@ -196,6 +507,26 @@ func (s prometheusSink) PullthroughRepositoryErrors(registry, funcname, errcode
 	return pullthroughRepositoryErrorsTotal.WithLabelValues(registry, funcname, errcode)
 }
 
+func (s prometheusSink) PullthroughCertificatePinFailures(registry string) Counter {
+	return pullthroughCertificatePinFailuresTotal.WithLabelValues(registry)
+}
+
+func (s prometheusSink) BlobServedBytes(namespace, source string) ValueCounter {
+	return httpBlobServedBytesTotal.WithLabelValues(namespace, source)
+}
+
+func (s prometheusSink) PullthroughMirroredBytes(namespace string) ValueCounter {
+	return pullthroughMirroredBytesTotal.WithLabelValues(namespace)
+}
+
+func (s prometheusSink) PullthroughMirrorQueued() Gauge {
+	return pullthroughMirrorQueued
+}
+
+func (s prometheusSink) PullthroughMirrorFailures(reason string) Counter {
+	return pullthroughMirrorFailuresTotal.WithLabelValues(reason)
+}
+
 func (s prometheusSink) StorageDuration(funcname string) Observer {
 	return storageDurationSeconds.WithLabelValues(funcname)
 }
@@ -204,6 +535,38 @@ func (s prometheusSink) StorageErrors(funcname, errcode string) Counter {
 	return storageErrorsTotal.WithLabelValues(funcname, errcode)
 }
 
+func (s prometheusSink) StorageCorrectedImages(action string) Counter {
+	return storageCorrectedImagesTotal.WithLabelValues(action)
+}
+
+func (s prometheusSink) StorageUsage() Gauge {
+	return storageUsageBytes
+}
+
+func (s prometheusSink) StorageWatermarkPrunes() Counter {
+	return storageWatermarkPrunesTotal
+}
+
+func (s prometheusSink) StoragePrunedBlobs() Counter {
+	return storagePrunedBlobsTotal
+}
+
+func (s prometheusSink) StorageSpoolBytes() Gauge {
+	return storageSpoolBytes
+}
+
+func (s prometheusSink) StorageSpoolPendingFiles() Gauge {
+	return storageSpoolPendingFiles
+}
+
+func (s prometheusSink) StorageSpoolMovedBytes() ValueCounter {
+	return storageSpoolMovedBytesTotal
+}
+
+func (s prometheusSink) StorageSpoolFailures(reason string) Counter {
+	return storageSpoolFailuresTotal.WithLabelValues(reason)
+}
+
 func (s prometheusSink) DigestCacheRequests(resultType string) Counter {
 	return digestCacheRequestsTotal.WithLabelValues(resultType)
 }
@@ -211,3 +574,63 @@ func (s prometheusSink) DigestCacheRequests(resultType string) Counter {
 func (s prometheusSink) DigestCacheScopedRequests(resultType string) Counter {
 	return digestCacheScopedRequestsTotal.WithLabelValues(resultType)
 }
+
+func (s prometheusSink) CacheRequests(cacheName, resultType string) Counter {
+	return cacheRequestsTotal.WithLabelValues(cacheName, resultType)
+}
+
+func (s prometheusSink) CacheEvictions(cacheName string) Counter {
+	return cacheEvictionsTotal.WithLabelValues(cacheName)
+}
+
+func (s prometheusSink) CacheEntries(cacheName string) Gauge {
+	return cacheEntries.WithLabelValues(cacheName)
+}
+
+func (s prometheusSink) CacheHitRatio(cacheName string) Gauge {
+	return cacheHitRatio.WithLabelValues(cacheName)
+}
+
+func (s prometheusSink) CoordinationLeader() Gauge {
+	return coordinationLeader
+}
+
+func (s prometheusSink) CoordinationTakeovers() Counter {
+	return coordinationTakeoversTotal
+}
+
+func (s prometheusSink) APIWriteRetries(operation, reason string) Counter {
+	return apiWriteRetriesTotal.WithLabelValues(operation, reason)
+}
+
+func (s prometheusSink) DegradedModeActive() Gauge {
+	return degradedModeActive
+}
+
+func (s prometheusSink) DegradedModeRequests(kind string) Counter {
+	return degradedModeRequestsTotal.WithLabelValues(kind)
+}
+
+func (s prometheusSink) TagDigestChanges() Counter {
+	return tagDigestChangesTotal
+}
+
+func (s prometheusSink) ManifestPlatformPulls(os, architecture, variant string) Counter {
+	return httpManifestPlatformPullsTotal.WithLabelValues(os, architecture, variant)
+}
+
+func (s prometheusSink) AuthReviewDuration(kind, verb, resource string) Observer {
+	return authReviewDurationSeconds.WithLabelValues(kind, verb, resource)
+}
+
+func (s prometheusSink) AuthReviewErrors(kind, verb, resource, reason string) Counter {
+	return authReviewErrorsTotal.WithLabelValues(kind, verb, resource, reason)
+}
+
+func (s prometheusSink) KubeClientAuthFailures(reason string) Counter {
+	return apiClientAuthFailuresTotal.WithLabelValues(reason)
+}
+
+func (s prometheusSink) KubeClientRebuilds(result string) Counter {
+	return apiClientRebuildsTotal.WithLabelValues(result)
+}
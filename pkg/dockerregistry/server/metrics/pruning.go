@@ -0,0 +1,43 @@
+package metrics
+
+// WatermarkPruning provides metrics for the pruning that is started when the
+// usage of the storage exceeds the high watermark.
+type WatermarkPruning interface {
+	// Usage reports the usage of the storage in bytes.
+	Usage(bytes int64)
+
+	// Started counts a pruning that is started by the high watermark.
+	Started()
+
+	// BlobPruned counts a blob that is deleted by the pruning.
+	BlobPruned()
+}
+
+type watermarkPruning struct {
+	usageGauge         Gauge
+	startedCounter     Counter
+	prunedBlobsCounter Counter
+}
+
+func (p *watermarkPruning) Usage(bytes int64) {
+	p.usageGauge.Set(float64(bytes))
+}
+
+func (p *watermarkPruning) Started() {
+	p.startedCounter.Inc()
+}
+
+func (p *watermarkPruning) BlobPruned() {
+	p.prunedBlobsCounter.Inc()
+}
+
+type noopWatermarkPruning struct{}
+
+func (p noopWatermarkPruning) Usage(bytes int64) {
+}
+
+func (p noopWatermarkPruning) Started() {
+}
+
+func (p noopWatermarkPruning) BlobPruned() {
+}
@@ -0,0 +1,34 @@
+package metrics
+
+// ManifestReconciliation provides metrics for images whose manifests are
+// corrected by the background verification of the storage.
+type ManifestReconciliation interface {
+	// ManifestRestored counts an image whose manifest was stored again from
+	// the image object.
+	ManifestRestored()
+
+	// AnnotationRemoved counts an image whose manifest wasn't found in the
+	// storage and couldn't be restored, so its annotation was removed.
+	AnnotationRemoved()
+}
+
+type manifestReconciliation struct {
+	restoredCounter          Counter
+	annotationRemovedCounter Counter
+}
+
+func (r *manifestReconciliation) ManifestRestored() {
+	r.restoredCounter.Inc()
+}
+
+func (r *manifestReconciliation) AnnotationRemoved() {
+	r.annotationRemovedCounter.Inc()
+}
+
+type noopManifestReconciliation struct{}
+
+func (r noopManifestReconciliation) ManifestRestored() {
+}
+
+func (r noopManifestReconciliation) AnnotationRemoved() {
+}
@@ -0,0 +1,53 @@
+package metrics
+
+const (
+	// SpoolFailureFull is the reason of a write that is rejected because the
+	// spool has no space left.
+	SpoolFailureFull = "full"
+
+	// SpoolFailureMove is the reason of a spooled file that isn't moved to
+	// the storage backend and is retried later.
+	SpoolFailureMove = "move"
+)
+
+// Spool provides metrics for the write-behind spool of the storage.
+type Spool interface {
+	// Usage reports the bytes in the spool and the number of spooled files
+	// that are not moved to the storage backend yet.
+	Usage(bytes int64, pending int)
+
+	// Moved counts the bytes that are moved to the storage backend.
+	Moved(bytes int64)
+
+	// Failed counts a write or a move that fails. reason is one of the
+	// SpoolFailure constants.
+	Failed(reason string)
+}
+
+type spool struct {
+	sink Sink
+}
+
+func (s *spool) Usage(bytes int64, pending int) {
+	s.sink.StorageSpoolBytes().Set(float64(bytes))
+	s.sink.StorageSpoolPendingFiles().Set(float64(pending))
+}
+
+func (s *spool) Moved(bytes int64) {
+	s.sink.StorageSpoolMovedBytes().Add(float64(bytes))
+}
+
+func (s *spool) Failed(reason string) {
+	s.sink.StorageSpoolFailures(reason).Inc()
+}
+
+type noopSpool struct{}
+
+func (s noopSpool) Usage(bytes int64, pending int) {
+}
+
+func (s noopSpool) Moved(bytes int64) {
+}
+
+func (s noopSpool) Failed(reason string) {
+}
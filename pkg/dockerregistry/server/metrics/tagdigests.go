@@ -0,0 +1,21 @@
+package metrics
+
+// TagDigests provides metrics for the tags that are pulled with another
+// digest than the last time.
+type TagDigests interface {
+	// Changed counts a pull of a tag that resolved to another digest.
+	Changed()
+}
+
+type tagDigests struct {
+	sink Sink
+}
+
+func (t *tagDigests) Changed() {
+	t.sink.TagDigestChanges().Inc()
+}
+
+type noopTagDigests struct{}
+
+func (t noopTagDigests) Changed() {
+}
@@ -19,6 +19,18 @@ func (f callbackCounter) Inc() {
 	f()
 }
 
+type callbackValueCounter func(float64)
+
+func (f callbackValueCounter) Add(value float64) {
+	f(value)
+}
+
+type callbackGauge func(float64)
+
+func (f callbackGauge) Set(value float64) {
+	f(value)
+}
+
 type counterSink struct {
 	c counter.Counter
 }
@@ -37,6 +49,12 @@ func (s counterSink) PullthroughBlobstoreCacheRequests(resultType string) metric
 	})
 }
 
+func (s counterSink) PullthroughBlobRequests(resultType string) metrics.Counter {
+	return callbackCounter(func() {
+		s.c.Add(fmt.Sprintf("pullthrough_blob_requests:%s", resultType), 1)
+	})
+}
+
 func (s counterSink) PullthroughRepositoryDuration(registry, funcname string) metrics.Observer {
 	return callbackObserver(func(float64) {
 		s.c.Add(fmt.Sprintf("pullthrough_repository:%s:%s", registry, funcname), 1)
@@ -49,6 +67,37 @@ func (s counterSink) PullthroughRepositoryErrors(registry, funcname, errcode str
 	})
 }
 
+func (s counterSink) PullthroughCertificatePinFailures(registry string) metrics.Counter {
+	return callbackCounter(func() {
+		s.c.Add(fmt.Sprintf("pullthrough_certificate_pin_failures:%s", registry), 1)
+	})
+}
+
+func (s counterSink) BlobServedBytes(namespace, source string) metrics.ValueCounter {
+	return callbackValueCounter(func(value float64) {
+		s.c.Add(fmt.Sprintf("blob_served_bytes:%s:%s", namespace, source), int(value))
+	})
+}
+
+func (s counterSink) PullthroughMirroredBytes(namespace string) metrics.ValueCounter {
+	return callbackValueCounter(func(value float64) {
+		s.c.Add(fmt.Sprintf("pullthrough_mirrored_bytes:%s", namespace), int(value))
+	})
+}
+
+func (s counterSink) PullthroughMirrorQueued() metrics.Gauge {
+	key := "pullthrough_mirror_queued"
+	return callbackGauge(func(value float64) {
+		s.c.Add(key, int(value)-s.c.Values()[key])
+	})
+}
+
+func (s counterSink) PullthroughMirrorFailures(reason string) metrics.Counter {
+	return callbackCounter(func() {
+		s.c.Add(fmt.Sprintf("pullthrough_mirror_failures:%s", reason), 1)
+	})
+}
+
 func (s counterSink) StorageDuration(funcname string) metrics.Observer {
 	return callbackObserver(func(float64) {
 		s.c.Add(fmt.Sprintf("storage:%s", funcname), 1)
@@ -61,6 +110,58 @@ func (s counterSink) StorageErrors(funcname, errcode string) metrics.Counter {
 	})
 }
 
+func (s counterSink) StorageCorrectedImages(action string) metrics.Counter {
+	return callbackCounter(func() {
+		s.c.Add(fmt.Sprintf("storage_corrected_images:%s", action), 1)
+	})
+}
+
+// StorageUsage stores the last value of the gauge in the counter.
+func (s counterSink) StorageUsage() metrics.Gauge {
+	key := "storage_usage"
+	return callbackGauge(func(value float64) {
+		s.c.Add(key, int(value)-s.c.Values()[key])
+	})
+}
+
+func (s counterSink) StorageWatermarkPrunes() metrics.Counter {
+	return callbackCounter(func() {
+		s.c.Add("storage_watermark_prunes", 1)
+	})
+}
+
+func (s counterSink) StoragePrunedBlobs() metrics.Counter {
+	return callbackCounter(func() {
+		s.c.Add("storage_pruned_blobs", 1)
+	})
+}
+
+func (s counterSink) StorageSpoolBytes() metrics.Gauge {
+	key := "storage_spool_bytes"
+	return callbackGauge(func(value float64) {
+		s.c.Add(key, int(value)-s.c.Values()[key])
+	})
+}
+
+func (s counterSink) StorageSpoolPendingFiles() metrics.Gauge {
+	key := "storage_spool_pending_files"
+	return callbackGauge(func(value float64) {
+		s.c.Add(key, int(value)-s.c.Values()[key])
+	})
+}
+
+func (s counterSink) StorageSpoolMovedBytes() metrics.ValueCounter {
+	return callbackValueCounter(func(value float64) {
+		s.c.Add("storage_spool_moved_bytes", int(value))
+	})
+}
+
+func (s counterSink) StorageSpoolFailures(reason string) metrics.Counter {
+	return callbackCounter(func() {
+		s.c.Add(fmt.Sprintf("storage_spool_failures:%s", reason), 1)
+	})
+}
+
 func (s counterSink) DigestCacheRequests(resultType string) metrics.Counter {
 	return callbackCounter(func() {
 		s.c.Add(fmt.Sprintf("digest_cache_requests:%s", resultType), 1)
@@ -73,6 +174,104 @@ func (s counterSink) DigestCacheScopedRequests(resultType string) metrics.Counte
 	})
 }
 
+func (s counterSink) CacheRequests(cacheName, resultType string) metrics.Counter {
+	return callbackCounter(func() {
+		s.c.Add(fmt.Sprintf("cache_requests:%s:%s", cacheName, resultType), 1)
+	})
+}
+
+func (s counterSink) CacheEvictions(cacheName string) metrics.Counter {
+	return callbackCounter(func() {
+		s.c.Add(fmt.Sprintf("cache_evictions:%s", cacheName), 1)
+	})
+}
+
+// CacheEntries stores the last value of the gauge in the counter.
+func (s counterSink) CacheEntries(cacheName string) metrics.Gauge {
+	key := fmt.Sprintf("cache_entries:%s", cacheName)
+	return callbackGauge(func(value float64) {
+		s.c.Add(key, int(value)-s.c.Values()[key])
+	})
+}
+
+// CacheHitRatio stores the last value of the gauge in percent in the counter.
+func (s counterSink) CacheHitRatio(cacheName string) metrics.Gauge {
+	key := fmt.Sprintf("cache_hit_ratio:%s", cacheName)
+	return callbackGauge(func(value float64) {
+		s.c.Add(key, int(value*100)-s.c.Values()[key])
+	})
+}
+
+// CoordinationLeader stores the last value of the gauge in the counter.
+func (s counterSink) CoordinationLeader() metrics.Gauge {
+	key := "coordination_leader"
+	return callbackGauge(func(value float64) {
+		s.c.Add(key, int(value)-s.c.Values()[key])
+	})
+}
+
+func (s counterSink) CoordinationTakeovers() metrics.Counter {
+	return callbackCounter(func() {
+		s.c.Add("coordination_takeovers", 1)
+	})
+}
+
+func (s counterSink) APIWriteRetries(operation, reason string) metrics.Counter {
+	return callbackCounter(func() {
+		s.c.Add(fmt.Sprintf("api_write_retries:%s:%s", operation, reason), 1)
+	})
+}
+
+// DegradedModeActive stores the last value of the gauge in the counter.
+func (s counterSink) DegradedModeActive() metrics.Gauge {
+	key := "degraded_mode_active"
+	return callbackGauge(func(value float64) {
+		s.c.Add(key, int(value)-s.c.Values()[key])
+	})
+}
+
+func (s counterSink) DegradedModeRequests(kind string) metrics.Counter {
+	return callbackCounter(func() {
+		s.c.Add(fmt.Sprintf("degraded_mode_requests:%s", kind), 1)
+	})
+}
+
+func (s counterSink) TagDigestChanges() metrics.Counter {
+	return callbackCounter(func() {
+		s.c.Add("tag_digest_changes", 1)
+	})
+}
+
+func (s counterSink) ManifestPlatformPulls(os, architecture, variant string) metrics.Counter {
+	return callbackCounter(func() {
+		s.c.Add(fmt.Sprintf("manifest_platform_pulls:%s/%s/%s", os, architecture, variant), 1)
+	})
+}
+
+func (s counterSink) AuthReviewDuration(kind, verb, resource string) metrics.Observer {
+	return callbackObserver(func(float64) {
+		s.c.Add(fmt.Sprintf("auth_review:%s:%s:%s", kind, verb, resource), 1)
+	})
+}
+
+func (s counterSink) AuthReviewErrors(kind, verb, resource, reason string) metrics.Counter {
+	return callbackCounter(func() {
+		s.c.Add(fmt.Sprintf("auth_review_errors:%s:%s:%s:%s", kind, verb, resource, reason), 1)
+	})
+}
+
+func (s counterSink) KubeClientAuthFailures(reason string) metrics.Counter {
+	return callbackCounter(func() {
+		s.c.Add("api_client_auth_failures:"+reason, 1)
+	})
+}
+
+func (s counterSink) KubeClientRebuilds(result string) metrics.Counter {
+	return callbackCounter(func() {
+		s.c.Add("api_client_rebuilds:"+result, 1)
+	})
+}
+
 func NewCounterSink() (counter.Counter, metrics.Sink) {
 	c := counter.New()
 	return c, counterSink{c: c}
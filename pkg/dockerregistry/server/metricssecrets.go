@@ -0,0 +1,120 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/configuration"
+)
+
+// metricsSecretsCheckInterval is how often the secrets file is checked for
+// changes.
+const metricsSecretsCheckInterval = 10 * time.Second
+
+// metricsSecrets are the bearer tokens accepted by the metrics endpoint. The
+// tokens from the secrets file are reloaded when the file changes, so that
+// the scrape credentials can be rotated without restarting the registry.
+type metricsSecrets struct {
+	static []string
+	file   string
+
+	mu        sync.Mutex
+	fromFile  []string
+	loaded    bool
+	modTime   time.Time
+	size      int64
+	checkedAt time.Time
+	now       func() time.Time
+}
+
+func newMetricsSecrets(cfg configuration.Metrics) *metricsSecrets {
+	s := &metricsSecrets{
+		file: cfg.SecretsFile,
+		now:  time.Now,
+	}
+	for _, secret := range append([]string{cfg.Secret}, cfg.Secrets...) {
+		if len(secret) > 0 {
+			s.static = append(s.static, secret)
+		}
+	}
+	return s
+}
+
+// Configured returns true if the metrics endpoint is protected by secrets
+// instead of access reviews.
+func (s *metricsSecrets) Configured() bool {
+	return len(s.static) > 0 || len(s.file) > 0
+}
+
+// Valid returns true if token is one of the accepted secrets.
+func (s *metricsSecrets) Valid(ctx context.Context, token string) bool {
+	if len(token) == 0 {
+		return false
+	}
+
+	valid := false
+	for _, secret := range s.secrets(ctx) {
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(token)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
+
+func (s *metricsSecrets) secrets(ctx context.Context) []string {
+	if len(s.file) == 0 {
+		return s.static
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if s.checkedAt.IsZero() || now.Sub(s.checkedAt) >= metricsSecretsCheckInterval {
+		s.reload(ctx)
+		s.checkedAt = now
+	}
+
+	return append(s.static[:len(s.static):len(s.static)], s.fromFile...)
+}
+
+// reload reads the secrets file if it has changed since the last read. The
+// last known secrets are kept if the file cannot be read.
+func (s *metricsSecrets) reload(ctx context.Context) {
+	fi, err := os.Stat(s.file)
+	if err != nil {
+		dcontext.GetLogger(ctx).Errorf("unable to check the metrics secrets file %s: %v", s.file, err)
+		return
+	}
+	if fi.ModTime().Equal(s.modTime) && fi.Size() == s.size && s.loaded {
+		return
+	}
+
+	data, err := os.ReadFile(s.file)
+	if err != nil {
+		dcontext.GetLogger(ctx).Errorf("unable to read the metrics secrets file %s: %v", s.file, err)
+		return
+	}
+
+	var secrets []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if secret := strings.TrimSpace(scanner.Text()); len(secret) > 0 {
+			secrets = append(secrets, secret)
+		}
+	}
+
+	s.fromFile = secrets
+	s.loaded = true
+	s.modTime = fi.ModTime()
+	s.size = fi.Size()
+	dcontext.GetLogger(ctx).Infof("loaded %d metrics secret(s) from %s", len(secrets), s.file)
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/configuration"
+)
+
+func TestMetricsSecrets(t *testing.T) {
+	ctx := context.Background()
+
+	file := filepath.Join(t.TempDir(), "secrets")
+	writeSecrets := func(content string, modTime time.Time) {
+		if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	start := time.Now()
+	writeSecrets("first\n\n  second  \n", start)
+
+	now := start
+	s := newMetricsSecrets(configuration.Metrics{
+		Secret:      "static",
+		Secrets:     []string{"", "other"},
+		SecretsFile: file,
+	})
+	s.now = func() time.Time { return now }
+
+	if !s.Configured() {
+		t.Fatal("expected the secrets to be configured")
+	}
+
+	for _, tc := range []struct {
+		token string
+		valid bool
+	}{
+		{token: "static", valid: true},
+		{token: "other", valid: true},
+		{token: "first", valid: true},
+		{token: "second", valid: true},
+		{token: "third"},
+		{token: ""},
+	} {
+		if valid := s.Valid(ctx, tc.token); valid != tc.valid {
+			t.Errorf("token %q: got valid=%t, want %t", tc.token, valid, tc.valid)
+		}
+	}
+
+	writeSecrets("third\n", start.Add(time.Minute))
+
+	now = now.Add(metricsSecretsCheckInterval / 2)
+	if !s.Valid(ctx, "first") {
+		t.Error("expected the secrets file not to be reloaded before the check interval")
+	}
+
+	now = now.Add(metricsSecretsCheckInterval)
+	if s.Valid(ctx, "first") {
+		t.Error("expected the old secret from the file to be rejected after the rotation")
+	}
+	if !s.Valid(ctx, "third") {
+		t.Error("expected the new secret from the file to be accepted after the rotation")
+	}
+	if !s.Valid(ctx, "static") {
+		t.Error("expected the static secret to be accepted after the rotation")
+	}
+
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(metricsSecretsCheckInterval)
+	if !s.Valid(ctx, "third") {
+		t.Error("expected the last known secrets to be kept when the file is missing")
+	}
+
+	if s := newMetricsSecrets(configuration.Metrics{Enabled: true}); s.Configured() {
+		t.Error("expected no secrets to be configured")
+	}
+}
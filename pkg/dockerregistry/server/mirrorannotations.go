@@ -0,0 +1,209 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/distribution/v3/manifest/schema2"
+	"github.com/opencontainers/go-digest"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	imageapiv1 "github.com/openshift/api/image/v1"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+)
+
+const (
+	// mirroredImageTTL is how long an image waits for the mirroring of its
+	// config. The config isn't mirrored if, for example, the write limits
+	// are reached or no client pulls it.
+	mirroredImageTTL = time.Hour
+
+	// mirrorAnnotationAttempts is the number of attempts to update an image
+	// that is modified concurrently.
+	mirrorAnnotationAttempts = 3
+)
+
+// mirroredImage is an image whose manifest was mirrored.
+type mirroredImage struct {
+	// config is the digest of the config blob that isn't mirrored yet. It
+	// is empty when the image can be annotated.
+	config     digest.Digest
+	mirroredAt time.Time
+}
+
+// mirroredImageAnnotator sets the ImageManifestBlobStored annotation on the
+// images whose manifests and configs are mirrored by the pullthrough. The
+// blobs of an image are mirrored by separate requests, so the mirroring only
+// records them and the images are updated in the background once per
+// interval. An image is updated once, no matter how many of its blobs were
+// mirrored, which keeps the API writes low during large imports.
+type mirroredImageAnnotator struct {
+	client   client.Interface
+	interval time.Duration
+	now      func() time.Time
+
+	mu     sync.Mutex
+	images map[string]*mirroredImage
+	// configs maps the digests of the config blobs that aren't mirrored
+	// yet to the names of their images.
+	configs map[digest.Digest][]string
+}
+
+func newMirroredImageAnnotator(osClient client.Interface, interval time.Duration) *mirroredImageAnnotator {
+	return &mirroredImageAnnotator{
+		client:   osClient,
+		interval: interval,
+		now:      time.Now,
+		images:   make(map[string]*mirroredImage),
+		configs:  make(map[digest.Digest][]string),
+	}
+}
+
+// run writes the recorded annotations every interval until ctx is done.
+func (a *mirroredImageAnnotator) run(ctx context.Context) {
+	dcontext.GetLogger(ctx).Infof("starting annotation of mirrored images every %s", a.interval)
+
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.flush(ctx)
+		}
+	}
+}
+
+// manifestMirrored records that the manifest of image was stored in the local
+// storage. blobs is used to check whether the config of the image is already
+// mirrored.
+func (a *mirroredImageAnnotator) manifestMirrored(ctx context.Context, image *imageapiv1.Image, manifest distribution.Manifest, blobs distribution.BlobStatter) {
+	if image.Annotations[imageapiv1.ImageManifestBlobStoredAnnotation] == "true" {
+		return
+	}
+
+	config := manifestConfig(manifest)
+	if config != "" {
+		if _, err := blobs.Stat(ctx, config); err == nil {
+			config = ""
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.images[image.Name]; ok {
+		return
+	}
+	a.images[image.Name] = &mirroredImage{
+		config:     config,
+		mirroredAt: a.now(),
+	}
+	if config != "" {
+		a.configs[config] = append(a.configs[config], image.Name)
+	}
+}
+
+// blobMirrored records that the blob dgst was stored in the local storage.
+func (a *mirroredImageAnnotator) blobMirrored(dgst digest.Digest) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, name := range a.configs[dgst] {
+		if image, ok := a.images[name]; ok {
+			image.config = ""
+		}
+	}
+	delete(a.configs, dgst)
+}
+
+// flush annotates the images whose manifests and configs are mirrored.
+func (a *mirroredImageAnnotator) flush(ctx context.Context) {
+	var ready []string
+
+	a.mu.Lock()
+	expired := a.now().Add(-mirroredImageTTL)
+	for name, image := range a.images {
+		switch {
+		case image.config == "":
+			ready = append(ready, name)
+			delete(a.images, name)
+		case image.mirroredAt.Before(expired):
+			dcontext.GetLogger(ctx).Debugf("mirror annotation: the config %s of image %s isn't mirrored", image.config, name)
+			delete(a.images, name)
+			a.removeConfigLocked(image.config, name)
+		}
+	}
+	a.mu.Unlock()
+
+	for _, name := range ready {
+		if err := a.annotate(ctx, name); err != nil {
+			dcontext.GetLogger(ctx).Errorf("mirror annotation: unable to annotate image %s: %v", name, err)
+		}
+	}
+}
+
+func (a *mirroredImageAnnotator) removeConfigLocked(config digest.Digest, name string) {
+	names := a.configs[config]
+	for i, n := range names {
+		if n == name {
+			names = append(names[:i], names[i+1:]...)
+			break
+		}
+	}
+	if len(names) == 0 {
+		delete(a.configs, config)
+		return
+	}
+	a.configs[config] = names
+}
+
+func (a *mirroredImageAnnotator) annotate(ctx context.Context, name string) error {
+	var err error
+	for attempt := 0; attempt < mirrorAnnotationAttempts; attempt++ {
+		var image *imageapiv1.Image
+		image, err = a.client.Images().Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if image.Annotations[imageapiv1.ImageManifestBlobStoredAnnotation] == "true" {
+			return nil
+		}
+
+		if image.Annotations == nil {
+			image.Annotations = make(map[string]string)
+		}
+		image.Annotations[imageapiv1.ImageManifestBlobStoredAnnotation] = "true"
+		_, err = a.client.Images().Update(ctx, image, metav1.UpdateOptions{})
+		if !apierrors.IsConflict(err) {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+	dcontext.GetLogger(ctx).Debugf("mirror annotation: annotated image %s", name)
+	return nil
+}
+
+// manifestConfig returns the digest of the config blob of manifest, or an
+// empty digest if the manifest has no config.
+func manifestConfig(manifest distribution.Manifest) digest.Digest {
+	switch m := manifest.(type) {
+	case *schema2.DeserializedManifest:
+		return m.Config.Digest
+	case *ocischema.DeserializedManifest:
+		return m.Config.Digest
+	}
+	return ""
+}
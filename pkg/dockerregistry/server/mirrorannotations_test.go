@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/opencontainers/go-digest"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	imageapiv1 "github.com/openshift/api/image/v1"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+	"github.com/openshift/image-registry/pkg/testutil"
+)
+
+func TestMirroredImageAnnotator(t *testing.T) {
+	ctx := context.Background()
+	ctx = testutil.WithTestLogger(ctx, t)
+
+	fos, imageClient := testutil.NewFakeOpenShiftWithClient(ctx)
+
+	const (
+		mirroredConfig = digest.Digest("sha256:0000000000000000000000000000000000000000000000000000000000000001")
+		pendingConfig  = digest.Digest("sha256:0000000000000000000000000000000000000000000000000000000000000002")
+		lostConfig     = digest.Digest("sha256:0000000000000000000000000000000000000000000000000000000000000003")
+		layer          = digest.Digest("sha256:0000000000000000000000000000000000000000000000000000000000000004")
+	)
+	blobs := testutil.NewFakeBlobStore(nil, testutil.BlobContents{
+		mirroredConfig: []byte("{}"),
+	})
+
+	newImage := func(config digest.Digest) (*imageapiv1.Image, distribution.Manifest) {
+		manifest, err := testutil.MakeSchema2Manifest(
+			distribution.Descriptor{Digest: config, Size: 2},
+			[]distribution.Descriptor{{Digest: layer, Size: 2}},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, payload, err := manifest.Payload()
+		if err != nil {
+			t.Fatal(err)
+		}
+		image, err := fos.CreateImage(&imageapiv1.Image{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: digest.FromBytes(payload).String(),
+			},
+			DockerImageReference: "docker.io/library/app@" + digest.FromBytes(payload).String(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return image, manifest
+	}
+
+	annotated := func(name string) bool {
+		image, err := fos.GetImage(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return image.Annotations[imageapiv1.ImageManifestBlobStoredAnnotation] == "true"
+	}
+	updates := func() int {
+		n := 0
+		for _, action := range imageClient.Actions() {
+			if action.GetVerb() == "update" && action.GetResource().Resource == "images" {
+				n++
+			}
+		}
+		return n
+	}
+
+	now := time.Now()
+	a := newMirroredImageAnnotator(client.NewFakeRegistryAPIClient(nil, imageClient), time.Minute)
+	a.now = func() time.Time { return now }
+
+	stored, storedManifest := newImage(mirroredConfig)
+	pending, pendingManifest := newImage(pendingConfig)
+	lost, lostManifest := newImage(lostConfig)
+
+	// The requests of the same image are recorded once.
+	for i := 0; i < 3; i++ {
+		a.manifestMirrored(ctx, stored, storedManifest, blobs)
+		a.manifestMirrored(ctx, pending, pendingManifest, blobs)
+	}
+	a.manifestMirrored(ctx, lost, lostManifest, blobs)
+	a.blobMirrored(layer)
+
+	a.flush(ctx)
+	if !annotated(stored.Name) {
+		t.Errorf("image %s with the mirrored config is not annotated", stored.Name)
+	}
+	if annotated(pending.Name) {
+		t.Errorf("image %s is annotated before its config is mirrored", pending.Name)
+	}
+	if n := updates(); n != 1 {
+		t.Errorf("got %d image updates, want 1", n)
+	}
+
+	a.blobMirrored(pendingConfig)
+	a.blobMirrored(pendingConfig)
+	now = now.Add(2 * mirroredImageTTL)
+	a.flush(ctx)
+	if !annotated(pending.Name) {
+		t.Errorf("image %s is not annotated after its config is mirrored", pending.Name)
+	}
+	if n := updates(); n != 2 {
+		t.Errorf("got %d image updates, want 2", n)
+	}
+
+	// The image whose config wasn't mirrored is forgotten.
+	a.blobMirrored(lostConfig)
+	a.flush(ctx)
+	if annotated(lost.Name) {
+		t.Errorf("image %s is annotated after it expired", lost.Name)
+	}
+	if len(a.images) != 0 || len(a.configs) != 0 {
+		t.Errorf("got %d images and %d configs, want none", len(a.images), len(a.configs))
+	}
+
+	// The annotated images are not updated again.
+	stored, err := fos.GetImage(stored.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.manifestMirrored(ctx, stored, storedManifest, blobs)
+	a.flush(ctx)
+	if n := updates(); n != 2 {
+		t.Errorf("got %d image updates, want 2", n)
+	}
+}
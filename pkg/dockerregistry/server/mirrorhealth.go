@@ -0,0 +1,225 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	reference "github.com/openshift/library-go/pkg/image/reference"
+	"github.com/openshift/library-go/pkg/image/registryclient"
+
+	registryconfig "github.com/openshift/image-registry/pkg/dockerregistry/server/configuration"
+)
+
+const (
+	// mirrorHealthDecay is the weight of the earlier requests in the
+	// success rate and the latency of a mirror.
+	mirrorHealthDecay = 0.8
+
+	// mirrorHealthTTL is how long the health of a mirror is remembered
+	// after its last request. A forgotten mirror gets back its declared
+	// position, so that a recovered mirror is tried again.
+	mirrorHealthTTL = 10 * time.Minute
+
+	// mirrorLatencyScale is the latency that halves the score of a mirror.
+	mirrorLatencyScale = time.Second
+
+	// mirrorScoreBuckets is the number of buckets the scores are rounded
+	// into. The mirrors with scores in the same bucket keep their declared
+	// order, so that small differences in latency don't reorder them.
+	mirrorScoreBuckets = 5
+)
+
+// mirrorStats is the health of a mirror.
+type mirrorStats struct {
+	successRate float64
+	latency     time.Duration
+	lastRequest time.Time
+}
+
+// score returns a value between 0 and 1, healthier mirrors have greater
+// scores.
+func (s *mirrorStats) score() float64 {
+	return s.successRate * float64(mirrorLatencyScale) / float64(mirrorLatencyScale+s.latency)
+}
+
+// mirrorHealth tracks the success rate and the latency of the requests to the
+// mirrors of ImageContentSourcePolicy, ImageDigestMirrorSet and
+// ImageTagMirrorSet objects, and orders the mirrors by their health. Without
+// it the mirrors are tried in their declared order, so a degraded first
+// mirror delays every pull that misses the local storage.
+type mirrorHealth struct {
+	now func() time.Time
+
+	mu    sync.Mutex
+	hosts map[string]*mirrorStats
+}
+
+// newMirrorHealth returns the mirror health for the ordering policy of the
+// mirrors. It returns nil if the mirrors are tried in their declared order.
+func newMirrorHealth(order string) *mirrorHealth {
+	if order != registryconfig.MirrorOrderHealth {
+		return nil
+	}
+	return &mirrorHealth{
+		now:   time.Now,
+		hosts: make(map[string]*mirrorStats),
+	}
+}
+
+// observe records a request to host that took latency and failed if err is
+// not nil.
+func (h *mirrorHealth) observe(host string, latency time.Duration, err error) {
+	success := 1.0
+	if err != nil {
+		success = 0
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	host = strings.ToLower(host)
+	now := h.now()
+	s, ok := h.hosts[host]
+	if !ok || now.Sub(s.lastRequest) > mirrorHealthTTL {
+		h.hosts[host] = &mirrorStats{
+			successRate: success,
+			latency:     latency,
+			lastRequest: now,
+		}
+		return
+	}
+	s.successRate = mirrorHealthDecay*s.successRate + (1-mirrorHealthDecay)*success
+	s.latency = time.Duration(mirrorHealthDecay*float64(s.latency) + (1-mirrorHealthDecay)*float64(latency))
+	s.lastRequest = now
+}
+
+// bucket returns the rounded score of host. Hosts without recent requests
+// are in the bucket of the healthy hosts.
+func (h *mirrorHealth) bucket(host string) int {
+	s, ok := h.hosts[strings.ToLower(host)]
+	if !ok || h.now().Sub(s.lastRequest) > mirrorHealthTTL {
+		return mirrorScoreBuckets - 1
+	}
+	if b := int(s.score() * mirrorScoreBuckets); b < mirrorScoreBuckets {
+		return b
+	}
+	return mirrorScoreBuckets - 1
+}
+
+// order sorts the mirrors among refs from the healthiest to the least
+// healthy. The last reference is the source of the mirrors, it is kept last.
+func (h *mirrorHealth) order(refs []reference.DockerImageReference) []reference.DockerImageReference {
+	if h == nil || len(refs) < 3 {
+		return refs
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	mirrors := refs[:len(refs)-1]
+	buckets := make(map[string]int, len(mirrors))
+	for _, ref := range mirrors {
+		host := ref.RegistryURL().Host
+		if _, ok := buckets[host]; !ok {
+			buckets[host] = h.bucket(host)
+		}
+	}
+	sort.SliceStable(mirrors, func(i, j int) bool {
+		return buckets[mirrors[i].RegistryURL().Host] > buckets[mirrors[j].RegistryURL().Host]
+	})
+	return refs
+}
+
+// status returns the success rates and the latencies of the mirrors with
+// recent requests.
+func (h *mirrorHealth) status() map[string]mirrorHealthStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	status := make(map[string]mirrorHealthStatus)
+	now := h.now()
+	for host, s := range h.hosts {
+		if now.Sub(s.lastRequest) > mirrorHealthTTL {
+			delete(h.hosts, host)
+			continue
+		}
+		status[host] = mirrorHealthStatus{
+			SuccessRate: s.successRate,
+			Latency:     s.latency.String(),
+		}
+	}
+	return status
+}
+
+// mirrorHealthStatus is the health of a mirror in the diagnostics bundles.
+type mirrorHealthStatus struct {
+	SuccessRate float64 `json:"successRate"`
+	Latency     string  `json:"latency"`
+}
+
+// Transport wraps rt to record the health of the registries it connects to.
+// rt is returned if h is nil.
+func (h *mirrorHealth) Transport(rt http.RoundTripper) http.RoundTripper {
+	if h == nil {
+		return rt
+	}
+	return &mirrorHealthTransport{
+		RoundTripper: rt,
+		health:       h,
+	}
+}
+
+// Strategy wraps strategy to try the mirrors in the order of their health.
+// strategy is returned if h is nil.
+func (h *mirrorHealth) Strategy(strategy registryclient.AlternateBlobSourceStrategy) registryclient.AlternateBlobSourceStrategy {
+	if h == nil {
+		return strategy
+	}
+	return &mirrorHealthStrategy{
+		AlternateBlobSourceStrategy: strategy,
+		health:                      h,
+	}
+}
+
+// mirrorHealthTransport records the latency of the responses of registries. The
+// server errors and the connection errors are failures, the client errors,
+// e.g. for missing content, mean that the registry is responsive.
+type mirrorHealthTransport struct {
+	http.RoundTripper
+	health *mirrorHealth
+}
+
+func (t *mirrorHealthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := t.health.now()
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if errors.Is(err, context.Canceled) {
+		return resp, err
+	}
+
+	failure := err
+	if err == nil && (resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests) {
+		failure = errors.New(resp.Status)
+	}
+	t.health.observe(req.URL.Host, t.health.now().Sub(start), failure)
+	return resp, err
+}
+
+// mirrorHealthStrategy orders the sources returned by an
+// AlternateBlobSourceStrategy by the health of the mirrors.
+type mirrorHealthStrategy struct {
+	registryclient.AlternateBlobSourceStrategy
+	health *mirrorHealth
+}
+
+func (s *mirrorHealthStrategy) FirstRequest(ctx context.Context, ref reference.DockerImageReference) ([]reference.DockerImageReference, error) {
+	refs, err := s.AlternateBlobSourceStrategy.FirstRequest(ctx, ref)
+	if err != nil {
+		return refs, err
+	}
+	return s.health.order(refs), nil
+}
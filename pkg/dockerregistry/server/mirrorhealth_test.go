@@ -0,0 +1,146 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	reference "github.com/openshift/library-go/pkg/image/reference"
+
+	registryconfig "github.com/openshift/image-registry/pkg/dockerregistry/server/configuration"
+)
+
+type fakeMirrorStrategy []reference.DockerImageReference
+
+func (s fakeMirrorStrategy) FirstRequest(ctx context.Context, ref reference.DockerImageReference) ([]reference.DockerImageReference, error) {
+	return append([]reference.DockerImageReference(nil), s...), nil
+}
+
+func (s fakeMirrorStrategy) OnFailure(ctx context.Context, ref reference.DockerImageReference) ([]reference.DockerImageReference, error) {
+	return nil, nil
+}
+
+func TestMirrorHealthOrder(t *testing.T) {
+	ctx := context.Background()
+
+	if h := newMirrorHealth(registryconfig.MirrorOrderDeclared); h != nil {
+		t.Fatalf("expected no mirror health for the declared order")
+	}
+	h := newMirrorHealth(registryconfig.MirrorOrderHealth)
+	now := time.Now()
+	h.now = func() time.Time { return now }
+
+	refs := func(names ...string) fakeMirrorStrategy {
+		var refs []reference.DockerImageReference
+		for _, name := range names {
+			ref, err := reference.Parse(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			refs = append(refs, ref)
+		}
+		return refs
+	}
+	order := func() fakeMirrorStrategy {
+		sources, err := h.Strategy(refs(
+			"slow.example.com/app",
+			"failing.example.com:5000/app",
+			"new.example.com/app",
+			"fast.example.com/app",
+			"source.example.com/app",
+		)).FirstRequest(ctx, reference.DockerImageReference{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sources
+	}
+
+	for i := 0; i < 5; i++ {
+		h.observe("slow.example.com", 3*time.Second, nil)
+		h.observe("failing.example.com:5000", 10*time.Millisecond, errors.New("503 Service Unavailable"))
+		h.observe("fast.example.com", 20*time.Millisecond, nil)
+		h.observe("source.example.com", 5*time.Second, errors.New("timeout"))
+	}
+
+	expected := refs(
+		"new.example.com/app",
+		"fast.example.com/app",
+		"slow.example.com/app",
+		"failing.example.com:5000/app",
+		"source.example.com/app",
+	)
+	if got := order(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("got order %v, want %v", got, expected)
+	}
+
+	// A single success doesn't restore a failing mirror.
+	h.observe("failing.example.com:5000", 10*time.Millisecond, nil)
+	if got := order(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("got order %v, want %v", got, expected)
+	}
+
+	// The mirrors get back their declared positions when their health is
+	// forgotten.
+	now = now.Add(2 * mirrorHealthTTL)
+	expected = refs(
+		"slow.example.com/app",
+		"failing.example.com:5000/app",
+		"new.example.com/app",
+		"fast.example.com/app",
+		"source.example.com/app",
+	)
+	if got := order(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("got order %v, want %v", got, expected)
+	}
+	if status := h.status(); len(status) != 0 {
+		t.Errorf("got status %v for forgotten mirrors", status)
+	}
+}
+
+func TestMirrorHealthTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/unavailable":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := newMirrorHealth(registryconfig.MirrorOrderHealth)
+	c := &http.Client{Transport: h.Transport(http.DefaultTransport)}
+
+	// Missing content means that the registry is responsive.
+	resp, err := c.Get(server.URL + "/missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if s := h.status()[u.Host]; s.SuccessRate != 1 {
+		t.Errorf("got success rate %v after a missing blob, want 1", s.SuccessRate)
+	}
+
+	resp, err = c.Get(server.URL + "/unavailable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if s := h.status()[u.Host]; s.SuccessRate >= 1 {
+		t.Errorf("got success rate %v after a server error, want less than 1", s.SuccessRate)
+	}
+
+	if h := (*mirrorHealth)(nil); h.Transport(http.DefaultTransport) != http.DefaultTransport {
+		t.Errorf("expected the transport to be returned as is for the declared order")
+	}
+}
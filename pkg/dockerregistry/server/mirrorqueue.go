@@ -0,0 +1,254 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/opencontainers/go-digest"
+
+	registryconfig "github.com/openshift/image-registry/pkg/dockerregistry/server/configuration"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/maxconnections"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/metrics"
+)
+
+// mirrorJob is a blob that is mirrored in the background.
+type mirrorJob struct {
+	// ctx has only the logger of the request that pulled the blob.
+	ctx       context.Context
+	dgst      digest.Digest
+	namespace string
+	// size is the size of the blob, or -1 if it is unknown.
+	size int64
+
+	// mirror stores the blob in the local storage.
+	mirror func(ctx context.Context) error
+	// release is called once when the job is finished or dropped.
+	release func()
+
+	attempts int
+}
+
+// mirrorJobs are the queued jobs of one priority. The namespaces take turns,
+// so that a large import into one namespace doesn't delay the mirroring of
+// the others.
+type mirrorJobs struct {
+	jobs       map[string][]*mirrorJob
+	namespaces []string
+}
+
+func (j *mirrorJobs) push(job *mirrorJob) {
+	if j.jobs == nil {
+		j.jobs = make(map[string][]*mirrorJob)
+	}
+	if _, ok := j.jobs[job.namespace]; !ok {
+		j.namespaces = append(j.namespaces, job.namespace)
+	}
+	j.jobs[job.namespace] = append(j.jobs[job.namespace], job)
+}
+
+// pop returns the first job of the next namespace, or nil if there are no
+// jobs.
+func (j *mirrorJobs) pop() *mirrorJob {
+	if len(j.namespaces) == 0 {
+		return nil
+	}
+	namespace := j.namespaces[0]
+	j.namespaces = j.namespaces[1:]
+
+	jobs := j.jobs[namespace]
+	job := jobs[0]
+	if len(jobs) == 1 {
+		delete(j.jobs, namespace)
+	} else {
+		j.jobs[namespace] = jobs[1:]
+		j.namespaces = append(j.namespaces, namespace)
+	}
+	return job
+}
+
+// mirrorQueue mirrors the pulled blobs into the local storage by a fixed
+// number of workers. Without it every pulled blob would start its own
+// goroutine and connection to the remote registry, which exhausts the memory
+// and the upstream connections when many images are pulled at once. The
+// blobs up to the priority size, e.g. the image configs, are mirrored first,
+// as the images cannot be used without them.
+type mirrorQueue struct {
+	config       registryconfig.MirrorQueue
+	writeLimiter maxconnections.Limiter
+	metrics      metrics.MirrorQueue
+	afterFunc    func(d time.Duration, f func())
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	priority mirrorJobs
+	regular  mirrorJobs
+	// waiting is the number of the jobs that are queued or wait for a
+	// retry.
+	waiting int
+	stopped bool
+}
+
+func newMirrorQueue(config registryconfig.MirrorQueue, writeLimiter maxconnections.Limiter, m metrics.MirrorQueue) *mirrorQueue {
+	q := &mirrorQueue{
+		config:       config,
+		writeLimiter: writeLimiter,
+		metrics:      m,
+		afterFunc: func(d time.Duration, f func()) {
+			time.AfterFunc(d, f)
+		},
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// run starts the workers and blocks until ctx is done. The jobs that are
+// still queued are dropped.
+func (q *mirrorQueue) run(ctx context.Context) {
+	dcontext.GetLogger(ctx).Infof("starting %d workers of the mirroring queue", q.config.Workers)
+
+	var wg sync.WaitGroup
+	for i := 0; i < q.config.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := q.next(); job != nil; job = q.next() {
+				q.process(job)
+			}
+		}()
+	}
+
+	<-ctx.Done()
+
+	q.mu.Lock()
+	q.stopped = true
+	q.cond.Broadcast()
+	for job := q.popLocked(); job != nil; job = q.popLocked() {
+		job.release()
+	}
+	q.mu.Unlock()
+
+	wg.Wait()
+}
+
+// enqueue adds job to the queue. The job is dropped if the queue is full.
+func (q *mirrorQueue) enqueue(job *mirrorJob) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.stopped || q.waiting >= q.config.MaxQueued {
+		dcontext.GetLogger(job.ctx).Infof("Skipped background mirroring of %q because the mirroring queue is full", job.dgst)
+		q.metrics.Failed(metrics.MirrorFailureQueueFull)
+		job.release()
+		return
+	}
+	q.waiting++
+	q.pushLocked(job)
+}
+
+func (q *mirrorQueue) pushLocked(job *mirrorJob) {
+	if job.size >= 0 && job.size <= q.config.PrioritySize {
+		q.priority.push(job)
+	} else {
+		q.regular.push(job)
+	}
+	q.metrics.Queued(q.waiting)
+	q.cond.Signal()
+}
+
+func (q *mirrorQueue) popLocked() *mirrorJob {
+	job := q.priority.pop()
+	if job == nil {
+		job = q.regular.pop()
+	}
+	if job != nil {
+		q.waiting--
+		q.metrics.Queued(q.waiting)
+	}
+	return job
+}
+
+// next waits for a queued job. It returns nil when the queue is stopped.
+func (q *mirrorQueue) next() *mirrorJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for {
+		if q.stopped {
+			return nil
+		}
+		if job := q.popLocked(); job != nil {
+			return job
+		}
+		q.cond.Wait()
+	}
+}
+
+// process makes an attempt to mirror the blob of job and schedules a retry if
+// it fails.
+func (q *mirrorQueue) process(job *mirrorJob) {
+	ctx := job.ctx
+
+	if q.writeLimiter != nil {
+		if !q.writeLimiter.Start(ctx) {
+			dcontext.GetLogger(ctx).Infof("Skipped background mirroring of %q because write limits are reached", job.dgst)
+			q.metrics.Failed(metrics.MirrorFailureWriteLimit)
+			job.release()
+			return
+		}
+	}
+
+	job.attempts++
+	dcontext.GetLogger(ctx).Infof("Start background mirroring of %q", job.dgst)
+	err := job.mirror(ctx)
+
+	if q.writeLimiter != nil {
+		q.writeLimiter.Done()
+	}
+
+	if err == nil {
+		dcontext.GetLogger(ctx).Infof("Completed mirroring of %q", job.dgst)
+		job.release()
+		return
+	}
+	if job.attempts >= q.config.Attempts {
+		dcontext.GetLogger(ctx).Errorf("Background mirroring of %q failed after %d attempts: %v", job.dgst, job.attempts, err)
+		q.metrics.Failed(metrics.MirrorFailureFailed)
+		job.release()
+		return
+	}
+
+	delay := q.backoff(job.attempts)
+	dcontext.GetLogger(ctx).Warnf("Background mirroring of %q failed, retrying in %s: %v", job.dgst, delay, err)
+	q.metrics.Failed(metrics.MirrorFailureRetried)
+
+	q.mu.Lock()
+	q.waiting++
+	q.metrics.Queued(q.waiting)
+	q.mu.Unlock()
+
+	q.afterFunc(delay, func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+
+		if q.stopped {
+			q.waiting--
+			job.release()
+			return
+		}
+		q.pushLocked(job)
+	})
+}
+
+// backoff returns the delay before the retry that follows the attempt.
+func (q *mirrorQueue) backoff(attempt int) time.Duration {
+	delay := q.config.InitialBackoff
+	for i := 1; i < attempt && delay < q.config.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > q.config.MaxBackoff {
+		delay = q.config.MaxBackoff
+	}
+	return delay
+}
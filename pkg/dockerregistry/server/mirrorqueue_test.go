@@ -0,0 +1,203 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+
+	registryconfig "github.com/openshift/image-registry/pkg/dockerregistry/server/configuration"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/metrics"
+	metricstesting "github.com/openshift/image-registry/pkg/dockerregistry/server/metrics/testing"
+	"github.com/openshift/image-registry/pkg/testutil"
+	"github.com/openshift/image-registry/pkg/testutil/counter"
+)
+
+func newTestMirrorJob(ctx context.Context, name, namespace string, size int64, released map[string]int, mirror func(ctx context.Context) error) *mirrorJob {
+	return &mirrorJob{
+		ctx:       ctx,
+		dgst:      digest.FromString(name),
+		namespace: namespace,
+		size:      size,
+		mirror:    mirror,
+		release: func() {
+			released[name]++
+		},
+	}
+}
+
+func TestMirrorQueueOrder(t *testing.T) {
+	ctx := testutil.WithTestLogger(context.Background(), t)
+
+	c, sink := metricstesting.NewCounterSink()
+	q := newMirrorQueue(registryconfig.MirrorQueue{
+		Workers:      1,
+		MaxQueued:    5,
+		PrioritySize: 1024,
+	}, nil, metrics.NewMetrics(sink).MirrorQueue())
+
+	released := make(map[string]int)
+	for _, job := range []struct {
+		name      string
+		namespace string
+		size      int64
+	}{
+		{"a-layer-1", "a", 1 << 20},
+		{"a-layer-2", "a", 1 << 20},
+		{"a-layer-3", "a", -1},
+		{"b-layer-1", "b", 1 << 20},
+		{"a-config", "a", 512},
+		{"c-layer-1", "c", 1 << 20},
+	} {
+		q.enqueue(newTestMirrorJob(ctx, job.name, job.namespace, job.size, released, nil))
+	}
+
+	if released["c-layer-1"] != 1 {
+		t.Errorf("the job over the queue limit is not released")
+	}
+	if diff := c.Diff(counter.M{
+		"pullthrough_mirror_queued":                                     5,
+		"pullthrough_mirror_failures:" + metrics.MirrorFailureQueueFull: 1,
+	}); diff != nil {
+		t.Error(diff)
+	}
+
+	var order []digest.Digest
+	for i := 0; i < 5; i++ {
+		order = append(order, q.next().dgst)
+	}
+	expected := []digest.Digest{
+		digest.FromString("a-config"),
+		digest.FromString("a-layer-1"),
+		digest.FromString("b-layer-1"),
+		digest.FromString("a-layer-2"),
+		digest.FromString("a-layer-3"),
+	}
+	if fmt.Sprint(order) != fmt.Sprint(expected) {
+		t.Errorf("got order %v, want %v", order, expected)
+	}
+	if q.waiting != 0 || c.Values()["pullthrough_mirror_queued"] != 0 {
+		t.Errorf("got %d waiting jobs, want none", q.waiting)
+	}
+}
+
+func TestMirrorQueueRetries(t *testing.T) {
+	ctx := testutil.WithTestLogger(context.Background(), t)
+
+	c, sink := metricstesting.NewCounterSink()
+	q := newMirrorQueue(registryconfig.MirrorQueue{
+		Workers:        1,
+		MaxQueued:      10,
+		Attempts:       3,
+		InitialBackoff: time.Second,
+		MaxBackoff:     time.Minute,
+	}, nil, metrics.NewMetrics(sink).MirrorQueue())
+
+	var delays []time.Duration
+	q.afterFunc = func(d time.Duration, f func()) {
+		delays = append(delays, d)
+		f()
+	}
+
+	released := make(map[string]int)
+	attempts := 0
+	q.enqueue(newTestMirrorJob(ctx, "blob", "ns", 1<<20, released, func(ctx context.Context) error {
+		attempts++
+		return errors.New("connection reset")
+	}))
+	for i := 0; i < 3; i++ {
+		job := q.next()
+		if job == nil {
+			t.Fatalf("attempt %d: no job", i+1)
+		}
+		q.process(job)
+	}
+
+	if attempts != 3 {
+		t.Errorf("got %d attempts, want 3", attempts)
+	}
+	if released["blob"] != 1 {
+		t.Errorf("the job is released %d times, want 1", released["blob"])
+	}
+	if fmt.Sprint(delays) != fmt.Sprint([]time.Duration{time.Second, 2 * time.Second}) {
+		t.Errorf("got delays %v, want 1s and 2s", delays)
+	}
+	if diff := c.Diff(counter.M{
+		"pullthrough_mirror_failures:" + metrics.MirrorFailureRetried: 2,
+		"pullthrough_mirror_failures:" + metrics.MirrorFailureFailed:  1,
+	}); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestMirrorQueueBackoff(t *testing.T) {
+	q := newMirrorQueue(registryconfig.MirrorQueue{
+		InitialBackoff: time.Second,
+		MaxBackoff:     5 * time.Second,
+	}, nil, metrics.NewNoopMetrics().MirrorQueue())
+
+	for attempt, expected := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if delay := q.backoff(attempt + 1); delay != expected {
+			t.Errorf("attempt %d: got delay %s, want %s", attempt+1, delay, expected)
+		}
+	}
+}
+
+func TestMirrorQueueRun(t *testing.T) {
+	ctx := testutil.WithTestLogger(context.Background(), t)
+	ctx, cancel := context.WithCancel(ctx)
+
+	q := newMirrorQueue(registryconfig.MirrorQueue{
+		Workers:   2,
+		MaxQueued: 10,
+		Attempts:  1,
+	}, nil, metrics.NewNoopMetrics().MirrorQueue())
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		q.run(ctx)
+	}()
+
+	mirrored := make(chan string, 3)
+	done := make(chan string, 3)
+	for _, name := range []string{"first", "second", "third"} {
+		name := name
+		q.enqueue(&mirrorJob{
+			ctx:       ctx,
+			dgst:      digest.FromString(name),
+			namespace: "ns",
+			size:      -1,
+			mirror: func(ctx context.Context) error {
+				mirrored <- name
+				return nil
+			},
+			release: func() {
+				done <- name
+			},
+		})
+	}
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for the mirroring")
+		}
+	}
+	if len(mirrored) != 3 {
+		t.Errorf("got %d mirrored blobs, want 3", len(mirrored))
+	}
+
+	cancel()
+	<-stopped
+
+	released := make(map[string]int)
+	q.enqueue(newTestMirrorJob(ctx, "late", "ns", -1, released, nil))
+	if released["late"] != 1 {
+		t.Errorf("the job queued after the stop is not released")
+	}
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubecache "k8s.io/apimachinery/pkg/util/cache"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+)
+
+const (
+	namespacePhaseCacheSize = 1024
+	namespacePhaseCacheTTL  = time.Minute
+	// namespacePhaseErrorTTL is how long the namespaces that cannot be read
+	// are assumed to be active before they are read again.
+	namespacePhaseErrorTTL = 10 * time.Second
+)
+
+// namespacePhases caches the phases of namespaces, so that pushes to
+// terminating namespaces can be rejected before anything is uploaded.
+type namespacePhases struct {
+	cache *kubecache.LRUExpireCache
+}
+
+func newNamespacePhases() *namespacePhases {
+	return &namespacePhases{
+		cache: kubecache.NewLRUExpireCache(namespacePhaseCacheSize),
+	}
+}
+
+// IsTerminating returns true if the namespace is being deleted. If the phase
+// of the namespace cannot be determined, the namespace is assumed to be
+// active, so that the request fails later with a more specific error. The
+// failures are cached too, so that every push doesn't read the namespace when
+// the registry is not allowed to.
+func (p *namespacePhases) IsTerminating(ctx context.Context, c client.NamespacesGetter, namespace string) bool {
+	if phase, ok := p.cache.Get(namespace); ok {
+		return phase.(corev1.NamespacePhase) == corev1.NamespaceTerminating
+	}
+
+	ns, err := c.Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+	if err != nil {
+		if !kerrors.IsNotFound(err) {
+			dcontext.GetLogger(ctx).Warnf("unable to get the phase of namespace %s: %v", namespace, err)
+		}
+		p.cache.Add(namespace, corev1.NamespacePhase(""), namespacePhaseErrorTTL)
+		return false
+	}
+
+	p.cache.Add(namespace, ns.Status.Phase, namespacePhaseCacheTTL)
+	return ns.Status.Phase == corev1.NamespaceTerminating
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/distribution/distribution/v3/registry/auth"
+	"github.com/distribution/distribution/v3/registry/handlers"
+	gorillahandlers "github.com/gorilla/handlers"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	imageapiv1 "github.com/openshift/api/image/v1"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/api"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+)
+
+// namespaceRepository describes a repository in the response of the
+// namespace repositories endpoint.
+type namespaceRepository struct {
+	Name        string    `json:"name"`
+	Tags        int       `json:"tags"`
+	LastUpdated time.Time `json:"lastUpdated"`
+}
+
+// namespaceRepositoriesResponse is the response of the namespace
+// repositories endpoint.
+type namespaceRepositoriesResponse struct {
+	Namespace    string                `json:"namespace"`
+	Repositories []namespaceRepository `json:"repositories"`
+}
+
+func (app *App) registerNamespaceRepositoriesHandler(dockerApp *handlers.App, registryClient client.Interface) {
+	extensionsRouter := dockerApp.NewRoute().PathPrefix(api.ExtensionsPrefix).Subrouter()
+	listAccess := func(r *http.Request) []auth.Access {
+		return []auth.Access{
+			{
+				Resource: auth.Resource{
+					Type: "namespace",
+					Name: dcontext.GetStringValue(dcontext.WithVars(dockerApp, r), "vars.namespace"),
+				},
+				Action: "list",
+			},
+		}
+	}
+	dockerApp.RegisterRoute(
+		"extensions-namespace-repositories",
+		// GET /extensions/v2/namespaces/<namespace>/repositories
+		extensionsRouter.Path(api.NamespaceReposPath).Methods("GET"),
+		newNamespaceRepositoriesDispatcher(registryClient),
+		handlers.NameNotRequired,
+		listAccess,
+	)
+}
+
+// newNamespaceRepositoriesDispatcher returns a dispatcher that builds the
+// handler for the namespace repositories requests.
+func newNamespaceRepositoriesDispatcher(registryClient client.Interface) func(*handlers.Context, *http.Request) http.Handler {
+	return func(ctx *handlers.Context, r *http.Request) http.Handler {
+		namespaceRepositoriesHandler := &namespaceRepositoriesHandler{
+			Context: ctx,
+			Client:  registryClient,
+		}
+
+		return gorillahandlers.MethodHandler{
+			"GET": http.HandlerFunc(namespaceRepositoriesHandler.Get),
+		}
+	}
+}
+
+// namespaceRepositoriesHandler lists the repositories of a namespace.
+type namespaceRepositoriesHandler struct {
+	*handlers.Context
+
+	// Client is the registry client. It is used to list the image streams
+	// and to review the access of anonymous users.
+	Client client.Interface
+}
+
+// Get returns the image streams of the namespace that the user is allowed to
+// pull from. If the user can pull from every image stream of the namespace,
+// the access to the individual image streams is not reviewed.
+func (h *namespaceRepositoriesHandler) Get(w http.ResponseWriter, req *http.Request) {
+	namespace := dcontext.GetStringValue(h, "vars.namespace")
+
+	iss, err := h.Client.ImageStreams(namespace).List(h, metav1.ListOptions{})
+	if err != nil {
+		h.handleError(w, errcode.ErrorCodeUnknown.WithDetail(fmt.Sprintf("failed to list image streams: %v", err)))
+		return
+	}
+
+	allowed := func(name string) (bool, error) {
+		return true, nil
+	}
+	if userClient, ok := userClientFrom(h); ok {
+		err := verifyImageStreamAccess(h, namespace, "", "get", userClient, h.Client)
+		switch err {
+		case nil:
+		case ErrOpenShiftAccessDenied:
+			allowed = func(name string) (bool, error) {
+				switch err := verifyImageStreamAccess(h, namespace, name, "get", userClient, h.Client); err {
+				case nil:
+					return true, nil
+				case ErrOpenShiftAccessDenied:
+					return false, nil
+				default:
+					return false, err
+				}
+			}
+		default:
+			h.handleError(w, errcode.ErrorCodeUnknown.WithDetail(fmt.Sprintf("failed to review access: %v", err)))
+			return
+		}
+	}
+
+	resp := namespaceRepositoriesResponse{
+		Namespace:    namespace,
+		Repositories: []namespaceRepository{},
+	}
+	for i := range iss.Items {
+		is := &iss.Items[i]
+		ok, err := allowed(is.Name)
+		if err != nil {
+			h.handleError(w, errcode.ErrorCodeUnknown.WithDetail(fmt.Sprintf("failed to review access to %s/%s: %v", namespace, is.Name, err)))
+			return
+		}
+		if !ok {
+			continue
+		}
+		resp.Repositories = append(resp.Repositories, describeNamespaceRepository(is))
+	}
+	sort.Slice(resp.Repositories, func(i, j int) bool {
+		return resp.Repositories[i].Name < resp.Repositories[j].Name
+	})
+
+	data, err := json.Marshal(resp)
+	if err != nil {
+		h.handleError(w, errcode.ErrorCodeUnknown.WithDetail(fmt.Sprintf("failed to serialize repositories: %v", err)))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_, _ = w.Write(data)
+}
+
+func (h *namespaceRepositoriesHandler) handleError(w http.ResponseWriter, err error) {
+	if serveErr := errcode.ServeJSON(w, err); serveErr != nil {
+		dcontext.GetResponseLogger(h).Errorf("error sending error response: %v", serveErr)
+	}
+}
+
+// describeNamespaceRepository counts the tags of is that point to images and
+// finds the time of its latest tag update. The creation time of is is used if
+// it has no tags.
+func describeNamespaceRepository(is *imageapiv1.ImageStream) namespaceRepository {
+	repo := namespaceRepository{
+		Name:        fmt.Sprintf("%s/%s", is.Namespace, is.Name),
+		LastUpdated: is.CreationTimestamp.UTC(),
+	}
+	for _, tag := range is.Status.Tags {
+		if len(tag.Items) == 0 {
+			continue
+		}
+		repo.Tags++
+		if created := tag.Items[0].Created.UTC(); created.After(repo.LastUpdated) {
+			repo.LastUpdated = created
+		}
+	}
+	return repo
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/registry/handlers"
+	"github.com/gorilla/mux"
+	authorizationapi "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	core "k8s.io/client-go/testing"
+
+	imageapiv1 "github.com/openshift/api/image/v1"
+	imagefakeclient "github.com/openshift/client-go/image/clientset/versioned/typed/image/v1/fake"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+	"github.com/openshift/image-registry/pkg/testutil"
+)
+
+// accessReviewClient answers the self subject access reviews of the user.
+type accessReviewClient struct {
+	client.Interface
+	allowed func(attrs *authorizationapi.ResourceAttributes) bool
+}
+
+func (c *accessReviewClient) SelfSubjectAccessReviews() client.SelfSubjectAccessReviewInterface {
+	return c
+}
+
+func (c *accessReviewClient) Create(ctx context.Context, sar *authorizationapi.SelfSubjectAccessReview, opts metav1.CreateOptions) (*authorizationapi.SelfSubjectAccessReview, error) {
+	response := sar.DeepCopy()
+	response.Status.Allowed = c.allowed(sar.Spec.ResourceAttributes)
+	return response, nil
+}
+
+func TestNamespaceRepositoriesHandler(t *testing.T) {
+	ctx := testutil.WithTestLogger(context.Background(), t)
+
+	created := metav1.NewTime(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	tagged := metav1.NewTime(time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC))
+	retagged := metav1.NewTime(time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC))
+	imageStream := func(namespace, name string, tags ...imageapiv1.NamedTagEventList) imageapiv1.ImageStream {
+		return imageapiv1.ImageStream{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:         namespace,
+				Name:              name,
+				CreationTimestamp: created,
+			},
+			Status: imageapiv1.ImageStreamStatus{
+				Tags: tags,
+			},
+		}
+	}
+	imageStreams := []imageapiv1.ImageStream{
+		imageStream("ns", "app",
+			imageapiv1.NamedTagEventList{Tag: "latest", Items: []imageapiv1.TagEvent{{Created: retagged}, {Created: tagged}}},
+			imageapiv1.NamedTagEventList{Tag: "v1", Items: []imageapiv1.TagEvent{{Created: tagged}}},
+			imageapiv1.NamedTagEventList{Tag: "broken"},
+		),
+		imageStream("ns", "empty"),
+		imageStream("ns", "private"),
+		imageStream("other", "app"),
+	}
+	imageClient := &imagefakeclient.FakeImageV1{Fake: &core.Fake{}}
+	imageClient.AddReactor("list", "imagestreams", func(action core.Action) (bool, runtime.Object, error) {
+		list := &imageapiv1.ImageStreamList{}
+		for _, is := range imageStreams {
+			if is.Namespace == action.GetNamespace() {
+				list.Items = append(list.Items, is)
+			}
+		}
+		return true, list, nil
+	})
+	registryClient := client.NewFakeRegistryAPIClient(nil, imageClient)
+
+	for _, tc := range []struct {
+		name     string
+		allowed  func(attrs *authorizationapi.ResourceAttributes) bool
+		expected []namespaceRepository
+	}{
+		{
+			name: "namespace access",
+			allowed: func(attrs *authorizationapi.ResourceAttributes) bool {
+				return attrs.Namespace == "ns"
+			},
+			expected: []namespaceRepository{
+				{Name: "ns/app", Tags: 2, LastUpdated: retagged.UTC()},
+				{Name: "ns/empty", LastUpdated: created.UTC()},
+				{Name: "ns/private", LastUpdated: created.UTC()},
+			},
+		},
+		{
+			name: "image stream access",
+			allowed: func(attrs *authorizationapi.ResourceAttributes) bool {
+				return attrs.Namespace == "ns" && (attrs.Name == "app" || attrs.Name == "empty")
+			},
+			expected: []namespaceRepository{
+				{Name: "ns/app", Tags: 2, LastUpdated: retagged.UTC()},
+				{Name: "ns/empty", LastUpdated: created.UTC()},
+			},
+		},
+		{
+			name: "no access",
+			allowed: func(attrs *authorizationapi.ResourceAttributes) bool {
+				return false
+			},
+			expected: []namespaceRepository{},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			userClient := &accessReviewClient{
+				Interface: registryClient,
+				allowed:   tc.allowed,
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/extensions/v2/namespaces/ns/repositories", nil)
+			req = mux.SetURLVars(req, map[string]string{"namespace": "ns"})
+			h := &namespaceRepositoriesHandler{
+				Context: &handlers.Context{
+					Context: withUserClient(dcontext.WithVars(ctx, req), userClient),
+				},
+				Client: registryClient,
+			}
+
+			w := httptest.NewRecorder()
+			h.Get(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+			}
+
+			var resp namespaceRepositoriesResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Namespace != "ns" || resp.Repositories == nil {
+				t.Errorf("unexpected response: %s", w.Body.String())
+			}
+			if len(resp.Repositories) != len(tc.expected) {
+				t.Fatalf("got repositories %+v, want %+v", resp.Repositories, tc.expected)
+			}
+			for i, repo := range resp.Repositories {
+				expected := tc.expected[i]
+				if repo.Name != expected.Name || repo.Tags != expected.Tags || !repo.LastUpdated.Equal(expected.LastUpdated) {
+					t.Errorf("got repository %+v, want %+v", repo, expected)
+				}
+			}
+		})
+	}
+}
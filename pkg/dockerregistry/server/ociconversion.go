@@ -0,0 +1,419 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/manifest"
+	"github.com/distribution/distribution/v3/manifest/manifestlist"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/distribution/v3/manifest/schema2"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	regapi "github.com/distribution/distribution/v3/registry/api/v2"
+	"github.com/gorilla/mux"
+	"github.com/opencontainers/go-digest"
+	ociv1 "github.com/opencontainers/image-spec/specs-go/v1"
+	kubecache "k8s.io/apimachinery/pkg/util/cache"
+)
+
+const (
+	ociConversionCacheSize = 4096
+	ociConversionCacheTTL  = 24 * time.Hour
+	// ociConversionUnknownTTL is how long the digests that are not found
+	// among the conversions of the tagged manifests of a repository are not
+	// searched again.
+	ociConversionUnknownTTL = time.Minute
+)
+
+// ociMediaTypes maps the media types of Docker schema 2 descriptors to their
+// OCI equivalents.
+var ociMediaTypes = map[string]string{
+	schema2.MediaTypeManifest:          ociv1.MediaTypeImageManifest,
+	manifestlist.MediaTypeManifestList: ociv1.MediaTypeImageIndex,
+	schema2.MediaTypeImageConfig:       ociv1.MediaTypeImageConfig,
+	schema2.MediaTypeLayer:             ociv1.MediaTypeImageLayerGzip,
+	schema2.MediaTypeForeignLayer:      ociv1.MediaTypeImageLayerNonDistributableGzip, //nolint:staticcheck
+}
+
+// ociConversions remembers the manifests that were converted to OCI media
+// types. The digests of the converted manifests are not known to the storage
+// and the conversions are remembered only by the replica that made them. The
+// conversion is deterministic, so other replicas find the converted manifests
+// by converting the tagged manifests of the repository again.
+type ociConversions struct {
+	// manifests maps digests of the original manifests to the converted
+	// manifests.
+	manifests *kubecache.LRUExpireCache
+	// originals maps digests of the converted manifests to the digests of
+	// the original manifests.
+	originals *kubecache.LRUExpireCache
+	// unknown remembers the repositories and the digests that aren't
+	// conversions of the tagged manifests of the repositories.
+	unknown *kubecache.LRUExpireCache
+}
+
+func newOCIConversions() *ociConversions {
+	return &ociConversions{
+		manifests: kubecache.NewLRUExpireCache(ociConversionCacheSize),
+		originals: kubecache.NewLRUExpireCache(ociConversionCacheSize),
+		unknown:   kubecache.NewLRUExpireCache(ociConversionCacheSize),
+	}
+}
+
+func (c *ociConversions) add(original digest.Digest, converted distribution.Manifest) (digest.Digest, error) {
+	_, payload, err := converted.Payload()
+	if err != nil {
+		return "", err
+	}
+	dgst := digest.FromBytes(payload)
+	c.manifests.Add(original, converted, ociConversionCacheTTL)
+	c.originals.Add(dgst, original, ociConversionCacheTTL)
+	return dgst, nil
+}
+
+func (c *ociConversions) manifest(original digest.Digest) (distribution.Manifest, bool) {
+	m, ok := c.manifests.Get(original)
+	if !ok {
+		return nil, false
+	}
+	return m.(distribution.Manifest), true
+}
+
+func (c *ociConversions) original(converted digest.Digest) (digest.Digest, bool) {
+	dgst, ok := c.originals.Get(converted)
+	if !ok {
+		return "", false
+	}
+	return dgst.(digest.Digest), true
+}
+
+// ociConversion is the result of the conversion of the manifest for the
+// current request.
+type ociConversion struct {
+	// digest is the digest of the served manifest.
+	digest digest.Digest
+
+	// notAcceptable is the error that is sent instead of the response of
+	// distribution if the client doesn't accept the manifest.
+	notAcceptable error
+}
+
+// ociConversionHandler prepares manifest requests for the conversion of Docker
+// schema 2 manifests to OCI media types. Distribution responds with the digest
+// of the stored manifest, so the digest headers are replaced by the digest of
+// the served manifest.
+type ociConversionHandler struct {
+	router  *mux.Router
+	handler http.Handler
+}
+
+func newOCIConversionHandler(prefix string, handler http.Handler) http.Handler {
+	return &ociConversionHandler{
+		router:  regapi.RouterWithPrefix(prefix),
+		handler: handler,
+	}
+}
+
+func (h *ociConversionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var match mux.RouteMatch
+	if (r.Method != http.MethodGet && r.Method != http.MethodHead) || !h.router.Match(r, &match) || match.Route.GetName() != regapi.RouteNameManifest {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+
+	conversion := &ociConversion{}
+	r = r.WithContext(withOCIConversion(r.Context(), conversion))
+	h.handler.ServeHTTP(&ociConversionResponseWriter{ResponseWriter: w, conversion: conversion}, r)
+}
+
+// ociConversionResponseWriter sets the digest headers to the digest of the
+// converted manifest. If the manifest is not acceptable, the not found
+// response of distribution is replaced by the negotiation error.
+type ociConversionResponseWriter struct {
+	http.ResponseWriter
+
+	conversion  *ociConversion
+	wroteHeader bool
+	discard     bool
+}
+
+func (w *ociConversionResponseWriter) WriteHeader(statusCode int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if statusCode == http.StatusNotFound && w.conversion.notAcceptable != nil {
+			w.discard = true
+			_ = errcode.ServeJSON(w.ResponseWriter, w.conversion.notAcceptable)
+			return
+		}
+		if statusCode == http.StatusOK && w.conversion.digest != "" {
+			w.Header().Set("Docker-Content-Digest", w.conversion.digest.String())
+			w.Header().Set("Etag", fmt.Sprintf(`"%s"`, w.conversion.digest))
+		}
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *ociConversionResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.discard {
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// ociConvertingManifestService serves Docker schema 2 manifests and manifest
+// lists with OCI media types to clients that accept only OCI manifests. It is
+// used when openshift.compatibility.serveoci is set.
+//
+// Like the conversion to schema 1 in distribution, manifests are converted
+// only when they are fetched by tag, as a manifest fetched by digest has to
+// match the digest. The converted manifests can be fetched by their own
+// digests.
+type ociConvertingManifestService struct {
+	distribution.ManifestService
+
+	// tags are the tags of the repository, their manifests are converted to
+	// find the converted manifests that were served by other replicas. The
+	// manifests are not searched for if it's nil.
+	tags        distribution.TagService
+	conversions *ociConversions
+}
+
+var _ distribution.ManifestService = &ociConvertingManifestService{}
+
+func (m *ociConvertingManifestService) Get(ctx context.Context, dgst digest.Digest, options ...distribution.ManifestServiceOption) (distribution.Manifest, error) {
+	conversion := ociConversionFrom(ctx)
+	if conversion == nil {
+		return m.ManifestService.Get(ctx, dgst, options...)
+	}
+
+	if original, ok := m.conversions.original(dgst); ok {
+		return m.getConverted(ctx, conversion, original, dgst, options...)
+	}
+
+	manifest, err := m.ManifestService.Get(ctx, dgst, options...)
+	if err != nil {
+		var unknown distribution.ErrManifestUnknownRevision
+		if !errors.As(err, &unknown) {
+			return manifest, err
+		}
+		original, ok := m.findOriginal(ctx, dgst)
+		if !ok {
+			return manifest, err
+		}
+		return m.getConverted(ctx, conversion, original, dgst, options...)
+	}
+
+	if _, err := digest.Parse(dcontext.GetStringValue(ctx, "vars.reference")); err == nil {
+		return manifest, nil
+	}
+
+	req, err := dcontext.GetRequest(ctx)
+	if err != nil || !acceptsOnlyOCI(req, manifest) {
+		return manifest, nil
+	}
+
+	converted, convertedDigest, err := m.convert(ctx, dgst, manifest)
+	if err != nil {
+		return nil, err
+	}
+	if converted == nil {
+		return manifest, nil
+	}
+
+	dcontext.GetLogger(ctx).Debugf("serving manifest %s with OCI media types as %s", dgst, convertedDigest)
+	conversion.digest = convertedDigest
+	return converted, nil
+}
+
+// getConverted returns the manifest original converted to OCI media types if
+// the digest of the converted manifest is dgst.
+func (m *ociConvertingManifestService) getConverted(ctx context.Context, conversion *ociConversion, original, dgst digest.Digest, options ...distribution.ManifestServiceOption) (distribution.Manifest, error) {
+	manifest, err := m.ManifestService.Get(ctx, original, options...)
+	if err != nil {
+		return nil, err
+	}
+	converted, convertedDigest, err := m.convert(ctx, original, manifest)
+	if err != nil {
+		return nil, err
+	}
+	if converted != nil && convertedDigest == dgst {
+		conversion.digest = convertedDigest
+		return converted, nil
+	}
+	return nil, distribution.ErrManifestUnknownRevision{
+		Name:     dcontext.GetStringValue(ctx, "vars.name"),
+		Revision: dgst,
+	}
+}
+
+// findOriginal converts the manifests of the tags of the repository to find
+// the original of the converted manifest dgst. The client may have got the
+// digest from another replica, which doesn't share its conversions.
+func (m *ociConvertingManifestService) findOriginal(ctx context.Context, dgst digest.Digest) (digest.Digest, bool) {
+	if m.tags == nil {
+		return "", false
+	}
+
+	key := dcontext.GetStringValue(ctx, "vars.name") + "@" + dgst.String()
+	if _, ok := m.conversions.unknown.Get(key); ok {
+		return "", false
+	}
+
+	tags, err := m.tags.All(ctx)
+	if err != nil {
+		dcontext.GetLogger(ctx).Debugf("unable to list the tags to find the converted manifest %s: %v", dgst, err)
+		return "", false
+	}
+	for _, tag := range tags {
+		desc, err := m.tags.Get(ctx, tag)
+		if err != nil {
+			continue
+		}
+		manifest, err := m.ManifestService.Get(ctx, desc.Digest)
+		if err != nil {
+			continue
+		}
+		if _, _, err := m.convert(ctx, desc.Digest, manifest); err != nil {
+			dcontext.GetLogger(ctx).Debugf("unable to convert the manifest %s of the tag %s: %v", desc.Digest, tag, err)
+			continue
+		}
+		// The manifests of the converted lists are converted too.
+		if original, ok := m.conversions.original(dgst); ok {
+			return original, true
+		}
+	}
+
+	m.conversions.unknown.Add(key, struct{}{}, ociConversionUnknownTTL)
+	return "", false
+}
+
+// convert returns the manifest dgst with OCI media types and its digest. It
+// returns a nil manifest if the manifest doesn't need to be converted.
+func (m *ociConvertingManifestService) convert(ctx context.Context, dgst digest.Digest, manifest distribution.Manifest) (distribution.Manifest, digest.Digest, error) {
+	if converted, ok := m.conversions.manifest(dgst); ok {
+		_, payload, err := converted.Payload()
+		if err != nil {
+			return nil, "", err
+		}
+		return converted, digest.FromBytes(payload), nil
+	}
+
+	var converted distribution.Manifest
+	var err error
+	switch manifest := manifest.(type) {
+	case *schema2.DeserializedManifest:
+		converted, err = convertSchema2ToOCI(manifest)
+	case *manifestlist.DeserializedManifestList:
+		if manifest.MediaType != manifestlist.MediaTypeManifestList {
+			return nil, "", nil
+		}
+		converted, err = m.convertManifestListToOCI(ctx, manifest)
+	default:
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to convert manifest %s to OCI media types: %w", dgst, err)
+	}
+
+	convertedDigest, err := m.conversions.add(dgst, converted)
+	if err != nil {
+		return nil, "", err
+	}
+	return converted, convertedDigest, nil
+}
+
+// convertManifestListToOCI returns an OCI image index with the manifests of
+// the list converted to OCI media types.
+func (m *ociConvertingManifestService) convertManifestListToOCI(ctx context.Context, list *manifestlist.DeserializedManifestList) (distribution.Manifest, error) {
+	descriptors := make([]manifestlist.ManifestDescriptor, len(list.Manifests))
+	for i, desc := range list.Manifests {
+		descriptors[i] = desc
+		if desc.MediaType != schema2.MediaTypeManifest {
+			continue
+		}
+
+		manifest, err := m.ManifestService.Get(ctx, desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+		converted, convertedDigest, err := m.convert(ctx, desc.Digest, manifest)
+		if err != nil {
+			return nil, err
+		}
+		if converted == nil {
+			continue
+		}
+		mediaType, payload, err := converted.Payload()
+		if err != nil {
+			return nil, err
+		}
+		descriptors[i].MediaType = mediaType
+		descriptors[i].Digest = convertedDigest
+		descriptors[i].Size = int64(len(payload))
+	}
+	return manifestlist.FromDescriptorsWithMediaType(descriptors, ociv1.MediaTypeImageIndex)
+}
+
+// convertSchema2ToOCI returns the schema 2 manifest with OCI media types.
+func convertSchema2ToOCI(m *schema2.DeserializedManifest) (*ocischema.DeserializedManifest, error) {
+	layers := make([]distribution.Descriptor, len(m.Layers))
+	for i, layer := range m.Layers {
+		layers[i] = ociDescriptor(layer)
+	}
+	return ocischema.FromStruct(ocischema.Manifest{
+		Versioned: manifest.Versioned{
+			SchemaVersion: 2,
+			MediaType:     ociv1.MediaTypeImageManifest,
+		},
+		Config: ociDescriptor(m.Config),
+		Layers: layers,
+	})
+}
+
+// ociDescriptor returns desc with the OCI equivalent of its media type.
+func ociDescriptor(desc distribution.Descriptor) distribution.Descriptor {
+	if mediaType, ok := ociMediaTypes[desc.MediaType]; ok {
+		desc.MediaType = mediaType
+	}
+	return desc
+}
+
+// acceptsOnlyOCI reports whether req has Accept headers that allow the OCI
+// equivalent of the manifest, but not the manifest itself.
+func acceptsOnlyOCI(req *http.Request, m distribution.Manifest) bool {
+	mediaType, _, err := m.Payload()
+	if err != nil {
+		return false
+	}
+	ociMediaType, ok := ociMediaTypes[mediaType]
+	if !ok {
+		return false
+	}
+
+	acceptsOCI := false
+	for _, accept := range req.Header.Values("Accept") {
+		for _, accepted := range strings.Split(accept, ",") {
+			accepted, _, err := mime.ParseMediaType(accepted)
+			if err != nil {
+				continue
+			}
+			switch accepted {
+			case mediaType:
+				return false
+			case ociMediaType:
+				acceptsOCI = true
+			}
+		}
+	}
+	return acceptsOCI
+}
@@ -0,0 +1,227 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/manifest/manifestlist"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/distribution/v3/manifest/schema2"
+	"github.com/gorilla/mux"
+	"github.com/opencontainers/go-digest"
+	ociv1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/openshift/image-registry/pkg/testutil"
+)
+
+func TestOCIConvertingManifestServiceGet(t *testing.T) {
+	manifest, err := schema2.FromStruct(schema2.Manifest{
+		Versioned: schema2.SchemaVersion,
+		Config:    distribution.Descriptor{Digest: "sha256:bef57ec7f53a6d40beb640a780a639c83bc29ac8a9816f1fc6c5c6dcd93c4721", Size: 2, MediaType: schema2.MediaTypeImageConfig},
+		Layers: []distribution.Descriptor{
+			{Digest: "sha256:3a1ba8f5a7ed0c5f4586f4b6a3c0e3a1cd3f905f4bd6f681758bb3ce86ffd0ab", Size: 10, MediaType: schema2.MediaTypeLayer},
+			{Digest: "sha256:cb4c6ae17e2e0d0221fdd5ac3d0e6c6c9bc21f9158863fd0d63a7163c73e0637", Size: 20, MediaType: schema2.MediaTypeForeignLayer},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, payload, err := manifest.Payload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dgst := digest.FromBytes(payload)
+
+	list, err := manifestlist.FromDescriptors([]manifestlist.ManifestDescriptor{{
+		Descriptor: distribution.Descriptor{Digest: dgst, Size: int64(len(payload)), MediaType: schema2.MediaTypeManifest},
+		Platform:   manifestlist.PlatformSpec{Architecture: "amd64", OS: "linux"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, listPayload, err := list.Payload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listDigest := digest.FromBytes(listPayload)
+
+	conversions := newOCIConversions()
+	ms := &ociConvertingManifestService{
+		ManifestService: testutil.NewFakeManifestService("user/app", map[digest.Digest]distribution.Manifest{
+			dgst:       manifest,
+			listDigest: list,
+		}),
+		conversions: conversions,
+	}
+
+	get := func(reference string, dgst digest.Digest, accept ...string) (distribution.Manifest, *ociConversion, error) {
+		ctx := context.Background()
+		ctx = testutil.WithTestLogger(ctx, t)
+
+		req := httptest.NewRequest(http.MethodGet, "/v2/user/app/manifests/"+reference, nil)
+		for _, a := range accept {
+			req.Header.Add("Accept", a)
+		}
+		req = mux.SetURLVars(req, map[string]string{"name": "user/app", "reference": reference})
+		conversion := &ociConversion{}
+		ctx = withOCIConversion(ctx, conversion)
+		ctx = dcontext.WithRequest(ctx, req)
+		ctx = dcontext.WithVars(ctx, req)
+
+		m, err := ms.Get(ctx, dgst)
+		return m, conversion, err
+	}
+
+	// Clients that accept Docker schema 2 get the stored manifest.
+	m, conversion, err := get("latest", dgst, schema2.MediaTypeManifest+", "+ociv1.MediaTypeImageManifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.(*schema2.DeserializedManifest); !ok || conversion.digest != "" {
+		t.Fatalf("expected the schema 2 manifest, got %T (digest %q)", m, conversion.digest)
+	}
+
+	// Manifests fetched by digest are not converted.
+	m, conversion, err = get(dgst.String(), dgst, ociv1.MediaTypeImageManifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.(*schema2.DeserializedManifest); !ok || conversion.digest != "" {
+		t.Fatalf("expected the schema 2 manifest, got %T (digest %q)", m, conversion.digest)
+	}
+
+	m, conversion, err = get("latest", dgst, ociv1.MediaTypeImageManifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	converted, ok := m.(*ocischema.DeserializedManifest)
+	if !ok {
+		t.Fatalf("expected an OCI manifest, got %T", m)
+	}
+	mediaType, convertedPayload, err := converted.Payload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaType != ociv1.MediaTypeImageManifest {
+		t.Errorf("got media type %q, want %q", mediaType, ociv1.MediaTypeImageManifest)
+	}
+	if conversion.digest != digest.FromBytes(convertedPayload) {
+		t.Errorf("got digest %q, want the digest of the converted manifest %q", conversion.digest, digest.FromBytes(convertedPayload))
+	}
+	if converted.Config.MediaType != ociv1.MediaTypeImageConfig || converted.Config.Digest != "sha256:bef57ec7f53a6d40beb640a780a639c83bc29ac8a9816f1fc6c5c6dcd93c4721" {
+		t.Errorf("unexpected config %#+v", converted.Config)
+	}
+	for i, expected := range []string{ociv1.MediaTypeImageLayerGzip, ociv1.MediaTypeImageLayerNonDistributableGzip} { //nolint:staticcheck
+		if converted.Layers[i].MediaType != expected || converted.Layers[i].Digest != manifest.Layers[i].Digest {
+			t.Errorf("layer %d: got %#+v, want media type %q", i, converted.Layers[i], expected)
+		}
+	}
+	convertedDigest := conversion.digest
+
+	// The converted manifest is stable and can be fetched by its digest.
+	m, conversion, err = get(convertedDigest.String(), convertedDigest, ociv1.MediaTypeImageManifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, p, _ := m.Payload(); digest.FromBytes(p) != convertedDigest || conversion.digest != convertedDigest {
+		t.Errorf("got manifest %s (digest %q), want %s", digest.FromBytes(p), conversion.digest, convertedDigest)
+	}
+
+	// The manifests of lists are converted too.
+	m, conversion, err = get("latest", listDigest, ociv1.MediaTypeImageIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, ok := m.(*manifestlist.DeserializedManifestList)
+	if !ok || index.MediaType != ociv1.MediaTypeImageIndex {
+		t.Fatalf("expected an OCI index, got %T", m)
+	}
+	if _, p, _ := index.Payload(); conversion.digest != digest.FromBytes(p) {
+		t.Errorf("got digest %q, want the digest of the converted index %q", conversion.digest, digest.FromBytes(p))
+	}
+	if desc := index.Manifests[0]; desc.MediaType != ociv1.MediaTypeImageManifest || desc.Digest != convertedDigest || desc.Size != int64(len(convertedPayload)) {
+		t.Errorf("unexpected index entry %#+v", desc)
+	}
+
+	// Another replica doesn't know the conversions, it finds the converted
+	// manifests among the conversions of the tagged manifests.
+	tags := newTestTagService(map[string]distribution.Descriptor{
+		"latest": {Digest: listDigest, MediaType: manifestlist.MediaTypeManifestList},
+	})
+	ms = &ociConvertingManifestService{
+		ManifestService: ms.ManifestService,
+		tags:            tags,
+		conversions:     newOCIConversions(),
+	}
+	m, conversion, err = get(convertedDigest.String(), convertedDigest, ociv1.MediaTypeImageManifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, p, _ := m.Payload(); digest.FromBytes(p) != convertedDigest || conversion.digest != convertedDigest {
+		t.Errorf("got manifest %s (digest %q) from another replica, want %s", digest.FromBytes(p), conversion.digest, convertedDigest)
+	}
+
+	// The digests that are not conversions are not searched for again.
+	for i := 0; i < 2; i++ {
+		if _, _, err := get(unknownBlobDigest, unknownBlobDigest, ociv1.MediaTypeImageManifest); err == nil {
+			t.Fatalf("expected an error for the unknown manifest")
+		}
+	}
+	if n := tags.calls["All"]; n != 2 {
+		t.Errorf("got %d tag listings, want 2", n)
+	}
+}
+
+func TestOCIConversionHandler(t *testing.T) {
+	convertedDigest := digest.FromString("converted")
+
+	for _, tc := range []struct {
+		name       string
+		convert    bool
+		statusCode int
+		expected   string
+	}{
+		{
+			name:       "stored manifest",
+			statusCode: http.StatusOK,
+			expected:   "sha256:stored",
+		},
+		{
+			name:       "converted manifest",
+			convert:    true,
+			statusCode: http.StatusOK,
+			expected:   convertedDigest.String(),
+		},
+		{
+			name:       "not modified",
+			statusCode: http.StatusNotModified,
+			expected:   "sha256:stored",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newOCIConversionHandler("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				conversion := ociConversionFrom(r.Context())
+				if conversion == nil {
+					t.Fatal("expected a conversion in the context")
+				}
+				if tc.convert {
+					conversion.digest = convertedDigest
+				}
+				w.Header().Set("Docker-Content-Digest", "sha256:stored")
+				w.WriteHeader(tc.statusCode)
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/v2/user/app/manifests/latest", nil)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			if got := w.Header().Get("Docker-Content-Digest"); got != tc.expected {
+				t.Errorf("got Docker-Content-Digest %q, want %q", got, tc.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	regapi "github.com/distribution/distribution/v3/registry/api/v2"
+	"github.com/gorilla/mux"
+
+	rerrors "github.com/openshift/image-registry/pkg/errors"
+)
+
+// ociErrorCodes maps error codes that are not defined by the OCI distribution
+// specification to the closest codes from the specification.
+var ociErrorCodes = map[string]string{
+	rerrors.ErrorCodePullthroughManifest.String():        regapi.ErrorCodeManifestUnknown.String(),
+	rerrors.ErrorCodePullthroughRegistryBlocked.String(): errcode.ErrorCodeDenied.String(),
+	ErrorCodeManifestTooLarge.String():                   regapi.ErrorCodeManifestInvalid.String(),
+	ErrorCodeManifestTooManyLayers.String():              regapi.ErrorCodeManifestInvalid.String(),
+	ErrorCodeManifestMediaTypeBlocked.String():           regapi.ErrorCodeManifestInvalid.String(),
+	ErrorCodeManifestForeignLayer.String():               regapi.ErrorCodeManifestInvalid.String(),
+	ErrorCodeForeignLayerUnavailable.String():            regapi.ErrorCodeManifestBlobUnknown.String(),
+	ErrorCodeManifestSchema1Disabled.String():            errcode.ErrorCodeUnsupported.String(),
+	ErrorCodeManifestNotAcceptable.String():              regapi.ErrorCodeManifestUnknown.String(),
+	ErrorCodeSignaturePolicyViolation.String():           errcode.ErrorCodeDenied.String(),
+	ErrorCodeStorageLimitExceeded.String():               errcode.ErrorCodeDenied.String(),
+	regapi.ErrorCodeTagInvalid.String():                  regapi.ErrorCodeManifestInvalid.String(),
+	regapi.ErrorCodeManifestUnverified.String():          regapi.ErrorCodeManifestInvalid.String(),
+	regapi.ErrorCodeRangeInvalid.String():                regapi.ErrorCodeBlobUploadInvalid.String(),
+	regapi.ErrorCodePaginationNumberInvalid.String():     errcode.ErrorCodeUnsupported.String(),
+}
+
+// ociError is an error in the error envelope of the OCI distribution
+// specification.
+type ociError struct {
+	Code    string          `json:"code"`
+	Message string          `json:"message"`
+	Detail  json.RawMessage `json:"detail,omitempty"`
+}
+
+// ociErrorHandler rewrites the error responses of the distribution API, so
+// that they contain only error codes from the OCI distribution specification.
+// Docker clients show the message of the error, so they are not affected.
+type ociErrorHandler struct {
+	router  *mux.Router
+	handler http.Handler
+}
+
+func newOCIErrorHandler(prefix string, handler http.Handler) http.Handler {
+	return &ociErrorHandler{
+		router:  regapi.RouterWithPrefix(prefix),
+		handler: handler,
+	}
+}
+
+func (h *ociErrorHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodHead {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+
+	// The error codes of the extension endpoints are not translated, but
+	// their errors still get the correlation ID of the request.
+	var match mux.RouteMatch
+	var codes map[string]string
+	if h.router.Match(r, &match) {
+		codes = ociErrorCodes
+	}
+	requestID := requestIDFrom(r.Context())
+	if codes == nil && requestID == "" {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+
+	ew := &ociErrorResponseWriter{
+		ResponseWriter: w,
+		codes:          codes,
+		requestID:      requestID,
+	}
+	h.handler.ServeHTTP(ew, r)
+	ew.flushError()
+}
+
+// ociErrorResponseWriter buffers JSON error responses until they are
+// translated by flushError.
+type ociErrorResponseWriter struct {
+	http.ResponseWriter
+
+	codes     map[string]string
+	requestID string
+
+	statusCode int
+	buf        *bytes.Buffer
+}
+
+func (w *ociErrorResponseWriter) WriteHeader(statusCode int) {
+	if w.statusCode != 0 {
+		return
+	}
+	w.statusCode = statusCode
+
+	if statusCode >= 400 && strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+		w.buf = &bytes.Buffer{}
+		return
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *ociErrorResponseWriter) Write(p []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.buf != nil {
+		return w.buf.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// flushError writes the buffered error response with the error codes
+// translated and the correlation ID of the request added to the details.
+func (w *ociErrorResponseWriter) flushError() {
+	if w.buf == nil {
+		return
+	}
+
+	body := w.buf.Bytes()
+	if translated, ok := translateOCIErrors(body, w.codes, w.requestID); ok {
+		body = translated
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	}
+
+	w.ResponseWriter.WriteHeader(w.statusCode)
+	_, _ = w.ResponseWriter.Write(body)
+}
+
+// translateOCIErrors returns the error envelope body with the error codes
+// replaced according to codes and with requestID added to the details of the
+// errors. It returns false if body is not an error envelope or if it has
+// nothing to change.
+func translateOCIErrors(body []byte, codes map[string]string, requestID string) ([]byte, bool) {
+	var envelope struct {
+		Errors []ociError `json:"errors"`
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil || len(envelope.Errors) == 0 {
+		return nil, false
+	}
+
+	translated := false
+	for i, e := range envelope.Errors {
+		if code, ok := codes[e.Code]; ok {
+			envelope.Errors[i].Code = code
+			translated = true
+		}
+		if requestID != "" {
+			if detail, ok := withRequestIDDetail(e.Detail, requestID); ok {
+				envelope.Errors[i].Detail = detail
+				translated = true
+			}
+		}
+	}
+	if !translated {
+		return nil, false
+	}
+
+	buf, err := json.Marshal(envelope)
+	if err != nil {
+		return nil, false
+	}
+	return append(buf, '\n'), true
+}
+
+// withRequestIDDetail returns the error detail with the requestID field. Only
+// empty details and JSON objects can be extended, other details are kept
+// as they are.
+func withRequestIDDetail(detail json.RawMessage, requestID string) (json.RawMessage, bool) {
+	fields := map[string]json.RawMessage{}
+	if len(detail) > 0 && string(detail) != "null" {
+		if err := json.Unmarshal(detail, &fields); err != nil {
+			return nil, false
+		}
+	}
+
+	id, err := json.Marshal(requestID)
+	if err != nil {
+		return nil, false
+	}
+	fields["requestID"] = id
+
+	buf, err := json.Marshal(fields)
+	if err != nil {
+		return nil, false
+	}
+	return buf, true
+}
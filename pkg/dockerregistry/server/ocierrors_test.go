@@ -0,0 +1,92 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	regapi "github.com/distribution/distribution/v3/registry/api/v2"
+
+	rerrors "github.com/openshift/image-registry/pkg/errors"
+)
+
+func TestOCIErrorHandler(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		path       string
+		err        error
+		wantStatus int
+		wantCode   string
+	}{
+		{
+			name:       "schema 1 disabled",
+			path:       "/v2/ns/is/manifests/latest",
+			err:        ErrorCodeManifestSchema1Disabled,
+			wantStatus: http.StatusBadRequest,
+			wantCode:   "UNSUPPORTED",
+		},
+		{
+			name:       "pullthrough",
+			path:       "/v2/ns/is/manifests/latest",
+			err:        errcode.Errors{rerrors.ErrorCodePullthroughManifest.WithArgs("ns/is:latest", "not found")},
+			wantStatus: http.StatusNotFound,
+			wantCode:   "MANIFEST_UNKNOWN",
+		},
+		{
+			name:       "tag invalid",
+			path:       "/v2/ns/is/manifests/latest",
+			err:        regapi.ErrorCodeTagInvalid.WithDetail("tag mismatch"),
+			wantStatus: http.StatusBadRequest,
+			wantCode:   "MANIFEST_INVALID",
+		},
+		{
+			name:       "spec error code",
+			path:       "/v2/ns/is/blobs/sha256:4355a46b19d348dc2f57c046f8ef63d4538ebb936000f3c9ee954a27460dd865",
+			err:        regapi.ErrorCodeBlobUnknown,
+			wantStatus: http.StatusNotFound,
+			wantCode:   "BLOB_UNKNOWN",
+		},
+		{
+			name:       "extension endpoint",
+			path:       "/extensions/v2/ns/is/signatures/sha256:4355a46b19d348dc2f57c046f8ef63d4538ebb936000f3c9ee954a27460dd865",
+			err:        ErrorCodeSignaturePolicyViolation,
+			wantStatus: http.StatusForbidden,
+			wantCode:   "SIGNATURE_POLICY_VIOLATION",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_ = errcode.ServeJSON(w, tc.err)
+			})
+			h := newOCIErrorHandler("", inner)
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.path, nil))
+
+			if w.Code != tc.wantStatus {
+				t.Errorf("got status %d, want %d", w.Code, tc.wantStatus)
+			}
+			if contentType := w.Header().Get("Content-Type"); contentType != "application/json" {
+				t.Errorf("got content type %q, want application/json", contentType)
+			}
+
+			var envelope struct {
+				Errors []ociError `json:"errors"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &envelope); err != nil {
+				t.Fatalf("unable to decode the response %q: %v", w.Body.String(), err)
+			}
+			if len(envelope.Errors) != 1 {
+				t.Fatalf("got %d errors, want 1", len(envelope.Errors))
+			}
+			if envelope.Errors[0].Code != tc.wantCode {
+				t.Errorf("got error code %s, want %s", envelope.Errors[0].Code, tc.wantCode)
+			}
+			if len(envelope.Errors[0].Message) == 0 {
+				t.Errorf("expected the error message to be preserved")
+			}
+		})
+	}
+}
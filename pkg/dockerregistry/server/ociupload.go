@@ -0,0 +1,117 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+
+	regapi "github.com/distribution/distribution/v3/registry/api/v2"
+	"github.com/gorilla/mux"
+)
+
+// ociUploadHandler supports the single POST monolithic blob uploads of the
+// OCI distribution specification, i.e. POST /v2/<name>/blobs/uploads/?digest=
+// with the blob in the body. Distribution ignores the digest and the body of
+// the POST request and starts a new upload, so the data is lost.
+//
+// The request is handled as the POST request that starts the upload and the
+// PUT request that completes it, so that the data goes through the same
+// middleware as the other uploads.
+type ociUploadHandler struct {
+	router  *mux.Router
+	handler http.Handler
+}
+
+func newOCIUploadHandler(prefix string, handler http.Handler) http.Handler {
+	return &ociUploadHandler{
+		router:  regapi.RouterWithPrefix(prefix),
+		handler: handler,
+	}
+}
+
+func (h *ociUploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if r.Method != http.MethodPost || query.Get("digest") == "" || query.Get("mount") != "" {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+	var match mux.RouteMatch
+	if !h.router.Match(r, &match) || match.Route.GetName() != regapi.RouteNameBlobUpload {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+
+	dgst := query.Get("digest")
+	query.Del("digest")
+
+	start := r.Clone(r.Context())
+	start.URL.RawQuery = query.Encode()
+	start.RequestURI = start.URL.RequestURI()
+	start.Body = http.NoBody
+	start.ContentLength = 0
+	start.Header.Del("Content-Length")
+	start.Header.Del("Content-Type")
+
+	sw := newBufferedResponseWriter()
+	h.handler.ServeHTTP(sw, start)
+	location, err := url.Parse(sw.header.Get("Location"))
+	if sw.statusCode != http.StatusAccepted || err != nil || location.Path == "" {
+		sw.writeTo(w)
+		return
+	}
+
+	query = location.Query()
+	query.Set("digest", dgst)
+
+	complete := r.Clone(r.Context())
+	complete.Method = http.MethodPut
+	complete.URL.Path = location.Path
+	complete.URL.RawPath = location.RawPath
+	complete.URL.RawQuery = query.Encode()
+	complete.RequestURI = complete.URL.RequestURI()
+	h.handler.ServeHTTP(w, complete)
+}
+
+// bufferedResponseWriter keeps the response of a request that is not sent to
+// the client.
+type bufferedResponseWriter struct {
+	header     http.Header
+	statusCode int
+	body       bytes.Buffer
+}
+
+func newBufferedResponseWriter() *bufferedResponseWriter {
+	return &bufferedResponseWriter{
+		header: http.Header{},
+	}
+}
+
+func (w *bufferedResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferedResponseWriter) WriteHeader(statusCode int) {
+	if w.statusCode == 0 {
+		w.statusCode = statusCode
+	}
+}
+
+func (w *bufferedResponseWriter) Write(p []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.body.Write(p)
+}
+
+// writeTo sends the kept response to w.
+func (w *bufferedResponseWriter) writeTo(rw http.ResponseWriter) {
+	for k, v := range w.header {
+		rw.Header()[k] = v
+	}
+	statusCode := w.statusCode
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+	rw.WriteHeader(statusCode)
+	_, _ = rw.Write(w.body.Bytes())
+}
@@ -0,0 +1,286 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/distribution/distribution/v3/configuration"
+	"github.com/opencontainers/go-digest"
+
+	registryclient "github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+	srvconfig "github.com/openshift/image-registry/pkg/dockerregistry/server/configuration"
+	"github.com/openshift/image-registry/pkg/testutil"
+)
+
+// ociUploadClient pushes blobs with plain HTTP requests, as the clients of the
+// OCI distribution specification do.
+type ociUploadClient struct {
+	t       *testing.T
+	baseURL string
+	repo    string
+}
+
+func (c *ociUploadClient) do(method, location string, header http.Header, body []byte) *http.Response {
+	c.t.Helper()
+
+	u, err := url.Parse(location)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if !u.IsAbs() {
+		base, _ := url.Parse(c.baseURL)
+		u = base.ResolveReference(u)
+	}
+
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, u.String(), r)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp
+}
+
+func (c *ociUploadClient) start(query string) string {
+	c.t.Helper()
+
+	resp := c.do(http.MethodPost, fmt.Sprintf("/v2/%s/blobs/uploads/%s", c.repo, query), nil, nil)
+	if resp.StatusCode != http.StatusAccepted {
+		c.t.Fatalf("POST: got status %d, want %d", resp.StatusCode, http.StatusAccepted)
+	}
+	return resp.Header.Get("Location")
+}
+
+func withDigest(location string, dgst digest.Digest) string {
+	u, _ := url.Parse(location)
+	q := u.Query()
+	q.Set("digest", dgst.String())
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+func ociChunkHeader(start, end int) http.Header {
+	return http.Header{
+		"Content-Type":   []string{"application/octet-stream"},
+		"Content-Range":  []string{fmt.Sprintf("%d-%d", start, end)},
+		"Content-Length": []string{fmt.Sprint(end - start + 1)},
+	}
+}
+
+// TestOCIBlobUploads pushes blobs the ways the push workflow of the OCI
+// distribution conformance suite does. The suite itself isn't vendored, so it
+// isn't run.
+func TestOCIBlobUploads(t *testing.T) {
+	ctx := context.Background()
+	ctx = testutil.WithTestLogger(ctx, t)
+
+	_, imageClient := testutil.NewFakeOpenShiftWithClient(ctx)
+	osclient, err := registryclient.NewFakeRegistryClient(imageClient).Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx = withAppMiddleware(ctx, &fakeAccessControllerMiddleware{t: t, userClient: osclient})
+
+	dockercfg := &configuration.Configuration{
+		Loglevel: "debug",
+		Auth: map[string]configuration.Parameters{
+			"openshift": nil,
+		},
+		Storage: configuration.Storage{
+			"inmemory": configuration.Parameters{},
+			"delete": configuration.Parameters{
+				"enabled": true,
+			},
+			"maintenance": configuration.Parameters{
+				"uploadpurging": map[interface{}]interface{}{
+					"enabled": false,
+				},
+			},
+		},
+		Middleware: map[string][]configuration.Middleware{
+			"registry":   {{Name: "openshift"}},
+			"repository": {{Name: "openshift"}},
+			"storage":    {{Name: "openshift"}},
+		},
+	}
+	cfg := &srvconfig.Configuration{
+		Server: &srvconfig.Server{
+			Addr: "localhost:5000",
+		},
+	}
+	if err := srvconfig.InitExtraConfig(dockercfg, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	app := NewApp(ctx, registryclient.NewFakeRegistryClient(imageClient), dockercfg, cfg, nil)
+	server := httptest.NewServer(app)
+	defer server.Close()
+
+	c := &ociUploadClient{t: t, baseURL: server.URL, repo: "user/app"}
+
+	for _, tc := range []struct {
+		name string
+		push func(blob []byte, dgst digest.Digest) *http.Response
+	}{
+		{
+			name: "monolithic POST then PUT",
+			push: func(blob []byte, dgst digest.Digest) *http.Response {
+				location := c.start("")
+				return c.do(http.MethodPut, withDigest(location, dgst), http.Header{
+					"Content-Type": []string{"application/octet-stream"},
+				}, blob)
+			},
+		},
+		{
+			name: "single POST",
+			push: func(blob []byte, dgst digest.Digest) *http.Response {
+				return c.do(http.MethodPost, fmt.Sprintf("/v2/%s/blobs/uploads/?digest=%s", c.repo, dgst), http.Header{
+					"Content-Type": []string{"application/octet-stream"},
+				}, blob)
+			},
+		},
+		{
+			name: "chunked",
+			push: func(blob []byte, dgst digest.Digest) *http.Response {
+				location := c.start("")
+				half := len(blob) / 2
+
+				resp := c.do(http.MethodPatch, location, ociChunkHeader(0, half-1), blob[:half])
+				if resp.StatusCode != http.StatusAccepted {
+					c.t.Fatalf("PATCH: got status %d, want %d", resp.StatusCode, http.StatusAccepted)
+				}
+				if r := resp.Header.Get("Range"); r != fmt.Sprintf("0-%d", half-1) {
+					c.t.Errorf("PATCH: got range %q, want 0-%d", r, half-1)
+				}
+
+				status := c.do(http.MethodGet, resp.Header.Get("Location"), nil, nil)
+				if status.StatusCode != http.StatusNoContent {
+					c.t.Errorf("GET: got status %d, want %d", status.StatusCode, http.StatusNoContent)
+				}
+				if r := status.Header.Get("Range"); r != fmt.Sprintf("0-%d", half-1) {
+					c.t.Errorf("GET: got range %q, want 0-%d", r, half-1)
+				}
+
+				// The chunk that was already sent is rejected.
+				retry := c.do(http.MethodPatch, resp.Header.Get("Location"), ociChunkHeader(0, half-1), blob[:half])
+				if retry.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+					c.t.Errorf("PATCH retry: got status %d, want %d", retry.StatusCode, http.StatusRequestedRangeNotSatisfiable)
+				}
+
+				header := ociChunkHeader(half, len(blob)-1)
+				header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", half, len(blob)-1, len(blob)))
+				return c.do(http.MethodPut, withDigest(resp.Header.Get("Location"), dgst), header, blob[half:])
+			},
+		},
+		{
+			name: "streamed",
+			push: func(blob []byte, dgst digest.Digest) *http.Response {
+				location := c.start("")
+				resp := c.do(http.MethodPatch, location, http.Header{
+					"Content-Type": []string{"application/octet-stream"},
+				}, blob)
+				if resp.StatusCode != http.StatusAccepted {
+					c.t.Fatalf("PATCH: got status %d, want %d", resp.StatusCode, http.StatusAccepted)
+				}
+				return c.do(http.MethodPut, withDigest(resp.Header.Get("Location"), dgst), nil, nil)
+			},
+		},
+		{
+			name: "PATCH without Content-Type",
+			push: func(blob []byte, dgst digest.Digest) *http.Response {
+				location := c.start("")
+				resp := c.do(http.MethodPatch, location, nil, blob)
+				if resp.StatusCode != http.StatusAccepted {
+					c.t.Fatalf("PATCH: got status %d, want %d", resp.StatusCode, http.StatusAccepted)
+				}
+				return c.do(http.MethodPut, withDigest(resp.Header.Get("Location"), dgst), nil, nil)
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c.t = t
+
+			blob := []byte(fmt.Sprintf("blob of the %s upload", tc.name))
+			dgst := digest.FromBytes(blob)
+
+			resp := tc.push(blob, dgst)
+			if resp.StatusCode != http.StatusCreated {
+				t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusCreated)
+			}
+			if got := resp.Header.Get("Docker-Content-Digest"); got != dgst.String() {
+				t.Errorf("got digest %q, want %q", got, dgst)
+			}
+			if resp.Header.Get("Location") == "" {
+				t.Errorf("expected the location of the blob")
+			}
+
+			head := c.do(http.MethodHead, fmt.Sprintf("/v2/%s/blobs/%s", c.repo, dgst), nil, nil)
+			if head.StatusCode != http.StatusOK {
+				t.Errorf("HEAD: got status %d, want %d", head.StatusCode, http.StatusOK)
+			}
+			if head.ContentLength != int64(len(blob)) {
+				t.Errorf("HEAD: got length %d, want %d", head.ContentLength, len(blob))
+			}
+		})
+	}
+
+	t.Run("cross-repository mount", func(t *testing.T) {
+		c.t = t
+
+		blob := []byte("blob of the mounted upload")
+		dgst := digest.FromBytes(blob)
+		resp := c.do(http.MethodPost, fmt.Sprintf("/v2/%s/blobs/uploads/?digest=%s", c.repo, dgst), nil, blob)
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("POST: got status %d, want %d", resp.StatusCode, http.StatusCreated)
+		}
+
+		// The registry can either mount the blob or start an upload, as the
+		// OCI distribution specification allows.
+		mount := c.do(http.MethodPost, fmt.Sprintf("/v2/user/other/blobs/uploads/?mount=%s&from=%s", dgst, c.repo), nil, nil)
+		switch mount.StatusCode {
+		case http.StatusCreated:
+			if got := mount.Header.Get("Docker-Content-Digest"); got != dgst.String() {
+				t.Errorf("got digest %q, want %q", got, dgst)
+			}
+		case http.StatusAccepted:
+			if mount.Header.Get("Location") == "" {
+				t.Errorf("expected the location of the upload")
+			}
+		default:
+			t.Errorf("got status %d, want %d or %d", mount.StatusCode, http.StatusCreated, http.StatusAccepted)
+		}
+	})
+
+	t.Run("single POST with wrong digest", func(t *testing.T) {
+		c.t = t
+
+		wrong := digest.FromString("another blob")
+		resp := c.do(http.MethodPost, fmt.Sprintf("/v2/%s/blobs/uploads/?digest=%s", c.repo, wrong), nil, []byte("blob"))
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("got status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+		}
+
+		head := c.do(http.MethodHead, fmt.Sprintf("/v2/%s/blobs/%s", c.repo, wrong), nil, nil)
+		if head.StatusCode != http.StatusNotFound {
+			t.Errorf("HEAD: got status %d, want %d", head.StatusCode, http.StatusNotFound)
+		}
+	})
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/opencontainers/go-digest"
+
+	registryconfig "github.com/openshift/image-registry/pkg/dockerregistry/server/configuration"
+)
+
+// BlobRedirector decides whether a blob download can be served by another
+// party instead of the registry.
+type BlobRedirector interface {
+	// BlobRedirectURL returns the URL where the client should be redirected
+	// to download the blob desc of the repository repo. An empty string means
+	// that the registry should serve the blob itself.
+	BlobRedirectURL(ctx context.Context, req *http.Request, repo string, desc distribution.Descriptor) (string, error)
+}
+
+// p2pBlobRedirector redirects clients that support it to a node-local
+// peer-to-peer distribution endpoint (e.g. spegel or dragonfly) which speaks
+// the registry protocol and mirrors this registry.
+type p2pBlobRedirector struct {
+	header   string
+	endpoint *url.URL
+	registry string
+}
+
+var _ BlobRedirector = &p2pBlobRedirector{}
+
+func newP2PBlobRedirector(cfg *registryconfig.Configuration) (*p2pBlobRedirector, error) {
+	endpoint, err := url.Parse(cfg.P2P.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return &p2pBlobRedirector{
+		header:   cfg.P2P.Header,
+		endpoint: endpoint,
+		registry: cfg.Server.Addr,
+	}, nil
+}
+
+func (r *p2pBlobRedirector) BlobRedirectURL(ctx context.Context, req *http.Request, repo string, desc distribution.Descriptor) (string, error) {
+	supported, err := strconv.ParseBool(req.Header.Get(r.header))
+	if err != nil || !supported {
+		return "", nil
+	}
+	return r.blobURL(repo, desc.Digest), nil
+}
+
+// blobURL returns the URL of the blob dgst of the repository repo on the
+// peer-to-peer endpoint.
+func (r *p2pBlobRedirector) blobURL(repo string, dgst digest.Digest) string {
+	u := *r.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + fmt.Sprintf("/v2/%s/blobs/%s", repo, dgst)
+	u.RawQuery = url.Values{"ns": []string{r.registry}}.Encode()
+	return u.String()
+}
+
+// redirectingBlobStore wraps a distribution.BlobStore and answers blob
+// downloads with a redirect when its BlobRedirector allows it.
+type redirectingBlobStore struct {
+	distribution.BlobStore
+
+	redirector BlobRedirector
+	repo       string
+}
+
+var _ distribution.BlobStore = &redirectingBlobStore{}
+
+// ServeBlob redirects the client if the blob is known to the registry and the
+// redirector provides a URL for it. Otherwise the blob is served by the
+// wrapped blob store. HEAD requests are never redirected.
+func (rbs *redirectingBlobStore) ServeBlob(ctx context.Context, w http.ResponseWriter, req *http.Request, dgst digest.Digest) error {
+	if req.Method != http.MethodGet {
+		return rbs.BlobStore.ServeBlob(ctx, w, req, dgst)
+	}
+
+	desc, err := rbs.BlobStore.Stat(ctx, dgst)
+	if err != nil {
+		return rbs.BlobStore.ServeBlob(ctx, w, req, dgst)
+	}
+
+	redirectURL, err := rbs.redirector.BlobRedirectURL(ctx, req, rbs.repo, desc)
+	if err != nil {
+		dcontext.GetLogger(ctx).Errorf("unable to get redirect URL for blob %s: %v", dgst, err)
+		return rbs.BlobStore.ServeBlob(ctx, w, req, dgst)
+	}
+	if len(redirectURL) == 0 {
+		return rbs.BlobStore.ServeBlob(ctx, w, req, dgst)
+	}
+
+	dcontext.GetLogger(ctx).Debugf("(*redirectingBlobStore).ServeBlob: redirecting blob %s to %s", dgst, redirectURL)
+	w.Header().Set("Docker-Content-Digest", desc.Digest.String())
+	http.Redirect(w, req, redirectURL, http.StatusTemporaryRedirect)
+	return nil
+}
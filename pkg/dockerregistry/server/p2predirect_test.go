@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/opencontainers/go-digest"
+
+	registryconfig "github.com/openshift/image-registry/pkg/dockerregistry/server/configuration"
+	"github.com/openshift/image-registry/pkg/testutil"
+)
+
+func TestRedirectingBlobStoreServeBlob(t *testing.T) {
+	ctx := context.Background()
+	ctx = testutil.WithTestLogger(ctx, t)
+
+	content := []byte("layer content")
+	dgst := makeDigestFromBytes(content)
+
+	redirector, err := newP2PBlobRedirector(&registryconfig.Configuration{
+		Server: &registryconfig.Server{
+			Addr: "image-registry.openshift-image-registry.svc:5000",
+		},
+		P2P: &registryconfig.P2P{
+			Enabled:  true,
+			Header:   "OpenShift-P2P",
+			Endpoint: "http://127.0.0.1:30020/",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name          string
+		method        string
+		header        string
+		dgst          digest.Digest
+		wantStatus    int
+		wantLocation  string
+		wantServeBlob int
+	}{
+		{
+			name:         "redirect",
+			method:       http.MethodGet,
+			header:       "true",
+			dgst:         dgst,
+			wantStatus:   http.StatusTemporaryRedirect,
+			wantLocation: "http://127.0.0.1:30020/v2/user/app/blobs/" + dgst.String() + "?ns=image-registry.openshift-image-registry.svc%3A5000",
+		},
+		{
+			name:          "client without p2p support",
+			method:        http.MethodGet,
+			dgst:          dgst,
+			wantStatus:    http.StatusOK,
+			wantServeBlob: 1,
+		},
+		{
+			name:          "head request",
+			method:        http.MethodHead,
+			header:        "true",
+			dgst:          dgst,
+			wantStatus:    http.StatusOK,
+			wantServeBlob: 1,
+		},
+		{
+			name:          "unknown blob",
+			method:        http.MethodGet,
+			header:        "true",
+			dgst:          unknownBlobDigest,
+			wantServeBlob: 1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			bs := testutil.NewFakeBlobStore(testutil.BlobDescriptors{
+				dgst: distribution.Descriptor{Digest: dgst, Size: int64(len(content))},
+			}, testutil.BlobContents{
+				dgst: content,
+			})
+			rbs := &redirectingBlobStore{
+				BlobStore:  bs,
+				redirector: redirector,
+				repo:       "user/app",
+			}
+
+			req := httptest.NewRequest(tc.method, "/v2/user/app/blobs/"+tc.dgst.String(), nil)
+			if len(tc.header) > 0 {
+				req.Header.Set("OpenShift-P2P", tc.header)
+			}
+			w := httptest.NewRecorder()
+
+			err := rbs.ServeBlob(ctx, w, req, tc.dgst)
+			if tc.wantStatus == 0 {
+				if err != distribution.ErrBlobUnknown {
+					t.Fatalf("got error %v, want %v", err, distribution.ErrBlobUnknown)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if w.Code != tc.wantStatus {
+					t.Errorf("got status %d, want %d", w.Code, tc.wantStatus)
+				}
+			}
+			if location := w.Header().Get("Location"); location != tc.wantLocation {
+				t.Errorf("got location %q, want %q", location, tc.wantLocation)
+			}
+			if bs.Calls("ServeBlob") != tc.wantServeBlob {
+				t.Errorf("got %d ServeBlob calls, want %d", bs.Calls("ServeBlob"), tc.wantServeBlob)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	regapi "github.com/distribution/distribution/v3/registry/api/v2"
+	"github.com/gorilla/mux"
+)
+
+type payloadErrorKey struct{}
+
+// payloadError is the error of a blob writer that rejected the body of the
+// request, or of a blob store that rejected the upload.
+type payloadError struct {
+	mu  sync.Mutex
+	err error
+}
+
+// reportPayloadError records err as the reason why the body of the blob upload
+// request of ctx is rejected, and returns err.
+func reportPayloadError(ctx context.Context, err errcode.Error) error {
+	if pe, ok := ctx.Value(payloadErrorKey{}).(*payloadError); ok {
+		pe.mu.Lock()
+		if pe.err == nil {
+			pe.err = err
+		}
+		pe.mu.Unlock()
+	}
+	return err
+}
+
+// payloadErrorHandler sends the errors of the blob writers that reject the
+// body of blob upload requests, and of the blob stores that refuse to start
+// uploads, to the clients. Distribution reports all the errors that happen
+// while the body is copied or the upload is created as UNKNOWN errors with the
+// status 500, so the clients retry the uploads that are never accepted.
+type payloadErrorHandler struct {
+	router  *mux.Router
+	handler http.Handler
+}
+
+func newPayloadErrorHandler(prefix string, handler http.Handler) http.Handler {
+	return &payloadErrorHandler{
+		router:  regapi.RouterWithPrefix(prefix),
+		handler: handler,
+	}
+}
+
+func (h *payloadErrorHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.isBlobUpload(r) {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+
+	pe := &payloadError{}
+	r = r.WithContext(context.WithValue(r.Context(), payloadErrorKey{}, pe))
+	h.handler.ServeHTTP(&payloadErrorResponseWriter{ResponseWriter: w, payloadError: pe}, r)
+}
+
+// isBlobUpload returns true for the requests that start blob uploads or
+// upload their content.
+func (h *payloadErrorHandler) isBlobUpload(r *http.Request) bool {
+	if r.Method != http.MethodPost && r.Method != http.MethodPatch && r.Method != http.MethodPut {
+		return false
+	}
+	var match mux.RouteMatch
+	if !h.router.Match(r, &match) {
+		return false
+	}
+	if r.Method == http.MethodPost {
+		return match.Route.GetName() == regapi.RouteNameBlobUpload
+	}
+	return match.Route.GetName() == regapi.RouteNameBlobUploadChunk
+}
+
+// payloadErrorResponseWriter replaces the internal server errors with the
+// recorded payload error.
+type payloadErrorResponseWriter struct {
+	http.ResponseWriter
+
+	payloadError *payloadError
+	// replaced is set once the error response is replaced, the original
+	// body is discarded then.
+	replaced bool
+}
+
+func (w *payloadErrorResponseWriter) WriteHeader(statusCode int) {
+	if w.replaced {
+		return
+	}
+	if statusCode == http.StatusInternalServerError {
+		w.payloadError.mu.Lock()
+		err := w.payloadError.err
+		w.payloadError.mu.Unlock()
+		if err != nil {
+			w.replaced = true
+			_ = errcode.ServeJSON(w.ResponseWriter, err)
+			return
+		}
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *payloadErrorResponseWriter) Write(p []byte) (int, error) {
+	if w.replaced {
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+)
+
+// isErrorCode returns true if err is an error with the code.
+func isErrorCode(err error, code errcode.ErrorCode) bool {
+	var e errcode.Error
+	return errors.As(err, &e) && e.Code == code
+}
+
+func TestPayloadErrorHandler(t *testing.T) {
+	rejected := errcode.ErrorCodeDenied.WithMessage("the upload of the layer exceeds the maximum size")
+	h := newPayloadErrorHandler("", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Reject") != "" {
+			_ = reportPayloadError(r.Context(), rejected)
+		}
+		// Distribution reports the errors of the copied body as unknown.
+		_ = errcode.ServeJSON(w, errcode.ErrorCodeUnknown.WithDetail("copy failed"))
+	}))
+
+	for _, tc := range []struct {
+		name           string
+		method         string
+		path           string
+		reject         bool
+		expectedStatus int
+		expectedCode   string
+	}{
+		{
+			name:           "rejected chunk",
+			method:         http.MethodPatch,
+			path:           "/v2/ns/app/blobs/uploads/upload-id",
+			reject:         true,
+			expectedStatus: http.StatusForbidden,
+			expectedCode:   errcode.ErrorCodeDenied.String(),
+		},
+		{
+			name:           "rejected upload start",
+			method:         http.MethodPost,
+			path:           "/v2/ns/app/blobs/uploads/",
+			reject:         true,
+			expectedStatus: http.StatusForbidden,
+			expectedCode:   errcode.ErrorCodeDenied.String(),
+		},
+		{
+			name:           "rejected upload",
+			method:         http.MethodPut,
+			path:           "/v2/ns/app/blobs/uploads/upload-id",
+			reject:         true,
+			expectedStatus: http.StatusForbidden,
+			expectedCode:   errcode.ErrorCodeDenied.String(),
+		},
+		{
+			name:           "other failure",
+			method:         http.MethodPatch,
+			path:           "/v2/ns/app/blobs/uploads/upload-id",
+			expectedStatus: http.StatusInternalServerError,
+			expectedCode:   errcode.ErrorCodeUnknown.String(),
+		},
+		{
+			name:           "manifest",
+			method:         http.MethodPut,
+			path:           "/v2/ns/app/manifests/latest",
+			reject:         true,
+			expectedStatus: http.StatusInternalServerError,
+			expectedCode:   errcode.ErrorCodeUnknown.String(),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.path, nil)
+			if tc.reject {
+				req.Header.Set("X-Reject", "1")
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			if w.Code != tc.expectedStatus {
+				t.Errorf("got status %d, want %d", w.Code, tc.expectedStatus)
+			}
+			var body struct {
+				Errors []struct {
+					Code string `json:"code"`
+				} `json:"errors"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("unable to decode the response %q: %v", w.Body.String(), err)
+			}
+			if len(body.Errors) != 1 || body.Errors[0].Code != tc.expectedCode {
+				t.Errorf("got errors %+v, want %s", body.Errors, tc.expectedCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	registryauth "github.com/distribution/distribution/v3/registry/auth"
+)
+
+// pingPaths are the API version checks that are answered without the
+// authentication of the registry if the request has no credentials.
+var pingPaths = []string{"/v2/", "/v2/_ping"}
+
+// v1PingPaths are the API version checks of the Docker Registry API v1,
+// which is not supported.
+var v1PingPaths = []string{"/v1/", "/v1/_ping"}
+
+// registryDocsURL is the documentation about accessing the registry that
+// the clients of the API v1 are pointed to.
+const registryDocsURL = "https://docs.openshift.com/container-platform/latest/registry/accessing-the-registry.html"
+
+var ErrorCodeAPIV1Unsupported = errcode.Register(errGroup, errcode.ErrorDescriptor{
+	Value:          "API_V1_UNSUPPORTED",
+	Message:        "the Docker Registry API v1 is not supported, only the API v2 is available at /v2/",
+	HTTPStatusCode: http.StatusNotFound,
+})
+
+// pingHandler answers unauthenticated API version checks, e.g. from health
+// checks and from clients that probe the registry, with the same challenge
+// as the access controller, but without evaluating the request by the
+// distribution application. Requests with credentials are passed to handler,
+// so that logins are verified as usual.
+type pingHandler struct {
+	paths   map[string]bool
+	ac      *AccessController
+	headers http.Header
+	handler http.Handler
+}
+
+func newPingHandler(prefix string, handler http.Handler, ac *AccessController, headers http.Header) http.Handler {
+	h := &pingHandler{
+		paths:   make(map[string]bool),
+		ac:      ac,
+		headers: headers,
+		handler: handler,
+	}
+	for _, p := range pingPaths {
+		h.paths[strings.TrimSuffix(prefix, "/")+p] = true
+	}
+	return h
+}
+
+func (h *pingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if (r.Method != http.MethodGet && r.Method != http.MethodHead) || !h.paths[r.URL.Path] || len(r.Header.Get("Authorization")) > 0 {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+
+	ctx := dcontext.WithRequest(r.Context(), r)
+	challenge, ok := h.ac.wrapErr(ctx, ErrTokenRequired).(registryauth.Challenge)
+	if !ok {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+
+	for name, values := range h.headers {
+		w.Header()[name] = values
+	}
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	challenge.SetHeaders(r, w)
+
+	if err := errcode.ServeJSON(w, errcode.ErrorCodeUnauthorized.WithDetail(nil)); err != nil {
+		dcontext.GetLogger(ctx).Errorf("error serving the ping response: %v", err)
+	}
+}
+
+// v1PingHandler answers the API version checks of old clients that probe
+// the API v1 before the API v2. Without it the requests reach the
+// authentication of the registry and the clients report confusing errors.
+// The user agents are logged, so that the legacy tools can be found and
+// updated.
+type v1PingHandler struct {
+	paths   map[string]bool
+	handler http.Handler
+}
+
+func newV1PingHandler(prefix string, handler http.Handler) http.Handler {
+	h := &v1PingHandler{
+		paths:   make(map[string]bool),
+		handler: handler,
+	}
+	for _, p := range v1PingPaths {
+		h.paths[strings.TrimSuffix(prefix, "/")+p] = true
+	}
+	return h
+}
+
+func (h *v1PingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if (r.Method != http.MethodGet && r.Method != http.MethodHead) || !h.paths[r.URL.Path] {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+
+	ctx := dcontext.WithRequest(r.Context(), r)
+	dcontext.GetLogger(ctx).Infof("request to the unsupported API v1 endpoint %s from the client %q", r.URL.Path, r.UserAgent())
+
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	err := ErrorCodeAPIV1Unsupported.WithDetail(map[string]string{
+		"documentation": registryDocsURL,
+	})
+	if err := errcode.ServeJSON(w, err); err != nil {
+		dcontext.GetLogger(ctx).Errorf("error serving the API v1 ping response: %v", err)
+	}
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestPingHandler(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Next-Handler", "1")
+		w.WriteHeader(http.StatusOK)
+	})
+
+	headers := http.Header{}
+	headers.Set("X-Registry-Supports-Signatures", "1")
+
+	for _, tc := range []struct {
+		name          string
+		tokenRealm    *url.URL
+		method        string
+		path          string
+		authorization string
+		passed        bool
+		challenge     string
+	}{
+		{
+			name:      "unauthenticated ping",
+			method:    http.MethodGet,
+			path:      "/v2/",
+			challenge: `Basic realm=myrealm,error="authorization header required"`,
+		},
+		{
+			name:      "unauthenticated legacy ping",
+			method:    http.MethodHead,
+			path:      "/v2/_ping",
+			challenge: `Basic realm=myrealm,error="authorization header required"`,
+		},
+		{
+			name:       "token realm",
+			tokenRealm: &url.URL{Path: "/openshift/token"},
+			method:     http.MethodGet,
+			path:       "/v2/",
+			challenge:  `Bearer realm="http://registry.example.com/openshift/token"`,
+		},
+		{
+			name:          "ping with credentials",
+			method:        http.MethodGet,
+			path:          "/v2/",
+			authorization: "Bearer token",
+			passed:        true,
+		},
+		{
+			name:   "other path",
+			method: http.MethodGet,
+			path:   "/v2/_catalog",
+			passed: true,
+		},
+		{
+			name:   "other method",
+			method: http.MethodPost,
+			path:   "/v2/",
+			passed: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ac := &AccessController{
+				realm:      "myrealm",
+				tokenRealm: tc.tokenRealm,
+			}
+			h := newPingHandler("/", next, ac, headers)
+
+			req := httptest.NewRequest(tc.method, "http://registry.example.com"+tc.path, nil)
+			if tc.authorization != "" {
+				req.Header.Set("Authorization", tc.authorization)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			if passed := w.Header().Get("X-Next-Handler") != ""; passed != tc.passed {
+				t.Fatalf("got passed to the next handler %t, want %t", passed, tc.passed)
+			}
+			if tc.passed {
+				return
+			}
+
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("got status %d, want %d", w.Code, http.StatusUnauthorized)
+			}
+			if version := w.Header().Get("Docker-Distribution-API-Version"); version != "registry/2.0" {
+				t.Errorf("got Docker-Distribution-API-Version %q, want %q", version, "registry/2.0")
+			}
+			if signatures := w.Header().Get("X-Registry-Supports-Signatures"); signatures != "1" {
+				t.Errorf("got X-Registry-Supports-Signatures %q, want %q", signatures, "1")
+			}
+			if challenge := w.Header().Get("WWW-Authenticate"); challenge != tc.challenge {
+				t.Errorf("got WWW-Authenticate %q, want %q", challenge, tc.challenge)
+			}
+		})
+	}
+}
+
+func TestV1PingHandler(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Next-Handler", "1")
+		w.WriteHeader(http.StatusOK)
+	})
+	h := newV1PingHandler("/", next)
+
+	for _, tc := range []struct {
+		name   string
+		method string
+		path   string
+		passed bool
+	}{
+		{
+			name:   "v1 ping",
+			method: http.MethodGet,
+			path:   "/v1/_ping",
+		},
+		{
+			name:   "v1 root",
+			method: http.MethodHead,
+			path:   "/v1/",
+		},
+		{
+			name:   "v2 ping",
+			method: http.MethodGet,
+			path:   "/v2/",
+			passed: true,
+		},
+		{
+			name:   "other method",
+			method: http.MethodPut,
+			path:   "/v1/_ping",
+			passed: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, "http://registry.example.com"+tc.path, nil)
+			req.Header.Set("User-Agent", "docker/1.5.0")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			if passed := w.Header().Get("X-Next-Handler") != ""; passed != tc.passed {
+				t.Fatalf("got passed to the next handler %t, want %t", passed, tc.passed)
+			}
+			if tc.passed {
+				return
+			}
+
+			if w.Code != http.StatusNotFound {
+				t.Errorf("got status %d, want %d", w.Code, http.StatusNotFound)
+			}
+			if version := w.Header().Get("Docker-Distribution-API-Version"); version != "registry/2.0" {
+				t.Errorf("got Docker-Distribution-API-Version %q, want %q", version, "registry/2.0")
+			}
+			if body := w.Body.String(); !strings.Contains(body, "API_V1_UNSUPPORTED") || !strings.Contains(body, registryDocsURL) {
+				t.Errorf("unexpected body: %s", body)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/manifest/manifestlist"
+	"github.com/opencontainers/go-digest"
+	dockerapiv10 "github.com/openshift/api/image/docker10"
+	kubecache "k8s.io/apimachinery/pkg/util/cache"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/metrics"
+	"github.com/openshift/image-registry/pkg/imagestream"
+)
+
+const (
+	// platformPullsSize is the maximum number of remembered platforms of the
+	// manifests referenced by manifest lists.
+	platformPullsSize = 16384
+
+	// platformPullsTTL is how long the platform of a manifest is remembered
+	// after the manifest list that references it is pulled.
+	platformPullsTTL = time.Hour
+)
+
+// platform is the platform of a manifest referenced by a manifest list.
+type platform struct {
+	os           string
+	architecture string
+	variant      string
+}
+
+// platformPulls counts the pulled images by their platforms. Clients pull a
+// manifest list first and then the manifest for their platform, so the
+// platforms from the served manifest lists are remembered for the following
+// pulls of the manifests. Each replica of the registry has its own memory.
+type platformPulls struct {
+	platforms *kubecache.LRUExpireCache
+	metrics   metrics.PlatformPulls
+}
+
+func newPlatformPulls(m metrics.PlatformPulls) *platformPulls {
+	return &platformPulls{
+		platforms: kubecache.NewLRUExpireCache(platformPullsSize),
+		metrics:   m,
+	}
+}
+
+// served records that the manifest dgst of the image stream is sent to the
+// client.
+func (p *platformPulls) served(ctx context.Context, is imagestream.ImageStream, dgst digest.Digest, manifest distribution.Manifest) {
+	req, err := dcontext.GetRequest(ctx)
+	if err != nil || req.Method != http.MethodGet {
+		return
+	}
+
+	if list, ok := manifest.(*manifestlist.DeserializedManifestList); ok {
+		for _, m := range list.Manifests {
+			p.platforms.Add(m.Digest, platform{
+				os:           m.Platform.OS,
+				architecture: m.Platform.Architecture,
+				variant:      m.Platform.Variant,
+			}, platformPullsTTL)
+		}
+		return
+	}
+
+	if pl, ok := p.platforms.Get(dgst); ok {
+		pl := pl.(platform)
+		p.metrics.Pulled(pl.os, pl.architecture, pl.variant)
+		return
+	}
+
+	// The manifest is pulled without its manifest list or the list was
+	// served by another replica. The images have only the architecture in
+	// their metadata.
+	var architecture string
+	if image, err := is.GetImageOfImageStream(ctx, dgst); err == nil {
+		if meta, ok := image.DockerImageMetadata.Object.(*dockerapiv10.DockerImage); ok {
+			architecture = meta.Architecture
+		}
+	}
+	p.metrics.Pulled("", architecture, "")
+}
+
+// platformPullsManifestService counts the pulled images by their platforms.
+type platformPullsManifestService struct {
+	distribution.ManifestService
+	imageStream   imagestream.ImageStream
+	platformPulls *platformPulls
+}
+
+var _ distribution.ManifestService = &platformPullsManifestService{}
+
+func (m *platformPullsManifestService) Get(ctx context.Context, dgst digest.Digest, options ...distribution.ManifestServiceOption) (distribution.Manifest, error) {
+	manifest, err := m.ManifestService.Get(ctx, dgst, options...)
+	if err != nil {
+		return nil, err
+	}
+	m.platformPulls.served(ctx, m.imageStream, dgst, manifest)
+	return manifest, nil
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/manifest/manifestlist"
+	"github.com/distribution/distribution/v3/manifest/schema2"
+	"github.com/opencontainers/go-digest"
+	dockerapiv10 "github.com/openshift/api/image/docker10"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	registryclient "github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/metrics"
+	metricstesting "github.com/openshift/image-registry/pkg/dockerregistry/server/metrics/testing"
+	"github.com/openshift/image-registry/pkg/imagestream"
+	"github.com/openshift/image-registry/pkg/testutil"
+	"github.com/openshift/image-registry/pkg/testutil/counter"
+)
+
+// mapManifestService serves the manifests from a map.
+type mapManifestService struct {
+	distribution.ManifestService
+	manifests map[digest.Digest]distribution.Manifest
+}
+
+func (ms *mapManifestService) Get(ctx context.Context, dgst digest.Digest, options ...distribution.ManifestServiceOption) (distribution.Manifest, error) {
+	manifest, ok := ms.manifests[dgst]
+	if !ok {
+		return nil, distribution.ErrManifestUnknownRevision{Revision: dgst}
+	}
+	return manifest, nil
+}
+
+func TestPlatformPulls(t *testing.T) {
+	namespace := "user"
+	repo := "app"
+
+	ctx := testutil.WithTestLogger(context.Background(), t)
+
+	// The image that isn't referenced by a manifest list has its
+	// architecture in the metadata.
+	fos, imageClient := testutil.NewFakeOpenShiftWithClient(ctx)
+	image, err := testutil.CreateRandomImage(namespace, repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := json.Marshal(&dockerapiv10.DockerImage{Architecture: "ppc64le", Size: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	image.DockerImageMetadata = runtime.RawExtension{Raw: meta}
+	testutil.AddImageStream(t, fos, namespace, repo, nil)
+	testutil.AddImage(t, fos, image, namespace, repo, "ppc64le")
+
+	arm64 := digest.FromString("arm64")
+	s390x := digest.FromString("s390x")
+	list, err := manifestlist.FromDescriptors([]manifestlist.ManifestDescriptor{
+		{
+			Descriptor: distribution.Descriptor{Digest: arm64},
+			Platform:   manifestlist.PlatformSpec{OS: "linux", Architecture: "arm64", Variant: "v8"},
+		},
+		{
+			Descriptor: distribution.Descriptor{Digest: s390x},
+			Platform:   manifestlist.PlatformSpec{OS: "linux", Architecture: "s390x"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, payload, err := list.Payload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listDigest := digest.FromBytes(payload)
+
+	single, err := schema2.FromStruct(schema2.Manifest{
+		Versioned: schema2.SchemaVersion,
+		Config:    distribution.Descriptor{MediaType: schema2.MediaTypeImageConfig, Digest: digest.FromString("config")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, sink := metricstesting.NewCounterSink()
+	ms := &platformPullsManifestService{
+		ManifestService: &mapManifestService{
+			manifests: map[digest.Digest]distribution.Manifest{
+				listDigest:                list,
+				arm64:                     single,
+				s390x:                     single,
+				digest.Digest(image.Name): single,
+			},
+		},
+		imageStream:   imagestream.New(ctx, namespace, repo, registryclient.NewFakeRegistryAPIClient(nil, imageClient)),
+		platformPulls: newPlatformPulls(metrics.NewMetrics(sink).PlatformPulls()),
+	}
+
+	get := func(method string, dgst digest.Digest) {
+		t.Helper()
+		reqCtx := dcontext.WithRequest(ctx, httptest.NewRequest(method, "/v2/user/app/manifests/"+dgst.String(), nil))
+		if _, err := ms.Get(reqCtx, dgst); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The platforms aren't known before the manifest list is pulled.
+	get(http.MethodGet, s390x)
+
+	get(http.MethodGet, listDigest)
+	get(http.MethodGet, arm64)
+	get(http.MethodGet, arm64)
+	get(http.MethodHead, s390x)
+	get(http.MethodGet, s390x)
+	get(http.MethodGet, digest.Digest(image.Name))
+
+	if diff := c.Diff(counter.M{
+		"manifest_platform_pulls://":             1,
+		"manifest_platform_pulls:linux/arm64/v8": 2,
+		"manifest_platform_pulls:linux/s390x/":   1,
+		"manifest_platform_pulls:/ppc64le/":      1,
+	}); diff != nil {
+		t.Error(diff)
+	}
+}
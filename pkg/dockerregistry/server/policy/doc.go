@@ -0,0 +1,4 @@
+// Package policy lets distributions of the registry reject pushes, tag
+// deletions and blob mounts with compiled-in hooks. A hook is registered from
+// an init function of a package that is linked into the registry binary.
+package policy
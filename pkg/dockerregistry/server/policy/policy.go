@@ -0,0 +1,143 @@
+package policy
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/opencontainers/go-digest"
+)
+
+// Hook is invoked before the registry changes a repository. An error rejects
+// the operation. Errors of the type errcode.Error are sent to the client as
+// is, other errors are sent as DENIED errors.
+//
+// The repository names are in the form namespace/name.
+type Hook interface {
+	// PutManifest is invoked when the manifest with the digest dgst is pushed
+	// into the repository. The manifest is already verified. The tag is empty
+	// if the manifest is pushed by digest.
+	PutManifest(ctx context.Context, repo string, tag string, manifest distribution.Manifest, dgst digest.Digest) error
+
+	// Tag is invoked when the tag of the repository is moved to the
+	// manifest desc by a push.
+	Tag(ctx context.Context, repo string, tag string, desc distribution.Descriptor) error
+
+	// Untag is invoked when the tag of the repository is deleted.
+	Untag(ctx context.Context, repo string, tag string) error
+
+	// MountBlob is invoked when the blob from is mounted into the
+	// repository.
+	MountBlob(ctx context.Context, repo string, from reference.Canonical) error
+}
+
+// NopHook allows every operation. It can be embedded into hooks that
+// implement only some of the methods.
+type NopHook struct{}
+
+var _ Hook = NopHook{}
+
+func (NopHook) PutManifest(ctx context.Context, repo string, tag string, manifest distribution.Manifest, dgst digest.Digest) error {
+	return nil
+}
+
+func (NopHook) Tag(ctx context.Context, repo string, tag string, desc distribution.Descriptor) error {
+	return nil
+}
+
+func (NopHook) Untag(ctx context.Context, repo string, tag string) error {
+	return nil
+}
+
+func (NopHook) MountBlob(ctx context.Context, repo string, from reference.Canonical) error {
+	return nil
+}
+
+var (
+	mu    sync.Mutex
+	hooks = map[string]Hook{}
+)
+
+// Register makes the hook available under the name. It returns an error if
+// another hook is registered under the same name.
+func Register(name string, hook Hook) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := hooks[name]; ok {
+		return fmt.Errorf("policy hook %q is already registered", name)
+	}
+	hooks[name] = hook
+	return nil
+}
+
+// Registered returns the registered hooks ordered by their names.
+func Registered() Hooks {
+	mu.Lock()
+	defer mu.Unlock()
+
+	names := make([]string, 0, len(hooks))
+	for name := range hooks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var result Hooks
+	for _, name := range names {
+		result = append(result, hooks[name])
+	}
+	return result
+}
+
+// Hooks invokes several hooks in order. The first rejection stops the
+// invocation.
+type Hooks []Hook
+
+var _ Hook = Hooks(nil)
+
+func (hs Hooks) PutManifest(ctx context.Context, repo string, tag string, manifest distribution.Manifest, dgst digest.Digest) error {
+	for _, h := range hs {
+		if err := h.PutManifest(ctx, repo, tag, manifest, dgst); err != nil {
+			return denied(err)
+		}
+	}
+	return nil
+}
+
+func (hs Hooks) Tag(ctx context.Context, repo string, tag string, desc distribution.Descriptor) error {
+	for _, h := range hs {
+		if err := h.Tag(ctx, repo, tag, desc); err != nil {
+			return denied(err)
+		}
+	}
+	return nil
+}
+
+func (hs Hooks) Untag(ctx context.Context, repo string, tag string) error {
+	for _, h := range hs {
+		if err := h.Untag(ctx, repo, tag); err != nil {
+			return denied(err)
+		}
+	}
+	return nil
+}
+
+func (hs Hooks) MountBlob(ctx context.Context, repo string, from reference.Canonical) error {
+	for _, h := range hs {
+		if err := h.MountBlob(ctx, repo, from); err != nil {
+			return denied(err)
+		}
+	}
+	return nil
+}
+
+// denied converts errors that are not registry errors into DENIED errors.
+func denied(err error) error {
+	if _, ok := err.(errcode.Error); ok {
+		return err
+	}
+	return errcode.ErrorCodeDenied.WithMessage(err.Error())
+}
@@ -0,0 +1,77 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	v2 "github.com/distribution/distribution/v3/registry/api/v2"
+)
+
+// untagHook records the invocations of Untag and returns err.
+type untagHook struct {
+	NopHook
+
+	calls *[]string
+	name  string
+	err   error
+}
+
+func (h untagHook) Untag(ctx context.Context, repo string, tag string) error {
+	*h.calls = append(*h.calls, h.name)
+	return h.err
+}
+
+func TestHooks(t *testing.T) {
+	ctx := context.Background()
+
+	var calls []string
+	hs := Hooks{
+		untagHook{calls: &calls, name: "first"},
+		untagHook{calls: &calls, name: "second", err: errors.New("tags of releases cannot be deleted")},
+		untagHook{calls: &calls, name: "third"},
+	}
+
+	err := hs.Untag(ctx, "ns/app", "v1")
+	if e, ok := err.(errcode.Error); !ok || e.Code != errcode.ErrorCodeDenied || e.Message != "tags of releases cannot be deleted" {
+		t.Errorf("got error %#+v, want a DENIED error with the message of the hook", err)
+	}
+	if len(calls) != 2 || calls[0] != "first" || calls[1] != "second" {
+		t.Errorf("got calls %v, want the hooks up to the first rejection", calls)
+	}
+
+	registryErr := v2.ErrorCodeTagInvalid.WithDetail("v1")
+	hs = Hooks{untagHook{calls: &calls, err: registryErr}}
+	if err := hs.Untag(ctx, "ns/app", "v1"); err != registryErr {
+		t.Errorf("got error %#+v, want %#+v", err, registryErr)
+	}
+
+	if err := Hooks(nil).PutManifest(ctx, "ns/app", "latest", nil, ""); err != nil {
+		t.Errorf("unexpected error without hooks: %v", err)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	defer func() {
+		hooks = map[string]Hook{}
+	}()
+
+	var calls []string
+	if err := Register("b", untagHook{calls: &calls, name: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Register("a", untagHook{calls: &calls, name: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Register("a", NopHook{}); err == nil {
+		t.Error("expected an error for a duplicate name")
+	}
+
+	if err := Registered().Untag(context.Background(), "ns/app", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 2 || calls[0] != "a" || calls[1] != "b" {
+		t.Errorf("got calls %v, want the hooks ordered by name", calls)
+	}
+}
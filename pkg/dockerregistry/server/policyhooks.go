@@ -0,0 +1,35 @@
+package server
+
+import (
+	"context"
+
+	"github.com/distribution/distribution/v3"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/policy"
+)
+
+// policyBlobStore lets the policy hooks reject blob mounts.
+type policyBlobStore struct {
+	distribution.BlobStore
+
+	hooks policy.Hooks
+	repo  string
+}
+
+var _ distribution.BlobStore = &policyBlobStore{}
+
+func (bs *policyBlobStore) Create(ctx context.Context, options ...distribution.BlobCreateOption) (distribution.BlobWriter, error) {
+	var opts distribution.CreateOptions
+	for _, option := range options {
+		// The options of other types are applied by the wrapped blob store.
+		_ = option.Apply(&opts)
+	}
+
+	if opts.Mount.ShouldMount {
+		if err := bs.hooks.MountBlob(ctx, bs.repo, opts.Mount.From); err != nil {
+			return nil, err
+		}
+	}
+
+	return bs.BlobStore.Create(ctx, options...)
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/policy"
+	"github.com/openshift/image-registry/pkg/testutil"
+)
+
+// namespaceMountHook rejects the blob mounts across namespaces.
+type namespaceMountHook struct {
+	policy.NopHook
+}
+
+func (namespaceMountHook) MountBlob(ctx context.Context, repo string, from reference.Canonical) error {
+	fromNamespace, _, _ := strings.Cut(from.Name(), "/")
+	namespace, _, _ := strings.Cut(repo, "/")
+	if fromNamespace != namespace {
+		return fmt.Errorf("%s cannot be mounted into %s", from, repo)
+	}
+	return nil
+}
+
+func TestPolicyBlobStore(t *testing.T) {
+	ctx := context.Background()
+	dgst := digest.FromString("blob")
+
+	for _, tc := range []struct {
+		name         string
+		from         string
+		expectDenied bool
+	}{
+		{
+			name: "upload",
+		},
+		{
+			name: "mount from the same namespace",
+			from: "ns1/base",
+		},
+		{
+			name:         "mount from another namespace",
+			from:         "ns2/base",
+			expectDenied: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := testutil.NewFakeBlobStore(nil, nil)
+			bs := &policyBlobStore{
+				BlobStore: fake,
+				hooks:     policy.Hooks{namespaceMountHook{}},
+				repo:      "ns1/app",
+			}
+
+			var options []distribution.BlobCreateOption
+			if tc.from != "" {
+				named, err := reference.WithName(tc.from)
+				if err != nil {
+					t.Fatal(err)
+				}
+				canonical, err := reference.WithDigest(named, dgst)
+				if err != nil {
+					t.Fatal(err)
+				}
+				options = append(options, storage.WithMountFrom(canonical))
+			}
+
+			_, err := bs.Create(ctx, options...)
+			if tc.expectDenied {
+				if e, ok := err.(errcode.Error); !ok || e.Code != errcode.ErrorCodeDenied {
+					t.Errorf("got error %v, want a DENIED error", err)
+				}
+				if calls := fake.Calls("Create"); calls != 0 {
+					t.Errorf("got %d calls of the wrapped blob store, want 0", calls)
+				}
+				return
+			}
+			if calls := fake.Calls("Create"); calls != 1 {
+				t.Errorf("got %d calls of the wrapped blob store, want 1", calls)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"net/http"
+	"net/http/pprof"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/registry/auth"
+	"github.com/distribution/distribution/v3/registry/handlers"
+	gorillahandlers "github.com/gorilla/handlers"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/api"
+)
+
+// RegisterProfilingHandler registers the pprof endpoint as a registry
+// extension. The endpoint is protected by the registry authorization.
+func RegisterProfilingHandler(app *handlers.App) {
+	getProfilingAccess := func(r *http.Request) []auth.Access {
+		return []auth.Access{
+			{
+				Resource: auth.Resource{
+					Type: "profiling",
+				},
+				Action: "get",
+			},
+		}
+	}
+	extensionsRouter := app.NewRoute().PathPrefix(api.ExtensionsPrefix).Subrouter()
+	app.RegisterRoute(
+		"extensions-profiling",
+		extensionsRouter.Path(api.ProfilingPath).Methods("GET"),
+		profilingDispatcher,
+		handlers.NameNotRequired,
+		getProfilingAccess,
+	)
+}
+
+// profilingDispatcher handles the GET requests for the profiling endpoint.
+func profilingDispatcher(ctx *handlers.Context, r *http.Request) http.Handler {
+	return gorillahandlers.MethodHandler{
+		"GET": profileHandler(dcontext.GetStringValue(ctx, "vars.profile")),
+	}
+}
+
+// NewProfilingHandler returns a handler that serves the pprof endpoint at
+// /debug/pprof/ without any authorization. It is intended to be used on a
+// dedicated listener.
+func NewProfilingHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", func(w http.ResponseWriter, r *http.Request) {
+		profileHandler(r.URL.Path[len("/debug/pprof/"):]).ServeHTTP(w, r)
+	})
+	return mux
+}
+
+func profileHandler(name string) http.Handler {
+	switch name {
+	case "":
+		return http.HandlerFunc(pprof.Index)
+	case "cmdline":
+		return http.HandlerFunc(pprof.Cmdline)
+	case "profile":
+		return http.HandlerFunc(pprof.Profile)
+	case "symbol":
+		return http.HandlerFunc(pprof.Symbol)
+	case "trace":
+		return http.HandlerFunc(pprof.Trace)
+	default:
+		return pprof.Handler(name)
+	}
+}
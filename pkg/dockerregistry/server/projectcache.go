@@ -2,26 +2,45 @@ package server
 
 import (
 	"fmt"
+	"sync"
 	"time"
 
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/tools/cache"
 
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/metrics"
 	"github.com/openshift/image-registry/pkg/imagestream"
 )
 
 // projectObjectListCache implements projectObjectListStore.
 type projectObjectListCache struct {
-	store cache.Store
+	store   cache.Store
+	metrics metrics.InternalCache
+
+	// mu serializes the updates of the metrics, so that an expired entry is
+	// counted only once.
+	mu sync.Mutex
 }
 
 var _ imagestream.ProjectObjectListStore = &projectObjectListCache{}
 
 // newProjectObjectListCache creates a cache to hold object list objects that will expire with the given ttl.
-func newProjectObjectListCache(ttl time.Duration) imagestream.ProjectObjectListStore {
+func newProjectObjectListCache(ttl time.Duration, m metrics.InternalCache) imagestream.ProjectObjectListStore {
 	return &projectObjectListCache{
-		store: cache.NewTTLStore(metaProjectObjectListKeyFunc, ttl),
+		store:   cache.NewTTLStore(metaProjectObjectListKeyFunc, ttl),
+		metrics: m,
+	}
+}
+
+// hasKey reports whether the store has an entry for the namespace, expired or
+// not.
+func (c *projectObjectListCache) hasKey(namespace string) bool {
+	for _, key := range c.store.ListKeys() {
+		if key == namespace {
+			return true
+		}
 	}
+	return false
 }
 
 // add stores given list object under the given namespace. Any prior object under this
@@ -34,16 +53,33 @@ func (c *projectObjectListCache) Add(namespace string, obj runtime.Object) error
 		namespace: namespace,
 		object:    obj,
 	}
-	return c.store.Add(no)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.store.Add(no); err != nil {
+		return err
+	}
+	c.metrics.Entries(len(c.store.ListKeys()))
+	return nil
 }
 
 // get retrieves a cached list object if present and not expired.
 func (c *projectObjectListCache) Get(namespace string) (runtime.Object, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	known := c.hasKey(namespace)
 	entry, exists, err := c.store.GetByKey(namespace)
 	if err != nil {
 		return nil, exists, err
 	}
+	c.metrics.Request(exists)
 	if !exists {
+		if known {
+			// The entry is expired and removed by the store.
+			c.metrics.Evict()
+			c.metrics.Entries(len(c.store.ListKeys()))
+		}
 		return nil, false, err
 	}
 	no, ok := entry.(*namespacedObject)
@@ -20,6 +20,15 @@
 // This mode allows you to delete blobs that are no longer referenced in the etcd
 // database (garbage) from storage and reduce the used space on the storage.
 //
+// The pruning can be split into two steps for review: PlanPruner records what
+// would be deleted into a Plan, which doesn't need write access to the storage,
+// and ApplyPlan deletes the objects of the plan that are still not used.
+//
+// The images that are deleted from the API may still be used by the pods of
+// the cluster. RunningDigests, which is made by ListRunningDigests from the
+// pods or by ReadKeepList from a file, makes the pruner keep their manifests
+// and blobs, so that the nodes can pull them again.
+//
 // # RECOVERY
 //
 // This mode is opposite to the HARD PRUNE. In this mode, we try to restore metadata
@@ -0,0 +1,90 @@
+package prune
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/opencontainers/go-digest"
+
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	imageapiv1 "github.com/openshift/api/image/v1"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+)
+
+// OrphanedImages returns the names of the images that were pushed into the
+// registry by digest, but are not referenced by any image stream. Such
+// images are left by the clients that abort a push after the manifest is
+// uploaded and before it is tagged. The images are kept while they are
+// younger than minAge, as the tag may be pushed later, e.g. the tag of a
+// manifest list is pushed after its manifests. The images with digests in
+// running are kept as well.
+func OrphanedImages(ctx context.Context, oc client.Interface, minAge time.Duration, running RunningDigests) ([]string, error) {
+	logger := dcontext.GetLogger(ctx)
+
+	imageList, err := oc.Images().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error listing images: %v", err)
+	}
+	isList, err := oc.ImageStreams(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error listing image streams: %v", err)
+	}
+
+	referenced := make(map[string]bool)
+	for _, is := range isList.Items {
+		for _, tagEventList := range is.Status.Tags {
+			for _, tagEvent := range tagEventList.Items {
+				referenced[tagEvent.Image] = true
+			}
+		}
+	}
+	// The manifests of the referenced manifest lists are referenced too.
+	for _, image := range imageList.Items {
+		if !referenced[image.Name] {
+			continue
+		}
+		for _, m := range image.DockerImageManifests {
+			referenced[m.Digest] = true
+		}
+	}
+
+	var orphaned []string
+	for _, image := range imageList.Items {
+		if image.Annotations[imageapiv1.ManagedByOpenShiftAnnotation] != "true" || referenced[image.Name] {
+			continue
+		}
+		if user, ok := running[digest.Digest(image.Name)]; ok {
+			logger.Printf("Keeping the orphaned image %s, it is used by %s", image.Name, user)
+			continue
+		}
+		if age := time.Since(image.CreationTimestamp.Time); age < minAge {
+			logger.Debugf("Keeping the orphaned image %s, it is created %s ago", image.Name, age)
+			continue
+		}
+		orphaned = append(orphaned, image.Name)
+	}
+	sort.Strings(orphaned)
+	return orphaned, nil
+}
+
+// DeleteImages deletes the images from the API. The blobs of the images
+// become unused and are deleted by Prune.
+func DeleteImages(ctx context.Context, oc client.Interface, names []string) error {
+	logger := dcontext.GetLogger(ctx)
+
+	for _, name := range names {
+		logger.Printf("Deleting the image %s", name)
+		err := oc.Images().Delete(ctx, name, metav1.DeleteOptions{})
+		if kerrors.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("failed to delete the image %s: %v", name, err)
+		}
+	}
+	return nil
+}
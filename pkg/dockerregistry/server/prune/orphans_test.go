@@ -0,0 +1,82 @@
+package prune
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	imageapiv1 "github.com/openshift/api/image/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	registryclient "github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+	"github.com/openshift/image-registry/pkg/testutil"
+)
+
+func TestOrphanedImages(t *testing.T) {
+	ctx := testutil.WithTestLogger(context.Background(), t)
+	fos, imageClient := testutil.NewFakeOpenShiftWithClient(ctx)
+
+	old := metav1.NewTime(time.Now().Add(-2 * time.Hour))
+	young := metav1.NewTime(time.Now())
+	managed := map[string]string{imageapiv1.ManagedByOpenShiftAnnotation: "true"}
+
+	tagged := digest.FromString("tagged").String()
+	child := digest.FromString("child").String()
+	orphaned := digest.FromString("orphaned").String()
+	for _, image := range []imageapiv1.Image{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: tagged, Annotations: managed, CreationTimestamp: old},
+			DockerImageManifests: []imageapiv1.ImageManifest{
+				{Digest: child},
+			},
+		},
+		{ObjectMeta: metav1.ObjectMeta{Name: child, Annotations: managed, CreationTimestamp: old}},
+		{ObjectMeta: metav1.ObjectMeta{Name: orphaned, Annotations: managed, CreationTimestamp: old}},
+		{ObjectMeta: metav1.ObjectMeta{Name: digest.FromString("young").String(), Annotations: managed, CreationTimestamp: young}},
+		{ObjectMeta: metav1.ObjectMeta{Name: digest.FromString("imported").String(), CreationTimestamp: old}},
+		{ObjectMeta: metav1.ObjectMeta{Name: digest.FromString("running").String(), Annotations: managed, CreationTimestamp: old}},
+	} {
+		testutil.AddUntaggedImage(t, fos, &image)
+	}
+	if _, err := fos.CreateImageStream("ns-test", &imageapiv1.ImageStream{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns-test", Name: "is-test"},
+		Status: imageapiv1.ImageStreamStatus{
+			Tags: []imageapiv1.NamedTagEventList{
+				{Tag: "latest", Items: []imageapiv1.TagEvent{{Image: tagged}}},
+			},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	oc, err := registryclient.NewFakeRegistryClient(imageClient).Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	running := RunningDigests{digest.FromString("running"): "the keep list"}
+	images, err := OrphanedImages(ctx, oc, time.Hour, running)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{orphaned}; !reflect.DeepEqual(images, want) {
+		t.Fatalf("got the orphaned images %v, want %v", images, want)
+	}
+
+	if err := DeleteImages(ctx, oc, images); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fos.GetImage(orphaned); !kerrors.IsNotFound(err) {
+		t.Errorf("got %v for the deleted image, want NotFound", err)
+	}
+	if _, err := fos.GetImage(tagged); err != nil {
+		t.Errorf("the tagged image is deleted: %v", err)
+	}
+
+	// The images that are already deleted are skipped.
+	if err := DeleteImages(ctx, oc, images); err != nil {
+		t.Errorf("deleting the deleted image: %v", err)
+	}
+}
@@ -0,0 +1,218 @@
+package prune
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
+
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+	imageref "github.com/openshift/library-go/pkg/image/reference"
+)
+
+// ErrReadOnly is returned on writes to a storage driver wrapped by
+// ReadOnlyDriver.
+var ErrReadOnly = errors.New("the storage is read-only")
+
+// Plan is the list of objects that the pruner would delete. It allows to
+// review the pruning before the data is deleted.
+type Plan struct {
+	Repositories  []string           `json:"repositories,omitempty"`
+	ManifestLinks []PlanManifestLink `json:"manifestLinks,omitempty"`
+	Blobs         []digest.Digest    `json:"blobs,omitempty"`
+}
+
+// PlanManifestLink is a manifest link in a repository.
+type PlanManifestLink struct {
+	Repository string        `json:"repository"`
+	Digest     digest.Digest `json:"digest"`
+}
+
+// ReadPlan reads a plan in the format of WritePlan.
+func ReadPlan(r io.Reader) (*Plan, error) {
+	plan := &Plan{}
+	if err := json.NewDecoder(r).Decode(plan); err != nil {
+		return nil, fmt.Errorf("unable to read the prune plan: %w", err)
+	}
+	return plan, nil
+}
+
+// WritePlan writes plan as JSON.
+func WritePlan(w io.Writer, plan *Plan) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(plan); err != nil {
+		return fmt.Errorf("unable to write the prune plan: %w", err)
+	}
+	return nil
+}
+
+// PlanPruner records the objects that would be deleted into Plan. It
+// doesn't change the storage, so it can be used with a read-only snapshot of
+// the storage.
+type PlanPruner struct {
+	Plan Plan
+}
+
+var _ Pruner = &PlanPruner{}
+
+func (p *PlanPruner) DeleteRepository(ctx context.Context, reponame string) error {
+	p.Plan.Repositories = append(p.Plan.Repositories, reponame)
+	return nil
+}
+
+func (p *PlanPruner) DeleteManifestLink(ctx context.Context, svc distribution.ManifestService, reponame string, dgst digest.Digest) error {
+	p.Plan.ManifestLinks = append(p.Plan.ManifestLinks, PlanManifestLink{Repository: reponame, Digest: dgst})
+	return nil
+}
+
+func (p *PlanPruner) DeleteBlob(ctx context.Context, dgst digest.Digest) error {
+	p.Plan.Blobs = append(p.Plan.Blobs, dgst)
+	return nil
+}
+
+// DeleteBlobVersions does nothing, the versions of the blobs of the plan are
+// deleted when the plan is applied to a storage that keeps them.
+func (p *PlanPruner) DeleteBlobVersions(ctx context.Context, versions BlobVersions, dgst digest.Digest) error {
+	return nil
+}
+
+// ApplyPlan deletes the objects of plan using pruner.
+//
+// The cluster may have changed since the plan was made, so the objects that
+// are used again are kept. The manifest links of the digests in running are
+// kept with the blobs that they reference, as Prune does. The manifest links
+// and the blobs that don't exist anymore are skipped.
+//
+// On error, the Summary will contain what was deleted so far.
+func ApplyPlan(ctx context.Context, registry distribution.Namespace, registryClient client.RegistryClient, pruner Pruner, plan *Plan, versions BlobVersions, running RunningDigests) (Summary, error) {
+	logger := dcontext.GetLogger(ctx)
+
+	oc, err := registryClient.Client()
+	if err != nil {
+		return Summary{}, fmt.Errorf("error getting clients: %v", err)
+	}
+
+	inuse, err := imagesInUse(ctx, oc)
+	if err != nil {
+		return Summary{}, err
+	}
+
+	var stats Summary
+
+	for _, link := range plan.ManifestLinks {
+		ref, err := imageref.Parse(link.Repository)
+		if err != nil {
+			return stats, fmt.Errorf("failed to parse the image reference %s: %v", link.Repository, err)
+		}
+		if _, ok := inuse[string(link.Digest)]; ok {
+			is, err := oc.ImageStreams(ref.Namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+			if err != nil && !kerrors.IsNotFound(err) {
+				return stats, fmt.Errorf("failed to get the image stream %s: %v", link.Repository, err)
+			}
+			if err == nil && imageStreamHasManifestDigest(is, link.Digest) {
+				logger.Printf("Keeping the manifest link %s@%s, it is used again", link.Repository, link.Digest)
+				continue
+			}
+		}
+
+		named, err := reference.WithName(link.Repository)
+		if err != nil {
+			return stats, fmt.Errorf("failed to parse the repo name %s: %v", link.Repository, err)
+		}
+		repository, err := registry.Repository(ctx, named)
+		if err != nil {
+			return stats, err
+		}
+		manifestService, err := repository.Manifests(ctx)
+		if err != nil {
+			return stats, err
+		}
+		if ok, err := manifestService.Exists(ctx, link.Digest); err != nil {
+			return stats, err
+		} else if !ok {
+			logger.Printf("Skipped the manifest link %s@%s, it doesn't exist", link.Repository, link.Digest)
+			continue
+		}
+		if user, ok := running[link.Digest]; ok {
+			logger.Printf("Keeping the manifest link %s@%s, it is used by %s", link.Repository, link.Digest, user)
+			keepManifestReferences(ctx, manifestService, link.Repository, link.Digest, user, inuse)
+			continue
+		}
+		if err := pruner.DeleteManifestLink(ctx, manifestService, link.Repository, link.Digest); err != nil {
+			return stats, err
+		}
+	}
+
+	for _, repoName := range plan.Repositories {
+		ref, err := imageref.Parse(repoName)
+		if err != nil {
+			return stats, fmt.Errorf("failed to parse the image reference %s: %v", repoName, err)
+		}
+		// Repositories with invalid names can't have image streams.
+		if ers := rest.IsValidPathSegmentName(ref.Name); len(ers) == 0 {
+			_, err := oc.ImageStreams(ref.Namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+			if err == nil {
+				logger.Printf("Keeping the repository %s, the image stream %s/%s exists", repoName, ref.Namespace, ref.Name)
+				continue
+			} else if !kerrors.IsNotFound(err) {
+				return stats, fmt.Errorf("failed to get the image stream %s: %v", repoName, err)
+			}
+		}
+		if err := pruner.DeleteRepository(ctx, repoName); err != nil {
+			return stats, err
+		}
+	}
+
+	blobStatter := registry.BlobStatter()
+	for _, dgst := range plan.Blobs {
+		if imageReference, ok := inuse[string(dgst)]; ok {
+			logger.Printf("Keeping the blob %s, it belongs to the image %s", dgst, imageReference)
+			continue
+		}
+		if err := deleteBlob(ctx, blobStatter, pruner, versions, dgst, &stats); err == distribution.ErrBlobUnknown {
+			logger.Printf("Skipped the blob %s, it doesn't exist", dgst)
+		} else if err != nil {
+			return stats, err
+		}
+	}
+
+	return stats, nil
+}
+
+// ReadOnlyDriver returns a storage driver that fails on writes to d. It
+// ensures that the pruner doesn't change the storage when it makes a plan.
+func ReadOnlyDriver(d driver.StorageDriver) driver.StorageDriver {
+	return &readOnlyDriver{StorageDriver: d}
+}
+
+type readOnlyDriver struct {
+	driver.StorageDriver
+}
+
+func (d *readOnlyDriver) PutContent(ctx context.Context, path string, content []byte) error {
+	return ErrReadOnly
+}
+
+func (d *readOnlyDriver) Writer(ctx context.Context, path string, append bool) (driver.FileWriter, error) {
+	return nil, ErrReadOnly
+}
+
+func (d *readOnlyDriver) Move(ctx context.Context, sourcePath string, destPath string) error {
+	return ErrReadOnly
+}
+
+func (d *readOnlyDriver) Delete(ctx context.Context, path string) error {
+	return ErrReadOnly
+}
@@ -0,0 +1,88 @@
+package prune
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
+
+	registryclient "github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+	"github.com/openshift/image-registry/pkg/testutil"
+)
+
+func TestPrunePlan(t *testing.T) {
+	ctx := context.Background()
+	ctx = testutil.WithTestLogger(ctx, t)
+	storageDriver := inmemory.New()
+	fos, imageClient := testutil.NewFakeOpenShiftWithClient(ctx)
+	reg, err := storage.NewRegistry(ctx, storageDriver)
+	if err != nil {
+		t.Fatalf("error creating registry: %v", err)
+	}
+
+	image1 := populateRegistry(ctx, t, fos, reg, "ns-test", "is-test", "latest")
+	danglingBlob := createBlob(ctx, t, reg, "ns-test", "this-is-has-been-deleted", "latest")
+
+	readOnlyReg, err := storage.NewRegistry(ctx, ReadOnlyDriver(storageDriver))
+	if err != nil {
+		t.Fatalf("error creating registry: %v", err)
+	}
+	planPruner := &PlanPruner{}
+	stats, err := Prune(ctx, readOnlyReg, registryclient.NewFakeRegistryClient(imageClient), planPruner, nil, nil)
+	if err != nil {
+		t.Fatalf("error calling Prune: %s", err)
+	}
+	if stats.Blobs != 1 {
+		t.Errorf("got %d blobs in the plan, want 1", stats.Blobs)
+	}
+	if len(planPruner.Plan.Blobs) != 1 || planPruner.Plan.Blobs[0] != danglingBlob.Digest {
+		t.Errorf("got blobs %v in the plan, want %s", planPruner.Plan.Blobs, danglingBlob.Digest)
+	}
+
+	statter := reg.BlobStatter()
+	if _, err := statter.Stat(ctx, danglingBlob.Digest); err != nil {
+		t.Fatalf("expected the blob to be kept by the plan, got %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := WritePlan(&buf, &planPruner.Plan); err != nil {
+		t.Fatal(err)
+	}
+	plan, err := ReadPlan(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The layer of the image is used, it is kept even if it is in the plan.
+	layer := digest.Digest(image1.DockerImageLayers[0].Name)
+	plan.Blobs = append(plan.Blobs, layer)
+
+	pruner := &RegistryPruner{StorageDriver: storageDriver}
+	stats, err = ApplyPlan(ctx, reg, registryclient.NewFakeRegistryClient(imageClient), pruner, plan, nil, nil)
+	if err != nil {
+		t.Fatalf("error calling ApplyPlan: %s", err)
+	}
+	if stats.Blobs != 1 || stats.DiskSpace != danglingBlob.Size {
+		t.Errorf("got %#+v, want 1 deleted blob of %d bytes", stats, danglingBlob.Size)
+	}
+
+	if _, err := statter.Stat(ctx, layer); err != nil {
+		t.Errorf("error retrieving blob %q: %#v", layer, err)
+	}
+	if _, err := statter.Stat(ctx, danglingBlob.Digest); err != distribution.ErrBlobUnknown {
+		t.Errorf("expected error to be distribution.ErrBlobUnknown, got %#v", err)
+	}
+
+	// The plan was applied, so there is nothing to delete anymore.
+	stats, err = ApplyPlan(ctx, reg, registryclient.NewFakeRegistryClient(imageClient), pruner, plan, nil, nil)
+	if err != nil {
+		t.Fatalf("error calling ApplyPlan again: %s", err)
+	}
+	if stats.Blobs != 0 {
+		t.Errorf("got %d deleted blobs, want 0", stats.Blobs)
+	}
+}
@@ -2,6 +2,7 @@ package prune
 
 import (
 	"context"
+	"errors"
 	"fmt"
 
 	"github.com/distribution/distribution/v3"
@@ -30,6 +31,7 @@ type Pruner interface {
 	DeleteRepository(ctx context.Context, reponame string) error
 	DeleteManifestLink(ctx context.Context, svc distribution.ManifestService, reponame string, dgst digest.Digest) error
 	DeleteBlob(ctx context.Context, dgst digest.Digest) error
+	DeleteBlobVersions(ctx context.Context, versions BlobVersions, dgst digest.Digest) error
 }
 
 // DryRunPruner prints information about each object that going to remove.
@@ -55,9 +57,18 @@ func (p *DryRunPruner) DeleteBlob(ctx context.Context, dgst digest.Digest) error
 	return nil
 }
 
+func (p *DryRunPruner) DeleteBlobVersions(ctx context.Context, versions BlobVersions, dgst digest.Digest) error {
+	logger := dcontext.GetLogger(ctx)
+	logger.Printf("Would delete versions of blob: %s", dgst)
+	return nil
+}
+
 // RegistryPruner deletes objects.
 type RegistryPruner struct {
 	StorageDriver driver.StorageDriver
+
+	// Trash keeps the data of the deleted blobs if it is not nil.
+	Trash *regstorage.Trash
 }
 
 var _ Pruner = &RegistryPruner{}
@@ -88,6 +99,14 @@ func (p *RegistryPruner) DeleteManifestLink(ctx context.Context, svc distributio
 
 // DeleteBlob removes a blob from the storage
 func (p *RegistryPruner) DeleteBlob(ctx context.Context, dgst digest.Digest) error {
+	if p.Trash != nil {
+		// Log message will be generated by Add with loglevel=info.
+		if err := p.Trash.Add(ctx, dgst); err != nil {
+			return fmt.Errorf("failed to move the blob %s to the trash: %v", dgst, err)
+		}
+		return nil
+	}
+
 	vacuum := storage.NewVacuum(ctx, p.StorageDriver)
 
 	// Log message will be generated by RemoveBlob with loglevel=info.
@@ -98,6 +117,18 @@ func (p *RegistryPruner) DeleteBlob(ctx context.Context, dgst digest.Digest) err
 	return nil
 }
 
+// DeleteBlobVersions removes the previous versions of a blob from the storage
+func (p *RegistryPruner) DeleteBlobVersions(ctx context.Context, versions BlobVersions, dgst digest.Digest) error {
+	logger := dcontext.GetLogger(ctx)
+
+	logger.Printf("Deleting versions of blob: %s", dgst)
+	if err := versions.DeleteVersions(ctx, dgst); err != nil {
+		return fmt.Errorf("failed to delete the versions of the blob %s: %w", dgst, err)
+	}
+
+	return nil
+}
+
 // garbageCollector holds objects for later deletion. If the object is replaced,
 // then the previous one will be deleted.
 type garbageCollector struct {
@@ -162,31 +193,12 @@ func imageStreamHasManifestDigest(is *imageapiv1.ImageStream, dgst digest.Digest
 	return false
 }
 
-// Summary is cumulative information about what was pruned.
-type Summary struct {
-	Blobs     int
-	DiskSpace int64
-}
-
-// Prune removes blobs which are not used by Images in OpenShift.
-//
-// On error, the Summary will contain what was deleted so far.
-//
-// TODO(dmage): remove layer links to a blob if the blob is removed or it doesn't belong to the ImageStream.
-// TODO(dmage): keep young blobs (distribution/distribution#2297).
-func Prune(ctx context.Context, registry distribution.Namespace, registryClient client.RegistryClient, pruner Pruner) (Summary, error) {
-	logger := dcontext.GetLogger(ctx)
-
-	enumStorage := regstorage.Enumerator{Registry: registry}
-
-	oc, err := registryClient.Client()
-	if err != nil {
-		return Summary{}, fmt.Errorf("error getting clients: %v", err)
-	}
-
+// imagesInUse returns the digests of the manifests, configs and layers of the
+// Images in OpenShift mapped to the references of the images.
+func imagesInUse(ctx context.Context, oc client.Interface) (map[string]string, error) {
 	imageList, err := oc.Images().List(ctx, metav1.ListOptions{})
 	if err != nil {
-		return Summary{}, fmt.Errorf("error listing images: %v", err)
+		return nil, fmt.Errorf("error listing images: %v", err)
 	}
 
 	inuse := make(map[string]string)
@@ -195,7 +207,7 @@ func Prune(ctx context.Context, registry distribution.Namespace, registryClient
 		inuse[image.Name] = image.DockerImageReference
 
 		if err := imageutil.ImageWithMetadata(&image); err != nil {
-			return Summary{}, fmt.Errorf("error getting image metadata: %v", err)
+			return nil, fmt.Errorf("error getting image metadata: %v", err)
 		}
 		// Keep the config for a schema 2 and OCI manifests.
 		if image.DockerImageManifestMediaType == schema2.MediaTypeManifest || image.DockerImageManifestMediaType == ociv1.MediaTypeImageManifest {
@@ -211,6 +223,84 @@ func Prune(ctx context.Context, registry distribution.Namespace, registryClient
 		}
 	}
 
+	return inuse, nil
+}
+
+// deleteBlob deletes the blob dgst and its versions, and adds it to stats.
+func deleteBlob(ctx context.Context, blobStatter distribution.BlobStatter, pruner Pruner, versions BlobVersions, dgst digest.Digest, stats *Summary) error {
+	logger := dcontext.GetLogger(ctx)
+
+	desc, err := blobStatter.Stat(ctx, dgst)
+	if err != nil {
+		return err
+	}
+
+	var retained int64
+	if versions != nil {
+		retained, err = versions.Retained(ctx, dgst)
+		if err != nil {
+			return err
+		}
+	}
+
+	stats.Blobs++
+	stats.DiskSpace += desc.Size
+	stats.RetainedDiskSpace += retained
+
+	if err := pruner.DeleteBlob(ctx, dgst); err != nil {
+		return err
+	}
+
+	if versions != nil {
+		if err := pruner.DeleteBlobVersions(ctx, versions, dgst); errors.Is(err, ErrRetained) {
+			logger.Warnf("Some data of the blob %s is not removed: %v", dgst, err)
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Summary is cumulative information about what was pruned.
+type Summary struct {
+	Blobs     int
+	DiskSpace int64
+	// RetainedDiskSpace is the part of DiskSpace that is not reclaimed as
+	// the storage retains the data of the deleted blobs.
+	RetainedDiskSpace int64
+}
+
+// Prune removes blobs which are not used by Images in OpenShift.
+//
+// If versions is not nil, the storage keeps the data of deleted objects, so
+// the previous versions of the removed blobs are deleted too. The versions
+// that are protected by retention settings are reported, but they don't
+// stop the pruning.
+//
+// If running is not nil, the manifests with its digests are kept in all
+// repositories together with the blobs that they reference, even if their
+// images are deleted from the API.
+//
+// On error, the Summary will contain what was deleted so far.
+//
+// TODO(dmage): remove layer links to a blob if the blob is removed or it doesn't belong to the ImageStream.
+// TODO(dmage): keep young blobs (distribution/distribution#2297).
+func Prune(ctx context.Context, registry distribution.Namespace, registryClient client.RegistryClient, pruner Pruner, versions BlobVersions, running RunningDigests) (Summary, error) {
+	logger := dcontext.GetLogger(ctx)
+
+	enumStorage := regstorage.Enumerator{Registry: registry}
+
+	oc, err := registryClient.Client()
+	if err != nil {
+		return Summary{}, fmt.Errorf("error getting clients: %v", err)
+	}
+
+	inuse, err := imagesInUse(ctx, oc)
+	if err != nil {
+		return Summary{}, err
+	}
+
 	var stats Summary
 
 	// The Enumerate calls a Stat() on each file or directory in the tree before call our handler.
@@ -264,6 +354,12 @@ func Prune(ctx context.Context, registry distribution.Namespace, registryClient
 		}
 
 		err = enumStorage.Manifests(ctx, repoName, func(dgst digest.Digest) error {
+			if user, ok := running[dgst]; ok {
+				logger.Printf("Keeping the manifest link %s@%s, it is used by %s", repoName, dgst, user)
+				keepManifestReferences(ctx, manifestService, repoName, dgst, user, inuse)
+				return nil
+			}
+
 			if _, ok := inuse[string(dgst)]; ok && imageStreamHasManifestDigest(is, dgst) {
 				logger.Debugf("Keeping the manifest link %s@%s", repoName, dgst)
 				return nil
@@ -298,15 +394,7 @@ func Prune(ctx context.Context, registry distribution.Namespace, registryClient
 			return nil
 		}
 
-		desc, err := blobStatter.Stat(ctx, dgst)
-		if err != nil {
-			return err
-		}
-
-		stats.Blobs++
-		stats.DiskSpace += desc.Size
-
-		return pruner.DeleteBlob(ctx, dgst)
+		return deleteBlob(ctx, blobStatter, pruner, versions, dgst, &stats)
 	})
 	return stats, err
 }
@@ -159,7 +159,7 @@ func TestPrune(t *testing.T) {
 	danglingBlob := createBlob(ctx, t, reg, "ns-test", "this-is-has-been-deleted", "latest")
 
 	pruner := &RegistryPruner{StorageDriver: storageDriver}
-	_, err = Prune(ctx, reg, registryclient.NewFakeRegistryClient(imageClient), pruner)
+	_, err = Prune(ctx, reg, registryclient.NewFakeRegistryClient(imageClient), pruner, nil, nil)
 	if err != nil {
 		t.Fatalf("error calling Prune: %s", err)
 	}
@@ -177,3 +177,110 @@ func TestPrune(t *testing.T) {
 		t.Errorf("expected error to be distribution.ErrBlobUnknown, got %#v", err)
 	}
 }
+
+func TestUnusedBlobs(t *testing.T) {
+	ctx := context.Background()
+	ctx = testutil.WithTestLogger(ctx, t)
+	storageDriver := inmemory.New()
+	fos, imageClient := testutil.NewFakeOpenShiftWithClient(ctx)
+	reg, err := storage.NewRegistry(ctx, storageDriver)
+	if err != nil {
+		t.Fatalf("error creating registry: %v", err)
+	}
+
+	image := populateRegistry(ctx, t, fos, reg, "ns-test", "is-test", "latest")
+	danglingBlob := createBlob(ctx, t, reg, "ns-test", "this-is-has-been-deleted", "latest")
+
+	unused, total, err := UnusedBlobs(ctx, storageDriver, reg, registryclient.NewFakeRegistryClient(imageClient))
+	if err != nil {
+		t.Fatalf("error calling UnusedBlobs: %s", err)
+	}
+
+	if len(unused) != 1 || unused[0].Digest != danglingBlob.Digest || unused[0].Size != danglingBlob.Size {
+		t.Errorf("got unused blobs %+v, want only %s", unused, danglingBlob.Digest)
+	}
+	if len(unused) == 1 && unused[0].ModTime.IsZero() {
+		t.Errorf("expected the modification time of the blob %s", danglingBlob.Digest)
+	}
+	if expected := image.DockerImageLayers[0].LayerSize + danglingBlob.Size; total != expected {
+		t.Errorf("got total size %d, want %d", total, expected)
+	}
+
+	// UnusedBlobs doesn't delete anything.
+	if _, err := reg.BlobStatter().Stat(ctx, danglingBlob.Digest); err != nil {
+		t.Errorf("error retrieving blob %s: %v", danglingBlob.Digest, err)
+	}
+}
+
+type fakeBlobVersions struct {
+	retained map[digest.Digest]int64
+	deleted  []digest.Digest
+}
+
+func (v *fakeBlobVersions) Retained(ctx context.Context, dgst digest.Digest) (int64, error) {
+	return v.retained[dgst], nil
+}
+
+func (v *fakeBlobVersions) DeleteVersions(ctx context.Context, dgst digest.Digest) error {
+	v.deleted = append(v.deleted, dgst)
+	if v.retained[dgst] > 0 {
+		return fmt.Errorf("1 of 1 versions of the blob %s are %w", dgst, ErrRetained)
+	}
+	return nil
+}
+
+func TestPruneBlobVersions(t *testing.T) {
+	ctx := context.Background()
+	ctx = testutil.WithTestLogger(ctx, t)
+	storageDriver := inmemory.New()
+	fos, imageClient := testutil.NewFakeOpenShiftWithClient(ctx)
+	reg, err := storage.NewRegistry(ctx, storageDriver, storage.EnableDelete)
+	if err != nil {
+		t.Fatalf("error creating registry: %v", err)
+	}
+
+	populateRegistry(ctx, t, fos, reg, "ns-test", "is-test", "latest")
+	retainedBlob := createBlob(ctx, t, reg, "ns-test", "retained", "latest")
+	danglingBlob := createBlob(ctx, t, reg, "ns-test", "dangling", "latest")
+
+	versions := &fakeBlobVersions{
+		retained: map[digest.Digest]int64{
+			retainedBlob.Digest: retainedBlob.Size,
+		},
+	}
+
+	pruner := &RegistryPruner{StorageDriver: storageDriver}
+	stats, err := Prune(ctx, reg, registryclient.NewFakeRegistryClient(imageClient), pruner, versions, nil)
+	if err != nil {
+		t.Fatalf("error calling Prune: %s", err)
+	}
+
+	if stats.Blobs != 2 {
+		t.Errorf("got %d pruned blobs, want 2", stats.Blobs)
+	}
+	if stats.DiskSpace != retainedBlob.Size+danglingBlob.Size {
+		t.Errorf("got disk space %d, want %d", stats.DiskSpace, retainedBlob.Size+danglingBlob.Size)
+	}
+	if stats.RetainedDiskSpace != retainedBlob.Size {
+		t.Errorf("got retained disk space %d, want %d", stats.RetainedDiskSpace, retainedBlob.Size)
+	}
+	if len(versions.deleted) != 2 {
+		t.Errorf("expected the versions of 2 blobs to be deleted, got %v", versions.deleted)
+	}
+}
+
+func TestS3BlobPrefix(t *testing.T) {
+	dgst := digest.Digest("sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef")
+	for _, tc := range []struct {
+		rootDirectory string
+		expected      string
+	}{
+		{rootDirectory: "", expected: "docker/registry/v2/blobs/sha256/01/0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef/"},
+		{rootDirectory: "/registry/", expected: "registry/docker/registry/v2/blobs/sha256/01/0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef/"},
+	} {
+		v := &s3BlobVersions{rootDirectory: tc.rootDirectory}
+		if prefix := v.blobPrefix(dgst); prefix != tc.expected {
+			t.Errorf("root directory %q: got %q, want %q", tc.rootDirectory, prefix, tc.expected)
+		}
+	}
+}
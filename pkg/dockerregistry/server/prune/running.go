@@ -0,0 +1,137 @@
+package prune
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/manifest/manifestlist"
+	"github.com/distribution/distribution/v3/manifest/schema2"
+	"github.com/opencontainers/go-digest"
+	ociv1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+)
+
+// podListPageSize is the number of pods that are requested from the API
+// server at once.
+const podListPageSize = 500
+
+// RunningDigests maps the digests of the images that are used by the
+// workloads of the cluster to the descriptions of their users. The pruner
+// keeps the manifests with these digests and the blobs that they reference,
+// even if the images are deleted from the API, so that the nodes can pull
+// them again.
+type RunningDigests map[digest.Digest]string
+
+// parseRunningDigest returns the digest of s, which is either a digest or an
+// image reference by digest.
+func parseRunningDigest(s string) (digest.Digest, bool) {
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		s = s[i+1:]
+	}
+	dgst, err := digest.Parse(s)
+	return dgst, err == nil
+}
+
+func (d RunningDigests) addPod(pod *corev1.Pod) {
+	user := fmt.Sprintf("the pod %s/%s", pod.Namespace, pod.Name)
+
+	var images []string
+	for _, c := range pod.Spec.InitContainers {
+		images = append(images, c.Image)
+	}
+	for _, c := range pod.Spec.Containers {
+		images = append(images, c.Image)
+	}
+	for _, c := range pod.Spec.EphemeralContainers {
+		images = append(images, c.Image)
+	}
+	// The container runtimes report the digests of the images that are
+	// pulled by tag.
+	for _, statuses := range [][]corev1.ContainerStatus{pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses, pod.Status.EphemeralContainerStatuses} {
+		for _, status := range statuses {
+			images = append(images, status.ImageID)
+		}
+	}
+
+	for _, image := range images {
+		if dgst, ok := parseRunningDigest(image); ok {
+			d[dgst] = user
+		}
+	}
+}
+
+// ListRunningDigests returns the digests of the images of the pods in all
+// namespaces. It uses the images of the specs that are referenced by digest
+// and the image IDs reported by the container runtimes.
+func ListRunningDigests(ctx context.Context, oc client.PodsGetter) (RunningDigests, error) {
+	running := make(RunningDigests)
+	opts := metav1.ListOptions{Limit: podListPageSize}
+	for {
+		pods, err := oc.Pods(metav1.NamespaceAll).List(ctx, opts)
+		if err != nil {
+			return nil, fmt.Errorf("error listing pods: %v", err)
+		}
+		for i := range pods.Items {
+			running.addPod(&pods.Items[i])
+		}
+		if len(pods.Continue) == 0 {
+			return running, nil
+		}
+		opts.Continue = pods.Continue
+	}
+}
+
+// ReadKeepList reads the digests that must be kept from r. Every line has a
+// digest or an image reference by digest. Empty lines and lines that start
+// with # are ignored.
+func ReadKeepList(r io.Reader) (RunningDigests, error) {
+	running := make(RunningDigests)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		dgst, ok := parseRunningDigest(line)
+		if !ok {
+			return nil, fmt.Errorf("error reading the keep list: line %d: %q is neither a digest nor an image reference by digest", n, line)
+		}
+		running[dgst] = "the keep list"
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading the keep list: %v", err)
+	}
+	return running, nil
+}
+
+// keepManifestReferences adds the manifest dgst of the repository repoName,
+// the blobs that it references and the manifests of a manifest list to
+// inuse, because the manifest is used by user.
+func keepManifestReferences(ctx context.Context, svc distribution.ManifestService, repoName string, dgst digest.Digest, user string, inuse map[string]string) {
+	imageReference := fmt.Sprintf("%s@%s used by %s", repoName, dgst, user)
+	inuse[string(dgst)] = imageReference
+
+	manifest, err := svc.Get(ctx, dgst)
+	if err != nil {
+		dcontext.GetLogger(ctx).Warnf("Unable to get the manifest %s@%s, keeping only the manifest: %v", repoName, dgst, err)
+		return
+	}
+
+	for _, ref := range manifest.References() {
+		switch ref.MediaType {
+		case schema2.MediaTypeManifest, manifestlist.MediaTypeManifestList, ociv1.MediaTypeImageManifest, ociv1.MediaTypeImageIndex:
+			keepManifestReferences(ctx, svc, repoName, ref.Digest, user, inuse)
+		default:
+			inuse[string(ref.Digest)] = imageReference
+		}
+	}
+}
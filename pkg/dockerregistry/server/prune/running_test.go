@@ -0,0 +1,187 @@
+package prune
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	registryclient "github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+	"github.com/openshift/image-registry/pkg/testutil"
+)
+
+const (
+	runningDigest1 = digest.Digest("sha256:1111111111111111111111111111111111111111111111111111111111111111")
+	runningDigest2 = digest.Digest("sha256:2222222222222222222222222222222222222222222222222222222222222222")
+	runningDigest3 = digest.Digest("sha256:3333333333333333333333333333333333333333333333333333333333333333")
+)
+
+// podsClient lists the pods one per page.
+type podsClient struct {
+	pods []corev1.Pod
+}
+
+func (c *podsClient) Pods(namespace string) registryclient.PodInterface {
+	return c
+}
+
+func (c *podsClient) List(ctx context.Context, opts metav1.ListOptions) (*corev1.PodList, error) {
+	i := 0
+	if len(opts.Continue) > 0 {
+		var err error
+		if i, err = strconv.Atoi(opts.Continue); err != nil {
+			return nil, err
+		}
+	}
+	list := &corev1.PodList{}
+	if i < len(c.pods) {
+		list.Items = c.pods[i : i+1]
+	}
+	if i+1 < len(c.pods) {
+		list.Continue = strconv.Itoa(i + 1)
+	}
+	return list, nil
+}
+
+func TestReadKeepList(t *testing.T) {
+	running, err := ReadKeepList(strings.NewReader(`# images of the build farm
+` + string(runningDigest1) + `
+
+  registry.example.com/ns/app@` + string(runningDigest2) + `
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(running) != 2 || running[runningDigest1] == "" || running[runningDigest2] == "" {
+		t.Errorf("got %v, want %s and %s", running, runningDigest1, runningDigest2)
+	}
+
+	if _, err := ReadKeepList(strings.NewReader("ns/app:latest\n")); err == nil {
+		t.Error("expected an error for an image reference by tag")
+	}
+}
+
+func TestListRunningDigests(t *testing.T) {
+	ctx := context.Background()
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "ns-test",
+			Name:      "app",
+		},
+		Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{
+				{Name: "init", Image: "image-registry.openshift-image-registry.svc:5000/ns-test/init@" + string(runningDigest1)},
+			},
+			Containers: []corev1.Container{
+				{Name: "app", Image: "image-registry.openshift-image-registry.svc:5000/ns-test/app:latest"},
+			},
+		},
+		Status: corev1.PodStatus{
+			ContainerStatuses: []corev1.ContainerStatus{
+				{Name: "app", ImageID: "image-registry.openshift-image-registry.svc:5000/ns-test/app@" + string(runningDigest2)},
+			},
+		},
+	}
+	other := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "ns-other",
+			Name:      "tool",
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Name: "tool", Image: "registry.example.com/tool:latest"},
+			},
+		},
+	}
+
+	running, err := ListRunningDigests(ctx, &podsClient{pods: []corev1.Pod{pod, other}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(running) != 2 {
+		t.Fatalf("got %v, want %s and %s", running, runningDigest1, runningDigest2)
+	}
+	for _, dgst := range []digest.Digest{runningDigest1, runningDigest2} {
+		if user := running[dgst]; user != "the pod ns-test/app" {
+			t.Errorf("%s: got user %q, want the pod ns-test/app", dgst, user)
+		}
+	}
+	if _, ok := running[runningDigest3]; ok {
+		t.Errorf("unexpected digest %s", runningDigest3)
+	}
+}
+
+func TestPruneKeepsRunningImages(t *testing.T) {
+	ctx := context.Background()
+	ctx = testutil.WithTestLogger(ctx, t)
+	storageDriver := inmemory.New()
+	fos, imageClient := testutil.NewFakeOpenShiftWithClient(ctx)
+	reg, err := storage.NewRegistry(ctx, storageDriver, storage.EnableDelete)
+	if err != nil {
+		t.Fatalf("error creating registry: %v", err)
+	}
+
+	populateRegistry(ctx, t, fos, reg, "ns-test", "is-test", "latest")
+
+	// The image is deleted from the API, but a pod still uses it.
+	repo, err := reg.Repository(ctx, makeRepoRef(t, "ns-test", "is-test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer, layerDesc, err := testutil.MakeRandomLayer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.UploadBlob(ctx, repo, layerDesc, layer); err != nil {
+		t.Fatal(err)
+	}
+	config, configDesc, err := testutil.MakeManifestConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.UploadBlob(ctx, repo, configDesc, config); err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := testutil.MakeSchema2Manifest(configDesc, []distribution.Descriptor{layerDesc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := testutil.UploadManifest(ctx, repo, "", manifest); err != nil {
+		t.Fatal(err)
+	}
+	_, payload, err := manifest.Payload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestDigest := digest.FromBytes(payload)
+
+	running := RunningDigests{manifestDigest: "the pod ns-test/app"}
+	pruner := &RegistryPruner{StorageDriver: storageDriver}
+	if _, err := Prune(ctx, reg, registryclient.NewFakeRegistryClient(imageClient), pruner, nil, running); err != nil {
+		t.Fatalf("error calling Prune: %s", err)
+	}
+
+	statter := reg.BlobStatter()
+	for _, dgst := range []digest.Digest{manifestDigest, configDesc.Digest, layerDesc.Digest} {
+		if _, err := statter.Stat(ctx, dgst); err != nil {
+			t.Errorf("error retrieving blob %s: %v", dgst, err)
+		}
+	}
+
+	// Without the pod the image is pruned.
+	if _, err := Prune(ctx, reg, registryclient.NewFakeRegistryClient(imageClient), pruner, nil, nil); err != nil {
+		t.Fatalf("error calling Prune: %s", err)
+	}
+	for _, dgst := range []digest.Digest{manifestDigest, configDesc.Digest, layerDesc.Digest} {
+		if _, err := statter.Stat(ctx, dgst); err != distribution.ErrBlobUnknown {
+			t.Errorf("blob %s: expected error to be distribution.ErrBlobUnknown, got %v", dgst, err)
+		}
+	}
+}
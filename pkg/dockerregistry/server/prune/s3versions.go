@@ -0,0 +1,239 @@
+package prune
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/opencontainers/go-digest"
+)
+
+// ErrRetained is returned when some versions of a blob cannot be deleted
+// because of the retention settings of the storage.
+var ErrRetained = errors.New("retained by the object lock of the bucket")
+
+// BlobVersions manages the previous versions of blobs in storages that keep
+// the data of deleted objects, such as S3 buckets with versioning enabled.
+type BlobVersions interface {
+	// Retained returns the size of the versions of the blob dgst that
+	// cannot be deleted because of the retention settings of the storage.
+	Retained(ctx context.Context, dgst digest.Digest) (int64, error)
+
+	// DeleteVersions deletes all versions of the blob dgst, including the
+	// delete markers. It returns ErrRetained if some of the versions are
+	// protected by the retention settings of the storage.
+	DeleteVersions(ctx context.Context, dgst digest.Digest) error
+}
+
+// s3BlobVersions manages the versions of blobs in a versioned S3 bucket.
+type s3BlobVersions struct {
+	client        *s3.S3
+	bucket        string
+	rootDirectory string
+	objectLock    bool
+}
+
+var _ BlobVersions = &s3BlobVersions{}
+
+// NewS3BlobVersions returns BlobVersions for the bucket of the s3 storage
+// driver with the parameters. It returns nil if versioning has never been
+// enabled for the bucket, as then the deleted blobs are not kept.
+func NewS3BlobVersions(ctx context.Context, parameters map[string]interface{}) (BlobVersions, error) {
+	param := func(name string) string {
+		if v, ok := parameters[name]; ok && v != nil {
+			return fmt.Sprint(v)
+		}
+		return ""
+	}
+
+	bucket := param("bucket")
+	if len(bucket) == 0 {
+		return nil, fmt.Errorf("no bucket parameter provided")
+	}
+
+	awsConfig := aws.NewConfig().WithRegion(param("region"))
+	if endpoint := param("regionendpoint"); len(endpoint) > 0 {
+		awsConfig = awsConfig.WithEndpoint(endpoint)
+	}
+	if forcePathStyle := param("forcepathstyle"); len(forcePathStyle) > 0 {
+		v, err := strconv.ParseBool(forcePathStyle)
+		if err != nil {
+			return nil, fmt.Errorf("the forcepathstyle parameter should be a boolean: %v", err)
+		}
+		awsConfig = awsConfig.WithS3ForcePathStyle(v)
+	}
+	if accessKey, secretKey := param("accesskey"), param("secretkey"); len(accessKey) > 0 || len(secretKey) > 0 {
+		awsConfig = awsConfig.WithCredentials(credentials.NewStaticCredentials(accessKey, secretKey, param("sessiontoken")))
+	}
+
+	sess, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create a new session: %v", err)
+	}
+
+	return newS3BlobVersions(ctx, s3.New(sess), bucket, param("rootdirectory"))
+}
+
+func newS3BlobVersions(ctx context.Context, client *s3.S3, bucket, rootDirectory string) (BlobVersions, error) {
+	versioning, err := client.GetBucketVersioningWithContext(ctx, &s3.GetBucketVersioningInput{
+		Bucket: aws.String(bucket),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the versioning state of the bucket %s: %v", bucket, err)
+	}
+	// A bucket with suspended versioning still keeps the versions that were
+	// created while versioning was enabled.
+	if aws.StringValue(versioning.Status) == "" {
+		return nil, nil
+	}
+
+	v := &s3BlobVersions{
+		client:        client,
+		bucket:        bucket,
+		rootDirectory: rootDirectory,
+	}
+
+	lock, err := client.GetObjectLockConfigurationWithContext(ctx, &s3.GetObjectLockConfigurationInput{
+		Bucket: aws.String(bucket),
+	})
+	if err != nil && !isAWSErrorCode(err, "ObjectLockConfigurationNotFoundError") {
+		return nil, fmt.Errorf("failed to get the object lock configuration of the bucket %s: %v", bucket, err)
+	}
+	if err == nil && lock.ObjectLockConfiguration != nil {
+		v.objectLock = aws.StringValue(lock.ObjectLockConfiguration.ObjectLockEnabled) == s3.ObjectLockEnabledEnabled
+	}
+
+	dcontext.GetLogger(ctx).Infof("the bucket %s keeps versions of deleted objects (versioning: %s, object lock: %t)", bucket, aws.StringValue(versioning.Status), v.objectLock)
+
+	return v, nil
+}
+
+// blobPrefix returns the key prefix of the objects of the blob dgst. It
+// follows the layout of the blobs in the storage of the registry.
+func (v *s3BlobVersions) blobPrefix(dgst digest.Digest) string {
+	path := fmt.Sprintf("/docker/registry/v2/blobs/%s/%s/%s/", dgst.Algorithm(), dgst.Hex()[:2], dgst.Hex())
+	return strings.TrimLeft(strings.TrimRight(v.rootDirectory, "/")+path, "/")
+}
+
+func (v *s3BlobVersions) listVersions(ctx context.Context, dgst digest.Digest, fn func(key, versionID string, size int64)) error {
+	return v.client.ListObjectVersionsPagesWithContext(ctx, &s3.ListObjectVersionsInput{
+		Bucket: aws.String(v.bucket),
+		Prefix: aws.String(v.blobPrefix(dgst)),
+	}, func(page *s3.ListObjectVersionsOutput, lastPage bool) bool {
+		for _, version := range page.Versions {
+			fn(aws.StringValue(version.Key), aws.StringValue(version.VersionId), aws.Int64Value(version.Size))
+		}
+		for _, marker := range page.DeleteMarkers {
+			fn(aws.StringValue(marker.Key), aws.StringValue(marker.VersionId), 0)
+		}
+		return true
+	})
+}
+
+// isRetained returns true if the version of the object is protected by a
+// retention period or by a legal hold.
+func (v *s3BlobVersions) isRetained(ctx context.Context, key, versionID string) (bool, error) {
+	retention, err := v.client.GetObjectRetentionWithContext(ctx, &s3.GetObjectRetentionInput{
+		Bucket:    aws.String(v.bucket),
+		Key:       aws.String(key),
+		VersionId: aws.String(versionID),
+	})
+	if err != nil && !isAWSErrorCode(err, "NoSuchObjectLockConfiguration") {
+		return false, err
+	}
+	if err == nil && retention.Retention != nil && aws.TimeValue(retention.Retention.RetainUntilDate).After(time.Now()) {
+		return true, nil
+	}
+
+	legalHold, err := v.client.GetObjectLegalHoldWithContext(ctx, &s3.GetObjectLegalHoldInput{
+		Bucket:    aws.String(v.bucket),
+		Key:       aws.String(key),
+		VersionId: aws.String(versionID),
+	})
+	if err != nil && !isAWSErrorCode(err, "NoSuchObjectLockConfiguration") {
+		return false, err
+	}
+	if err == nil && legalHold.LegalHold != nil && aws.StringValue(legalHold.LegalHold.Status) == s3.ObjectLockLegalHoldStatusOn {
+		return true, nil
+	}
+
+	return false, nil
+}
+
+func (v *s3BlobVersions) Retained(ctx context.Context, dgst digest.Digest) (int64, error) {
+	if !v.objectLock {
+		return 0, nil
+	}
+
+	type objectVersion struct {
+		key, versionID string
+		size           int64
+	}
+	var versions []objectVersion
+	if err := v.listVersions(ctx, dgst, func(key, versionID string, size int64) {
+		if size > 0 {
+			versions = append(versions, objectVersion{key: key, versionID: versionID, size: size})
+		}
+	}); err != nil {
+		return 0, fmt.Errorf("failed to list the versions of the blob %s: %v", dgst, err)
+	}
+
+	var retained int64
+	for _, version := range versions {
+		ok, err := v.isRetained(ctx, version.key, version.versionID)
+		if err != nil {
+			return 0, fmt.Errorf("failed to get the retention of %s (version %s): %v", version.key, version.versionID, err)
+		}
+		if ok {
+			retained += version.size
+		}
+	}
+	return retained, nil
+}
+
+func (v *s3BlobVersions) DeleteVersions(ctx context.Context, dgst digest.Digest) error {
+	type objectVersion struct {
+		key, versionID string
+	}
+	var versions []objectVersion
+	if err := v.listVersions(ctx, dgst, func(key, versionID string, size int64) {
+		versions = append(versions, objectVersion{key: key, versionID: versionID})
+	}); err != nil {
+		return fmt.Errorf("failed to list the versions of the blob %s: %v", dgst, err)
+	}
+
+	retained := 0
+	for _, version := range versions {
+		_, err := v.client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+			Bucket:    aws.String(v.bucket),
+			Key:       aws.String(version.key),
+			VersionId: aws.String(version.versionID),
+		})
+		if v.objectLock && isAWSErrorCode(err, "AccessDenied") {
+			dcontext.GetLogger(ctx).Debugf("the version %s of %s is retained: %v", version.versionID, version.key, err)
+			retained++
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to delete %s (version %s): %v", version.key, version.versionID, err)
+		}
+	}
+	if retained > 0 {
+		return fmt.Errorf("%d of %d versions of the blob %s are %w", retained, len(versions), dgst, ErrRetained)
+	}
+	return nil
+}
+
+func isAWSErrorCode(err error, code string) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && aerr.Code() == code
+}
@@ -0,0 +1,95 @@
+package prune
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+	regstorage "github.com/openshift/image-registry/pkg/dockerregistry/server/storage"
+)
+
+// BlobInfo describes a blob in the storage.
+type BlobInfo struct {
+	Digest  digest.Digest
+	Size    int64
+	ModTime time.Time
+	// Repositories are the repositories that have layer links to the blob.
+	Repositories []string
+}
+
+// UnusedBlobs returns the blobs in the storage that are not used by Images in
+// OpenShift, and the total size of all blobs in the storage. The repositories
+// that link the unused blobs are found by walking the storage.
+//
+// Unlike Prune, it doesn't change the storage, so the caller can choose which
+// of the blobs should be deleted.
+func UnusedBlobs(ctx context.Context, storageDriver driver.StorageDriver, registry distribution.Namespace, registryClient client.RegistryClient) ([]BlobInfo, int64, error) {
+	logger := dcontext.GetLogger(ctx)
+
+	oc, err := registryClient.Client()
+	if err != nil {
+		return nil, 0, fmt.Errorf("error getting clients: %v", err)
+	}
+
+	inuse, err := imagesInUse(ctx, oc)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var unused []BlobInfo
+	var total int64
+	enumStorage := regstorage.Enumerator{Registry: registry}
+	err = enumStorage.Blobs(ctx, func(dgst digest.Digest) error {
+		fi, err := storageDriver.Stat(ctx, regstorage.BlobDataPath(dgst))
+		if _, ok := err.(driver.PathNotFoundError); ok {
+			// The blob is deleted or it isn't committed yet.
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to get the size of the blob %s: %w", dgst, err)
+		}
+
+		total += fi.Size()
+		if imageReference, ok := inuse[string(dgst)]; ok {
+			logger.Debugf("The blob %s is used by the image %s", dgst, imageReference)
+			return nil
+		}
+
+		unused = append(unused, BlobInfo{
+			Digest:  dgst,
+			Size:    fi.Size(),
+			ModTime: fi.ModTime(),
+		})
+		return nil
+	})
+	if _, ok := err.(driver.PathNotFoundError); ok {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	links, err := regstorage.LayerLinks(ctx, storageDriver)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get the layer links: %w", err)
+	}
+	for i := range unused {
+		unused[i].Repositories = links[unused[i].Digest]
+	}
+	return unused, total, nil
+}
+
+// BlobsInUse returns the digests of the manifests, configs and layers of the
+// Images in OpenShift mapped to the references of the images.
+func BlobsInUse(ctx context.Context, registryClient client.RegistryClient) (map[string]string, error) {
+	oc, err := registryClient.Client()
+	if err != nil {
+		return nil, fmt.Errorf("error getting clients: %v", err)
+	}
+	return imagesInUse(ctx, oc)
+}
@@ -13,6 +13,7 @@ import (
 	"github.com/opencontainers/go-digest"
 
 	"github.com/openshift/image-registry/pkg/dockerregistry/server/maxconnections"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/metrics"
 )
 
 // pullthroughBlobStore wraps a distribution.BlobStore and allows remote repositories to serve blobs from remote
@@ -20,10 +21,28 @@ import (
 type pullthroughBlobStore struct {
 	distribution.BlobStore
 
+	// repo is the name of the repository. The downloads of remote blobs are
+	// shared only within the repository.
+	repo string
+
 	remoteBlobGetter  BlobGetterService
 	writeLimiter      maxconnections.Limiter
 	mirror            bool
 	newLocalBlobStore func(ctx context.Context) distribution.BlobStore
+
+	// coalescing is optional.
+	coalescing metrics.Coalescing
+
+	// transfers is optional. The bytes are counted for namespace.
+	transfers metrics.BlobTransfers
+	namespace string
+
+	// mirroredImages is optional. It is notified about the mirrored blobs.
+	mirroredImages *mirroredImageAnnotator
+
+	// mirrorQueue mirrors the blobs in the background. The blobs that
+	// aren't served from a shared download are not mirrored without it.
+	mirrorQueue *mirrorQueue
 }
 
 var _ distribution.BlobStore = &pullthroughBlobStore{}
@@ -56,6 +75,16 @@ func (pbs *pullthroughBlobStore) Stat(ctx context.Context, dgst digest.Digest) (
 // [1] https://docs.docker.com/registry/spec/api/#existing-layers
 func (pbs *pullthroughBlobStore) ServeBlob(ctx context.Context, w http.ResponseWriter, req *http.Request, dgst digest.Digest) error {
 	dcontext.GetLogger(ctx).Debugf("(*pullthroughBlobStore).ServeBlob: starting with dgst=%s", dgst.String())
+
+	source := metrics.BlobSourceLocal
+	if pbs.transfers != nil {
+		cw := &countingResponseWriter{ResponseWriter: w}
+		w = cw
+		defer func() {
+			pbs.transfers.Served(pbs.namespace, source, cw.n)
+		}()
+	}
+
 	// This call should be done without BlobGetterService in the context.
 	err := pbs.BlobStore.ServeBlob(ctx, w, req, dgst)
 	switch {
@@ -69,9 +98,19 @@ func (pbs *pullthroughBlobStore) ServeBlob(ctx context.Context, w http.ResponseW
 		return err
 	}
 
+	source = metrics.BlobSourcePullthrough
+
+	// concurrent requests for the whole blob share a single download, which
+	// is also mirrored if requested
+	if shouldCoalesce(req) {
+		if served, err := pbs.serveCoalesced(ctx, w, dgst); served {
+			return err
+		}
+	}
+
 	// store the content locally if requested, but ensure only one instance at a time
 	// is storing to avoid excessive local writes
-	if pbs.mirror {
+	if pbs.mirror && pbs.mirrorQueue != nil {
 		mu.Lock()
 		if _, ok := inflight[dgst]; ok {
 			mu.Unlock()
@@ -100,6 +139,24 @@ func (pbs *pullthroughBlobStore) Get(ctx context.Context, dgst digest.Digest) ([
 	return pbs.remoteBlobGetter.Get(ctx, dgst)
 }
 
+// Open attempts to open the requested blob by digest using a remote proxy store if necessary.
+func (pbs *pullthroughBlobStore) Open(ctx context.Context, dgst digest.Digest) (distribution.ReadSeekCloser, error) {
+	dcontext.GetLogger(ctx).Debugf("(*pullthroughBlobStore).Open: starting with dgst=%s", dgst.String())
+	rsc, err := pbs.BlobStore.Open(ctx, dgst)
+	switch {
+	case err == distribution.ErrBlobUnknown:
+		// continue on to the code below and look up the blob in a remote store since it is not in
+		// the local store
+	case err != nil:
+		dcontext.GetLogger(ctx).Errorf("unable to open blob %s: %v", dgst.String(), err)
+		fallthrough
+	default:
+		return rsc, err
+	}
+
+	return pbs.remoteBlobGetter.Open(ctx, dgst)
+}
+
 // setResponseHeaders sets the appropriate content serving headers
 func setResponseHeaders(w http.ResponseWriter, length int64, mediaType string, digest digest.Digest) {
 	w.Header().Set("Content-Type", mediaType)
@@ -152,7 +209,7 @@ func copyContent(ctx context.Context, store BlobGetterService, dgst digest.Diges
 		return distribution.Descriptor{}, err
 	}
 
-	remoteReader, err := store.Open(ctx, dgst)
+	remoteReader, err := openBlobWithFailover(ctx, store, dgst, desc.Size)
 	if err != nil {
 		dcontext.GetLogger(ctx).Debugf("copyContent: BlobGetterService.Open error=%s", err)
 		return distribution.Descriptor{}, err
@@ -178,47 +235,63 @@ func copyContent(ctx context.Context, store BlobGetterService, dgst digest.Diges
 	return desc, nil
 }
 
-// storeLocalInBackground spawns a separate thread to copy the remote blob from the remote registry to the
-// local blob store.
+// storeLocalInBackground queues the copy of the remote blob from the remote registry to the
+// local blob store. The blob is removed from inflight when the mirroring is finished or dropped.
 // The function assumes that localBlobStore is thread-safe.
 func (pbs *pullthroughBlobStore) storeLocalInBackground(ctx context.Context, dgst digest.Digest) {
 	// leave only the essential entries in the context (logger)
 	newCtx := dcontext.WithLogger(context.Background(), dcontext.GetLogger(ctx))
 
+	// the size is used to mirror the small blobs first, the descriptor is
+	// usually cached by the Stat of the request
+	var size int64 = -1
+	if desc, err := pbs.remoteBlobGetter.Stat(ctx, dgst); err == nil {
+		size = desc.Size
+	}
+
 	localBlobStore := pbs.newLocalBlobStore(newCtx)
-	writeLimiter := pbs.writeLimiter
 	remoteGetter := pbs.remoteBlobGetter
-
-	go func(dgst digest.Digest) {
-		if writeLimiter != nil {
-			if !writeLimiter.Start(newCtx) {
-				dcontext.GetLogger(newCtx).Infof("Skipped background mirroring of %q because write limits are reached", dgst)
-				return
+	transfers := pbs.transfers
+	namespace := pbs.namespace
+	mirroredImages := pbs.mirroredImages
+
+	pbs.mirrorQueue.enqueue(&mirrorJob{
+		ctx:       newCtx,
+		dgst:      dgst,
+		namespace: namespace,
+		size:      size,
+		mirror: func(ctx context.Context) error {
+			// a retried blob may have been stored by another request
+			if _, err := localBlobStore.Stat(ctx, dgst); err == nil {
+				return nil
 			}
-			defer writeLimiter.Done()
-		}
-
-		dcontext.GetLogger(newCtx).Infof("Start background mirroring of %q", dgst)
-		if err := storeLocal(newCtx, localBlobStore, remoteGetter, dgst); err != nil {
-			dcontext.GetLogger(newCtx).Errorf("Background mirroring failed: error committing to storage: %v", err.Error())
-			return
-		}
-		dcontext.GetLogger(newCtx).Infof("Completed mirroring of %q", dgst)
-	}(dgst)
+			desc, err := storeLocal(ctx, localBlobStore, remoteGetter, dgst)
+			if err != nil {
+				return fmt.Errorf("error committing to storage: %w", err)
+			}
+			if transfers != nil {
+				transfers.Mirrored(namespace, desc.Size)
+			}
+			if mirroredImages != nil {
+				mirroredImages.blobMirrored(dgst)
+			}
+			return nil
+		},
+		release: func() {
+			mu.Lock()
+			delete(inflight, dgst)
+			mu.Unlock()
+		},
+	})
 }
 
 // storeLocal retrieves the named blob from the provided store and writes it into the local store.
-func storeLocal(ctx context.Context, localBlobStore distribution.BlobStore, remoteGetter BlobGetterService, dgst digest.Digest) (err error) {
-	defer func() {
-		mu.Lock()
-		delete(inflight, dgst)
-		mu.Unlock()
-	}()
-
+// It returns the descriptor of the committed blob.
+func storeLocal(ctx context.Context, localBlobStore distribution.BlobStore, remoteGetter BlobGetterService, dgst digest.Digest) (desc distribution.Descriptor, err error) {
 	var bw distribution.BlobWriter
 	bw, err = localBlobStore.Create(ctx)
 	if err != nil {
-		return err
+		return distribution.Descriptor{}, err
 	}
 	defer func() {
 		// When everything is fine, it returns the "already closed" error.
@@ -226,12 +299,10 @@ func storeLocal(ctx context.Context, localBlobStore distribution.BlobStore, remo
 		_ = bw.Cancel(ctx)
 	}()
 
-	var desc distribution.Descriptor
 	desc, err = copyContent(ctx, remoteGetter, dgst, bw, nil)
 	if err != nil {
-		return err
+		return distribution.Descriptor{}, err
 	}
 
-	_, err = bw.Commit(ctx, desc)
-	return
+	return bw.Commit(ctx, desc)
 }
@@ -1,7 +1,6 @@
 package server
 
 import (
-	"bytes"
 	"context"
 	"crypto/sha256"
 	"fmt"
@@ -15,7 +14,6 @@ import (
 
 	"github.com/distribution/distribution/v3"
 	dcontext "github.com/distribution/distribution/v3/context"
-	"github.com/distribution/distribution/v3/manifest/schema1"
 	_ "github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
 	"github.com/opencontainers/go-digest"
 
@@ -152,7 +150,7 @@ func TestPullthroughServeBlob(t *testing.T) {
 			expectedLocalCalls: map[string]int{"Stat": 1},
 		},
 	} {
-		localBlobStore := newTestBlobStore(nil, tc.localBlobs)
+		localBlobStore := testutil.NewFakeBlobStore(nil, tc.localBlobs)
 
 		imageStream := imagestream.New(ctx, namespace, name, dockerregistryclient.NewFakeRegistryAPIClient(nil, imageClient))
 
@@ -176,6 +174,11 @@ func TestPullthroughServeBlob(t *testing.T) {
 			icsp,
 			idms,
 			itms,
+			nil,
+			nil,
+			nil,
+			nil,
+			nil,
 		)
 
 		ptbs := &pullthroughBlobStore{
@@ -222,19 +225,19 @@ func TestPullthroughServeBlob(t *testing.T) {
 		}
 
 		for name, expCount := range tc.expectedLocalCalls {
-			count := localBlobStore.calls[name]
+			count := localBlobStore.Calls(name)
 			if count != expCount {
 				t.Errorf("[%s] expected %d calls to method %s of local blob store, not %d", tc.name, expCount, name, count)
 			}
 		}
-		for name, count := range localBlobStore.calls {
+		for name, count := range localBlobStore.CallCounts() {
 			if _, exists := tc.expectedLocalCalls[name]; !exists {
 				t.Errorf("[%s] expected no calls to method %s of local blob store, got %d", tc.name, name, count)
 			}
 		}
 
-		if localBlobStore.bytesServed != tc.expectedBytesServedLocally {
-			t.Errorf("[%s] unexpected number of bytes served locally: %d != %d", tc.name, localBlobStore.bytesServed, tc.expectedBytesServed)
+		if localBlobStore.BytesServed() != tc.expectedBytesServedLocally {
+			t.Errorf("[%s] unexpected number of bytes served locally: %d != %d", tc.name, localBlobStore.BytesServed(), tc.expectedBytesServed)
 		}
 	}
 }
@@ -308,7 +311,7 @@ func TestPullthroughServeNotSeekableBlob(t *testing.T) {
 
 	// Test that the blob can be fetched.
 	ptbs := &pullthroughBlobStore{
-		BlobStore:        newTestBlobStore(nil, nil),
+		BlobStore:        testutil.NewFakeBlobStore(nil, nil),
 		remoteBlobGetter: repoBlobs,
 		mirror:           false,
 	}
@@ -593,7 +596,7 @@ func TestPullthroughServeBlobInsecure(t *testing.T) {
 
 			tc.fakeOpenShiftInit(fos)
 
-			localBlobStore := newTestBlobStore(nil, tc.localBlobs)
+			localBlobStore := testutil.NewFakeBlobStore(nil, tc.localBlobs)
 
 			imageStream := imagestream.New(ctx, namespace, repo1, dockerregistryclient.NewFakeRegistryAPIClient(nil, imageClient))
 
@@ -617,6 +620,11 @@ func TestPullthroughServeBlobInsecure(t *testing.T) {
 				icsp,
 				idms,
 				itms,
+				nil,
+				nil,
+				nil,
+				nil,
+				nil,
 			)
 
 			ptbs := &pullthroughBlobStore{
@@ -664,19 +672,19 @@ func TestPullthroughServeBlobInsecure(t *testing.T) {
 			}
 
 			for name, expCount := range tc.expectedLocalCalls {
-				count := localBlobStore.calls[name]
+				count := localBlobStore.Calls(name)
 				if count != expCount {
 					t.Errorf("[%s] expected %d calls to method %s of local blob store, not %d", tc.name, expCount, name, count)
 				}
 			}
-			for name, count := range localBlobStore.calls {
+			for name, count := range localBlobStore.CallCounts() {
 				if _, exists := tc.expectedLocalCalls[name]; !exists {
 					t.Errorf("[%s] expected no calls to method %s of local blob store, got %d", tc.name, name, count)
 				}
 			}
 
-			if localBlobStore.bytesServed != tc.expectedBytesServedLocally {
-				t.Errorf("[%s] unexpected number of bytes served locally: %d != %d", tc.name, localBlobStore.bytesServed, tc.expectedBytesServed)
+			if localBlobStore.BytesServed() != tc.expectedBytesServedLocally {
+				t.Errorf("[%s] unexpected number of bytes served locally: %d != %d", tc.name, localBlobStore.BytesServed(), tc.expectedBytesServed)
 			}
 		})
 	}
@@ -724,7 +732,7 @@ func TestPullthroughMetrics(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	localBlobStore := newTestBlobStore(nil, nil)
+	localBlobStore := testutil.NewFakeBlobStore(nil, nil)
 
 	imageStream := imagestream.New(ctx, namespace, name, dockerregistryclient.NewFakeRegistryAPIClient(nil, imageClient))
 
@@ -748,6 +756,11 @@ func TestPullthroughMetrics(t *testing.T) {
 		icsp,
 		idms,
 		itms,
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
 	)
 
 	ptbs := &pullthroughBlobStore{
@@ -792,155 +805,3 @@ const (
 func makeDigestFromBytes(data []byte) digest.Digest {
 	return digest.Digest(fmt.Sprintf("sha256:%x", sha256.Sum256(data)))
 }
-
-type blobContents map[digest.Digest][]byte
-type blobDescriptors map[digest.Digest]distribution.Descriptor
-
-type testBlobStore struct {
-	blobDescriptors blobDescriptors
-	// blob digest mapped to content
-	blobs blobContents
-	// method name mapped to number of invocations
-	calls       map[string]int
-	bytesServed int64
-}
-
-var _ distribution.BlobStore = &testBlobStore{}
-
-func newTestBlobStore(blobDescriptors blobDescriptors, blobs blobContents) *testBlobStore {
-	bs := make(map[digest.Digest][]byte)
-	for d, content := range blobs {
-		bs[d] = content
-	}
-	bds := make(map[digest.Digest]distribution.Descriptor)
-	for d, desc := range blobDescriptors {
-		bds[d] = desc
-	}
-	return &testBlobStore{
-		blobDescriptors: bds,
-		blobs:           bs,
-		calls:           make(map[string]int),
-	}
-}
-
-func (t *testBlobStore) Stat(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, error) {
-	t.calls["Stat"]++
-	desc, exists := t.blobDescriptors[dgst]
-	if exists {
-		return desc, nil
-	}
-
-	content, exists := t.blobs[dgst]
-	if !exists {
-		return distribution.Descriptor{}, distribution.ErrBlobUnknown
-	}
-	return distribution.Descriptor{
-		MediaType: schema1.MediaTypeManifestLayer,
-		Size:      int64(len(content)),
-		Digest:    makeDigestFromBytes(content),
-	}, nil
-}
-
-func (t *testBlobStore) Get(ctx context.Context, dgst digest.Digest) ([]byte, error) {
-	t.calls["Get"]++
-	content, exists := t.blobs[dgst]
-	if !exists {
-		return nil, distribution.ErrBlobUnknown
-	}
-	return content, nil
-}
-
-func (t *testBlobStore) Open(ctx context.Context, dgst digest.Digest) (distribution.ReadSeekCloser, error) {
-	t.calls["Open"]++
-	content, exists := t.blobs[dgst]
-	if !exists {
-		return nil, distribution.ErrBlobUnknown
-	}
-	return &testBlobFileReader{
-		bs:      t,
-		content: content,
-	}, nil
-}
-
-func (t *testBlobStore) Put(ctx context.Context, mediaType string, p []byte) (distribution.Descriptor, error) {
-	t.calls["Put"]++
-	return distribution.Descriptor{}, fmt.Errorf("method not implemented")
-}
-
-func (t *testBlobStore) Create(ctx context.Context, options ...distribution.BlobCreateOption) (distribution.BlobWriter, error) {
-	t.calls["Create"]++
-	return nil, fmt.Errorf("method not implemented")
-}
-
-func (t *testBlobStore) Resume(ctx context.Context, id string) (distribution.BlobWriter, error) {
-	t.calls["Resume"]++
-	return nil, fmt.Errorf("method not implemented")
-}
-
-func (t *testBlobStore) ServeBlob(ctx context.Context, w http.ResponseWriter, req *http.Request, dgst digest.Digest) error {
-	t.calls["ServeBlob"]++
-	content, exists := t.blobs[dgst]
-	if !exists {
-		return distribution.ErrBlobUnknown
-	}
-	reader := bytes.NewReader(content)
-	setResponseHeaders(w, int64(len(content)), "application/octet-stream", dgst)
-	http.ServeContent(w, req, dgst.String(), time.Time{}, reader)
-	n, err := reader.Seek(0, 1)
-	if err != nil {
-		return err
-	}
-	t.bytesServed = n
-	return nil
-}
-
-func (t *testBlobStore) Delete(ctx context.Context, dgst digest.Digest) error {
-	t.calls["Delete"]++
-	return fmt.Errorf("method not implemented")
-}
-
-type testBlobFileReader struct {
-	bs      *testBlobStore
-	content []byte
-	offset  int64
-}
-
-var _ distribution.ReadSeekCloser = &testBlobFileReader{}
-
-func (fr *testBlobFileReader) Read(p []byte) (n int, err error) {
-	fr.bs.calls["ReadSeakCloser.Read"]++
-	n = copy(p, fr.content[fr.offset:])
-	fr.offset += int64(n)
-	fr.bs.bytesServed += int64(n)
-	return n, nil
-}
-
-func (fr *testBlobFileReader) Seek(offset int64, whence int) (int64, error) {
-	fr.bs.calls["ReadSeakCloser.Seek"]++
-
-	newOffset := fr.offset
-
-	switch whence {
-	case io.SeekCurrent:
-		newOffset += int64(offset)
-	case io.SeekEnd:
-		newOffset = int64(len(fr.content)) + offset
-	case io.SeekStart:
-		newOffset = int64(offset)
-	}
-
-	var err error
-	if newOffset < 0 {
-		err = fmt.Errorf("cannot seek to negative position")
-	} else {
-		// No problems, set the offset.
-		fr.offset = newOffset
-	}
-
-	return fr.offset, err
-}
-
-func (fr *testBlobFileReader) Close() error {
-	fr.bs.calls["ReadSeakCloser.Close"]++
-	return nil
-}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/distribution/distribution/v3/registry/auth"
+	"github.com/distribution/distribution/v3/registry/handlers"
+	gorillahandlers "github.com/gorilla/handlers"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/api"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+	"github.com/openshift/image-registry/pkg/imagestream"
+)
+
+// pullthroughCandidate describes a remote repository in the response of the
+// pullthrough candidates endpoint.
+type pullthroughCandidate struct {
+	Repository string `json:"repository"`
+	Insecure   bool   `json:"insecure"`
+	// PullSecret is the secret preferred for the repository, if any.
+	PullSecret string `json:"pullSecret,omitempty"`
+	// HasCredentials is true if the registry has credentials for the
+	// repository. The credentials aren't checked with the remote registry.
+	HasCredentials bool `json:"hasCredentials"`
+}
+
+// pullthroughCandidatesResponse is the response of the pullthrough
+// candidates endpoint.
+type pullthroughCandidatesResponse struct {
+	Repository string `json:"repository"`
+	// Primary are the repositories of the current images of the tags, they
+	// are searched first.
+	Primary []pullthroughCandidate `json:"primary"`
+	// Secondary are the repositories of the older images of the tags.
+	Secondary []pullthroughCandidate `json:"secondary"`
+}
+
+func (app *App) registerPullthroughCandidatesHandler(dockerApp *handlers.App, registryClient client.Interface) {
+	extensionsRouter := dockerApp.NewRoute().PathPrefix(api.ExtensionsPrefix).Subrouter()
+	candidatesAccess := func(r *http.Request) []auth.Access {
+		return []auth.Access{
+			{
+				Resource: auth.Resource{
+					Type: "repository",
+					Name: dcontext.GetStringValue(dcontext.WithVars(dockerApp, r), "vars.name"),
+				},
+				Action: "push",
+			},
+		}
+	}
+	dockerApp.RegisterRoute(
+		"extensions-pullthrough-candidates",
+		// GET /extensions/v2/<namespace>/<name>/pullthrough-candidates
+		extensionsRouter.Path(api.PullthroughCandidatesPath).Methods("GET"),
+		app.newPullthroughCandidatesDispatcher(registryClient),
+		handlers.NameRequired,
+		candidatesAccess,
+	)
+}
+
+// newPullthroughCandidatesDispatcher returns a dispatcher that builds the
+// handler for the pullthrough candidates requests.
+func (app *App) newPullthroughCandidatesDispatcher(registryClient client.Interface) func(*handlers.Context, *http.Request) http.Handler {
+	return func(ctx *handlers.Context, r *http.Request) http.Handler {
+		pullthroughCandidatesHandler := &pullthroughCandidatesHandler{
+			Context: ctx,
+			NewImageStream: func(namespace, name string) imagestream.ImageStream {
+				return app.newImageStream(ctx, namespace, name, registryClient)
+			},
+		}
+
+		return gorillahandlers.MethodHandler{
+			"GET": http.HandlerFunc(pullthroughCandidatesHandler.Get),
+		}
+	}
+}
+
+// pullthroughCandidatesHandler lists the remote repositories that are
+// searched for the blobs of a repository that aren't stored in the registry.
+type pullthroughCandidatesHandler struct {
+	*handlers.Context
+
+	// NewImageStream returns the image stream of the repository.
+	NewImageStream func(namespace, name string) imagestream.ImageStream
+}
+
+// Get returns the candidate repositories in the order in which they are
+// searched.
+func (h *pullthroughCandidatesHandler) Get(w http.ResponseWriter, req *http.Request) {
+	namespace, name, err := getNamespaceName(h.Repository.Named().Name())
+	if err != nil {
+		h.handleError(w, errcode.ErrorCodeUnknown.WithDetail(err))
+		return
+	}
+	is := h.NewImageStream(namespace, name)
+
+	secrets, rErr := is.GetSecrets()
+	if rErr != nil {
+		dcontext.GetLogger(h).Errorf("error getting secrets: %v", rErr)
+	}
+
+	primary, primarySpecs, rErr := is.IdentifyCandidateRepositories(h, true)
+	if rErr != nil {
+		h.handleError(w, errcode.ErrorCodeUnknown.WithDetail(fmt.Sprintf("failed to identify candidate repositories: %v", rErr)))
+		return
+	}
+	secondary, secondarySpecs, rErr := is.IdentifyCandidateRepositories(h, false)
+	if rErr != nil {
+		h.handleError(w, errcode.ErrorCodeUnknown.WithDetail(fmt.Sprintf("failed to identify candidate repositories: %v", rErr)))
+		return
+	}
+	// The primary candidates are not searched again.
+	for repo := range primarySpecs {
+		delete(secondarySpecs, repo)
+	}
+
+	resp := pullthroughCandidatesResponse{
+		Repository: is.Reference(),
+	}
+	if resp.Primary, err = h.describeCandidates(primary, primarySpecs, secrets); err != nil {
+		h.handleError(w, errcode.ErrorCodeUnknown.WithDetail(fmt.Sprintf("failed to load credentials: %v", err)))
+		return
+	}
+	if resp.Secondary, err = h.describeCandidates(secondary, secondarySpecs, secrets); err != nil {
+		h.handleError(w, errcode.ErrorCodeUnknown.WithDetail(fmt.Sprintf("failed to load credentials: %v", err)))
+		return
+	}
+
+	data, err := json.Marshal(resp)
+	if err != nil {
+		h.handleError(w, errcode.ErrorCodeUnknown.WithDetail(fmt.Sprintf("failed to serialize pullthrough candidates: %v", err)))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_, _ = w.Write(data)
+}
+
+// describeCandidates describes the repositories that have specs, in the order
+// of repos.
+func (h *pullthroughCandidatesHandler) describeCandidates(repos []string, specs map[string]imagestream.ImagePullthroughSpec, secrets []corev1.Secret) ([]pullthroughCandidate, error) {
+	candidates := []pullthroughCandidate{}
+	for _, repo := range repos {
+		spec, ok := specs[repo]
+		if !ok {
+			continue
+		}
+		credentials, err := newPullthroughCredentials(h, secrets, spec.PullSecret)
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, pullthroughCandidate{
+			Repository:     repo,
+			Insecure:       spec.Insecure,
+			PullSecret:     spec.PullSecret,
+			HasCredentials: credentials.hasCredentials(repo),
+		})
+	}
+	return candidates, nil
+}
+
+func (h *pullthroughCandidatesHandler) handleError(w http.ResponseWriter, err error) {
+	if serveErr := errcode.ServeJSON(w, err); serveErr != nil {
+		dcontext.GetResponseLogger(h).Errorf("error sending error response: %v", serveErr)
+	}
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/handlers"
+	"github.com/gorilla/mux"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	core "k8s.io/client-go/testing"
+
+	imageapiv1 "github.com/openshift/api/image/v1"
+	imagefakeclient "github.com/openshift/client-go/image/clientset/versioned/typed/image/v1/fake"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+	"github.com/openshift/image-registry/pkg/imagestream"
+	"github.com/openshift/image-registry/pkg/testutil"
+)
+
+func TestPullthroughCandidatesHandler(t *testing.T) {
+	ctx := testutil.WithTestLogger(context.Background(), t)
+
+	stream := &imageapiv1.ImageStream{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "app"},
+		Spec: imageapiv1.ImageStreamSpec{
+			Tags: []imageapiv1.TagReference{
+				{
+					Name:         "dev",
+					ImportPolicy: imageapiv1.TagImportPolicy{Insecure: true},
+					Annotations:  map[string]string{imagestream.PullSecretAnnotation: "dev-registry"},
+				},
+			},
+		},
+		Status: imageapiv1.ImageStreamStatus{
+			DockerImageRepository: "image-registry.openshift-image-registry.svc:5000/ns/app",
+			Tags: []imageapiv1.NamedTagEventList{
+				{
+					Tag: "latest",
+					Items: []imageapiv1.TagEvent{
+						{DockerImageReference: "quay.io/org/app@sha256:0000000000000000000000000000000000000000000000000000000000000002"},
+						{DockerImageReference: "docker.io/library/app@sha256:0000000000000000000000000000000000000000000000000000000000000001"},
+						{DockerImageReference: "quay.io/org/app@sha256:0000000000000000000000000000000000000000000000000000000000000000"},
+					},
+				},
+				{
+					Tag: "dev",
+					Items: []imageapiv1.TagEvent{
+						{DockerImageReference: "dev.example.com:5000/team/app@sha256:0000000000000000000000000000000000000000000000000000000000000003"},
+					},
+				},
+				{
+					Tag: "pushed",
+					Items: []imageapiv1.TagEvent{
+						{DockerImageReference: "image-registry.openshift-image-registry.svc:5000/ns/app@sha256:0000000000000000000000000000000000000000000000000000000000000004"},
+					},
+				},
+			},
+		},
+	}
+	secrets := []corev1.Secret{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "dev-registry"},
+			Type:       corev1.SecretTypeDockerConfigJson,
+			Data: map[string][]byte{
+				".dockerconfigjson": []byte(`{"auths":{"dev.example.com:5000":{"auth":"dXNlcjpwYXNz"}}}`),
+			},
+		},
+	}
+
+	imageClient := &imagefakeclient.FakeImageV1{Fake: &core.Fake{}}
+	imageClient.AddReactor("get", "imagestreams", func(action core.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() == "secrets" {
+			return true, &imageapiv1.SecretList{Items: secrets}, nil
+		}
+		return true, stream.DeepCopy(), nil
+	})
+	registryClient := client.NewFakeRegistryAPIClient(nil, imageClient)
+
+	named, err := reference.WithName("ns/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/extensions/v2/ns/app/pullthrough-candidates", nil)
+	req = mux.SetURLVars(req, map[string]string{"name": "ns/app"})
+	h := &pullthroughCandidatesHandler{
+		Context: &handlers.Context{
+			Context:    dcontext.WithVars(ctx, req),
+			Repository: &namedRepository{name: named},
+		},
+		NewImageStream: func(namespace, name string) imagestream.ImageStream {
+			return imagestream.New(ctx, namespace, name, registryClient)
+		},
+	}
+
+	w := httptest.NewRecorder()
+	h.Get(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+
+	var resp pullthroughCandidatesResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	expected := pullthroughCandidatesResponse{
+		Repository: "ns/app",
+		Primary: []pullthroughCandidate{
+			{Repository: "quay.io/org/app"},
+			{Repository: "dev.example.com:5000/team/app", Insecure: true, PullSecret: "dev-registry", HasCredentials: true},
+		},
+		Secondary: []pullthroughCandidate{
+			{Repository: "docker.io/library/app"},
+		},
+	}
+	if !reflect.DeepEqual(resp, expected) {
+		t.Errorf("got %#+v, want %#+v", resp, expected)
+	}
+}
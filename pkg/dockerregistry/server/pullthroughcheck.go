@@ -0,0 +1,238 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/openshift/library-go/pkg/image/reference"
+	"github.com/openshift/library-go/pkg/image/registryclient"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+	registryconfig "github.com/openshift/image-registry/pkg/dockerregistry/server/configuration"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/metrics"
+	"github.com/openshift/image-registry/pkg/imagestream"
+)
+
+// pullthroughCheckTimeout limits the duration of the check of a remote
+// repository.
+const pullthroughCheckTimeout = 30 * time.Second
+
+// PullthroughCheckResult is the result of the check of a remote repository
+// that the registry pulls through from.
+type PullthroughCheckResult struct {
+	Registry   string `json:"registry"`
+	Repository string `json:"repository"`
+	// Reference is the digest or the tag whose manifest was requested.
+	Reference string `json:"reference"`
+	// MirrorOf is the source repository if Repository is its mirror from an
+	// ImageContentSourcePolicy, ImageDigestMirrorSet or ImageTagMirrorSet.
+	MirrorOf string `json:"mirrorOf,omitempty"`
+	// ImageStreams are the image streams that reference the repository.
+	ImageStreams   []string `json:"imageStreams"`
+	Insecure       bool     `json:"insecure"`
+	PullSecret     string   `json:"pullSecret,omitempty"`
+	HasCredentials bool     `json:"hasCredentials"`
+	// Error is empty if the manifest is available.
+	Error string `json:"error,omitempty"`
+}
+
+// PullthroughCheckReport is the result of the checks of the remote
+// repositories of a namespace.
+type PullthroughCheckReport struct {
+	Namespace string                   `json:"namespace"`
+	Passed    bool                     `json:"passed"`
+	Results   []PullthroughCheckResult `json:"results"`
+}
+
+// CheckPullthrough checks that the registry can get the manifests of the
+// image streams of namespace from their remote repositories and from the
+// mirrors of these repositories, using the credentials that the pullthrough
+// uses.
+func CheckPullthrough(ctx context.Context, registryClient client.RegistryClient, config *registryconfig.Configuration, namespace string) (*PullthroughCheckReport, error) {
+	oc, err := registryClient.Client()
+	if err != nil {
+		return nil, fmt.Errorf("unable to create the client: %w", err)
+	}
+	pins := newCertificatePins(ctx, config.Pullthrough.CertificatePins, metrics.NewNoopMetrics().CertificatePins())
+	checker := &pullthroughChecker{
+		oc:         oc,
+		mirrors:    NewSimpleLookupImageMirrorSetsStrategy(oc.ImageContentSourcePolicy(), oc.ImageDigestMirrorSet(), oc.ImageTagMirrorSet()),
+		proxy:      newClusterProxy(registryClient, pins),
+		challenges: newAuthChallenges(config.Pullthrough.BasicAuthHosts),
+	}
+	return checker.check(ctx, namespace)
+}
+
+// pullthroughChecker requests the manifests of the images of the image
+// streams from their remote repositories.
+type pullthroughChecker struct {
+	oc         client.Interface
+	mirrors    registryclient.AlternateBlobSourceStrategy
+	proxy      *clusterProxy
+	challenges *authChallenges
+}
+
+// pullthroughCheck is a remote repository to check.
+type pullthroughCheck struct {
+	result  PullthroughCheckResult
+	ref     reference.DockerImageReference
+	secrets []corev1.Secret
+}
+
+func (c *pullthroughChecker) check(ctx context.Context, namespace string) (*PullthroughCheckReport, error) {
+	streams, err := c.oc.ImageStreams(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list the image streams of the namespace %s: %w", namespace, err)
+	}
+
+	checks := make(map[string]*pullthroughCheck)
+	var keys []string
+	for _, stream := range streams.Items {
+		is := imagestream.New(ctx, namespace, stream.Name, c.oc)
+
+		primary, specs, rErr := is.IdentifyCandidateRepositories(ctx, true)
+		if rErr != nil {
+			return nil, rErr
+		}
+		secondary, secondarySpecs, rErr := is.IdentifyCandidateRepositories(ctx, false)
+		if rErr != nil {
+			return nil, rErr
+		}
+		for repo, spec := range secondarySpecs {
+			if _, ok := specs[repo]; !ok {
+				specs[repo] = spec
+			}
+		}
+		if len(specs) == 0 {
+			continue
+		}
+
+		secrets, rErr := is.GetSecrets()
+		if rErr != nil {
+			return nil, rErr
+		}
+
+		for _, repo := range append(primary, secondary...) {
+			spec, ok := specs[repo]
+			if !ok {
+				continue
+			}
+			delete(specs, repo)
+
+			for _, ref := range c.sources(ctx, *spec.DockerImageReference) {
+				result := PullthroughCheckResult{
+					Registry:   ref.Registry,
+					Repository: ref.AsRepository().Exact(),
+					Insecure:   spec.Insecure,
+					PullSecret: spec.PullSecret,
+				}
+				if result.Repository != repo {
+					result.MirrorOf = repo
+				}
+				key := fmt.Sprintf("%s %s %s %t", result.Repository, result.MirrorOf, result.PullSecret, result.Insecure)
+				check, ok := checks[key]
+				if !ok {
+					check = &pullthroughCheck{
+						result:  result,
+						ref:     ref,
+						secrets: secrets,
+					}
+					checks[key] = check
+					keys = append(keys, key)
+				}
+				check.result.ImageStreams = append(check.result.ImageStreams, is.Reference())
+			}
+		}
+	}
+
+	report := &PullthroughCheckReport{
+		Namespace: namespace,
+		Passed:    true,
+		Results:   []PullthroughCheckResult{},
+	}
+	for _, key := range keys {
+		check := checks[key]
+		if err := c.checkRepository(ctx, check); err != nil {
+			check.result.Error = err.Error()
+			report.Passed = false
+		}
+		report.Results = append(report.Results, check.result)
+	}
+	sort.SliceStable(report.Results, func(i, j int) bool {
+		a, b := report.Results[i], report.Results[j]
+		if a.Registry != b.Registry {
+			return a.Registry < b.Registry
+		}
+		return a.Repository < b.Repository
+	})
+	return report, nil
+}
+
+// sources returns the mirrors of ref followed by ref itself. The digest or
+// the tag of ref is kept in the mirrors.
+func (c *pullthroughChecker) sources(ctx context.Context, ref reference.DockerImageReference) []reference.DockerImageReference {
+	repos, err := c.mirrors.FirstRequest(ctx, ref)
+	if err != nil || len(repos) == 0 {
+		return []reference.DockerImageReference{ref}
+	}
+	sources := make([]reference.DockerImageReference, 0, len(repos))
+	for _, repo := range repos {
+		repo.ID = ref.ID
+		repo.Tag = ref.Tag
+		sources = append(sources, repo.DockerClientDefaults())
+	}
+	return sources
+}
+
+// checkRepository requests the manifest of check from its repository with
+// HEAD.
+func (c *pullthroughChecker) checkRepository(ctx context.Context, check *pullthroughCheck) error {
+	ctx, cancel := context.WithTimeout(ctx, pullthroughCheckTimeout)
+	defer cancel()
+
+	credentials, err := newPullthroughCredentials(ctx, check.secrets, check.result.PullSecret)
+	if err != nil {
+		return fmt.Errorf("unable to load the credentials: %w", err)
+	}
+	check.result.HasCredentials = credentials.hasCredentials(check.result.Repository)
+
+	secure, insecure := c.proxy.Transports()
+	registryContext := registryclient.NewContext(secure, insecure).WithCredentialsFactory(credentials)
+	registryContext.Challenges = c.challenges.Manager()
+
+	ref := check.ref
+	repo, err := registryContext.Repository(ctx, ref.RegistryURL(), ref.RepositoryName(), check.result.Insecure)
+	if err != nil {
+		return err
+	}
+
+	if len(ref.ID) > 0 {
+		check.result.Reference = ref.ID
+		ms, err := repo.Manifests(ctx)
+		if err != nil {
+			return err
+		}
+		ok, err := ms.Exists(ctx, digest.Digest(ref.ID))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("the manifest %s is not found", ref.ID)
+		}
+		return nil
+	}
+
+	tag := ref.Tag
+	if len(tag) == 0 {
+		tag = "latest"
+	}
+	check.result.Reference = tag
+	_, err = repo.Tags(ctx).Get(ctx, tag)
+	return err
+}
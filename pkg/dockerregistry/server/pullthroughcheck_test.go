@@ -0,0 +1,186 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	cfgv1 "github.com/openshift/api/config/v1"
+	imageapiv1 "github.com/openshift/api/image/v1"
+	cfgfake "github.com/openshift/client-go/config/clientset/versioned/fake"
+	operatorfake "github.com/openshift/client-go/operator/clientset/versioned/fake"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+	"github.com/openshift/image-registry/pkg/testutil"
+)
+
+func TestPullthroughChecker(t *testing.T) {
+	ctx := testutil.WithTestLogger(context.Background(), t)
+
+	const (
+		appDigest     = "sha256:0000000000000000000000000000000000000000000000000000000000000001"
+		missingDigest = "sha256:0000000000000000000000000000000000000000000000000000000000000002"
+	)
+
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Logf("remote registry got %s %s", r.Method, r.URL.Path)
+
+		w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+		switch r.URL.Path {
+		case "/v2/":
+			w.Write([]byte(`{}`))
+		case "/v2/org/app/manifests/" + appDigest, "/v2/org/tools/manifests/stable":
+			w.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
+			w.Header().Set("Docker-Content-Digest", appDigest)
+			w.Header().Set("Content-Length", "2")
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer remote.Close()
+
+	remoteURL, err := url.Parse(remote.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := remoteURL.Host
+
+	fos, imageClient := testutil.NewFakeOpenShiftWithClient(ctx)
+	for _, stream := range []*imageapiv1.ImageStream{
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "ns",
+				Name:        "app",
+				Annotations: map[string]string{imageapiv1.InsecureRepositoryAnnotation: "true"},
+			},
+			Status: imageapiv1.ImageStreamStatus{
+				DockerImageRepository: "image-registry.openshift-image-registry.svc:5000/ns/app",
+				Tags: []imageapiv1.NamedTagEventList{
+					{
+						Tag: "latest",
+						Items: []imageapiv1.TagEvent{
+							{DockerImageReference: host + "/org/app@" + appDigest},
+						},
+					},
+					{
+						Tag: "old",
+						Items: []imageapiv1.TagEvent{
+							{DockerImageReference: host + "/org/missing@" + missingDigest},
+						},
+					},
+					{
+						Tag: "pushed",
+						Items: []imageapiv1.TagEvent{
+							{DockerImageReference: "image-registry.openshift-image-registry.svc:5000/ns/app@" + appDigest},
+						},
+					},
+				},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "ns",
+				Name:        "tools",
+				Annotations: map[string]string{imageapiv1.InsecureRepositoryAnnotation: "true"},
+			},
+			Status: imageapiv1.ImageStreamStatus{
+				Tags: []imageapiv1.NamedTagEventList{
+					{
+						Tag: "stable",
+						Items: []imageapiv1.TagEvent{
+							{DockerImageReference: host + "/org/tools:stable"},
+						},
+					},
+				},
+			},
+		},
+	} {
+		if _, err := fos.CreateImageStream(stream.Namespace, stream); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	idms := &cfgv1.ImageDigestMirrorSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "mirrors"},
+		Spec: cfgv1.ImageDigestMirrorSetSpec{
+			ImageDigestMirrors: []cfgv1.ImageDigestMirrors{
+				{
+					Source:  host + "/org/app",
+					Mirrors: []cfgv1.ImageMirror{cfgv1.ImageMirror(host + "/mirror/app")},
+				},
+			},
+		},
+	}
+	configClient := cfgfake.NewSimpleClientset(idms).ConfigV1()
+
+	checker := &pullthroughChecker{
+		oc: client.NewFakeRegistryAPIClient(nil, imageClient),
+		mirrors: NewSimpleLookupImageMirrorSetsStrategy(
+			operatorfake.NewSimpleClientset().OperatorV1alpha1().ImageContentSourcePolicies(),
+			configClient.ImageDigestMirrorSets(),
+			configClient.ImageTagMirrorSets(),
+		),
+		challenges: newAuthChallenges(nil),
+	}
+	report, err := checker.check(ctx, "ns")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Passed {
+		t.Errorf("expected the check to fail")
+	}
+	var got []PullthroughCheckResult
+	for _, result := range report.Results {
+		if result.Registry != host {
+			t.Errorf("%s: got registry %q, want %q", result.Repository, result.Registry, host)
+		}
+		failed := len(result.Error) > 0
+		result.Error = ""
+		if failed {
+			result.Error = "failed"
+		}
+		got = append(got, result)
+	}
+	expected := []PullthroughCheckResult{
+		{
+			Registry:     host,
+			Repository:   host + "/mirror/app",
+			Reference:    appDigest,
+			MirrorOf:     host + "/org/app",
+			ImageStreams: []string{"ns/app"},
+			Insecure:     true,
+			Error:        "failed",
+		},
+		{
+			Registry:     host,
+			Repository:   host + "/org/app",
+			Reference:    appDigest,
+			ImageStreams: []string{"ns/app"},
+			Insecure:     true,
+		},
+		{
+			Registry:     host,
+			Repository:   host + "/org/missing",
+			Reference:    missingDigest,
+			ImageStreams: []string{"ns/app"},
+			Insecure:     true,
+			Error:        "failed",
+		},
+		{
+			Registry:     host,
+			Repository:   host + "/org/tools",
+			Reference:    "stable",
+			ImageStreams: []string{"ns/tools"},
+			Insecure:     true,
+		},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %#+v, want %#+v", got, expected)
+	}
+}
@@ -0,0 +1,374 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/opencontainers/go-digest"
+)
+
+// blobDownload is a download of a remote blob into a temporary file. The file
+// is read by all concurrent requests for the blob, so that the blob is
+// downloaded from the remote registry only once.
+type blobDownload struct {
+	key  blobDownloadKey
+	dgst digest.Digest
+
+	// ready is closed when desc and file are set or when the download has
+	// failed to start.
+	ready chan struct{}
+	desc  distribution.Descriptor
+	file  *os.File
+
+	mu      sync.Mutex
+	written int64
+	done    bool
+	err     error
+	changed chan struct{}
+	refs    int
+}
+
+// blobDownloadKey identifies a download. The downloads are shared only by the
+// requests for the same repository, as the remote blob getters of different
+// repositories use different image streams and credentials.
+type blobDownloadKey struct {
+	repo string
+	dgst digest.Digest
+}
+
+// downloads tracks the blob downloads in progress.
+var downloads = make(map[blobDownloadKey]*blobDownload)
+
+// downloadsMu protects downloads
+var downloadsMu sync.Mutex
+
+// shouldCoalesce returns true if the request can be served from a download
+// that is shared with other requests. Range and HEAD requests are served
+// directly by the remote registry.
+func shouldCoalesce(req *http.Request) bool {
+	return req != nil && req.Method == http.MethodGet && len(req.Header.Get("Range")) == 0
+}
+
+// serveCoalesced serves the remote blob from a download that is shared with
+// concurrent requests for the same blob. It returns false if the download
+// cannot be started and the request should be served without coalescing.
+func (pbs *pullthroughBlobStore) serveCoalesced(ctx context.Context, w http.ResponseWriter, dgst digest.Digest) (bool, error) {
+	d, coalesced, err := pbs.joinDownload(ctx, dgst)
+	if err != nil {
+		return true, err
+	}
+	if d == nil {
+		return false, nil
+	}
+	defer d.release()
+
+	if pbs.coalescing != nil {
+		pbs.coalescing.Request(coalesced)
+	}
+	if coalesced {
+		dcontext.GetLogger(ctx).Infof("Serving %q from the download in progress", dgst)
+	}
+
+	setResponseHeaders(w, d.desc.Size, d.desc.MediaType, d.desc.Digest)
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", d.desc.Size))
+
+	_, err = io.Copy(w, &blobDownloadReader{ctx: ctx, download: d})
+	return true, err
+}
+
+// joinDownload returns the download of the blob that is in progress for the
+// repository. If there is none, a new download is started. The returned download must be
+// released by the caller.
+func (pbs *pullthroughBlobStore) joinDownload(ctx context.Context, dgst digest.Digest) (*blobDownload, bool, error) {
+	key := blobDownloadKey{repo: pbs.repo, dgst: dgst}
+
+	downloadsMu.Lock()
+	if d, ok := downloads[key]; ok {
+		d.acquire()
+		downloadsMu.Unlock()
+
+		select {
+		case <-d.ready:
+		case <-ctx.Done():
+			d.release()
+			return nil, true, ctx.Err()
+		}
+		if d.file == nil {
+			d.release()
+			return nil, true, d.err
+		}
+		return d, true, nil
+	}
+
+	d := &blobDownload{
+		key:     key,
+		dgst:    dgst,
+		ready:   make(chan struct{}),
+		changed: make(chan struct{}),
+		// One reference is held by the request, the other one is held by
+		// the download itself.
+		refs: 2,
+	}
+	downloads[key] = d
+	downloadsMu.Unlock()
+
+	started, err := pbs.startDownload(ctx, d)
+	if !started {
+		downloadsMu.Lock()
+		delete(downloads, key)
+		downloadsMu.Unlock()
+
+		d.err = err
+		if d.err == nil {
+			d.err = fmt.Errorf("unable to start the download of blob %s", dgst)
+		}
+		close(d.ready)
+		return nil, false, err
+	}
+	close(d.ready)
+
+	return d, false, nil
+}
+
+// startDownload checks the remote blob and starts its download in the
+// background. The download is not bound to the context of the request as the
+// data is consumed by other requests too. It returns false without an error
+// if the temporary file for the blob cannot be created.
+func (pbs *pullthroughBlobStore) startDownload(ctx context.Context, d *blobDownload) (bool, error) {
+	desc, err := pbs.remoteBlobGetter.Stat(ctx, d.dgst)
+	if err != nil {
+		dcontext.GetLogger(ctx).Debugf("startDownload: BlobGetterService.Stat error=%s", err)
+		return false, err
+	}
+
+	file, err := os.CreateTemp("", "blob-")
+	if err != nil {
+		dcontext.GetLogger(ctx).Errorf("unable to create a temporary file for blob %s: %v", d.dgst, err)
+		return false, nil
+	}
+
+	d.desc = desc
+	d.file = file
+
+	// leave only the essential entries in the context (logger)
+	newCtx := dcontext.WithLogger(context.Background(), dcontext.GetLogger(ctx))
+
+	go func() {
+		defer d.release()
+
+		err := pbs.download(newCtx, d)
+		if err != nil {
+			dcontext.GetLogger(newCtx).Errorf("Download of %q failed: %v", d.dgst, err)
+		}
+
+		downloadsMu.Lock()
+		delete(downloads, d.key)
+		downloadsMu.Unlock()
+
+		d.finish(err)
+	}()
+
+	return true, nil
+}
+
+// download copies the remote blob into the temporary file. The blob is also
+// written into the local blob store if mirroring is enabled.
+func (pbs *pullthroughBlobStore) download(ctx context.Context, d *blobDownload) (err error) {
+	remoteReader, err := openBlobWithFailover(ctx, pbs.remoteBlobGetter, d.dgst, d.desc.Size)
+	if err != nil {
+		return err
+	}
+	defer remoteReader.Close()
+
+	bw, mirrorDone := pbs.newMirrorWriter(ctx, d.dgst)
+	defer mirrorDone()
+	defer func() {
+		if err != nil && bw != nil {
+			_ = bw.Cancel(ctx)
+		}
+	}()
+
+	r := io.LimitReader(remoteReader, d.desc.Size)
+	buf := make([]byte, 32*1024)
+	var written int64
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if _, err := d.file.WriteAt(buf[:n], written); err != nil {
+				return err
+			}
+			if bw != nil {
+				if _, err := bw.Write(buf[:n]); err != nil {
+					dcontext.GetLogger(ctx).Errorf("Mirroring of %q failed: %v", d.dgst, err)
+					_ = bw.Cancel(ctx)
+					bw = nil
+				}
+			}
+			written += int64(n)
+			d.progress(written)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if written != d.desc.Size {
+		return io.ErrUnexpectedEOF
+	}
+
+	if bw != nil {
+		if _, err := bw.Commit(ctx, d.desc); err != nil {
+			dcontext.GetLogger(ctx).Errorf("Mirroring of %q failed: error committing to storage: %v", d.dgst, err)
+			_ = bw.Cancel(ctx)
+		} else {
+			if pbs.transfers != nil {
+				pbs.transfers.Mirrored(pbs.namespace, d.desc.Size)
+			}
+			if pbs.mirroredImages != nil {
+				pbs.mirroredImages.blobMirrored(d.dgst)
+			}
+			dcontext.GetLogger(ctx).Infof("Completed mirroring of %q", d.dgst)
+		}
+		bw = nil
+	}
+
+	return nil
+}
+
+// newMirrorWriter returns a writer into the local blob store, or nil if the
+// blob shouldn't be mirrored by this download. The returned function must be
+// called when the mirroring is finished.
+func (pbs *pullthroughBlobStore) newMirrorWriter(ctx context.Context, dgst digest.Digest) (distribution.BlobWriter, func()) {
+	if !pbs.mirror {
+		return nil, func() {}
+	}
+
+	mu.Lock()
+	if _, ok := inflight[dgst]; ok {
+		mu.Unlock()
+		return nil, func() {}
+	}
+	inflight[dgst] = struct{}{}
+	mu.Unlock()
+
+	done := func() {
+		mu.Lock()
+		delete(inflight, dgst)
+		mu.Unlock()
+	}
+
+	if pbs.writeLimiter != nil {
+		if !pbs.writeLimiter.Start(ctx) {
+			dcontext.GetLogger(ctx).Infof("Skipped mirroring of %q because write limits are reached", dgst)
+			done()
+			return nil, func() {}
+		}
+		inflightDone := done
+		done = func() {
+			pbs.writeLimiter.Done()
+			inflightDone()
+		}
+	}
+
+	bw, err := pbs.newLocalBlobStore(ctx).Create(ctx)
+	if err != nil {
+		dcontext.GetLogger(ctx).Errorf("Mirroring of %q failed: %v", dgst, err)
+		done()
+		return nil, func() {}
+	}
+
+	dcontext.GetLogger(ctx).Infof("Start mirroring of %q", dgst)
+	return bw, done
+}
+
+func (d *blobDownload) acquire() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.refs++
+}
+
+// release removes the temporary file when the download is no longer used.
+func (d *blobDownload) release() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.refs--
+	if d.refs == 0 && d.file != nil {
+		_ = d.file.Close()
+		_ = os.Remove(d.file.Name())
+	}
+}
+
+// progress notifies the readers that the first written bytes are available.
+func (d *blobDownload) progress(written int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.written = written
+	close(d.changed)
+	d.changed = make(chan struct{})
+}
+
+func (d *blobDownload) finish(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.done = true
+	d.err = err
+	close(d.changed)
+}
+
+// readAt reads the downloaded data at off. It waits until the data is
+// available.
+func (d *blobDownload) readAt(ctx context.Context, p []byte, off int64) (int, error) {
+	for {
+		d.mu.Lock()
+		if off < d.written {
+			if available := d.written - off; int64(len(p)) > available {
+				p = p[:available]
+			}
+			d.mu.Unlock()
+			return d.file.ReadAt(p, off)
+		}
+		if d.done {
+			err := d.err
+			d.mu.Unlock()
+			if err == nil {
+				err = io.EOF
+			}
+			return 0, err
+		}
+		changed := d.changed
+		d.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// blobDownloadReader reads the blob from the download in progress.
+type blobDownloadReader struct {
+	ctx      context.Context
+	download *blobDownload
+	off      int64
+}
+
+func (r *blobDownloadReader) Read(p []byte) (int, error) {
+	if r.off >= r.download.desc.Size {
+		return 0, io.EOF
+	}
+	n, err := r.download.readAt(r.ctx, p, r.off)
+	r.off += int64(n)
+	if err == io.EOF && r.off < r.download.desc.Size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/metrics"
+	metricstesting "github.com/openshift/image-registry/pkg/dockerregistry/server/metrics/testing"
+	"github.com/openshift/image-registry/pkg/testutil"
+)
+
+// blockingBlobGetter serves a single blob whose content is sent only after
+// unblock is closed.
+type blockingBlobGetter struct {
+	BlobGetterService
+
+	content []byte
+	opened  chan struct{}
+	unblock chan struct{}
+	opens   int32
+}
+
+func (g *blockingBlobGetter) Stat(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, error) {
+	return distribution.Descriptor{
+		MediaType: "application/octet-stream",
+		Size:      int64(len(g.content)),
+		Digest:    dgst,
+	}, nil
+}
+
+func (g *blockingBlobGetter) Open(ctx context.Context, dgst digest.Digest) (distribution.ReadSeekCloser, error) {
+	if atomic.AddInt32(&g.opens, 1) == 1 {
+		close(g.opened)
+	}
+	return &blockingReader{ReadSeeker: bytes.NewReader(g.content), unblock: g.unblock}, nil
+}
+
+type blockingReader struct {
+	io.ReadSeeker
+	unblock chan struct{}
+}
+
+func (r *blockingReader) Read(p []byte) (int, error) {
+	<-r.unblock
+	return r.ReadSeeker.Read(p)
+}
+
+func (r *blockingReader) Close() error {
+	return nil
+}
+
+// emptyBlobStore is a local blob store without any blobs.
+type emptyBlobStore struct {
+	distribution.BlobStore
+}
+
+func (bs emptyBlobStore) ServeBlob(ctx context.Context, w http.ResponseWriter, req *http.Request, dgst digest.Digest) error {
+	return distribution.ErrBlobUnknown
+}
+
+func TestPullthroughServeBlobCoalescing(t *testing.T) {
+	ctx := context.Background()
+	ctx = testutil.WithTestLogger(ctx, t)
+
+	content := bytes.Repeat([]byte("layer"), 100000)
+	dgst := digest.FromBytes(content)
+
+	remote := &blockingBlobGetter{
+		content: content,
+		opened:  make(chan struct{}),
+		unblock: make(chan struct{}),
+	}
+	c, sink := metricstesting.NewCounterSink()
+	pbs := &pullthroughBlobStore{
+		BlobStore:        emptyBlobStore{},
+		repo:             "ns/is",
+		remoteBlobGetter: remote,
+		coalescing:       metrics.NewMetrics(sink).BlobRequestCoalescing(),
+		transfers:        metrics.NewMetrics(sink).BlobTransfers(),
+		namespace:        "ns",
+	}
+
+	const requests = 3
+	recorders := make([]*httptest.ResponseRecorder, requests)
+	errs := make([]error, requests)
+	var wg sync.WaitGroup
+	serve := func(i int) {
+		defer wg.Done()
+		recorders[i] = httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/v2/ns/is/blobs/"+dgst.String(), nil)
+		errs[i] = pbs.ServeBlob(ctx, recorders[i], req, dgst)
+	}
+
+	wg.Add(1)
+	go serve(0)
+	<-remote.opened
+
+	for i := 1; i < requests; i++ {
+		wg.Add(1)
+		go serve(i)
+	}
+
+	// Wait until the other requests have joined the download.
+	deadline := time.Now().Add(10 * time.Second)
+	for c.Values()["pullthrough_blob_requests:Coalesced"] != requests-1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("requests were not coalesced: %v", c.Values())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(remote.unblock)
+	wg.Wait()
+
+	for i := 0; i < requests; i++ {
+		if errs[i] != nil {
+			t.Errorf("request %d: unexpected error: %v", i, errs[i])
+			continue
+		}
+		if !bytes.Equal(recorders[i].Body.Bytes(), content) {
+			t.Errorf("request %d: got %d bytes, want %d bytes of the blob", i, recorders[i].Body.Len(), len(content))
+		}
+		if got := recorders[i].Header().Get("Docker-Content-Digest"); got != dgst.String() {
+			t.Errorf("request %d: got digest %q, want %q", i, got, dgst)
+		}
+	}
+
+	if opens := atomic.LoadInt32(&remote.opens); opens != 1 {
+		t.Errorf("expected the remote blob to be opened once, got %d", opens)
+	}
+	if started := c.Values()["pullthrough_blob_requests:Started"]; started != 1 {
+		t.Errorf("got %d started downloads, want 1", started)
+	}
+	if served := c.Values()["blob_served_bytes:ns:pullthrough"]; served != requests*len(content) {
+		t.Errorf("got %d bytes served through pullthrough, want %d", served, requests*len(content))
+	}
+}
+
+// unknownBlobGetter doesn't have any blobs.
+type unknownBlobGetter struct {
+	BlobGetterService
+}
+
+func (unknownBlobGetter) Stat(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, error) {
+	return distribution.Descriptor{}, distribution.ErrBlobUnknown
+}
+
+func TestPullthroughServeBlobCoalescingIsScopedToRepository(t *testing.T) {
+	ctx := context.Background()
+	ctx = testutil.WithTestLogger(ctx, t)
+
+	content := []byte("private layer")
+	dgst := digest.FromBytes(content)
+
+	remote := &blockingBlobGetter{
+		content: content,
+		opened:  make(chan struct{}),
+		unblock: make(chan struct{}),
+	}
+	private := &pullthroughBlobStore{
+		BlobStore:        emptyBlobStore{},
+		repo:             "private/is",
+		remoteBlobGetter: remote,
+	}
+	// The image stream of the other repository doesn't reference the blob.
+	other := &pullthroughBlobStore{
+		BlobStore:        emptyBlobStore{},
+		repo:             "other/is",
+		remoteBlobGetter: unknownBlobGetter{},
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		req := httptest.NewRequest(http.MethodGet, "/v2/private/is/blobs/"+dgst.String(), nil)
+		done <- private.ServeBlob(ctx, httptest.NewRecorder(), req, dgst)
+	}()
+	<-remote.opened
+
+	// The request would wait for the blocked download if it joined it.
+	otherCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/v2/other/is/blobs/"+dgst.String(), nil)
+	if err := other.ServeBlob(otherCtx, w, req, dgst); err != distribution.ErrBlobUnknown {
+		t.Errorf("got error %v, want %v", err, distribution.ErrBlobUnknown)
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("expected the blob of the other repository not to be served, got %d bytes", w.Body.Len())
+	}
+
+	close(remote.unblock)
+	if err := <-done; err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -14,6 +14,7 @@ import (
 	cfgv1 "github.com/openshift/client-go/config/clientset/versioned/typed/config/v1"
 	operatorv1alpha1 "github.com/openshift/client-go/operator/clientset/versioned/typed/operator/v1alpha1"
 
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/accesslog"
 	"github.com/openshift/image-registry/pkg/dockerregistry/server/cache"
 	"github.com/openshift/image-registry/pkg/dockerregistry/server/metrics"
 	"github.com/openshift/image-registry/pkg/errors"
@@ -28,14 +29,22 @@ import (
 type pullthroughManifestService struct {
 	distribution.ManifestService
 	newLocalManifestService func(ctx context.Context) (distribution.ManifestService, error)
+	localBlobStore          distribution.BlobStore
 	imageStream             imagestream.ImageStream
 	cache                   cache.RepositoryDigest
 	mirror                  bool
+	foreignLayerMirror      *foreignLayerMirror
 	registryAddr            string
 	metrics                 metrics.Pullthrough
 	idms                    cfgv1.ImageDigestMirrorSetInterface
 	itms                    cfgv1.ImageTagMirrorSetInterface
 	icsp                    operatorv1alpha1.ImageContentSourcePolicyInterface
+	policy                  *registryPolicy
+	fallbackMirror          *fallbackMirror
+	proxy                   *clusterProxy
+	authChallenges          *authChallenges
+	mirrorHealth            *mirrorHealth
+	mirroredImages          *mirroredImageAnnotator
 }
 
 var _ distribution.ManifestService = &pullthroughManifestService{}
@@ -53,7 +62,9 @@ func (m *pullthroughManifestService) Get(ctx context.Context, dgst digest.Digest
 
 func (m *pullthroughManifestService) remoteGet(ctx context.Context, dgst digest.Digest, options ...distribution.ManifestServiceOption) (distribution.Manifest, error) {
 	dcontext.GetLogger(ctx).Debugf("(*pullthroughManifestService).remoteGet: starting with dgst=%s", dgst.String())
-	image, rErr := m.imageStream.GetImageOfImageStream(ctx, dgst)
+	// The images of the tags with the Local reference policy are pulled
+	// through from their sources as well.
+	image, rErr := m.imageStream.GetSourceImageOfImageStream(ctx, dgst)
 	if rErr != nil {
 		switch rErr.Code() {
 		case imagestream.ErrImageStreamNotFoundCode, imagestream.ErrImageStreamImageNotFoundCode:
@@ -84,6 +95,11 @@ func (m *pullthroughManifestService) remoteGet(ctx context.Context, dgst digest.
 		}
 	}
 
+	if err := m.policy.Admit(ctx, ref); err != nil {
+		dcontext.GetLogger(ctx).Errorf("remoteGet: refusing to pull through %s: %v", ref.Exact(), err)
+		return nil, err
+	}
+
 	repo, err := m.getRemoteRepositoryClient(ctx, &ref, dgst, options...)
 	if err != nil {
 		return nil, errors.ErrorCodePullthroughManifest.WithArgs(ref.Exact(), err)
@@ -101,16 +117,26 @@ func (m *pullthroughManifestService) remoteGet(ctx context.Context, dgst digest.
 				return nil, errcode.ErrorCodeTooManyRequests.WithMessage("unable to pullthrough manifest")
 			}
 		}
-		return nil, errors.ErrorCodePullthroughManifest.WithArgs(ref.Exact(), err)
+		fallbackManifest, fallbackErr := m.fallbackGet(ctx, ref, dgst)
+		if fallbackErr != nil {
+			return nil, errors.ErrorCodePullthroughManifest.WithArgs(ref.Exact(), err)
+		}
+		manifest = fallbackManifest
+	} else {
+		accesslog.SetUpstream(ctx, ref.AsRepository().Exact())
 	}
 
 	if m.mirror {
 		if mirrorErr := m.mirrorManifest(ctx, manifest); mirrorErr != nil {
 			errors.Handle(ctx, fmt.Sprintf("failed to mirror manifest from %s", ref.Exact()), mirrorErr)
+		} else if m.mirroredImages != nil {
+			m.mirroredImages.manifestMirrored(ctx, image, manifest, m.localBlobStore)
 		}
 	}
 
 	RememberLayersOfImage(ctx, m.cache, image, ref.Exact())
+	setLastModifiedHeader(ctx, image)
+	setImageStreamGenerationHeader(ctx, m.imageStream)
 
 	return manifest, nil
 }
@@ -122,7 +148,52 @@ func (m *pullthroughManifestService) mirrorManifest(ctx context.Context, manifes
 	}
 
 	_, err = localManifestService.Put(ctx, manifest)
-	return err
+	if err != nil {
+		return err
+	}
+
+	if m.foreignLayerMirror != nil && len(foreignLayers(manifest)) != 0 {
+		// Foreign layers are large, they are downloaded in the background
+		// to not delay the response.
+		ctx := context.WithoutCancel(ctx)
+		go func() {
+			if err := m.foreignLayerMirror.mirror(ctx, m.localBlobStore, manifest); err != nil {
+				dcontext.GetLogger(ctx).Errorf("failed to mirror foreign layers: %v", err)
+			}
+		}()
+	}
+	return nil
+}
+
+// fallbackGet fetches the manifest dgst from the mirror of ref in the
+// fallback mirror.
+func (m *pullthroughManifestService) fallbackGet(ctx context.Context, ref reference.DockerImageReference, dgst digest.Digest) (distribution.Manifest, error) {
+	if m.fallbackMirror == nil {
+		return nil, distribution.ErrManifestUnknownRevision{
+			Name:     m.imageStream.Reference(),
+			Revision: dgst,
+		}
+	}
+
+	repo, mirrorRef, err := m.fallbackMirror.Repository(ctx, ref, m.metrics)
+	if err != nil {
+		dcontext.GetLogger(ctx).Errorf("fallbackGet: unable to get fallback mirror repository for %s: %v", ref.Exact(), err)
+		return nil, err
+	}
+
+	ms, err := repo.Manifests(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, err := ms.Get(ctx, dgst)
+	if err != nil {
+		dcontext.GetLogger(ctx).Errorf("fallbackGet: unable to get manifest %s from fallback mirror %s: %v", dgst, mirrorRef.AsRepository().Exact(), err)
+		return nil, err
+	}
+	dcontext.GetLogger(ctx).Infof("fallbackGet: found manifest %s in fallback mirror %s", dgst, mirrorRef.AsRepository().Exact())
+	accesslog.SetUpstream(ctx, mirrorRef.AsRepository().Exact())
+	return manifest, nil
 }
 
 func (m *pullthroughManifestService) getRemoteRepositoryClient(ctx context.Context, ref *reference.DockerImageReference, dgst digest.Digest, options ...distribution.ManifestServiceOption) (distribution.Repository, error) {
@@ -132,12 +203,8 @@ func (m *pullthroughManifestService) getRemoteRepositoryClient(ctx context.Conte
 		dcontext.GetLogger(ctx).Errorf("error getting secrets: %v", err)
 	}
 
-	retriever, impErr := getImportContext(ctx, ref, secrets, m.metrics, m.icsp, m.idms, m.itms)
-	if impErr != nil {
-		return nil, impErr
-	}
-
-	// determine, whether to fall-back to insecure transport based on a specification of image's tag
+	// determine, whether to fall-back to insecure transport and which pull
+	// secret to use based on a specification of image's tag
 	// if the client pulls by tag, use that
 	tag := ""
 	for _, option := range options {
@@ -147,6 +214,16 @@ func (m *pullthroughManifestService) getRemoteRepositoryClient(ctx context.Conte
 		}
 	}
 
+	pullSecret, err := m.imageStream.TagPullSecret(ctx, tag, dgst)
+	if err != nil {
+		return nil, err
+	}
+
+	retriever, impErr := getImportContext(ctx, ref, secrets, pullSecret, m.metrics, m.icsp, m.idms, m.itms, m.proxy, m.authChallenges, m.mirrorHealth)
+	if impErr != nil {
+		return nil, impErr
+	}
+
 	insecure, err := m.imageStream.TagIsInsecure(ctx, tag, dgst)
 	if err != nil {
 		return nil, err
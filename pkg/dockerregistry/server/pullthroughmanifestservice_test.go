@@ -169,7 +169,7 @@ func TestPullthroughManifests(t *testing.T) {
 			},
 		},
 	} {
-		localManifestService := newTestManifestService(repoName, tc.localData)
+		localManifestService := testutil.NewFakeManifestService(repoName, tc.localData)
 
 		imageStream := imagestream.New(ctx, namespace, repo, registryclient.NewFakeRegistryAPIClient(nil, imageClient))
 
@@ -219,7 +219,7 @@ func TestPullthroughManifests(t *testing.T) {
 			}
 		}
 
-		for name, count := range localManifestService.calls {
+		for name, count := range localManifestService.CallCounts() {
 			expectCount, exists := tc.expectedLocalCalls[name]
 			if !exists {
 				t.Errorf("[%s] expected no calls to method %s of local manifest service, got %d", tc.name, name, count)
@@ -417,7 +417,7 @@ func TestPullthroughManifestInsecure(t *testing.T) {
 
 			tc.fakeOpenShiftInit(fos)
 
-			localManifestService := newTestManifestService(repoName, tc.localData)
+			localManifestService := testutil.NewFakeManifestService(repoName, tc.localData)
 
 			imageStream := imagestream.New(ctx, namespace, repo, registryclient.NewFakeRegistryAPIClient(nil, imageClient))
 
@@ -467,7 +467,7 @@ func TestPullthroughManifestInsecure(t *testing.T) {
 
 			testutil.AssertManifestsEqual(t, tc.name, manifestResult, tc.expectedManifest)
 
-			for name, count := range localManifestService.calls {
+			for name, count := range localManifestService.CallCounts() {
 				expectCount, exists := tc.expectedLocalCalls[name]
 				if !exists {
 					t.Errorf("expected no calls to method %s of local manifest service, got %d", name, count)
@@ -580,7 +580,7 @@ func TestPullthroughManifestDockerReference(t *testing.T) {
 		imageStream := imagestream.New(ctx, namespace, tc.repoName, registryclient.NewFakeRegistryAPIClient(nil, imageClient))
 
 		ptms := &pullthroughManifestService{
-			ManifestService: newTestManifestService(tc.repoName, nil),
+			ManifestService: testutil.NewFakeManifestService(tc.repoName, nil),
 			imageStream:     imageStream,
 			metrics:         metrics.NewNoopMetrics(),
 			idms:            idms,
@@ -604,60 +604,6 @@ func TestPullthroughManifestDockerReference(t *testing.T) {
 	}
 }
 
-type testManifestService struct {
-	name  string
-	data  map[digest.Digest]distribution.Manifest
-	calls map[string]int
-}
-
-var _ distribution.ManifestService = &testManifestService{}
-
-func newTestManifestService(name string, data map[digest.Digest]distribution.Manifest) *testManifestService {
-	b := make(map[digest.Digest]distribution.Manifest)
-	for d, content := range data {
-		b[d] = content
-	}
-	return &testManifestService{
-		name:  name,
-		data:  b,
-		calls: make(map[string]int),
-	}
-}
-
-func (t *testManifestService) Exists(ctx context.Context, dgst digest.Digest) (bool, error) {
-	t.calls["Exists"]++
-	_, exists := t.data[dgst]
-	return exists, nil
-}
-
-func (t *testManifestService) Get(ctx context.Context, dgst digest.Digest, options ...distribution.ManifestServiceOption) (distribution.Manifest, error) {
-	t.calls["Get"]++
-	content, exists := t.data[dgst]
-	if !exists {
-		return nil, distribution.ErrManifestUnknownRevision{
-			Name:     t.name,
-			Revision: dgst,
-		}
-	}
-	return content, nil
-}
-
-func (t *testManifestService) Put(ctx context.Context, manifest distribution.Manifest, options ...distribution.ManifestServiceOption) (digest.Digest, error) {
-	t.calls["Put"]++
-	_, payload, err := manifest.Payload()
-	if err != nil {
-		return "", err
-	}
-	dgst := digest.FromBytes(payload)
-	t.data[dgst] = manifest
-	return dgst, nil
-}
-
-func (t *testManifestService) Delete(ctx context.Context, dgst digest.Digest) error {
-	t.calls["Delete"]++
-	return fmt.Errorf("method not implemented")
-}
-
 const etcdDigest = "sha256:958608f8ecc1dc62c93b6c610f3a834dae4220c9642e6e8b4e0f2b3ad7cbd238"
 
 type putWaiterManifestService struct {
@@ -823,7 +769,7 @@ func TestPullthroughManifestMetrics(t *testing.T) {
 	imageStream := imagestream.New(ctx, namespace, repo, registryclient.NewFakeRegistryAPIClient(nil, imageClient))
 
 	c, sink := metricstesting.NewCounterSink()
-	ms := newTestManifestService(repoName, nil)
+	ms := testutil.NewFakeManifestService(repoName, nil)
 	ptms := &pullthroughManifestService{
 		ManifestService:         ms,
 		newLocalManifestService: func(ctx context.Context) (distribution.ManifestService, error) { return ms, nil },
@@ -10,27 +10,40 @@
 // *Note*: Here, we take into account just a single layer, not the image as a whole because the layers are
 // uploaded before the manifest. This leads to a situation where several layers can be written until a big
 // enough layer will be received that exceeds the limit.
+//
+// The limit is checked while the layer is being uploaded, so that the upload of a layer exceeding the limit
+// is refused as soon as the limit is reached instead of after the whole layer is received.
 package server
 
 import (
 	"context"
 	"fmt"
+	"io"
 
 	"github.com/distribution/distribution/v3"
 	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
 
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 
 	imageapiv1 "github.com/openshift/api/image/v1"
 	"github.com/openshift/image-registry/pkg/dockerregistry/server/configuration"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/metrics"
 	"github.com/openshift/image-registry/pkg/imagestream"
 )
 
+// limitRangesCacheName is the name of the cache of limit ranges in metrics.
+const limitRangesCacheName = "limit_ranges"
+
+// imagePushRejectedReason is the reason of the image stream events for
+// pushes that are rejected by the quota or limit enforcement.
+const imagePushRejectedReason = "ImagePushRejected"
+
 // newQuotaEnforcingConfig creates caches for quota objects. The objects are stored with given eviction
 // timeout. Caches will only be initialized if the given ttl is positive. Options are gathered from
 // configuration file and will be overridden by enforceQuota and projectCacheTTL environment variable values.
-func newQuotaEnforcingConfig(ctx context.Context, quotaCfg *configuration.Quota) *quotaEnforcingConfig {
+func newQuotaEnforcingConfig(ctx context.Context, quotaCfg *configuration.Quota, m metrics.Caches) *quotaEnforcingConfig {
 	if !quotaCfg.Enabled {
 		dcontext.GetLogger(ctx).Info("quota enforcement disabled")
 		return &quotaEnforcingConfig{}
@@ -46,7 +59,7 @@ func newQuotaEnforcingConfig(ctx context.Context, quotaCfg *configuration.Quota)
 	dcontext.GetLogger(ctx).Infof("caching project quota objects with TTL %s", quotaCfg.CacheTTL.String())
 	return &quotaEnforcingConfig{
 		enforcementEnabled: true,
-		limitRanges:        newProjectObjectListCache(quotaCfg.CacheTTL),
+		limitRanges:        newProjectObjectListCache(quotaCfg.CacheTTL, m.InternalCache(limitRangesCacheName)),
 	}
 }
 
@@ -109,18 +122,149 @@ type quotaRestrictedBlobWriter struct {
 	distribution.BlobWriter
 
 	repo *repository
+
+	// limit is the maximum size of the blob, or -1 if there is no limit. It is
+	// loaded on the first write if limitLoaded is not set.
+	limit       int64
+	limitLoaded bool
+}
+
+// sizeLimit returns the maximum size of the blob allowed by the image limit
+// ranges, or -1 if the blob size is not limited.
+func (bw *quotaRestrictedBlobWriter) sizeLimit(ctx context.Context) (int64, error) {
+	if bw.limitLoaded {
+		return bw.limit, nil
+	}
+
+	limit, err := imageSizeLimit(ctx, bw.repo)
+	if err != nil {
+		return 0, err
+	}
+
+	bw.limit = limit
+	bw.limitLoaded = true
+	return limit, nil
+}
+
+func (bw *quotaRestrictedBlobWriter) Write(p []byte) (int, error) {
+	limit, err := bw.sizeLimit(bw.repo.ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	if limit >= 0 && bw.BlobWriter.Size()+int64(len(p)) > limit {
+		return 0, bw.sizeLimitExceeded(limit)
+	}
+
+	return bw.BlobWriter.Write(p)
+}
+
+func (bw *quotaRestrictedBlobWriter) ReadFrom(r io.Reader) (int64, error) {
+	limit, err := bw.sizeLimit(bw.repo.ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	if limit < 0 {
+		return bw.BlobWriter.ReadFrom(r)
+	}
+
+	lr := &blobSizeLimitReader{
+		Reader:    r,
+		remaining: limit - bw.BlobWriter.Size(),
+	}
+	n, err := bw.BlobWriter.ReadFrom(lr)
+	if err == distribution.ErrAccessDenied {
+		err = bw.sizeLimitExceeded(limit)
+	}
+	return n, err
+}
+
+// sizeLimitExceeded reports the rejection of the blob that is larger than
+// limit bytes and returns the error for the client.
+func (bw *quotaRestrictedBlobWriter) sizeLimitExceeded(limit int64) error {
+	message := fmt.Sprintf("the upload of the layer exceeds the maximum size per %s (%s)", imageapiv1.LimitTypeImage, resource.NewQuantity(limit, resource.BinarySI).String())
+	dcontext.GetLogger(bw.repo.ctx).Errorf("refusing to write blob exceeding the maximum size per %s (%d)", imageapiv1.LimitTypeImage, limit)
+	bw.repo.pushRejectedEventf(bw.repo.ctx, "Push of a layer was rejected: %s", message)
+	// The error happens while distribution copies the body of the request,
+	// so it has to be reported separately to get to the client.
+	return reportPayloadError(bw.repo.ctx, errcode.ErrorCodeDenied.WithMessage(message))
 }
 
 func (bw *quotaRestrictedBlobWriter) Commit(ctx context.Context, provisional distribution.Descriptor) (canonical distribution.Descriptor, err error) {
 	dcontext.GetLogger(ctx).Debug("(*quotaRestrictedBlobWriter).Commit: starting")
 
-	if err := admitBlobWrite(ctx, bw.repo, provisional.Size); err != nil {
+	size := provisional.Size
+	if size == 0 {
+		// The client doesn't have to provide the size when the upload is
+		// completed, use the number of bytes received so far.
+		size = bw.BlobWriter.Size()
+	}
+
+	if err := admitBlobWrite(ctx, bw.repo, size); err != nil {
 		return distribution.Descriptor{}, err
 	}
 
 	return bw.BlobWriter.Commit(ctx, provisional)
 }
 
+// blobSizeLimitReader returns ErrAccessDenied once more than remaining bytes
+// are read from Reader.
+type blobSizeLimitReader struct {
+	io.Reader
+
+	remaining int64
+}
+
+func (r *blobSizeLimitReader) Read(p []byte) (int, error) {
+	if r.remaining < 0 {
+		return 0, distribution.ErrAccessDenied
+	}
+
+	// Read one byte more than allowed to find out whether the limit is
+	// exceeded.
+	if int64(len(p)) > r.remaining+1 {
+		p = p[:r.remaining+1]
+	}
+
+	n, err := r.Reader.Read(p)
+	if int64(n) > r.remaining {
+		n = int(r.remaining)
+		r.remaining = -1
+		return n, distribution.ErrAccessDenied
+	}
+
+	r.remaining -= int64(n)
+	return n, err
+}
+
+// imageSizeLimit returns the smallest maximum size of an image set by the
+// limit ranges in the project of the repository, or -1 if there is no limit.
+func imageSizeLimit(ctx context.Context, repo *repository) (int64, error) {
+	lrs, err := repo.imageStream.GetLimitRangeList(ctx, repo.app.quotaEnforcing.limitRanges)
+	if err != nil {
+		return 0, err
+	}
+
+	limit := int64(-1)
+	for _, limitrange := range lrs.Items {
+		for _, item := range limitrange.Spec.Limits {
+			if item.Type != imageapiv1.LimitTypeImage {
+				continue
+			}
+			limitQuantity, ok := item.Max[corev1.ResourceStorage]
+			if !ok {
+				continue
+			}
+			if value := limitQuantity.Value(); limit < 0 || value < limit {
+				limit = value
+			}
+		}
+	}
+
+	return limit, nil
+}
+
 // admitBlobWrite checks whether the blob does not exceed image limit ranges if set. Returns ErrAccessDenied
 // error if the limit is exceeded.
 func admitBlobWrite(ctx context.Context, repo *repository, size int64) error {
@@ -138,6 +282,7 @@ func admitBlobWrite(ctx context.Context, repo *repository, size int64) error {
 		for _, limit := range limitrange.Spec.Limits {
 			if err := admitImage(size, limit); err != nil {
 				dcontext.GetLogger(ctx).Errorf("refusing to write blob exceeding limit range %s: %s", limitrange.Name, err.Error())
+				repo.pushRejectedEventf(ctx, "Push of a layer was rejected by the limit range %s: %v", limitrange.Name, err)
 				return distribution.ErrAccessDenied
 			}
 		}
@@ -169,3 +314,19 @@ func admitImage(size int64, limit corev1.LimitRangeItem) error {
 	}
 	return nil
 }
+
+// pushRejectedEventf records a warning event for the image stream of the
+// repository, so that the users of the project can see why the push was
+// rejected.
+func (r *repository) pushRejectedEventf(ctx context.Context, messageFmt string, args ...interface{}) {
+	if r.app == nil || r.app.events == nil {
+		return
+	}
+
+	namespace, name, err := getNamespaceName(r.Named().Name())
+	if err != nil {
+		dcontext.GetLogger(ctx).Errorf("unable to record the rejected push: %v", err)
+		return
+	}
+	r.app.events.ImageStreamEventf(ctx, namespace, name, corev1.EventTypeWarning, imagePushRejectedReason, messageFmt, args...)
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/openshift/image-registry/pkg/testutil"
+)
+
+type bufferBlobWriter struct {
+	distribution.BlobWriter
+	buf bytes.Buffer
+}
+
+func (bw *bufferBlobWriter) Size() int64 {
+	return int64(bw.buf.Len())
+}
+
+func (bw *bufferBlobWriter) Write(p []byte) (int, error) {
+	return bw.buf.Write(p)
+}
+
+func (bw *bufferBlobWriter) ReadFrom(r io.Reader) (int64, error) {
+	return bw.buf.ReadFrom(r)
+}
+
+func TestQuotaRestrictedBlobWriterLimit(t *testing.T) {
+	ctx := context.Background()
+	ctx = testutil.WithTestLogger(ctx, t)
+
+	for _, tc := range []struct {
+		name    string
+		limit   int64
+		chunks  []string
+		wantErr bool
+	}{
+		{
+			name:   "no limit",
+			limit:  -1,
+			chunks: []string{"0123456789", "0123456789"},
+		},
+		{
+			name:   "within limit",
+			limit:  20,
+			chunks: []string{"0123456789", "0123456789"},
+		},
+		{
+			name:    "single chunk exceeds limit",
+			limit:   5,
+			chunks:  []string{"0123456789"},
+			wantErr: true,
+		},
+		{
+			name:    "second chunk exceeds limit",
+			limit:   15,
+			chunks:  []string{"0123456789", "0123456789"},
+			wantErr: true,
+		},
+	} {
+		for _, method := range []string{"Write", "ReadFrom"} {
+			t.Run(tc.name+"/"+method, func(t *testing.T) {
+				upstream := &bufferBlobWriter{}
+				bw := &quotaRestrictedBlobWriter{
+					BlobWriter:  upstream,
+					repo:        &repository{ctx: ctx},
+					limit:       tc.limit,
+					limitLoaded: true,
+				}
+
+				var err error
+				for _, chunk := range tc.chunks {
+					if method == "Write" {
+						_, err = bw.Write([]byte(chunk))
+					} else {
+						_, err = bw.ReadFrom(strings.NewReader(chunk))
+					}
+					if err != nil {
+						break
+					}
+				}
+
+				if tc.wantErr {
+					if !isErrorCode(err, errcode.ErrorCodeDenied) {
+						t.Fatalf("got error %v, want %v", err, errcode.ErrorCodeDenied)
+					}
+					if tc.limit >= 0 && upstream.Size() > tc.limit {
+						t.Errorf("%d bytes written, want at most %d", upstream.Size(), tc.limit)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			})
+		}
+	}
+}
+
+func TestQuotaRestrictedBlobWriterEvent(t *testing.T) {
+	ctx := context.Background()
+	ctx = testutil.WithTestLogger(ctx, t)
+
+	named, err := reference.WithName("myproject/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ec := &eventsClient{}
+
+	bw := &quotaRestrictedBlobWriter{
+		BlobWriter: &bufferBlobWriter{},
+		repo: &repository{
+			Repository: &namedRepository{name: named},
+			ctx:        ctx,
+			app: &App{
+				events: newEventRecorder(ec, "openshift-image-registry", "image-registry-1"),
+			},
+		},
+		limit:       1024,
+		limitLoaded: true,
+	}
+	if _, err := bw.Write(make([]byte, 2048)); !isErrorCode(err, errcode.ErrorCodeDenied) {
+		t.Fatalf("got error %v, want %v", err, errcode.ErrorCodeDenied)
+	}
+
+	events := ec.wait(t, "myproject", 1)
+	if len(events) != 1 {
+		t.Fatalf("got %d events, want 1", len(events))
+	}
+	e := events[0]
+	if e.Reason != imagePushRejectedReason || e.Type != corev1.EventTypeWarning {
+		t.Errorf("unexpected event %s of type %s", e.Reason, e.Type)
+	}
+	if e.InvolvedObject.Kind != "ImageStream" || e.InvolvedObject.Namespace != "myproject" || e.InvolvedObject.Name != "app" {
+		t.Errorf("unexpected involved object: %+v", e.InvolvedObject)
+	}
+	if !strings.Contains(e.Message, "1Ki") {
+		t.Errorf("expected the limit in the message, got %q", e.Message)
+	}
+	if e.Source.Host != "image-registry-1" {
+		t.Errorf("unexpected source: %+v", e.Source)
+	}
+}
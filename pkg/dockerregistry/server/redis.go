@@ -0,0 +1,42 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/gomodule/redigo/redis"
+)
+
+// newRedisPool returns a pool of connections to the redis server of the
+// redis section of the configuration.
+func newRedisPool(ctx context.Context, cfg *configuration.Configuration) *redis.Pool {
+	return &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			conn, err := redis.Dial("tcp",
+				cfg.Redis.Addr,
+				redis.DialConnectTimeout(cfg.Redis.DialTimeout),
+				redis.DialReadTimeout(cfg.Redis.ReadTimeout),
+				redis.DialWriteTimeout(cfg.Redis.WriteTimeout),
+				redis.DialUseTLS(cfg.Redis.TLS.Enabled),
+				redis.DialPassword(cfg.Redis.Password),
+				redis.DialDatabase(cfg.Redis.DB),
+			)
+			if err != nil {
+				dcontext.GetLogger(ctx).Errorf("unable to connect to redis %s: %v", cfg.Redis.Addr, err)
+				return nil, err
+			}
+			return conn, nil
+		},
+		MaxIdle:     cfg.Redis.Pool.MaxIdle,
+		MaxActive:   cfg.Redis.Pool.MaxActive,
+		IdleTimeout: cfg.Redis.Pool.IdleTimeout,
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			_, err := c.Do("PING")
+			return err
+		},
+		// if a connection is not available, proceed without cache
+		Wait: false,
+	}
+}
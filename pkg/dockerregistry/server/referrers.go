@@ -0,0 +1,299 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	v2 "github.com/distribution/distribution/v3/registry/api/v2"
+	"github.com/distribution/distribution/v3/registry/auth"
+	"github.com/distribution/distribution/v3/registry/handlers"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	gorillahandlers "github.com/gorilla/handlers"
+	"github.com/opencontainers/go-digest"
+	ociv1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/api"
+	regstorage "github.com/openshift/image-registry/pkg/dockerregistry/server/storage"
+)
+
+const (
+	// referrersFiltersAppliedHeader lists the filters that the registry
+	// applied to the referrers, so that clients know that they don't have to
+	// filter the response themselves.
+	referrersFiltersAppliedHeader = "OCI-Filters-Applied"
+
+	// referrersArtifactTypeFilter is the query parameter that selects the
+	// referrers with the given artifact type.
+	referrersArtifactTypeFilter = "artifactType"
+)
+
+// referrersIndex is the image index that is returned by the referrers API.
+type referrersIndex struct {
+	SchemaVersion int                  `json:"schemaVersion"`
+	MediaType     string               `json:"mediaType"`
+	Manifests     []referrerDescriptor `json:"manifests"`
+}
+
+// referrerDescriptor describes a manifest that refers to the subject. The
+// descriptor type of the vendored image-spec doesn't have the artifact type.
+type referrerDescriptor struct {
+	MediaType    string            `json:"mediaType"`
+	Digest       digest.Digest     `json:"digest"`
+	Size         int64             `json:"size"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+}
+
+// referrerManifest has the fields of image manifests and image indexes that
+// are needed to find the referrers of a subject. The manifest types of the
+// vendored distribution don't have the subject and the artifact type, so they
+// are read from the payload.
+type referrerManifest struct {
+	ArtifactType string `json:"artifactType"`
+	Config       *struct {
+		MediaType string `json:"mediaType"`
+	} `json:"config"`
+	Subject *struct {
+		Digest digest.Digest `json:"digest"`
+	} `json:"subject"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+func (app *App) registerReferrersHandler(dockerApp *handlers.App) {
+	pullAccess := func(r *http.Request) []auth.Access {
+		return []auth.Access{
+			{
+				Resource: auth.Resource{
+					Type: "repository",
+					Name: dcontext.GetStringValue(dcontext.WithVars(dockerApp, r), "vars.name"),
+				},
+				Action: "pull",
+			},
+		}
+	}
+	dockerApp.RegisterRoute(
+		"referrers",
+		// GET /v2/<namespace>/<name>/referrers/<digest>
+		dockerApp.NewRoute().Path(api.ReferrersPath).Methods("GET"),
+		app.referrersDispatcher,
+		handlers.NameRequired,
+		pullAccess,
+	)
+}
+
+// referrerOf returns the subject of the manifest dgst and its descriptor in
+// the referrers of the subject. It returns false if the manifest doesn't have
+// a subject.
+func referrerOf(dgst digest.Digest, mediaType string, payload []byte) (digest.Digest, referrerDescriptor, bool) {
+	var m referrerManifest
+	if err := json.Unmarshal(payload, &m); err != nil || m.Subject == nil || m.Subject.Digest.Validate() != nil {
+		return "", referrerDescriptor{}, false
+	}
+
+	desc := referrerDescriptor{
+		MediaType:    mediaType,
+		Digest:       dgst,
+		Size:         int64(len(payload)),
+		ArtifactType: m.ArtifactType,
+		Annotations:  m.Annotations,
+	}
+	if desc.ArtifactType == "" && m.Config != nil {
+		desc.ArtifactType = m.Config.MediaType
+	}
+	return m.Subject.Digest, desc, true
+}
+
+// indexReferrer adds the manifest dgst to the index of the referrers of its
+// subject in the repository repo if it has a subject.
+func indexReferrer(ctx context.Context, driver storagedriver.StorageDriver, repo string, dgst digest.Digest, mediaType string, payload []byte) error {
+	subject, desc, ok := referrerOf(dgst, mediaType, payload)
+	if !ok {
+		return nil
+	}
+	data, err := json.Marshal(desc)
+	if err != nil {
+		return err
+	}
+	return regstorage.PutReferrer(ctx, driver, repo, subject, dgst, data)
+}
+
+// indexReferrers adds the manifests of the repository that were pushed before
+// the referrers were indexed to the index.
+func indexReferrers(ctx context.Context, driver storagedriver.StorageDriver, repo string, ms distribution.ManifestService) error {
+	enumerator, ok := ms.(distribution.ManifestEnumerator)
+	if !ok {
+		return fmt.Errorf("unable to enumerate manifests")
+	}
+
+	err := enumerator.Enumerate(ctx, func(dgst digest.Digest) error {
+		manifest, err := ms.Get(ctx, dgst)
+		if err != nil {
+			dcontext.GetLogger(ctx).Warnf("referrers: unable to get the manifest %s: %v", dgst, err)
+			return nil
+		}
+		mediaType, payload, err := manifest.Payload()
+		if err != nil {
+			return err
+		}
+		return indexReferrer(ctx, driver, repo, dgst, mediaType, payload)
+	})
+	if _, ok := err.(storagedriver.PathNotFoundError); err != nil && !ok {
+		return err
+	}
+	return regstorage.MarkReferrersIndexed(ctx, driver, repo)
+}
+
+// referrersIndexingManifestService adds the stored manifests that have a
+// subject to the index of the referrers.
+type referrersIndexingManifestService struct {
+	distribution.ManifestService
+
+	driver storagedriver.StorageDriver
+	repo   string
+}
+
+var _ distribution.ManifestService = &referrersIndexingManifestService{}
+
+func (m *referrersIndexingManifestService) Put(ctx context.Context, manifest distribution.Manifest, options ...distribution.ManifestServiceOption) (digest.Digest, error) {
+	dgst, err := m.ManifestService.Put(ctx, manifest, options...)
+	if err != nil {
+		return dgst, err
+	}
+	mediaType, payload, err := manifest.Payload()
+	if err != nil {
+		return dgst, err
+	}
+	// The push fails if the referrer isn't indexed, so that the client
+	// retries it.
+	if err := indexReferrer(ctx, m.driver, m.repo, dgst, mediaType, payload); err != nil {
+		return dgst, fmt.Errorf("unable to index the referrer %s: %w", dgst, err)
+	}
+	return dgst, nil
+}
+
+// referrersDispatcher takes the request context and builds the handler for
+// the referrers requests.
+func (app *App) referrersDispatcher(ctx *handlers.Context, r *http.Request) http.Handler {
+	referrersHandler := &referrersHandler{
+		Context:  ctx,
+		Registry: app.registry,
+		Driver:   app.driver,
+	}
+
+	return gorillahandlers.MethodHandler{
+		"GET": http.HandlerFunc(referrersHandler.Get),
+	}
+}
+
+// referrersHandler implements the referrers API of the OCI distribution
+// specification.
+type referrersHandler struct {
+	*handlers.Context
+
+	// Registry is the storage of the manifests.
+	Registry distribution.Namespace
+
+	// Driver is the storage of the index of the referrers. The repositories
+	// that have manifests from before the index are indexed on the first
+	// request.
+	Driver storagedriver.StorageDriver
+}
+
+// Get returns the manifests in the repository that have the requested
+// digest as their subject. The referrers can be filtered by their artifact
+// type with the artifactType query parameter.
+func (h *referrersHandler) Get(w http.ResponseWriter, req *http.Request) {
+	subject, err := digest.Parse(dcontext.GetStringValue(h, "vars.digest"))
+	if err != nil {
+		h.handleError(w, v2.ErrorCodeDigestInvalid.WithDetail(err))
+		return
+	}
+
+	query := req.URL.Query()
+	_, filtered := query[referrersArtifactTypeFilter]
+	artifactType := query.Get(referrersArtifactTypeFilter)
+
+	index := referrersIndex{
+		SchemaVersion: 2,
+		MediaType:     ociv1.MediaTypeImageIndex,
+		Manifests:     []referrerDescriptor{},
+	}
+
+	repoName := h.Repository.Named().Name()
+	repo, err := h.Registry.Repository(h, h.Repository.Named())
+	if err != nil {
+		h.handleError(w, err)
+		return
+	}
+	ms, err := repo.Manifests(h)
+	if err != nil {
+		h.handleError(w, err)
+		return
+	}
+
+	indexed, err := regstorage.ReferrersIndexed(h, h.Driver, repoName)
+	if err == nil && !indexed {
+		err = indexReferrers(h, h.Driver, repoName, ms)
+	}
+	if err != nil {
+		h.handleError(w, errcode.ErrorCodeUnknown.WithDetail(fmt.Sprintf("failed to index referrers: %v", err)))
+		return
+	}
+
+	referrers, err := regstorage.Referrers(h, h.Driver, repoName, subject)
+	if err != nil {
+		h.handleError(w, errcode.ErrorCodeUnknown.WithDetail(fmt.Sprintf("failed to get referrers: %v", err)))
+		return
+	}
+	for dgst, data := range referrers {
+		var desc referrerDescriptor
+		if err := json.Unmarshal(data, &desc); err != nil {
+			dcontext.GetLogger(h).Warnf("referrers: invalid descriptor of the referrer %s: %v", dgst, err)
+			continue
+		}
+		if filtered && desc.ArtifactType != artifactType {
+			continue
+		}
+
+		// The index isn't updated when manifests are deleted.
+		exists, err := ms.Exists(h, dgst)
+		if err != nil {
+			h.handleError(w, err)
+			return
+		}
+		if !exists {
+			if err := regstorage.DeleteReferrer(h, h.Driver, repoName, subject, dgst); err != nil {
+				dcontext.GetLogger(h).Warnf("referrers: unable to remove the deleted referrer %s: %v", dgst, err)
+			}
+			continue
+		}
+
+		index.Manifests = append(index.Manifests, desc)
+	}
+	sort.Slice(index.Manifests, func(i, j int) bool {
+		return index.Manifests[i].Digest < index.Manifests[j].Digest
+	})
+
+	data, err := json.Marshal(index)
+	if err != nil {
+		h.handleError(w, errcode.ErrorCodeUnknown.WithDetail(fmt.Sprintf("failed to serialize referrers: %v", err)))
+		return
+	}
+	if filtered {
+		w.Header().Set(referrersFiltersAppliedHeader, referrersArtifactTypeFilter)
+	}
+	w.Header().Set("Content-Type", ociv1.MediaTypeImageIndex)
+	_, _ = w.Write(data)
+}
+
+func (h *referrersHandler) handleError(w http.ResponseWriter, err error) {
+	if serveErr := errcode.ServeJSON(w, err); serveErr != nil {
+		dcontext.GetResponseLogger(h).Errorf("error sending error response: %v", serveErr)
+	}
+}
@@ -0,0 +1,244 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/handlers"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/gorilla/mux"
+	"github.com/opencontainers/go-digest"
+	ociv1 "github.com/opencontainers/image-spec/specs-go/v1"
+
+	regstorage "github.com/openshift/image-registry/pkg/dockerregistry/server/storage"
+	"github.com/openshift/image-registry/pkg/testutil"
+)
+
+func putOCIManifest(ctx context.Context, t *testing.T, repo distribution.Repository, payload string) digest.Digest {
+	var m ocischema.DeserializedManifest
+	if err := m.UnmarshalJSON([]byte(payload)); err != nil {
+		t.Fatal(err)
+	}
+	ms, err := repo.Manifests(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dgst, err := ms.Put(ctx, &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dgst
+}
+
+func TestReferrersHandler(t *testing.T) {
+	ctx := testutil.WithTestLogger(context.Background(), t)
+
+	driver := inmemory.New()
+	reg, err := storage.NewRegistry(ctx, driver, storage.EnableDelete)
+	if err != nil {
+		t.Fatal(err)
+	}
+	named, err := reference.WithName("ns/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo, err := reg.Repository(ctx, named)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bs := repo.Blobs(ctx)
+	config, err := bs.Put(ctx, ociv1.MediaTypeImageConfig, []byte("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer, err := bs.Put(ctx, ociv1.MediaTypeImageLayer, []byte("layer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	descriptor := func(mediaType string, desc distribution.Descriptor) string {
+		return fmt.Sprintf(`{"mediaType": %q, "digest": %q, "size": %d}`, mediaType, desc.Digest, desc.Size)
+	}
+
+	image := putOCIManifest(ctx, t, repo, fmt.Sprintf(`{
+		"schemaVersion": 2,
+		"mediaType": %q,
+		"config": %s,
+		"layers": [%s]
+	}`, ociv1.MediaTypeImageManifest, descriptor(ociv1.MediaTypeImageConfig, config), descriptor(ociv1.MediaTypeImageLayer, layer)))
+	subject := fmt.Sprintf(`{"mediaType": %q, "digest": %q, "size": 1}`, ociv1.MediaTypeImageManifest, image)
+
+	signature := putOCIManifest(ctx, t, repo, fmt.Sprintf(`{
+		"schemaVersion": 2,
+		"mediaType": %q,
+		"config": %s,
+		"layers": [%s],
+		"subject": %s,
+		"annotations": {"org.example.signer": "ci"}
+	}`, ociv1.MediaTypeImageManifest, descriptor("application/vnd.dev.cosign.artifact.sig.v1+json", config), descriptor(ociv1.MediaTypeImageLayer, layer), subject))
+
+	sbom := putOCIManifest(ctx, t, repo, fmt.Sprintf(`{
+		"schemaVersion": 2,
+		"mediaType": %q,
+		"artifactType": "application/spdx+json",
+		"config": %s,
+		"layers": [%s],
+		"subject": %s
+	}`, ociv1.MediaTypeImageManifest, descriptor("application/vnd.oci.empty.v1+json", config), descriptor(ociv1.MediaTypeImageLayer, layer), subject))
+
+	getReferrers := func(t *testing.T, subject digest.Digest, query url.Values) (*httptest.ResponseRecorder, referrersIndex) {
+		req := httptest.NewRequest(http.MethodGet, "/v2/ns/app/referrers/"+subject.String()+"?"+query.Encode(), nil)
+		req = mux.SetURLVars(req, map[string]string{"name": "ns/app", "digest": subject.String()})
+		h := &referrersHandler{
+			Context: &handlers.Context{
+				Context:    dcontext.WithVars(ctx, req),
+				Repository: &namedRepository{name: named},
+			},
+			Registry: reg,
+			Driver:   driver,
+		}
+
+		w := httptest.NewRecorder()
+		h.Get(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+		}
+		var index referrersIndex
+		if err := json.Unmarshal(w.Body.Bytes(), &index); err != nil {
+			t.Fatal(err)
+		}
+		return w, index
+	}
+
+	// The manifests that were pushed before the index are indexed by the
+	// first request.
+	for _, tc := range []struct {
+		name           string
+		subject        digest.Digest
+		query          url.Values
+		expected       map[digest.Digest]string
+		filtersApplied string
+	}{
+		{
+			name:    "all referrers",
+			subject: image,
+			expected: map[digest.Digest]string{
+				signature: "application/vnd.dev.cosign.artifact.sig.v1+json",
+				sbom:      "application/spdx+json",
+			},
+		},
+		{
+			name:    "signatures",
+			subject: image,
+			query:   url.Values{"artifactType": {"application/vnd.dev.cosign.artifact.sig.v1+json"}},
+			expected: map[digest.Digest]string{
+				signature: "application/vnd.dev.cosign.artifact.sig.v1+json",
+			},
+			filtersApplied: "artifactType",
+		},
+		{
+			name:           "unknown artifact type",
+			subject:        image,
+			query:          url.Values{"artifactType": {"application/vnd.example.unknown"}},
+			expected:       map[digest.Digest]string{},
+			filtersApplied: "artifactType",
+		},
+		{
+			name:     "no referrers",
+			subject:  signature,
+			expected: map[digest.Digest]string{},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w, index := getReferrers(t, tc.subject, tc.query)
+			if contentType := w.Header().Get("Content-Type"); contentType != ociv1.MediaTypeImageIndex {
+				t.Errorf("got Content-Type %q, want %q", contentType, ociv1.MediaTypeImageIndex)
+			}
+			if filtersApplied := w.Header().Get("OCI-Filters-Applied"); filtersApplied != tc.filtersApplied {
+				t.Errorf("got OCI-Filters-Applied %q, want %q", filtersApplied, tc.filtersApplied)
+			}
+
+			if index.SchemaVersion != 2 || index.MediaType != ociv1.MediaTypeImageIndex || index.Manifests == nil {
+				t.Errorf("unexpected index: %s", w.Body.String())
+			}
+			got := make(map[digest.Digest]string)
+			for _, desc := range index.Manifests {
+				got[desc.Digest] = desc.ArtifactType
+				if desc.MediaType != ociv1.MediaTypeImageManifest || desc.Size == 0 {
+					t.Errorf("unexpected descriptor: %+v", desc)
+				}
+				if desc.Digest == signature && desc.Annotations["org.example.signer"] != "ci" {
+					t.Errorf("expected the annotations of the signature, got %+v", desc)
+				}
+			}
+			if len(got) != len(tc.expected) {
+				t.Errorf("got referrers %v, want %v", got, tc.expected)
+			}
+			for dgst, artifactType := range tc.expected {
+				if got[dgst] != artifactType {
+					t.Errorf("got artifact type %q for %s, want %q", got[dgst], dgst, artifactType)
+				}
+			}
+		})
+	}
+
+	// The manifests that are pushed later are indexed when they are stored,
+	// the deleted manifests are removed from the index.
+	if indexed, err := regstorage.ReferrersIndexed(ctx, driver, "ns/app"); err != nil || !indexed {
+		t.Fatalf("got indexed %t, %v; want the repository to be indexed", indexed, err)
+	}
+	ms, err := repo.Manifests(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexing := &referrersIndexingManifestService{ManifestService: ms, driver: driver, repo: "ns/app"}
+	var attestationManifest ocischema.DeserializedManifest
+	if err := attestationManifest.UnmarshalJSON([]byte(fmt.Sprintf(`{
+		"schemaVersion": 2,
+		"mediaType": %q,
+		"artifactType": "application/vnd.in-toto+json",
+		"config": %s,
+		"layers": [%s],
+		"subject": %s
+	}`, ociv1.MediaTypeImageManifest, descriptor("application/vnd.oci.empty.v1+json", config), descriptor(ociv1.MediaTypeImageLayer, layer), subject))); err != nil {
+		t.Fatal(err)
+	}
+	attestation, err := indexing.Put(ctx, &attestationManifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.Delete(ctx, sbom); err != nil {
+		t.Fatal(err)
+	}
+
+	_, index := getReferrers(t, image, nil)
+	var got []digest.Digest
+	for _, desc := range index.Manifests {
+		got = append(got, desc.Digest)
+	}
+	expected := []digest.Digest{signature, attestation}
+	sort.Slice(expected, func(i, j int) bool { return expected[i] < expected[j] })
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("got referrers %v, want %v", got, expected)
+	}
+	referrers, err := regstorage.Referrers(ctx, driver, "ns/app", image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := referrers[sbom]; ok {
+		t.Error("expected the deleted referrer to be removed from the index")
+	}
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+var (
+	errRefreshTokenInvalid = errors.New("invalid refresh token")
+	errRefreshTokenExpired = errors.New("refresh token expired")
+)
+
+// refreshTokenClaims is the content of a refresh token.
+type refreshTokenClaims struct {
+	// Token is the OpenShift token the refresh token was issued for.
+	Token string `json:"token"`
+	// ClientID is the client that requested the refresh token.
+	ClientID string `json:"clientID"`
+	// ExpiresAt is the Unix time when the refresh token expires.
+	ExpiresAt int64 `json:"expiresAt"`
+}
+
+// refreshTokens issues and validates the refresh tokens of the Docker
+// Registry v2 OAuth2 token flow.
+//
+// The registry doesn't store refresh tokens. A refresh token has the OpenShift
+// token it was issued for, encrypted with a key derived from the HTTP secret
+// of the registry, so it can be used only with this registry. The token
+// handler checks the OpenShift token on every refresh, so a refresh token
+// stops working when the OpenShift token expires or is revoked.
+type refreshTokens struct {
+	aead     cipher.AEAD
+	lifetime time.Duration
+	now      func() time.Time
+}
+
+func newRefreshTokens(secret string, lifetime time.Duration) (*refreshTokens, error) {
+	key := sha256.Sum256([]byte("openshift.refresh-token:" + secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &refreshTokens{
+		aead:     aead,
+		lifetime: lifetime,
+		now:      time.Now,
+	}, nil
+}
+
+// issue returns a refresh token for the OpenShift token that is requested by
+// clientID.
+func (r *refreshTokens) issue(token, clientID string) (string, error) {
+	plaintext, err := json.Marshal(refreshTokenClaims{
+		Token:     token,
+		ClientID:  clientID,
+		ExpiresAt: r.now().Add(r.lifetime).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, r.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", fmt.Errorf("unable to generate a nonce: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(r.aead.Seal(nonce, nonce, plaintext, nil)), nil
+}
+
+// validate returns the OpenShift token of refreshToken if it was issued to
+// clientID and hasn't expired.
+func (r *refreshTokens) validate(refreshToken, clientID string) (string, error) {
+	ciphertext, err := base64.RawURLEncoding.DecodeString(refreshToken)
+	if err != nil || len(ciphertext) < r.aead.NonceSize() {
+		return "", errRefreshTokenInvalid
+	}
+	nonce, ciphertext := ciphertext[:r.aead.NonceSize()], ciphertext[r.aead.NonceSize():]
+	plaintext, err := r.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", errRefreshTokenInvalid
+	}
+
+	var claims refreshTokenClaims
+	if err := json.Unmarshal(plaintext, &claims); err != nil || len(claims.Token) == 0 {
+		return "", errRefreshTokenInvalid
+	}
+	if claims.ClientID != clientID {
+		return "", errRefreshTokenInvalid
+	}
+	if r.now().Unix() >= claims.ExpiresAt {
+		return "", errRefreshTokenExpired
+	}
+	return claims.Token, nil
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"path"
+	"strings"
+	"time"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	configv1 "github.com/openshift/api/config/v1"
+	"github.com/openshift/library-go/pkg/image/reference"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+	"github.com/openshift/image-registry/pkg/errors"
+)
+
+const (
+	// imageConfigName is the name of the cluster-wide image configuration.
+	imageConfigName = "cluster"
+
+	// registryPolicyTTL is how long the image configuration is cached.
+	registryPolicyTTL = time.Minute
+
+	// registryPolicyErrorTTL is how long the errors reading the image
+	// configuration are cached.
+	registryPolicyErrorTTL = 10 * time.Second
+)
+
+// registryPolicy enforces the registry restrictions of the cluster image
+// configuration on pullthrough. Image stream tags that were imported before
+// a registry was blocked still reference it, so the registry has to check the
+// policy itself.
+type registryPolicy struct {
+	registryClient client.RegistryClient
+
+	// spec caches the spec of the image configuration. A nil value means
+	// there are no restrictions.
+	spec *ttlCache[*configv1.ImageSpec]
+}
+
+func newRegistryPolicy(registryClient client.RegistryClient) *registryPolicy {
+	p := &registryPolicy{
+		registryClient: registryClient,
+	}
+	p.spec = newTTLCache(registryPolicyTTL, registryPolicyErrorTTL, p.loadImageSpec)
+	return p
+}
+
+func (p *registryPolicy) loadImageSpec(ctx context.Context) (*configv1.ImageSpec, error) {
+	c, err := p.registryClient.Client()
+	if err != nil {
+		dcontext.GetLogger(ctx).Errorf("unable to get client to read the image configuration: %v", err)
+		return nil, err
+	}
+
+	config, err := c.ImageConfigs().Get(ctx, imageConfigName, metav1.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		dcontext.GetLogger(ctx).Errorf("unable to get the image configuration %s: %v", imageConfigName, err)
+		return nil, err
+	}
+	return &config.Spec, nil
+}
+
+// imageSpec returns the cached spec of the image configuration. The last
+// known policy is used while the image configuration cannot be read.
+func (p *registryPolicy) imageSpec(ctx context.Context) *configv1.ImageSpec {
+	spec, _ := p.spec.Get(ctx)
+	return spec
+}
+
+// Admit returns an error if ref cannot be pulled through according to the
+// image configuration.
+func (p *registryPolicy) Admit(ctx context.Context, ref reference.DockerImageReference) error {
+	if p == nil {
+		return nil
+	}
+
+	spec := p.imageSpec(ctx)
+	if spec == nil {
+		return nil
+	}
+
+	ref = ref.DockerClientDefaults()
+	if sources := spec.RegistrySources; len(sources.BlockedRegistries) > 0 {
+		for _, scope := range sources.BlockedRegistries {
+			if matchRegistryScope(scope, ref) {
+				return errors.ErrorCodePullthroughRegistryBlocked.WithArgs(ref.Exact(), "spec.registrySources.blockedRegistries")
+			}
+		}
+	} else if len(sources.AllowedRegistries) > 0 {
+		allowed := false
+		for _, scope := range sources.AllowedRegistries {
+			if matchRegistryScope(scope, ref) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return errors.ErrorCodePullthroughRegistryBlocked.WithArgs(ref.Exact(), "spec.registrySources.allowedRegistries")
+		}
+	}
+
+	if len(spec.AllowedRegistriesForImport) > 0 {
+		allowed := false
+		for _, location := range spec.AllowedRegistriesForImport {
+			if matchRegistryDomain(location.DomainName, ref.Registry) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return errors.ErrorCodePullthroughRegistryBlocked.WithArgs(ref.Exact(), "spec.allowedRegistriesForImport")
+		}
+	}
+
+	return nil
+}
+
+// normalizeRegistry returns the canonical name of the Docker Hub registry for
+// its well-known aliases.
+func normalizeRegistry(registry string) string {
+	switch registry {
+	case reference.DockerDefaultV1Registry, reference.DockerDefaultV2Registry:
+		return reference.DockerDefaultRegistry
+	}
+	return registry
+}
+
+// matchRegistryDomain reports whether registry matches the domain name which
+// may contain wildcards.
+func matchRegistryDomain(domain, registry string) bool {
+	domain, registry = normalizeRegistry(domain), normalizeRegistry(registry)
+	if domain == registry {
+		return true
+	}
+	ok, err := path.Match(domain, registry)
+	return err == nil && ok
+}
+
+// matchRegistryScope reports whether ref belongs to scope, which is a
+// registry domain optionally followed by a repository path.
+func matchRegistryScope(scope string, ref reference.DockerImageReference) bool {
+	domain, repo, _ := strings.Cut(scope, "/")
+	if !matchRegistryDomain(domain, ref.Registry) {
+		return false
+	}
+	if len(repo) == 0 {
+		return true
+	}
+	name := ref.RepositoryName()
+	return name == repo || strings.HasPrefix(name, repo+"/")
+}
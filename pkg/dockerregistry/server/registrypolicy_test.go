@@ -0,0 +1,144 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	configv1 "github.com/openshift/api/config/v1"
+	cfgfake "github.com/openshift/client-go/config/clientset/versioned/fake"
+	cfgv1 "github.com/openshift/client-go/config/clientset/versioned/typed/config/v1"
+	"github.com/openshift/library-go/pkg/image/reference"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+	"github.com/openshift/image-registry/pkg/errors"
+	"github.com/openshift/image-registry/pkg/testutil"
+)
+
+type imageConfigClient struct {
+	client.Interface
+	config cfgv1.ConfigV1Interface
+}
+
+func (c *imageConfigClient) ImageConfigs() cfgv1.ImageInterface {
+	return c.config.Images()
+}
+
+type imageConfigRegistryClient struct {
+	client.RegistryClient
+	client client.Interface
+}
+
+func (c *imageConfigRegistryClient) Client() (client.Interface, error) {
+	return c.client, nil
+}
+
+func TestRegistryPolicyAdmit(t *testing.T) {
+	ctx := context.Background()
+	ctx = testutil.WithTestLogger(ctx, t)
+
+	for _, tc := range []struct {
+		name         string
+		spec         *configv1.ImageSpec
+		ref          string
+		expectedRule string
+	}{
+		{
+			name: "no image config",
+			ref:  "docker.io/library/busybox:latest",
+		},
+		{
+			name: "blocked registry",
+			spec: &configv1.ImageSpec{
+				RegistrySources: configv1.RegistrySources{
+					BlockedRegistries: []string{"docker.io"},
+				},
+			},
+			ref:          "busybox:latest",
+			expectedRule: "spec.registrySources.blockedRegistries",
+		},
+		{
+			name: "blocked repository",
+			spec: &configv1.ImageSpec{
+				RegistrySources: configv1.RegistrySources{
+					BlockedRegistries: []string{"quay.io/evil"},
+				},
+			},
+			ref: "quay.io/evilcorp/app:latest",
+		},
+		{
+			name: "allowed registry with wildcard",
+			spec: &configv1.ImageSpec{
+				RegistrySources: configv1.RegistrySources{
+					AllowedRegistries: []string{"*.example.com"},
+				},
+			},
+			ref: "registry.example.com/app/app:latest",
+		},
+		{
+			name: "not allowed registry",
+			spec: &configv1.ImageSpec{
+				RegistrySources: configv1.RegistrySources{
+					AllowedRegistries: []string{"quay.io"},
+				},
+			},
+			ref:          "registry-1.docker.io/library/busybox:latest",
+			expectedRule: "spec.registrySources.allowedRegistries",
+		},
+		{
+			name: "not allowed for import",
+			spec: &configv1.ImageSpec{
+				AllowedRegistriesForImport: []configv1.RegistryLocation{
+					{DomainName: "quay.io"},
+				},
+			},
+			ref:          "docker.io/library/busybox:latest",
+			expectedRule: "spec.allowedRegistriesForImport",
+		},
+		{
+			name: "allowed for import with port",
+			spec: &configv1.ImageSpec{
+				AllowedRegistriesForImport: []configv1.RegistryLocation{
+					{DomainName: "registry.local:5000"},
+				},
+			},
+			ref: "registry.local:5000/ns/app:latest",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfgclient := cfgfake.NewSimpleClientset()
+			if tc.spec != nil {
+				cfgclient = cfgfake.NewSimpleClientset(&configv1.Image{
+					ObjectMeta: metav1.ObjectMeta{Name: imageConfigName},
+					Spec:       *tc.spec,
+				})
+			}
+			policy := newRegistryPolicy(&imageConfigRegistryClient{
+				client: &imageConfigClient{config: cfgclient.ConfigV1()},
+			})
+
+			ref, err := reference.Parse(tc.ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = policy.Admit(ctx, ref)
+			if len(tc.expectedRule) == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+
+			e, ok := err.(errcode.Error)
+			if !ok || e.Code != errors.ErrorCodePullthroughRegistryBlocked {
+				t.Fatalf("got error %v, want %v", err, errors.ErrorCodePullthroughRegistryBlocked)
+			}
+			if want := errors.ErrorCodePullthroughRegistryBlocked.WithArgs(ref.DockerClientDefaults().Exact(), tc.expectedRule); e.Message != want.Message {
+				t.Errorf("got message %q, want %q", e.Message, want.Message)
+			}
+		})
+	}
+}
@@ -15,8 +15,10 @@ import (
 
 	cfgv1 "github.com/openshift/client-go/config/clientset/versioned/typed/config/v1"
 	operatorv1alpha1 "github.com/openshift/client-go/operator/clientset/versioned/typed/operator/v1alpha1"
+	"github.com/openshift/library-go/pkg/image/reference"
 	"github.com/openshift/library-go/pkg/image/registryclient"
 
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/accesslog"
 	"github.com/openshift/image-registry/pkg/dockerregistry/server/cache"
 	"github.com/openshift/image-registry/pkg/dockerregistry/server/metrics"
 	rerrors "github.com/openshift/image-registry/pkg/errors"
@@ -75,9 +77,24 @@ type remoteBlobGetterService struct {
 	icsp          operatorv1alpha1.ImageContentSourcePolicyInterface
 	idms          cfgv1.ImageDigestMirrorSetInterface
 	itms          cfgv1.ImageTagMirrorSetInterface
+	policy        *registryPolicy
+	// fallbackMirror is searched when none of the candidates has the blob.
+	fallbackMirror *fallbackMirror
+	proxy          *clusterProxy
+	authChallenges *authChallenges
+	mirrorHealth   *mirrorHealth
+
+	// sourcesMu protects sources and failedSources.
+	sourcesMu sync.Mutex
+	// sources are the candidate repositories the blobs are downloaded from.
+	sources map[digest.Digest]string
+	// failedSources are the candidate repositories that failed in the
+	// middle of a download of a blob.
+	failedSources map[digest.Digest]map[string]bool
 }
 
 var _ BlobGetterService = &remoteBlobGetterService{}
+var _ blobFailover = &remoteBlobGetterService{}
 
 // NewBlobGetterService returns a getter for remote blobs. Its cache will be shared among different middleware
 // wrappers, which is a must at least for stat calls made on manifest's dependencies during its verification.
@@ -89,16 +106,28 @@ func NewBlobGetterService(
 	icsp operatorv1alpha1.ImageContentSourcePolicyInterface,
 	idms cfgv1.ImageDigestMirrorSetInterface,
 	itms cfgv1.ImageTagMirrorSetInterface,
+	policy *registryPolicy,
+	fallbackMirror *fallbackMirror,
+	proxy *clusterProxy,
+	authChallenges *authChallenges,
+	mirrorHealth *mirrorHealth,
 ) BlobGetterService {
 	return &remoteBlobGetterService{
-		imageStream:   imageStream,
-		getSecrets:    secretsGetter,
-		cache:         cache,
-		digestToStore: newDigestBlobStoreCache(m),
-		metrics:       m,
-		icsp:          icsp,
-		idms:          idms,
-		itms:          itms,
+		imageStream:    imageStream,
+		getSecrets:     secretsGetter,
+		cache:          cache,
+		digestToStore:  newDigestBlobStoreCache(m),
+		metrics:        m,
+		icsp:           icsp,
+		idms:           idms,
+		itms:           itms,
+		policy:         policy,
+		fallbackMirror: fallbackMirror,
+		proxy:          proxy,
+		authChallenges: authChallenges,
+		mirrorHealth:   mirrorHealth,
+		sources:        make(map[digest.Digest]string),
+		failedSources:  make(map[digest.Digest]map[string]bool),
 	}
 }
 
@@ -135,6 +164,9 @@ func (rbgs *remoteBlobGetterService) findBlobStore(ctx context.Context, dgst dig
 		return distribution.Descriptor{}, nil, err
 	}
 
+	// remember the candidates before the search drops the failed ones
+	fallbackRefs := rbgs.fallbackReferences(ctx, repositoryCandidates, search)
+
 	var tooManyRequests error
 	if desc, bs, err := rbgs.findCandidateRepository(ctx, repositoryCandidates, search, cached, dgst, secrets); err == nil {
 		return desc, bs, nil
@@ -152,6 +184,7 @@ func (rbgs *remoteBlobGetterService) findBlobStore(ctx context.Context, dgst dig
 	for k := range search {
 		delete(secondary, k)
 	}
+	fallbackRefs = append(fallbackRefs, rbgs.fallbackReferences(ctx, repositoryCandidates, secondary)...)
 	if desc, bs, err := rbgs.findCandidateRepository(ctx, repositoryCandidates, secondary, cached, dgst, secrets); err == nil {
 		return desc, bs, nil
 	} else if nerr, ok := err.(*client.UnexpectedHTTPResponseError); ok {
@@ -160,6 +193,12 @@ func (rbgs *remoteBlobGetterService) findBlobStore(ctx context.Context, dgst dig
 		}
 	}
 
+	if rbgs.fallbackMirror != nil && len(fallbackRefs) > 0 {
+		if desc, bs, err := rbgs.fallbackMirror.Stat(ctx, fallbackRefs, dgst, rbgs.metrics); err == nil {
+			return desc, bs, nil
+		}
+	}
+
 	nerr := distribution.ErrBlobUnknown
 	if tooManyRequests != nil {
 		nerr = errcode.ErrorCodeTooManyRequests.WithMessage("unable to pullthrough blob")
@@ -167,6 +206,28 @@ func (rbgs *remoteBlobGetterService) findBlobStore(ctx context.Context, dgst dig
 	return distribution.Descriptor{}, nil, nerr
 }
 
+// fallbackReferences returns the references of the candidate repositories
+// that can be looked up in the fallback mirror.
+func (rbgs *remoteBlobGetterService) fallbackReferences(ctx context.Context, repositoryCandidates []string, search map[string]imagestream.ImagePullthroughSpec) []reference.DockerImageReference {
+	if rbgs.fallbackMirror == nil {
+		return nil
+	}
+
+	var refs []reference.DockerImageReference
+	for _, repo := range repositoryCandidates {
+		spec, ok := search[repo]
+		if !ok {
+			continue
+		}
+		// The mirror must not be used to bypass the cluster image policy.
+		if err := rbgs.policy.Admit(ctx, *spec.DockerImageReference); err != nil {
+			continue
+		}
+		refs = append(refs, *spec.DockerImageReference)
+	}
+	return refs
+}
+
 // Stat provides metadata about a blob identified by the digest. If the
 // blob is unknown to the describer, ErrBlobUnknown will be returned.
 func (rbgs *remoteBlobGetterService) Stat(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, error) {
@@ -215,6 +276,46 @@ func (rbgs *remoteBlobGetterService) Open(ctx context.Context, dgst digest.Diges
 	return bs.Open(ctx, dgst)
 }
 
+// Failover excludes the candidate repository that is currently used for the
+// blob dgst and opens the blob in the next candidate repository that has it.
+func (rbgs *remoteBlobGetterService) Failover(ctx context.Context, dgst digest.Digest) (distribution.ReadSeekCloser, error) {
+	rbgs.sourcesMu.Lock()
+	repo, ok := rbgs.sources[dgst]
+	if ok {
+		delete(rbgs.sources, dgst)
+		if rbgs.failedSources[dgst] == nil {
+			rbgs.failedSources[dgst] = make(map[string]bool)
+		}
+		rbgs.failedSources[dgst][repo] = true
+	}
+	rbgs.sourcesMu.Unlock()
+	if !ok {
+		// The blob is served by the fallback mirror, which is the last
+		// resort.
+		return nil, errNoAlternateBlobSource
+	}
+
+	_, bs, err := rbgs.findBlobStore(ctx, dgst)
+	if err != nil {
+		return nil, err
+	}
+	rbgs.digestToStore.Put(dgst, bs)
+
+	return bs.Open(ctx, dgst)
+}
+
+func (rbgs *remoteBlobGetterService) setSource(dgst digest.Digest, repo string) {
+	rbgs.sourcesMu.Lock()
+	defer rbgs.sourcesMu.Unlock()
+	rbgs.sources[dgst] = repo
+}
+
+func (rbgs *remoteBlobGetterService) sourceFailed(dgst digest.Digest, repo string) bool {
+	rbgs.sourcesMu.Lock()
+	defer rbgs.sourcesMu.Unlock()
+	return rbgs.failedSources[dgst][repo]
+}
+
 func (rbgs *remoteBlobGetterService) ServeBlob(ctx context.Context, w http.ResponseWriter, req *http.Request, dgst digest.Digest) error {
 	dcontext.GetLogger(ctx).Debugf("(*remoteBlobGetterService).ServeBlob: starting with dgst=%s", dgst)
 	bs, ok := rbgs.digestToStore.Get(dgst)
@@ -259,6 +360,7 @@ func (rbgs *remoteBlobGetterService) proxyStat(
 		return distribution.Descriptor{}, nil, err
 	}
 
+	accesslog.SetUpstream(ctx, ref.AsRepository().Exact())
 	return desc, pullthroughBlobStore, nil
 }
 
@@ -298,11 +400,18 @@ func (rbgs *remoteBlobGetterService) findCandidateRepository(
 	nerr := distribution.ErrBlobUnknown
 	for _, repo := range cachedRepos {
 		spec, ok := search[repo]
-		if !ok {
+		if !ok || rbgs.sourceFailed(dgst, repo) {
 			continue
 		}
 
-		retriever, impErr := getImportContext(ctx, spec.DockerImageReference, secrets, rbgs.metrics, rbgs.icsp, rbgs.idms, rbgs.itms)
+		if err := rbgs.policy.Admit(ctx, *spec.DockerImageReference); err != nil {
+			dcontext.GetLogger(ctx).Errorf("refusing to pull through %s: %v", spec.DockerImageReference.Exact(), err)
+			nerr = err
+			delete(search, repo)
+			continue
+		}
+
+		retriever, impErr := getImportContext(ctx, spec.DockerImageReference, secrets, spec.PullSecret, rbgs.metrics, rbgs.icsp, rbgs.idms, rbgs.itms, rbgs.proxy, rbgs.authChallenges, rbgs.mirrorHealth)
 		if impErr != nil {
 			return distribution.Descriptor{}, nil, impErr
 		}
@@ -314,17 +423,25 @@ func (rbgs *remoteBlobGetterService) findCandidateRepository(
 			continue
 		}
 		dcontext.GetLogger(ctx).Infof("Found digest location from cache %q in %q", dgst, repo)
+		rbgs.setSource(dgst, repo)
 		return desc, bs, nil
 	}
 
 	// search the remaining registries for this digest
 	for _, repo := range repositoryCandidates {
 		spec, ok := search[repo]
-		if !ok {
+		if !ok || rbgs.sourceFailed(dgst, repo) {
+			continue
+		}
+
+		if err := rbgs.policy.Admit(ctx, *spec.DockerImageReference); err != nil {
+			dcontext.GetLogger(ctx).Errorf("refusing to pull through %s: %v", spec.DockerImageReference.Exact(), err)
+			nerr = err
+			delete(search, repo)
 			continue
 		}
 
-		retriever, impErr := getImportContext(ctx, spec.DockerImageReference, secrets, rbgs.metrics, rbgs.icsp, rbgs.idms, rbgs.itms)
+		retriever, impErr := getImportContext(ctx, spec.DockerImageReference, secrets, spec.PullSecret, rbgs.metrics, rbgs.icsp, rbgs.idms, rbgs.itms, rbgs.proxy, rbgs.authChallenges, rbgs.mirrorHealth)
 		if impErr != nil {
 			return distribution.Descriptor{}, nil, impErr
 		}
@@ -336,6 +453,7 @@ func (rbgs *remoteBlobGetterService) findCandidateRepository(
 		}
 		_ = rbgs.cache.AddDigest(dgst, repo)
 		dcontext.GetLogger(ctx).Infof("Found digest location by search %q in %q", dgst, repo)
+		rbgs.setSource(dgst, repo)
 		return desc, bs, nil
 	}
 	return distribution.Descriptor{}, nil, nerr
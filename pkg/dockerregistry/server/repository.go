@@ -7,6 +7,7 @@ import (
 
 	"github.com/distribution/distribution/v3"
 	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
 	registrystorage "github.com/distribution/distribution/v3/registry/storage"
 
 	restclient "k8s.io/client-go/rest"
@@ -16,6 +17,8 @@ import (
 
 	"github.com/openshift/image-registry/pkg/dockerregistry/server/audit"
 	"github.com/openshift/image-registry/pkg/dockerregistry/server/cache"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/configuration"
 	"github.com/openshift/image-registry/pkg/imagestream"
 )
 
@@ -54,8 +57,16 @@ type repository struct {
 	// remoteBlobGetter is used to fetch blobs from remote registries if pullthrough is enabled.
 	remoteBlobGetter BlobGetterService
 	cache            cache.RepositoryDigest
+
+	// storageUsage is the usage of the storage limit of the image stream
+	// during the request. It is shared by the copies of the repository.
+	storageUsage *storageUsage
 }
 
+// imageStreamCacheName is the name of the per-request image stream cache in
+// metrics.
+const imageStreamCacheName = "imagestream"
+
 // Repository returns a new repository middleware.
 func (app *App) Repository(ctx context.Context, repo distribution.Repository, crossmount bool) (distribution.Repository, distribution.BlobDescriptorServiceFactory, error) {
 	registryOSClient, err := app.registryClient.Client()
@@ -75,11 +86,18 @@ func (app *App) Repository(ctx context.Context, repo distribution.Repository, cr
 		app:        app,
 		crossmount: crossmount,
 
-		imageStream: imagestream.New(ctx, namespace, name, registryOSClient),
+		imageStream: app.newImageStream(ctx, namespace, name, registryOSClient),
 		cache:       cache.NewRepositoryDigest(app.cache),
 		icsp:        registryOSClient.ImageContentSourcePolicy(),
 		idms:        registryOSClient.ImageDigestMirrorSet(),
 		itms:        registryOSClient.ImageTagMirrorSet(),
+
+		storageUsage: &storageUsage{},
+	}
+
+	if app.cacheWarmup != nil && app.cacheWarmup.begin(r.imageStream.Reference()) {
+		// The warm-up outlives the request, so it uses its own image stream.
+		go app.cacheWarmup.warm(app.ctx, app.newImageStream(app.ctx, namespace, name, registryOSClient))
 	}
 
 	r.remoteBlobGetter = NewBlobGetterService(
@@ -90,6 +108,11 @@ func (app *App) Repository(ctx context.Context, repo distribution.Repository, cr
 		r.icsp,
 		r.idms,
 		r.itms,
+		r.app.registryPolicy,
+		r.app.fallbackMirror,
+		r.app.proxy,
+		r.app.authChallenges,
+		r.app.mirrorHealth,
 	)
 
 	repo = distribution.Repository(r)
@@ -100,12 +123,30 @@ func (app *App) Repository(ctx context.Context, repo distribution.Repository, cr
 	return repo, bdsf, nil
 }
 
+// newImageStream returns the image stream namespace/name that retries its
+// writes to the API server as configured.
+func (app *App) newImageStream(ctx context.Context, namespace, name string, c client.Interface) imagestream.ImageStream {
+	is := imagestream.NewWithCacheMetrics(ctx, namespace, name, c, app.metrics.InternalCache(imageStreamCacheName))
+	if cfg := app.config.WriteRetries; cfg != nil {
+		is = imagestream.WithWriteRetries(is, imagestream.WriteRetries{
+			Attempts:       cfg.Attempts,
+			InitialBackoff: cfg.InitialBackoff,
+			MaxBackoff:     cfg.MaxBackoff,
+			Metrics:        app.metrics.APIWrites(),
+		})
+	}
+	if !app.autoProvisionImageStreams() {
+		is = imagestream.WithoutAutoProvisioning(is)
+	}
+	return is
+}
+
 // Manifests returns r, which implements distribution.ManifestService.
 func (r *repository) Manifests(ctx context.Context, options ...distribution.ManifestServiceOption) (distribution.ManifestService, error) {
 	// We do a verification of our own. We do more restrictive checks and we
 	// know about remote blobs.
 	opts := append(options, registrystorage.SkipLayerVerification())
-	ms, err := r.Repository.Manifests(ctx, opts...)
+	localManifests, err := r.localManifests(ctx, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -115,29 +156,124 @@ func (r *repository) Manifests(ctx context.Context, options ...distribution.Mani
 		return nil, err
 	}
 
-	ms = &manifestService{
-		manifests:        ms,
-		blobStore:        r.Blobs(ctx),
-		serverAddr:       r.app.config.Server.Addr,
-		imageStream:      r.imageStream,
-		registryOSClient: registryOSClient,
-		cache:            r.cache,
-		acceptSchema2:    r.app.config.Compatibility.AcceptSchema2,
+	var admitBlob func(ctx context.Context, size int64) error
+	var pushRejected func(ctx context.Context, messageFmt string, args ...interface{})
+	if r.app.quotaEnforcing.enforcementEnabled {
+		admitBlob = func(ctx context.Context, size int64) error {
+			return admitBlobWrite(ctx, r, size)
+		}
+		pushRejected = r.pushRejectedEventf
+	}
+
+	var ms distribution.ManifestService = &manifestService{
+		manifests:           localManifests,
+		blobStore:           r.Blobs(ctx),
+		serverAddr:          r.app.config.Server.Addr,
+		imageStream:         r.imageStream,
+		registryOSClient:    registryOSClient,
+		cache:               r.cache,
+		acceptSchema2:       r.app.config.Compatibility.AcceptSchema2,
+		maxManifestBytes:    r.app.config.Compatibility.MaxManifestBytes,
+		maxLayers:           r.app.config.Compatibility.MaxLayers,
+		admitBlob:           admitBlob,
+		pushRejected:        pushRejected,
+		manifestAnnotations: r.app.config.Compatibility.ManifestAnnotations,
+		allowedMediaTypes:   r.app.config.Compatibility.AllowedMediaTypes,
+		blockedMediaTypes:   r.app.config.Compatibility.BlockedMediaTypes,
+		rejectForeignLayers: r.app.config.Compatibility.ForeignLayers == configuration.ForeignLayersReject,
+		foreignLayerMirror:  r.app.foreignLayerMirror,
+		policyHooks:         r.app.policyHooks,
+		layerHints:          r.app.layerHints,
+		puts:                r.app.manifestPuts,
+	}
+
+	if r.app.degraded != nil {
+		ms = &degradedManifestService{
+			ManifestService: ms,
+			local:           localManifests,
+			degraded:        r.app.degraded,
+		}
 	}
 
 	ms = &pullthroughManifestService{
 		ManifestService: ms,
 		newLocalManifestService: func(ctx context.Context) (distribution.ManifestService, error) {
-			return r.Repository.Manifests(ctx, opts...)
+			return r.localManifests(ctx, opts...)
 		},
-		imageStream:  r.imageStream,
-		cache:        r.cache,
-		mirror:       r.app.config.Pullthrough.Mirror,
-		registryAddr: r.app.config.Server.Addr,
-		metrics:      r.app.metrics,
-		idms:         r.idms,
-		icsp:         r.icsp,
-		itms:         r.itms,
+		localBlobStore:     r.localBlobs(ctx),
+		imageStream:        r.imageStream,
+		cache:              r.cache,
+		mirror:             r.app.config.Pullthrough.Mirror,
+		foreignLayerMirror: r.app.foreignLayerMirror,
+		registryAddr:       r.app.config.Server.Addr,
+		metrics:            r.app.metrics,
+		idms:               r.idms,
+		icsp:               r.icsp,
+		itms:               r.itms,
+		policy:             r.app.registryPolicy,
+		fallbackMirror:     r.app.fallbackMirror,
+		proxy:              r.app.proxy,
+		authChallenges:     r.app.authChallenges,
+		mirrorHealth:       r.app.mirrorHealth,
+		mirroredImages:     r.app.mirroredImages,
+	}
+
+	if r.app.platformPulls != nil {
+		ms = &platformPullsManifestService{
+			ManifestService: ms,
+			imageStream:     r.imageStream,
+			platformPulls:   r.app.platformPulls,
+		}
+	}
+
+	if r.app.config.Signatures.TagConvention {
+		ms = &cosignTagManifestService{
+			ManifestService: ms,
+			blobStore:       r.Blobs(ctx),
+		}
+	}
+
+	if r.app.tagPropagator != nil {
+		ms = &tagPropagatingManifestService{
+			ManifestService: ms,
+			ref:             r.imageStream.Reference(),
+			propagator:      r.app.tagPropagator,
+		}
+	}
+
+	if r.app.signatureVerifier != nil {
+		ms = &signatureVerifyingManifestService{
+			ManifestService: ms,
+			imageStream:     r.imageStream,
+			verifier:        r.app.signatureVerifier,
+		}
+	}
+
+	if r.app.config.Compatibility.DisableSchema1 {
+		ms = &noSchema1ManifestService{
+			ManifestService: ms,
+		}
+	}
+
+	if r.app.ociConversions != nil {
+		ms = &ociConvertingManifestService{
+			ManifestService: ms,
+			tags:            r.Tags(ctx),
+			conversions:     r.app.ociConversions,
+		}
+	}
+
+	if r.app.config.Compatibility.NegotiateManifests {
+		ms = &negotiatingManifestService{
+			ManifestService: ms,
+		}
+	}
+
+	if len(r.app.config.Server.CacheControl) > 0 {
+		ms = &cacheControlManifestService{
+			ManifestService: ms,
+			cacheControl:    r.app.config.Server.CacheControl,
+		}
 	}
 
 	ms = newPendingErrorsManifestService(ms, r)
@@ -149,10 +285,72 @@ func (r *repository) Manifests(ctx context.Context, options ...distribution.Mani
 	return ms, nil
 }
 
+// localManifests returns the manifest service of the storage. The manifests
+// that are stored are added to the index of the referrers.
+func (r *repository) localManifests(ctx context.Context, options ...distribution.ManifestServiceOption) (distribution.ManifestService, error) {
+	ms, err := r.Repository.Manifests(ctx, options...)
+	if err != nil {
+		return nil, err
+	}
+	return &referrersIndexingManifestService{
+		ManifestService: ms,
+		driver:          r.app.driver,
+		repo:            r.Named().Name(),
+	}, nil
+}
+
+// localBlobs returns the blob store of the storage for the blobs that are
+// mirrored from remote repositories.
+func (r *repository) localBlobs(ctx context.Context) distribution.BlobStore {
+	bs := r.Repository.Blobs(ctx)
+
+	if r.app.decompressionLimits != nil {
+		bs = &decompressionLimitedBlobStore{
+			BlobStore: bs,
+
+			limits: r.app.decompressionLimits,
+			repo:   r,
+		}
+	}
+
+	return bs
+}
+
 // Blobs returns a blob store which can delegate to remote repositories.
 func (r *repository) Blobs(ctx context.Context) distribution.BlobStore {
 	bs := r.Repository.Blobs(ctx)
 
+	bs = &blobDeletingBlobStore{
+		BlobStore: bs,
+
+		repo: r,
+	}
+
+	if r.app.decompressionLimits != nil && r.app.config.Security.CheckUploads {
+		bs = &decompressionLimitedBlobStore{
+			BlobStore: bs,
+
+			limits: r.app.decompressionLimits,
+			repo:   r,
+		}
+	}
+
+	if r.app.zeroCopyRootDirectory != "" {
+		bs = &zeroCopyBlobStore{
+			BlobStore: bs,
+
+			rootDirectory: r.app.zeroCopyRootDirectory,
+		}
+	}
+
+	if !r.app.autoProvisionImageStreams() {
+		bs = &imageStreamRequiredBlobStore{
+			BlobStore: bs,
+
+			imageStream: r.imageStream,
+		}
+	}
+
 	if r.app.quotaEnforcing.enforcementEnabled {
 		bs = &quotaRestrictedBlobStore{
 			BlobStore: bs,
@@ -161,13 +359,80 @@ func (r *repository) Blobs(ctx context.Context) distribution.BlobStore {
 		}
 	}
 
+	if r.app.config.Quota.StorageLimits {
+		bs = &storageLimitedBlobStore{
+			BlobStore: bs,
+
+			repo: r,
+		}
+	}
+
+	if r.app.uploads != nil {
+		bs = &progressBlobStore{
+			BlobStore: bs,
+
+			uploads: r.app.uploads,
+			repo:    r.Named().Name(),
+		}
+	}
+
+	// The name was validated when the repository was created.
+	namespace, _, _ := getNamespaceName(r.Named().Name())
 	bs = &pullthroughBlobStore{
 		BlobStore: bs,
 
 		remoteBlobGetter:  r.remoteBlobGetter,
+		repo:              r.Named().Name(),
 		writeLimiter:      r.app.writeLimiter,
 		mirror:            r.app.config.Pullthrough.Mirror,
-		newLocalBlobStore: r.Repository.Blobs,
+		newLocalBlobStore: r.localBlobs,
+		coalescing:        r.app.metrics.BlobRequestCoalescing(),
+		transfers:         r.app.metrics.BlobTransfers(),
+		namespace:         namespace,
+		mirroredImages:    r.app.mirroredImages,
+		mirrorQueue:       r.app.mirrorQueue,
+	}
+
+	if r.app.blobRedirector != nil {
+		bs = &redirectingBlobStore{
+			BlobStore: bs,
+
+			redirector: r.app.blobRedirector,
+			repo:       r.Named().Name(),
+		}
+	}
+
+	if len(r.app.config.Server.CacheControl) > 0 {
+		bs = &cacheControlBlobStore{
+			BlobStore: bs,
+
+			cacheControl: r.app.config.Server.CacheControl,
+		}
+	}
+
+	if r.app.config.Server.BlobMediaTypes {
+		bs = &blobMediaTypeBlobStore{
+			BlobStore: bs,
+
+			imageStream: r.imageStream,
+		}
+	}
+
+	if r.app.blobPulls != nil {
+		bs = &pullRecordingBlobStore{
+			BlobStore: bs,
+
+			pulls: r.app.blobPulls,
+		}
+	}
+
+	if len(r.app.policyHooks) > 0 {
+		bs = &policyBlobStore{
+			BlobStore: bs,
+
+			hooks: r.app.policyHooks,
+			repo:  r.Named().Name(),
+		}
 	}
 
 	bs = newPendingErrorsBlobStore(bs, r)
@@ -186,6 +451,9 @@ func (r *repository) Tags(ctx context.Context) distribution.TagService {
 	ts = &tagService{
 		TagService:  ts,
 		imageStream: r.imageStream,
+		tagDigests:  r.app.tagDigests,
+		tagIndex:    r.app.tagIndex,
+		policyHooks: r.app.policyHooks,
 	}
 
 	ts = newPendingErrorsTagService(ts, r)
@@ -225,5 +493,11 @@ func (r *repository) checkPendingErrors(ctx context.Context) error {
 
 	dcontext.GetLogger(r.ctx).Debugf("Origin auth: found deferred error for %s: %v", r.imageStream.Reference(), repoErr)
 
+	// Distribution reports the errors of blob stores that refuse to start
+	// uploads as unknown errors.
+	if err, ok := repoErr.(errcode.Error); ok {
+		return reportPayloadError(ctx, err)
+	}
+
 	return repoErr
 }
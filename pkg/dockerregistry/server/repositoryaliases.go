@@ -0,0 +1,155 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	regapi "github.com/distribution/distribution/v3/registry/api/v2"
+	"github.com/gorilla/mux"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/configuration"
+)
+
+const (
+	// repositoryAliasesTTL is how long the aliases from the ConfigMap are
+	// cached.
+	repositoryAliasesTTL = time.Minute
+
+	// repositoryAliasesErrorTTL is how long the errors reading the ConfigMap
+	// are cached.
+	repositoryAliasesErrorTTL = 10 * time.Second
+)
+
+// repositoryAliases maps names without a namespace to repositories according
+// to a ConfigMap.
+type repositoryAliases struct {
+	registryClient client.RegistryClient
+	namespace      string
+	name           string
+
+	aliases *ttlCache[map[string]string]
+}
+
+func newRepositoryAliases(registryClient client.RegistryClient, configMap string) *repositoryAliases {
+	namespace, name, _ := strings.Cut(configMap, "/")
+	a := &repositoryAliases{
+		registryClient: registryClient,
+		namespace:      namespace,
+		name:           name,
+	}
+	a.aliases = newTTLCache(repositoryAliasesTTL, repositoryAliasesErrorTTL, a.load)
+	return a
+}
+
+// Lookup returns the repository for alias. The last known aliases are used
+// while the ConfigMap cannot be read.
+func (a *repositoryAliases) Lookup(ctx context.Context, alias string) (string, bool) {
+	aliases, _ := a.aliases.Get(ctx)
+	repo, ok := aliases[alias]
+	return repo, ok
+}
+
+func (a *repositoryAliases) load(ctx context.Context) (map[string]string, error) {
+	c, err := a.registryClient.Client()
+	if err != nil {
+		dcontext.GetLogger(ctx).Errorf("unable to get client to read the repository aliases: %v", err)
+		return nil, err
+	}
+
+	cm, err := c.ConfigMaps(a.namespace).Get(ctx, a.name, metav1.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		dcontext.GetLogger(ctx).Errorf("unable to get the repository aliases from the config map %s/%s: %v", a.namespace, a.name, err)
+		return nil, err
+	}
+
+	aliases := make(map[string]string, len(cm.Data))
+	for alias, repo := range cm.Data {
+		repo = strings.TrimSpace(repo)
+		if _, _, err := getNamespaceName(repo); err != nil {
+			dcontext.GetLogger(ctx).Errorf("ignoring the repository alias %s in the config map %s/%s: %v", alias, a.namespace, a.name, err)
+			continue
+		}
+		aliases[alias] = repo
+	}
+	return aliases, nil
+}
+
+// repositoryAliasHandler rewrites requests for repositories with a name
+// without a namespace, so that external consumers can use simple image
+// references that don't depend on project names.
+type repositoryAliasHandler struct {
+	router           *mux.Router
+	handler          http.Handler
+	defaultNamespace string
+	aliases          *repositoryAliases
+}
+
+// newRepositoryAliasHandler returns handler if neither the default namespace
+// nor the aliases are configured.
+func newRepositoryAliasHandler(prefix string, handler http.Handler, cfg *configuration.Aliases, registryClient client.RegistryClient) http.Handler {
+	if cfg == nil || (len(cfg.DefaultNamespace) == 0 && len(cfg.ConfigMap) == 0) {
+		return handler
+	}
+
+	h := &repositoryAliasHandler{
+		router:           regapi.RouterWithPrefix(prefix),
+		handler:          handler,
+		defaultNamespace: cfg.DefaultNamespace,
+	}
+	if len(cfg.ConfigMap) > 0 {
+		h.aliases = newRepositoryAliases(registryClient, cfg.ConfigMap)
+	}
+	return h
+}
+
+// resolve returns the repository for name, or false if name is not an alias.
+func (h *repositoryAliasHandler) resolve(ctx context.Context, name string) (string, bool) {
+	if strings.Contains(name, "/") {
+		return "", false
+	}
+	if h.aliases != nil {
+		if repo, ok := h.aliases.Lookup(ctx, name); ok {
+			return repo, true
+		}
+	}
+	if len(h.defaultNamespace) > 0 {
+		return h.defaultNamespace + "/" + name, true
+	}
+	return "", false
+}
+
+func (h *repositoryAliasHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var match mux.RouteMatch
+	if !h.router.Match(r, &match) {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+
+	name, ok := match.Vars["name"]
+	if !ok {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+
+	repo, ok := h.resolve(r.Context(), name)
+	if !ok {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+
+	dcontext.GetLogger(r.Context()).Debugf("serving repository %s for %s", repo, name)
+
+	r = r.Clone(r.Context())
+	r.URL.Path = strings.Replace(r.URL.Path, "/v2/"+name+"/", "/v2/"+repo+"/", 1)
+	r.URL.RawPath = ""
+	r.RequestURI = r.URL.RequestURI()
+	h.handler.ServeHTTP(w, r)
+}
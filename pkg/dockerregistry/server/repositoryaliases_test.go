@@ -0,0 +1,128 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/configuration"
+)
+
+// configMapClient serves the config maps from memory.
+type configMapClient struct {
+	client.Interface
+	configMaps []*corev1.ConfigMap
+}
+
+func (c *configMapClient) ConfigMaps(namespace string) client.ConfigMapInterface {
+	return &namespacedConfigMapClient{configMapClient: c, namespace: namespace}
+}
+
+type namespacedConfigMapClient struct {
+	*configMapClient
+	namespace string
+}
+
+func (c *namespacedConfigMapClient) Get(ctx context.Context, name string, opts metav1.GetOptions) (*corev1.ConfigMap, error) {
+	for _, cm := range c.configMaps {
+		if cm.Namespace == c.namespace && cm.Name == name {
+			return cm.DeepCopy(), nil
+		}
+	}
+	return nil, kerrors.NewNotFound(corev1.Resource("configmaps"), name)
+}
+
+func (c *namespacedConfigMapClient) Create(ctx context.Context, configMap *corev1.ConfigMap, opts metav1.CreateOptions) (*corev1.ConfigMap, error) {
+	return nil, fmt.Errorf("unexpected creation of the config map %s/%s", c.namespace, configMap.Name)
+}
+
+func (c *namespacedConfigMapClient) Update(ctx context.Context, configMap *corev1.ConfigMap, opts metav1.UpdateOptions) (*corev1.ConfigMap, error) {
+	return nil, fmt.Errorf("unexpected update of the config map %s/%s", c.namespace, configMap.Name)
+}
+
+func TestRepositoryAliasHandler(t *testing.T) {
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "openshift-image-registry",
+			Name:      "repository-aliases",
+		},
+		Data: map[string]string{
+			"app":     "team-a/frontend",
+			"invalid": "no-namespace",
+		},
+	}
+	registryClient := &imageConfigRegistryClient{
+		client: &configMapClient{configMaps: []*corev1.ConfigMap{configMap}},
+	}
+
+	var gotPath string
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+	})
+
+	for _, tc := range []struct {
+		name     string
+		cfg      *configuration.Aliases
+		path     string
+		wantPath string
+	}{
+		{
+			name:     "not configured",
+			cfg:      &configuration.Aliases{},
+			path:     "/v2/app/manifests/latest",
+			wantPath: "/v2/app/manifests/latest",
+		},
+		{
+			name:     "default namespace",
+			cfg:      &configuration.Aliases{DefaultNamespace: "shared"},
+			path:     "/v2/app/manifests/latest",
+			wantPath: "/v2/shared/app/manifests/latest",
+		},
+		{
+			name:     "name with namespace",
+			cfg:      &configuration.Aliases{DefaultNamespace: "shared"},
+			path:     "/v2/team-b/app/blobs/sha256:4355a46b19d348dc2f57c046f8ef63d4538ebb936000f3c9ee954a27460dd865",
+			wantPath: "/v2/team-b/app/blobs/sha256:4355a46b19d348dc2f57c046f8ef63d4538ebb936000f3c9ee954a27460dd865",
+		},
+		{
+			name:     "alias",
+			cfg:      &configuration.Aliases{DefaultNamespace: "shared", ConfigMap: "openshift-image-registry/repository-aliases"},
+			path:     "/v2/app/tags/list",
+			wantPath: "/v2/team-a/frontend/tags/list",
+		},
+		{
+			name:     "invalid alias",
+			cfg:      &configuration.Aliases{DefaultNamespace: "shared", ConfigMap: "openshift-image-registry/repository-aliases"},
+			path:     "/v2/invalid/blobs/uploads/",
+			wantPath: "/v2/shared/invalid/blobs/uploads/",
+		},
+		{
+			name:     "unknown alias without default namespace",
+			cfg:      &configuration.Aliases{ConfigMap: "openshift-image-registry/repository-aliases"},
+			path:     "/v2/other/manifests/latest",
+			wantPath: "/v2/other/manifests/latest",
+		},
+		{
+			name:     "catalog",
+			cfg:      &configuration.Aliases{DefaultNamespace: "shared"},
+			path:     "/v2/_catalog",
+			wantPath: "/v2/_catalog",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			gotPath = ""
+			h := newRepositoryAliasHandler("", inner, tc.cfg, registryClient)
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, tc.path, nil))
+			if gotPath != tc.wantPath {
+				t.Errorf("got path %s, want %s", gotPath, tc.wantPath)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"context"
+	"net/http"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/uuid"
+
+	"github.com/openshift/image-registry/pkg/requesttrace"
+)
+
+// maxRequestIDLength is the maximum length of a correlation ID that is
+// accepted from clients.
+const maxRequestIDLength = 128
+
+// requestIDHandler assigns a correlation ID to every request. The ID is taken
+// from the X-Request-Id header of the request if it is valid, otherwise a new
+// one is generated. The ID is returned in the X-Request-Id header of the
+// response, added to the log entries and to the error details of the
+// request, and passed to the upstream registries.
+type requestIDHandler struct {
+	handler http.Handler
+}
+
+func newRequestIDHandler(handler http.Handler) http.Handler {
+	return &requestIDHandler{
+		handler: handler,
+	}
+}
+
+func (h *requestIDHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := r.Header.Get(requesttrace.RequestIDHeader)
+	if !isValidRequestID(id) {
+		id = uuid.Generate().String()
+	}
+
+	// The header of the request is used by the request tracer to pass the ID
+	// to the upstream registries.
+	r.Header.Set(requesttrace.RequestIDHeader, id)
+	w.Header().Set(requesttrace.RequestIDHeader, id)
+
+	ctx := withRequestID(r.Context(), id)
+	ctx = withRequestIDLogger(ctx)
+	h.handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// withRequestIDLogger returns a new Context with a logger that has the
+// correlation ID of the request. The distribution application replaces the
+// logger of the request context, so this is done again once the request is
+// authorized.
+func withRequestIDLogger(ctx context.Context) context.Context {
+	if requestIDFrom(ctx) == "" {
+		return ctx
+	}
+	return dcontext.WithLogger(ctx, dcontext.GetLogger(ctx, requestIDKey))
+}
+
+// isValidRequestID reports whether id can be used as a correlation ID. It
+// should be short and consist of printable ASCII characters, so that it can
+// be safely logged and sent in headers.
+func isValidRequestID(id string) bool {
+	if len(id) == 0 || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
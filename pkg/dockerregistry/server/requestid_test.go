@@ -0,0 +1,115 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	regapi "github.com/distribution/distribution/v3/registry/api/v2"
+)
+
+func TestRequestIDHandler(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		requestID string
+		keep      bool
+	}{
+		{
+			name:      "client id",
+			requestID: "0f2d5b9c-trace",
+			keep:      true,
+		},
+		{
+			name: "no id",
+		},
+		{
+			name:      "invalid id",
+			requestID: "bad id\x7f",
+		},
+		{
+			name:      "too long id",
+			requestID: strings.Repeat("a", maxRequestIDLength+1),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var gotID, gotHeader string
+			inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotID = requestIDFrom(r.Context())
+				gotHeader = r.Header.Get("X-Request-Id")
+				_ = errcode.ServeJSON(w, regapi.ErrorCodeManifestUnknown)
+			})
+			h := newRequestIDHandler(newOCIErrorHandler("", inner))
+
+			req := httptest.NewRequest(http.MethodGet, "/v2/ns/is/manifests/latest", nil)
+			if tc.requestID != "" {
+				req.Header.Set("X-Request-Id", tc.requestID)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			if gotID == "" {
+				t.Fatal("expected the request to have an id")
+			}
+			if tc.keep && gotID != tc.requestID {
+				t.Errorf("got id %q, want %q", gotID, tc.requestID)
+			}
+			if !tc.keep && gotID == tc.requestID {
+				t.Errorf("expected the id %q to be replaced", tc.requestID)
+			}
+			if gotHeader != gotID {
+				t.Errorf("got request header %q, want %q", gotHeader, gotID)
+			}
+			if header := w.Header().Get("X-Request-Id"); header != gotID {
+				t.Errorf("got response header %q, want %q", header, gotID)
+			}
+
+			var envelope struct {
+				Errors []struct {
+					Code   string `json:"code"`
+					Detail struct {
+						RequestID string `json:"requestID"`
+					} `json:"detail"`
+				} `json:"errors"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &envelope); err != nil {
+				t.Fatalf("unable to decode the response %q: %v", w.Body.String(), err)
+			}
+			if len(envelope.Errors) != 1 {
+				t.Fatalf("got %d errors, want 1", len(envelope.Errors))
+			}
+			if envelope.Errors[0].Detail.RequestID != gotID {
+				t.Errorf("got request id %q in the error detail, want %q", envelope.Errors[0].Detail.RequestID, gotID)
+			}
+		})
+	}
+}
+
+func TestTranslateOCIErrorsRequestID(t *testing.T) {
+	body := []byte(`{"errors":[` +
+		`{"code":"TAG_INVALID","message":"invalid tag","detail":{"tag":"latest"}},` +
+		`{"code":"MANIFEST_UNKNOWN","message":"manifest unknown","detail":"latest"}]}`)
+
+	translated, ok := translateOCIErrors(body, nil, "req-1")
+	if !ok {
+		t.Fatal("expected the errors to be changed")
+	}
+
+	var envelope struct {
+		Errors []ociError `json:"errors"`
+	}
+	if err := json.Unmarshal(translated, &envelope); err != nil {
+		t.Fatal(err)
+	}
+	if envelope.Errors[0].Code != "TAG_INVALID" {
+		t.Errorf("got code %s, want the code to be kept without the translation table", envelope.Errors[0].Code)
+	}
+	if detail := string(envelope.Errors[0].Detail); detail != `{"requestID":"req-1","tag":"latest"}` {
+		t.Errorf("got detail %s", detail)
+	}
+	if detail := string(envelope.Errors[1].Detail); detail != `"latest"` {
+		t.Errorf("got detail %s, want the string detail to be kept", detail)
+	}
+}
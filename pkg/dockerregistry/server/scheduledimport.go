@@ -0,0 +1,121 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	imageapiv1 "github.com/openshift/api/image/v1"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/coordination"
+)
+
+const scheduledImportPageSize = 500
+
+// scheduledImportReconciler periodically re-imports tags that have a
+// scheduled import policy and are pulled through the registry. It is an
+// alternative to the scheduled import controller for clusters where the
+// controller is disabled. The imports are performed by the master API, which
+// also updates the tag history of the image streams.
+type scheduledImportReconciler struct {
+	client   client.Interface
+	interval time.Duration
+
+	// state keeps the schedule when the leadership moves to another
+	// replica. It is nil if the replicas don't coordinate.
+	state *coordination.State
+}
+
+func newScheduledImportReconciler(osClient client.Interface, interval time.Duration) *scheduledImportReconciler {
+	return &scheduledImportReconciler{
+		client:   osClient,
+		interval: interval,
+	}
+}
+
+// Run re-imports the scheduled tags every interval until ctx is done.
+func (r *scheduledImportReconciler) Run(ctx context.Context) {
+	dcontext.GetLogger(ctx).Infof("starting scheduled imports of pullthrough tags every %s", r.interval)
+	r.state.Every(ctx, "scheduledimport", r.interval, r.reconcile)
+}
+
+func (r *scheduledImportReconciler) reconcile(ctx context.Context) {
+	opts := metav1.ListOptions{Limit: scheduledImportPageSize}
+	for {
+		iss, err := r.client.ImageStreams(metav1.NamespaceAll).List(ctx, opts)
+		if apierrors.IsResourceExpired(err) && len(opts.Continue) > 0 {
+			dcontext.GetLogger(ctx).Warnf("scheduled import: continuation token expired (%v), starting over", err)
+			opts.Continue = ""
+			continue
+		}
+		if err != nil {
+			dcontext.GetLogger(ctx).Errorf("scheduled import: unable to list image streams: %v", err)
+			return
+		}
+
+		for i := range iss.Items {
+			r.importImageStream(ctx, &iss.Items[i])
+		}
+
+		if len(iss.Continue) == 0 {
+			return
+		}
+		opts.Continue = iss.Continue
+	}
+}
+
+func (r *scheduledImportReconciler) importImageStream(ctx context.Context, is *imageapiv1.ImageStream) {
+	isi := newScheduledImageStreamImport(is)
+	if isi == nil {
+		return
+	}
+
+	_, err := r.client.ImageStreamImports(is.Namespace).Create(ctx, isi, metav1.CreateOptions{})
+	if err != nil {
+		dcontext.GetLogger(ctx).Errorf("scheduled import: unable to import tags of image stream %s/%s: %v", is.Namespace, is.Name, err)
+		return
+	}
+	dcontext.GetLogger(ctx).Debugf("scheduled import: imported %d tag(s) of image stream %s/%s", len(isi.Spec.Images), is.Namespace, is.Name)
+}
+
+// newScheduledImageStreamImport returns an import request for the tags of is
+// that have a scheduled import policy and the Local reference policy. It
+// returns nil if there are no such tags.
+func newScheduledImageStreamImport(is *imageapiv1.ImageStream) *imageapiv1.ImageStreamImport {
+	isi := &imageapiv1.ImageStreamImport{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            is.Name,
+			Namespace:       is.Namespace,
+			ResourceVersion: is.ResourceVersion,
+			UID:             is.UID,
+		},
+		Spec: imageapiv1.ImageStreamImportSpec{
+			Import: true,
+		},
+	}
+
+	for _, tag := range is.Spec.Tags {
+		if tag.From == nil || tag.From.Kind != "DockerImage" {
+			continue
+		}
+		if !tag.ImportPolicy.Scheduled || tag.ReferencePolicy.Type != imageapiv1.LocalTagReferencePolicy {
+			continue
+		}
+		isi.Spec.Images = append(isi.Spec.Images, imageapiv1.ImageImportSpec{
+			From:            *tag.From,
+			To:              &corev1.LocalObjectReference{Name: tag.Name},
+			ImportPolicy:    tag.ImportPolicy,
+			ReferencePolicy: tag.ReferencePolicy,
+		})
+	}
+
+	if len(isi.Spec.Images) == 0 {
+		return nil
+	}
+	return isi
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgotesting "k8s.io/client-go/testing"
+
+	imageapiv1 "github.com/openshift/api/image/v1"
+	imagefakeclient "github.com/openshift/client-go/image/clientset/versioned/typed/image/v1/fake"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+)
+
+func TestScheduledImportReconciler(t *testing.T) {
+	scheduledTag := func(name, from string, referencePolicy imageapiv1.TagReferencePolicyType) imageapiv1.TagReference {
+		return imageapiv1.TagReference{
+			Name: name,
+			From: &corev1.ObjectReference{
+				Kind: "DockerImage",
+				Name: from,
+			},
+			ImportPolicy: imageapiv1.TagImportPolicy{
+				Scheduled: true,
+			},
+			ReferencePolicy: imageapiv1.TagReferencePolicy{
+				Type: referencePolicy,
+			},
+		}
+	}
+
+	streams := []imageapiv1.ImageStream{
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "scheduled", ResourceVersion: "5"},
+			Spec: imageapiv1.ImageStreamSpec{
+				Tags: []imageapiv1.TagReference{
+					scheduledTag("latest", "docker.io/library/busybox:latest", imageapiv1.LocalTagReferencePolicy),
+					scheduledTag("source", "docker.io/library/busybox:1.36", imageapiv1.SourceTagReferencePolicy),
+					{
+						Name: "manual",
+						From: &corev1.ObjectReference{Kind: "DockerImage", Name: "docker.io/library/busybox:1.35"},
+						ReferencePolicy: imageapiv1.TagReferencePolicy{
+							Type: imageapiv1.LocalTagReferencePolicy,
+						},
+					},
+				},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "unscheduled"},
+			Spec: imageapiv1.ImageStreamSpec{
+				Tags: []imageapiv1.TagReference{
+					{
+						Name: "alias",
+						From: &corev1.ObjectReference{Kind: "ImageStreamTag", Name: "scheduled:latest"},
+					},
+				},
+			},
+		},
+	}
+
+	var imports []*imageapiv1.ImageStreamImport
+	imageClient := &imagefakeclient.FakeImageV1{Fake: &clientgotesting.Fake{}}
+	imageClient.AddReactor("list", "imagestreams", func(action clientgotesting.Action) (bool, runtime.Object, error) {
+		return true, &imageapiv1.ImageStreamList{Items: streams}, nil
+	})
+	imageClient.AddReactor("create", "imagestreamimports", func(action clientgotesting.Action) (bool, runtime.Object, error) {
+		isi := action.(clientgotesting.CreateAction).GetObject().(*imageapiv1.ImageStreamImport)
+		imports = append(imports, isi)
+		return true, isi, nil
+	})
+
+	r := newScheduledImportReconciler(client.NewFakeRegistryAPIClient(nil, imageClient), 0)
+	r.reconcile(context.Background())
+
+	if len(imports) != 1 {
+		t.Fatalf("got %d imports, want 1", len(imports))
+	}
+
+	isi := imports[0]
+	if isi.Namespace != "ns" || isi.Name != "scheduled" || isi.ResourceVersion != "5" {
+		t.Errorf("got import for %s/%s@%s, want ns/scheduled@5", isi.Namespace, isi.Name, isi.ResourceVersion)
+	}
+	if !isi.Spec.Import {
+		t.Errorf("got spec.import false, want true")
+	}
+
+	want := []imageapiv1.ImageImportSpec{
+		{
+			From:         corev1.ObjectReference{Kind: "DockerImage", Name: "docker.io/library/busybox:latest"},
+			To:           &corev1.LocalObjectReference{Name: "latest"},
+			ImportPolicy: imageapiv1.TagImportPolicy{Scheduled: true},
+			ReferencePolicy: imageapiv1.TagReferencePolicy{
+				Type: imageapiv1.LocalTagReferencePolicy,
+			},
+		},
+	}
+	if !reflect.DeepEqual(isi.Spec.Images, want) {
+		t.Errorf("got images %#+v, want %#+v", isi.Spec.Images, want)
+	}
+}
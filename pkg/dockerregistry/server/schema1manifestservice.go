@@ -0,0 +1,77 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/manifest/manifestlist"
+	"github.com/distribution/distribution/v3/manifest/schema1"
+	"github.com/distribution/distribution/v3/manifest/schema2"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/opencontainers/go-digest"
+	ociv1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var ErrorCodeManifestSchema1Disabled = errcode.Register(errGroup, errcode.ErrorDescriptor{
+	Value:          "MANIFEST_SCHEMA1_DISABLED",
+	Message:        "manifest V2 schema 1 is disabled in this registry",
+	HTTPStatusCode: http.StatusBadRequest,
+})
+
+// noSchema1ManifestService rejects schema 1 manifests. It is used when
+// openshift.compatibility.disableschema1 is set.
+type noSchema1ManifestService struct {
+	distribution.ManifestService
+}
+
+var _ distribution.ManifestService = &noSchema1ManifestService{}
+
+func (m *noSchema1ManifestService) Get(ctx context.Context, dgst digest.Digest, options ...distribution.ManifestServiceOption) (distribution.Manifest, error) {
+	manifest, err := m.ManifestService.Get(ctx, dgst, options...)
+	if err != nil {
+		return manifest, err
+	}
+
+	switch manifest.(type) {
+	case *schema1.SignedManifest:
+		dcontext.GetLogger(ctx).Errorf("refusing to serve schema 1 manifest %s", dgst)
+		return nil, ErrorCodeManifestSchema1Disabled
+	case *schema2.DeserializedManifest, *manifestlist.DeserializedManifestList:
+		// The distribution rewrites these manifests in schema 1 when they are
+		// requested by a client that accepts only schema 1.
+		if req, err := dcontext.GetRequest(ctx); err == nil && acceptsOnlySchema1(req) {
+			dcontext.GetLogger(ctx).Errorf("refusing to convert manifest %s to schema 1", dgst)
+			return nil, ErrorCodeManifestSchema1Disabled
+		}
+	}
+
+	return manifest, nil
+}
+
+func (m *noSchema1ManifestService) Put(ctx context.Context, manifest distribution.Manifest, options ...distribution.ManifestServiceOption) (digest.Digest, error) {
+	if _, ok := manifest.(*schema1.SignedManifest); ok {
+		return "", ErrorCodeManifestSchema1Disabled
+	}
+	return m.ManifestService.Put(ctx, manifest, options...)
+}
+
+// acceptsOnlySchema1 reports whether req is a manifest request with Accept
+// headers that don't allow any newer manifest media type.
+func acceptsOnlySchema1(req *http.Request) bool {
+	if !strings.Contains(req.URL.Path, "/manifests/") {
+		return false
+	}
+	for _, accept := range req.Header.Values("Accept") {
+		for _, mediaType := range strings.Split(accept, ",") {
+			mediaType, _, _ = strings.Cut(mediaType, ";")
+			switch strings.TrimSpace(mediaType) {
+			case schema2.MediaTypeManifest, manifestlist.MediaTypeManifestList, ociv1.MediaTypeImageManifest, ociv1.MediaTypeImageIndex:
+				return false
+			}
+		}
+	}
+	return true
+}
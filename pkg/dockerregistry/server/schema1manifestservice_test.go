@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/manifest/schema2"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/openshift/image-registry/pkg/testutil"
+)
+
+func TestNoSchema1ManifestService(t *testing.T) {
+	ctx := context.Background()
+	ctx = testutil.WithTestLogger(ctx, t)
+
+	layers := []distribution.Descriptor{{Digest: "sha256:4355a46b19d348dc2f57c046f8ef63d4538ebb936000f3c9ee954a27460dd865", Size: 2}}
+	schema1Manifest, err := testutil.MakeSchema1Manifest("user/app", "latest", layers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema2Manifest, err := testutil.MakeSchema2Manifest(distribution.Descriptor{Digest: "sha256:bef57ec7f53a6d40beb640a780a639c83bc29ac8a9816f1fc6c5c6dcd93c4721", Size: 2}, layers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	schema1Digest := digest.Digest("sha256:0000000000000000000000000000000000000000000000000000000000000001")
+	schema2Digest := digest.Digest("sha256:0000000000000000000000000000000000000000000000000000000000000002")
+	tms := testutil.NewFakeManifestService("user/app", map[digest.Digest]distribution.Manifest{
+		schema1Digest: schema1Manifest,
+		schema2Digest: schema2Manifest,
+	})
+	ms := &noSchema1ManifestService{ManifestService: tms}
+
+	for _, tc := range []struct {
+		name    string
+		dgst    digest.Digest
+		accept  []string
+		wantErr bool
+	}{
+		{
+			name:    "schema 1",
+			dgst:    schema1Digest,
+			accept:  []string{schema2.MediaTypeManifest},
+			wantErr: true,
+		},
+		{
+			name:   "schema 2",
+			dgst:   schema2Digest,
+			accept: []string{schema2.MediaTypeManifest},
+		},
+		{
+			name:    "schema 2 for an old client",
+			dgst:    schema2Digest,
+			wantErr: true,
+		},
+		{
+			name:   "schema 2 with multiple media types",
+			dgst:   schema2Digest,
+			accept: []string{"application/vnd.docker.distribution.manifest.v1+prettyjws, " + schema2.MediaTypeManifest + ";q=0.9"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/v2/user/app/manifests/latest", nil)
+			for _, accept := range tc.accept {
+				req.Header.Add("Accept", accept)
+			}
+			getCtx := dcontext.WithRequest(ctx, req)
+
+			_, err := ms.Get(getCtx, tc.dgst)
+			if tc.wantErr {
+				if err != ErrorCodeManifestSchema1Disabled {
+					t.Fatalf("got error %v, want %v", err, ErrorCodeManifestSchema1Disabled)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+
+	if _, err := ms.Put(ctx, schema1Manifest); err != ErrorCodeManifestSchema1Disabled {
+		t.Errorf("got error %v on put, want %v", err, ErrorCodeManifestSchema1Disabled)
+	}
+	if tms.Calls("Put") != 0 {
+		t.Errorf("expected the schema 1 manifest not to be stored, got %d Put calls", tms.Calls("Put"))
+	}
+}
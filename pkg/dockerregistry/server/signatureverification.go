@@ -0,0 +1,297 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/opencontainers/go-digest"
+
+	imageapiv1 "github.com/openshift/api/image/v1"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/configuration"
+	"github.com/openshift/image-registry/pkg/imagestream"
+)
+
+const (
+	// cosignSignatureType is the type of image signatures made by cosign.
+	cosignSignatureType = "cosign"
+
+	// cosignPayloadType is the critical type of cosign signature payloads.
+	cosignPayloadType = "cosign container image signature"
+)
+
+var ErrorCodeSignaturePolicyViolation = errcode.Register(errGroup, errcode.ErrorDescriptor{
+	Value:          "SIGNATURE_POLICY_VIOLATION",
+	Message:        "image %s is not signed by any of the keys %v required by the repository",
+	HTTPStatusCode: http.StatusForbidden,
+})
+
+// cosignSignature is the content of an image signature of the cosign type. It
+// holds the simple signing payload of the cosign signature image and the
+// signature of the payload.
+type cosignSignature struct {
+	Payload   []byte `json:"payload"`
+	Signature []byte `json:"signature"`
+}
+
+// simpleSigningPayload is the part of the simple signing payload that is
+// relevant for the verification.
+type simpleSigningPayload struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+}
+
+// signatureVerifier verifies image signatures against the configured public
+// keys. Only cosign signatures can be verified, atomic signatures are OpenPGP
+// messages and are ignored.
+type signatureVerifier struct {
+	keys map[string]crypto.PublicKey
+}
+
+// newSignatureVerifier loads the public keys. It returns nil if the
+// verification is disabled.
+func newSignatureVerifier(cfg *configuration.Signatures) (*signatureVerifier, error) {
+	if !cfg.Verify {
+		return nil, nil
+	}
+
+	v := &signatureVerifier{
+		keys: make(map[string]crypto.PublicKey),
+	}
+	for name, path := range cfg.PublicKeys {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read public key %s: %v", name, err)
+		}
+		key, err := parsePublicKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse public key %s from %s: %v", name, path, err)
+		}
+		v.keys[name] = key
+	}
+	return v, nil
+}
+
+func parsePublicKey(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch key.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey, ed25519.PublicKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported public key type %T", key)
+}
+
+// Verify returns nil if image has a signature made by one of the keys for the
+// manifest dgst.
+func (v *signatureVerifier) Verify(ctx context.Context, image *imageapiv1.Image, dgst digest.Digest, keyNames []string) error {
+	for _, s := range image.Signatures {
+		if s.Type != cosignSignatureType {
+			continue
+		}
+		for _, name := range keyNames {
+			key, ok := v.keys[name]
+			if !ok {
+				dcontext.GetLogger(ctx).Warnf("signature policy refers to unknown public key %s", name)
+				continue
+			}
+			if err := verifyCosignSignature(key, s.Content, dgst); err != nil {
+				dcontext.GetLogger(ctx).Debugf("signature %s of image %s is not verified by the key %s: %v", s.Name, image.Name, name, err)
+				continue
+			}
+			dcontext.GetLogger(ctx).Debugf("signature %s of image %s is verified by the key %s", s.Name, image.Name, name)
+			return nil
+		}
+	}
+	return ErrorCodeSignaturePolicyViolation.WithArgs(dgst, keyNames)
+}
+
+func verifyCosignSignature(key crypto.PublicKey, content []byte, dgst digest.Digest) error {
+	var sig cosignSignature
+	if err := json.Unmarshal(content, &sig); err != nil {
+		return fmt.Errorf("invalid signature content: %v", err)
+	}
+
+	hash := sha256.Sum256(sig.Payload)
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, hash[:], sig.Signature) {
+			return fmt.Errorf("invalid ECDSA signature")
+		}
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], sig.Signature); err != nil {
+			return err
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, sig.Payload, sig.Signature) {
+			return fmt.Errorf("invalid Ed25519 signature")
+		}
+	default:
+		return fmt.Errorf("unsupported public key type %T", key)
+	}
+
+	var payload simpleSigningPayload
+	if err := json.Unmarshal(sig.Payload, &payload); err != nil {
+		return fmt.Errorf("invalid signature payload: %v", err)
+	}
+	if payload.Critical.Type != cosignPayloadType {
+		return fmt.Errorf("unexpected payload type %q", payload.Critical.Type)
+	}
+	if payload.Critical.Image.DockerManifestDigest != dgst.String() {
+		return fmt.Errorf("the signature is made for %s", payload.Critical.Image.DockerManifestDigest)
+	}
+	return nil
+}
+
+// signatureVerifyingManifestService refuses to serve manifests of images that
+// are not signed according to the signature policy of the image stream.
+type signatureVerifyingManifestService struct {
+	distribution.ManifestService
+	imageStream imagestream.ImageStream
+	verifier    *signatureVerifier
+}
+
+var _ distribution.ManifestService = &signatureVerifyingManifestService{}
+
+func (m *signatureVerifyingManifestService) Get(ctx context.Context, dgst digest.Digest, options ...distribution.ManifestServiceOption) (distribution.Manifest, error) {
+	dcontext.GetLogger(ctx).Debugf("(*signatureVerifyingManifestService).Get: starting with dgst=%s", dgst.String())
+
+	keyNames, rErr := m.imageStream.SignaturePolicy(ctx)
+	if rErr != nil {
+		switch rErr.Code() {
+		case imagestream.ErrImageStreamNotFoundCode:
+			// The image stream that doesn't exist has no policy, let the
+			// underlying service report the error.
+			return m.ManifestService.Get(ctx, dgst, options...)
+		case imagestream.ErrImageStreamForbiddenCode:
+			return nil, distribution.ErrAccessDenied
+		}
+		// The images cannot be served without knowing the policy.
+		dcontext.GetLogger(ctx).Errorf("unable to get the signature policy of %s: %v", m.imageStream.Reference(), rErr)
+		return nil, rErr
+	}
+	if len(keyNames) > 0 {
+		if err := m.verify(ctx, dgst, keyNames); err != nil {
+			return nil, err
+		}
+	}
+
+	return m.ManifestService.Get(ctx, dgst, options...)
+}
+
+// verify checks the signatures of the image dgst. Sub-manifests of manifest
+// lists are usually not signed, so they are also allowed if one of their
+// manifest lists is signed.
+func (m *signatureVerifyingManifestService) verify(ctx context.Context, dgst digest.Digest, keyNames []string) error {
+	image, err := m.image(ctx, dgst)
+	if err != nil {
+		return err
+	}
+
+	// The signatures of cosign aren't signed, and cosign has to read them
+	// to verify the images. They are served if the image they are tagged
+	// for is signed.
+	if isCosignArtifact(image) {
+		for _, subject := range m.cosignSubjects(ctx, dgst) {
+			subjectImage, err := m.image(ctx, subject)
+			if err != nil {
+				continue
+			}
+			if m.verifyImage(ctx, subject, subjectImage, keyNames) == nil {
+				return nil
+			}
+		}
+	}
+
+	if err := m.verifyImage(ctx, dgst, image, keyNames); err != nil {
+		dcontext.GetLogger(ctx).Errorf("refusing to serve manifest %s from %s: %v", dgst, m.imageStream.Reference(), err)
+		return err
+	}
+	return nil
+}
+
+func (m *signatureVerifyingManifestService) image(ctx context.Context, dgst digest.Digest) (*imageapiv1.Image, error) {
+	image, rErr := m.imageStream.GetImageOfImageStream(ctx, dgst)
+	if rErr != nil {
+		switch rErr.Code() {
+		case imagestream.ErrImageStreamNotFoundCode, imagestream.ErrImageStreamImageNotFoundCode:
+			return nil, distribution.ErrManifestUnknownRevision{
+				Name:     m.imageStream.Reference(),
+				Revision: dgst,
+			}
+		case imagestream.ErrImageStreamForbiddenCode:
+			return nil, distribution.ErrAccessDenied
+		}
+		return nil, rErr
+	}
+	return image, nil
+}
+
+// cosignSubjects returns the images whose sha256-<digest>.sig, .att or .sbom
+// tags point to the image dgst.
+func (m *signatureVerifyingManifestService) cosignSubjects(ctx context.Context, dgst digest.Digest) []digest.Digest {
+	tags, rErr := m.imageStream.Tags(ctx)
+	if rErr != nil {
+		dcontext.GetLogger(ctx).Errorf("unable to get tags of %s: %v", m.imageStream.Reference(), rErr)
+		return nil
+	}
+
+	var subjects []digest.Digest
+	for tag, tagged := range tags {
+		if tagged != dgst {
+			continue
+		}
+		if subject, _, ok := parseCosignTag(tag); ok {
+			subjects = append(subjects, subject)
+		}
+	}
+	return subjects
+}
+
+// verifyImage checks the signatures of the image dgst and of its manifest
+// lists.
+func (m *signatureVerifyingManifestService) verifyImage(ctx context.Context, dgst digest.Digest, image *imageapiv1.Image, keyNames []string) error {
+	err := m.verifier.Verify(ctx, image, dgst, keyNames)
+	if err == nil {
+		return nil
+	}
+
+	lists, rErr := m.imageStream.ManifestListsOf(ctx, dgst)
+	if rErr != nil {
+		dcontext.GetLogger(ctx).Errorf("unable to find manifest lists of %s in %s: %v", dgst, m.imageStream.Reference(), rErr)
+		return err
+	}
+	for _, list := range lists {
+		listImage, rErr := m.imageStream.GetImageOfImageStream(ctx, list)
+		if rErr != nil {
+			continue
+		}
+		if m.verifier.Verify(ctx, listImage, list, keyNames) == nil {
+			return nil
+		}
+	}
+	return err
+}
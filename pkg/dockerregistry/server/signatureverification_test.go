@@ -0,0 +1,227 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/distribution/distribution/v3/manifest/manifestlist"
+	"github.com/distribution/distribution/v3/manifest/schema2"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/opencontainers/go-digest"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	imageapiv1 "github.com/openshift/api/image/v1"
+
+	registryclient "github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/configuration"
+	rerrors "github.com/openshift/image-registry/pkg/errors"
+	"github.com/openshift/image-registry/pkg/imagestream"
+	"github.com/openshift/image-registry/pkg/testutil"
+)
+
+func makeCosignSignature(t *testing.T, key *ecdsa.PrivateKey, dgst digest.Digest) imageapiv1.ImageSignature {
+	payload := []byte(fmt.Sprintf(`{"critical":{"identity":{"docker-reference":"example.com/app"},"image":{"docker-manifest-digest":%q},"type":%q},"optional":null}`, dgst, cosignPayloadType))
+	hash := sha256.Sum256(payload)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := json.Marshal(cosignSignature{Payload: payload, Signature: sig})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return imageapiv1.ImageSignature{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: fmt.Sprintf("%s@%x", dgst, hash[:16]),
+		},
+		Type:    cosignSignatureType,
+		Content: content,
+	}
+}
+
+// failingSignaturePolicy is an image stream whose signature policy cannot be
+// read.
+type failingSignaturePolicy struct {
+	imagestream.ImageStream
+	code string
+}
+
+func (is failingSignaturePolicy) Reference() string {
+	return "user/app"
+}
+
+func (is failingSignaturePolicy) SignaturePolicy(ctx context.Context) ([]string, rerrors.Error) {
+	return nil, rerrors.NewError(is.code, "SignaturePolicy", fmt.Errorf("unavailable"))
+}
+
+func TestSignatureVerifyingManifestServiceGetWithoutPolicy(t *testing.T) {
+	ctx := context.Background()
+	ctx = testutil.WithTestLogger(ctx, t)
+
+	dgst := digest.Digest("sha256:0000000000000000000000000000000000000000000000000000000000000001")
+	for _, tc := range []struct {
+		code          string
+		expectedCalls int
+	}{
+		{code: imagestream.ErrImageStreamNotFoundCode, expectedCalls: 1},
+		{code: imagestream.ErrImageStreamForbiddenCode},
+		{code: imagestream.ErrImageStreamUnknownErrorCode},
+	} {
+		t.Run(tc.code, func(t *testing.T) {
+			ms := &signatureVerifyingManifestService{
+				ManifestService: testutil.NewFakeManifestService("user/app", nil),
+				imageStream:     failingSignaturePolicy{code: tc.code},
+			}
+
+			_, err := ms.Get(ctx, dgst)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if calls := ms.ManifestService.(*testutil.FakeManifestService).Calls("Get"); calls != tc.expectedCalls {
+				t.Errorf("got %d calls to the underlying service, want %d", calls, tc.expectedCalls)
+			}
+		})
+	}
+}
+
+func TestSignatureVerifyingManifestServiceGet(t *testing.T) {
+	trustedKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(&trustedKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(t.TempDir(), "release.pub")
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	verifier, err := newSignatureVerifier(&configuration.Signatures{
+		Verify:     true,
+		PublicKeys: map[string]string{"release": keyPath},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		signedDigest   = digest.Digest("sha256:0000000000000000000000000000000000000000000000000000000000000001")
+		unsignedDigest = digest.Digest("sha256:0000000000000000000000000000000000000000000000000000000000000002")
+		untrustDigest  = digest.Digest("sha256:0000000000000000000000000000000000000000000000000000000000000003")
+		replayDigest   = digest.Digest("sha256:0000000000000000000000000000000000000000000000000000000000000004")
+		childDigest    = digest.Digest("sha256:0000000000000000000000000000000000000000000000000000000000000005")
+		cosignDigest   = digest.Digest("sha256:0000000000000000000000000000000000000000000000000000000000000006")
+		unsignedSig    = digest.Digest("sha256:0000000000000000000000000000000000000000000000000000000000000007")
+		untaggedSig    = digest.Digest("sha256:0000000000000000000000000000000000000000000000000000000000000008")
+	)
+	listManifest := fmt.Sprintf(`{"schemaVersion":2,"mediaType":%q,"manifests":[{"mediaType":%q,"digest":%q,"size":100,"platform":{"architecture":"amd64","os":"linux"}}]}`,
+		manifestlist.MediaTypeManifestList, schema2.MediaTypeManifest, childDigest)
+	listDigest := digest.FromString(listManifest)
+
+	newImage := func(dgst digest.Digest, signatures ...imageapiv1.ImageSignature) *imageapiv1.Image {
+		return &imageapiv1.Image{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: dgst.String(),
+				Annotations: map[string]string{
+					imageapiv1.ManagedByOpenShiftAnnotation: "true",
+				},
+			},
+			DockerImageReference:         "localhost:5000/user/app@" + dgst.String(),
+			DockerImageManifestMediaType: schema2.MediaTypeManifest,
+			Signatures:                   signatures,
+		}
+	}
+
+	ctx := context.Background()
+	ctx = testutil.WithTestLogger(ctx, t)
+
+	fos, imageClient := testutil.NewFakeOpenShiftWithClient(ctx)
+	testutil.AddImageStream(t, fos, "user", "app", map[string]string{
+		imagestream.SignaturePolicyAnnotation: "release, unknown",
+	})
+	testutil.AddImageStream(t, fos, "user", "unprotected", nil)
+	testutil.AddImage(t, fos, newImage(signedDigest, makeCosignSignature(t, trustedKey, signedDigest)), "user", "app", "signed")
+	testutil.AddImage(t, fos, newImage(unsignedDigest), "user", "app", "unsigned")
+	testutil.AddImage(t, fos, newImage(untrustDigest, makeCosignSignature(t, otherKey, untrustDigest)), "user", "app", "untrusted")
+	testutil.AddImage(t, fos, newImage(replayDigest, makeCosignSignature(t, trustedKey, signedDigest)), "user", "app", "replayed")
+	testutil.AddImage(t, fos, newImage(unsignedDigest), "user", "unprotected", "unsigned")
+	cosignImage := newImage(cosignDigest)
+	cosignImage.DockerImageLayers = []imageapiv1.ImageLayer{{Name: "sha256:7", MediaType: cosignSimpleSigningMediaType}}
+	testutil.AddImage(t, fos, cosignImage, "user", "app", "sha256-"+signedDigest.Encoded()+".sig")
+	unsignedSigImage := newImage(unsignedSig)
+	unsignedSigImage.DockerImageLayers = cosignImage.DockerImageLayers
+	testutil.AddImage(t, fos, unsignedSigImage, "user", "app", "sha256-"+unsignedDigest.Encoded()+".sig")
+	untaggedSigImage := newImage(untaggedSig)
+	untaggedSigImage.DockerImageLayers = cosignImage.DockerImageLayers
+	testutil.AddImage(t, fos, untaggedSigImage, "user", "app", "signature")
+	if _, err := fos.CreateImage(newImage(childDigest)); err != nil {
+		t.Fatal(err)
+	}
+	list := newImage(listDigest, makeCosignSignature(t, trustedKey, listDigest))
+	list.DockerImageManifestMediaType = manifestlist.MediaTypeManifestList
+	list.DockerImageManifest = listManifest
+	testutil.AddImage(t, fos, list, "user", "app", "list")
+
+	for _, tc := range []struct {
+		name          string
+		repo          string
+		dgst          digest.Digest
+		expectedError bool
+	}{
+		{name: "signed", repo: "app", dgst: signedDigest},
+		{name: "unsigned", repo: "app", dgst: unsignedDigest, expectedError: true},
+		{name: "signed by untrusted key", repo: "app", dgst: untrustDigest, expectedError: true},
+		{name: "signature of another image", repo: "app", dgst: replayDigest, expectedError: true},
+		{name: "signed manifest list", repo: "app", dgst: listDigest},
+		{name: "sub-manifest of signed manifest list", repo: "app", dgst: childDigest},
+		{name: "no policy", repo: "unprotected", dgst: unsignedDigest},
+		{name: "cosign signature", repo: "app", dgst: cosignDigest},
+		{name: "cosign signature of unsigned image", repo: "app", dgst: unsignedSig, expectedError: true},
+		{name: "cosign signature without cosign tag", repo: "app", dgst: untaggedSig, expectedError: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ms := &signatureVerifyingManifestService{
+				ManifestService: testutil.NewFakeManifestService("user/"+tc.repo, nil),
+				imageStream:     imagestream.New(ctx, "user", tc.repo, registryclient.NewFakeRegistryAPIClient(nil, imageClient)),
+				verifier:        verifier,
+			}
+
+			_, err := ms.Get(ctx, tc.dgst)
+			calls := ms.ManifestService.(*testutil.FakeManifestService).Calls("Get")
+			if tc.expectedError {
+				e, ok := err.(errcode.Error)
+				if !ok || e.Code != ErrorCodeSignaturePolicyViolation {
+					t.Fatalf("got error %v, want %v", err, ErrorCodeSignaturePolicyViolation)
+				}
+				if calls != 0 {
+					t.Errorf("the manifest is fetched from the underlying service")
+				}
+				return
+			}
+			// The test manifest service doesn't have the manifests.
+			if e, ok := err.(errcode.Error); ok && e.Code == ErrorCodeSignaturePolicyViolation {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if calls != 1 {
+				t.Errorf("got %d calls to the underlying service, want 1", calls)
+			}
+		})
+	}
+}
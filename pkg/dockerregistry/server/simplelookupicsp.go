@@ -88,9 +88,31 @@ func isSubrepo(repo, ancestor string) bool {
 	return false
 }
 
+// matchingSourcePrefix returns the length of the prefix of repo that matches
+// source, or -1 if repo doesn't match source. The source matches repo and its
+// subrepositories. If wildcard is true, a source *.example.com matches
+// repositories of any subdomain of example.com, the whole host part of repo
+// is the prefix then.
+func matchingSourcePrefix(repo, source string, wildcard bool) int {
+	if wildcard && strings.HasPrefix(source, "*.") {
+		host, _, _ := strings.Cut(repo, "/")
+		if strings.HasSuffix(host, source[1:]) {
+			return len(host)
+		}
+		return -1
+	}
+	if isSubrepo(repo, source) {
+		return len(source)
+	}
+	return -1
+}
+
 type mirrorSource struct {
 	source  string
 	mirrors []string
+	// wildcard is true if the source may be a wildcard, such as
+	// *.example.com. ImageContentSourcePolicy doesn't support wildcards.
+	wildcard bool
 }
 
 // alternativeImageSources returns unique list of DockerImageReference objects from list of
@@ -103,17 +125,16 @@ func (s *simpleLookupImageMirrorSets) alternativeImageSources(
 
 	mirrorSources := []mirrorSource{}
 	for _, icsp := range icspList {
-		s := mirrorSource{}
 		for _, rdm := range icsp.Spec.RepositoryDigestMirrors {
-			s.source = rdm.Source
-			s.mirrors = rdm.Mirrors
-			mirrorSources = append(mirrorSources, s)
+			mirrorSources = append(mirrorSources, mirrorSource{
+				source:  rdm.Source,
+				mirrors: rdm.Mirrors,
+			})
 		}
 	}
 	for _, idms := range idmsList {
-		s := mirrorSource{}
 		for _, idm := range idms.Spec.ImageDigestMirrors {
-			s.source = idm.Source
+			s := mirrorSource{source: idm.Source, wildcard: true}
 			for _, m := range idm.Mirrors {
 				s.mirrors = append(s.mirrors, string(m))
 			}
@@ -122,9 +143,8 @@ func (s *simpleLookupImageMirrorSets) alternativeImageSources(
 	}
 
 	for _, itms := range itmsList {
-		s := mirrorSource{}
 		for _, itm := range itms.Spec.ImageTagMirrors {
-			s.source = itm.Source
+			s := mirrorSource{source: itm.Source, wildcard: true}
 			for _, m := range itm.Mirrors {
 				s.mirrors = append(s.mirrors, string(m))
 			}
@@ -136,13 +156,12 @@ func (s *simpleLookupImageMirrorSets) alternativeImageSources(
 	uniqueMirrors := map[reference.DockerImageReference]bool{}
 
 	for _, ms := range mirrorSources {
-		rdmRepo := ms.source
-
-		if !isSubrepo(repo, rdmRepo) {
+		prefixLen := matchingSourcePrefix(repo, ms.source, ms.wildcard)
+		if prefixLen < 0 {
 			continue
 		}
 
-		suffix := repo[len(rdmRepo):]
+		suffix := repo[prefixLen:]
 
 		for _, m := range ms.mirrors {
 			mRef, err := reference.Parse(m + suffix)
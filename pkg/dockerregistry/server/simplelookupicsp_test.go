@@ -561,3 +561,98 @@ func TestFirstRequestICSPandIDMS(t *testing.T) {
 
 	}
 }
+
+func TestFirstRequestWildcardSources(t *testing.T) {
+	wildcardRule := rule{
+		name: "rule",
+		ruleElement: []element{
+			{source: "*.example.com",
+				mirrors: []string{
+					"mirror.local/example",
+				}},
+			{source: "registry.example.com/ns",
+				mirrors: []string{
+					"registry-mirror.local/ns",
+				}},
+		},
+	}
+
+	for _, tt := range []struct {
+		name string
+		ref  string
+		icsp bool
+		res  []string
+	}{
+		{
+			name: "subdomain",
+			ref:  "registry.example.com/ns/app:latest",
+			res: []string{
+				"mirror.local/example/ns/app",
+				"registry-mirror.local/ns/app",
+				"registry.example.com/ns/app",
+			},
+		},
+		{
+			name: "nested subdomain",
+			ref:  "eu.registry.example.com/app",
+			res: []string{
+				"mirror.local/example/app",
+				"eu.registry.example.com/app",
+			},
+		},
+		{
+			name: "domain itself",
+			ref:  "example.com/ns/app",
+			res: []string{
+				"example.com/ns/app",
+			},
+		},
+		{
+			name: "other domain",
+			ref:  "registry.example.org/ns/app",
+			res: []string{
+				"registry.example.org/ns/app",
+			},
+		},
+		{
+			name: "icsp",
+			ref:  "quay.example.com/ns/app",
+			icsp: true,
+			res: []string{
+				"quay.example.com/ns/app",
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cli := fake.NewSimpleClientset()
+			cfgcli := cfgfake.NewSimpleClientset(newIDMSRule(wildcardRule))
+			if tt.icsp {
+				cli = fake.NewSimpleClientset(newICSPRule(wildcardRule))
+				cfgcli = cfgfake.NewSimpleClientset()
+			}
+			lookup := NewSimpleLookupImageMirrorSetsStrategy(
+				cli.OperatorV1alpha1().ImageContentSourcePolicies(),
+				cfgcli.ConfigV1().ImageDigestMirrorSets(),
+				cfgcli.ConfigV1().ImageTagMirrorSets(),
+			)
+
+			ref, err := reference.Parse(tt.ref)
+			if err != nil {
+				t.Fatalf("unexpected error parsing reference: %s", err)
+			}
+
+			alternates, err := lookup.FirstRequest(context.Background(), ref)
+			if err != nil {
+				t.Fatalf("FirstRequest does not return error, received: %s", err)
+			}
+
+			var res []string
+			for _, alternate := range alternates {
+				res = append(res, alternate.Exact())
+			}
+			if !reflect.DeepEqual(res, tt.res) {
+				t.Errorf("expected %v, received %v", tt.res, res)
+			}
+		})
+	}
+}
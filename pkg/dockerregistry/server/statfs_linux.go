@@ -0,0 +1,19 @@
+//go:build linux
+
+package server
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// volumeUsage returns the used bytes and the capacity of the filesystem that
+// contains path.
+func volumeUsage(path string) (int64, int64, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return 0, 0, err
+	}
+	capacity := int64(st.Blocks) * st.Bsize
+	used := int64(st.Blocks-st.Bfree) * st.Bsize
+	return used, capacity, nil
+}
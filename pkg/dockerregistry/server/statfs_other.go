@@ -0,0 +1,13 @@
+//go:build !linux
+
+package server
+
+import (
+	"fmt"
+)
+
+// volumeUsage is not supported, the usage of the volume is checked only on
+// Linux.
+func volumeUsage(path string) (int64, int64, error) {
+	return 0, 0, fmt.Errorf("the usage of the volume is not supported on this platform")
+}
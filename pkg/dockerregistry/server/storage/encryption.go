@@ -0,0 +1,576 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+)
+
+const (
+	// encryptionMagic starts the files that are encrypted by the encrypting
+	// driver. Files without it are not encrypted.
+	encryptionMagic = "\x00OSENC\x00\x01"
+
+	encryptionKeyIDSize   = 8
+	encryptionKeySize     = 32
+	encryptionNonceSize   = 12
+	encryptionTagSize     = 16
+	encryptionHeaderSize  = len(encryptionMagic) + encryptionKeyIDSize + encryptionNonceSize + encryptionKeySize + encryptionTagSize
+	encryptionChunkSize   = 64 << 10
+	encryptionSealedChunk = encryptionChunkSize + encryptionTagSize
+)
+
+// encryptedPathRegexp matches the files with the blob data, both in the blob
+// store and in the trash.
+var encryptedPathRegexp = regexp.MustCompile(`^/docker/registry/v2/(blobs/[^/]+/[0-9a-f]{2}/[0-9a-f]+|trash/[^/]+/[0-9a-f]+)/data$`)
+
+var errEncryptedAppend = errors.New("appending to encrypted files is not supported")
+
+func isEncryptedPath(path string) bool {
+	return encryptedPathRegexp.MatchString(path)
+}
+
+// EncryptionKeys are the key encryption keys of the encrypting driver.
+type EncryptionKeys struct {
+	primary [encryptionKeyIDSize]byte
+	keys    map[[encryptionKeyIDSize]byte]cipher.AEAD
+}
+
+// LoadEncryptionKeys reads the keys from the files in dir. Every file should
+// contain a base64-encoded 256-bit key. The files with names that start with
+// a dot are ignored, they are used by Kubernetes for the updates of mounted
+// secrets.
+func LoadEncryptionKeys(dir string, primary string) (*EncryptionKeys, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the encryption keys: %w", err)
+	}
+
+	keys := make(map[string][]byte)
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the encryption key %s: %w", name, err)
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(content)))
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode the encryption key %s: %w", name, err)
+		}
+		keys[name] = key
+	}
+	return NewEncryptionKeys(keys, primary)
+}
+
+// NewEncryptionKeys returns the keys that encrypt the data keys of new files
+// with the key primary, and that can decrypt the files encrypted with any of
+// keys.
+func NewEncryptionKeys(keys map[string][]byte, primary string) (*EncryptionKeys, error) {
+	if _, ok := keys[primary]; !ok {
+		return nil, fmt.Errorf("the primary encryption key %s is not found", primary)
+	}
+
+	ek := &EncryptionKeys{
+		keys: make(map[[encryptionKeyIDSize]byte]cipher.AEAD),
+	}
+	for name, key := range keys {
+		if len(key) != encryptionKeySize {
+			return nil, fmt.Errorf("the encryption key %s has %d bytes, want %d", name, len(key), encryptionKeySize)
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key %s: %w", name, err)
+		}
+		id := encryptionKeyID(key)
+		ek.keys[id] = aead
+		if name == primary {
+			ek.primary = id
+		}
+	}
+	return ek, nil
+}
+
+func encryptionKeyID(key []byte) [encryptionKeyIDSize]byte {
+	var id [encryptionKeyIDSize]byte
+	sum := sha256.Sum256(key)
+	copy(id[:], sum[:])
+	return id
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// newHeader generates a data key for a new file. It returns the header of the
+// file with the data key encrypted by the primary key.
+func (ek *EncryptionKeys) newHeader() ([]byte, cipher.AEAD, error) {
+	dataKey := make([]byte, encryptionKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, nil, fmt.Errorf("unable to generate a data key: %w", err)
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	header := make([]byte, 0, encryptionHeaderSize)
+	header = append(header, encryptionMagic...)
+	header = append(header, ek.primary[:]...)
+	nonce := make([]byte, encryptionNonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, nil, fmt.Errorf("unable to generate a nonce: %w", err)
+	}
+	header = append(header, nonce...)
+	header = ek.keys[ek.primary].Seal(header, nonce, dataKey, header[:len(encryptionMagic)+encryptionKeyIDSize])
+	return header, aead, nil
+}
+
+// openHeader decrypts the data key of a file from its header.
+func (ek *EncryptionKeys) openHeader(header []byte) (cipher.AEAD, error) {
+	var id [encryptionKeyIDSize]byte
+	copy(id[:], header[len(encryptionMagic):])
+	kek, ok := ek.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("the file is encrypted with an unknown key %x", id)
+	}
+
+	prefix := len(encryptionMagic) + encryptionKeyIDSize
+	nonce := header[prefix : prefix+encryptionNonceSize]
+	dataKey, err := kek.Open(nil, nonce, header[prefix+encryptionNonceSize:], header[:prefix])
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt the data key: %w", err)
+	}
+	return newAEAD(dataKey)
+}
+
+// chunkNonce returns the nonce of the chunk i. Every file has its own data
+// key, so the nonces don't need to be random.
+func chunkNonce(i int64) []byte {
+	nonce := make([]byte, encryptionNonceSize)
+	binary.BigEndian.PutUint64(nonce[encryptionNonceSize-8:], uint64(i))
+	return nonce
+}
+
+// chunkAdditionalData marks the last chunk of a file, so that truncated files
+// are detected.
+func chunkAdditionalData(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// plaintextSize returns the size of the content of an encrypted file of size
+// bytes. All chunks except the last one are full, so the number of chunks is
+// known from the size.
+func plaintextSize(size int64) (int64, error) {
+	sealed := size - int64(encryptionHeaderSize)
+	if sealed < encryptionTagSize {
+		return 0, fmt.Errorf("the encrypted file is truncated")
+	}
+	chunks := (sealed + encryptionSealedChunk - 1) / encryptionSealedChunk
+	return sealed - chunks*encryptionTagSize, nil
+}
+
+// NewEncryptingDriver returns a storage driver that encrypts the blob data
+// written to d with AES-GCM and decrypts it on reads.
+//
+// Every file has its own data key that is encrypted with the primary key of
+// keys and stored in the header of the file. The content is split into chunks
+// that are sealed separately, so the files can be read from any offset. The
+// blob data that is not encrypted is read as is.
+//
+// The upload data is not encrypted until the upload is committed, then it is
+// encrypted while it is moved into the blob store. Redirects to the storage
+// are disabled for the blob data, because the clients would get the encrypted
+// content.
+func NewEncryptingDriver(d driver.StorageDriver, keys *EncryptionKeys) driver.StorageDriver {
+	return &encryptingDriver{
+		StorageDriver: d,
+		keys:          keys,
+	}
+}
+
+type encryptingDriver struct {
+	driver.StorageDriver
+	keys *EncryptionKeys
+}
+
+// readHeader returns the data key of the file at path, or nil if the file is
+// not encrypted.
+func (d *encryptingDriver) readHeader(ctx context.Context, path string) (cipher.AEAD, error) {
+	r, err := d.StorageDriver.Reader(ctx, path, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	header := make([]byte, encryptionHeaderSize)
+	if _, err := io.ReadFull(r, header); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(header, []byte(encryptionMagic)) {
+		return nil, nil
+	}
+	return d.keys.openHeader(header)
+}
+
+func (d *encryptingDriver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	content, err := d.StorageDriver.GetContent(ctx, path)
+	if err != nil || !isEncryptedPath(path) || !bytes.HasPrefix(content, []byte(encryptionMagic)) {
+		return content, err
+	}
+	if len(content) < encryptionHeaderSize {
+		return nil, fmt.Errorf("%s: the encrypted file is truncated", path)
+	}
+
+	aead, err := d.keys.openHeader(content[:encryptionHeaderSize])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	size, err := plaintextSize(int64(len(content)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	plaintext := make([]byte, 0, size)
+	sealed := content[encryptionHeaderSize:]
+	for i := int64(0); len(sealed) > 0; i++ {
+		n := len(sealed)
+		if n > encryptionSealedChunk {
+			n = encryptionSealedChunk
+		}
+		plaintext, err = aead.Open(plaintext, chunkNonce(i), sealed[:n], chunkAdditionalData(n == len(sealed)))
+		if err != nil {
+			return nil, fmt.Errorf("%s: unable to decrypt the chunk %d: %w", path, i, err)
+		}
+		sealed = sealed[n:]
+	}
+	return plaintext, nil
+}
+
+func (d *encryptingDriver) PutContent(ctx context.Context, path string, content []byte) error {
+	if !isEncryptedPath(path) {
+		return d.StorageDriver.PutContent(ctx, path, content)
+	}
+
+	header, aead, err := d.keys.newHeader()
+	if err != nil {
+		return err
+	}
+	sealed := header
+	for i := int64(0); ; i++ {
+		n := len(content)
+		if n > encryptionChunkSize {
+			n = encryptionChunkSize
+		}
+		sealed = aead.Seal(sealed, chunkNonce(i), content[:n], chunkAdditionalData(n == len(content)))
+		content = content[n:]
+		if len(content) == 0 {
+			break
+		}
+	}
+	return d.StorageDriver.PutContent(ctx, path, sealed)
+}
+
+func (d *encryptingDriver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	if !isEncryptedPath(path) {
+		return d.StorageDriver.Reader(ctx, path, offset)
+	}
+
+	aead, err := d.readHeader(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if aead == nil {
+		return d.StorageDriver.Reader(ctx, path, offset)
+	}
+
+	fi, err := d.StorageDriver.Stat(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	size, err := plaintextSize(fi.Size())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if offset < 0 || offset > size {
+		return nil, driver.InvalidOffsetError{Path: path, Offset: offset, DriverName: d.Name()}
+	}
+
+	chunk := offset / encryptionChunkSize
+	r, err := d.StorageDriver.Reader(ctx, path, int64(encryptionHeaderSize)+chunk*encryptionSealedChunk)
+	if err != nil {
+		return nil, err
+	}
+	dr := &decryptingReader{
+		r:      r,
+		aead:   aead,
+		path:   path,
+		chunk:  chunk,
+		chunks: (fi.Size() - int64(encryptionHeaderSize) + encryptionSealedChunk - 1) / encryptionSealedChunk,
+		sealed: make([]byte, encryptionSealedChunk),
+	}
+	if err := dr.next(); err == io.EOF {
+		// The offset is at the end of the content.
+		return dr, nil
+	} else if err != nil {
+		r.Close()
+		return nil, err
+	}
+	dr.plaintext = dr.plaintext[offset-chunk*encryptionChunkSize:]
+	return dr, nil
+}
+
+// decryptingReader decrypts the chunks of an encrypted file.
+type decryptingReader struct {
+	r         io.ReadCloser
+	aead      cipher.AEAD
+	path      string
+	chunk     int64
+	chunks    int64
+	sealed    []byte
+	plaintext []byte
+}
+
+// next decrypts the next chunk.
+func (r *decryptingReader) next() error {
+	if r.chunk >= r.chunks {
+		return io.EOF
+	}
+	n, err := io.ReadFull(r.r, r.sealed)
+	if err == io.ErrUnexpectedEOF || (err == io.EOF && r.chunk == r.chunks-1) {
+		err = nil
+	}
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return fmt.Errorf("%s: unable to read the chunk %d: %w", r.path, r.chunk, err)
+	}
+
+	last := r.chunk == r.chunks-1
+	r.plaintext, err = r.aead.Open(r.sealed[:0], chunkNonce(r.chunk), r.sealed[:n], chunkAdditionalData(last))
+	if err != nil {
+		return fmt.Errorf("%s: unable to decrypt the chunk %d: %w", r.path, r.chunk, err)
+	}
+	r.chunk++
+	return nil
+}
+
+func (r *decryptingReader) Read(p []byte) (int, error) {
+	for len(r.plaintext) == 0 {
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plaintext)
+	r.plaintext = r.plaintext[n:]
+	return n, nil
+}
+
+func (r *decryptingReader) Close() error {
+	return r.r.Close()
+}
+
+func (d *encryptingDriver) Writer(ctx context.Context, path string, append bool) (driver.FileWriter, error) {
+	if !isEncryptedPath(path) {
+		return d.StorageDriver.Writer(ctx, path, append)
+	}
+	if append {
+		return nil, errEncryptedAppend
+	}
+
+	header, aead, err := d.keys.newHeader()
+	if err != nil {
+		return nil, err
+	}
+	w, err := d.StorageDriver.Writer(ctx, path, false)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		_ = w.Cancel(ctx)
+		return nil, err
+	}
+	return &encryptingWriter{
+		w:      w,
+		aead:   aead,
+		buf:    make([]byte, 0, encryptionChunkSize+1),
+		sealed: make([]byte, 0, encryptionSealedChunk),
+	}, nil
+}
+
+// encryptingWriter seals the content in chunks. A full chunk is kept until
+// more data is written, because the last chunk should be sealed as the last
+// one on Commit.
+type encryptingWriter struct {
+	w      driver.FileWriter
+	aead   cipher.AEAD
+	chunk  int64
+	size   int64
+	buf    []byte
+	sealed []byte
+}
+
+func (w *encryptingWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(w.buf) > encryptionChunkSize {
+			if err := w.flush(w.buf[:encryptionChunkSize], false); err != nil {
+				return written, err
+			}
+			w.buf = append(w.buf[:0], w.buf[encryptionChunkSize:]...)
+		}
+		n := encryptionChunkSize + 1 - len(w.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+		w.buf = append(w.buf, p[:n]...)
+		p = p[n:]
+		written += n
+		w.size += int64(n)
+	}
+	return written, nil
+}
+
+func (w *encryptingWriter) flush(plaintext []byte, last bool) error {
+	w.sealed = w.aead.Seal(w.sealed[:0], chunkNonce(w.chunk), plaintext, chunkAdditionalData(last))
+	w.chunk++
+	_, err := w.w.Write(w.sealed)
+	return err
+}
+
+func (w *encryptingWriter) Size() int64 {
+	return w.size
+}
+
+// Close closes the file. The content that is not committed is lost.
+func (w *encryptingWriter) Close() error {
+	return w.w.Close()
+}
+
+func (w *encryptingWriter) Cancel(ctx context.Context) error {
+	return w.w.Cancel(ctx)
+}
+
+func (w *encryptingWriter) Commit() error {
+	if len(w.buf) > encryptionChunkSize {
+		if err := w.flush(w.buf[:encryptionChunkSize], false); err != nil {
+			return err
+		}
+		w.buf = w.buf[encryptionChunkSize:]
+	}
+	if err := w.flush(w.buf, true); err != nil {
+		return err
+	}
+	w.buf = w.buf[:0]
+	return w.w.Commit()
+}
+
+func (d *encryptingDriver) Stat(ctx context.Context, path string) (driver.FileInfo, error) {
+	fi, err := d.StorageDriver.Stat(ctx, path)
+	if err != nil || fi.IsDir() || !isEncryptedPath(path) {
+		return fi, err
+	}
+	return d.plaintextFileInfo(ctx, fi)
+}
+
+// plaintextFileInfo returns fi with the size of the content if the file is
+// encrypted.
+func (d *encryptingDriver) plaintextFileInfo(ctx context.Context, fi driver.FileInfo) (driver.FileInfo, error) {
+	if fi.Size() < int64(encryptionHeaderSize) {
+		return fi, nil
+	}
+	aead, err := d.readHeader(ctx, fi.Path())
+	if err != nil || aead == nil {
+		return fi, err
+	}
+	size, err := plaintextSize(fi.Size())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fi.Path(), err)
+	}
+	return driver.FileInfoInternal{FileInfoFields: driver.FileInfoFields{
+		Path:    fi.Path(),
+		Size:    size,
+		ModTime: fi.ModTime(),
+		IsDir:   false,
+	}}, nil
+}
+
+// Move encrypts the upload data when it is moved into the blob store. The
+// files are moved as is otherwise.
+func (d *encryptingDriver) Move(ctx context.Context, sourcePath string, destPath string) error {
+	if !isEncryptedPath(destPath) || isEncryptedPath(sourcePath) {
+		return d.StorageDriver.Move(ctx, sourcePath, destPath)
+	}
+
+	r, err := d.StorageDriver.Reader(ctx, sourcePath, 0)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := d.Writer(ctx, destPath, false)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		_ = w.Cancel(ctx)
+		_ = w.Close()
+		return fmt.Errorf("unable to encrypt %s: %w", sourcePath, err)
+	}
+	if err := w.Commit(); err != nil {
+		_ = w.Close()
+		return fmt.Errorf("unable to encrypt %s: %w", sourcePath, err)
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return d.StorageDriver.Delete(ctx, sourcePath)
+}
+
+// URLFor doesn't return URLs for the blob data, the clients would download the
+// encrypted content.
+func (d *encryptingDriver) URLFor(ctx context.Context, path string, options map[string]interface{}) (string, error) {
+	if isEncryptedPath(path) {
+		return "", driver.ErrUnsupportedMethod{DriverName: d.Name()}
+	}
+	return d.StorageDriver.URLFor(ctx, path, options)
+}
+
+func (d *encryptingDriver) Walk(ctx context.Context, path string, f driver.WalkFn) error {
+	return d.StorageDriver.Walk(ctx, path, func(fi driver.FileInfo) error {
+		if !fi.IsDir() && isEncryptedPath(fi.Path()) {
+			pfi, err := d.plaintextFileInfo(ctx, fi)
+			if err != nil {
+				return err
+			}
+			fi = pfi
+		}
+		return f(fi)
+	})
+}
@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/openshift/image-registry/pkg/testutil"
+)
+
+func TestEncryptingDriver(t *testing.T) {
+	ctx := context.Background()
+	ctx = testutil.WithTestLogger(ctx, t)
+
+	oldKey := bytes.Repeat([]byte{1}, encryptionKeySize)
+	newKey := bytes.Repeat([]byte{2}, encryptionKeySize)
+	oldKeys, err := NewEncryptionKeys(map[string][]byte{"old": oldKey}, "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotatedKeys, err := NewEncryptionKeys(map[string][]byte{"old": oldKey, "new": newKey}, "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend := inmemory.New()
+	named, err := reference.WithName("user/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newRepository := func(d driver.StorageDriver) (distribution.BlobStore, distribution.BlobStatter) {
+		registry, err := storage.NewRegistry(ctx, d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		repo, err := registry.Repository(ctx, named)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return repo.Blobs(ctx), registry.BlobStatter()
+	}
+
+	// The blob was stored before the encryption was enabled.
+	plainBlobs, _ := newRepository(backend)
+	plainContent := []byte("stored before the encryption")
+	plainDesc, err := plainBlobs.Put(ctx, "application/octet-stream", plainContent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blobs, _ := newRepository(NewEncryptingDriver(backend, oldKeys))
+
+	smallContent := []byte("config")
+	smallDesc, err := blobs.Put(ctx, "application/octet-stream", smallContent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	largeContent := bytes.Repeat([]byte("0123456789"), 2*encryptionChunkSize/10+7)
+	upload, err := blobs.Create(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(upload, bytes.NewReader(largeContent)); err != nil {
+		t.Fatal(err)
+	}
+	largeDesc, err := upload.Commit(ctx, distribution.Descriptor{
+		Digest: digest.FromBytes(largeContent),
+		Size:   int64(len(largeContent)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dgst := range []digest.Digest{smallDesc.Digest, largeDesc.Digest} {
+		data, err := backend.GetContent(ctx, blobPath(dgst)+"/data")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(data, []byte(encryptionMagic)) || bytes.Contains(data, []byte("0123456789")) || bytes.Contains(data, smallContent) {
+			t.Errorf("expected the data of the blob %s to be encrypted in the storage", dgst)
+		}
+	}
+
+	// The old key is still used to read the blobs after the rotation.
+	blobs, statter := newRepository(NewEncryptingDriver(backend, rotatedKeys))
+	for _, tc := range []struct {
+		name    string
+		content []byte
+		desc    distribution.Descriptor
+	}{
+		{name: "plain", content: plainContent, desc: plainDesc},
+		{name: "small", content: smallContent, desc: smallDesc},
+		{name: "large", content: largeContent, desc: largeDesc},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			desc, err := statter.Stat(ctx, tc.desc.Digest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if desc.Size != int64(len(tc.content)) {
+				t.Errorf("got size %d, want %d", desc.Size, len(tc.content))
+			}
+
+			content, err := blobs.Get(ctx, tc.desc.Digest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(content, tc.content) {
+				t.Errorf("got content of %d bytes, want %d bytes", len(content), len(tc.content))
+			}
+
+			for _, offset := range []int64{0, 1, encryptionChunkSize, int64(len(tc.content))} {
+				if offset > int64(len(tc.content)) {
+					continue
+				}
+				rsc, err := blobs.Open(ctx, tc.desc.Digest)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := rsc.Seek(offset, io.SeekStart); err != nil {
+					t.Fatal(err)
+				}
+				content, err := io.ReadAll(rsc)
+				rsc.Close()
+				if err != nil {
+					t.Fatalf("offset %d: %v", offset, err)
+				}
+				if !bytes.Equal(content, tc.content[offset:]) {
+					t.Errorf("offset %d: got %d bytes, want %d bytes", offset, len(content), len(tc.content)-int(offset))
+				}
+			}
+		})
+	}
+
+	d := NewEncryptingDriver(backend, rotatedKeys)
+	if _, err := d.URLFor(ctx, blobPath(largeDesc.Digest)+"/data", nil); err == nil {
+		t.Errorf("expected no URL for the encrypted blob data")
+	}
+
+	// A truncated file is detected.
+	data, err := backend.GetContent(ctx, blobPath(largeDesc.Digest)+"/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.PutContent(ctx, blobPath(largeDesc.Digest)+"/data", data[:encryptionHeaderSize+encryptionSealedChunk]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.GetContent(ctx, blobPath(largeDesc.Digest)+"/data"); err == nil {
+		t.Errorf("expected an error for a truncated file")
+	}
+}
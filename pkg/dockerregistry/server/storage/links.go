@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"path"
+	"strings"
+
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
+)
+
+// LayerLinkPath returns the path of the link that makes the blob dgst
+// available in the repository repo.
+func LayerLinkPath(repo string, dgst digest.Digest) string {
+	return path.Join(repositoriesRoot, repo, "_layers", dgst.Algorithm().String(), dgst.Hex(), "link")
+}
+
+// LayerLinks returns the repositories that have layer links mapped by the
+// digests of the linked blobs. The repositories are found by walking the
+// storage, so the repositories without manifests are found too.
+func LayerLinks(ctx context.Context, d driver.StorageDriver) (map[digest.Digest][]string, error) {
+	links := make(map[digest.Digest][]string)
+	err := d.Walk(ctx, repositoriesRoot, func(fi driver.FileInfo) error {
+		if !fi.IsDir() {
+			return nil
+		}
+		switch path.Base(fi.Path()) {
+		case "_layers":
+			name := strings.TrimPrefix(path.Dir(fi.Path()), repositoriesRoot+"/")
+			dgsts, err := LinkedLayers(ctx, d, name)
+			if err != nil {
+				return err
+			}
+			for _, dgst := range dgsts {
+				links[dgst] = append(links[dgst], name)
+			}
+			return driver.ErrSkipDir
+		case "_manifests", "_uploads":
+			return driver.ErrSkipDir
+		}
+		return nil
+	})
+	if err != nil && !errors.As(err, &driver.PathNotFoundError{}) {
+		return nil, err
+	}
+	return links, nil
+}
+
+// DeleteLayerLink removes the layer link of the blob dgst from the repository
+// repo. It's not an error if the link doesn't exist.
+func DeleteLayerLink(ctx context.Context, d driver.StorageDriver, repo string, dgst digest.Digest) error {
+	err := d.Delete(ctx, path.Dir(LayerLinkPath(repo, dgst)))
+	if errors.As(err, &driver.PathNotFoundError{}) {
+		return nil
+	}
+	return err
+}
+
+// LinkedLayers returns the digests of the blobs that have layer links in the
+// repository repo.
+func LinkedLayers(ctx context.Context, d driver.StorageDriver, repo string) ([]digest.Digest, error) {
+	root := path.Join(repositoriesRoot, repo, "_layers")
+	algorithms, err := d.List(ctx, root)
+	if errors.As(err, &driver.PathNotFoundError{}) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var dgsts []digest.Digest
+	for _, algorithm := range algorithms {
+		hexes, err := d.List(ctx, algorithm)
+		if err != nil {
+			return nil, err
+		}
+		for _, hex := range hexes {
+			dgst := digest.NewDigestFromEncoded(digest.Algorithm(path.Base(algorithm)), path.Base(hex))
+			if dgst.Validate() != nil {
+				continue
+			}
+			dgsts = append(dgsts, dgst)
+		}
+	}
+	return dgsts, nil
+}
@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/openshift/image-registry/pkg/testutil"
+)
+
+func TestLayerLinks(t *testing.T) {
+	ctx := context.Background()
+	ctx = testutil.WithTestLogger(ctx, t)
+
+	driver := inmemory.New()
+	registry, err := storage.NewRegistry(ctx, driver)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	put := func(repoName string, content string) digest.Digest {
+		named, err := reference.WithName(repoName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		repo, err := registry.Repository(ctx, named)
+		if err != nil {
+			t.Fatal(err)
+		}
+		desc, err := repo.Blobs(ctx).Put(ctx, "application/octet-stream", []byte(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return desc.Digest
+	}
+	shared := put("user/app", "shared")
+	put("other/app", "shared")
+	own := put("user/app", "own")
+
+	links, err := LayerLinks(ctx, driver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, repos := range links {
+		sort.Strings(repos)
+	}
+	expected := map[digest.Digest][]string{
+		shared: {"other/app", "user/app"},
+		own:    {"user/app"},
+	}
+	if !reflect.DeepEqual(links, expected) {
+		t.Errorf("got links %v, want %v", links, expected)
+	}
+
+	if err := DeleteLayerLink(ctx, driver, "user/app", shared); err != nil {
+		t.Fatal(err)
+	}
+	// The deleted links are not an error.
+	if err := DeleteLayerLink(ctx, driver, "user/app", shared); err != nil {
+		t.Fatal(err)
+	}
+	links, err = LayerLinks(ctx, driver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repos := links[shared]; !reflect.DeepEqual(repos, []string{"other/app"}) {
+		t.Errorf("got the repositories %v linking the deleted link, want [other/app]", repos)
+	}
+
+	// The storage without repositories has no links.
+	links, err = LayerLinks(ctx, inmemory.New())
+	if err != nil || len(links) != 0 {
+		t.Errorf("got %v, %v for the empty storage", links, err)
+	}
+}
@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"path"
+
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
+)
+
+// referrersRoot returns the directory of the index of the referrers in the
+// repository repo. It's kept in the _manifests directory, so that the
+// enumerations of the repositories and the layer links skip it.
+func referrersRoot(repo string) string {
+	return path.Join(repositoriesRoot, repo, "_manifests", "referrers")
+}
+
+// referrersIndexedPath returns the path of the marker of the repositories
+// whose manifests have been indexed.
+func referrersIndexedPath(repo string) string {
+	return path.Join(referrersRoot(repo), "indexed")
+}
+
+func referrersPath(repo string, subject digest.Digest) string {
+	return path.Join(referrersRoot(repo), subject.Algorithm().String(), subject.Hex())
+}
+
+func referrerPath(repo string, subject, referrer digest.Digest) string {
+	return path.Join(referrersPath(repo, subject), referrer.Algorithm().String(), referrer.Hex())
+}
+
+// PutReferrer adds the manifest referrer to the referrers of subject in the
+// repository repo. The descriptor is returned by Referrers.
+func PutReferrer(ctx context.Context, d driver.StorageDriver, repo string, subject, referrer digest.Digest, descriptor []byte) error {
+	return d.PutContent(ctx, referrerPath(repo, subject, referrer), descriptor)
+}
+
+// DeleteReferrer removes the manifest referrer from the referrers of subject
+// in the repository repo. It's not an error if it isn't a referrer.
+func DeleteReferrer(ctx context.Context, d driver.StorageDriver, repo string, subject, referrer digest.Digest) error {
+	err := d.Delete(ctx, referrerPath(repo, subject, referrer))
+	if errors.As(err, &driver.PathNotFoundError{}) {
+		return nil
+	}
+	return err
+}
+
+// Referrers returns the descriptors of the referrers of subject in the
+// repository repo.
+func Referrers(ctx context.Context, d driver.StorageDriver, repo string, subject digest.Digest) (map[digest.Digest][]byte, error) {
+	algorithms, err := d.List(ctx, referrersPath(repo, subject))
+	if errors.As(err, &driver.PathNotFoundError{}) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	referrers := make(map[digest.Digest][]byte)
+	for _, algorithm := range algorithms {
+		paths, err := d.List(ctx, algorithm)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range paths {
+			dgst := digest.NewDigestFromEncoded(digest.Algorithm(path.Base(algorithm)), path.Base(p))
+			if dgst.Validate() != nil {
+				continue
+			}
+			descriptor, err := d.GetContent(ctx, p)
+			if errors.As(err, &driver.PathNotFoundError{}) {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			referrers[dgst] = descriptor
+		}
+	}
+	return referrers, nil
+}
+
+// ReferrersIndexed returns true if the referrers of the manifests that were
+// pushed into the repository repo before the index was introduced have been
+// added to the index.
+func ReferrersIndexed(ctx context.Context, d driver.StorageDriver, repo string) (bool, error) {
+	_, err := d.Stat(ctx, referrersIndexedPath(repo))
+	if errors.As(err, &driver.PathNotFoundError{}) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// MarkReferrersIndexed records that all manifests of the repository repo have
+// been indexed.
+func MarkReferrersIndexed(ctx context.Context, d driver.StorageDriver, repo string) error {
+	return d.PutContent(ctx, referrersIndexedPath(repo), []byte{})
+}
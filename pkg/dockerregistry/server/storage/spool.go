@@ -0,0 +1,828 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/filesystem"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/metrics"
+)
+
+const (
+	uploadsDirectory = "/_uploads/"
+
+	// spoolMaxThreads limits the concurrent operations with the files of the
+	// spool, it is the default of the filesystem storage driver.
+	spoolMaxThreads = 100
+)
+
+var errSpoolFull = errors.New("the write-behind spool is full")
+
+// uploadDir returns the directory of the upload that path belongs to, or
+// false if path is not in an upload.
+func uploadDir(path string) (string, bool) {
+	i := strings.Index(path, uploadsDirectory)
+	if i < 0 {
+		return "", false
+	}
+	end := i + len(uploadsDirectory)
+	if j := strings.IndexByte(path[end:], '/'); j >= 0 {
+		end += j
+	} else {
+		end = len(path)
+	}
+	return path[:end], true
+}
+
+func isUploadPath(path string) bool {
+	_, ok := uploadDir(path)
+	return ok
+}
+
+// isUploadStart returns true if path is the first file that is written when
+// an upload is created.
+func isUploadStart(p string) bool {
+	return isUploadPath(p) && path.Base(p) == "startedat"
+}
+
+func isBlobDataPath(path string) bool {
+	return strings.HasPrefix(path, blobsRoot+"/") && strings.HasSuffix(path, "/data")
+}
+
+// spoolFile is a file in the spool.
+type spoolFile struct {
+	size int64
+	// gen changes when the file starts to be written, so that the mover
+	// doesn't delete a file that is written while it is moved.
+	gen uint64
+	// pending is set for the files that are not moved to the storage
+	// backend yet. The files of uploads are never moved, they are moved
+	// within the spool when the uploads are committed.
+	pending bool
+}
+
+// spoolMove is a file that waits to be moved to the storage backend.
+type spoolMove struct {
+	path string
+	gen  uint64
+}
+
+// Spool is a storage driver that writes the uploads and the blobs into a
+// local directory when the storage backend fails, so that pushes keep working
+// during short outages of the storage backend. The spooled files are moved to
+// the backend by Run in the order they were written, and they are read from
+// the spool until they are moved.
+//
+// The files are written into the backend unless it fails, the uploads that
+// are created or started while it fails are written into the spool until
+// they are committed. The other files are written into the spool while there
+// are files that are not moved yet, as the links to the spooled blobs
+// shouldn't get into the backend before the blobs. The spool is local to the
+// replica, the other replicas see the spooled files only once they are
+// moved. The spool is strictly limited by its maximum size, the writes that
+// would exceed it fail.
+type Spool struct {
+	driver.StorageDriver
+	spool   driver.StorageDriver
+	maxSize int64
+	metrics metrics.Spool
+	wakeup  chan struct{}
+
+	mu    sync.Mutex
+	files map[string]*spoolFile
+	// children are the names of the entries of the directories that have
+	// spooled files, so that the directories are looked up without
+	// scanning all files.
+	children map[string]map[string]bool
+	size     int64
+	pending  int
+	queue    []spoolMove
+}
+
+// NewSpool returns the spool in the directory dir for the storage backend d.
+// The files that were not moved before the registry was restarted are moved
+// again.
+func NewSpool(ctx context.Context, d driver.StorageDriver, dir string, maxSize int64, m metrics.Spool) (*Spool, error) {
+	spool := filesystem.New(filesystem.DriverParameters{
+		RootDirectory: dir,
+		MaxThreads:    spoolMaxThreads,
+	})
+	return newSpool(ctx, d, spool, maxSize, m)
+}
+
+func newSpool(ctx context.Context, d, spool driver.StorageDriver, maxSize int64, m metrics.Spool) (*Spool, error) {
+	s := &Spool{
+		StorageDriver: d,
+		spool:         spool,
+		maxSize:       maxSize,
+		metrics:       m,
+		wakeup:        make(chan struct{}, 1),
+		files:         make(map[string]*spoolFile),
+		children:      make(map[string]map[string]bool),
+	}
+
+	var pending []driver.FileInfo
+	err := spool.Walk(ctx, "/", func(fi driver.FileInfo) error {
+		if fi.IsDir() {
+			return nil
+		}
+		f := &spoolFile{
+			size:    fi.Size(),
+			pending: !isUploadPath(fi.Path()),
+		}
+		s.addLocked(fi.Path(), f)
+		s.size += f.size
+		if f.pending {
+			s.pending++
+			pending = append(pending, fi)
+		}
+		return nil
+	})
+	if _, ok := err.(driver.PathNotFoundError); err != nil && !ok {
+		return nil, fmt.Errorf("unable to read the spool: %w", err)
+	}
+
+	sort.SliceStable(pending, func(i, j int) bool {
+		return pending[i].ModTime().Before(pending[j].ModTime())
+	})
+	for _, fi := range pending {
+		s.queue = append(s.queue, spoolMove{path: fi.Path()})
+	}
+	if len(pending) > 0 {
+		dcontext.GetLogger(ctx).Infof("the spool has %d files that are not moved to the storage backend", len(pending))
+	}
+	s.metrics.Usage(s.size, s.pending)
+	return s, nil
+}
+
+func (s *Spool) reportLocked() {
+	s.metrics.Usage(s.size, s.pending)
+}
+
+// addLocked adds the spooled file p to the files and its directories.
+func (s *Spool) addLocked(p string, f *spoolFile) {
+	s.files[p] = f
+	for child := p; child != "/"; child = path.Dir(child) {
+		dir := path.Dir(child)
+		entries, ok := s.children[dir]
+		if !ok {
+			entries = make(map[string]bool)
+			s.children[dir] = entries
+		}
+		if entries[child] {
+			// The parent directories already have spooled files.
+			return
+		}
+		entries[child] = true
+	}
+}
+
+// deleteLocked removes the spooled file p from the files and the directories
+// that don't have other spooled files.
+func (s *Spool) deleteLocked(p string) {
+	delete(s.files, p)
+	for child := p; child != "/"; child = path.Dir(child) {
+		dir := path.Dir(child)
+		entries := s.children[dir]
+		delete(entries, child)
+		if len(entries) > 0 {
+			return
+		}
+		delete(s.children, dir)
+	}
+}
+
+// filesLocked returns the spooled files in the directory dir and its
+// subdirectories.
+func (s *Spool) filesLocked(dir string) []string {
+	var files []string
+	for child := range s.children[dir] {
+		if _, ok := s.files[child]; ok {
+			files = append(files, child)
+		} else {
+			files = append(files, s.filesLocked(child)...)
+		}
+	}
+	return files
+}
+
+// hasFilesLocked returns true if path is a spooled file or a directory with
+// spooled files.
+func (s *Spool) hasFilesLocked(p string) bool {
+	if _, ok := s.files[p]; ok {
+		return true
+	}
+	return len(s.children[cleanSpoolPath(p)]) > 0
+}
+
+// cleanSpoolPath returns the path of the directory p without the trailing
+// slash.
+func cleanSpoolPath(p string) string {
+	if p == "/" {
+		return p
+	}
+	return strings.TrimSuffix(p, "/")
+}
+
+func (s *Spool) isSpooled(path string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.files[path]
+	return ok
+}
+
+func (s *Spool) hasFiles(path string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hasFilesLocked(path)
+}
+
+// isSpooledUpload returns true if path belongs to an upload that is written
+// into the spool.
+func (s *Spool) isSpooledUpload(path string) bool {
+	dir, ok := uploadDir(path)
+	return ok && s.hasFiles(dir)
+}
+
+// startLocked starts a write of path with size bytes into the spool. It
+// returns false if the spool has no space for them.
+func (s *Spool) startLocked(path string, size int64) bool {
+	if s.size+size > s.maxSize {
+		return false
+	}
+	s.size += size
+	f, ok := s.files[path]
+	if !ok {
+		f = &spoolFile{}
+		s.addLocked(path, f)
+	}
+	f.gen++
+	return true
+}
+
+// finishLocked finishes a write of path that changed the size of the spooled
+// file by delta. The file becomes pending if it's committed outside of an
+// upload.
+func (s *Spool) finishLocked(path string, delta int64, committed bool) {
+	f, ok := s.files[path]
+	if !ok {
+		// The file is deleted while it is written.
+		s.size -= delta
+		s.reportLocked()
+		return
+	}
+	f.size += delta
+	if committed && !f.pending && !isUploadPath(path) {
+		f.pending = true
+		s.pending++
+	}
+	if f.pending {
+		s.queue = append(s.queue, spoolMove{path: path, gen: f.gen})
+		select {
+		case s.wakeup <- struct{}{}:
+		default:
+		}
+	}
+	s.reportLocked()
+}
+
+// removeLocked removes path and the files in it from the spool. It returns
+// false if there are no such files.
+func (s *Spool) removeLocked(path string) bool {
+	removed := false
+	paths := []string{path}
+	if _, ok := s.files[path]; !ok {
+		paths = s.filesLocked(cleanSpoolPath(path))
+	}
+	for _, p := range paths {
+		f, ok := s.files[p]
+		if !ok {
+			continue
+		}
+		s.deleteLocked(p)
+		s.size -= f.size
+		if f.pending {
+			s.pending--
+		}
+		removed = true
+	}
+	if removed {
+		s.reportLocked()
+	}
+	return removed
+}
+
+// forget removes the spooled copy of path after it is written to the storage
+// backend.
+func (s *Spool) forget(ctx context.Context, path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.files[path]; !ok {
+		return
+	}
+	s.removeLocked(path)
+	if err := s.spool.Delete(ctx, path); err != nil {
+		if _, ok := err.(driver.PathNotFoundError); !ok {
+			dcontext.GetLogger(ctx).Warnf("unable to delete %s from the spool: %v", path, err)
+		}
+	}
+}
+
+// spoolWrite decides whether a new write of path goes into the spool before
+// the storage backend is tried. The uploads stay in the spool once they are
+// in it.
+func (s *Spool) spoolWrite(path string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if dir, ok := uploadDir(path); ok {
+		return s.hasFilesLocked(dir)
+	}
+	_, ok := s.files[path]
+	return ok || s.pending > 0
+}
+
+func (s *Spool) GetContent(ctx context.Context, path string) ([]byte, error) {
+	if s.isSpooled(path) {
+		content, err := s.spool.GetContent(ctx, path)
+		if _, ok := err.(driver.PathNotFoundError); !ok {
+			return content, err
+		}
+		// The file is moved to the storage backend.
+	}
+	return s.StorageDriver.GetContent(ctx, path)
+}
+
+func (s *Spool) PutContent(ctx context.Context, path string, content []byte) error {
+	if s.spoolWrite(path) {
+		if err := s.putSpool(ctx, path, content); err != errSpoolFull {
+			return err
+		}
+	}
+
+	// The uploads are spooled only if they are created while the backend
+	// fails, their other files shouldn't be split between the spool and the
+	// backend.
+	err := s.StorageDriver.PutContent(ctx, path, content)
+	if err != nil && (!isUploadPath(path) || isUploadStart(path)) {
+		if spoolErr := s.putSpool(ctx, path, content); spoolErr == nil {
+			dcontext.GetLogger(ctx).Warnf("%s is written into the spool, the storage backend failed: %v", path, err)
+			return nil
+		}
+		return err
+	}
+	if err == nil {
+		s.forget(ctx, path)
+	}
+	return err
+}
+
+func (s *Spool) putSpool(ctx context.Context, path string, content []byte) error {
+	size := int64(len(content))
+
+	s.mu.Lock()
+	_, existed := s.files[path]
+	if !s.startLocked(path, size) {
+		s.mu.Unlock()
+		s.metrics.Failed(metrics.SpoolFailureFull)
+		return errSpoolFull
+	}
+	s.mu.Unlock()
+
+	err := s.spool.PutContent(ctx, path, content)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.size -= size
+		if existed {
+			s.finishLocked(path, 0, false)
+		} else {
+			s.removeLocked(path)
+		}
+		return err
+	}
+	if f, ok := s.files[path]; ok {
+		// The new content replaces the previous one.
+		s.size -= f.size
+		f.size = 0
+	}
+	s.finishLocked(path, size, true)
+	return nil
+}
+
+func (s *Spool) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	if s.isSpooled(path) {
+		r, err := s.spool.Reader(ctx, path, offset)
+		if _, ok := err.(driver.PathNotFoundError); !ok {
+			return r, err
+		}
+	}
+	return s.StorageDriver.Reader(ctx, path, offset)
+}
+
+// Writer writes into the spool the files that are already in it, the files
+// of the spooled uploads and the new files that cannot be written into the
+// storage backend. The files that are appended in the backend stay there.
+func (s *Spool) Writer(ctx context.Context, path string, append bool) (driver.FileWriter, error) {
+	if s.spoolWrite(path) {
+		w, err := s.writeSpool(ctx, path, append)
+		if err != errSpoolFull {
+			return w, err
+		}
+	}
+
+	w, err := s.StorageDriver.Writer(ctx, path, append)
+	if err == nil || append {
+		return w, err
+	}
+	if _, ok := err.(driver.PathNotFoundError); ok {
+		return nil, err
+	}
+	spoolW, spoolErr := s.writeSpool(ctx, path, false)
+	if spoolErr != nil {
+		return nil, err
+	}
+	dcontext.GetLogger(ctx).Warnf("%s is written into the spool, the storage backend failed: %v", path, err)
+	return spoolW, nil
+}
+
+// writeSpool opens the writer of path in the spool. The new files outside of
+// the uploads are not started when the spool is full.
+func (s *Spool) writeSpool(ctx context.Context, path string, append bool) (driver.FileWriter, error) {
+	s.mu.Lock()
+	_, existed := s.files[path]
+	if !existed && !isUploadPath(path) && s.size >= s.maxSize {
+		s.mu.Unlock()
+		s.metrics.Failed(metrics.SpoolFailureFull)
+		return nil, errSpoolFull
+	}
+	s.startLocked(path, 0)
+	s.mu.Unlock()
+
+	w, err := s.spool.Writer(ctx, path, append)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		if existed {
+			s.finishLocked(path, 0, false)
+		} else {
+			s.removeLocked(path)
+		}
+		return nil, err
+	}
+	if f, ok := s.files[path]; ok {
+		// The file is truncated unless it is appended.
+		s.size += w.Size() - f.size
+		f.size = w.Size()
+		s.reportLocked()
+	}
+	return &spoolWriter{
+		FileWriter: w,
+		spool:      s,
+		path:       path,
+	}, nil
+}
+
+// spoolWriter counts the bytes written into the spool.
+type spoolWriter struct {
+	driver.FileWriter
+	spool *Spool
+	path  string
+}
+
+func (w *spoolWriter) Write(p []byte) (int, error) {
+	s := w.spool
+	size := int64(len(p))
+
+	s.mu.Lock()
+	if s.size+size > s.maxSize {
+		s.mu.Unlock()
+		s.metrics.Failed(metrics.SpoolFailureFull)
+		return 0, errSpoolFull
+	}
+	s.size += size
+	s.mu.Unlock()
+
+	n, err := w.FileWriter.Write(p)
+
+	s.mu.Lock()
+	s.size -= size
+	if f, ok := s.files[w.path]; ok {
+		s.size += int64(n)
+		f.size += int64(n)
+	}
+	s.reportLocked()
+	s.mu.Unlock()
+	return n, err
+}
+
+// Close queues the file again if it's pending, the queued move was skipped
+// while the file was written.
+func (w *spoolWriter) Close() error {
+	err := w.FileWriter.Close()
+	s := w.spool
+	s.mu.Lock()
+	if f, ok := s.files[w.path]; ok && f.pending {
+		s.finishLocked(w.path, 0, false)
+	}
+	s.mu.Unlock()
+	return err
+}
+
+func (w *spoolWriter) Cancel(ctx context.Context) error {
+	err := w.FileWriter.Cancel(ctx)
+	s := w.spool
+	s.mu.Lock()
+	s.removeLocked(w.path)
+	s.mu.Unlock()
+	return err
+}
+
+func (w *spoolWriter) Commit() error {
+	err := w.FileWriter.Commit()
+	s := w.spool
+	s.mu.Lock()
+	s.finishLocked(w.path, 0, err == nil)
+	s.mu.Unlock()
+	return err
+}
+
+func (s *Spool) Stat(ctx context.Context, path string) (driver.FileInfo, error) {
+	if s.isSpooled(path) {
+		fi, err := s.spool.Stat(ctx, path)
+		if _, ok := err.(driver.PathNotFoundError); !ok {
+			return fi, err
+		}
+	}
+
+	fi, err := s.StorageDriver.Stat(ctx, path)
+	if err == nil {
+		return fi, nil
+	}
+	if s.hasFiles(path) {
+		// The directory has only spooled files, or the backend is
+		// unavailable.
+		if spoolFi, spoolErr := s.spool.Stat(ctx, path); spoolErr == nil {
+			return spoolFi, nil
+		}
+	}
+	if _, ok := err.(driver.PathNotFoundError); !ok && (isBlobDataPath(path) || s.isSpooledUpload(path)) {
+		// The blobs are addressed by their content, so a blob that is
+		// stored again while the backend is unavailable doesn't change
+		// it. The uploads that are in the spool are only there.
+		return nil, driver.PathNotFoundError{Path: path, DriverName: s.Name()}
+	}
+	return nil, err
+}
+
+// List returns the entries of path both in the spool and in the storage
+// backend.
+func (s *Spool) List(ctx context.Context, path string) ([]string, error) {
+	s.mu.Lock()
+	spooled := make(map[string]bool)
+	for name := range s.children[cleanSpoolPath(path)] {
+		spooled[name] = true
+	}
+	s.mu.Unlock()
+
+	entries, err := s.StorageDriver.List(ctx, path)
+	if len(spooled) == 0 {
+		return entries, err
+	}
+	if _, ok := err.(driver.PathNotFoundError); err != nil && !ok && !s.isSpooledUpload(path) {
+		return nil, err
+	}
+	for _, entry := range entries {
+		delete(spooled, entry)
+	}
+	var names []string
+	for name := range spooled {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return append(entries, names...), nil
+}
+
+// Move moves the spooled files within the spool. The files that are moved out
+// of an upload become pending.
+func (s *Spool) Move(ctx context.Context, sourcePath string, destPath string) error {
+	s.mu.Lock()
+	f, ok := s.files[sourcePath]
+	if !ok {
+		s.mu.Unlock()
+		if err := s.StorageDriver.Move(ctx, sourcePath, destPath); err != nil {
+			return err
+		}
+		s.forget(ctx, destPath)
+		return nil
+	}
+	wasPending := f.pending
+	_, destExists := s.files[destPath]
+	s.startLocked(destPath, 0)
+	s.mu.Unlock()
+
+	err := s.spool.Move(ctx, sourcePath, destPath)
+
+	s.mu.Lock()
+	if err != nil {
+		if destExists {
+			s.finishLocked(destPath, 0, false)
+		} else {
+			s.removeLocked(destPath)
+		}
+		s.mu.Unlock()
+		return err
+	}
+	size := int64(0)
+	if f, ok := s.files[sourcePath]; ok {
+		size = f.size
+		s.removeLocked(sourcePath)
+	}
+	if dest, ok := s.files[destPath]; ok {
+		s.size -= dest.size
+		dest.size = 0
+	}
+	s.size += size
+	s.finishLocked(destPath, size, true)
+	s.mu.Unlock()
+
+	if wasPending {
+		// An older copy of the file may be in the storage backend.
+		if err := s.StorageDriver.Delete(ctx, sourcePath); err != nil {
+			if _, ok := err.(driver.PathNotFoundError); !ok {
+				dcontext.GetLogger(ctx).Warnf("unable to delete %s from the storage backend: %v", sourcePath, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Spool) Delete(ctx context.Context, path string) error {
+	s.mu.Lock()
+	spooled := s.removeLocked(path)
+	s.mu.Unlock()
+
+	if spooled {
+		if err := s.spool.Delete(ctx, path); err != nil {
+			if _, ok := err.(driver.PathNotFoundError); !ok {
+				return err
+			}
+		}
+	}
+
+	err := s.StorageDriver.Delete(ctx, path)
+	if _, ok := err.(driver.PathNotFoundError); ok && spooled {
+		return nil
+	}
+	if err != nil && spooled && isUploadPath(path) {
+		// The upload was written into the spool, the storage backend
+		// has at most its files that were written while the spool was
+		// full. They are purged with the other abandoned uploads.
+		dcontext.GetLogger(ctx).Warnf("unable to delete %s from the storage backend: %v", path, err)
+		return nil
+	}
+	return err
+}
+
+// URLFor doesn't return URLs for the spooled files, they are not in the
+// storage backend yet.
+func (s *Spool) URLFor(ctx context.Context, path string, options map[string]interface{}) (string, error) {
+	if s.hasFiles(path) {
+		return "", driver.ErrUnsupportedMethod{DriverName: s.Name()}
+	}
+	return s.StorageDriver.URLFor(ctx, path, options)
+}
+
+func (s *Spool) Walk(ctx context.Context, path string, f driver.WalkFn) error {
+	if s.hasFiles(path) {
+		return driver.WalkFallback(ctx, s, path, f)
+	}
+	return s.StorageDriver.Walk(ctx, path, f)
+}
+
+// Run moves the spooled files to the storage backend until ctx is done. The
+// moves are retried every interval after the backend fails.
+func (s *Spool) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.moveAll(ctx); err != nil && ctx.Err() == nil {
+			dcontext.GetLogger(ctx).Warnf("unable to move the spooled files to the storage backend, retrying in %s: %v", interval, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.wakeup:
+		case <-ticker.C:
+		}
+	}
+}
+
+// next returns the first file that waits to be moved. The files that were
+// written again since they were queued are skipped, they are queued again.
+func (s *Spool) next() (spoolMove, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for len(s.queue) > 0 {
+		m := s.queue[0]
+		if f, ok := s.files[m.path]; ok && f.pending && f.gen == m.gen {
+			return m, true
+		}
+		s.queue = s.queue[1:]
+	}
+	return spoolMove{}, false
+}
+
+// moveAll moves the pending files in order. It stops at the first failure,
+// so that the files are not moved out of order.
+func (s *Spool) moveAll(ctx context.Context) error {
+	for ctx.Err() == nil {
+		m, ok := s.next()
+		if !ok {
+			return nil
+		}
+		if err := s.move(ctx, m); err != nil {
+			s.metrics.Failed(metrics.SpoolFailureMove)
+			return err
+		}
+		s.mu.Lock()
+		if len(s.queue) > 0 && s.queue[0] == m {
+			s.queue = s.queue[1:]
+		}
+		s.mu.Unlock()
+	}
+	return ctx.Err()
+}
+
+// move copies the file of m to the storage backend and deletes it from the
+// spool.
+func (s *Spool) move(ctx context.Context, m spoolMove) error {
+	r, err := s.spool.Reader(ctx, m.path, 0)
+	if _, ok := err.(driver.PathNotFoundError); ok {
+		// The file is deleted.
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := s.StorageDriver.Writer(ctx, m.path, false)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(w, r)
+	if err != nil {
+		_ = w.Cancel(ctx)
+		_ = w.Close()
+		return fmt.Errorf("unable to move %s: %w", m.path, err)
+	}
+	if err := w.Commit(); err != nil {
+		_ = w.Close()
+		return fmt.Errorf("unable to move %s: %w", m.path, err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("unable to move %s: %w", m.path, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, ok := s.files[m.path]
+	if !ok {
+		// The file is deleted while it is moved, the copy shouldn't
+		// bring it back.
+		if err := s.StorageDriver.Delete(ctx, m.path); err != nil {
+			if _, ok := err.(driver.PathNotFoundError); !ok {
+				dcontext.GetLogger(ctx).Warnf("unable to delete %s from the storage backend: %v", m.path, err)
+			}
+		}
+		return nil
+	}
+	if f.gen != m.gen {
+		// The file is written again, it is queued again.
+		return nil
+	}
+	s.removeLocked(m.path)
+	if err := s.spool.Delete(ctx, m.path); err != nil {
+		if _, ok := err.(driver.PathNotFoundError); !ok {
+			dcontext.GetLogger(ctx).Warnf("unable to delete %s from the spool: %v", m.path, err)
+		}
+	}
+	s.metrics.Moved(n)
+	return nil
+}
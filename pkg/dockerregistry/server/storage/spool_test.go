@@ -0,0 +1,284 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/metrics"
+	metricstesting "github.com/openshift/image-registry/pkg/dockerregistry/server/metrics/testing"
+	"github.com/openshift/image-registry/pkg/testutil"
+)
+
+var errBackendUnavailable = errors.New("connection refused")
+
+// unavailableDriver fails all operations while it is unavailable.
+type unavailableDriver struct {
+	driver.StorageDriver
+	unavailable bool
+}
+
+func (d *unavailableDriver) GetContent(ctx context.Context, path string) ([]byte, error) {
+	if d.unavailable {
+		return nil, errBackendUnavailable
+	}
+	return d.StorageDriver.GetContent(ctx, path)
+}
+
+func (d *unavailableDriver) PutContent(ctx context.Context, path string, content []byte) error {
+	if d.unavailable {
+		return errBackendUnavailable
+	}
+	return d.StorageDriver.PutContent(ctx, path, content)
+}
+
+func (d *unavailableDriver) Reader(ctx context.Context, path string, offset int64) (io.ReadCloser, error) {
+	if d.unavailable {
+		return nil, errBackendUnavailable
+	}
+	return d.StorageDriver.Reader(ctx, path, offset)
+}
+
+func (d *unavailableDriver) Writer(ctx context.Context, path string, append bool) (driver.FileWriter, error) {
+	if d.unavailable {
+		return nil, errBackendUnavailable
+	}
+	return d.StorageDriver.Writer(ctx, path, append)
+}
+
+func (d *unavailableDriver) Stat(ctx context.Context, path string) (driver.FileInfo, error) {
+	if d.unavailable {
+		return nil, errBackendUnavailable
+	}
+	return d.StorageDriver.Stat(ctx, path)
+}
+
+func (d *unavailableDriver) List(ctx context.Context, path string) ([]string, error) {
+	if d.unavailable {
+		return nil, errBackendUnavailable
+	}
+	return d.StorageDriver.List(ctx, path)
+}
+
+func (d *unavailableDriver) Move(ctx context.Context, sourcePath string, destPath string) error {
+	if d.unavailable {
+		return errBackendUnavailable
+	}
+	return d.StorageDriver.Move(ctx, sourcePath, destPath)
+}
+
+func (d *unavailableDriver) Delete(ctx context.Context, path string) error {
+	if d.unavailable {
+		return errBackendUnavailable
+	}
+	return d.StorageDriver.Delete(ctx, path)
+}
+
+func newSpoolRepository(t *testing.T, ctx context.Context, d driver.StorageDriver) distribution.BlobStore {
+	registry, err := storage.NewRegistry(ctx, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	named, err := reference.WithName("user/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo, err := registry.Repository(ctx, named)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return repo.Blobs(ctx)
+}
+
+func uploadBlob(ctx context.Context, blobs distribution.BlobStore, content []byte) (distribution.Descriptor, error) {
+	w, err := blobs.Create(ctx)
+	if err != nil {
+		return distribution.Descriptor{}, err
+	}
+	if _, err := w.Write(content); err != nil {
+		_ = w.Cancel(ctx)
+		return distribution.Descriptor{}, err
+	}
+	return w.Commit(ctx, distribution.Descriptor{Digest: digest.FromBytes(content)})
+}
+
+func TestSpool(t *testing.T) {
+	ctx := testutil.WithTestLogger(context.Background(), t)
+
+	backend := &unavailableDriver{StorageDriver: inmemory.New()}
+	spoolDriver := inmemory.New()
+	c, sink := metricstesting.NewCounterSink()
+	s, err := newSpool(ctx, backend, spoolDriver, 1<<20, metrics.NewMetrics(sink).Spool())
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobs := newSpoolRepository(t, ctx, s)
+
+	// The blobs are pushed directly to the available backend.
+	direct, err := uploadBlob(ctx, blobs, []byte("pushed to the backend"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.Stat(ctx, BlobDataPath(direct.Digest)); err != nil {
+		t.Errorf("the blob isn't written to the backend: %v", err)
+	}
+	if n := len(s.files); n != 0 {
+		t.Errorf("got %d files in the spool while the backend is available, want none", n)
+	}
+
+	// The blob is pushed while the storage backend is unavailable.
+	backend.unavailable = true
+	content := bytes.Repeat([]byte("layer"), 1000)
+	desc, err := uploadBlob(ctx, blobs, content)
+	if err != nil {
+		t.Fatalf("unable to push the blob while the backend is unavailable: %v", err)
+	}
+	got, err := blobs.Get(ctx, desc.Digest)
+	if err != nil {
+		t.Fatalf("unable to read the spooled blob: %v", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("got the spooled content %q, want %q", got, content)
+	}
+	if _, err := s.URLFor(ctx, BlobDataPath(desc.Digest), nil); err == nil {
+		t.Errorf("got a URL for the spooled blob, want an error")
+	}
+	if err := s.moveAll(ctx); err == nil {
+		t.Errorf("the files are moved to the unavailable backend")
+	}
+
+	// The blob data and the link are moved after the backend recovers.
+	backend.unavailable = false
+	if err := s.moveAll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.Stat(ctx, BlobDataPath(desc.Digest)); err != nil {
+		t.Errorf("the blob data isn't moved to the backend: %v", err)
+	}
+	if _, err := backend.Stat(ctx, LayerLinkPath("user/app", desc.Digest)); err != nil {
+		t.Errorf("the layer link isn't moved to the backend: %v", err)
+	}
+	if n := len(s.files); n != 0 {
+		t.Errorf("got %d files in the spool after the move, want none", n)
+	}
+	if n := len(s.children); n != 0 {
+		t.Errorf("got %d directories with spooled files after the move, want none", n)
+	}
+	if _, err := spoolDriver.Stat(ctx, BlobDataPath(desc.Digest)); err == nil {
+		t.Errorf("the moved blob data is still in the spool")
+	}
+	got, err = newSpoolRepository(t, ctx, backend).Get(ctx, desc.Digest)
+	if err != nil {
+		t.Fatalf("unable to read the moved blob from the backend: %v", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("got the moved content %q, want %q", got, content)
+	}
+
+	values := c.Values()
+	if values["storage_spool_bytes"] != 0 || values["storage_spool_pending_files"] != 0 {
+		t.Errorf("got the spool usage %d bytes and %d pending files, want none", values["storage_spool_bytes"], values["storage_spool_pending_files"])
+	}
+	if values["storage_spool_moved_bytes"] < len(content) {
+		t.Errorf("got %d moved bytes, want at least %d", values["storage_spool_moved_bytes"], len(content))
+	}
+	if values["storage_spool_failures:"+metrics.SpoolFailureMove] != 1 {
+		t.Errorf("got %d failed moves, want 1", values["storage_spool_failures:"+metrics.SpoolFailureMove])
+	}
+}
+
+func TestSpoolMaxSize(t *testing.T) {
+	ctx := testutil.WithTestLogger(context.Background(), t)
+
+	backend := &unavailableDriver{StorageDriver: inmemory.New()}
+	c, sink := metricstesting.NewCounterSink()
+	s, err := newSpool(ctx, backend, inmemory.New(), 1024, metrics.NewMetrics(sink).Spool())
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobs := newSpoolRepository(t, ctx, s)
+
+	backend.unavailable = true
+	if _, err := uploadBlob(ctx, blobs, bytes.Repeat([]byte("x"), 2048)); err == nil {
+		t.Errorf("the blob that exceeds the spool is pushed")
+	}
+	if c.Values()["storage_spool_failures:"+metrics.SpoolFailureFull] == 0 {
+		t.Errorf("the rejected write isn't counted")
+	}
+	if s.size != 0 {
+		t.Errorf("got %d bytes in the spool after the failed push, want none", s.size)
+	}
+
+	// The pushes go directly to the backend while the spool is full.
+	backend.unavailable = false
+	s.size = s.maxSize
+	content := []byte("pushed while the spool is full")
+	desc, err := uploadBlob(ctx, blobs, content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.Stat(ctx, BlobDataPath(desc.Digest)); err != nil {
+		t.Errorf("the blob isn't written to the backend: %v", err)
+	}
+}
+
+func TestSpoolRestart(t *testing.T) {
+	ctx := testutil.WithTestLogger(context.Background(), t)
+
+	backend := &unavailableDriver{StorageDriver: inmemory.New(), unavailable: true}
+	spoolDriver := inmemory.New()
+	s, err := newSpool(ctx, backend, spoolDriver, 1<<20, metrics.NewNoopMetrics().Spool())
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc, err := uploadBlob(ctx, newSpoolRepository(t, ctx, s), []byte("pushed before the restart"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The registry is restarted with an upload in progress.
+	w, err := newSpoolRepository(t, ctx, s).Create(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("in progress")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = newSpool(ctx, backend, spoolDriver, 1<<20, metrics.NewNoopMetrics().Spool())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.pending != 2 {
+		t.Errorf("got %d pending files after the restart, want the blob data and its link", s.pending)
+	}
+	for p, f := range s.files {
+		if f.pending == strings.Contains(p, "/_uploads/") {
+			t.Errorf("%s: got pending %t", p, f.pending)
+		}
+	}
+
+	backend.unavailable = false
+	if err := s.moveAll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.Stat(ctx, BlobDataPath(desc.Digest)); err != nil {
+		t.Errorf("the blob data isn't moved after the restart: %v", err)
+	}
+	if s.pending != 0 {
+		t.Errorf("got %d pending files after the move, want none", s.pending)
+	}
+}
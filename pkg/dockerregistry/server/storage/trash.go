@@ -0,0 +1,187 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	blobsRoot        = "/docker/registry/v2/blobs"
+	repositoriesRoot = "/docker/registry/v2/repositories"
+	trashRoot        = "/docker/registry/v2/trash"
+
+	trashDataFile      = "data"
+	trashDeletedAtFile = "deletedat"
+)
+
+// Trash keeps the data of deleted blobs for the retention period, so that
+// the blobs can be restored if they were deleted by mistake.
+//
+// The data of a blob is moved from the blob store into
+// /docker/registry/v2/trash/<algorithm>/<hex>/data, the time of the deletion
+// is stored next to it.
+type Trash struct {
+	driver    driver.StorageDriver
+	retention time.Duration
+	now       func() time.Time
+}
+
+// NewTrash returns the trash in the storage d that keeps blobs for
+// retention.
+func NewTrash(d driver.StorageDriver, retention time.Duration) *Trash {
+	return &Trash{
+		driver:    d,
+		retention: retention,
+		now:       time.Now,
+	}
+}
+
+func blobPath(dgst digest.Digest) string {
+	return path.Join(blobsRoot, dgst.Algorithm().String(), dgst.Hex()[:2], dgst.Hex())
+}
+
+// BlobDataPath returns the path of the data of the blob dgst in the storage.
+func BlobDataPath(dgst digest.Digest) string {
+	return path.Join(blobPath(dgst), "data")
+}
+
+func trashPath(dgst digest.Digest) string {
+	return path.Join(trashRoot, dgst.Algorithm().String(), dgst.Hex())
+}
+
+// Add moves the data of the blob dgst into the trash. It returns
+// distribution.ErrBlobUnknown if the blob doesn't exist.
+func (t *Trash) Add(ctx context.Context, dgst digest.Digest) error {
+	if err := dgst.Validate(); err != nil {
+		return err
+	}
+
+	dcontext.GetLogger(ctx).Infof("Moving blob to the trash: %s", dgst)
+
+	dir := trashPath(dgst)
+	deletedAt := []byte(t.now().UTC().Format(time.RFC3339))
+	if err := t.driver.PutContent(ctx, path.Join(dir, trashDeletedAtFile), deletedAt); err != nil {
+		return fmt.Errorf("unable to move the blob %s to the trash: %w", dgst, err)
+	}
+
+	err := t.driver.Move(ctx, path.Join(blobPath(dgst), "data"), path.Join(dir, trashDataFile))
+	if _, ok := err.(driver.PathNotFoundError); ok {
+		// The blob may have been restored and deleted again, so the data
+		// of the previous deletion is kept.
+		if _, statErr := t.driver.Stat(ctx, path.Join(dir, trashDataFile)); statErr != nil {
+			_ = t.driver.Delete(ctx, dir)
+		}
+		return distribution.ErrBlobUnknown
+	} else if err != nil {
+		return fmt.Errorf("unable to move the blob %s to the trash: %w", dgst, err)
+	}
+
+	if err := t.driver.Delete(ctx, blobPath(dgst)); err != nil {
+		if _, ok := err.(driver.PathNotFoundError); !ok {
+			dcontext.GetLogger(ctx).Warnf("unable to remove the directory of the blob %s: %v", dgst, err)
+		}
+	}
+	return nil
+}
+
+// Restore moves the data of the blob dgst back from the trash. It returns
+// distribution.ErrBlobUnknown if the blob is not in the trash.
+func (t *Trash) Restore(ctx context.Context, dgst digest.Digest) error {
+	if err := dgst.Validate(); err != nil {
+		return err
+	}
+
+	dcontext.GetLogger(ctx).Infof("Restoring blob from the trash: %s", dgst)
+
+	dir := trashPath(dgst)
+	err := t.driver.Move(ctx, path.Join(dir, trashDataFile), path.Join(blobPath(dgst), "data"))
+	if _, ok := err.(driver.PathNotFoundError); ok {
+		return distribution.ErrBlobUnknown
+	} else if err != nil {
+		return fmt.Errorf("unable to restore the blob %s from the trash: %w", dgst, err)
+	}
+
+	if err := t.driver.Delete(ctx, dir); err != nil {
+		if _, ok := err.(driver.PathNotFoundError); !ok {
+			dcontext.GetLogger(ctx).Warnf("unable to remove the blob %s from the trash: %v", dgst, err)
+		}
+	}
+	return nil
+}
+
+// Purge permanently deletes the blobs that have been in the trash for longer
+// than the retention period. It returns the number and the size of the
+// deleted blobs.
+func (t *Trash) Purge(ctx context.Context) (int, int64, error) {
+	algorithms, err := t.driver.List(ctx, trashRoot)
+	if _, ok := err.(driver.PathNotFoundError); ok {
+		return 0, 0, nil
+	} else if err != nil {
+		return 0, 0, fmt.Errorf("unable to list the trash: %w", err)
+	}
+
+	var blobs int
+	var size int64
+	for _, algorithm := range algorithms {
+		dirs, err := t.driver.List(ctx, algorithm)
+		if _, ok := err.(driver.PathNotFoundError); ok {
+			continue
+		} else if err != nil {
+			return blobs, size, fmt.Errorf("unable to list the trash: %w", err)
+		}
+
+		for _, dir := range dirs {
+			expired, n, err := t.expired(ctx, dir)
+			if err != nil {
+				dcontext.GetLogger(ctx).Warnf("skipping %s in the trash: %v", dir, err)
+				continue
+			}
+			if !expired {
+				continue
+			}
+
+			dcontext.GetLogger(ctx).Infof("Deleting blob from the trash: %s", dir)
+			if err := t.driver.Delete(ctx, dir); err != nil {
+				if _, ok := err.(driver.PathNotFoundError); ok {
+					continue
+				}
+				return blobs, size, fmt.Errorf("unable to delete %s from the trash: %w", dir, err)
+			}
+			blobs++
+			size += n
+		}
+	}
+	return blobs, size, nil
+}
+
+// expired reports whether the blob in the trash directory dir is past the
+// retention period, and returns its size.
+func (t *Trash) expired(ctx context.Context, dir string) (bool, int64, error) {
+	content, err := t.driver.GetContent(ctx, path.Join(dir, trashDeletedAtFile))
+	if err != nil {
+		return false, 0, err
+	}
+	deletedAt, err := time.Parse(time.RFC3339, string(content))
+	if err != nil {
+		return false, 0, err
+	}
+	if t.now().Sub(deletedAt) < t.retention {
+		return false, 0, nil
+	}
+
+	var size int64
+	fi, err := t.driver.Stat(ctx, path.Join(dir, trashDataFile))
+	if err == nil {
+		size = fi.Size()
+	} else if _, ok := err.(driver.PathNotFoundError); !ok {
+		return false, 0, err
+	}
+	return true, size, nil
+}
@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+
+	"github.com/openshift/image-registry/pkg/testutil"
+)
+
+func TestTrash(t *testing.T) {
+	ctx := context.Background()
+	ctx = testutil.WithTestLogger(ctx, t)
+
+	driver := inmemory.New()
+	registry, err := storage.NewRegistry(ctx, driver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	named, err := reference.WithName("user/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo, err := registry.Repository(ctx, named)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc, err := repo.Blobs(ctx).Put(ctx, "application/octet-stream", []byte("layer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	statter := registry.BlobStatter()
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	trash := NewTrash(driver, 24*time.Hour)
+	trash.now = func() time.Time { return now }
+
+	if err := trash.Add(ctx, desc.Digest); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := statter.Stat(ctx, desc.Digest); err != distribution.ErrBlobUnknown {
+		t.Fatalf("expected the blob to be removed, got %v", err)
+	}
+	if err := trash.Add(ctx, desc.Digest); err != distribution.ErrBlobUnknown {
+		t.Fatalf("got error %v for a removed blob, want %v", err, distribution.ErrBlobUnknown)
+	}
+
+	if err := trash.Restore(ctx, desc.Digest); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := statter.Stat(ctx, desc.Digest); err != nil {
+		t.Fatalf("expected the blob to be restored, got %v", err)
+	}
+	if err := trash.Restore(ctx, desc.Digest); err != distribution.ErrBlobUnknown {
+		t.Fatalf("got error %v for a restored blob, want %v", err, distribution.ErrBlobUnknown)
+	}
+
+	if err := trash.Add(ctx, desc.Digest); err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(23 * time.Hour)
+	blobs, _, err := trash.Purge(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blobs != 0 {
+		t.Errorf("got %d purged blobs before the retention expired, want 0", blobs)
+	}
+
+	now = now.Add(time.Hour)
+	blobs, size, err := trash.Purge(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blobs != 1 || size != desc.Size {
+		t.Errorf("got %d purged blobs of %d bytes, want 1 of %d bytes", blobs, size, desc.Size)
+	}
+	if err := trash.Restore(ctx, desc.Digest); err != distribution.ErrBlobUnknown {
+		t.Fatalf("got error %v for a purged blob, want %v", err, distribution.ErrBlobUnknown)
+	}
+}
@@ -0,0 +1,256 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	storagedriver "github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	regstorage "github.com/openshift/image-registry/pkg/dockerregistry/server/storage"
+	rerrors "github.com/openshift/image-registry/pkg/errors"
+)
+
+var ErrorCodeStorageLimitExceeded = errcode.Register(errGroup, errcode.ErrorDescriptor{
+	Value:          "STORAGE_LIMIT_EXCEEDED",
+	Message:        "the blob would increase the storage used by the image stream %s to %s, which exceeds its limit of %s",
+	HTTPStatusCode: http.StatusForbidden,
+})
+
+// storageLimitedBlobStore rejects the layer links that would make the blobs
+// of the repository exceed the storage limit of its image stream.
+//
+// The usage is the size of the blobs referenced by the images of the image
+// stream and of the blobs that are linked to the repository but aren't
+// referenced by any image yet, like the layers of a push in progress.
+// Concurrent pushes into the same image stream may exceed the limit together.
+type storageLimitedBlobStore struct {
+	distribution.BlobStore
+
+	repo *repository
+}
+
+var _ distribution.BlobStore = &storageLimitedBlobStore{}
+
+// Create starts a regular upload instead of mounting a blob that would exceed
+// the limit, so that the client gets the error when the upload is committed.
+func (bs *storageLimitedBlobStore) Create(ctx context.Context, options ...distribution.BlobCreateOption) (distribution.BlobWriter, error) {
+	var opts distribution.CreateOptions
+	for _, option := range options {
+		// The options of other types are applied by the wrapped blob store.
+		_ = option.Apply(&opts)
+	}
+
+	if opts.Mount.ShouldMount {
+		dgst := opts.Mount.From.Digest()
+		size := int64(-1)
+		if opts.Mount.Stat != nil {
+			size = opts.Mount.Stat.Size
+		}
+		if err := admitBlobLink(ctx, bs.repo, dgst, size); err != nil {
+			dcontext.GetLogger(ctx).Infof("not mounting the blob %s from %s: %v", dgst, opts.Mount.From.Name(), err)
+			options = withoutMount(options)
+		}
+	}
+
+	bw, err := bs.BlobStore.Create(ctx, options...)
+	if err != nil {
+		return nil, err
+	}
+	return &storageLimitedBlobWriter{
+		BlobWriter: bw,
+		repo:       bs.repo,
+	}, nil
+}
+
+func (bs *storageLimitedBlobStore) Resume(ctx context.Context, id string) (distribution.BlobWriter, error) {
+	bw, err := bs.BlobStore.Resume(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return &storageLimitedBlobWriter{
+		BlobWriter: bw,
+		repo:       bs.repo,
+	}, nil
+}
+
+// withoutMount returns the blob creation options that don't mount a blob.
+func withoutMount(options []distribution.BlobCreateOption) []distribution.BlobCreateOption {
+	var result []distribution.BlobCreateOption
+	for _, option := range options {
+		var opts distribution.CreateOptions
+		if err := option.Apply(&opts); err == nil && opts.Mount.ShouldMount {
+			continue
+		}
+		result = append(result, option)
+	}
+	return result
+}
+
+// storageLimitedBlobWriter checks the storage limit before the upload is
+// linked to the repository.
+type storageLimitedBlobWriter struct {
+	distribution.BlobWriter
+
+	repo *repository
+}
+
+func (bw *storageLimitedBlobWriter) Commit(ctx context.Context, provisional distribution.Descriptor) (distribution.Descriptor, error) {
+	size := provisional.Size
+	if size == 0 {
+		size = bw.BlobWriter.Size()
+	}
+
+	if err := admitBlobLink(ctx, bw.repo, provisional.Digest, size); err != nil {
+		return distribution.Descriptor{}, err
+	}
+
+	return bw.BlobWriter.Commit(ctx, provisional)
+}
+
+// storageUsage keeps the storage limit of the image stream and the sizes of
+// the blobs of the repository, so that they are read once per request
+// instead of once per linked blob.
+type storageUsage struct {
+	mu     sync.Mutex
+	loaded bool
+	limit  int64
+	sizes  map[digest.Digest]int64
+}
+
+// loadLocked reads the limit and the sizes of the blobs unless they are
+// already loaded. The errors of the API are returned as rerrors.Error.
+func (u *storageUsage) loadLocked(ctx context.Context, repo *repository) error {
+	if u.loaded {
+		return nil
+	}
+
+	limit, rErr := repo.imageStream.StorageLimit(ctx)
+	if rErr != nil {
+		return rErr
+	}
+	var sizes map[digest.Digest]int64
+	if limit >= 0 {
+		var err error
+		sizes, err = linkedBlobSizes(ctx, repo)
+		if err != nil {
+			return err
+		}
+	}
+
+	u.loaded, u.limit, u.sizes = true, limit, sizes
+	return nil
+}
+
+// admitBlobLink returns ErrorCodeStorageLimitExceeded if linking the blob dgst
+// of size bytes would exceed the storage limit of the image stream. If size
+// is negative, it is read from the storage. The blob is admitted if the image
+// stream cannot be read, so that the uploads don't depend on the API. The
+// admitted blob is counted for the rest of the request.
+func admitBlobLink(ctx context.Context, repo *repository, dgst digest.Digest, size int64) error {
+	u := repo.storageUsage
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if err := u.loadLocked(ctx, repo); err != nil {
+		var rErr rerrors.Error
+		if !errors.As(err, &rErr) {
+			return err
+		}
+		dcontext.GetLogger(ctx).Warnf("unable to check the storage limit of the image stream %s, linking the blob %s: %v", repo.imageStream.Reference(), dgst, err)
+		return nil
+	}
+	limit, sizes := u.limit, u.sizes
+	if limit < 0 {
+		return nil
+	}
+
+	if _, ok := sizes[dgst]; ok {
+		// The blob is already accounted for.
+		return nil
+	}
+	if size < 0 {
+		var err error
+		size, err = storedBlobSize(ctx, repo.app.driver, dgst)
+		if err != nil {
+			return err
+		}
+	}
+
+	usage := size
+	for _, s := range sizes {
+		usage += s
+	}
+	if usage <= limit {
+		sizes[dgst] = size
+		return nil
+	}
+
+	usageQuantity := resource.NewQuantity(usage, resource.BinarySI)
+	limitQuantity := resource.NewQuantity(limit, resource.BinarySI)
+	dcontext.GetLogger(ctx).Errorf("refusing to link blob %s of %d bytes: the storage usage of the image stream %s would be %d bytes, which exceeds its limit of %d bytes", dgst, size, repo.imageStream.Reference(), usage, limit)
+	repo.pushRejectedEventf(ctx, "Push of a layer was rejected: the storage usage of the image stream would be %s, which exceeds its limit of %s", usageQuantity.String(), limitQuantity.String())
+	return ErrorCodeStorageLimitExceeded.WithArgs(repo.imageStream.Reference(), usageQuantity.String(), limitQuantity.String()).WithDetail(map[string]interface{}{
+		"blob":  dgst.String(),
+		"size":  size,
+		"usage": usage,
+		"limit": limit,
+	})
+}
+
+// linkedBlobSizes returns the sizes of the blobs referenced by the images of
+// the image stream and of the blobs that have layer links in the repository.
+func linkedBlobSizes(ctx context.Context, repo *repository) (map[digest.Digest]int64, error) {
+	layers, rErr := repo.imageStream.Layers(ctx)
+	if rErr != nil {
+		return nil, rErr
+	}
+
+	sizes := make(map[digest.Digest]int64)
+	for dgst, blob := range layers.Blobs {
+		if blob.LayerSize != nil {
+			sizes[digest.Digest(dgst)] = *blob.LayerSize
+		}
+	}
+
+	if repo.app.driver == nil {
+		return sizes, nil
+	}
+	linked, err := regstorage.LinkedLayers(ctx, repo.app.driver, repo.Named().Name())
+	if err != nil {
+		return nil, err
+	}
+	for _, dgst := range linked {
+		if _, ok := sizes[dgst]; ok {
+			continue
+		}
+		size, err := storedBlobSize(ctx, repo.app.driver, dgst)
+		if errors.As(err, &storagedriver.PathNotFoundError{}) {
+			// The link is left after the blob was deleted.
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		sizes[dgst] = size
+	}
+	return sizes, nil
+}
+
+// storedBlobSize returns the size of the data of the blob dgst in the storage.
+func storedBlobSize(ctx context.Context, d storagedriver.StorageDriver, dgst digest.Digest) (int64, error) {
+	if d == nil {
+		return 0, nil
+	}
+	fi, err := d.Stat(ctx, regstorage.BlobDataPath(dgst))
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
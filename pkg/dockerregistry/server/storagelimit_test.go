@@ -0,0 +1,216 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgotesting "k8s.io/client-go/testing"
+
+	imagefakeclient "github.com/openshift/client-go/image/clientset/versioned/typed/image/v1/fake"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+	"github.com/openshift/image-registry/pkg/imagestream"
+	"github.com/openshift/image-registry/pkg/testutil"
+)
+
+func pushBlob(ctx context.Context, bs distribution.BlobStore, content []byte) (distribution.Descriptor, error) {
+	bw, err := bs.Create(ctx)
+	if err != nil {
+		return distribution.Descriptor{}, err
+	}
+	if _, err := bw.Write(content); err != nil {
+		return distribution.Descriptor{}, err
+	}
+	return bw.Commit(ctx, distribution.Descriptor{Digest: digest.FromBytes(content), Size: int64(len(content))})
+}
+
+func TestStorageLimitedBlobStore(t *testing.T) {
+	ctx := context.Background()
+	ctx = testutil.WithTestLogger(ctx, t)
+
+	fos, imageClient := testutil.NewFakeOpenShiftWithClient(ctx)
+	image, err := testutil.CreateRandomImage("user", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	imageUsage := int64(0)
+	for i := range image.DockerImageLayers {
+		image.DockerImageLayers[i].LayerSize = 1000
+		imageUsage += image.DockerImageLayers[i].LayerSize
+	}
+	const headroom = 100
+	testutil.AddImageStream(t, fos, "user", "app", map[string]string{
+		imagestream.StorageLimitAnnotation: strconv.FormatInt(imageUsage+headroom, 10),
+	})
+	testutil.AddImage(t, fos, image, "user", "app", "latest")
+	testutil.AddImageStream(t, fos, "user", "unlimited", nil)
+
+	d := inmemory.New()
+	registry, err := storage.NewRegistry(ctx, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &App{driver: d}
+	blobStore := func(name string) distribution.BlobStore {
+		named, err := reference.WithName("user/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		repo, err := registry.Repository(ctx, named)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &storageLimitedBlobStore{
+			BlobStore: repo.Blobs(ctx),
+			repo: &repository{
+				Repository:  repo,
+				app:         app,
+				imageStream: imagestream.New(ctx, "user", name, client.NewFakeRegistryAPIClient(nil, imageClient)),
+
+				storageUsage: &storageUsage{},
+			},
+		}
+	}
+	expectLimitExceeded := func(err error) {
+		t.Helper()
+		var e errcode.Error
+		if !errors.As(err, &e) || e.Code != ErrorCodeStorageLimitExceeded {
+			t.Errorf("got error %v, want %v", err, ErrorCodeStorageLimitExceeded)
+		}
+	}
+
+	// The blobs of the images are already counted.
+	app1 := blobStore("app")
+	small := bytes.Repeat([]byte("s"), headroom/2)
+	if _, err := pushBlob(ctx, app1, small); err != nil {
+		t.Fatalf("unable to push the blob within the limit: %v", err)
+	}
+
+	// The layer link of the previous push is counted too, though no image
+	// references it yet.
+	large := bytes.Repeat([]byte("l"), headroom)
+	if _, err := pushBlob(ctx, app1, large); err == nil {
+		t.Fatalf("the blob exceeding the limit is pushed")
+	} else {
+		expectLimitExceeded(err)
+	}
+	if _, err := pushBlob(ctx, app1, small); err != nil {
+		t.Errorf("unable to push the blob that is already linked: %v", err)
+	}
+
+	unlimited := blobStore("unlimited")
+	desc, err := pushBlob(ctx, unlimited, large)
+	if err != nil {
+		t.Fatalf("unable to push the blob into the image stream without a limit: %v", err)
+	}
+	smallDesc, err := pushBlob(ctx, unlimited, small[:headroom/4])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The mount that would exceed the limit starts an upload instead.
+	mount := func(desc distribution.Descriptor) (distribution.BlobWriter, error) {
+		named, err := reference.WithName("user/unlimited")
+		if err != nil {
+			t.Fatal(err)
+		}
+		canonical, err := reference.WithDigest(named, desc.Digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return app1.Create(ctx, storage.WithMountFrom(canonical))
+	}
+	bw, err := mount(desc)
+	if err != nil {
+		t.Fatalf("got error %v, want a regular upload", err)
+	}
+	if _, err := bw.Write(large); err != nil {
+		t.Fatal(err)
+	}
+	_, err = bw.Commit(ctx, desc)
+	expectLimitExceeded(err)
+
+	_, err = mount(smallDesc)
+	if _, ok := err.(distribution.ErrBlobMounted); !ok {
+		t.Errorf("got error %v, want the blob within the limit to be mounted", err)
+	}
+}
+
+func TestStorageLimitedBlobStoreUnavailableAPI(t *testing.T) {
+	ctx := context.Background()
+	ctx = testutil.WithTestLogger(ctx, t)
+
+	imageClient := &imagefakeclient.FakeImageV1{Fake: &clientgotesting.Fake{}}
+	imageClient.AddReactor("get", "imagestreams", func(action clientgotesting.Action) (bool, runtime.Object, error) {
+		return true, nil, kerrors.NewServiceUnavailable("the server is restarting")
+	})
+
+	d := inmemory.New()
+	registry, err := storage.NewRegistry(ctx, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	named, err := reference.WithName("user/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo, err := registry.Repository(ctx, named)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := &storageLimitedBlobStore{
+		BlobStore: repo.Blobs(ctx),
+		repo: &repository{
+			Repository:  repo,
+			app:         &App{driver: d},
+			imageStream: imagestream.New(ctx, "user", "app", client.NewFakeRegistryAPIClient(nil, imageClient)),
+
+			storageUsage: &storageUsage{},
+		},
+	}
+
+	// The limit cannot be checked, so the upload isn't rejected.
+	if _, err := pushBlob(ctx, bs, []byte("pushed while the API is unavailable")); err != nil {
+		t.Errorf("unable to push the blob while the API is unavailable: %v", err)
+	}
+	if n := len(imageClient.Actions()); n == 0 {
+		t.Errorf("expected the image stream to be read")
+	}
+}
+
+func TestStorageLimitedBlobStoreInvalidLimit(t *testing.T) {
+	ctx := context.Background()
+	ctx = testutil.WithTestLogger(ctx, t)
+
+	fos, imageClient := testutil.NewFakeOpenShiftWithClient(ctx)
+	testutil.AddImageStream(t, fos, "user", "app", map[string]string{
+		imagestream.StorageLimitAnnotation: "1Gi",
+	})
+
+	limit, err := imagestream.New(ctx, "user", "app", client.NewFakeRegistryAPIClient(nil, imageClient)).StorageLimit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limit != -1 {
+		t.Errorf("got the limit %d for the invalid annotation, want none", limit)
+	}
+
+	limit, err = imagestream.New(ctx, "user", "missing", client.NewFakeRegistryAPIClient(nil, imageClient)).StorageLimit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limit != -1 {
+		t.Errorf("got the limit %d for the missing image stream, want none", limit)
+	}
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/opencontainers/go-digest"
+	kubecache "k8s.io/apimachinery/pkg/util/cache"
+
+	registryconfig "github.com/openshift/image-registry/pkg/dockerregistry/server/configuration"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/metrics"
+)
+
+const (
+	// previousDigestHeader is the digest that was served for the tag before
+	// the tag was moved to the digest of the response.
+	previousDigestHeader = "X-OpenShift-Previous-Digest"
+
+	// tagDigestsSize is the maximum number of remembered tags.
+	tagDigestsSize = 16384
+
+	// tagDigestsTTL is how long the digest served for a tag is remembered
+	// after the last pull of the tag.
+	tagDigestsTTL = 24 * time.Hour
+)
+
+// tagDigests remembers the digests that were served for the pulled tags and
+// reports the tags that are pulled with another digest. Each replica of the
+// registry has its own memory.
+type tagDigests struct {
+	digests *kubecache.LRUExpireCache
+	header  bool
+	metrics metrics.TagDigests
+}
+
+// newTagDigests returns the tracker of the tag digests configured by cfg. It
+// returns nil if the tracking is disabled.
+func newTagDigests(cfg *registryconfig.Cache, m metrics.TagDigests) *tagDigests {
+	if cfg == nil || !cfg.TagDigests.Enabled {
+		return nil
+	}
+	return &tagDigests{
+		digests: kubecache.NewLRUExpireCache(tagDigestsSize),
+		header:  cfg.TagDigests.PreviousDigestHeader,
+		metrics: m,
+	}
+}
+
+// served records that the tag of the repository is pulled with dgst. If the
+// tag was pulled with another digest before, the change is logged and, if
+// configured, the previous digest is sent to the client.
+func (t *tagDigests) served(ctx context.Context, repo, tag string, dgst digest.Digest) {
+	req, err := dcontext.GetRequest(ctx)
+	if err != nil || (req.Method != http.MethodGet && req.Method != http.MethodHead) {
+		return
+	}
+
+	key := repo + ":" + tag
+	prev, ok := t.digests.Get(key)
+	t.digests.Add(key, dgst, tagDigestsTTL)
+	if !ok || prev.(digest.Digest) == dgst {
+		return
+	}
+
+	t.metrics.Changed()
+	dcontext.GetLogger(ctx).Warnf("the tag %s resolves to %s, but it was pulled as %s before", key, dgst, prev)
+
+	if !t.header {
+		return
+	}
+	w, err := dcontext.GetResponseWriter(ctx)
+	if err != nil {
+		return
+	}
+	w.Header().Set(previousDigestHeader, prev.(digest.Digest).String())
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+
+	registryclient "github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+	registryconfig "github.com/openshift/image-registry/pkg/dockerregistry/server/configuration"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/metrics"
+	metricstesting "github.com/openshift/image-registry/pkg/dockerregistry/server/metrics/testing"
+	"github.com/openshift/image-registry/pkg/imagestream"
+	"github.com/openshift/image-registry/pkg/testutil"
+	"github.com/openshift/image-registry/pkg/testutil/counter"
+)
+
+func TestTagGetDigestChanges(t *testing.T) {
+	namespace := "user"
+	repo := "app"
+	tag := "latest"
+
+	ctx := testutil.WithTestLogger(context.Background(), t)
+
+	fos, imageClient := testutil.NewFakeOpenShiftWithClient(ctx)
+	first := testutil.AddRandomImage(t, fos, namespace, repo, tag)
+
+	c, sink := metricstesting.NewCounterSink()
+	td := newTagDigests(&registryconfig.Cache{
+		TagDigests: registryconfig.CacheTagDigests{
+			Enabled:              true,
+			PreviousDigestHeader: true,
+		},
+	}, metrics.NewMetrics(sink).TagDigests())
+
+	get := func(method string) http.Header {
+		t.Helper()
+		ts := &tagService{
+			TagService:  newTestTagService(nil),
+			imageStream: imagestream.New(ctx, namespace, repo, registryclient.NewFakeRegistryAPIClient(nil, imageClient)),
+			tagDigests:  td,
+		}
+
+		reqCtx := dcontext.WithRequest(ctx, httptest.NewRequest(method, "/v2/user/app/manifests/latest", nil))
+		reqCtx, w := dcontext.WithResponseWriter(reqCtx, httptest.NewRecorder())
+		if _, err := ts.Get(reqCtx, tag); err != nil {
+			t.Fatal(err)
+		}
+		return w.Header()
+	}
+
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		if h := get(method).Get(previousDigestHeader); h != "" {
+			t.Errorf("%s: unexpected %s header %q before the tag is moved", method, previousDigestHeader, h)
+		}
+	}
+
+	// Move the tag to another image.
+	fos, imageClient = testutil.NewFakeOpenShiftWithClient(ctx)
+	testutil.AddRandomImage(t, fos, namespace, repo, tag)
+
+	// Pushes don't update the remembered digest.
+	get(http.MethodPut)
+
+	if h := get(http.MethodGet).Get(previousDigestHeader); h != first.Name {
+		t.Errorf("got %s header %q, want %q", previousDigestHeader, h, first.Name)
+	}
+	if h := get(http.MethodGet).Get(previousDigestHeader); h != "" {
+		t.Errorf("unexpected %s header %q for the same digest", previousDigestHeader, h)
+	}
+
+	if diff := c.Diff(counter.M{
+		"tag_digest_changes": 1,
+	}); diff != nil {
+		t.Error(diff)
+	}
+}
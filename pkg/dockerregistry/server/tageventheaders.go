@@ -0,0 +1,57 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+
+	"github.com/openshift/image-registry/pkg/imagestream"
+)
+
+const (
+	// tagGenerationHeader is the generation of the image stream at which the
+	// pulled tag was set to the image.
+	tagGenerationHeader = "X-OpenShift-Tag-Generation"
+
+	// tagCreatedHeader is the time when the pulled tag was set to the image.
+	tagCreatedHeader = "X-OpenShift-Tag-Created"
+
+	// tagSourceHeader is the reference of the image that the pulled tag was
+	// set to, e.g. the upstream image it was imported from.
+	tagSourceHeader = "X-OpenShift-Tag-Source"
+)
+
+// setTagEventHeaders sets the headers that describe the current event of the
+// tag on responses to manifest requests by tag, so that clients can verify
+// the lineage of the pulled image without asking the API server.
+func setTagEventHeaders(ctx context.Context, is imagestream.ImageStream, tag string) {
+	req, err := dcontext.GetRequest(ctx)
+	if err != nil || (req.Method != http.MethodGet && req.Method != http.MethodHead) {
+		return
+	}
+
+	w, err := dcontext.GetResponseWriter(ctx)
+	if err != nil {
+		return
+	}
+
+	event, rErr := is.LatestTagEvent(ctx, tag)
+	if rErr != nil {
+		dcontext.GetLogger(ctx).Errorf("unable to get the event of the tag %s:%s: %v", is.Reference(), tag, rErr)
+		return
+	}
+	if event == nil {
+		return
+	}
+
+	w.Header().Set(tagGenerationHeader, strconv.FormatInt(event.Generation, 10))
+	if !event.Created.IsZero() {
+		w.Header().Set(tagCreatedHeader, event.Created.UTC().Format(time.RFC3339))
+	}
+	if len(event.DockerImageReference) > 0 {
+		w.Header().Set(tagSourceHeader, event.DockerImageReference)
+	}
+}
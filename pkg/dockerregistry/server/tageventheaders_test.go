@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	core "k8s.io/client-go/testing"
+
+	imageapiv1 "github.com/openshift/api/image/v1"
+	imagefakeclient "github.com/openshift/client-go/image/clientset/versioned/typed/image/v1/fake"
+
+	registryclient "github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+	"github.com/openshift/image-registry/pkg/imagestream"
+	"github.com/openshift/image-registry/pkg/testutil"
+)
+
+func TestTagGetTagEventHeaders(t *testing.T) {
+	ctx := testutil.WithTestLogger(context.Background(), t)
+
+	const dgst = "sha256:0000000000000000000000000000000000000000000000000000000000000001"
+	created := time.Date(2024, time.March, 1, 12, 30, 0, 0, time.UTC)
+	stream := &imageapiv1.ImageStream{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "user", Name: "app"},
+		Status: imageapiv1.ImageStreamStatus{
+			Tags: []imageapiv1.NamedTagEventList{
+				{
+					Tag: "latest",
+					Items: []imageapiv1.TagEvent{
+						{
+							Created:              metav1.NewTime(created),
+							DockerImageReference: "quay.io/org/app@" + dgst,
+							Image:                dgst,
+							Generation:           7,
+						},
+						{
+							Created:              metav1.NewTime(created.Add(-time.Hour)),
+							DockerImageReference: "quay.io/org/app@sha256:0000000000000000000000000000000000000000000000000000000000000000",
+							Image:                "sha256:0000000000000000000000000000000000000000000000000000000000000000",
+							Generation:           3,
+						},
+					},
+				},
+			},
+		},
+	}
+	imageClient := &imagefakeclient.FakeImageV1{Fake: &core.Fake{}}
+	imageClient.AddReactor("get", "imagestreams", func(action core.Action) (bool, runtime.Object, error) {
+		return true, stream.DeepCopy(), nil
+	})
+
+	get := func(method string) http.Header {
+		t.Helper()
+		ts := &tagService{
+			TagService:  newTestTagService(nil),
+			imageStream: imagestream.New(ctx, "user", "app", registryclient.NewFakeRegistryAPIClient(nil, imageClient)),
+		}
+
+		reqCtx := dcontext.WithRequest(ctx, httptest.NewRequest(method, "/v2/user/app/manifests/latest", nil))
+		reqCtx, w := dcontext.WithResponseWriter(reqCtx, httptest.NewRecorder())
+		desc, err := ts.Get(reqCtx, "latest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if desc.Digest != dgst {
+			t.Fatalf("got digest %s, want %s", desc.Digest, dgst)
+		}
+		return w.Header()
+	}
+
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		header := get(method)
+		if got, expected := header.Get(tagGenerationHeader), "7"; got != expected {
+			t.Errorf("%s: got %s %q, want %q", method, tagGenerationHeader, got, expected)
+		}
+		if got, expected := header.Get(tagCreatedHeader), "2024-03-01T12:30:00Z"; got != expected {
+			t.Errorf("%s: got %s %q, want %q", method, tagCreatedHeader, got, expected)
+		}
+		if got, expected := header.Get(tagSourceHeader), "quay.io/org/app@"+dgst; got != expected {
+			t.Errorf("%s: got %s %q, want %q", method, tagSourceHeader, got, expected)
+		}
+	}
+
+	if header := get(http.MethodPut); len(header.Get(tagGenerationHeader)) != 0 {
+		t.Errorf("unexpected %s header for a push", tagGenerationHeader)
+	}
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"time"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	kubecache "k8s.io/apimachinery/pkg/util/cache"
+
+	rerrors "github.com/openshift/image-registry/pkg/errors"
+	"github.com/openshift/image-registry/pkg/imagestream"
+)
+
+const (
+	// tagIndexSize is the maximum number of repositories whose sorted tags
+	// are remembered.
+	tagIndexSize = 1024
+
+	// tagIndexTTL is how long the sorted tags of a repository are
+	// remembered after they were last listed.
+	tagIndexTTL = 30 * time.Minute
+)
+
+// tagIndexEntry is the sorted list of the tags of an image stream at a
+// resource version.
+type tagIndexEntry struct {
+	resourceVersion string
+	tags            []string
+}
+
+// tagIndex remembers the sorted tags of the listed image streams, so that
+// the tags of large image streams aren't collected and sorted again for
+// every page of the tag list. An entry is used only if the resource version
+// of the image stream hasn't changed, i.e. any update of the image stream
+// invalidates it.
+type tagIndex struct {
+	entries *kubecache.LRUExpireCache
+}
+
+func newTagIndex() *tagIndex {
+	return &tagIndex{
+		entries: kubecache.NewLRUExpireCache(tagIndexSize),
+	}
+}
+
+// sortedTags returns the lexicographically sorted tags of is. The returned
+// slice is shared and must not be modified. is must have been fetched
+// already, so that its resource version is known.
+func (i *tagIndex) sortedTags(ctx context.Context, is imagestream.ImageStream) ([]string, rerrors.Error) {
+	_, resourceVersion, ok := is.Generation()
+	if i != nil && ok && len(resourceVersion) > 0 {
+		if entry, found := i.entries.Get(is.Reference()); found && entry.(*tagIndexEntry).resourceVersion == resourceVersion {
+			return entry.(*tagIndexEntry).tags, nil
+		}
+	}
+
+	tags, err := is.Tags(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tagList := make([]string, 0, len(tags))
+	for tag := range tags {
+		tagList = append(tagList, tag)
+	}
+	sort.Strings(tagList)
+
+	if i != nil && ok && len(resourceVersion) > 0 {
+		i.entries.Add(is.Reference(), &tagIndexEntry{
+			resourceVersion: resourceVersion,
+			tags:            tagList,
+		}, tagIndexTTL)
+	}
+
+	return tagList, nil
+}
+
+// forget removes the sorted tags of the repository.
+func (i *tagIndex) forget(repo string) {
+	if i == nil {
+		return
+	}
+	i.entries.Remove(repo)
+}
+
+// withPaginationMarker returns tags with the last tag of the previous page
+// inserted if it has been removed from the image stream since the page was
+// served. The tag list handler skips the tags up to and including the
+// marker, so without it the tag following the removed one would be skipped
+// as well.
+func withPaginationMarker(ctx context.Context, tags []string) []string {
+	req, err := dcontext.GetRequest(ctx)
+	if err != nil || req.Method != http.MethodGet {
+		return tags
+	}
+	last := req.URL.Query().Get("last")
+	if len(last) == 0 {
+		return tags
+	}
+
+	idx := sort.SearchStrings(tags, last)
+	if idx < len(tags) && tags[idx] == last {
+		return tags
+	}
+
+	marked := make([]string, 0, len(tags)+1)
+	marked = append(marked, tags[:idx]...)
+	marked = append(marked, last)
+	return append(marked, tags[idx:]...)
+}
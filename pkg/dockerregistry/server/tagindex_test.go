@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/opencontainers/go-digest"
+
+	rerrors "github.com/openshift/image-registry/pkg/errors"
+	"github.com/openshift/image-registry/pkg/imagestream"
+)
+
+// versionedImageStream is an image stream with the given tags at a resource
+// version.
+type versionedImageStream struct {
+	imagestream.ImageStream
+
+	resourceVersion string
+	tags            map[string]digest.Digest
+	tagsCalls       int
+}
+
+func (is *versionedImageStream) Reference() string {
+	return "user/app"
+}
+
+func (is *versionedImageStream) Generation() (int64, string, bool) {
+	return 1, is.resourceVersion, true
+}
+
+func (is *versionedImageStream) Tags(ctx context.Context) (map[string]digest.Digest, rerrors.Error) {
+	is.tagsCalls++
+	return is.tags, nil
+}
+
+func TestTagIndex(t *testing.T) {
+	ctx := context.Background()
+	index := newTagIndex()
+
+	is := &versionedImageStream{
+		resourceVersion: "1",
+		tags: map[string]digest.Digest{
+			"v2":     "sha256:2",
+			"latest": "sha256:3",
+			"v1":     "sha256:1",
+		},
+	}
+
+	expected := []string{"latest", "v1", "v2"}
+	for i := 0; i < 2; i++ {
+		tags, err := index.sortedTags(ctx, is)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(tags, expected) {
+			t.Fatalf("got %v, want %v", tags, expected)
+		}
+	}
+	if is.tagsCalls != 1 {
+		t.Errorf("got %d calls to collect the tags of the image stream, want 1", is.tagsCalls)
+	}
+
+	// An update of the image stream invalidates the index.
+	is.resourceVersion = "2"
+	is.tags["v3"] = "sha256:4"
+	tags, err := index.sortedTags(ctx, is)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"latest", "v1", "v2", "v3"}; !reflect.DeepEqual(tags, expected) {
+		t.Errorf("got %v after the update, want %v", tags, expected)
+	}
+
+	index.forget(is.Reference())
+	if _, err := index.sortedTags(ctx, is); err != nil {
+		t.Fatal(err)
+	}
+	if is.tagsCalls != 3 {
+		t.Errorf("got %d calls to collect the tags of the image stream, want 3", is.tagsCalls)
+	}
+}
+
+func TestWithPaginationMarker(t *testing.T) {
+	tags := []string{"a", "c", "d"}
+
+	for _, tc := range []struct {
+		url      string
+		expected []string
+	}{
+		{url: "/v2/user/app/tags/list", expected: []string{"a", "c", "d"}},
+		{url: "/v2/user/app/tags/list?n=1&last=c", expected: []string{"a", "c", "d"}},
+		{url: "/v2/user/app/tags/list?n=1&last=b", expected: []string{"a", "b", "c", "d"}},
+		{url: "/v2/user/app/tags/list?n=1&last=e", expected: []string{"a", "c", "d", "e"}},
+	} {
+		ctx := dcontext.WithRequest(context.Background(), httptest.NewRequest("GET", tc.url, nil))
+		if got := withPaginationMarker(ctx, tags); !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("%s: got %v, want %v", tc.url, got, tc.expected)
+		}
+	}
+	if expected := []string{"a", "c", "d"}; !reflect.DeepEqual(tags, expected) {
+		t.Errorf("the shared tags were modified: %v", tags)
+	}
+}
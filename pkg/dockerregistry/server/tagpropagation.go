@@ -0,0 +1,227 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/configuration"
+)
+
+const (
+	// tagPropagationSignatureHeader is the header with the HMAC-SHA256 of the
+	// body of a notification as sha256=<hex>.
+	tagPropagationSignatureHeader = "X-OpenShift-Signature"
+
+	// tagPropagationQueueSize is the number of notifications that can wait
+	// for a peer. Newer notifications are dropped when the queue is full.
+	tagPropagationQueueSize = 256
+
+	// tagPropagationAttempts is the number of attempts to deliver a
+	// notification to a peer.
+	tagPropagationAttempts = 3
+
+	// tagPropagationTimeout limits the duration of a single attempt.
+	tagPropagationTimeout = 10 * time.Second
+)
+
+// tagPropagationEvent is the body of the notifications about pushed tags.
+type tagPropagationEvent struct {
+	Namespace   string        `json:"namespace"`
+	ImageStream string        `json:"imageStream"`
+	Tag         string        `json:"tag"`
+	Digest      digest.Digest `json:"digest"`
+	// DockerImageReference is the pull spec of the image in this registry.
+	DockerImageReference string    `json:"dockerImageReference"`
+	Time                 time.Time `json:"time"`
+}
+
+// tagPropagationPeer is a receiver of the notifications.
+type tagPropagationPeer struct {
+	url    string
+	secret []byte
+	queue  chan []byte
+}
+
+// tagPropagator notifies peer registries or clusters about the tags that are
+// pushed to this registry, so that they can import the images. The
+// notifications are delivered in the background, a push doesn't wait for the
+// peers.
+type tagPropagator struct {
+	registryAddr string
+	client       *http.Client
+	peers        []*tagPropagationPeer
+
+	// initialBackoff is the delay before the first retry, it is doubled
+	// after each retry.
+	initialBackoff time.Duration
+	now            func() time.Time
+}
+
+// newTagPropagator returns nil if there are no peers.
+func newTagPropagator(cfg *configuration.TagPropagation, registryAddr string) (*tagPropagator, error) {
+	if cfg == nil || len(cfg.Peers) == 0 {
+		return nil, nil
+	}
+
+	tp := &tagPropagator{
+		registryAddr:   registryAddr,
+		client:         &http.Client{Timeout: tagPropagationTimeout},
+		initialBackoff: time.Second,
+		now:            time.Now,
+	}
+	for _, peer := range cfg.Peers {
+		secret, err := os.ReadFile(peer.SecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the secret of the tag propagation peer %s: %v", peer.URL, err)
+		}
+		secret = bytes.TrimSpace(secret)
+		if len(secret) == 0 {
+			return nil, fmt.Errorf("the secret of the tag propagation peer %s is empty", peer.URL)
+		}
+		tp.peers = append(tp.peers, &tagPropagationPeer{
+			url:    peer.URL,
+			secret: secret,
+			queue:  make(chan []byte, tagPropagationQueueSize),
+		})
+	}
+	return tp, nil
+}
+
+// run delivers the notifications to the peers until ctx is done.
+func (tp *tagPropagator) run(ctx context.Context) {
+	for _, peer := range tp.peers {
+		go tp.deliver(ctx, peer)
+	}
+}
+
+// tagPushed queues the notifications about the tag of the image stream
+// <namespace>/<name> that now refers to dgst.
+func (tp *tagPropagator) tagPushed(ctx context.Context, ref string, tag string, dgst digest.Digest) {
+	namespace, name, _ := strings.Cut(ref, "/")
+	body, err := json.Marshal(tagPropagationEvent{
+		Namespace:            namespace,
+		ImageStream:          name,
+		Tag:                  tag,
+		Digest:               dgst,
+		DockerImageReference: fmt.Sprintf("%s/%s@%s", tp.registryAddr, ref, dgst),
+		Time:                 tp.now().UTC(),
+	})
+	if err != nil {
+		dcontext.GetLogger(ctx).Errorf("unable to encode the tag propagation event for %s:%s: %v", ref, tag, err)
+		return
+	}
+
+	for _, peer := range tp.peers {
+		select {
+		case peer.queue <- body:
+		default:
+			dcontext.GetLogger(ctx).Warnf("the tag propagation queue of %s is full, %s:%s is not propagated", peer.url, ref, tag)
+		}
+	}
+}
+
+// deliver sends the queued notifications to peer one by one, so that the
+// peer receives them in the order of the pushes.
+func (tp *tagPropagator) deliver(ctx context.Context, peer *tagPropagationPeer) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case body := <-peer.queue:
+			if err := tp.send(ctx, peer, body); err != nil {
+				dcontext.GetLogger(ctx).Errorf("unable to propagate the tag to %s: %v", peer.url, err)
+			}
+		}
+	}
+}
+
+// send posts body to peer, retrying the failed attempts with an exponential
+// backoff.
+func (tp *tagPropagator) send(ctx context.Context, peer *tagPropagationPeer, body []byte) error {
+	backoff := tp.initialBackoff
+	var err error
+	for attempt := 1; attempt <= tagPropagationAttempts; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+
+		err = tp.post(ctx, peer, body)
+		if err == nil {
+			return nil
+		}
+		dcontext.GetLogger(ctx).Warnf("attempt %d to propagate the tag to %s failed: %v", attempt, peer.url, err)
+	}
+	return err
+}
+
+func (tp *tagPropagator) post(ctx context.Context, peer *tagPropagationPeer, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, peer.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(tagPropagationSignatureHeader, signTagPropagationEvent(peer.secret, body))
+
+	resp, err := tp.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// signTagPropagationEvent returns the value of the signature header for
+// body. The receivers compute the same value with their copy of the secret.
+func signTagPropagationEvent(secret []byte, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	_, _ = mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// tagPropagatingManifestService notifies the peers about the manifests that
+// are pushed by tag.
+type tagPropagatingManifestService struct {
+	distribution.ManifestService
+
+	ref        string
+	propagator *tagPropagator
+}
+
+var _ distribution.ManifestService = &tagPropagatingManifestService{}
+
+func (m *tagPropagatingManifestService) Put(ctx context.Context, manifest distribution.Manifest, options ...distribution.ManifestServiceOption) (digest.Digest, error) {
+	dgst, err := m.ManifestService.Put(ctx, manifest, options...)
+	if err != nil || dryRun(ctx) {
+		return dgst, err
+	}
+
+	for _, option := range options {
+		if opt, ok := option.(distribution.WithTagOption); ok {
+			m.propagator.tagPushed(ctx, m.ref, opt.Tag, dgst)
+			break
+		}
+	}
+	return dgst, nil
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/configuration"
+	"github.com/openshift/image-registry/pkg/testutil"
+)
+
+func TestTagPropagation(t *testing.T) {
+	ctx, cancel := context.WithCancel(testutil.WithTestLogger(context.Background(), t))
+	defer cancel()
+
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secretFile, []byte("s3cr3t\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	type delivery struct {
+		signature string
+		event     tagPropagationEvent
+	}
+	deliveries := make(chan delivery, 10)
+	failures := 1
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("unable to read the body: %v", err)
+			return
+		}
+		var event tagPropagationEvent
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Errorf("unable to decode the body: %v", err)
+		}
+		if expected := signTagPropagationEvent([]byte("s3cr3t"), body); r.Header.Get(tagPropagationSignatureHeader) != expected {
+			t.Errorf("unexpected signature %q, want %q", r.Header.Get(tagPropagationSignatureHeader), expected)
+		}
+		deliveries <- delivery{signature: r.Header.Get(tagPropagationSignatureHeader), event: event}
+	}))
+	defer ts.Close()
+
+	tp, err := newTagPropagator(&configuration.TagPropagation{
+		Peers: []configuration.TagPropagationPeer{
+			{URL: ts.URL, SecretFile: secretFile},
+		},
+	}, "registry.hub.example.com:5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tp.initialBackoff = 0
+	now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	tp.now = func() time.Time { return now }
+	tp.run(ctx)
+
+	manifest, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned: ocischema.SchemaVersion,
+		Config: distribution.Descriptor{
+			MediaType: "application/vnd.oci.image.config.v1+json",
+			Digest:    "sha256:0000000000000000000000000000000000000000000000000000000000000002",
+			Size:      2,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ms := &tagPropagatingManifestService{
+		ManifestService: &storingManifestService{},
+		ref:             "foo/bar",
+		propagator:      tp,
+	}
+
+	// Pushes by digest don't change tags.
+	if _, err := ms.Put(ctx, manifest); err != nil {
+		t.Fatal(err)
+	}
+	dgst, err := ms.Put(ctx, manifest, distribution.WithTagOption{Tag: "latest"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var d delivery
+	select {
+	case d = <-deliveries:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout while waiting for the notification")
+	}
+
+	expected := tagPropagationEvent{
+		Namespace:            "foo",
+		ImageStream:          "bar",
+		Tag:                  "latest",
+		Digest:               dgst,
+		DockerImageReference: "registry.hub.example.com:5000/foo/bar@" + dgst.String(),
+		Time:                 now,
+	}
+	if d.event != expected {
+		t.Errorf("unexpected event: %#+v, want %#+v", d.event, expected)
+	}
+
+	select {
+	case d := <-deliveries:
+		t.Errorf("unexpected notification: %#+v", d)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestTagPropagationQueueFull(t *testing.T) {
+	ctx := testutil.WithTestLogger(context.Background(), t)
+
+	peer := &tagPropagationPeer{
+		url:   "http://localhost/",
+		queue: make(chan []byte, 1),
+	}
+	tp := &tagPropagator{
+		peers: []*tagPropagationPeer{peer},
+		now:   time.Now,
+	}
+
+	// The notifications are dropped without blocking the pushes.
+	dgst := digest.FromString("image")
+	tp.tagPushed(ctx, "foo/bar", "v1", dgst)
+	tp.tagPushed(ctx, "foo/bar", "v2", dgst)
+
+	if len(peer.queue) != 1 {
+		t.Fatalf("expected 1 queued notification, got %d", len(peer.queue))
+	}
+	var event tagPropagationEvent
+	if err := json.Unmarshal(<-peer.queue, &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Tag != "v1" {
+		t.Errorf("expected the first notification to be kept, got %#+v", event)
+	}
+}
+
+func TestNewTagPropagatorWithoutPeers(t *testing.T) {
+	tp, err := newTagPropagator(&configuration.TagPropagation{}, "registry:5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tp != nil {
+		t.Fatalf("expected no propagator, got %#+v", tp)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/registry/api/v2"
 
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/policy"
 	"github.com/openshift/image-registry/pkg/imagestream"
 )
 
@@ -13,6 +14,17 @@ type tagService struct {
 	distribution.TagService
 
 	imageStream imagestream.ImageStream
+
+	// tagDigests reports the tags that are pulled with another digest. It
+	// is nil if the tracking is disabled.
+	tagDigests *tagDigests
+
+	// tagIndex remembers the sorted tags of the image streams. If it is nil,
+	// the tags are sorted for every request.
+	tagIndex *tagIndex
+
+	// policyHooks can reject the deletions of tags.
+	policyHooks policy.Hooks
 }
 
 func (t tagService) Get(ctx context.Context, tag string) (distribution.Descriptor, error) {
@@ -35,6 +47,11 @@ func (t tagService) Get(ctx context.Context, tag string) (distribution.Descripto
 		return distribution.Descriptor{}, distribution.ErrTagUnknown{Tag: tag}
 	}
 
+	if t.tagDigests != nil {
+		t.tagDigests.served(ctx, t.imageStream.Reference(), tag, dgst)
+	}
+	setTagEventHeaders(ctx, t.imageStream, tag)
+
 	return distribution.Descriptor{Digest: dgst}, nil
 }
 
@@ -47,17 +64,15 @@ func (t tagService) All(ctx context.Context) ([]string, error) {
 		return nil, distribution.ErrRepositoryUnknown{Name: t.imageStream.Reference()}
 	}
 
-	tags, err := t.imageStream.Tags(ctx)
+	// The tag list handler paginates the tags assuming they are sorted.
+	tags, err := t.tagIndex.sortedTags(ctx, t.imageStream)
 	if err != nil {
 		return nil, err
 	}
 
-	tagList := []string{}
-	for tag := range tags {
-		tagList = append(tagList, tag)
-	}
+	setImageStreamGenerationHeader(ctx, t.imageStream)
 
-	return tagList, nil
+	return withPaginationMarker(ctx, tags), nil
 }
 
 func (t tagService) Lookup(ctx context.Context, desc distribution.Descriptor) ([]string, error) {
@@ -91,5 +106,5 @@ func (t tagService) Tag(ctx context.Context, tag string, desc distribution.Descr
 }
 
 func (t tagService) Untag(ctx context.Context, tag string) error {
-	return nil
+	return t.policyHooks.Untag(ctx, t.imageStream.Reference(), tag)
 }
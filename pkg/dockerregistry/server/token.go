@@ -5,6 +5,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
 	dcontext "github.com/distribution/distribution/v3/context"
 	"github.com/openshift/image-registry/pkg/dockerregistry/server/auth"
@@ -15,16 +17,24 @@ import (
 )
 
 type tokenHandler struct {
-	ctx    context.Context
-	client client.RegistryClient
+	ctx           context.Context
+	client        client.RegistryClient
+	refreshTokens *refreshTokens
 }
 
-// NewTokenHandler returns a handler that implements the docker token protocol
-func NewTokenHandler(ctx context.Context, client client.RegistryClient) http.Handler {
-	return &tokenHandler{
-		ctx:    ctx,
-		client: client,
+// NewTokenHandler returns a handler that implements the docker token protocol.
+// The refresh tokens it issues are encrypted with a key derived from secret
+// and are valid for at most refreshTokenLifetime.
+func NewTokenHandler(ctx context.Context, client client.RegistryClient, secret string, refreshTokenLifetime time.Duration) (http.Handler, error) {
+	refreshTokens, err := newRefreshTokens(secret, refreshTokenLifetime)
+	if err != nil {
+		return nil, fmt.Errorf("unable to set up refresh tokens: %w", err)
 	}
+	return &tokenHandler{
+		ctx:           ctx,
+		client:        client,
+		refreshTokens: refreshTokens,
+	}, nil
 }
 
 // bearer token issued to token requests that present no credentials
@@ -34,26 +44,20 @@ const anonymousToken = "anonymous"
 func (t *tokenHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	ctx := dcontext.WithRequest(t.ctx, req)
 
+	if req.Method == http.MethodPost {
+		t.serveOAuth2(ctx, w, req)
+		return
+	}
+
 	params := req.URL.Query()
-	if len(params.Get("scope")) > 0 {
-		accessRecords := auth.ResolveScopeSpecifiers(ctx, params["scope"])
-		for _, access := range accessRecords {
-			switch access.Resource.Type {
-			case "repository", "signature":
-				_, _, err := getNamespaceName(access.Resource.Name)
-				if err != nil {
-					dcontext.GetRequestLogger(ctx).Errorf("auth token request for unsupported resource name: %s", access.Resource.Name)
-					t.writeError(w, req, err.Error())
-					return
-				}
-			}
-		}
+	if !t.checkScopes(ctx, w, req, params["scope"]) {
+		return
 	}
 
 	// If no authorization is provided, return a token the auth provider will treat as an anonymous user
 	if len(req.Header.Get("Authorization")) == 0 {
 		dcontext.GetRequestLogger(ctx).Debugf("anonymous token request")
-		t.writeToken(anonymousToken, w, req)
+		t.writeToken(anonymousToken, "", w, req)
 		return
 	}
 
@@ -65,15 +69,124 @@ func (t *tokenHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if !t.verifyToken(ctx, w, req, token) {
+		return
+	}
+
+	var refreshToken string
+	if params.Get("offline_token") == "true" {
+		var err error
+		refreshToken, err = t.refreshTokens.issue(token, params.Get("client_id"))
+		if err != nil {
+			dcontext.GetRequestLogger(ctx).Errorf("error issuing refresh token: %v", err)
+			t.writeError(w, req, "unable to issue refresh token")
+			return
+		}
+	}
+
+	t.writeToken(token, refreshToken, w, req)
+}
+
+// serveOAuth2 implements the OAuth2 flow of the docker token protocol. The
+// clients that requested offline access get a refresh token with the
+// password grant, and then use the refresh token grant instead of sending
+// their credentials.
+func (t *tokenHandler) serveOAuth2(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		dcontext.GetRequestLogger(ctx).Debugf("invalid token request: %v", err)
+		t.writeOAuth2Error(w, req, "invalid_request", "unable to parse the form")
+		return
+	}
+	form := req.PostForm
+
+	if !t.checkScopes(ctx, w, req, strings.Fields(form.Get("scope"))) {
+		return
+	}
+
+	clientID := form.Get("client_id")
+	if len(clientID) == 0 {
+		t.writeOAuth2Error(w, req, "invalid_request", "client_id is required")
+		return
+	}
+
+	var token string
+	grantType := form.Get("grant_type")
+	switch grantType {
+	case "refresh_token":
+		var err error
+		token, err = t.refreshTokens.validate(form.Get("refresh_token"), clientID)
+		if err != nil {
+			dcontext.GetRequestLogger(ctx).Debugf("refresh token rejected: %v", err)
+			t.writeOAuth2Error(w, req, "invalid_grant", err.Error())
+			return
+		}
+	case "password":
+		// use the password as the token
+		token = form.Get("password")
+		if len(token) == 0 {
+			t.writeOAuth2Error(w, req, "invalid_request", "password is required")
+			return
+		}
+	default:
+		t.writeOAuth2Error(w, req, "unsupported_grant_type", fmt.Sprintf("unsupported grant type %q", grantType))
+		return
+	}
+
+	// The refresh token is bound to the OpenShift token, so it stops working
+	// as soon as the OpenShift token expires or is revoked.
+	if !t.verifyToken(ctx, w, req, token) {
+		return
+	}
+
+	// A refresh token is not renewed by the refresh token grant, so that it
+	// doesn't outlive its lifetime.
+	var refreshToken string
+	if grantType == "password" && form.Get("access_type") == "offline" {
+		var err error
+		refreshToken, err = t.refreshTokens.issue(token, clientID)
+		if err != nil {
+			dcontext.GetRequestLogger(ctx).Errorf("error issuing refresh token: %v", err)
+			t.writeError(w, req, "unable to issue refresh token")
+			return
+		}
+	}
+
+	t.writeToken(token, refreshToken, w, req)
+}
+
+// checkScopes reports whether the requested scopes are supported. It writes
+// the error response if they are not.
+func (t *tokenHandler) checkScopes(ctx context.Context, w http.ResponseWriter, req *http.Request, scopes []string) bool {
+	if len(scopes) == 0 {
+		return true
+	}
+	accessRecords := auth.ResolveScopeSpecifiers(ctx, scopes)
+	for _, access := range accessRecords {
+		switch access.Resource.Type {
+		case "repository", "signature":
+			_, _, err := getNamespaceName(access.Resource.Name)
+			if err != nil {
+				dcontext.GetRequestLogger(ctx).Errorf("auth token request for unsupported resource name: %s", access.Resource.Name)
+				t.writeError(w, req, err.Error())
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// verifyToken reports whether token is a valid OpenShift token. It writes the
+// error response if it is not.
+func (t *tokenHandler) verifyToken(ctx context.Context, w http.ResponseWriter, req *http.Request, token string) bool {
 	// TODO: if this doesn't validate as an API token, attempt to obtain an API token using the given username/password
 	osClient, err := t.client.ClientFromToken(token)
 	if err != nil {
 		dcontext.GetRequestLogger(ctx).Errorf("error building client: %v", err)
 		t.writeError(w, req, "invalid request")
-		return
+		return false
 	}
 
-	if _, _, err := verifyOpenShiftUser(ctx, osClient); err != nil {
+	if _, err := verifyOpenShiftUser(ctx, osClient); err != nil {
 		dcontext.GetRequestLogger(ctx).Errorf("invalid token: %v", err)
 		if kerrors.IsUnauthorized(err) {
 			t.writeUnauthorized(w, req)
@@ -84,10 +197,9 @@ func (t *tokenHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			}
 			t.writeError(w, req, msg)
 		}
-		return
+		return false
 	}
-
-	t.writeToken(token, w, req)
+	return true
 }
 
 func (t *tokenHandler) writeError(w http.ResponseWriter, req *http.Request, msg string) {
@@ -97,13 +209,26 @@ func (t *tokenHandler) writeError(w http.ResponseWriter, req *http.Request, msg
 	_ = json.NewEncoder(w).Encode(map[string]interface{}{"details": msg})
 }
 
-func (t *tokenHandler) writeToken(token string, w http.ResponseWriter, req *http.Request) {
+func (t *tokenHandler) writeToken(token, refreshToken string, w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(200)
-	// TODO(dmage): log error?
-	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+	resp := map[string]interface{}{
 		"token":        token,
 		"access_token": token,
+	}
+	if len(refreshToken) > 0 {
+		resp["refresh_token"] = refreshToken
+	}
+	// TODO(dmage): log error?
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func (t *tokenHandler) writeOAuth2Error(w http.ResponseWriter, req *http.Request, code, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(400)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":             code,
+		"error_description": description,
 	})
 }
 
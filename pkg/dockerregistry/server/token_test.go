@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	authenticationapi "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	restclient "k8s.io/client-go/rest"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+	"github.com/openshift/image-registry/pkg/origin-common/clientcmd"
+	"github.com/openshift/image-registry/pkg/testutil"
+)
+
+func TestTokenHandlerRefreshTokens(t *testing.T) {
+	ctx := context.Background()
+	ctx = testutil.WithTestLogger(ctx, t)
+
+	userResponse := response{200, runtime.EncodeOrDie(codecs.LegacyCodec(authenticationapi.SchemeGroupVersion), &authenticationapi.SelfSubjectReview{Status: authenticationapi.SelfSubjectReviewStatus{UserInfo: authenticationapi.UserInfo{Username: "usr1"}}})}
+	server, actions := simulateOpenShiftMaster([]response{
+		userResponse,
+		userResponse,
+		{401, `{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"Unauthorized","code":401}`},
+	})
+	defer server.Close()
+
+	cfg := clientcmd.NewConfig()
+	cfg.SkipEnv = true
+	cfg.KubernetesAddr.Set(server.URL)
+	cfg.CommonConfig = restclient.Config{
+		Host:            server.URL,
+		TLSClientConfig: restclient.TLSClientConfig{Insecure: true},
+	}
+	h, err := NewTokenHandler(ctx, client.NewRegistryClient(cfg), "secret", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	h.(*tokenHandler).refreshTokens.now = func() time.Time { return now }
+
+	postToken := func(form url.Values) (int, map[string]string) {
+		req := httptest.NewRequest(http.MethodPost, "/openshift/token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		body := map[string]string{}
+		if w.Body.Len() > 0 {
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("unable to decode the response %q: %v", w.Body.String(), err)
+			}
+		}
+		return w.Code, body
+	}
+
+	code, body := postToken(url.Values{
+		"grant_type":  {"password"},
+		"client_id":   {"builder"},
+		"access_type": {"offline"},
+		"username":    {"usr1"},
+		"password":    {"awesome"},
+	})
+	if code != http.StatusOK || body["access_token"] != "awesome" {
+		t.Fatalf("got %d %v for the password grant, want the access token", code, body)
+	}
+	refreshToken := body["refresh_token"]
+	if len(refreshToken) == 0 || strings.Contains(refreshToken, "awesome") {
+		t.Fatalf("got refresh token %q, want an opaque token", refreshToken)
+	}
+
+	code, body = postToken(url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {"builder"},
+		"refresh_token": {refreshToken},
+	})
+	if code != http.StatusOK || body["access_token"] != "awesome" {
+		t.Fatalf("got %d %v for the refresh token grant, want the access token", code, body)
+	}
+
+	code, body = postToken(url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {"other"},
+		"refresh_token": {refreshToken},
+	})
+	if code != http.StatusBadRequest || body["error"] != "invalid_grant" {
+		t.Errorf("got %d %v for a refresh token of another client, want invalid_grant", code, body)
+	}
+
+	code, body = postToken(url.Values{
+		"grant_type": {"authorization_code"},
+		"client_id":  {"builder"},
+	})
+	if code != http.StatusBadRequest || body["error"] != "unsupported_grant_type" {
+		t.Errorf("got %d %v for an unknown grant, want unsupported_grant_type", code, body)
+	}
+
+	// The OpenShift token has been revoked.
+	code, _ = postToken(url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {"builder"},
+		"refresh_token": {refreshToken},
+	})
+	if code != http.StatusUnauthorized {
+		t.Errorf("got %d for a revoked token, want %d", code, http.StatusUnauthorized)
+	}
+
+	now = now.Add(time.Hour)
+	code, body = postToken(url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {"builder"},
+		"refresh_token": {refreshToken},
+	})
+	if code != http.StatusBadRequest || body["error"] != "invalid_grant" {
+		t.Errorf("got %d %v for an expired refresh token, want invalid_grant", code, body)
+	}
+
+	expectedActions := []string{
+		"POST /apis/authentication.k8s.io/v1/selfsubjectreviews (Authorization=Bearer awesome)",
+		"POST /apis/authentication.k8s.io/v1/selfsubjectreviews (Authorization=Bearer awesome)",
+		"POST /apis/authentication.k8s.io/v1/selfsubjectreviews (Authorization=Bearer awesome)",
+	}
+	if !reflect.DeepEqual(*actions, expectedActions) {
+		t.Errorf("expected: %#v, got: %#v", expectedActions, *actions)
+	}
+}
@@ -0,0 +1,3 @@
+// Package traffic records the requests served by the registry and replays
+// them against a registry for load testing.
+package traffic
@@ -0,0 +1,297 @@
+package traffic
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// recordsBufferSize is the number of records that wait to be written. The
+// records of the requests that are served while the buffer is full are
+// dropped, so that a slow disk doesn't slow down the registry.
+const recordsBufferSize = 1024
+
+// Record is the metadata of a request served by the registry. The bodies and
+// the headers of the requests are not recorded.
+type Record struct {
+	Time          time.Time     `json:"time"`
+	Method        string        `json:"method"`
+	Path          string        `json:"path"`
+	Status        int           `json:"status"`
+	RequestBytes  int64         `json:"requestBytes"`
+	ResponseBytes int64         `json:"responseBytes"`
+	Latency       time.Duration `json:"latency"`
+}
+
+// Recorder is an http.Handler that writes the metadata of a sample of the
+// served requests as JSON lines. The records are written in the background.
+type Recorder struct {
+	handler    http.Handler
+	sampleRate float64
+
+	// mu protects closed and inflight, the number of the sampled requests
+	// that are being served. Close waits on drained until they are done.
+	mu       sync.Mutex
+	drained  *sync.Cond
+	closed   bool
+	inflight int
+
+	records chan Record
+	done    chan struct{}
+	err     error
+
+	// random allows to override the sampling for tests.
+	random func() float64
+}
+
+// NewRecorder returns an http.Handler that records the fraction sampleRate of
+// the requests served by h into w. If w is an io.Closer, it's closed by
+// Close.
+func NewRecorder(w io.Writer, sampleRate float64, h http.Handler) *Recorder {
+	rec := &Recorder{
+		handler:    h,
+		sampleRate: sampleRate,
+		records:    make(chan Record, recordsBufferSize),
+		done:       make(chan struct{}),
+		random:     rand.Float64,
+	}
+	rec.drained = sync.NewCond(&rec.mu)
+	go rec.write(w)
+	return rec
+}
+
+func (rec *Recorder) write(w io.Writer) {
+	defer close(rec.done)
+
+	// Every record is written by a single call, so that the files are
+	// rotated between the records.
+	enc := json.NewEncoder(w)
+	for record := range rec.records {
+		// The recording is best effort, it must not fail the requests.
+		_ = enc.Encode(record)
+	}
+
+	if c, ok := w.(io.Closer); ok {
+		rec.err = c.Close()
+	}
+}
+
+// Close waits for the sampled requests that are being served, writes the
+// remaining records and closes the writer. The requests that are served
+// after Close are not recorded.
+func (rec *Recorder) Close() error {
+	rec.mu.Lock()
+	if !rec.closed {
+		rec.closed = true
+		for rec.inflight > 0 {
+			rec.drained.Wait()
+		}
+		close(rec.records)
+	}
+	rec.mu.Unlock()
+
+	<-rec.done
+	return rec.err
+}
+
+func (rec *Recorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if rec.random() >= rec.sampleRate {
+		rec.handler.ServeHTTP(w, r)
+		return
+	}
+
+	rec.mu.Lock()
+	closed := rec.closed
+	if !closed {
+		rec.inflight++
+	}
+	rec.mu.Unlock()
+	if closed {
+		rec.handler.ServeHTTP(w, r)
+		return
+	}
+
+	// The record stays nil if the handler panics.
+	var record *Record
+	defer func() {
+		rec.finish(record)
+	}()
+
+	rw := &recordingResponseWriter{ResponseWriter: w}
+	start := time.Now()
+	rec.handler.ServeHTTP(rw, r)
+
+	requestBytes := r.ContentLength
+	if requestBytes < 0 {
+		requestBytes = 0
+	}
+	status := rw.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	record = &Record{
+		Time:          start.UTC(),
+		Method:        r.Method,
+		Path:          r.URL.Path,
+		Status:        status,
+		RequestBytes:  requestBytes,
+		ResponseBytes: rw.written,
+		Latency:       time.Since(start),
+	}
+}
+
+// finish queues the record of a sampled request for writing.
+func (rec *Recorder) finish(record *Record) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if record != nil {
+		select {
+		case rec.records <- *record:
+		default:
+		}
+	}
+	rec.inflight--
+	if rec.inflight == 0 {
+		rec.drained.Broadcast()
+	}
+}
+
+// recordingResponseWriter remembers the status and the size of the
+// response.
+type recordingResponseWriter struct {
+	http.ResponseWriter
+
+	status  int
+	written int64
+}
+
+func (w *recordingResponseWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *recordingResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+// ReadFrom keeps the sendfile optimization of the underlying writer for
+// the blobs that are served from the filesystem.
+func (w *recordingResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	var n int64
+	var err error
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(w.ResponseWriter, r)
+	}
+	w.written += n
+	return n, err
+}
+
+func (w *recordingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *recordingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("the response writer %T doesn't support hijacking", w.ResponseWriter)
+	}
+	return h.Hijack()
+}
+
+// File is a recording file that is rotated when it grows larger than its
+// limit. The previous records are kept in the file with the suffix .1.
+type File struct {
+	path     string
+	maxBytes int64
+
+	f    *os.File
+	size int64
+}
+
+// OpenFile opens the file path to append records to it. The file is rotated
+// once it's larger than maxBytes, zero disables the rotation.
+func OpenFile(path string, maxBytes int64) (*File, error) {
+	file := &File{path: path, maxBytes: maxBytes}
+	if err := file.open(); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (file *File) open() error {
+	f, err := os.OpenFile(file.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	file.f, file.size = f, fi.Size()
+	return nil
+}
+
+func (file *File) rotate() error {
+	err := file.f.Close()
+	file.f = nil
+	if err != nil {
+		return err
+	}
+	// The file is reopened even if it cannot be renamed, so that the
+	// recording continues.
+	renameErr := os.Rename(file.path, file.path+".1")
+	if err := file.open(); err != nil {
+		return err
+	}
+	return renameErr
+}
+
+func (file *File) Write(p []byte) (int, error) {
+	var rotateErr error
+	if file.f != nil && file.maxBytes > 0 && file.size > 0 && file.size+int64(len(p)) > file.maxBytes {
+		rotateErr = file.rotate()
+	}
+	if file.f == nil {
+		// The file couldn't be reopened by the rotation.
+		if err := file.open(); err != nil {
+			return 0, fmt.Errorf("unable to reopen %s: %w", file.path, err)
+		}
+	}
+
+	n, err := file.f.Write(p)
+	file.size += int64(n)
+	if err == nil && rotateErr != nil {
+		err = fmt.Errorf("unable to rotate %s: %w", file.path, rotateErr)
+	}
+	return n, err
+}
+
+func (file *File) Close() error {
+	if file.f == nil {
+		return nil
+	}
+	return file.f.Close()
+}
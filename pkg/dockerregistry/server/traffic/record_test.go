@@ -0,0 +1,149 @@
+package traffic
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecorder(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		_, _ = w.Write([]byte("hello"))
+	})
+
+	buf := &bytes.Buffer{}
+	rec := NewRecorder(buf, 1, h)
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/v2/foo/bar/manifests/latest?token=secret", nil),
+		httptest.NewRequest(http.MethodPut, "/v2/foo/bar/manifests/latest", strings.NewReader("{}")),
+	} {
+		rec.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := ReadProfile(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(records))
+	}
+
+	if r := records[0]; r.Method != http.MethodGet || r.Path != "/v2/foo/bar/manifests/latest" || r.Status != http.StatusOK || r.ResponseBytes != 5 || r.RequestBytes != 0 {
+		t.Errorf("unexpected record: %#+v", r)
+	}
+	if r := records[1]; r.Method != http.MethodPut || r.Status != http.StatusCreated || r.ResponseBytes != 0 || r.RequestBytes != 2 {
+		t.Errorf("unexpected record: %#+v", r)
+	}
+}
+
+func TestRecorderSampling(t *testing.T) {
+	buf := &bytes.Buffer{}
+	rec := NewRecorder(buf, 0.5, http.NotFoundHandler())
+
+	samples := []float64{0.1, 0.7, 0.49, 0.5}
+	rec.random = func() float64 {
+		v := samples[0]
+		samples = samples[1:]
+		return v
+	}
+
+	for i := 0; i < 4; i++ {
+		rec.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v2/", nil))
+	}
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := ReadProfile(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected 2 sampled records, got %d", len(records))
+	}
+	for _, r := range records {
+		if r.Status != http.StatusNotFound {
+			t.Errorf("unexpected status: %d", r.Status)
+		}
+	}
+}
+
+func TestRecorderResponseWriter(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(http.Hijacker); !ok {
+			t.Errorf("the response writer %T doesn't implement http.Hijacker", w)
+		}
+		rf, ok := w.(io.ReaderFrom)
+		if !ok {
+			t.Fatalf("the response writer %T doesn't implement io.ReaderFrom", w)
+		}
+		if _, err := rf.ReadFrom(strings.NewReader("blob")); err != nil {
+			t.Error(err)
+		}
+	})
+
+	buf := &bytes.Buffer{}
+	rec := NewRecorder(buf, 1, h)
+	rec.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v2/foo/bar/blobs/sha256:abc", nil))
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := ReadProfile(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].ResponseBytes != 4 || records[0].Status != http.StatusOK {
+		t.Errorf("unexpected records: %#+v", records)
+	}
+}
+
+func TestFileRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traffic.json")
+	f, err := OpenFile(path, 150)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := NewRecorder(f, 1, http.NotFoundHandler())
+	for i := 0; i < 3; i++ {
+		rec.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v2/", nil))
+	}
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	count := 0
+	for _, name := range []string{path, path + ".1"} {
+		r, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records, err := ReadProfile(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(records) == 0 {
+			t.Errorf("%s: no records", name)
+		}
+		count += len(records)
+	}
+	// Every record is larger than the half of the limit, so the last
+	// file has one record and the rotated file has the one before it.
+	if count != 2 {
+		t.Errorf("got %d records in the files, want 2", count)
+	}
+}
@@ -0,0 +1,201 @@
+package traffic
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ReadProfile reads the records written by a Recorder.
+func ReadProfile(r io.Reader) ([]Record, error) {
+	var records []Record
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// Replayer sends the recorded requests to a registry.
+type Replayer struct {
+	// Client is used to send the requests.
+	Client *http.Client
+	// Target is the base URL of the registry.
+	Target *url.URL
+	// Token is the bearer token that is sent with the requests. The
+	// requests are anonymous if it's empty.
+	Token string
+	// Concurrency is the number of requests that are sent at the same time.
+	Concurrency int
+}
+
+// Summary is the result of a replay.
+type Summary struct {
+	// Requests is the number of sent requests.
+	Requests int `json:"requests"`
+	// Skipped is the number of records that were not replayed. Only the
+	// pulls are replayed as the pushes need the recorded bodies.
+	Skipped int `json:"skipped"`
+	// Errors is the number of requests that failed without a response.
+	Errors int `json:"errors"`
+	// Statuses is the number of responses with each status code.
+	Statuses map[int]int `json:"statuses"`
+	// Bytes is the total size of the response bodies.
+	Bytes int64 `json:"bytes"`
+	// Duration is how long the replay took.
+	Duration time.Duration `json:"duration"`
+	// LatencyP50, LatencyP90 and LatencyP99 are the percentiles of the
+	// latencies of the requests.
+	LatencyP50 time.Duration `json:"latencyP50"`
+	LatencyP90 time.Duration `json:"latencyP90"`
+	LatencyP99 time.Duration `json:"latencyP99"`
+}
+
+// result is the outcome of a single replayed request.
+type result struct {
+	status  int
+	bytes   int64
+	latency time.Duration
+	err     error
+}
+
+// Replay sends the GET and HEAD requests of records to the target registry
+// in their recorded order. It stops sending new requests when ctx is done.
+func (rp *Replayer) Replay(ctx context.Context, records []Record) *Summary {
+	summary := &Summary{
+		Statuses: make(map[int]int),
+	}
+
+	concurrency := rp.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	start := time.Now()
+	queue := make(chan Record)
+	results := make(chan result)
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for record := range queue {
+				results <- rp.send(ctx, record)
+			}
+		}()
+	}
+
+	go func() {
+		defer close(queue)
+		for _, record := range records {
+			if record.Method != http.MethodGet && record.Method != http.MethodHead {
+				continue
+			}
+			select {
+			case queue <- record:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var latencies []time.Duration
+	for res := range results {
+		summary.Requests++
+		if res.err != nil {
+			summary.Errors++
+			continue
+		}
+		summary.Statuses[res.status]++
+		summary.Bytes += res.bytes
+		latencies = append(latencies, res.latency)
+	}
+
+	for _, record := range records {
+		if record.Method != http.MethodGet && record.Method != http.MethodHead {
+			summary.Skipped++
+		}
+	}
+
+	summary.Duration = time.Since(start)
+	sort.Slice(latencies, func(i, j int) bool {
+		return latencies[i] < latencies[j]
+	})
+	summary.LatencyP50 = percentile(latencies, 50)
+	summary.LatencyP90 = percentile(latencies, 90)
+	summary.LatencyP99 = percentile(latencies, 99)
+	return summary
+}
+
+// send replays record and reads the whole response.
+func (rp *Replayer) send(ctx context.Context, record Record) result {
+	u := *rp.Target
+	u.Path = record.Path
+
+	req, err := http.NewRequestWithContext(ctx, record.Method, u.String(), nil)
+	if err != nil {
+		return result{err: err}
+	}
+	if len(rp.Token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+rp.Token)
+	}
+
+	client := rp.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return result{err: err}
+	}
+	defer resp.Body.Close()
+
+	n, err := io.Copy(io.Discard, resp.Body)
+	if err != nil {
+		return result{err: err}
+	}
+	return result{
+		status:  resp.StatusCode,
+		bytes:   n,
+		latency: time.Since(start),
+	}
+}
+
+// percentile returns the p-th percentile of the sorted latencies.
+func percentile(latencies []time.Duration, p int) time.Duration {
+	if len(latencies) == 0 {
+		return 0
+	}
+	i := (len(latencies)*p + 99) / 100
+	if i > 0 {
+		i--
+	}
+	return latencies[i]
+}
@@ -0,0 +1,95 @@
+package traffic
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReplay(t *testing.T) {
+	var mu sync.Mutex
+	paths := make(map[string]int)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths[r.Method+" "+r.URL.Path]++
+		mu.Unlock()
+
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path == "/v2/missing/manifests/latest" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte("content"))
+	}))
+	defer ts.Close()
+
+	target, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := []Record{
+		{Method: http.MethodGet, Path: "/v2/foo/bar/manifests/latest"},
+		{Method: http.MethodHead, Path: "/v2/foo/bar/blobs/sha256:abc"},
+		{Method: http.MethodGet, Path: "/v2/foo/bar/blobs/sha256:abc"},
+		{Method: http.MethodGet, Path: "/v2/missing/manifests/latest"},
+		{Method: http.MethodPut, Path: "/v2/foo/bar/manifests/latest"},
+		{Method: http.MethodPatch, Path: "/v2/foo/bar/blobs/uploads/1"},
+	}
+
+	rp := &Replayer{
+		Client:      ts.Client(),
+		Target:      target,
+		Token:       "token",
+		Concurrency: 3,
+	}
+	summary := rp.Replay(context.Background(), records)
+
+	if summary.Requests != 4 || summary.Skipped != 2 || summary.Errors != 0 {
+		t.Errorf("unexpected summary: %#+v", summary)
+	}
+	if summary.Statuses[http.StatusOK] != 3 || summary.Statuses[http.StatusNotFound] != 1 {
+		t.Errorf("unexpected statuses: %v", summary.Statuses)
+	}
+	// The body of the HEAD request is not sent.
+	if summary.Bytes != 2*int64(len("content")) {
+		t.Errorf("unexpected number of bytes: %d", summary.Bytes)
+	}
+	if paths["PUT /v2/foo/bar/manifests/latest"] != 0 {
+		t.Errorf("pushes must not be replayed: %v", paths)
+	}
+	if summary.LatencyP99 < summary.LatencyP50 {
+		t.Errorf("unexpected latencies: %#+v", summary)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	var latencies []time.Duration
+	for i := 1; i <= 100; i++ {
+		latencies = append(latencies, time.Duration(i)*time.Millisecond)
+	}
+
+	for _, tc := range []struct {
+		p        int
+		expected time.Duration
+	}{
+		{p: 50, expected: 50 * time.Millisecond},
+		{p: 90, expected: 90 * time.Millisecond},
+		{p: 99, expected: 99 * time.Millisecond},
+	} {
+		if got := percentile(latencies, tc.p); got != tc.expected {
+			t.Errorf("p%d: got %s, want %s", tc.p, got, tc.expected)
+		}
+	}
+
+	if got := percentile(nil, 50); got != 0 {
+		t.Errorf("unexpected percentile of no latencies: %s", got)
+	}
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/coordination"
+	regstorage "github.com/openshift/image-registry/pkg/dockerregistry/server/storage"
+)
+
+// trashPurger periodically deletes the blobs with expired retention from the
+// trash.
+type trashPurger struct {
+	trash    *regstorage.Trash
+	interval time.Duration
+
+	// state keeps the schedule when the leadership moves to another
+	// replica. It is nil if the replicas don't coordinate.
+	state *coordination.State
+}
+
+func newTrashPurger(trash *regstorage.Trash, interval time.Duration) *trashPurger {
+	return &trashPurger{
+		trash:    trash,
+		interval: interval,
+	}
+}
+
+// Run purges the trash every interval until ctx is done.
+func (r *trashPurger) Run(ctx context.Context) {
+	dcontext.GetLogger(ctx).Infof("starting purge of the trash every %s", r.interval)
+	r.state.Every(ctx, "trashpurge", r.interval, r.purge)
+}
+
+func (r *trashPurger) purge(ctx context.Context) {
+	blobs, size, err := r.trash.Purge(ctx)
+	if err != nil {
+		dcontext.GetLogger(ctx).Errorf("trash purge: %v", err)
+	}
+	if blobs > 0 {
+		dcontext.GetLogger(ctx).Infof("trash purge: deleted %d blobs (%d bytes) with expired retention", blobs, size)
+	}
+}
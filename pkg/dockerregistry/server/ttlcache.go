@@ -0,0 +1,78 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// ttlCache caches the result of load for ttl. Only one load runs at a time,
+// the concurrent callers wait for its result instead of sending their own
+// requests to the API server.
+//
+// The errors are cached for errorTTL, so that every request doesn't retry
+// a failing API server. The last value that was loaded successfully is
+// returned with the errors.
+type ttlCache[T any] struct {
+	load     func(ctx context.Context) (T, error)
+	ttl      time.Duration
+	errorTTL time.Duration
+	now      func() time.Time
+
+	mu        sync.Mutex
+	value     T
+	err       error
+	expiresAt time.Time
+	// loading is closed when the running load is finished.
+	loading chan struct{}
+}
+
+func newTTLCache[T any](ttl, errorTTL time.Duration, load func(ctx context.Context) (T, error)) *ttlCache[T] {
+	return &ttlCache[T]{
+		load:     load,
+		ttl:      ttl,
+		errorTTL: errorTTL,
+		now:      time.Now,
+	}
+}
+
+// Get returns the cached value, loading it if the cached result is expired.
+func (c *ttlCache[T]) Get(ctx context.Context) (T, error) {
+	c.mu.Lock()
+	for c.loading != nil {
+		loading := c.loading
+		c.mu.Unlock()
+		select {
+		case <-loading:
+		case <-ctx.Done():
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			return c.value, ctx.Err()
+		}
+		c.mu.Lock()
+	}
+	if c.now().Before(c.expiresAt) {
+		defer c.mu.Unlock()
+		return c.value, c.err
+	}
+	loading := make(chan struct{})
+	c.loading = loading
+	c.mu.Unlock()
+
+	// The result is shared with the other callers, so it shouldn't depend
+	// on the cancellation of this one.
+	value, err := c.load(context.WithoutCancel(ctx))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		c.err = err
+		c.expiresAt = c.now().Add(c.errorTTL)
+	} else {
+		c.value, c.err = value, nil
+		c.expiresAt = c.now().Add(c.ttl)
+	}
+	c.loading = nil
+	close(loading)
+	return c.value, c.err
+}
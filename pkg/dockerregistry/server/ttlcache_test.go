@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTTLCache(t *testing.T) {
+	var (
+		loads   atomic.Int32
+		loadErr error
+	)
+	now := time.Now()
+	c := newTTLCache(time.Minute, 10*time.Second, func(ctx context.Context) (int, error) {
+		n := int(loads.Add(1))
+		if loadErr != nil {
+			return 0, loadErr
+		}
+		return n, nil
+	})
+	c.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	if v, err := c.Get(ctx); v != 1 || err != nil {
+		t.Fatalf("got %d, %v; want 1, nil", v, err)
+	}
+	now = now.Add(30 * time.Second)
+	if v, _ := c.Get(ctx); v != 1 {
+		t.Errorf("got %d before the value is expired, want 1", v)
+	}
+
+	// The error is cached, and the last value is returned with it.
+	loadErr = errors.New("unavailable")
+	now = now.Add(time.Minute)
+	for i := 0; i < 2; i++ {
+		if v, err := c.Get(ctx); v != 1 || err != loadErr {
+			t.Errorf("got %d, %v; want 1, %v", v, err, loadErr)
+		}
+	}
+	if n := loads.Load(); n != 2 {
+		t.Errorf("got %d loads, want the error to be cached", n)
+	}
+
+	loadErr = nil
+	now = now.Add(10 * time.Second)
+	if v, err := c.Get(ctx); v != 3 || err != nil {
+		t.Errorf("got %d, %v after the error is expired; want 3, nil", v, err)
+	}
+}
+
+func TestTTLCacheConcurrentLoads(t *testing.T) {
+	var loads atomic.Int32
+	release := make(chan struct{})
+	c := newTTLCache(time.Minute, time.Minute, func(ctx context.Context) (string, error) {
+		loads.Add(1)
+		<-release
+		// The load doesn't fail when the caller that started it goes away.
+		return "value", ctx.Err()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, _ = c.Get(ctx)
+	}()
+	for loads.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	results := make(chan string, 3)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := c.Get(context.Background())
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			results <- v
+		}()
+	}
+	cancel()
+	close(release)
+	wg.Wait()
+	close(results)
+
+	for v := range results {
+		if v != "value" {
+			t.Errorf("got %q, want value", v)
+		}
+	}
+	if n := loads.Load(); n != 1 {
+		t.Errorf("got %d loads, want 1", n)
+	}
+}
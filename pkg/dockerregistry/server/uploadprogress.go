@@ -0,0 +1,261 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	v2 "github.com/distribution/distribution/v3/registry/api/v2"
+	"github.com/distribution/distribution/v3/registry/auth"
+	"github.com/distribution/distribution/v3/registry/handlers"
+	gorillahandlers "github.com/gorilla/handlers"
+	kubecache "k8s.io/apimachinery/pkg/util/cache"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/api"
+)
+
+const (
+	uploadProgressCacheSize = 1024
+	// uploadProgressTTL is how long the progress of an upload is kept after
+	// the last received data.
+	uploadProgressTTL = time.Hour
+)
+
+// uploadProgress is the progress of an in-flight blob upload.
+type uploadProgress struct {
+	startedAt    time.Time
+	received     atomic.Int64
+	lastActivity atomic.Int64
+}
+
+func (p *uploadProgress) add(n int64) {
+	p.received.Add(n)
+	p.lastActivity.Store(time.Now().UnixNano())
+}
+
+// uploadProgressResponse is the response of the upload progress endpoint.
+type uploadProgressResponse struct {
+	UUID           string    `json:"uuid"`
+	BytesReceived  int64     `json:"bytesReceived"`
+	StartedAt      time.Time `json:"startedAt"`
+	LastActivity   time.Time `json:"lastActivity"`
+	BytesPerSecond float64   `json:"bytesPerSecond"`
+}
+
+// uploadTracker keeps the progress of the blob uploads that are handled by
+// this replica.
+type uploadTracker struct {
+	uploads *kubecache.LRUExpireCache
+}
+
+func newUploadTracker() *uploadTracker {
+	return &uploadTracker{
+		uploads: kubecache.NewLRUExpireCache(uploadProgressCacheSize),
+	}
+}
+
+func uploadKey(repo, id string) string {
+	return repo + "@" + id
+}
+
+// track returns the progress of the upload bw to the repository repo.
+func (t *uploadTracker) track(repo string, bw distribution.BlobWriter) *uploadProgress {
+	key := uploadKey(repo, bw.ID())
+	if p, ok := t.uploads.Get(key); ok {
+		return p.(*uploadProgress)
+	}
+
+	p := &uploadProgress{startedAt: bw.StartedAt()}
+	p.add(bw.Size())
+	t.uploads.Add(key, p, uploadProgressTTL)
+	return p
+}
+
+func (t *uploadTracker) touch(repo, id string, p *uploadProgress) {
+	t.uploads.Add(uploadKey(repo, id), p, uploadProgressTTL)
+}
+
+func (t *uploadTracker) remove(repo, id string) {
+	t.uploads.Remove(uploadKey(repo, id))
+}
+
+func (t *uploadTracker) get(repo, id string) (*uploadProgress, bool) {
+	p, ok := t.uploads.Get(uploadKey(repo, id))
+	if !ok {
+		return nil, false
+	}
+	return p.(*uploadProgress), true
+}
+
+// progressBlobStore records the progress of the blob uploads.
+type progressBlobStore struct {
+	distribution.BlobStore
+
+	uploads *uploadTracker
+	repo    string
+}
+
+var _ distribution.BlobStore = &progressBlobStore{}
+
+func (bs *progressBlobStore) Create(ctx context.Context, options ...distribution.BlobCreateOption) (distribution.BlobWriter, error) {
+	bw, err := bs.BlobStore.Create(ctx, options...)
+	if err != nil {
+		return bw, err
+	}
+	return bs.newBlobWriter(bw), nil
+}
+
+func (bs *progressBlobStore) Resume(ctx context.Context, id string) (distribution.BlobWriter, error) {
+	bw, err := bs.BlobStore.Resume(ctx, id)
+	if err != nil {
+		return bw, err
+	}
+	return bs.newBlobWriter(bw), nil
+}
+
+func (bs *progressBlobStore) newBlobWriter(bw distribution.BlobWriter) distribution.BlobWriter {
+	return &progressBlobWriter{
+		BlobWriter: bw,
+		uploads:    bs.uploads,
+		repo:       bs.repo,
+		progress:   bs.uploads.track(bs.repo, bw),
+	}
+}
+
+// progressBlobWriter counts the bytes written into the blob.
+type progressBlobWriter struct {
+	distribution.BlobWriter
+
+	uploads  *uploadTracker
+	repo     string
+	progress *uploadProgress
+}
+
+func (bw *progressBlobWriter) Write(p []byte) (int, error) {
+	n, err := bw.BlobWriter.Write(p)
+	bw.progress.add(int64(n))
+	return n, err
+}
+
+func (bw *progressBlobWriter) ReadFrom(r io.Reader) (int64, error) {
+	return bw.BlobWriter.ReadFrom(&progressReader{Reader: r, progress: bw.progress})
+}
+
+func (bw *progressBlobWriter) Close() error {
+	// The upload continues with the next request, so its progress is kept
+	// for a while.
+	bw.uploads.touch(bw.repo, bw.ID(), bw.progress)
+	return bw.BlobWriter.Close()
+}
+
+func (bw *progressBlobWriter) Commit(ctx context.Context, provisional distribution.Descriptor) (distribution.Descriptor, error) {
+	desc, err := bw.BlobWriter.Commit(ctx, provisional)
+	if err == nil {
+		bw.uploads.remove(bw.repo, bw.ID())
+	}
+	return desc, err
+}
+
+func (bw *progressBlobWriter) Cancel(ctx context.Context) error {
+	bw.uploads.remove(bw.repo, bw.ID())
+	return bw.BlobWriter.Cancel(ctx)
+}
+
+// progressReader counts the bytes read by the blob writer.
+type progressReader struct {
+	io.Reader
+	progress *uploadProgress
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.progress.add(int64(n))
+	return n, err
+}
+
+func (app *App) registerUploadProgressHandler(dockerApp *handlers.App) {
+	extensionsRouter := dockerApp.NewRoute().PathPrefix(api.ExtensionsPrefix).Subrouter()
+	progressAccess := func(r *http.Request) []auth.Access {
+		return []auth.Access{
+			{
+				Resource: auth.Resource{
+					Type: "repository",
+					Name: dcontext.GetStringValue(dcontext.WithVars(dockerApp, r), "vars.name"),
+				},
+				Action: "push",
+			},
+		}
+	}
+	dockerApp.RegisterRoute(
+		"extensions-upload-progress",
+		// GET /extensions/v2/<namespace>/<name>/uploads/<uuid>/progress
+		extensionsRouter.Path(api.UploadProgressPath).Methods("GET"),
+		app.uploadProgressDispatcher,
+		handlers.NameRequired,
+		progressAccess,
+	)
+}
+
+// uploadProgressDispatcher takes the request context and builds the handler
+// for the upload progress requests.
+func (app *App) uploadProgressDispatcher(ctx *handlers.Context, r *http.Request) http.Handler {
+	uploadProgressHandler := &uploadProgressHandler{
+		Context: ctx,
+		Uploads: app.uploads,
+	}
+
+	return gorillahandlers.MethodHandler{
+		"GET": http.HandlerFunc(uploadProgressHandler.Get),
+	}
+}
+
+// uploadProgressHandler reports the progress of in-flight blob uploads.
+type uploadProgressHandler struct {
+	*handlers.Context
+
+	Uploads *uploadTracker
+}
+
+// Get returns the progress of the upload. Only the replica that receives the
+// upload knows its progress, so the client has to use the same replica as
+// for the upload.
+func (h *uploadProgressHandler) Get(w http.ResponseWriter, req *http.Request) {
+	id := dcontext.GetStringValue(h, "vars.uuid")
+
+	p, ok := h.Uploads.get(h.Repository.Named().Name(), id)
+	if !ok {
+		h.handleError(w, v2.ErrorCodeBlobUploadUnknown.WithDetail(fmt.Sprintf("no in-flight upload %s", id)))
+		return
+	}
+
+	resp := uploadProgressResponse{
+		UUID:          id,
+		BytesReceived: p.received.Load(),
+		StartedAt:     p.startedAt.UTC(),
+		LastActivity:  time.Unix(0, p.lastActivity.Load()).UTC(),
+	}
+	if elapsed := time.Since(p.startedAt).Seconds(); elapsed > 0 {
+		resp.BytesPerSecond = float64(resp.BytesReceived) / elapsed
+	}
+
+	data, err := json.Marshal(resp)
+	if err != nil {
+		h.handleError(w, errcode.ErrorCodeUnknown.WithDetail(fmt.Sprintf("failed to serialize upload progress: %v", err)))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_, _ = w.Write(data)
+}
+
+func (h *uploadProgressHandler) handleError(w http.ResponseWriter, err error) {
+	if serveErr := errcode.ServeJSON(w, err); serveErr != nil {
+		dcontext.GetResponseLogger(h).Errorf("error sending error response: %v", serveErr)
+	}
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/handlers"
+	"github.com/gorilla/mux"
+
+	"github.com/openshift/image-registry/pkg/testutil"
+)
+
+type fakeUploadBlobStore struct {
+	distribution.BlobStore
+	writer *fakeBlobWriter
+}
+
+func (bs *fakeUploadBlobStore) Create(ctx context.Context, options ...distribution.BlobCreateOption) (distribution.BlobWriter, error) {
+	return bs.writer, nil
+}
+
+func (bs *fakeUploadBlobStore) Resume(ctx context.Context, id string) (distribution.BlobWriter, error) {
+	return bs.writer, nil
+}
+
+type fakeBlobWriter struct {
+	distribution.BlobWriter
+	id        string
+	startedAt time.Time
+	buf       bytes.Buffer
+}
+
+func (bw *fakeBlobWriter) ID() string           { return bw.id }
+func (bw *fakeBlobWriter) StartedAt() time.Time { return bw.startedAt }
+func (bw *fakeBlobWriter) Size() int64          { return int64(bw.buf.Len()) }
+func (bw *fakeBlobWriter) Close() error         { return nil }
+
+func (bw *fakeBlobWriter) Write(p []byte) (int, error) {
+	return bw.buf.Write(p)
+}
+
+func (bw *fakeBlobWriter) ReadFrom(r io.Reader) (int64, error) {
+	return bw.buf.ReadFrom(r)
+}
+
+func (bw *fakeBlobWriter) Commit(ctx context.Context, provisional distribution.Descriptor) (distribution.Descriptor, error) {
+	return provisional, nil
+}
+
+func TestUploadProgress(t *testing.T) {
+	ctx := context.Background()
+	ctx = testutil.WithTestLogger(ctx, t)
+
+	const repo = "ns/app"
+	uploads := newUploadTracker()
+	writer := &fakeBlobWriter{id: "5c7a4b2e-upload", startedAt: time.Now().Add(-10 * time.Second)}
+	bs := &progressBlobStore{
+		BlobStore: &fakeUploadBlobStore{writer: writer},
+		uploads:   uploads,
+		repo:      repo,
+	}
+
+	named, err := reference.WithName(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	getProgress := func(id string) (*httptest.ResponseRecorder, uploadProgressResponse) {
+		req := httptest.NewRequest(http.MethodGet, "/extensions/v2/"+repo+"/uploads/"+id+"/progress", nil)
+		req = mux.SetURLVars(req, map[string]string{"name": repo, "uuid": id})
+		h := &uploadProgressHandler{
+			Context: &handlers.Context{
+				Context:    dcontext.WithVars(ctx, req),
+				Repository: &namedRepository{name: named},
+			},
+			Uploads: uploads,
+		}
+		w := httptest.NewRecorder()
+		h.Get(w, req)
+
+		var resp uploadProgressResponse
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w, resp
+	}
+
+	bw, err := bs.Create(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bw.Write([]byte("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	if err := bw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	bw, err = bs.Resume(ctx, writer.id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(bw, strings.NewReader(strings.Repeat("x", 20))); err != nil {
+		t.Fatal(err)
+	}
+
+	w, resp := getProgress(writer.id)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	if resp.UUID != writer.id || resp.BytesReceived != 30 {
+		t.Errorf("got %#+v, want 30 bytes received for %s", resp, writer.id)
+	}
+	if !resp.StartedAt.Equal(writer.startedAt.UTC()) {
+		t.Errorf("got start time %s, want %s", resp.StartedAt, writer.startedAt)
+	}
+	if resp.BytesPerSecond <= 0 || resp.BytesPerSecond > 3 {
+		t.Errorf("got throughput %f, want about 3 bytes per second", resp.BytesPerSecond)
+	}
+	if time.Since(resp.LastActivity) > time.Minute {
+		t.Errorf("got last activity %s, want a recent time", resp.LastActivity)
+	}
+
+	if w, _ := getProgress("unknown-upload"); w.Code != http.StatusNotFound {
+		t.Errorf("unknown upload: got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	if _, err := bw.Commit(ctx, distribution.Descriptor{}); err != nil {
+		t.Fatal(err)
+	}
+	if w, _ := getProgress(writer.id); w.Code != http.StatusNotFound {
+		t.Errorf("committed upload: got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
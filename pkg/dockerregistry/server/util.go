@@ -47,15 +47,25 @@ func getNamespaceName(resourceName string) (string, string, error) {
 	return ns, name, nil
 }
 
-// getImportContext loads secrets and returns a context for getting
-// distribution clients to remote repositories.
-func getImportContext(ctx context.Context, ref *reference.DockerImageReference, secrets []corev1.Secret, m metrics.Pullthrough, icsp operatorv1alpha1.ImageContentSourcePolicyInterface, idms apicfgv1.ImageDigestMirrorSetInterface, itms apicfgv1.ImageTagMirrorSetInterface) (registryclient.RepositoryRetriever, error) {
-	req, err := dcontext.GetRequest(ctx)
-	if err != nil {
-		dcontext.GetLogger(ctx).Errorf("unable to get request from context: %v", err)
-		return nil, err
+// selectPullSecret returns the secret named pullSecret if it is among
+// secrets. Otherwise all secrets are returned.
+func selectPullSecret(ctx context.Context, secrets []corev1.Secret, pullSecret string) []corev1.Secret {
+	if len(pullSecret) == 0 {
+		return secrets
 	}
+	for _, secret := range secrets {
+		if secret.Name == pullSecret {
+			return []corev1.Secret{secret}
+		}
+	}
+	dcontext.GetLogger(ctx).Warnf("pull secret %q is not found, proceeding with all secrets", pullSecret)
+	return secrets
+}
 
+// newPullthroughCredentials returns the credentials for the remote
+// registries from the installation credentials and the secrets, or only the
+// secret pullSecret if it is set and exists.
+func newPullthroughCredentials(ctx context.Context, secrets []corev1.Secret, pullSecret string) (*credentialStoreFactory, error) {
 	installKeyring := &credentialprovider.BasicDockerKeyring{}
 	if config, err := credentialprovider.ReadDockerConfigJSONFile(
 		[]string{installCredentialsDir},
@@ -65,25 +75,46 @@ func getImportContext(ctx context.Context, ref *reference.DockerImageReference,
 		installKeyring.Add(config)
 	}
 
-	keyring, err := credentialprovider.MakeDockerKeyring(secrets, installKeyring)
+	keyring, err := credentialprovider.MakeDockerKeyring(selectPullSecret(ctx, secrets, pullSecret), installKeyring)
 	if err != nil {
 		dcontext.GetLogger(ctx).Errorf("error creating keyring: %v", err)
 		return nil, err
 	}
 
-	var retriever registryclient.RepositoryRetriever
-	retriever = registryclient.NewContext(
-		secureTransport, insecureTransport,
+	return &credentialStoreFactory{
+		keyring: keyring,
+	}, nil
+}
+
+// getImportContext loads secrets and returns a context for getting
+// distribution clients to remote repositories.
+func getImportContext(ctx context.Context, ref *reference.DockerImageReference, secrets []corev1.Secret, pullSecret string, m metrics.Pullthrough, icsp operatorv1alpha1.ImageContentSourcePolicyInterface, idms apicfgv1.ImageDigestMirrorSetInterface, itms apicfgv1.ImageTagMirrorSetInterface, proxy *clusterProxy, challenges *authChallenges, mirrors *mirrorHealth) (registryclient.RepositoryRetriever, error) {
+	req, err := dcontext.GetRequest(ctx)
+	if err != nil {
+		dcontext.GetLogger(ctx).Errorf("unable to get request from context: %v", err)
+		return nil, err
+	}
+
+	credentials, err := newPullthroughCredentials(ctx, secrets, pullSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	secure, insecure := proxy.Transports()
+	secure, insecure = mirrors.Transport(secure), mirrors.Transport(insecure)
+
+	registryContext := registryclient.NewContext(
+		secure, insecure,
 	).WithRequestModifiers(
 		requesttrace.New(ctx, req),
 	).WithAlternateBlobSourceStrategy(
-		NewSimpleLookupImageMirrorSetsStrategy(icsp, idms, itms),
+		mirrors.Strategy(NewSimpleLookupImageMirrorSetsStrategy(icsp, idms, itms)),
 	).WithCredentialsFactory(
-		&credentialStoreFactory{
-			keyring: keyring,
-		},
+		credentials,
 	)
+	registryContext.Challenges = challenges.Manager()
 
+	var retriever registryclient.RepositoryRetriever = registryContext
 	retriever = m.RepositoryRetriever(retriever)
 	return retriever, nil
 }
@@ -8,6 +8,7 @@ import (
 	"testing"
 
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	cfgfake "github.com/openshift/client-go/config/clientset/versioned/fake"
 	operatorfake "github.com/openshift/client-go/operator/clientset/versioned/fake"
@@ -27,6 +28,22 @@ func (m *mockMetricsPullThrough) DigestBlobStoreCache() metrics.Cache {
 	return nil
 }
 
+func (m *mockMetricsPullThrough) BlobRequestCoalescing() metrics.Coalescing {
+	return nil
+}
+
+func (m *mockMetricsPullThrough) CertificatePins() metrics.CertificatePins {
+	return nil
+}
+
+func (m *mockMetricsPullThrough) BlobTransfers() metrics.BlobTransfers {
+	return nil
+}
+
+func (m *mockMetricsPullThrough) MirrorQueue() metrics.MirrorQueue {
+	return nil
+}
+
 func Test_getImportContext(t *testing.T) {
 	icsp := operatorfake.NewSimpleClientset().OperatorV1alpha1().ImageContentSourcePolicies()
 	idms := cfgfake.NewSimpleClientset().ConfigV1().ImageDigestMirrorSets()
@@ -47,14 +64,15 @@ func Test_getImportContext(t *testing.T) {
 	}()
 
 	for _, tt := range []struct {
-		creds   []byte
-		err     string
-		name    string
-		pass    string
-		ref     *reference.DockerImageReference
-		req     bool
-		secrets []corev1.Secret
-		user    string
+		creds      []byte
+		err        string
+		name       string
+		pass       string
+		pullSecret string
+		ref        *reference.DockerImageReference
+		req        bool
+		secrets    []corev1.Secret
+		user       string
 	}{
 		{
 			name: "context without http request",
@@ -111,6 +129,53 @@ func Test_getImportContext(t *testing.T) {
 			user: "useronsecret",
 			pass: "passonsecret",
 		},
+		{
+			name: "pull secret selected by tag",
+			ref: &reference.DockerImageReference{
+				Name:     "192.168.122.19:8000/test",
+				Registry: "192.168.122.19:8000",
+			},
+			req:        true,
+			pullSecret: "team-b",
+			secrets: []corev1.Secret{
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "team-a"},
+					Type:       corev1.SecretTypeDockerConfigJson,
+					Data: map[string][]byte{
+						".dockerconfigjson": []byte(`{"auths":{"192.168.122.19:8000":{"auth":"dGVhbWE6cGFzc2E="}}}`),
+					},
+				},
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "team-b"},
+					Type:       corev1.SecretTypeDockerConfigJson,
+					Data: map[string][]byte{
+						".dockerconfigjson": []byte(`{"auths":{"192.168.122.19:8000":{"auth":"dGVhbWI6cGFzc2I="}}}`),
+					},
+				},
+			},
+			user: "teamb",
+			pass: "passb",
+		},
+		{
+			name: "unknown pull secret",
+			ref: &reference.DockerImageReference{
+				Name:     "192.168.122.19:8000/test",
+				Registry: "192.168.122.19:8000",
+			},
+			req:        true,
+			pullSecret: "team-c",
+			secrets: []corev1.Secret{
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "team-a"},
+					Type:       corev1.SecretTypeDockerConfigJson,
+					Data: map[string][]byte{
+						".dockerconfigjson": []byte(`{"auths":{"192.168.122.19:8000":{"auth":"dGVhbWE6cGFzc2E="}}}`),
+					},
+				},
+			},
+			user: "teama",
+			pass: "passa",
+		},
 		{
 			name: "no credentials",
 			ref: &reference.DockerImageReference{
@@ -144,7 +209,7 @@ func Test_getImportContext(t *testing.T) {
 			}
 
 			retriever, err := getImportContext(
-				ctx, tt.ref, tt.secrets, &mockMetricsPullThrough{}, icsp, idms, itms,
+				ctx, tt.ref, tt.secrets, tt.pullSecret, &mockMetricsPullThrough{}, icsp, idms, itms, nil, nil, nil,
 			)
 			if err != nil {
 				if len(tt.err) == 0 {
@@ -0,0 +1,250 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/distribution/distribution/v3/configuration"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/opencontainers/go-digest"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+	registryconfig "github.com/openshift/image-registry/pkg/dockerregistry/server/configuration"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/coordination"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/metrics"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/prune"
+	regstorage "github.com/openshift/image-registry/pkg/dockerregistry/server/storage"
+)
+
+// watermarkPruner periodically checks the usage of the storage. When the
+// usage exceeds the high watermark, it deletes the blobs that are not used
+// by images, starting with the least recently pulled ones, until the usage is
+// below the low watermark. The pruner runs only on the leader of the
+// replicas.
+type watermarkPruner struct {
+	high       registryconfig.Watermark
+	low        registryconfig.Watermark
+	interval   time.Duration
+	minBlobAge time.Duration
+
+	// volumeUsage returns the used bytes and the capacity of the volume with
+	// the storage. If it is nil, the usage is the size of all blobs and the
+	// capacity is unknown.
+	volumeUsage func() (int64, int64, error)
+
+	// unusedBlobs returns the blobs that are not used by images and the
+	// total size of all blobs.
+	unusedBlobs func(ctx context.Context) ([]prune.BlobInfo, int64, error)
+
+	// blobsInUse returns the blobs that are used by images. The blobs are
+	// checked again before they are deleted, as the images may be created
+	// while the storage is enumerated.
+	blobsInUse func(ctx context.Context) (map[string]string, error)
+
+	// mergePulls merges the pulls from other replicas.
+	mergePulls func(ctx context.Context)
+
+	// deleteBlob deletes the blob and its layer links from the storage.
+	deleteBlob func(ctx context.Context, blob prune.BlobInfo) error
+
+	pulls   *blobPulls
+	metrics metrics.WatermarkPruning
+	events  *eventRecorder
+	now     func() time.Time
+
+	// state keeps the schedule when the leadership moves to another
+	// replica. It is nil if the replicas don't coordinate.
+	state *coordination.State
+}
+
+// newWatermarkPruner returns the pruner of the storage for the configuration
+// of app. The usage of the volume is checked for the filesystem storage
+// driver, for other drivers it is the size of all blobs.
+func (app *App) newWatermarkPruner(ctx context.Context, storage configuration.Storage, c client.Interface) (*watermarkPruner, error) {
+	cfg := app.config.Pruning
+
+	// The watermarks are validated by the configuration parser.
+	high, err := registryconfig.ParseWatermark(cfg.HighWatermark)
+	if err != nil {
+		return nil, err
+	}
+	low, err := registryconfig.ParseWatermark(cfg.LowWatermark)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &watermarkPruner{
+		high:       high,
+		low:        low,
+		interval:   cfg.Interval,
+		minBlobAge: cfg.MinBlobAge,
+		unusedBlobs: func(ctx context.Context) ([]prune.BlobInfo, int64, error) {
+			return prune.UnusedBlobs(ctx, app.driver, app.registry, app.registryClient)
+		},
+		blobsInUse: func(ctx context.Context) (map[string]string, error) {
+			return prune.BlobsInUse(ctx, app.registryClient)
+		},
+		mergePulls: func(ctx context.Context) {
+			mergeBlobPulls(ctx, app.driver, app.blobPulls, blobPullsStaleAge)
+		},
+		pulls:   app.blobPulls,
+		metrics: app.metrics.WatermarkPruning(),
+		now:     time.Now,
+	}
+
+	if root, ok := filesystemRootDirectory(storage); ok {
+		p.volumeUsage = func() (int64, int64, error) {
+			return volumeUsage(root)
+		}
+	} else if high.Percent > 0 {
+		return nil, fmt.Errorf("the watermarks in percent are supported only by the %s storage driver", filesystemDriverName)
+	}
+
+	// The blobs are deleted immediately even if the trash is enabled, as
+	// the pruning has to free the space. The layer links are deleted first,
+	// so that the repositories don't refer to the data that is deleted.
+	pruner := &prune.RegistryPruner{StorageDriver: app.driver}
+	p.deleteBlob = func(ctx context.Context, blob prune.BlobInfo) error {
+		for _, repo := range blob.Repositories {
+			if err := regstorage.DeleteLayerLink(ctx, app.driver, repo, blob.Digest); err != nil {
+				return fmt.Errorf("failed to delete the layer link %s@%s: %w", repo, blob.Digest, err)
+			}
+		}
+		if err := pruner.DeleteBlob(ctx, blob.Digest); err != nil {
+			return err
+		}
+		if err := app.cache.Remove(blob.Digest); err != nil {
+			dcontext.GetLogger(ctx).Warnf("unable to remove the blob %s from the cache: %v", blob.Digest, err)
+		}
+		return nil
+	}
+
+	p.events, err = app.newEventRecorder(c)
+	if err != nil {
+		dcontext.GetLogger(ctx).Warnf("events of the watermark pruning are disabled: %v", err)
+	}
+
+	return p, nil
+}
+
+// Run checks the usage of the storage every interval until ctx is done.
+func (p *watermarkPruner) Run(ctx context.Context) {
+	dcontext.GetLogger(ctx).Infof("starting check of the storage usage every %s", p.interval)
+	p.state.Every(ctx, "watermarkpruning", p.interval, p.check)
+}
+
+func (p *watermarkPruner) check(ctx context.Context) {
+	var blobs []prune.BlobInfo
+	var used, capacity int64
+	var err error
+	if p.volumeUsage != nil {
+		used, capacity, err = p.volumeUsage()
+	} else {
+		blobs, used, err = p.unusedBlobs(ctx)
+	}
+	if err != nil {
+		dcontext.GetLogger(ctx).Errorf("watermark pruning: unable to get the usage of the storage: %v", err)
+		return
+	}
+	p.metrics.Usage(used)
+
+	high, low := p.high.Size(capacity), p.low.Size(capacity)
+	if used <= high {
+		dcontext.GetLogger(ctx).Debugf("watermark pruning: the usage %d is below the high watermark %d", used, high)
+		return
+	}
+
+	dcontext.GetLogger(ctx).Warnf("watermark pruning: the usage %d exceeds the high watermark %d, pruning unused blobs", used, high)
+	p.events.Eventf(ctx, corev1.EventTypeWarning, "StorageHighWatermarkExceeded", "The usage of the storage %d exceeds the high watermark %d, pruning unused blobs", used, high)
+	p.metrics.Started()
+
+	if p.mergePulls != nil {
+		p.mergePulls(ctx)
+	}
+
+	if p.volumeUsage != nil {
+		blobs, _, err = p.unusedBlobs(ctx)
+		if err != nil {
+			dcontext.GetLogger(ctx).Errorf("watermark pruning: unable to get unused blobs: %v", err)
+			return
+		}
+	}
+
+	count, size := p.prune(ctx, blobs, used-low)
+	used -= size
+	p.metrics.Usage(used)
+
+	dcontext.GetLogger(ctx).Infof("watermark pruning: deleted %d blobs (%d bytes)", count, size)
+	if used > low {
+		p.events.Eventf(ctx, corev1.EventTypeWarning, "StorageLowWatermarkNotReached", "Pruned %d unused blobs (%d bytes), the usage of the storage %d is still above the low watermark %d", count, size, used, low)
+	} else {
+		p.events.Eventf(ctx, corev1.EventTypeNormal, "StoragePruned", "Pruned %d unused blobs (%d bytes), the usage of the storage is %d", count, size, used)
+	}
+}
+
+// prune deletes the least recently used blobs until at least target bytes
+// are freed. It returns the number and the size of the deleted blobs. The
+// blobs that were pushed or pulled within minBlobAge are kept, as they may be
+// used by the manifests that are being pushed.
+func (p *watermarkPruner) prune(ctx context.Context, blobs []prune.BlobInfo, target int64) (int, int64) {
+	now := p.now()
+
+	inuse, err := p.blobsInUse(ctx)
+	if err != nil {
+		dcontext.GetLogger(ctx).Errorf("watermark pruning: unable to get the blobs in use: %v", err)
+		return 0, 0
+	}
+
+	unused := make(map[digest.Digest]bool, len(blobs))
+	type candidate struct {
+		prune.BlobInfo
+		lastUsed time.Time
+	}
+	var candidates []candidate
+	for _, blob := range blobs {
+		unused[blob.Digest] = true
+		lastUsed := blob.ModTime
+		if t, ok := p.pulls.LastPull(blob.Digest); ok && t.After(lastUsed) {
+			lastUsed = t
+		}
+		if now.Sub(lastUsed) < p.minBlobAge {
+			continue
+		}
+		if imageReference, ok := inuse[string(blob.Digest)]; ok {
+			dcontext.GetLogger(ctx).Debugf("watermark pruning: the blob %s is used by the new image %s", blob.Digest, imageReference)
+			continue
+		}
+		candidates = append(candidates, candidate{BlobInfo: blob, lastUsed: lastUsed})
+	}
+
+	// The pulls of the blobs that are no longer in the storage are not
+	// needed.
+	p.pulls.Retain(func(dgst digest.Digest) bool {
+		_, ok := inuse[string(dgst)]
+		return ok || unused[dgst]
+	})
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].lastUsed.Before(candidates[j].lastUsed)
+	})
+
+	var count int
+	var size int64
+	for _, c := range candidates {
+		if size >= target {
+			break
+		}
+		if err := p.deleteBlob(ctx, c.BlobInfo); err != nil {
+			dcontext.GetLogger(ctx).Errorf("watermark pruning: %v", err)
+			continue
+		}
+		p.pulls.Forget(c.Digest)
+		p.metrics.BlobPruned()
+		count++
+		size += c.Size
+	}
+	return count, size
+}
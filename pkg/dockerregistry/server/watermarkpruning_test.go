@@ -0,0 +1,279 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
+	corev1 "k8s.io/api/core/v1"
+
+	registryconfig "github.com/openshift/image-registry/pkg/dockerregistry/server/configuration"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/metrics"
+	metricstesting "github.com/openshift/image-registry/pkg/dockerregistry/server/metrics/testing"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/prune"
+	"github.com/openshift/image-registry/pkg/testutil"
+)
+
+func TestWatermarkPruner(t *testing.T) {
+	ctx := testutil.WithTestLogger(context.Background(), t)
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	blob := func(n int, size int64, age time.Duration) prune.BlobInfo {
+		return prune.BlobInfo{
+			Digest:  digest.FromString(fmt.Sprint(n)),
+			Size:    size,
+			ModTime: now.Add(-age),
+		}
+	}
+	blobs := []prune.BlobInfo{
+		blob(0, 100, 72*time.Hour),
+		blob(1, 100, 48*time.Hour),
+		blob(2, 100, 24*time.Hour),
+		blob(3, 100, 10*time.Minute), // too young
+		blob(4, 100, 96*time.Hour),
+	}
+
+	for _, tc := range []struct {
+		name     string
+		used     int64
+		pulls    map[int]time.Duration
+		inuse    []int
+		deleted  []int
+		failures map[int]bool
+		event    string
+	}{
+		{
+			name:  "below high watermark",
+			used:  800,
+			event: "",
+		},
+		{
+			name:    "oldest blobs first",
+			used:    950,
+			deleted: []int{4, 0, 1},
+			event:   "StoragePruned",
+		},
+		{
+			name:    "recently pulled blobs last",
+			used:    950,
+			pulls:   map[int]time.Duration{4: 2 * time.Hour, 0: 3 * time.Hour},
+			deleted: []int{1, 2, 0},
+			event:   "StoragePruned",
+		},
+		{
+			name:    "blobs pulled within minblobage are kept",
+			used:    950,
+			pulls:   map[int]time.Duration{4: time.Minute},
+			deleted: []int{0, 1, 2},
+			event:   "StoragePruned",
+		},
+		{
+			name:    "blobs of new images are kept",
+			used:    950,
+			inuse:   []int{4, 1},
+			deleted: []int{0, 2},
+			event:   "StorageLowWatermarkNotReached",
+		},
+		{
+			name:     "failed deletions are skipped",
+			used:     950,
+			failures: map[int]bool{0: true},
+			deleted:  []int{4, 1, 2},
+			event:    "StoragePruned",
+		},
+		{
+			name:     "young blobs are kept",
+			used:     1000,
+			failures: map[int]bool{0: true, 1: true},
+			deleted:  []int{4, 2},
+			event:    "StorageLowWatermarkNotReached",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ec := &eventsClient{}
+			c, s := metricstesting.NewCounterSink()
+
+			pulls := newBlobPulls()
+			for n, ago := range tc.pulls {
+				pulls.now = func() time.Time { return now.Add(-ago) }
+				pulls.Record(blobs[n].Digest)
+			}
+			gone := digest.FromString("gone")
+			pulls.Record(gone)
+
+			inuse := make(map[string]string)
+			for _, n := range tc.inuse {
+				inuse[string(blobs[n].Digest)] = fmt.Sprintf("ns/app@%s", blobs[n].Digest)
+			}
+			merged := false
+
+			var deleted []int
+			p := &watermarkPruner{
+				high:       registryconfig.Watermark{Percent: 90},
+				low:        registryconfig.Watermark{Percent: 70},
+				minBlobAge: time.Hour,
+				volumeUsage: func() (int64, int64, error) {
+					return tc.used, 1000, nil
+				},
+				unusedBlobs: func(ctx context.Context) ([]prune.BlobInfo, int64, error) {
+					return blobs, 0, nil
+				},
+				blobsInUse: func(ctx context.Context) (map[string]string, error) {
+					return inuse, nil
+				},
+				mergePulls: func(ctx context.Context) {
+					merged = true
+				},
+				deleteBlob: func(ctx context.Context, blob prune.BlobInfo) error {
+					dgst := blob.Digest
+					for n, b := range blobs {
+						if b.Digest == dgst {
+							if tc.failures[n] {
+								return fmt.Errorf("failed to delete the blob %s", dgst)
+							}
+							deleted = append(deleted, n)
+						}
+					}
+					return nil
+				},
+				pulls:   pulls,
+				metrics: metrics.NewMetrics(s).WatermarkPruning(),
+				events:  newEventRecorder(ec, "openshift-image-registry", "image-registry-1"),
+				now:     func() time.Time { return now },
+			}
+			p.check(ctx)
+
+			if !reflect.DeepEqual(deleted, tc.deleted) {
+				t.Errorf("got deleted blobs %v, want %v", deleted, tc.deleted)
+			}
+			if got := c.Values()["storage_pruned_blobs"]; got != len(tc.deleted) {
+				t.Errorf("got %d pruned blobs in metrics, want %d", got, len(tc.deleted))
+			}
+			if expected := tc.used - int64(100*len(tc.deleted)); c.Values()["storage_usage"] != int(expected) {
+				t.Errorf("got usage %d in metrics, want %d", c.Values()["storage_usage"], expected)
+			}
+			for _, n := range tc.deleted {
+				if _, ok := pulls.LastPull(blobs[n].Digest); ok {
+					t.Errorf("expected the pull of the deleted blob %d to be forgotten", n)
+				}
+			}
+			if _, ok := pulls.LastPull(gone); ok == (tc.event != "") {
+				t.Errorf("got the pull of the blob that is not in the storage %t, want it to be forgotten by the pruning", ok)
+			}
+			if merged != (tc.event != "") {
+				t.Errorf("got the pulls merged %t, want them to be merged before the pruning", merged)
+			}
+
+			expectedEvents := 0
+			if tc.event != "" {
+				expectedEvents = 2
+			}
+			events := ec.wait(t, "openshift-image-registry", expectedEvents)
+			var reasons []string
+			for _, e := range events {
+				if e.InvolvedObject.Name != "image-registry-1" {
+					t.Errorf("unexpected involved object of the event %s: %+v", e.Reason, e.InvolvedObject)
+				}
+				if e.Reason != "StorageHighWatermarkExceeded" {
+					reasons = append(reasons, e.Reason)
+				} else if e.Type != corev1.EventTypeWarning {
+					t.Errorf("unexpected type of the event %s: %s", e.Reason, e.Type)
+				}
+			}
+			if tc.event == "" && len(events) != 0 {
+				t.Errorf("unexpected events: %v", events)
+			}
+			if tc.event != "" && (len(events) != 2 || !reflect.DeepEqual(reasons, []string{tc.event})) {
+				t.Errorf("got events %v, want StorageHighWatermarkExceeded and %s", reasons, tc.event)
+			}
+		})
+	}
+}
+
+func TestBlobPullsMerge(t *testing.T) {
+	dgst1 := digest.FromString("1")
+	dgst2 := digest.FromString("2")
+	t1 := time.Unix(1000, 0)
+	t2 := time.Unix(2000, 0)
+
+	a := newBlobPulls()
+	a.now = func() time.Time { return t1 }
+	a.Record(dgst1)
+	a.now = func() time.Time { return t2 }
+	a.Record(dgst2)
+
+	b := newBlobPulls()
+	b.now = func() time.Time { return t2 }
+	b.Record(dgst1)
+	b.now = func() time.Time { return t1 }
+	b.Record(dgst2)
+
+	snapshot, err := b.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Merge(snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		dgst     digest.Digest
+		expected time.Time
+	}{
+		{dgst: dgst1, expected: t2},
+		{dgst: dgst2, expected: t2},
+	} {
+		if got, ok := a.LastPull(tc.dgst); !ok || !got.Equal(tc.expected) {
+			t.Errorf("%s: got last pull %s (%t), want %s", tc.dgst, got, ok, tc.expected)
+		}
+	}
+}
+
+func TestMergeBlobPulls(t *testing.T) {
+	ctx := testutil.WithTestLogger(context.Background(), t)
+	driver := inmemory.New()
+
+	dgst := digest.FromString("1")
+	replica := newBlobPulls()
+	replica.now = func() time.Time { return time.Unix(1000, 0) }
+	replica.Record(dgst)
+	snapshot, err := replica.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, identity := range []string{"replica-1", "replica-2"} {
+		if err := driver.PutContent(ctx, blobPullsSnapshotPath(identity), snapshot); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The snapshots are kept on startup.
+	pulls := newBlobPulls()
+	pulls.now = func() time.Time { return time.Now().Add(2 * blobPullsStaleAge) }
+	mergeBlobPulls(ctx, driver, pulls, 0)
+	if paths, _ := driver.List(ctx, blobPullsDir); len(paths) != 2 {
+		t.Errorf("got snapshots %v, want both of them to be kept", paths)
+	}
+
+	pulls.now = time.Now
+	mergeBlobPulls(ctx, driver, pulls, blobPullsStaleAge)
+	if last, ok := pulls.LastPull(dgst); !ok || last.Unix() != 1000 {
+		t.Errorf("got last pull %s (%t), want the time from the snapshots", last, ok)
+	}
+	if paths, _ := driver.List(ctx, blobPullsDir); len(paths) != 2 {
+		t.Errorf("got snapshots %v, want the fresh snapshots to be kept", paths)
+	}
+
+	pulls.now = func() time.Time { return time.Now().Add(2 * blobPullsStaleAge) }
+	mergeBlobPulls(ctx, driver, pulls, blobPullsStaleAge)
+	if paths, err := driver.List(ctx, blobPullsDir); len(paths) != 0 {
+		t.Errorf("got snapshots %v (%v), want the stale snapshots to be removed", paths, err)
+	}
+	if _, ok := pulls.LastPull(dgst); !ok {
+		t.Error("expected the pulls of the removed snapshots to be kept")
+	}
+}
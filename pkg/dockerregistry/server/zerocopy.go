@@ -0,0 +1,143 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/configuration"
+	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	filesystemDriverName = "filesystem"
+
+	// defaultFilesystemRootDirectory is the root directory of the filesystem
+	// storage driver if it's not configured.
+	defaultFilesystemRootDirectory = "/var/lib/registry"
+
+	// blobCacheControlMaxAge is the max-age of the Cache-Control header that
+	// the distribution blob server sets for blobs.
+	blobCacheControlMaxAge = 365 * 24 * time.Hour
+)
+
+// zeroCopyHandler makes the response writer of the connection available to
+// the blob stores. The distribution application wraps the response writer
+// into writers that hide its ReadFrom method, so http.ServeContent would
+// copy the data through a buffer instead of using sendfile.
+type zeroCopyHandler struct {
+	handler http.Handler
+}
+
+func newZeroCopyHandler(handler http.Handler) http.Handler {
+	return &zeroCopyHandler{
+		handler: handler,
+	}
+}
+
+func (h *zeroCopyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if rf, ok := w.(io.ReaderFrom); ok {
+		r = r.WithContext(withConnectionWriter(r.Context(), rf))
+	}
+	h.handler.ServeHTTP(w, r)
+}
+
+// zeroCopyResponseWriter writes the headers through the response writer of
+// the handler, so that they are seen by the distribution application, and
+// sends the content directly to the connection.
+//
+// The bytes sent by ReadFrom are not counted by the distribution application,
+// so they are missing in the http.response.written field of its logs. They
+// are reported to the wrapped response writer if it is a sentBytesCounter.
+type zeroCopyResponseWriter struct {
+	http.ResponseWriter
+	conn io.ReaderFrom
+}
+
+func (w *zeroCopyResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	n, err := w.conn.ReadFrom(r)
+	if c, ok := w.ResponseWriter.(sentBytesCounter); ok {
+		c.countSent(n)
+	}
+	return n, err
+}
+
+// filesystemRootDirectory returns the root directory of the filesystem storage
+// driver, or false if the registry uses another driver.
+func filesystemRootDirectory(storage configuration.Storage) (string, bool) {
+	if storage.Type() != filesystemDriverName {
+		return "", false
+	}
+	if root, ok := storage.Parameters()["rootdirectory"]; ok && root != nil {
+		if s := fmt.Sprint(root); len(s) > 0 {
+			return s, true
+		}
+	}
+	return defaultFilesystemRootDirectory, true
+}
+
+// zeroCopyBlobStore serves the blobs of the filesystem storage driver with
+// http.ServeContent on the blob file. It allows the kernel to send the file
+// to the client without copying it through the registry.
+type zeroCopyBlobStore struct {
+	distribution.BlobStore
+
+	rootDirectory string
+}
+
+var _ distribution.BlobStore = &zeroCopyBlobStore{}
+
+// blobDataPath returns the path of the data of the blob dgst on the filesystem.
+// It matches the layout of the distribution storage.
+func (bs *zeroCopyBlobStore) blobDataPath(dgst digest.Digest) string {
+	return filepath.Join(bs.rootDirectory, "docker", "registry", "v2", "blobs", dgst.Algorithm().String(), dgst.Hex()[:2], dgst.Hex(), "data")
+}
+
+// ServeBlob serves the blob from its file. The blob is served by the wrapped
+// blob store if it is unknown to the repository or if the file can't be
+// opened.
+func (bs *zeroCopyBlobStore) ServeBlob(ctx context.Context, w http.ResponseWriter, req *http.Request, dgst digest.Digest) error {
+	desc, err := bs.BlobStore.Stat(ctx, dgst)
+	if err != nil {
+		return bs.BlobStore.ServeBlob(ctx, w, req, dgst)
+	}
+	if err := desc.Digest.Validate(); err != nil {
+		return bs.BlobStore.ServeBlob(ctx, w, req, dgst)
+	}
+
+	f, err := os.Open(bs.blobDataPath(desc.Digest))
+	if err != nil {
+		dcontext.GetLogger(ctx).Warnf("unable to open the file of the blob %s, falling back to the storage driver: %v", desc.Digest, err)
+		return bs.BlobStore.ServeBlob(ctx, w, req, dgst)
+	}
+	defer f.Close()
+
+	if req.Method == http.MethodGet {
+		if err := adviseSequentialRead(f); err != nil {
+			dcontext.GetLogger(ctx).Debugf("unable to advise the kernel about the reads of the blob %s: %v", desc.Digest, err)
+		}
+	}
+
+	w.Header().Set("ETag", fmt.Sprintf(`"%s"`, desc.Digest)) // If-None-Match handled by ServeContent
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%.f", blobCacheControlMaxAge.Seconds()))
+	if w.Header().Get("Docker-Content-Digest") == "" {
+		w.Header().Set("Docker-Content-Digest", desc.Digest.String())
+	}
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", desc.MediaType)
+	}
+
+	if conn, ok := connectionWriterFrom(ctx); ok {
+		w = &zeroCopyResponseWriter{ResponseWriter: w, conn: conn}
+	}
+
+	dcontext.GetLogger(ctx).Debugf("(*zeroCopyBlobStore).ServeBlob: serving blob %s from %s", desc.Digest, f.Name())
+	http.ServeContent(w, req, desc.Digest.String(), time.Time{}, f)
+	return nil
+}
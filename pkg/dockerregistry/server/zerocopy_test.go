@@ -0,0 +1,170 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/storage"
+	"github.com/distribution/distribution/v3/registry/storage/driver/filesystem"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/openshift/image-registry/pkg/testutil"
+)
+
+func newFilesystemBlobStore(ctx context.Context, t testing.TB, root string) distribution.BlobStore {
+	driver, err := filesystem.FromParameters(map[string]interface{}{"rootdirectory": root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry, err := storage.NewRegistry(ctx, driver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	named, err := reference.WithName("user/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo, err := registry.Repository(ctx, named)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return repo.Blobs(ctx)
+}
+
+// newBlobServer returns a server that serves the blob dgst of bs on every
+// request.
+func newBlobServer(ctx context.Context, bs distribution.BlobStore, dgst digest.Digest, errs chan<- error) *httptest.Server {
+	return httptest.NewServer(newZeroCopyHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := bs.ServeBlob(r.Context(), w, r, dgst); err != nil {
+			errs <- err
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})))
+}
+
+func TestZeroCopyBlobStore(t *testing.T) {
+	ctx := context.Background()
+	ctx = testutil.WithTestLogger(ctx, t)
+
+	root := t.TempDir()
+	blobStore := newFilesystemBlobStore(ctx, t, root)
+	content := bytes.Repeat([]byte("layer"), 1000)
+	desc, err := blobStore.Put(ctx, "application/octet-stream", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bs := &zeroCopyBlobStore{
+		BlobStore:     blobStore,
+		rootDirectory: root,
+	}
+	errs := make(chan error, 1)
+	server := newBlobServer(ctx, bs, desc.Digest, errs)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if !bytes.Equal(body, content) {
+		t.Errorf("got %d bytes, want the blob of %d bytes", len(body), len(content))
+	}
+	if dgst := resp.Header.Get("Docker-Content-Digest"); dgst != desc.Digest.String() {
+		t.Errorf("got Docker-Content-Digest %q, want %q", dgst, desc.Digest)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Range", "bytes=5-9")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusPartialContent || string(body) != "layer" {
+		t.Errorf("got %d %q for the range request, want %d %q", resp.StatusCode, body, http.StatusPartialContent, "layer")
+	}
+
+	unknown := newBlobServer(ctx, bs, digest.FromString("unknown"), errs)
+	defer unknown.Close()
+	resp, err = http.Get(unknown.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if err := <-errs; err != distribution.ErrBlobUnknown {
+		t.Errorf("got error %v for an unknown blob, want %v", err, distribution.ErrBlobUnknown)
+	}
+}
+
+func BenchmarkServeBlob(b *testing.B) {
+	ctx := context.Background()
+
+	root := b.TempDir()
+	blobStore := newFilesystemBlobStore(ctx, b, root)
+	content := bytes.Repeat([]byte("0123456789abcdef"), 4<<20)
+	desc, err := blobStore.Put(ctx, "application/octet-stream", content)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, bc := range []struct {
+		name string
+		bs   distribution.BlobStore
+	}{
+		{
+			name: "driver",
+			bs:   blobStore,
+		},
+		{
+			name: "zerocopy",
+			bs: &zeroCopyBlobStore{
+				BlobStore:     blobStore,
+				rootDirectory: root,
+			},
+		},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			errs := make(chan error, 1)
+			server := newBlobServer(ctx, bc.bs, desc.Digest, errs)
+			defer server.Close()
+
+			b.SetBytes(desc.Size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				resp, err := http.Get(server.URL)
+				if err != nil {
+					b.Fatal(err)
+				}
+				n, err := io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if n != desc.Size {
+					b.Fatalf("got %d bytes, want %d", n, desc.Size)
+				}
+			}
+		})
+	}
+}
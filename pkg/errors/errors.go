@@ -17,6 +17,12 @@ var (
 		// Otherwise the error message with not be shown by the client.
 		HTTPStatusCode: http.StatusNotFound,
 	})
+
+	ErrorCodePullthroughRegistryBlocked = errcode.Register(errGroup, errcode.ErrorDescriptor{
+		Value:          "OPENSHIFT_PULLTHROUGH_REGISTRY_BLOCKED",
+		Message:        "pulling from %s is not allowed by the cluster image policy %s",
+		HTTPStatusCode: http.StatusForbidden,
+	})
 )
 
 // Error provides a wrapper around error.
@@ -10,6 +10,7 @@ import (
 	imageapiv1 "github.com/openshift/api/image/v1"
 
 	"github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/metrics"
 	rerrors "github.com/openshift/image-registry/pkg/errors"
 	"github.com/openshift/library-go/pkg/quota/quotautil"
 )
@@ -28,9 +29,19 @@ type cachedImageStreamGetter struct {
 	isNamespacer            client.ImageStreamsNamespacer
 	cachedImageStream       *imageapiv1.ImageStream
 	cachedImageStreamLayers *imageapiv1.ImageStreamLayers
+
+	// metrics is optional.
+	metrics metrics.Cache
+}
+
+func (g *cachedImageStreamGetter) request(hit bool) {
+	if g.metrics != nil {
+		g.metrics.Request(hit)
+	}
 }
 
 func (g *cachedImageStreamGetter) get() (*imageapiv1.ImageStream, rerrors.Error) {
+	g.request(g.cachedImageStream != nil)
 	if g.cachedImageStream != nil {
 		return g.cachedImageStream, nil
 	}
@@ -51,6 +62,7 @@ func (g *cachedImageStreamGetter) get() (*imageapiv1.ImageStream, rerrors.Error)
 }
 
 func (g *cachedImageStreamGetter) layers() (*imageapiv1.ImageStreamLayers, rerrors.Error) {
+	g.request(g.cachedImageStreamLayers != nil)
 	if g.cachedImageStreamLayers != nil {
 		return g.cachedImageStreamLayers, nil
 	}
@@ -70,6 +82,25 @@ func (g *cachedImageStreamGetter) layers() (*imageapiv1.ImageStreamLayers, rerro
 	return is, nil
 }
 
+// objectMeta returns the metadata of the cached image stream, or of the
+// cached image stream layers if the image stream hasn't been fetched.
+func (g *cachedImageStreamGetter) objectMeta() *metav1.ObjectMeta {
+	switch {
+	case g.cachedImageStream != nil:
+		return &g.cachedImageStream.ObjectMeta
+	case g.cachedImageStreamLayers != nil:
+		return &g.cachedImageStreamLayers.ObjectMeta
+	}
+	return nil
+}
+
 func (g *cachedImageStreamGetter) cacheImageStream(is *imageapiv1.ImageStream) {
 	g.cachedImageStream = is
 }
+
+// invalidate drops the cached image stream and its layers, so that they are
+// fetched again when they are needed.
+func (g *cachedImageStreamGetter) invalidate() {
+	g.cachedImageStream = nil
+	g.cachedImageStreamLayers = nil
+}
@@ -2,6 +2,7 @@ package imagestream
 
 import (
 	"sort"
+	"strings"
 
 	imageapiv1 "github.com/openshift/api/image/v1"
 
@@ -62,6 +63,9 @@ func identifyCandidateRepositories(
 	// maps registry to insecure flag
 	insecureRegistries := make(map[string]bool)
 
+	// maps repository to the name of its preferred pull secret
+	pullSecrets := make(map[string]string)
+
 	// identify the canonical location of referenced registries to search
 	search := make(map[string]*reference.DockerImageReference)
 	for _, tagEvent := range is.Status.Tags {
@@ -89,10 +93,14 @@ func identifyCandidateRepositories(
 				continue
 			}
 			ref = ref.DockerClientDefaults()
+			repo := ref.AsRepository().Exact()
 			insecure := insecureByDefault
 			for _, t := range is.Spec.Tags {
 				if t.Name == tag {
 					insecure = insecureByDefault || t.ImportPolicy.Insecure
+					if secret := strings.TrimSpace(t.Annotations[PullSecretAnnotation]); len(secret) > 0 && len(pullSecrets[repo]) == 0 {
+						pullSecrets[repo] = secret
+					}
 					break
 				}
 			}
@@ -100,7 +108,7 @@ func identifyCandidateRepositories(
 				insecureRegistries[ref.Registry] = insecure
 			}
 
-			search[ref.AsRepository().Exact()] = &ref
+			search[repo] = &ref
 		}
 	}
 
@@ -113,6 +121,7 @@ func identifyCandidateRepositories(
 		spec := ImagePullthroughSpec{
 			DockerImageReference: ref,
 			Insecure:             insecureRegistries[ref.Registry],
+			PullSecret:           pullSecrets[repo],
 		}
 		results[repo] = spec
 		specs = append(specs, &spec)
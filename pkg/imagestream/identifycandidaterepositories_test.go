@@ -88,6 +88,43 @@ func TestIdentifyCandidateRepositories(t *testing.T) {
 			},
 		},
 
+		{
+			name: "pull secret of a tag",
+			is: &imageapiv1.ImageStream{
+				Spec: imageapiv1.ImageStreamSpec{
+					Tags: []imageapiv1.TagReference{
+						{
+							Name:        "team-a",
+							Annotations: map[string]string{PullSecretAnnotation: "team-a-pull"},
+						},
+					},
+				},
+				Status: imageapiv1.ImageStreamStatus{
+					Tags: []imageapiv1.NamedTagEventList{
+						{
+							Tag:   "team-a",
+							Items: []imageapiv1.TagEvent{{DockerImageReference: "registry.example.org/team-a/app:v1"}},
+						},
+						{
+							Tag:   "team-b",
+							Items: []imageapiv1.TagEvent{{DockerImageReference: "registry.example.org/team-b/app:v1"}},
+						},
+					},
+				},
+			},
+			localRegistry:        "localhost:5000",
+			primary:              true,
+			expectedRepositories: []string{"registry.example.org/team-a/app", "registry.example.org/team-b/app"},
+			expectedSearch: map[string]ImagePullthroughSpec{
+				"registry.example.org/team-a/app": func() ImagePullthroughSpec {
+					spec := makeTestImagePullthroughSpec(t, "registry.example.org/team-a/app:v1", false)
+					spec.PullSecret = "team-a-pull"
+					return spec
+				}(),
+				"registry.example.org/team-b/app": makeTestImagePullthroughSpec(t, "registry.example.org/team-b/app:v1", false),
+			},
+		},
+
 		{
 			name: "search secondary results in insecure image stream",
 			is: &imageapiv1.ImageStream{
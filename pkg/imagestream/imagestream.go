@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"path"
+	"strconv"
 	"strings"
 
 	dcontext "github.com/distribution/distribution/v3/context"
@@ -17,6 +19,7 @@ import (
 	imageapiv1 "github.com/openshift/api/image/v1"
 
 	"github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/metrics"
 	rerrors "github.com/openshift/image-registry/pkg/errors"
 	util "github.com/openshift/image-registry/pkg/origin-common/util"
 	"github.com/openshift/library-go/pkg/image/reference"
@@ -31,6 +34,26 @@ const (
 	ErrImageStreamForbiddenCode     = ErrImageStreamCode + "Forbidden"
 )
 
+// SignaturePolicyAnnotation is an image stream annotation with a
+// comma-separated list of names of the public keys that must have signed the
+// images pulled from the image stream.
+const SignaturePolicyAnnotation = "imageregistry.openshift.io/signature-policy"
+
+// ImmutableTagsAnnotation is an image stream annotation with a
+// comma-separated list of glob patterns of tags that cannot be moved to
+// another image once they exist.
+const ImmutableTagsAnnotation = "image.openshift.io/immutable-tags"
+
+// StorageLimitAnnotation is an image stream annotation with the maximum
+// number of bytes that the blobs linked to the repository of the image stream
+// may use.
+const StorageLimitAnnotation = "image.openshift.io/storage-limit-bytes"
+
+// PullSecretAnnotation is an image stream tag annotation with the name of the
+// secret that should be used to pull the images of the tag through from the
+// remote registry.
+const PullSecretAnnotation = "imageregistry.openshift.io/pull-secret"
+
 // ProjectObjectListStore represents a cache of objects indexed by a project name.
 // Used to store a list of items per namespace.
 type ProjectObjectListStore interface {
@@ -43,6 +66,9 @@ type ProjectObjectListStore interface {
 type ImagePullthroughSpec struct {
 	DockerImageReference *reference.DockerImageReference
 	Insecure             bool
+	// PullSecret is the name of the secret preferred for the repository, if
+	// any.
+	PullSecret string
 }
 
 type ImageStream interface {
@@ -50,16 +76,30 @@ type ImageStream interface {
 	Exists(ctx context.Context) (bool, rerrors.Error)
 
 	GetImageOfImageStream(ctx context.Context, dgst digest.Digest) (*imageapiv1.Image, rerrors.Error)
+	GetSourceImageOfImageStream(ctx context.Context, dgst digest.Digest) (*imageapiv1.Image, rerrors.Error)
 	CreateImageStreamMapping(ctx context.Context, userClient client.Interface, tag string, image *imageapiv1.Image) rerrors.Error
 	ResolveImageID(ctx context.Context, dgst digest.Digest) (*imageapiv1.TagEvent, rerrors.Error)
 
 	HasBlob(ctx context.Context, dgst digest.Digest) (bool, *imageapiv1.ImageStreamLayers, *imageapiv1.Image)
+	Layers(ctx context.Context) (*imageapiv1.ImageStreamLayers, rerrors.Error)
 	IdentifyCandidateRepositories(ctx context.Context, primary bool) ([]string, map[string]ImagePullthroughSpec, rerrors.Error)
 	GetLimitRangeList(ctx context.Context, cache ProjectObjectListStore) (*corev1.LimitRangeList, rerrors.Error)
 	GetSecrets() ([]corev1.Secret, rerrors.Error)
 
 	TagIsInsecure(ctx context.Context, tag string, dgst digest.Digest) (bool, rerrors.Error)
+	TagPullSecret(ctx context.Context, tag string, dgst digest.Digest) (string, rerrors.Error)
 	Tags(ctx context.Context) (map[string]digest.Digest, rerrors.Error)
+	LatestTagEvent(ctx context.Context, tag string) (*imageapiv1.TagEvent, rerrors.Error)
+
+	SignaturePolicy(ctx context.Context) ([]string, rerrors.Error)
+	TagIsImmutable(ctx context.Context, tag string) (bool, rerrors.Error)
+	StorageLimit(ctx context.Context) (int64, rerrors.Error)
+	ManifestListsOf(ctx context.Context, dgst digest.Digest) ([]digest.Digest, rerrors.Error)
+
+	// Generation returns the generation and the resource version of the
+	// image stream that was used while handling the request. It returns
+	// false if the image stream hasn't been fetched yet.
+	Generation() (generation int64, resourceVersion string, ok bool)
 }
 
 type imageStream struct {
@@ -74,6 +114,13 @@ type imageStream struct {
 	// The image stream stays cached for the entire time of handling single
 	// repository-scoped request.
 	imageStreamGetter *cachedImageStreamGetter
+
+	// writeRetries configures the retries of the writes to the API server.
+	writeRetries WriteRetries
+
+	// autoProvisioningDisabled prevents CreateImageStreamMapping from
+	// creating the image stream if it doesn't exist.
+	autoProvisioningDisabled bool
 }
 
 var _ ImageStream = &imageStream{}
@@ -92,6 +139,22 @@ func New(ctx context.Context, namespace, name string, client client.Interface) I
 	}
 }
 
+// NewWithCacheMetrics is like New, but it also reports requests to the cache
+// of the image stream getter to m.
+func NewWithCacheMetrics(ctx context.Context, namespace, name string, client client.Interface, m metrics.Cache) ImageStream {
+	is := New(ctx, namespace, name, client).(*imageStream)
+	is.imageStreamGetter.metrics = m
+	return is
+}
+
+// WithoutAutoProvisioning makes CreateImageStreamMapping of is fail with
+// ErrImageStreamNotFoundCode instead of creating the image stream if it
+// doesn't exist.
+func WithoutAutoProvisioning(is ImageStream) ImageStream {
+	is.(*imageStream).autoProvisioningDisabled = true
+	return is
+}
+
 func (is *imageStream) Reference() string {
 	return fmt.Sprintf("%s/%s", is.namespace, is.name)
 }
@@ -184,14 +247,21 @@ func (is *imageStream) getImageOfImageStream(ctx context.Context, dgst digest.Di
 }
 
 // GetImageOfImageStream retrieves the Image with the given digest for the image
-// stream. The image's field DockerImageReference is modified on the fly to
-// pretend that we've got the image from the source from which the image was
-// tagged to match tag's DockerImageReference.
+// stream. The image's field DockerImageReference is modified on the fly
+// according to the reference policies of the tags that point to the image, as
+// the master API does for image stream tags. If a tag with the Local policy
+// points to the image, the reference points to the image stream in the
+// integrated registry. Otherwise the reference points to the source from which
+// the image was tagged to match tag's DockerImageReference.
 //
 // The layers API is also searched, as a manifest which is part of a manifest
 // list in an image stream will not be available in the image stream history,
 // only its parent manifest list will be found there.
 //
+// If a sub-manifest of a manifest list in the image stream doesn't have an
+// Image object, an unmanaged image without metadata is returned, so that the
+// manifest can be pulled through from the source of the manifest list.
+//
 // If the Image with the given digest is not part of the image stream, a not found
 // error is returned.
 //
@@ -199,30 +269,74 @@ func (is *imageStream) getImageOfImageStream(ctx context.Context, dgst digest.Di
 // not be sent to the master API. If you need unmodified version of the
 // image object, please use getStoredImageOfImageStream.
 func (is *imageStream) GetImageOfImageStream(ctx context.Context, dgst digest.Digest) (*imageapiv1.Image, rerrors.Error) {
+	image, tagged, err := is.getSourceImageOfImageStream(ctx, dgst)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := is.imageStreamGetter.get()
+	if err != nil {
+		return nil, convertImageStreamGetterError(err, fmt.Sprintf("GetImageOfImageStream: failed to get image stream %s", is.Reference()))
+	}
+	if hasLocalTag(stream, tagged) {
+		if ref, ok := localImageReference(stream, dgst); ok {
+			image.DockerImageReference = ref
+		}
+	}
+
+	return image, nil
+}
+
+// GetSourceImageOfImageStream is like GetImageOfImageStream, but the image's
+// field DockerImageReference always points to the source from which the image
+// was tagged, regardless of the reference policy of the tag. It should be used
+// to pull the image through from its source.
+func (is *imageStream) GetSourceImageOfImageStream(ctx context.Context, dgst digest.Digest) (*imageapiv1.Image, rerrors.Error) {
+	image, _, err := is.getSourceImageOfImageStream(ctx, dgst)
+	return image, err
+}
+
+// getSourceImageOfImageStream returns the image dgst with the reference to
+// its source and the digest of the image that is tagged into the image
+// stream, which is the manifest list for sub-manifests.
+func (is *imageStream) getSourceImageOfImageStream(ctx context.Context, dgst digest.Digest) (*imageapiv1.Image, digest.Digest, rerrors.Error) {
 	isImage, err := is.getImageOfImageStream(ctx, dgst)
 	if err == nil {
-		return isImage, nil
+		return isImage, dgst, nil
 	}
 
-	ref, err := is.resolveUpstreamRef(ctx, dgst)
+	ref, parent, err := is.resolveUpstreamRef(ctx, dgst)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	image, err := is.getImage(ctx, dgst)
 	if err != nil {
-		return nil, err
+		if err.Code() != ErrImageStreamImageNotFoundCode {
+			return nil, "", err
+		}
+		// Sub-manifests of imported manifest lists may not have Image
+		// objects. They are still served by pulling them through from the
+		// source repository of their manifest list.
+		dcontext.GetLogger(ctx).Debugf("GetImageOfImageStream: image %s is missing, using the source %s of its manifest list", dgst, ref.Exact())
+		return &imageapiv1.Image{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: dgst.String(),
+			},
+			DockerImageReference: ref.String(),
+		}, parent, nil
 	}
 
 	// We don't want to mutate the origial image object, which we've got by reference.
 	img := *image
 	img.DockerImageReference = ref.String()
 
-	return &img, nil
+	return &img, parent, nil
 }
 
 // resolveUpstreamRef returns an image reference for an image with the given
-// digest that can be used to pull the image from the upstream repository.
+// digest that can be used to pull the image from the upstream repository, and
+// the digest of its parent image.
 //
 // It uses the image layers API to find the parent image, and then finds the
 // upstream repository for the parent image in the image stream.
@@ -230,10 +344,10 @@ func (is *imageStream) GetImageOfImageStream(ctx context.Context, dgst digest.Di
 // It works only for sub-manifests, for which the image stream usually does not
 // have a history entry. For the main manifest, the image stream should have a
 // history entry that can be found by ResolveImageID.
-func (is *imageStream) resolveUpstreamRef(ctx context.Context, dgst digest.Digest) (reference.DockerImageReference, rerrors.Error) {
+func (is *imageStream) resolveUpstreamRef(ctx context.Context, dgst digest.Digest) (reference.DockerImageReference, digest.Digest, rerrors.Error) {
 	layers, rErr := is.imageStreamGetter.layers()
 	if rErr != nil {
-		return reference.DockerImageReference{}, rerrors.NewError(
+		return reference.DockerImageReference{}, "", rerrors.NewError(
 			ErrImageStreamUnknownErrorCode,
 			fmt.Sprintf("resolveUpstreamRef: failed to get layers for image stream %s", is.Reference()),
 			rErr,
@@ -255,7 +369,7 @@ func (is *imageStream) resolveUpstreamRef(ctx context.Context, dgst digest.Diges
 		}
 	}
 	if parent == "" {
-		return reference.DockerImageReference{}, rerrors.NewError(
+		return reference.DockerImageReference{}, "", rerrors.NewError(
 			ErrImageStreamImageNotFoundCode,
 			fmt.Sprintf("resolveUpstreamRef: unable to find parent for image %s in image stream %s", dgst.String(), is.Reference()),
 			nil,
@@ -264,7 +378,7 @@ func (is *imageStream) resolveUpstreamRef(ctx context.Context, dgst digest.Diges
 
 	parentTagEvent, rErr := is.ResolveImageID(ctx, digest.Digest(parent))
 	if rErr != nil {
-		return reference.DockerImageReference{}, rerrors.NewError(
+		return reference.DockerImageReference{}, "", rerrors.NewError(
 			ErrImageStreamUnknownErrorCode,
 			fmt.Sprintf("resolveUpstreamRef: unable to get parent event %s in image stream %s", parent, is.Reference()),
 			rErr,
@@ -273,7 +387,7 @@ func (is *imageStream) resolveUpstreamRef(ctx context.Context, dgst digest.Diges
 
 	ref, err := reference.Parse(parentTagEvent.DockerImageReference)
 	if err != nil {
-		return reference.DockerImageReference{}, rerrors.NewError(
+		return reference.DockerImageReference{}, "", rerrors.NewError(
 			ErrImageStreamUnknownErrorCode,
 			fmt.Sprintf("resolveUpstreamRef: unable to parse parent image reference %s in image stream %s", parentTagEvent.DockerImageReference, is.Reference()),
 			err,
@@ -283,7 +397,7 @@ func (is *imageStream) resolveUpstreamRef(ctx context.Context, dgst digest.Diges
 	ref.Tag = ""
 	ref.ID = dgst.String()
 
-	return ref, nil
+	return ref, digest.Digest(parent), nil
 }
 
 func (is *imageStream) GetSecrets() ([]corev1.Secret, rerrors.Error) {
@@ -326,6 +440,116 @@ func (is *imageStream) TagIsInsecure(ctx context.Context, tag string, dgst diges
 	return false, nil
 }
 
+// TagPullSecret returns the name of the secret from the pull secret annotation
+// of the given tag. If the tag is empty, the tag is found by the digest.
+func (is *imageStream) TagPullSecret(ctx context.Context, tag string, dgst digest.Digest) (string, rerrors.Error) {
+	stream, err := is.imageStreamGetter.get()
+	if err != nil {
+		return "", convertImageStreamGetterError(err, fmt.Sprintf("TagPullSecret: failed to get image stream %s", is.Reference()))
+	}
+
+	if len(tag) == 0 {
+		// if the client pulled by digest, find the corresponding tag in the image stream
+		tag, _ = util.LatestImageTagEvent(stream, dgst.String())
+	}
+
+	if len(tag) != 0 {
+		for _, t := range stream.Spec.Tags {
+			if t.Name == tag {
+				return strings.TrimSpace(t.Annotations[PullSecretAnnotation]), nil
+			}
+		}
+	}
+
+	return "", nil
+}
+
+// SignaturePolicy returns the names of the public keys from the signature
+// policy annotation of the image stream. An empty list means the signatures
+// are not verified.
+func (is *imageStream) SignaturePolicy(ctx context.Context) ([]string, rerrors.Error) {
+	stream, err := is.imageStreamGetter.get()
+	if err != nil {
+		return nil, convertImageStreamGetterError(err, fmt.Sprintf("SignaturePolicy: failed to get image stream %s", is.Reference()))
+	}
+
+	var keys []string
+	for _, key := range strings.Split(stream.Annotations[SignaturePolicyAnnotation], ",") {
+		if key = strings.TrimSpace(key); len(key) > 0 {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// TagIsImmutable returns true if tag matches one of the patterns from the
+// immutable tags annotation of the image stream.
+func (is *imageStream) TagIsImmutable(ctx context.Context, tag string) (bool, rerrors.Error) {
+	stream, err := is.imageStreamGetter.get()
+	if err != nil {
+		return false, convertImageStreamGetterError(err, fmt.Sprintf("TagIsImmutable: failed to get image stream %s", is.Reference()))
+	}
+
+	for _, pattern := range strings.Split(stream.Annotations[ImmutableTagsAnnotation], ",") {
+		if pattern = strings.TrimSpace(pattern); len(pattern) == 0 {
+			continue
+		}
+		matched, err := path.Match(pattern, tag)
+		if err != nil {
+			dcontext.GetLogger(ctx).Errorf("invalid immutable tag pattern %q in image stream %s: %v", pattern, is.Reference(), err)
+			continue
+		}
+		if matched {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// StorageLimit returns the number of bytes from the storage limit annotation
+// of the image stream, or -1 if the storage of the image stream is not
+// limited.
+func (is *imageStream) StorageLimit(ctx context.Context) (int64, rerrors.Error) {
+	stream, err := is.imageStreamGetter.get()
+	if err != nil {
+		if err.Code() == ErrImageStreamGetterNotFoundCode {
+			return -1, nil
+		}
+		return 0, convertImageStreamGetterError(err, fmt.Sprintf("StorageLimit: failed to get image stream %s", is.Reference()))
+	}
+
+	value, ok := stream.Annotations[StorageLimitAnnotation]
+	if !ok {
+		return -1, nil
+	}
+	limit, perr := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if perr != nil || limit < 0 {
+		dcontext.GetLogger(ctx).Errorf("invalid storage limit %q in image stream %s", value, is.Reference())
+		return -1, nil
+	}
+	return limit, nil
+}
+
+// ManifestListsOf returns the digests of the manifest lists in the image
+// stream that reference the manifest dgst.
+func (is *imageStream) ManifestListsOf(ctx context.Context, dgst digest.Digest) ([]digest.Digest, rerrors.Error) {
+	layers, err := is.imageStreamGetter.layers()
+	if err != nil {
+		return nil, convertImageStreamGetterError(err, fmt.Sprintf("ManifestListsOf: failed to get image stream layers %s", is.Reference()))
+	}
+
+	var lists []digest.Digest
+	for imageID, ref := range layers.Images {
+		for _, manifest := range ref.Manifests {
+			if manifest == dgst.String() {
+				lists = append(lists, digest.Digest(imageID))
+				break
+			}
+		}
+	}
+	return lists, nil
+}
+
 func (is *imageStream) Exists(ctx context.Context) (bool, rerrors.Error) {
 	_, rErr := is.imageStreamGetter.get()
 	if rErr != nil {
@@ -337,6 +561,14 @@ func (is *imageStream) Exists(ctx context.Context) (bool, rerrors.Error) {
 	return true, nil
 }
 
+func (is *imageStream) Generation() (int64, string, bool) {
+	meta := is.imageStreamGetter.objectMeta()
+	if meta == nil {
+		return 0, "", false
+	}
+	return meta.Generation, meta.ResourceVersion, true
+}
+
 func (is *imageStream) localRegistry(ctx context.Context) ([]string, rerrors.Error) {
 	stream, rErr := is.imageStreamGetter.get()
 	if rErr != nil {
@@ -405,6 +637,33 @@ func (is *imageStream) Tags(ctx context.Context) (map[string]digest.Digest, rerr
 	return m, nil
 }
 
+// LatestTagEvent returns the current event of the tag, i.e. the event of the
+// image that the tag points to. It returns nil if the tag has no events.
+func (is *imageStream) LatestTagEvent(ctx context.Context, tag string) (*imageapiv1.TagEvent, rerrors.Error) {
+	stream, err := is.imageStreamGetter.get()
+	if err != nil {
+		return nil, convertImageStreamGetterError(err, fmt.Sprintf("LatestTagEvent: failed to get image stream %s", is.Reference()))
+	}
+
+	for _, history := range stream.Status.Tags {
+		if history.Tag != tag || len(history.Items) == 0 {
+			continue
+		}
+		event := history.Items[0]
+		return &event, nil
+	}
+	return nil, nil
+}
+
+// Layers returns the blobs and the images referenced by the image stream.
+func (is *imageStream) Layers(ctx context.Context) (*imageapiv1.ImageStreamLayers, rerrors.Error) {
+	layers, err := is.imageStreamGetter.layers()
+	if err != nil {
+		return nil, convertImageStreamGetterError(err, fmt.Sprintf("Layers: failed to get layers of image stream %s", is.Reference()))
+	}
+	return layers, nil
+}
+
 func (is *imageStream) CreateImageStreamMapping(ctx context.Context, userClient client.Interface, tag string, image *imageapiv1.Image) rerrors.Error {
 	ism := imageapiv1.ImageStreamMapping{
 		ObjectMeta: metav1.ObjectMeta{
@@ -415,8 +674,22 @@ func (is *imageStream) CreateImageStreamMapping(ctx context.Context, userClient
 		Tag:   tag,
 	}
 
-	_, err := is.registryOSClient.ImageStreamMappings(is.namespace).Create(ctx, &ism, metav1.CreateOptions{})
+	createImageStreamMapping := func() error {
+		_, err := is.registryOSClient.ImageStreamMappings(is.namespace).Create(ctx, &ism, metav1.CreateOptions{})
+		if kerrors.IsAlreadyExists(err) {
+			// The image has been created by a concurrent push of the
+			// same manifest.
+			return nil
+		}
+		if kerrors.IsConflict(err) {
+			// The image stream has been updated concurrently, e.g. by a
+			// push of another tag, so the cached one is stale.
+			is.imageStreamGetter.invalidate()
+		}
+		return err
+	}
 
+	err := is.retryWrite(ctx, "CreateImageStreamMapping", createImageStreamMapping)
 	if err == nil {
 		return nil
 	}
@@ -461,14 +734,27 @@ func (is *imageStream) CreateImageStreamMapping(ctx context.Context, userClient
 		)
 	}
 
+	if is.autoProvisioningDisabled {
+		return rerrors.NewError(
+			ErrImageStreamNotFoundCode,
+			fmt.Sprintf("CreateImageStreamMapping: ImageStream %s does not exist and its auto provisioning is disabled", is.Reference()),
+			err,
+		)
+	}
+
 	stream := &imageapiv1.ImageStream{}
 	stream.Name = is.name
 
-	_, err = userClient.ImageStreams(is.namespace).Create(ctx, stream, metav1.CreateOptions{})
+	err = is.retryWrite(ctx, "CreateImageStream", func() error {
+		_, err := userClient.ImageStreams(is.namespace).Create(ctx, stream, metav1.CreateOptions{})
+		if kerrors.IsAlreadyExists(err) || kerrors.IsConflict(err) {
+			// It is ok.
+			return nil
+		}
+		return err
+	})
 
 	switch {
-	case kerrors.IsAlreadyExists(err), kerrors.IsConflict(err):
-		// It is ok.
 	case kerrors.IsForbidden(err), kerrors.IsUnauthorized(err), quotautil.IsErrorQuotaExceeded(err):
 		return rerrors.NewError(
 			ErrImageStreamForbiddenCode,
@@ -487,8 +773,7 @@ func (is *imageStream) CreateImageStreamMapping(ctx context.Context, userClient
 	is.imageStreamGetter.cacheImageStream(stream)
 
 	// try to create the ISM again
-	_, err = is.registryOSClient.ImageStreamMappings(is.namespace).Create(ctx, &ism, metav1.CreateOptions{})
-
+	err = is.retryWrite(ctx, "CreateImageStreamMapping", createImageStreamMapping)
 	if err == nil {
 		return nil
 	}
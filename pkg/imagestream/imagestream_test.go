@@ -0,0 +1,286 @@
+package imagestream
+
+import (
+	"testing"
+
+	"github.com/distribution/distribution/v3/context"
+	"github.com/opencontainers/go-digest"
+
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	core "k8s.io/client-go/testing"
+
+	imageapiv1 "github.com/openshift/api/image/v1"
+	imagefakeclient "github.com/openshift/client-go/image/clientset/versioned/typed/image/v1/fake"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+	"github.com/openshift/image-registry/pkg/testutil"
+)
+
+func TestGetImageOfImageStreamSubManifest(t *testing.T) {
+	const (
+		listDigest    = "sha256:0000000000000000000000000000000000000000000000000000000000000001"
+		amd64Digest   = "sha256:0000000000000000000000000000000000000000000000000000000000000002"
+		arm64Digest   = "sha256:0000000000000000000000000000000000000000000000000000000000000003"
+		unknownDigest = "sha256:0000000000000000000000000000000000000000000000000000000000000004"
+	)
+
+	stream := &imageapiv1.ImageStream{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "user",
+			Name:      "app",
+		},
+		Status: imageapiv1.ImageStreamStatus{
+			Tags: []imageapiv1.NamedTagEventList{
+				{
+					Tag: "latest",
+					Items: []imageapiv1.TagEvent{
+						{Image: listDigest, DockerImageReference: "remote.example.com/upstream/app@" + listDigest},
+					},
+				},
+			},
+		},
+	}
+	layers := &imageapiv1.ImageStreamLayers{
+		Images: map[string]imageapiv1.ImageBlobReferences{
+			listDigest:  {Manifests: []string{amd64Digest, arm64Digest}},
+			amd64Digest: {},
+			arm64Digest: {ImageMissing: true},
+		},
+	}
+	amd64Image := &imageapiv1.Image{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: amd64Digest,
+			Annotations: map[string]string{
+				imageapiv1.ManagedByOpenShiftAnnotation: "true",
+			},
+		},
+		DockerImageReference: "registry.example.com/user/app@" + amd64Digest,
+	}
+
+	for _, tc := range []struct {
+		name              string
+		dgst              string
+		expectedReference string
+		expectedManaged   bool
+		expectedError     string
+	}{
+		{
+			name:              "sub-manifest with image",
+			dgst:              amd64Digest,
+			expectedReference: "remote.example.com/upstream/app@" + amd64Digest,
+			expectedManaged:   true,
+		},
+		{
+			name:              "sub-manifest without image",
+			dgst:              arm64Digest,
+			expectedReference: "remote.example.com/upstream/app@" + arm64Digest,
+		},
+		{
+			name:          "unknown manifest",
+			dgst:          unknownDigest,
+			expectedError: ErrImageStreamImageNotFoundCode,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			ctx = testutil.WithTestLogger(ctx, t)
+
+			imageClient := &imagefakeclient.FakeImageV1{Fake: &core.Fake{}}
+			imageClient.AddReactor("get", "imagestreams", func(action core.Action) (bool, runtime.Object, error) {
+				if action.GetSubresource() == "layers" {
+					return true, layers, nil
+				}
+				return true, stream, nil
+			})
+			imageClient.AddReactor("get", "images", func(action core.Action) (bool, runtime.Object, error) {
+				name := action.(core.GetAction).GetName()
+				if name == amd64Digest {
+					return true, amd64Image.DeepCopy(), nil
+				}
+				return true, nil, kerrors.NewNotFound(imageapiv1.Resource("images"), name)
+			})
+
+			is := New(ctx, "user", "app", client.NewFakeRegistryAPIClient(nil, imageClient))
+
+			image, rErr := is.GetImageOfImageStream(ctx, digest.Digest(tc.dgst))
+			if len(tc.expectedError) > 0 {
+				if rErr == nil || rErr.Code() != tc.expectedError {
+					t.Fatalf("got error %v, want %s", rErr, tc.expectedError)
+				}
+				return
+			}
+			if rErr != nil {
+				t.Fatal(rErr)
+			}
+			if image.Name != tc.dgst {
+				t.Errorf("got image %s, want %s", image.Name, tc.dgst)
+			}
+			if image.DockerImageReference != tc.expectedReference {
+				t.Errorf("got reference %q, want %q", image.DockerImageReference, tc.expectedReference)
+			}
+			if managed := IsImageManaged(image); managed != tc.expectedManaged {
+				t.Errorf("got managed=%t, want %t", managed, tc.expectedManaged)
+			}
+		})
+	}
+}
+
+func TestGetImageOfImageStreamReferencePolicy(t *testing.T) {
+	const (
+		localDigest  = "sha256:0000000000000000000000000000000000000000000000000000000000000001"
+		sourceDigest = "sha256:0000000000000000000000000000000000000000000000000000000000000002"
+		subDigest    = "sha256:0000000000000000000000000000000000000000000000000000000000000003"
+		oldDigest    = "sha256:0000000000000000000000000000000000000000000000000000000000000004"
+	)
+
+	newStream := func(dockerImageRepository string) *imageapiv1.ImageStream {
+		return &imageapiv1.ImageStream{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "user",
+				Name:      "app",
+			},
+			Spec: imageapiv1.ImageStreamSpec{
+				Tags: []imageapiv1.TagReference{
+					{Name: "local", ReferencePolicy: imageapiv1.TagReferencePolicy{Type: imageapiv1.LocalTagReferencePolicy}},
+					{Name: "source", ReferencePolicy: imageapiv1.TagReferencePolicy{Type: imageapiv1.SourceTagReferencePolicy}},
+				},
+			},
+			Status: imageapiv1.ImageStreamStatus{
+				DockerImageRepository: dockerImageRepository,
+				Tags: []imageapiv1.NamedTagEventList{
+					{
+						Tag: "local",
+						Items: []imageapiv1.TagEvent{
+							{Image: localDigest, DockerImageReference: "remote.example.com/upstream/app@" + localDigest},
+							{Image: oldDigest, DockerImageReference: "remote.example.com/upstream/app@" + oldDigest},
+						},
+					},
+					{
+						Tag: "source",
+						Items: []imageapiv1.TagEvent{
+							{Image: sourceDigest, DockerImageReference: "remote.example.com/upstream/app@" + sourceDigest},
+						},
+					},
+				},
+			},
+		}
+	}
+	layers := &imageapiv1.ImageStreamLayers{
+		Images: map[string]imageapiv1.ImageBlobReferences{
+			localDigest: {Manifests: []string{subDigest}},
+			subDigest:   {ImageMissing: true},
+		},
+	}
+
+	for _, tc := range []struct {
+		name                    string
+		dockerImageRepository   string
+		dgst                    string
+		expectedReference       string
+		expectedSourceReference string
+	}{
+		{
+			name:                    "local tag",
+			dockerImageRepository:   "image-registry.openshift-image-registry.svc:5000/user/app",
+			dgst:                    localDigest,
+			expectedReference:       "image-registry.openshift-image-registry.svc:5000/user/app@" + localDigest,
+			expectedSourceReference: "remote.example.com/upstream/app@" + localDigest,
+		},
+		{
+			name:                    "source tag",
+			dockerImageRepository:   "image-registry.openshift-image-registry.svc:5000/user/app",
+			dgst:                    sourceDigest,
+			expectedReference:       "remote.example.com/upstream/app@" + sourceDigest,
+			expectedSourceReference: "remote.example.com/upstream/app@" + sourceDigest,
+		},
+		{
+			name:                    "sub-manifest of local tag",
+			dockerImageRepository:   "image-registry.openshift-image-registry.svc:5000/user/app",
+			dgst:                    subDigest,
+			expectedReference:       "image-registry.openshift-image-registry.svc:5000/user/app@" + subDigest,
+			expectedSourceReference: "remote.example.com/upstream/app@" + subDigest,
+		},
+		{
+			name:                    "previous image of local tag",
+			dockerImageRepository:   "image-registry.openshift-image-registry.svc:5000/user/app",
+			dgst:                    oldDigest,
+			expectedReference:       "remote.example.com/upstream/app@" + oldDigest,
+			expectedSourceReference: "remote.example.com/upstream/app@" + oldDigest,
+		},
+		{
+			name:                    "local tag without integrated registry",
+			dgst:                    localDigest,
+			expectedReference:       "remote.example.com/upstream/app@" + localDigest,
+			expectedSourceReference: "remote.example.com/upstream/app@" + localDigest,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			ctx = testutil.WithTestLogger(ctx, t)
+
+			stream := newStream(tc.dockerImageRepository)
+			imageClient := &imagefakeclient.FakeImageV1{Fake: &core.Fake{}}
+			imageClient.AddReactor("get", "imagestreams", func(action core.Action) (bool, runtime.Object, error) {
+				if action.GetSubresource() == "layers" {
+					return true, layers, nil
+				}
+				return true, stream, nil
+			})
+			imageClient.AddReactor("get", "images", func(action core.Action) (bool, runtime.Object, error) {
+				name := action.(core.GetAction).GetName()
+				if name == subDigest {
+					return true, nil, kerrors.NewNotFound(imageapiv1.Resource("images"), name)
+				}
+				return true, &imageapiv1.Image{ObjectMeta: metav1.ObjectMeta{Name: name}}, nil
+			})
+
+			is := New(ctx, "user", "app", client.NewFakeRegistryAPIClient(nil, imageClient))
+
+			image, rErr := is.GetImageOfImageStream(ctx, digest.Digest(tc.dgst))
+			if rErr != nil {
+				t.Fatal(rErr)
+			}
+			if image.DockerImageReference != tc.expectedReference {
+				t.Errorf("got reference %q, want %q", image.DockerImageReference, tc.expectedReference)
+			}
+
+			image, rErr = is.GetSourceImageOfImageStream(ctx, digest.Digest(tc.dgst))
+			if rErr != nil {
+				t.Fatal(rErr)
+			}
+			if image.DockerImageReference != tc.expectedSourceReference {
+				t.Errorf("got source reference %q, want %q", image.DockerImageReference, tc.expectedSourceReference)
+			}
+		})
+	}
+}
+
+func TestCreateImageStreamMappingWithoutAutoProvisioning(t *testing.T) {
+	ctx := context.Background()
+	ctx = testutil.WithTestLogger(ctx, t)
+
+	imageClient := &imagefakeclient.FakeImageV1{Fake: &core.Fake{}}
+	imageClient.AddReactor("create", "imagestreammappings", func(action core.Action) (bool, runtime.Object, error) {
+		return true, nil, kerrors.NewNotFound(imageapiv1.Resource("imagestreammappings"), "app")
+	})
+	created := false
+	imageClient.AddReactor("create", "imagestreams", func(action core.Action) (bool, runtime.Object, error) {
+		created = true
+		return true, action.(core.CreateAction).GetObject(), nil
+	})
+	registryClient := client.NewFakeRegistryAPIClient(nil, imageClient)
+
+	is := WithoutAutoProvisioning(New(ctx, "user", "app", registryClient))
+
+	image := &imageapiv1.Image{}
+	image.Name = "sha256:0000000000000000000000000000000000000000000000000000000000000001"
+	rErr := is.CreateImageStreamMapping(ctx, registryClient, "latest", image)
+	if rErr == nil || rErr.Code() != ErrImageStreamNotFoundCode {
+		t.Errorf("got error %v, want %s", rErr, ErrImageStreamNotFoundCode)
+	}
+	if created {
+		t.Error("expected the image stream not to be created")
+	}
+}
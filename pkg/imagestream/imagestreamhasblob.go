@@ -5,8 +5,11 @@ import (
 	"time"
 
 	dcontext "github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/manifest/schema2"
 	"github.com/opencontainers/go-digest"
+	ociv1 "github.com/opencontainers/image-spec/specs-go/v1"
 
+	dockerapiv10 "github.com/openshift/api/image/docker10"
 	imageapiv1 "github.com/openshift/api/image/v1"
 )
 
@@ -43,5 +46,73 @@ func (is *imageStream) HasBlob(ctx context.Context, dgst digest.Digest) (bool, *
 		return logFound(true, layers, nil)
 	}
 
+	// check for the blob in the sub-manifests of manifest lists
+	if found, image := is.hasBlobInSubManifests(ctx, dgst, layers); found {
+		return logFound(true, layers, image)
+	}
+
 	return logFound(false, layers, nil)
 }
+
+// hasBlobInSubManifests looks for the blob in the layers and the config blobs
+// of the images referenced by manifest lists of the image stream. Sub-manifests
+// that are not described by the layers API are fetched from the master API,
+// the ones that are described as missing are skipped.
+// The fetched image that references the blob is returned, so the caller is
+// able to remember its layers.
+func (is *imageStream) hasBlobInSubManifests(ctx context.Context, dgst digest.Digest, layers *imageapiv1.ImageStreamLayers) (bool, *imageapiv1.Image) {
+	for _, ref := range layers.Images {
+		for _, manifest := range ref.Manifests {
+			if manifest == dgst.String() {
+				return true, nil
+			}
+
+			if subRef, ok := layers.Images[manifest]; ok {
+				// The images that are missing cannot be fetched either.
+				if !subRef.ImageMissing && imageBlobReferencesHaveBlob(subRef, dgst) {
+					return true, nil
+				}
+				continue
+			}
+
+			image, err := is.imageClient.Get(ctx, digest.Digest(manifest))
+			if err != nil {
+				dcontext.GetLogger(ctx).Errorf("imageStream.HasBlob: failed to get sub-manifest image %s: %v", manifest, err)
+				continue
+			}
+			if imageHasBlob(image, dgst) {
+				return true, image
+			}
+		}
+	}
+	return false, nil
+}
+
+// imageBlobReferencesHaveBlob returns true if the blob is a layer or the
+// config of the image described by ref.
+func imageBlobReferencesHaveBlob(ref imageapiv1.ImageBlobReferences, dgst digest.Digest) bool {
+	if ref.Config != nil && *ref.Config == dgst.String() {
+		return true
+	}
+	for _, layer := range ref.Layers {
+		if layer == dgst.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// imageHasBlob returns true if the blob is a layer or the config of image.
+func imageHasBlob(image *imageapiv1.Image, dgst digest.Digest) bool {
+	for _, layer := range image.DockerImageLayers {
+		if layer.Name == dgst.String() {
+			return true
+		}
+	}
+	switch image.DockerImageManifestMediaType {
+	case schema2.MediaTypeManifest, ociv1.MediaTypeImageManifest:
+		meta, ok := image.DockerImageMetadata.Object.(*dockerapiv10.DockerImage)
+		return ok && meta.ID == dgst.String()
+	}
+	return false
+}
@@ -0,0 +1,108 @@
+package imagestream
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/distribution/distribution/v3/context"
+	"github.com/distribution/distribution/v3/manifest/manifestlist"
+	"github.com/distribution/distribution/v3/manifest/schema2"
+	"github.com/opencontainers/go-digest"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	core "k8s.io/client-go/testing"
+
+	dockerapiv10 "github.com/openshift/api/image/docker10"
+	imageapiv1 "github.com/openshift/api/image/v1"
+	imagefakeclient "github.com/openshift/client-go/image/clientset/versioned/typed/image/v1/fake"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+	"github.com/openshift/image-registry/pkg/testutil"
+)
+
+func TestHasBlobInSubManifests(t *testing.T) {
+	const (
+		listDigest  = "sha256:0000000000000000000000000000000000000000000000000000000000000001"
+		amd64Digest = "sha256:0000000000000000000000000000000000000000000000000000000000000002"
+		arm64Digest = "sha256:0000000000000000000000000000000000000000000000000000000000000003"
+		amd64Layer  = "sha256:0000000000000000000000000000000000000000000000000000000000000004"
+		arm64Layer  = "sha256:0000000000000000000000000000000000000000000000000000000000000005"
+		arm64Config = "sha256:0000000000000000000000000000000000000000000000000000000000000006"
+		unknownBlob = "sha256:0000000000000000000000000000000000000000000000000000000000000007"
+		amd64Config = "sha256:0000000000000000000000000000000000000000000000000000000000000008"
+		s390xDigest = "sha256:0000000000000000000000000000000000000000000000000000000000000009"
+	)
+
+	config := amd64Config
+	layers := &imageapiv1.ImageStreamLayers{
+		Blobs: map[string]imageapiv1.ImageLayerData{
+			listDigest: {MediaType: manifestlist.MediaTypeManifestList},
+		},
+		Images: map[string]imageapiv1.ImageBlobReferences{
+			listDigest: {Manifests: []string{amd64Digest, s390xDigest, arm64Digest}},
+			// The amd64 image is described by the layers API, but its blobs are
+			// not listed.
+			amd64Digest: {Layers: []string{amd64Layer}, Config: &config},
+			// The s390x image doesn't exist, so it isn't fetched. The arm64
+			// image isn't described at all.
+			s390xDigest: {ImageMissing: true},
+		},
+	}
+	arm64Image := &imageapiv1.Image{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: arm64Digest,
+		},
+		DockerImageManifestMediaType: schema2.MediaTypeManifest,
+		DockerImageLayers:            []imageapiv1.ImageLayer{{Name: arm64Layer}},
+		DockerImageMetadata: runtime.RawExtension{
+			Object: &dockerapiv10.DockerImage{ID: arm64Config},
+		},
+	}
+
+	for _, tc := range []struct {
+		name          string
+		dgst          string
+		expectedFound bool
+		expectedImage string
+	}{
+		{name: "sub-manifest", dgst: arm64Digest, expectedFound: true},
+		{name: "layer of described sub-manifest", dgst: amd64Layer, expectedFound: true},
+		{name: "config of described sub-manifest", dgst: amd64Config, expectedFound: true},
+		{name: "missing sub-manifest", dgst: s390xDigest, expectedFound: true},
+		{name: "layer of undescribed sub-manifest", dgst: arm64Layer, expectedFound: true, expectedImage: arm64Digest},
+		{name: "config of undescribed sub-manifest", dgst: arm64Config, expectedFound: true, expectedImage: arm64Digest},
+		{name: "unknown blob", dgst: unknownBlob},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			ctx = testutil.WithTestLogger(ctx, t)
+
+			imageClient := &imagefakeclient.FakeImageV1{Fake: &core.Fake{}}
+			imageClient.AddReactor("get", "imagestreams", func(action core.Action) (bool, runtime.Object, error) {
+				return true, layers, nil
+			})
+			imageClient.AddReactor("get", "images", func(action core.Action) (bool, runtime.Object, error) {
+				if getAction, ok := action.(core.GetAction); !ok || getAction.GetName() != arm64Digest {
+					t.Errorf("unexpected action: %#+v", action)
+					return true, nil, fmt.Errorf("unexpected action")
+				}
+				return true, arm64Image.DeepCopy(), nil
+			})
+
+			is := New(ctx, "user", "app", client.NewFakeRegistryAPIClient(nil, imageClient))
+
+			found, _, image := is.HasBlob(ctx, digest.Digest(tc.dgst))
+			if found != tc.expectedFound {
+				t.Fatalf("got found=%t, want %t", found, tc.expectedFound)
+			}
+			name := ""
+			if image != nil {
+				name = image.Name
+			}
+			if name != tc.expectedImage {
+				t.Errorf("got image %q, want %q", name, tc.expectedImage)
+			}
+		})
+	}
+}
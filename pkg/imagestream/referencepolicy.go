@@ -0,0 +1,45 @@
+package imagestream
+
+import (
+	"github.com/opencontainers/go-digest"
+
+	imageapiv1 "github.com/openshift/api/image/v1"
+	"github.com/openshift/library-go/pkg/image/imageutil"
+	"github.com/openshift/library-go/pkg/image/reference"
+)
+
+// hasLocalTag returns true if a tag with the Local reference policy points to
+// the image tagged. As the master API applies the reference policies only to
+// the current events of the tags, the images from the history of the tags
+// keep their source references.
+func hasLocalTag(stream *imageapiv1.ImageStream, tagged digest.Digest) bool {
+	for _, history := range stream.Status.Tags {
+		if len(history.Items) == 0 || history.Items[0].Image != tagged.String() {
+			continue
+		}
+		ref, ok := imageutil.SpecHasTag(stream, history.Tag)
+		if ok && ref.ReferencePolicy.Type == imageapiv1.LocalTagReferencePolicy {
+			return true
+		}
+	}
+	return false
+}
+
+// localImageReference returns the pull spec of the image dgst in the
+// integrated registry, built the same way as the master API builds the pull
+// specs of the tags with the Local reference policy. It returns false if the
+// image stream doesn't have a valid repository in the integrated registry, in
+// which case the master API falls back to the source reference too.
+func localImageReference(stream *imageapiv1.ImageStream, dgst digest.Digest) (string, bool) {
+	if len(stream.Status.DockerImageRepository) == 0 {
+		return "", false
+	}
+
+	ref, err := reference.Parse(stream.Status.DockerImageRepository)
+	if err != nil {
+		return "", false
+	}
+	ref.Tag = ""
+	ref.ID = dgst.String()
+	return ref.Exact(), true
+}
@@ -0,0 +1,125 @@
+package imagestream
+
+import (
+	"context"
+	"time"
+
+	dcontext "github.com/distribution/distribution/v3/context"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/metrics"
+)
+
+// WriteRetries configures the retries of the writes to the API server that
+// fail with transient errors: conflicts, throttling and server errors.
+type WriteRetries struct {
+	// Attempts is the maximum number of attempts of a write. Values less
+	// than 2 disable the retries, except for conflicts.
+	Attempts int
+
+	// InitialBackoff is the delay before the first retry. The delay is
+	// doubled after each retry up to MaxBackoff. The delay requested by the
+	// API server with Retry-After is used instead if there is one, but it
+	// is limited by MaxBackoff too.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	// Metrics counts the retried writes. It may be nil.
+	Metrics metrics.APIWrites
+}
+
+const (
+	// conflictAttempts is the minimum number of attempts of a write that
+	// fails with conflicts. The image stream is updated concurrently by the
+	// pushes of its other tags, so the conflicts are retried even if the
+	// retries of the writes are disabled.
+	conflictAttempts = 5
+
+	// conflictBackoff is the delay before a retry of a conflicting write if
+	// the retries of the writes are disabled. It is jittered, so that the
+	// concurrent writes don't conflict again.
+	conflictBackoff = 20 * time.Millisecond
+)
+
+// WithWriteRetries makes is retry its writes to the API server according to
+// retries.
+func WithWriteRetries(is ImageStream, retries WriteRetries) ImageStream {
+	is.(*imageStream).writeRetries = retries
+	return is
+}
+
+// transientWriteError returns the reason of err if the write that failed
+// with err can be retried.
+func transientWriteError(err error) (string, bool) {
+	switch {
+	case kerrors.IsConflict(err):
+		return "Conflict", true
+	case kerrors.IsTooManyRequests(err):
+		return "TooManyRequests", true
+	}
+
+	status, ok := err.(kerrors.APIStatus)
+	if !ok || status.Status().Code < 500 {
+		return "", false
+	}
+	if reason := string(kerrors.ReasonForError(err)); reason != "" {
+		return reason, true
+	}
+	return "ServerError", true
+}
+
+// retryWrite calls write until it succeeds, fails with a permanent error,
+// the attempts are exhausted or ctx is done. It returns the last error of
+// write. The conflicts are retried at least conflictAttempts times.
+func (is *imageStream) retryWrite(ctx context.Context, operation string, write func() error) error {
+	r := is.writeRetries
+	backoff := r.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := write()
+		if err == nil {
+			return nil
+		}
+		reason, ok := transientWriteError(err)
+		if !ok {
+			return err
+		}
+
+		attempts := r.Attempts
+		conflict := kerrors.IsConflict(err)
+		if conflict && attempts < conflictAttempts {
+			attempts = conflictAttempts
+		}
+		if attempt >= attempts {
+			return err
+		}
+
+		delay := backoff
+		if seconds, ok := kerrors.SuggestsClientDelay(err); ok {
+			delay = time.Duration(seconds) * time.Second
+		}
+		if delay > r.MaxBackoff {
+			delay = r.MaxBackoff
+		}
+		if conflict && delay <= 0 {
+			delay = wait.Jitter(conflictBackoff, 1.0)
+		}
+		backoff *= 2
+		if backoff > r.MaxBackoff {
+			backoff = r.MaxBackoff
+		}
+
+		dcontext.GetLogger(ctx).Warnf("%s for %s failed (attempt %d of %d), retrying in %s: %v", operation, is.Reference(), attempt, attempts, delay, err)
+		if r.Metrics != nil {
+			r.Metrics.Retried(operation, reason)
+		}
+
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package imagestream
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	core "k8s.io/client-go/testing"
+
+	imageapiv1 "github.com/openshift/api/image/v1"
+	imagefakeclient "github.com/openshift/client-go/image/clientset/versioned/typed/image/v1/fake"
+
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/client"
+	"github.com/openshift/image-registry/pkg/dockerregistry/server/metrics"
+	metricstesting "github.com/openshift/image-registry/pkg/dockerregistry/server/metrics/testing"
+	"github.com/openshift/image-registry/pkg/testutil"
+	"github.com/openshift/image-registry/pkg/testutil/counter"
+)
+
+func TestCreateImageStreamMappingRetries(t *testing.T) {
+	conflict := kerrors.NewConflict(imageapiv1.Resource("imagestreams"), "app", fmt.Errorf("the object has been modified"))
+	throttled := kerrors.NewTooManyRequests("too many requests", 1)
+	unavailable := kerrors.NewServiceUnavailable("the server is restarting")
+	alreadyExists := kerrors.NewAlreadyExists(imageapiv1.Resource("images"), "sha256:0000000000000000000000000000000000000000000000000000000000000001")
+	forbidden := kerrors.NewForbidden(imageapiv1.Resource("imagestreammappings"), "app", fmt.Errorf("exceeded quota: images, requested: openshift.io/imagestreams=1, used: openshift.io/imagestreams=1, limited: openshift.io/imagestreams=1"))
+
+	for _, tc := range []struct {
+		name          string
+		errors        []error
+		expectedCalls int
+		expectedError string
+		expectedRetry counter.M
+	}{
+		{
+			name:          "success",
+			expectedCalls: 1,
+			expectedRetry: counter.M{},
+		},
+		{
+			name:          "conflict",
+			errors:        []error{conflict},
+			expectedCalls: 2,
+			expectedRetry: counter.M{
+				"api_write_retries:CreateImageStreamMapping:Conflict": 1,
+			},
+		},
+		{
+			name:          "throttled with Retry-After",
+			errors:        []error{throttled, unavailable},
+			expectedCalls: 3,
+			expectedRetry: counter.M{
+				"api_write_retries:CreateImageStreamMapping:TooManyRequests":    1,
+				"api_write_retries:CreateImageStreamMapping:ServiceUnavailable": 1,
+			},
+		},
+		{
+			name:          "attempts exhausted",
+			errors:        []error{unavailable, unavailable, unavailable, unavailable},
+			expectedCalls: 3,
+			expectedError: ErrImageStreamUnknownErrorCode,
+			expectedRetry: counter.M{
+				"api_write_retries:CreateImageStreamMapping:ServiceUnavailable": 2,
+			},
+		},
+		{
+			name:          "image created by a concurrent push",
+			errors:        []error{alreadyExists},
+			expectedCalls: 1,
+			expectedRetry: counter.M{},
+		},
+		{
+			name:          "permanent error",
+			errors:        []error{forbidden},
+			expectedCalls: 1,
+			expectedError: ErrImageStreamForbiddenCode,
+			expectedRetry: counter.M{},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			ctx = testutil.WithTestLogger(ctx, t)
+
+			calls := 0
+			imageClient := &imagefakeclient.FakeImageV1{Fake: &core.Fake{}}
+			imageClient.AddReactor("create", "imagestreammappings", func(action core.Action) (bool, runtime.Object, error) {
+				calls++
+				if calls <= len(tc.errors) {
+					return true, nil, tc.errors[calls-1]
+				}
+				return true, &metav1.Status{}, nil
+			})
+
+			c, sink := metricstesting.NewCounterSink()
+			is := WithWriteRetries(New(ctx, "user", "app", client.NewFakeRegistryAPIClient(nil, imageClient)), WriteRetries{
+				Attempts:       3,
+				InitialBackoff: time.Millisecond,
+				// The delay requested by Retry-After is limited too.
+				MaxBackoff: 10 * time.Millisecond,
+				Metrics:    metrics.NewMetrics(sink).APIWrites(),
+			})
+
+			image := &imageapiv1.Image{}
+			image.Name = "sha256:0000000000000000000000000000000000000000000000000000000000000001"
+			rErr := is.CreateImageStreamMapping(ctx, nil, "latest", image)
+			if len(tc.expectedError) > 0 {
+				if rErr == nil || rErr.Code() != tc.expectedError {
+					t.Errorf("got error %v, want %s", rErr, tc.expectedError)
+				}
+			} else if rErr != nil {
+				t.Errorf("unexpected error: %v", rErr)
+			}
+
+			if calls != tc.expectedCalls {
+				t.Errorf("got %d calls, want %d", calls, tc.expectedCalls)
+			}
+			if diff := c.Diff(tc.expectedRetry); diff != nil {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestCreateImageStreamMappingConcurrentTags(t *testing.T) {
+	const tags = 20
+
+	ctx := context.Background()
+	ctx = testutil.WithTestLogger(ctx, t)
+
+	var (
+		mu       sync.Mutex
+		attempts = map[string]int{}
+		gets     int
+		stream   = &imageapiv1.ImageStream{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "user", Name: "app"},
+		}
+	)
+	imageClient := &imagefakeclient.FakeImageV1{Fake: &core.Fake{}}
+	imageClient.AddReactor("get", "imagestreams", func(action core.Action) (bool, runtime.Object, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		gets++
+		return true, stream.DeepCopy(), nil
+	})
+	imageClient.AddReactor("create", "imagestreammappings", func(action core.Action) (bool, runtime.Object, error) {
+		ism := action.(core.CreateAction).GetObject().(*imageapiv1.ImageStreamMapping)
+
+		mu.Lock()
+		defer mu.Unlock()
+		attempts[ism.Tag]++
+		if attempts[ism.Tag] == 1 {
+			// Every push races with the pushes of the other tags.
+			return true, nil, kerrors.NewConflict(imageapiv1.Resource("imagestreams"), "app", fmt.Errorf("the object has been modified"))
+		}
+		stream.Status.Tags = append(stream.Status.Tags, imageapiv1.NamedTagEventList{
+			Tag:   ism.Tag,
+			Items: []imageapiv1.TagEvent{{Image: ism.Image.Name}},
+		})
+		return true, &metav1.Status{}, nil
+	})
+	registryClient := client.NewFakeRegistryAPIClient(nil, imageClient)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, tags)
+	for i := 0; i < tags; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			// The retries of the writes are disabled.
+			is := New(ctx, "user", "app", registryClient)
+			if _, err := is.Tags(ctx); err != nil {
+				errs <- err
+				return
+			}
+
+			tag := fmt.Sprintf("v%d", i)
+			image := &imageapiv1.Image{}
+			image.Name = fmt.Sprintf("sha256:%064x", i)
+			if err := is.CreateImageStreamMapping(ctx, nil, tag, image); err != nil {
+				errs <- err
+				return
+			}
+
+			// The image stream cached before the conflict is stale.
+			current, err := is.Tags(ctx)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if current[tag] != digest.Digest(image.Name) {
+				errs <- fmt.Errorf("tag %s: got %q, want %s", tag, current[tag], image.Name)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if len(stream.Status.Tags) != tags {
+		t.Errorf("got %d tags, want %d", len(stream.Status.Tags), tags)
+	}
+	for tag, n := range attempts {
+		if n != 2 {
+			t.Errorf("tag %s: got %d attempts, want 2", tag, n)
+		}
+	}
+	if gets != 2*tags {
+		t.Errorf("got %d gets of the image stream, want %d", gets, 2*tags)
+	}
+}
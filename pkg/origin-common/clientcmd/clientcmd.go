@@ -148,6 +148,8 @@ func (cfg *Config) bindEnv() error {
 	if value, ok := getEnv("BEARER_TOKEN_FILE"); ok && len(cfg.CommonConfig.BearerToken) == 0 {
 		if tokenData, tokenErr := ioutil.ReadFile(value); tokenErr == nil {
 			cfg.CommonConfig.BearerToken = strings.TrimSpace(string(tokenData))
+			// The clients reload the rotated tokens from the file.
+			cfg.CommonConfig.BearerTokenFile = value
 			if len(cfg.CommonConfig.BearerToken) == 0 {
 				err = fmt.Errorf("BEARER_TOKEN_FILE %q was empty", value)
 			}
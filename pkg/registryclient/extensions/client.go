@@ -0,0 +1,267 @@
+// Package extensions is a client for the extension APIs of the integrated
+// registry, which are served under /extensions/v2/.
+package extensions
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	"github.com/opencontainers/go-digest"
+)
+
+const extensionsPrefix = "/extensions/v2/"
+
+// Signature is a signature of an image.
+type Signature struct {
+	// Version is the schema version of the signature.
+	Version int `json:"schemaVersion"`
+	// Name is the name of the signature in the <digest>@<name> format.
+	Name string `json:"name"`
+	// Type is the type of the signature. The registry uses AtomicImageV1 if
+	// it is empty.
+	Type string `json:"type"`
+	// Content is the signature.
+	Content []byte `json:"content"`
+}
+
+// Repository describes an image stream in a namespace.
+type Repository struct {
+	Name        string    `json:"name"`
+	Tags        int       `json:"tags"`
+	LastUpdated time.Time `json:"lastUpdated"`
+}
+
+// Descriptor describes a manifest that refers to another manifest.
+type Descriptor struct {
+	MediaType    string            `json:"mediaType"`
+	Digest       digest.Digest     `json:"digest"`
+	Size         int64             `json:"size"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+}
+
+// UploadProgress is the progress of a blob upload.
+type UploadProgress struct {
+	UUID           string    `json:"uuid"`
+	BytesReceived  int64     `json:"bytesReceived"`
+	StartedAt      time.Time `json:"startedAt"`
+	LastActivity   time.Time `json:"lastActivity"`
+	BytesPerSecond float64   `json:"bytesPerSecond"`
+}
+
+// PullthroughCandidate is a remote repository that images of a repository
+// may be pulled through from.
+type PullthroughCandidate struct {
+	Repository     string `json:"repository"`
+	Insecure       bool   `json:"insecure"`
+	PullSecret     string `json:"pullSecret,omitempty"`
+	HasCredentials bool   `json:"hasCredentials"`
+}
+
+// PullthroughCandidates are the remote repositories of a repository.
+type PullthroughCandidates struct {
+	Repository string `json:"repository"`
+	// Primary are the repositories of the current images of the tags.
+	Primary []PullthroughCandidate `json:"primary"`
+	// Secondary are the repositories of the older images of the tags.
+	Secondary []PullthroughCandidate `json:"secondary"`
+}
+
+// Error is returned when the registry responds with an error status.
+type Error struct {
+	StatusCode int
+	// Errors are the errors from the response body, if the registry sent
+	// them.
+	Errors errcode.Errors
+}
+
+func (e *Error) Error() string {
+	if len(e.Errors) == 0 {
+		return fmt.Sprintf("unexpected status code %d", e.StatusCode)
+	}
+	return fmt.Sprintf("status code %d: %v", e.StatusCode, e.Errors)
+}
+
+// Client makes requests to the extension APIs of a registry.
+type Client struct {
+	baseURL    *url.URL
+	httpClient *http.Client
+	token      string
+}
+
+// NewClient returns a client for the registry at registryURL. The requests
+// are authenticated with token, which is an OpenShift API token or, for the
+// metrics, the metrics secret. If token is empty, the requests are
+// anonymous. If httpClient is nil, http.DefaultClient is used.
+func NewClient(registryURL string, httpClient *http.Client, token string) (*Client, error) {
+	u, err := url.Parse(registryURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid registry URL %q: %w", registryURL, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid registry URL %q: the scheme must be http or https", registryURL)
+	}
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	return &Client{
+		baseURL:    u,
+		httpClient: httpClient,
+		token:      token,
+	}, nil
+}
+
+// do sends a request to the endpoint p and checks that the response has the
+// status code expected. The caller must close the body of the response.
+func (c *Client) do(ctx context.Context, method, p string, query url.Values, body []byte, expected int) (*http.Response, error) {
+	u := *c.baseURL
+	u.Path += p
+	u.RawQuery = query.Encode()
+
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), r)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != expected {
+		defer resp.Body.Close()
+		e := &Error{StatusCode: resp.StatusCode}
+		var errs errcode.Errors
+		if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&errs); err == nil {
+			e.Errors = errs
+		}
+		return nil, e
+	}
+	return resp, nil
+}
+
+// get decodes the JSON response of the endpoint p into v.
+func (c *Client) get(ctx context.Context, p string, query url.Values, v interface{}) error {
+	resp, err := c.do(ctx, http.MethodGet, p, query, nil, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("unable to decode the response of %s: %w", p, err)
+	}
+	return nil
+}
+
+// Signatures returns the signatures of the image dgst in the repository
+// repo, which is <namespace>/<name>.
+func (c *Client) Signatures(ctx context.Context, repo string, dgst digest.Digest) ([]Signature, error) {
+	var resp struct {
+		Signatures []Signature `json:"signatures"`
+	}
+	if err := c.get(ctx, extensionsPrefix+repo+"/signatures/"+dgst.String(), nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Signatures, nil
+}
+
+// PutSignature adds the signature to the image dgst in the repository repo.
+func (c *Client) PutSignature(ctx context.Context, repo string, dgst digest.Digest, signature Signature) error {
+	body, err := json.Marshal(signature)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(ctx, http.MethodPut, extensionsPrefix+repo+"/signatures/"+dgst.String(), nil, body, http.StatusCreated)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Metrics returns the metrics of the registry in the Prometheus text format.
+func (c *Client) Metrics(ctx context.Context) ([]byte, error) {
+	resp, err := c.do(ctx, http.MethodGet, extensionsPrefix+"metrics", nil, nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// NamespaceRepositories returns the image streams of the namespace that the
+// user is allowed to pull from.
+func (c *Client) NamespaceRepositories(ctx context.Context, namespace string) ([]Repository, error) {
+	var resp struct {
+		Repositories []Repository `json:"repositories"`
+	}
+	if err := c.get(ctx, extensionsPrefix+"namespaces/"+namespace+"/repositories", nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Repositories, nil
+}
+
+// Referrers returns the manifests in the repository repo that have the
+// manifest dgst as their subject. If artifactType is not empty, only the
+// manifests with this artifact type are returned.
+func (c *Client) Referrers(ctx context.Context, repo string, dgst digest.Digest, artifactType string) ([]Descriptor, error) {
+	query := url.Values{}
+	if artifactType != "" {
+		query.Set("artifactType", artifactType)
+	}
+	var resp struct {
+		Manifests []Descriptor `json:"manifests"`
+	}
+	if err := c.get(ctx, "/v2/"+repo+"/referrers/"+dgst.String(), query, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Manifests, nil
+}
+
+// UploadProgress returns the progress of the blob upload uuid in the
+// repository repo. Only the replica that receives the upload knows its
+// progress.
+func (c *Client) UploadProgress(ctx context.Context, repo, uuid string) (*UploadProgress, error) {
+	progress := &UploadProgress{}
+	if err := c.get(ctx, extensionsPrefix+repo+"/uploads/"+uuid+"/progress", nil, progress); err != nil {
+		return nil, err
+	}
+	return progress, nil
+}
+
+// PullthroughCandidates returns the remote repositories that the images of
+// the repository repo may be pulled through from.
+func (c *Client) PullthroughCandidates(ctx context.Context, repo string) (*PullthroughCandidates, error) {
+	candidates := &PullthroughCandidates{}
+	if err := c.get(ctx, extensionsPrefix+repo+"/pullthrough-candidates", nil, candidates); err != nil {
+		return nil, err
+	}
+	return candidates, nil
+}
+
+// InvalidateCache removes the cached data of the repository repo from the
+// replica that serves the request.
+func (c *Client) InvalidateCache(ctx context.Context, repo string) error {
+	resp, err := c.do(ctx, http.MethodPost, extensionsPrefix+repo+"/cache-invalidate", nil, nil, http.StatusNoContent)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
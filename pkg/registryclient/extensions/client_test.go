@@ -0,0 +1,144 @@
+package extensions
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/distribution/distribution/v3/registry/api/errcode"
+	v2 "github.com/distribution/distribution/v3/registry/api/v2"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestNewClient(t *testing.T) {
+	for _, registryURL := range []string{"", "registry:5000", "ftp://registry", "https://registry\n"} {
+		if _, err := NewClient(registryURL, nil, ""); err == nil {
+			t.Errorf("%q: expected an error", registryURL)
+		}
+	}
+}
+
+func TestClient(t *testing.T) {
+	const dgst = digest.Digest("sha256:0000000000000000000000000000000000000000000000000000000000000001")
+
+	type request struct {
+		method        string
+		path          string
+		query         string
+		authorization string
+		body          string
+	}
+	var requests []request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		requests = append(requests, request{
+			method:        r.Method,
+			path:          r.URL.Path,
+			query:         r.URL.RawQuery,
+			authorization: r.Header.Get("Authorization"),
+			body:          string(body),
+		})
+
+		switch r.URL.Path {
+		case "/extensions/v2/user/app/signatures/" + dgst.String():
+			if r.Method == http.MethodPut {
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+			_, _ = w.Write([]byte(`{"signatures":[{"schemaVersion":2,"name":"` + dgst.String() + `@sig","type":"atomic","content":"c2ln"}]}`))
+		case "/extensions/v2/namespaces/user/repositories":
+			_, _ = w.Write([]byte(`{"namespace":"user","repositories":[{"name":"app","tags":2,"lastUpdated":"2020-01-01T00:00:00Z"}]}`))
+		case "/v2/user/app/referrers/" + dgst.String():
+			_, _ = w.Write([]byte(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.index.v1+json","manifests":[{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":"` + dgst.String() + `","size":10,"artifactType":"application/sbom"}]}`))
+		case "/extensions/v2/user/app/cache-invalidate":
+			w.WriteHeader(http.StatusNoContent)
+		case "/extensions/v2/metrics":
+			_, _ = w.Write([]byte("openshift_registry_up 1\n"))
+		default:
+			_ = errcode.ServeJSON(w, v2.ErrorCodeBlobUploadUnknown.WithDetail("no in-flight upload"))
+		}
+	}))
+	defer server.Close()
+
+	c, err := NewClient(server.URL+"/", server.Client(), "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	signatures, err := c.Signatures(ctx, "user/app", dgst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Signature{{Version: 2, Name: dgst.String() + "@sig", Type: "atomic", Content: []byte("sig")}}; !reflect.DeepEqual(signatures, want) {
+		t.Errorf("got signatures %+v, want %+v", signatures, want)
+	}
+	if err := c.PutSignature(ctx, "user/app", dgst, signatures[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	repos, err := c.NamespaceRepositories(ctx, "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(repos) != 1 || repos[0].Name != "app" || repos[0].Tags != 2 {
+		t.Errorf("got repositories %+v, want app with 2 tags", repos)
+	}
+
+	referrers, err := c.Referrers(ctx, "user/app", dgst, "application/sbom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(referrers) != 1 || referrers[0].ArtifactType != "application/sbom" {
+		t.Errorf("got referrers %+v, want one SBOM", referrers)
+	}
+
+	if err := c.InvalidateCache(ctx, "user/app"); err != nil {
+		t.Fatal(err)
+	}
+
+	metrics, err := c.Metrics(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(metrics) != "openshift_registry_up 1\n" {
+		t.Errorf("got metrics %q", metrics)
+	}
+
+	_, err = c.UploadProgress(ctx, "user/app", "uuid")
+	var e *Error
+	if !errors.As(err, &e) {
+		t.Fatalf("got %v, want *Error", err)
+	}
+	if e.StatusCode != http.StatusNotFound || len(e.Errors) != 1 || e.Errors[0].(errcode.Error).Code != v2.ErrorCodeBlobUploadUnknown {
+		t.Errorf("got %+v, want BLOB_UPLOAD_UNKNOWN", e)
+	}
+
+	signature, err := json.Marshal(signatures[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []request{
+		{method: http.MethodGet, path: "/extensions/v2/user/app/signatures/" + dgst.String()},
+		{method: http.MethodPut, path: "/extensions/v2/user/app/signatures/" + dgst.String(), body: string(signature)},
+		{method: http.MethodGet, path: "/extensions/v2/namespaces/user/repositories"},
+		{method: http.MethodGet, path: "/v2/user/app/referrers/" + dgst.String(), query: "artifactType=application%2Fsbom"},
+		{method: http.MethodPost, path: "/extensions/v2/user/app/cache-invalidate"},
+		{method: http.MethodGet, path: "/extensions/v2/metrics"},
+		{method: http.MethodGet, path: "/extensions/v2/user/app/uploads/uuid/progress"},
+	}
+	for i := range want {
+		want[i].authorization = "Bearer token"
+	}
+	if !reflect.DeepEqual(requests, want) {
+		t.Errorf("got requests %+v, want %+v", requests, want)
+	}
+}
@@ -11,6 +11,11 @@ import (
 
 const (
 	requestHeader = "X-Registry-Request-URL"
+
+	// RequestIDHeader is the header with the correlation ID of the request.
+	// It is passed to the upstream registries, so that their requests can be
+	// matched with the requests to the registry.
+	RequestIDHeader = "X-Request-Id"
 )
 
 type requestTracer struct {
@@ -35,6 +40,9 @@ func (rt *requestTracer) ModifyRequest(req *http.Request) (err error) {
 			}
 			req.Header.Add(requestHeader, k)
 		}
+		if id := rt.req.Header.Get(RequestIDHeader); id != "" {
+			req.Header.Set(RequestIDHeader, id)
+		}
 	}
 	req.Header.Add(requestHeader, req.URL.String())
 	return
@@ -73,3 +73,25 @@ func TestLoopRequests(t *testing.T) {
 		req = newReq
 	}
 }
+
+func TestRequestID(t *testing.T) {
+	ctx := context.Background()
+	ctx = testutil.WithTestLogger(ctx, t)
+
+	req, err := http.NewRequest("GET", "https://registry.local/v2/app/manifests/latest", nil)
+	if err != nil {
+		t.Fatalf("unable to make new request: %v", err)
+	}
+	req.Header.Set(requesttrace.RequestIDHeader, "req-1")
+
+	upstreamReq, err := http.NewRequest("GET", "https://docker.io/v2/app/manifests/latest", nil)
+	if err != nil {
+		t.Fatalf("unable to make new request: %v", err)
+	}
+	if err := requesttrace.New(ctx, req).ModifyRequest(upstreamReq); err != nil {
+		t.Fatalf("unable to modify request: %v", err)
+	}
+	if id := upstreamReq.Header.Get(requesttrace.RequestIDHeader); id != "req-1" {
+		t.Errorf("got request id %q, want %q", id, "req-1")
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"path"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -209,7 +210,16 @@ func MakeDockerConfigSecret(name string, config *DockerConfig) (*corev1.Secret,
 
 type CleanupFunc func()
 
+// CreateEphemeralRegistry runs the distribution registry 2.x in the namespace
+// and exposes it by a route. The registry authenticates the accounts if they
+// are not nil. It returns the host of the route and the name of the pod.
 func CreateEphemeralRegistry(t *testing.T, restConfig *rest.Config, namespace string, accounts map[string]string) (string, string, CleanupFunc) {
+	return CreateEphemeralRegistryOf(t, restConfig, namespace, DistributionV2, accounts)
+}
+
+// CreateEphemeralRegistryOf is like CreateEphemeralRegistry, but it runs the
+// registry implementation impl.
+func CreateEphemeralRegistryOf(t *testing.T, restConfig *rest.Config, namespace string, impl RegistryImplementation, accounts map[string]string) (string, string, CleanupFunc) {
 	ctx := context.Background()
 
 	kubeClient, err := kubeclient.NewForConfig(restConfig)
@@ -232,9 +242,8 @@ func CreateEphemeralRegistry(t *testing.T, restConfig *rest.Config, namespace st
 		t.Logf("deleted ephemeral registry %s", name)
 	}
 
-	var volumes []corev1.Volume
-	var mounts []corev1.VolumeMount
-	var env []corev1.EnvVar
+	var htpasswd []byte
+	var htpasswdPath string
 	if accounts != nil {
 		var b bytes.Buffer
 		for user, password := range accounts {
@@ -244,14 +253,38 @@ func CreateEphemeralRegistry(t *testing.T, restConfig *rest.Config, namespace st
 			}
 			fmt.Fprintf(&b, "%s:%s\n", user, hash)
 		}
+		htpasswd = b.Bytes()
+		htpasswdPath = path.Join(ephemeralRegistryConfigDir, "htpasswd")
+	}
 
+	files, env, args := impl.configure(htpasswdPath)
+	if htpasswd != nil {
+		if files == nil {
+			files = map[string][]byte{}
+		}
+		files["htpasswd"] = htpasswd
+	}
+
+	volumes := []corev1.Volume{
+		{
+			Name: "storage",
+			VolumeSource: corev1.VolumeSource{
+				EmptyDir: &corev1.EmptyDirVolumeSource{},
+			},
+		},
+	}
+	mounts := []corev1.VolumeMount{
+		{
+			Name:      "storage",
+			MountPath: "/var/lib/registry",
+		},
+	}
+	if len(files) > 0 {
 		secret := &corev1.Secret{
 			ObjectMeta: metav1.ObjectMeta{
 				Name: name,
 			},
-			Data: map[string][]byte{
-				"htpasswd": b.Bytes(),
-			},
+			Data: files,
 		}
 
 		_, err = kubeClient.CoreV1().Secrets(namespace).Create(ctx, secret, metav1.CreateOptions{})
@@ -266,7 +299,7 @@ func CreateEphemeralRegistry(t *testing.T, restConfig *rest.Config, namespace st
 		})
 
 		volumes = append(volumes, corev1.Volume{
-			Name: "auth",
+			Name: "config",
 			VolumeSource: corev1.VolumeSource{
 				Secret: &corev1.SecretVolumeSource{
 					SecretName: name,
@@ -274,24 +307,9 @@ func CreateEphemeralRegistry(t *testing.T, restConfig *rest.Config, namespace st
 			},
 		})
 		mounts = append(mounts, corev1.VolumeMount{
-			Name:      "auth",
-			MountPath: "/auth",
+			Name:      "config",
+			MountPath: ephemeralRegistryConfigDir,
 		})
-		env = append(
-			env,
-			corev1.EnvVar{
-				Name:  "REGISTRY_AUTH",
-				Value: "htpasswd",
-			},
-			corev1.EnvVar{
-				Name:  "REGISTRY_AUTH_HTPASSWD_REALM",
-				Value: "Registry",
-			},
-			corev1.EnvVar{
-				Name:  "REGISTRY_AUTH_HTPASSWD_PATH",
-				Value: "/auth/htpasswd",
-			},
-		)
 	}
 
 	falseVal := false
@@ -308,7 +326,8 @@ func CreateEphemeralRegistry(t *testing.T, restConfig *rest.Config, namespace st
 			Containers: []corev1.Container{
 				{
 					Name:  "registry",
-					Image: "docker.io/library/registry:2.7.1",
+					Image: impl.Image,
+					Args:  args,
 					Ports: []corev1.ContainerPort{
 						{
 							ContainerPort: 5000,
@@ -323,20 +342,10 @@ func CreateEphemeralRegistry(t *testing.T, restConfig *rest.Config, namespace st
 					},
 					VolumeMounts: mounts,
 					LivenessProbe: &corev1.Probe{
-						ProbeHandler: corev1.ProbeHandler{
-							HTTPGet: &corev1.HTTPGetAction{
-								Path: "/",
-								Port: intstr.FromInt(5000),
-							},
-						},
+						ProbeHandler: impl.probe,
 					},
 					ReadinessProbe: &corev1.Probe{
-						ProbeHandler: corev1.ProbeHandler{
-							HTTPGet: &corev1.HTTPGetAction{
-								Path: "/",
-								Port: intstr.FromInt(5000),
-							},
-						},
+						ProbeHandler: impl.probe,
 					},
 					TerminationMessagePolicy: corev1.TerminationMessageFallbackToLogsOnError,
 					SecurityContext: &corev1.SecurityContext{
@@ -502,7 +511,7 @@ func CreateEphemeralRegistry(t *testing.T, restConfig *rest.Config, namespace st
 		t.Fatalf("failed to wait until route %s is ready: %v", name, lastErr)
 	}
 
-	t.Logf("created ephemeral registry: %s (%s)", host, name)
+	t.Logf("created ephemeral registry %s: %s (%s)", impl.Name, host, name)
 	return host, name, cleanup
 }
 
@@ -0,0 +1,165 @@
+package testframework
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// ephemeralRegistryConfigDir is the directory where the configuration files
+// of ephemeral registries are mounted.
+const ephemeralRegistryConfigDir = "/etc/ephemeral-registry"
+
+// RegistryImplementation is an implementation of the registry API that can be
+// run as an ephemeral registry, so that the interoperability with upstream
+// registries other than the distribution registry can be tested.
+//
+// Quay isn't provided as it cannot run without a database and Redis.
+type RegistryImplementation struct {
+	// Name identifies the implementation in test names and in the
+	// TEST_EXTERNAL_REGISTRIES environment variable.
+	Name string
+
+	// Image is the container image of the registry.
+	Image string
+
+	// configure returns the configuration files, the environment variables
+	// and the arguments of the registry. htpasswd is the path to the
+	// htpasswd file of the registry, or empty if the registry doesn't
+	// authenticate clients.
+	configure func(htpasswd string) (files map[string][]byte, env []corev1.EnvVar, args []string)
+
+	// probe checks that the registry is ready.
+	probe corev1.ProbeHandler
+}
+
+func distributionConfiguration(htpasswd string) (map[string][]byte, []corev1.EnvVar, []string) {
+	if len(htpasswd) == 0 {
+		return nil, nil, nil
+	}
+	env := []corev1.EnvVar{
+		{
+			Name:  "REGISTRY_AUTH",
+			Value: "htpasswd",
+		},
+		{
+			Name:  "REGISTRY_AUTH_HTPASSWD_REALM",
+			Value: "Registry",
+		},
+		{
+			Name:  "REGISTRY_AUTH_HTPASSWD_PATH",
+			Value: htpasswd,
+		},
+	}
+	return nil, env, nil
+}
+
+var (
+	// DistributionV2 is the distribution registry 2.x, the upstream that is
+	// used by default.
+	DistributionV2 = RegistryImplementation{
+		Name:      "distribution-v2",
+		Image:     "docker.io/library/registry:2.7.1",
+		configure: distributionConfiguration,
+		probe: corev1.ProbeHandler{
+			HTTPGet: &corev1.HTTPGetAction{
+				Path: "/",
+				Port: intstr.FromInt(5000),
+			},
+		},
+	}
+
+	// DistributionV3 is the distribution registry 3.x.
+	DistributionV3 = RegistryImplementation{
+		Name:      "distribution-v3",
+		Image:     "docker.io/library/registry:3.0.0",
+		configure: distributionConfiguration,
+		probe: corev1.ProbeHandler{
+			HTTPGet: &corev1.HTTPGetAction{
+				Path: "/",
+				Port: intstr.FromInt(5000),
+			},
+		},
+	}
+
+	// Zot is the zot registry. It responds with other auth challenges than
+	// the distribution registry and stores the images as OCI images.
+	Zot = RegistryImplementation{
+		Name:  "zot",
+		Image: "ghcr.io/project-zot/zot:v2.1.2",
+		configure: func(htpasswd string) (map[string][]byte, []corev1.EnvVar, []string) {
+			config := map[string]interface{}{
+				"distSpecVersion": "1.1.0",
+				"storage": map[string]interface{}{
+					"rootDirectory": "/var/lib/registry",
+				},
+				"http": map[string]interface{}{
+					"address": "0.0.0.0",
+					"port":    "5000",
+					// The test images are Docker images.
+					"compat": []string{"docker2s2"},
+				},
+				"log": map[string]interface{}{
+					"level": "info",
+				},
+			}
+			if len(htpasswd) > 0 {
+				config["http"].(map[string]interface{})["auth"] = map[string]interface{}{
+					"htpasswd": map[string]interface{}{
+						"path": htpasswd,
+					},
+				}
+			}
+			data, err := json.Marshal(config)
+			if err != nil {
+				panic(err)
+			}
+			files := map[string][]byte{
+				"config.json": data,
+			}
+			return files, nil, []string{"serve", path.Join(ephemeralRegistryConfigDir, "config.json")}
+		},
+		probe: corev1.ProbeHandler{
+			TCPSocket: &corev1.TCPSocketAction{
+				Port: intstr.FromInt(5000),
+			},
+		},
+	}
+)
+
+// RegistryImplementations returns the implementations that the tests of the
+// interoperability with upstream registries should be run against. It is the
+// distribution registry 2.x and the implementations listed in the
+// comma-separated environment variable TEST_EXTERNAL_REGISTRIES, or all of
+// them if it is "all".
+func RegistryImplementations(t *testing.T) []RegistryImplementation {
+	impls := []RegistryImplementation{DistributionV2}
+
+	external := []RegistryImplementation{DistributionV3, Zot}
+	for _, name := range strings.Split(os.Getenv("TEST_EXTERNAL_REGISTRIES"), ",") {
+		name = strings.TrimSpace(name)
+		if len(name) == 0 {
+			continue
+		}
+		if name == "all" {
+			return append(impls, external...)
+		}
+		found := false
+		for _, impl := range external {
+			if impl.Name == name {
+				impls = append(impls, impl)
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Fatalf("unknown registry implementation %q in TEST_EXTERNAL_REGISTRIES", name)
+		}
+	}
+	return impls
+}
@@ -0,0 +1,289 @@
+package testutil
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/manifest/schema1"
+	"github.com/opencontainers/go-digest"
+)
+
+// BlobContents maps blob digests to their content.
+type BlobContents map[digest.Digest][]byte
+
+// BlobDescriptors maps blob digests to their descriptors.
+type BlobDescriptors map[digest.Digest]distribution.Descriptor
+
+// FakeBlobStore is an in-memory distribution.BlobStore that counts the calls
+// of its methods. It is safe for concurrent use.
+type FakeBlobStore struct {
+	mu sync.Mutex
+
+	descriptors BlobDescriptors
+	blobs       BlobContents
+
+	// calls maps method names to the number of invocations.
+	calls map[string]int
+	// errors maps method names to the errors they return.
+	errors      map[string]error
+	bytesServed int64
+}
+
+var _ distribution.BlobStore = &FakeBlobStore{}
+
+// NewFakeBlobStore returns a blob store with copies of descriptors and blobs.
+// Stat returns the descriptor of a blob if there is one, otherwise it is
+// made from the content of the blob.
+func NewFakeBlobStore(descriptors BlobDescriptors, blobs BlobContents) *FakeBlobStore {
+	bs := &FakeBlobStore{
+		descriptors: make(BlobDescriptors),
+		blobs:       make(BlobContents),
+		calls:       make(map[string]int),
+		errors:      make(map[string]error),
+	}
+	for dgst, desc := range descriptors {
+		bs.descriptors[dgst] = desc
+	}
+	for dgst, content := range blobs {
+		bs.blobs[dgst] = content
+	}
+	return bs
+}
+
+// Calls returns the number of invocations of method. The methods of the
+// readers returned by Open are counted as ReadSeekCloser.Read,
+// ReadSeekCloser.Seek and ReadSeekCloser.Close.
+func (bs *FakeBlobStore) Calls(method string) int {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	return bs.calls[method]
+}
+
+// BytesServed returns the number of bytes sent by ServeBlob and read from
+// the readers returned by Open.
+func (bs *FakeBlobStore) BytesServed() int64 {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	return bs.bytesServed
+}
+
+// CallCounts returns the number of invocations of every called method.
+func (bs *FakeBlobStore) CallCounts() map[string]int {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	calls := make(map[string]int, len(bs.calls))
+	for method, n := range bs.calls {
+		calls[method] = n
+	}
+	return calls
+}
+
+// SetError makes method return err. A nil err removes the injected error.
+func (bs *FakeBlobStore) SetError(method string, err error) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if err == nil {
+		delete(bs.errors, method)
+		return
+	}
+	bs.errors[method] = err
+}
+
+// call records the invocation of method and returns its injected error. The
+// caller must hold bs.mu.
+func (bs *FakeBlobStore) call(method string) error {
+	bs.calls[method]++
+	return bs.errors[method]
+}
+
+func (bs *FakeBlobStore) Stat(ctx context.Context, dgst digest.Digest) (distribution.Descriptor, error) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if err := bs.call("Stat"); err != nil {
+		return distribution.Descriptor{}, err
+	}
+
+	if desc, ok := bs.descriptors[dgst]; ok {
+		return desc, nil
+	}
+	content, ok := bs.blobs[dgst]
+	if !ok {
+		return distribution.Descriptor{}, distribution.ErrBlobUnknown
+	}
+	return distribution.Descriptor{
+		MediaType: schema1.MediaTypeManifestLayer,
+		Size:      int64(len(content)),
+		Digest:    digest.FromBytes(content),
+	}, nil
+}
+
+func (bs *FakeBlobStore) Get(ctx context.Context, dgst digest.Digest) ([]byte, error) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if err := bs.call("Get"); err != nil {
+		return nil, err
+	}
+
+	content, ok := bs.blobs[dgst]
+	if !ok {
+		return nil, distribution.ErrBlobUnknown
+	}
+	return content, nil
+}
+
+func (bs *FakeBlobStore) Open(ctx context.Context, dgst digest.Digest) (distribution.ReadSeekCloser, error) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if err := bs.call("Open"); err != nil {
+		return nil, err
+	}
+
+	content, ok := bs.blobs[dgst]
+	if !ok {
+		return nil, distribution.ErrBlobUnknown
+	}
+	return &fakeBlobReader{
+		bs:      bs,
+		content: content,
+	}, nil
+}
+
+// Put stores the content p.
+func (bs *FakeBlobStore) Put(ctx context.Context, mediaType string, p []byte) (distribution.Descriptor, error) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if err := bs.call("Put"); err != nil {
+		return distribution.Descriptor{}, err
+	}
+
+	dgst := digest.FromBytes(p)
+	bs.blobs[dgst] = p
+	return distribution.Descriptor{
+		MediaType: mediaType,
+		Size:      int64(len(p)),
+		Digest:    dgst,
+	}, nil
+}
+
+// Create is not implemented.
+func (bs *FakeBlobStore) Create(ctx context.Context, options ...distribution.BlobCreateOption) (distribution.BlobWriter, error) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if err := bs.call("Create"); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("method not implemented")
+}
+
+// Resume is not implemented.
+func (bs *FakeBlobStore) Resume(ctx context.Context, id string) (distribution.BlobWriter, error) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if err := bs.call("Resume"); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("method not implemented")
+}
+
+func (bs *FakeBlobStore) ServeBlob(ctx context.Context, w http.ResponseWriter, req *http.Request, dgst digest.Digest) error {
+	bs.mu.Lock()
+	err := bs.call("ServeBlob")
+	content, ok := bs.blobs[dgst]
+	bs.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return distribution.ErrBlobUnknown
+	}
+
+	reader := bytes.NewReader(content)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Docker-Content-Digest", dgst.String())
+	w.Header().Set("Etag", dgst.String())
+	http.ServeContent(w, req, dgst.String(), time.Time{}, reader)
+	n, err := reader.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	bs.mu.Lock()
+	bs.bytesServed = n
+	bs.mu.Unlock()
+	return nil
+}
+
+func (bs *FakeBlobStore) Delete(ctx context.Context, dgst digest.Digest) error {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if err := bs.call("Delete"); err != nil {
+		return err
+	}
+
+	_, ok := bs.blobs[dgst]
+	if !ok {
+		return distribution.ErrBlobUnknown
+	}
+	delete(bs.blobs, dgst)
+	delete(bs.descriptors, dgst)
+	return nil
+}
+
+type fakeBlobReader struct {
+	bs      *FakeBlobStore
+	content []byte
+	offset  int64
+}
+
+var _ distribution.ReadSeekCloser = &fakeBlobReader{}
+
+func (r *fakeBlobReader) Read(p []byte) (int, error) {
+	r.bs.mu.Lock()
+	defer r.bs.mu.Unlock()
+	if err := r.bs.call("ReadSeekCloser.Read"); err != nil {
+		return 0, err
+	}
+
+	if r.offset >= int64(len(r.content)) {
+		return 0, io.EOF
+	}
+	n := copy(p, r.content[r.offset:])
+	r.offset += int64(n)
+	r.bs.bytesServed += int64(n)
+	return n, nil
+}
+
+func (r *fakeBlobReader) Seek(offset int64, whence int) (int64, error) {
+	r.bs.mu.Lock()
+	defer r.bs.mu.Unlock()
+	if err := r.bs.call("ReadSeekCloser.Seek"); err != nil {
+		return r.offset, err
+	}
+
+	newOffset := r.offset
+	switch whence {
+	case io.SeekCurrent:
+		newOffset += offset
+	case io.SeekEnd:
+		newOffset = int64(len(r.content)) + offset
+	case io.SeekStart:
+		newOffset = offset
+	}
+	if newOffset < 0 {
+		return r.offset, fmt.Errorf("cannot seek to negative position")
+	}
+	r.offset = newOffset
+	return r.offset, nil
+}
+
+func (r *fakeBlobReader) Close() error {
+	r.bs.mu.Lock()
+	defer r.bs.mu.Unlock()
+	return r.bs.call("ReadSeekCloser.Close")
+}
@@ -0,0 +1,137 @@
+package testutil
+
+import (
+	"context"
+	"sync"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/opencontainers/go-digest"
+)
+
+// FakeManifestService is an in-memory distribution.ManifestService that
+// counts the calls of its methods. It is safe for concurrent use.
+type FakeManifestService struct {
+	mu sync.Mutex
+
+	name string
+	data map[digest.Digest]distribution.Manifest
+
+	// calls maps method names to the number of invocations.
+	calls map[string]int
+	// errors maps method names to the errors they return.
+	errors map[string]error
+}
+
+var _ distribution.ManifestService = &FakeManifestService{}
+
+// NewFakeManifestService returns a manifest service for the repository name
+// with a copy of data.
+func NewFakeManifestService(name string, data map[digest.Digest]distribution.Manifest) *FakeManifestService {
+	ms := &FakeManifestService{
+		name:   name,
+		data:   make(map[digest.Digest]distribution.Manifest),
+		calls:  make(map[string]int),
+		errors: make(map[string]error),
+	}
+	for dgst, manifest := range data {
+		ms.data[dgst] = manifest
+	}
+	return ms
+}
+
+// Calls returns the number of invocations of method.
+func (ms *FakeManifestService) Calls(method string) int {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.calls[method]
+}
+
+// CallCounts returns the number of invocations of every called method.
+func (ms *FakeManifestService) CallCounts() map[string]int {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	calls := make(map[string]int, len(ms.calls))
+	for method, n := range ms.calls {
+		calls[method] = n
+	}
+	return calls
+}
+
+// SetError makes method return err. A nil err removes the injected error.
+func (ms *FakeManifestService) SetError(method string, err error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if err == nil {
+		delete(ms.errors, method)
+		return
+	}
+	ms.errors[method] = err
+}
+
+// call records the invocation of method and returns its injected error. The
+// caller must hold ms.mu.
+func (ms *FakeManifestService) call(method string) error {
+	ms.calls[method]++
+	return ms.errors[method]
+}
+
+func (ms *FakeManifestService) Exists(ctx context.Context, dgst digest.Digest) (bool, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if err := ms.call("Exists"); err != nil {
+		return false, err
+	}
+
+	_, ok := ms.data[dgst]
+	return ok, nil
+}
+
+func (ms *FakeManifestService) Get(ctx context.Context, dgst digest.Digest, options ...distribution.ManifestServiceOption) (distribution.Manifest, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if err := ms.call("Get"); err != nil {
+		return nil, err
+	}
+
+	manifest, ok := ms.data[dgst]
+	if !ok {
+		return nil, distribution.ErrManifestUnknownRevision{
+			Name:     ms.name,
+			Revision: dgst,
+		}
+	}
+	return manifest, nil
+}
+
+func (ms *FakeManifestService) Put(ctx context.Context, manifest distribution.Manifest, options ...distribution.ManifestServiceOption) (digest.Digest, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if err := ms.call("Put"); err != nil {
+		return "", err
+	}
+
+	_, payload, err := manifest.Payload()
+	if err != nil {
+		return "", err
+	}
+	dgst := digest.FromBytes(payload)
+	ms.data[dgst] = manifest
+	return dgst, nil
+}
+
+func (ms *FakeManifestService) Delete(ctx context.Context, dgst digest.Digest) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if err := ms.call("Delete"); err != nil {
+		return err
+	}
+
+	if _, ok := ms.data[dgst]; !ok {
+		return distribution.ErrManifestUnknownRevision{
+			Name:     ms.name,
+			Revision: dgst,
+		}
+	}
+	delete(ms.data, dgst)
+	return nil
+}
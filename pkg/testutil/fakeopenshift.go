@@ -138,6 +138,21 @@ func (fos *FakeOpenShift) UpdateImage(image *imageapiv1.Image) (*imageapiv1.Imag
 	return image, nil
 }
 
+func (fos *FakeOpenShift) DeleteImage(name string) error {
+	fos.mu.Lock()
+	defer fos.mu.Unlock()
+
+	_, ok := fos.images[name]
+	if !ok {
+		return errors.NewNotFound(imageapiv1.Resource("images"), name)
+	}
+
+	delete(fos.images, name)
+	fos.logger.Debugf("(*FakeOpenShift).images[%q] deleted", name)
+
+	return nil
+}
+
 func (fos *FakeOpenShift) CreateImageStream(namespace string, is *imageapiv1.ImageStream) (*imageapiv1.ImageStream, error) {
 	fos.mu.Lock()
 	defer fos.mu.Unlock()
@@ -530,6 +545,8 @@ func (fos *FakeOpenShift) imagesHandler(action clientgotesting.Action) (bool, ru
 					action.Object.(*imageapiv1.Image),
 				)
 				return true, image, err
+			case clientgotesting.DeleteActionImpl:
+				return true, nil, fos.DeleteImage(action.Name)
 			}
 			return fos.todo(action)
 		},
@@ -0,0 +1,154 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/openshift/image-registry/pkg/testframework"
+	"github.com/openshift/image-registry/pkg/testutil"
+)
+
+// ociErrorCodes are the error codes defined by the OCI distribution
+// specification.
+var ociErrorCodes = map[string]bool{
+	"BLOB_UNKNOWN":          true,
+	"BLOB_UPLOAD_INVALID":   true,
+	"BLOB_UPLOAD_UNKNOWN":   true,
+	"DIGEST_INVALID":        true,
+	"MANIFEST_BLOB_UNKNOWN": true,
+	"MANIFEST_INVALID":      true,
+	"MANIFEST_UNKNOWN":      true,
+	"NAME_INVALID":          true,
+	"NAME_UNKNOWN":          true,
+	"SIZE_INVALID":          true,
+	"UNAUTHORIZED":          true,
+	"DENIED":                true,
+	"UNSUPPORTED":           true,
+	"TOOMANYREQUESTS":       true,
+}
+
+func TestOCIErrorCodes(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	master := testframework.NewMaster(t)
+	defer master.Close()
+	registry := master.StartRegistry(t)
+	defer registry.Close()
+
+	namespace := "oci-errors-integration-test"
+	isname := "imagestream"
+	testuser := master.CreateUser("testuser", "testp@ssw0rd")
+	proj := master.CreateProject(namespace, testuser.Name)
+	repoName := fmt.Sprintf("%s/%s", proj.Name, isname)
+
+	regURL, err := url.Parse(registry.BaseURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, _, _, err = testutil.CreateAndUploadTestManifest(
+		ctx,
+		testutil.ManifestSchemaOCI,
+		1,
+		regURL,
+		testutil.NewBasicCredentialStore(testuser.Name, testuser.Token),
+		repoName,
+		"latest",
+	)
+	if err != nil {
+		t.Fatalf("error uploading manifest: %s", err)
+	}
+
+	for _, tc := range []struct {
+		name       string
+		method     string
+		path       string
+		anonymous  bool
+		wantStatus int
+		wantCode   string
+	}{
+		{
+			name:       "unknown tag",
+			method:     http.MethodGet,
+			path:       "/v2/" + repoName + "/manifests/unknown",
+			wantStatus: http.StatusNotFound,
+			wantCode:   "MANIFEST_UNKNOWN",
+		},
+		{
+			name:       "unknown blob",
+			method:     http.MethodGet,
+			path:       "/v2/" + repoName + "/blobs/sha256:4355a46b19d348dc2f57c046f8ef63d4538ebb936000f3c9ee954a27460dd865",
+			wantStatus: http.StatusNotFound,
+			wantCode:   "BLOB_UNKNOWN",
+		},
+		{
+			name:       "unknown upload",
+			method:     http.MethodGet,
+			path:       "/v2/" + repoName + "/blobs/uploads/00000000-0000-0000-0000-000000000000",
+			wantStatus: http.StatusNotFound,
+			wantCode:   "BLOB_UPLOAD_UNKNOWN",
+		},
+		{
+			name:       "invalid pagination",
+			method:     http.MethodGet,
+			path:       "/v2/" + repoName + "/tags/list?n=invalid",
+			wantStatus: http.StatusBadRequest,
+			wantCode:   "UNSUPPORTED",
+		},
+		{
+			name:       "anonymous",
+			method:     http.MethodGet,
+			path:       "/v2/" + repoName + "/manifests/latest",
+			anonymous:  true,
+			wantStatus: http.StatusUnauthorized,
+			wantCode:   "UNAUTHORIZED",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequestWithContext(ctx, tc.method, registry.BaseURL()+tc.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tc.anonymous {
+				req.SetBasicAuth(testuser.Name, testuser.Token)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tc.wantStatus {
+				t.Errorf("got status %d, want %d", resp.StatusCode, tc.wantStatus)
+			}
+
+			var envelope struct {
+				Errors []struct {
+					Code    string `json:"code"`
+					Message string `json:"message"`
+				} `json:"errors"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+				t.Fatalf("unable to decode the error response: %v", err)
+			}
+			if len(envelope.Errors) == 0 {
+				t.Fatal("expected at least one error")
+			}
+			for _, e := range envelope.Errors {
+				if !ociErrorCodes[e.Code] {
+					t.Errorf("error code %s is not defined by the OCI distribution specification", e.Code)
+				}
+			}
+			if envelope.Errors[0].Code != tc.wantCode {
+				t.Errorf("got error code %s, want %s", envelope.Errors[0].Code, tc.wantCode)
+			}
+		})
+	}
+}
@@ -87,6 +87,16 @@ func testPullThroughStatBlob(baseURL string, stream *imageapiv1.ImageStreamImpor
 }
 
 func TestPullThroughInsecure(t *testing.T) {
+	for _, impl := range testframework.RegistryImplementations(t) {
+		t.Run(impl.Name, func(t *testing.T) {
+			testPullThroughInsecure(t, impl)
+		})
+	}
+}
+
+// testPullThroughInsecure pulls images through an insecure upstream registry
+// served by impl.
+func testPullThroughInsecure(t *testing.T, impl testframework.RegistryImplementation) {
 	imageData, err := testframework.NewSchema2ImageData()
 	if err != nil {
 		t.Fatal(err)
@@ -105,7 +115,7 @@ func TestPullThroughInsecure(t *testing.T) {
 	master := testframework.NewMaster(t)
 	defer master.Close()
 
-	namespace := "image-registry-test-integration"
+	namespace := "image-registry-test-integration-" + impl.Name
 	testuser := master.CreateUser("testuser", "testp@ssw0rd")
 	master.CreateProject(namespace, testuser.Name)
 
@@ -124,7 +134,7 @@ func TestPullThroughInsecure(t *testing.T) {
 		imageSize += size
 	}
 
-	remoteRegistryAddr, _, _ := testframework.CreateEphemeralRegistry(t, master.AdminKubeConfig(), namespace, nil)
+	remoteRegistryAddr, _, _ := testframework.CreateEphemeralRegistryOf(t, master.AdminKubeConfig(), namespace, impl, nil)
 
 	remoteRepo, err := testutil.NewInsecureRepository(remoteRegistryAddr+"/"+isname, nil)
 	if err != nil {
@@ -282,10 +292,20 @@ func TestPullThroughInsecure(t *testing.T) {
 }
 
 func TestPullThroughICSP(t *testing.T) {
+	for _, impl := range testframework.RegistryImplementations(t) {
+		t.Run(impl.Name, func(t *testing.T) {
+			testPullThroughICSP(t, impl)
+		})
+	}
+}
+
+// testPullThroughICSP pulls images through the mirror of an ImageContentSourcePolicy
+// served by impl.
+func testPullThroughICSP(t *testing.T, impl testframework.RegistryImplementation) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
 	defer cancel()
 
-	namespace := "image-registry-test-integration-icsp"
+	namespace := "image-registry-test-integration-icsp-" + impl.Name
 	reponame := "testrepo"
 	repotag := "testtag"
 	isname := "test/" + reponame
@@ -310,8 +330,8 @@ func TestPullThroughICSP(t *testing.T) {
 		string(imageData.LayerDigest):  int64(len(imageData.Layer)),
 	}
 
-	remoteRegistryAddr, _, _ := testframework.CreateEphemeralRegistry(
-		t, master.AdminKubeConfig(), namespace, nil,
+	remoteRegistryAddr, _, _ := testframework.CreateEphemeralRegistryOf(
+		t, master.AdminKubeConfig(), namespace, impl, nil,
 	)
 
 	remoteRepo, err := testutil.NewInsecureRepository(remoteRegistryAddr+"/"+isname, nil)
@@ -457,10 +477,20 @@ func TestPullThroughICSP(t *testing.T) {
 }
 
 func TestPullThroughIDMS(t *testing.T) {
+	for _, impl := range testframework.RegistryImplementations(t) {
+		t.Run(impl.Name, func(t *testing.T) {
+			testPullThroughIDMS(t, impl)
+		})
+	}
+}
+
+// testPullThroughIDMS pulls images through the mirror of an ImageDigestMirrorSet
+// served by impl.
+func testPullThroughIDMS(t *testing.T, impl testframework.RegistryImplementation) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
 	defer cancel()
 
-	namespace := "image-registry-test-integration-idms"
+	namespace := "image-registry-test-integration-idms-" + impl.Name
 	reponame := "testrepo"
 	repotag := "testtag"
 	isname := "test/" + reponame
@@ -485,8 +515,8 @@ func TestPullThroughIDMS(t *testing.T) {
 		string(imageData.LayerDigest):  int64(len(imageData.Layer)),
 	}
 
-	remoteRegistryAddr, _, _ := testframework.CreateEphemeralRegistry(
-		t, master.AdminKubeConfig(), namespace, nil,
+	remoteRegistryAddr, _, _ := testframework.CreateEphemeralRegistryOf(
+		t, master.AdminKubeConfig(), namespace, impl, nil,
 	)
 
 	remoteRepo, err := testutil.NewInsecureRepository(remoteRegistryAddr+"/"+isname, nil)
@@ -632,10 +662,20 @@ func TestPullThroughIDMS(t *testing.T) {
 }
 
 func TestPullThroughITMS(t *testing.T) {
+	for _, impl := range testframework.RegistryImplementations(t) {
+		t.Run(impl.Name, func(t *testing.T) {
+			testPullThroughITMS(t, impl)
+		})
+	}
+}
+
+// testPullThroughITMS pulls images through the mirror of an ImageTagMirrorSet
+// served by impl.
+func testPullThroughITMS(t *testing.T, impl testframework.RegistryImplementation) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
 	defer cancel()
 
-	namespace := "image-registry-test-integration-itms"
+	namespace := "image-registry-test-integration-itms-" + impl.Name
 	reponame := "testrepo"
 	repotag := "testtag"
 	isname := "test/" + reponame
@@ -660,8 +700,8 @@ func TestPullThroughITMS(t *testing.T) {
 		string(imageData.LayerDigest):  int64(len(imageData.Layer)),
 	}
 
-	remoteRegistryAddr, _, _ := testframework.CreateEphemeralRegistry(
-		t, master.AdminKubeConfig(), namespace, nil,
+	remoteRegistryAddr, _, _ := testframework.CreateEphemeralRegistryOf(
+		t, master.AdminKubeConfig(), namespace, impl, nil,
 	)
 
 	remoteRepo, err := testutil.NewInsecureRepository(remoteRegistryAddr+"/"+isname, nil)